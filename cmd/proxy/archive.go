@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/gitcmd"
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+const archiveUsage = `usage:
+  smart-git-proxy export <archive> [config flags]
+  smart-git-proxy import [-force] <archive> [config flags]
+
+export writes the mirror dir to a tar archive, import extracts one into the
+mirror dir of a proxy to seed it. Run both with the proxy stopped.
+`
+
+// runArchive runs the export and import subcommands, copying mirrors between
+// the mirror dir and a tar archive, and returns the exit code.
+func runArchive(cmd string, args []string) int {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, archiveUsage) }
+	force := false
+	if cmd == "import" {
+		fs.BoolVar(&force, "force", false, "import into a mirror dir that already has mirrors, replacing those also in the archive")
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return 2
+	}
+	archive := fs.Arg(0)
+	cfg, err := config.LoadArgs(fs.Args()[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config error: %v\n", err)
+		return 2
+	}
+	gitcmd.Configure(cfg.GitBinary, cfg.GitEnv)
+
+	if cmd == "export" {
+		f, err := os.Create(archive)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "export failed: %v\n", err)
+			return 1
+		}
+		n, err := mirror.Export(cfg.MirrorDir, f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "export failed: %v\n", err)
+			return 1
+		}
+		fmt.Printf("exported %d mirrors from %s to %s\n", n, cfg.MirrorDir, archive)
+		return 0
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import failed: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	imported, err := mirror.Import(ctx, cfg.MirrorDir, f, force)
+	if len(imported) > 0 || err == nil {
+		fmt.Printf("imported %d mirrors from %s to %s\n", len(imported), archive, cfg.MirrorDir)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import failed: %v\n", err)
+		if errors.Is(err, mirror.ErrNotEmpty) {
+			fmt.Fprintln(os.Stderr, "use -force to import into a mirror dir that already has mirrors")
+		}
+		return 1
+	}
+	return 0
+}
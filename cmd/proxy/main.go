@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -13,25 +16,62 @@ import (
 
 	"github.com/crohr/smart-git-proxy/internal/cloudmap"
 	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/gitcmd"
 	"github.com/crohr/smart-git-proxy/internal/gitproxy"
 	"github.com/crohr/smart-git-proxy/internal/logging"
 	"github.com/crohr/smart-git-proxy/internal/metrics"
 	"github.com/crohr/smart-git-proxy/internal/mirror"
 	"github.com/crohr/smart-git-proxy/internal/route53"
+	"github.com/crohr/smart-git-proxy/internal/version"
 )
 
 func main() {
+	// Offline cache seeding: copy the mirror dir to or from an archive and exit
+	if len(os.Args) > 1 && (os.Args[1] == "export" || os.Args[1] == "import") {
+		os.Exit(runArchive(os.Args[1], os.Args[2:]))
+	}
+
 	cfg, err := config.Load()
 	if err != nil {
 		log.Fatalf("config error: %v", err)
 	}
+	gitcmd.Configure(cfg.GitBinary, cfg.GitEnv)
+
+	// Validation mode: check config against the environment and exit
+	if cfg.ValidateConfig {
+		if err := cfg.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "config invalid:\n%v\n", err)
+			os.Exit(1)
+		}
+		for _, w := range cfg.Warnings() {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+		}
+		fmt.Println("config ok")
+		return
+	}
 
 	logger, err := logging.New(cfg.LogLevel)
 	if err != nil {
 		log.Fatalf("logger init: %v", err)
 	}
+	build := version.Get()
+	logger.Info("starting smart-git-proxy", "version", build.Version, "commit", build.Commit, "date", build.Date, "go_version", build.GoVersion)
+
+	if err := cfg.Validate(); err != nil {
+		logger.Error("config invalid", "err", err)
+		os.Exit(1)
+	}
+	for _, w := range cfg.Warnings() {
+		logger.Warn("config warning", "warning", w)
+	}
 
-	mirrorStore, err := mirror.New(cfg.MirrorDir, cfg.SyncStaleAfter, cfg.MirrorMaxSize, cfg.UploadPackThreads, cfg.MaintainAfterSync, logger)
+	metricsRegistry := metrics.New(logger)
+
+	// One-shot maintenance runs alongside the instance serving the mirror roots
+	if cfg.MaintenanceRepo != "" {
+		cfg.CacheLock = "off"
+	}
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
 	if err != nil {
 		logger.Error("mirror init failed", "err", err)
 		os.Exit(1)
@@ -58,15 +98,30 @@ func main() {
 		return
 	}
 
-	metricsRegistry := metrics.New()
 	server := gitproxy.New(cfg, mirrorStore, logger, metricsRegistry)
 
+	evictCtx, stopEviction := context.WithCancel(context.Background())
+	defer stopEviction()
+	mirrorStore.StartEvictionLoop(evictCtx, cfg.EvictionInterval)
+	mirrorStore.StartVerifyLoop(evictCtx, cfg.VerifyInterval, cfg.VerifySampleRate)
+	mirrorStore.StartMaintenanceLoop(evictCtx, cfg.MaintenanceSchedule)
+	// Readiness waits on these, while the proxy already serves clients
+	go server.WarmBeforeReady(evictCtx)
+
 	mux := http.NewServeMux()
 	mux.Handle(cfg.HealthPath, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("ok\n"))
 	}))
-	mux.Handle(cfg.MetricsPath, promhttp.Handler())
+	mux.Handle(cfg.ReadyPath, server.ReadyHandler())
+	metricsHandler := server.MetricsHandler(promhttp.Handler())
+	if cfg.MetricsListenAddr == "" {
+		mux.Handle(cfg.MetricsPath, metricsHandler)
+	}
+	mux.HandleFunc("GET /version", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(build)
+	})
 	mux.Handle("/", server.Handler())
 
 	httpServer := &http.Server{
@@ -75,14 +130,72 @@ func main() {
 		ReadHeaderTimeout: 15 * time.Second,
 	}
 
+	ln, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		logger.Error("listen failed", "addr", cfg.ListenAddr, "err", err)
+		os.Exit(1)
+	}
 	go func() {
-		logger.Info("listening", "addr", cfg.ListenAddr, "mirror_dir", cfg.MirrorDir, "allowed_upstreams", cfg.AllowedUpstreams, "sync_stale_after", cfg.SyncStaleAfter)
-		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Info("listening", "addr", cfg.ListenAddr, "mirror_dir", cfg.MirrorDir, "allowed_upstreams", cfg.AllowedUpstreams, "sync_stale_after", cfg.SyncStaleAfter, "max_connections", cfg.MaxConnections)
+		if err := httpServer.Serve(gitproxy.NewListener(ln, cfg, metricsRegistry)); err != nil && err != http.ErrServerClosed {
 			logger.Error("http server failed", "err", err)
 			os.Exit(1)
 		}
 	}()
 
+	// Legacy tooling may only speak git://
+	var daemonLn net.Listener
+	if cfg.EnableGitDaemon {
+		daemonLn, err = net.Listen("tcp", cfg.GitDaemonListenAddr)
+		if err != nil {
+			logger.Error("git daemon listen failed", "addr", cfg.GitDaemonListenAddr, "err", err)
+			os.Exit(1)
+		}
+		go func() {
+			logger.Info("git daemon listening", "addr", cfg.GitDaemonListenAddr)
+			if err := server.ServeDaemon(daemonLn); err != nil {
+				logger.Error("git daemon failed", "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	// The admin API has no auth of its own, so it only listens where configured
+	var adminServer *http.Server
+	if cfg.AdminListenAddr != "" {
+		adminServer = &http.Server{
+			Addr:              cfg.AdminListenAddr,
+			Handler:           server.AdminHandler(),
+			ReadHeaderTimeout: 15 * time.Second,
+		}
+		go func() {
+			logger.Info("admin API listening", "addr", cfg.AdminListenAddr)
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("admin http server failed", "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	// Metrics on their own listener, e.g. for a network only scrapers reach
+	var metricsServer *http.Server
+	if cfg.MetricsListenAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle(cfg.MetricsPath, metricsHandler)
+		metricsServer = &http.Server{
+			Addr:              cfg.MetricsListenAddr,
+			Handler:           metricsMux,
+			ReadHeaderTimeout: 15 * time.Second,
+		}
+		go func() {
+			logger.Info("metrics listening", "addr", cfg.MetricsListenAddr)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("metrics http server failed", "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
 	// DNS registration (Route53 preferred, Cloud Map deprecated)
 	var cloudMapMgr *cloudmap.Manager
 	var route53Mgr *route53.Manager
@@ -112,9 +225,20 @@ func main() {
 		}
 	}
 
+	// SIGHUP reloads the settings that can change while serving; others need a restart
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigCh {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		next, err := config.Load()
+		if err != nil {
+			logger.Error("config reload failed, keeping current config", "err", err)
+			continue
+		}
+		server.Reload(next)
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
@@ -130,4 +254,21 @@ func main() {
 	if err := httpServer.Shutdown(ctx); err != nil {
 		logger.Error("graceful shutdown failed", "err", err)
 	}
+	if daemonLn != nil {
+		_ = daemonLn.Close()
+	}
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			logger.Error("admin graceful shutdown failed", "err", err)
+		}
+	}
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(ctx); err != nil {
+			logger.Error("metrics graceful shutdown failed", "err", err)
+		}
+	}
+	// Let the next instance have the mirror roots
+	if err := mirrorStore.Close(); err != nil {
+		logger.Error("releasing mirror roots failed", "err", err)
+	}
 }
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// HostAliases maps hosts clients may name in requests to the allowed upstream
+// host they stand for, e.g. www.github.com to github.com. Aliased requests
+// share the mirrors of that host and are fetched from it.
+type HostAliases map[string]string
+
+// Canonical returns the upstream host host stands for, or host itself if it
+// isn't an alias.
+func (a HostAliases) Canonical(host string) string {
+	if target, ok := a[host]; ok {
+		return target
+	}
+	return host
+}
+
+// parseHostAliases parses comma-separated alias=host pairs. Targets must be
+// allowed upstreams and aliases must not, so each request host has a single
+// meaning.
+func parseHostAliases(s string, allowed []string) (HostAliases, error) {
+	aliases := HostAliases{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		alias, host, ok := strings.Cut(pair, "=")
+		alias, host = strings.TrimSpace(alias), strings.TrimSpace(host)
+		if !ok || alias == "" || host == "" {
+			return nil, fmt.Errorf("expected alias=host, got %q", pair)
+		}
+		if err := validateUpstreamHost(alias); err != nil {
+			return nil, fmt.Errorf("invalid alias %q: expected a host name", alias)
+		}
+		if !slices.Contains(allowed, host) {
+			return nil, fmt.Errorf("host %s of alias %s is not an allowed upstream", host, alias)
+		}
+		if slices.Contains(allowed, alias) {
+			return nil, fmt.Errorf("alias %s is an allowed upstream itself", alias)
+		}
+		aliases[alias] = host
+	}
+	return aliases, nil
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ClientAuth holds the credentials clients must present to the proxy itself,
+// as opposed to AuthMode, which governs the credentials sent upstream, unless
+// the client's token maps to its own in UpstreamTokens.
+type ClientAuth struct {
+	Tokens         []string          // Accepted as bearer tokens, or as basic auth passwords with any user name
+	Users          map[string]string // Basic auth user name -> password
+	UpstreamTokens map[string]string // Token (also in Tokens) -> token sent upstream for its requests
+	Priorities     map[string]string // Token or user name -> priority (interactive or batch) of its upstream fetches
+}
+
+// Enabled reports whether clients must authenticate.
+func (a ClientAuth) Enabled() bool {
+	return len(a.Tokens) > 0 || len(a.Users) > 0
+}
+
+// parseClientAuth parses comma-separated tokens, user=password pairs,
+// token=upstream-token pairs and client=priority pairs. Tokens with an
+// upstream token are accepted too; priorities must name a token or user.
+func parseClientAuth(tokens, users, upstreamTokens, priorities string) (ClientAuth, error) {
+	var auth ClientAuth
+	for _, token := range strings.Split(tokens, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			auth.Tokens = append(auth.Tokens, token)
+		}
+	}
+	for _, pair := range strings.Split(upstreamTokens, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		token, upstream, ok := strings.Cut(pair, "=")
+		if !ok || token == "" || upstream == "" {
+			return ClientAuth{}, errors.New("invalid client auth upstream token (expected token=upstream-token)")
+		}
+		if auth.UpstreamTokens == nil {
+			auth.UpstreamTokens = map[string]string{}
+		}
+		if !slices.Contains(auth.Tokens, token) {
+			auth.Tokens = append(auth.Tokens, token)
+		}
+		auth.UpstreamTokens[token] = upstream
+	}
+	for _, pair := range strings.Split(users, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		user, password, ok := strings.Cut(pair, "=")
+		if !ok || user == "" || password == "" || strings.Contains(user, ":") {
+			return ClientAuth{}, fmt.Errorf("invalid client auth user %q (expected user=password, without : in the user name)", user)
+		}
+		if auth.Users == nil {
+			auth.Users = map[string]string{}
+		}
+		auth.Users[user] = password
+	}
+	for _, pair := range strings.Split(priorities, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		client, priority, ok := strings.Cut(pair, "=")
+		if !ok || client == "" {
+			return ClientAuth{}, errors.New("invalid client auth priority (expected client=priority)")
+		}
+		if priority != "interactive" && priority != "batch" {
+			return ClientAuth{}, fmt.Errorf("invalid client auth priority %q (expected interactive or batch)", priority)
+		}
+		if _, isUser := auth.Users[client]; !isUser && !slices.Contains(auth.Tokens, client) {
+			return ClientAuth{}, errors.New("invalid client auth priority: client is neither a client auth token nor user")
+		}
+		if auth.Priorities == nil {
+			auth.Priorities = map[string]string{}
+		}
+		auth.Priorities[client] = priority
+	}
+	return auth, nil
+}
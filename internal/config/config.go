@@ -5,30 +5,132 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 )
 
 type Config struct {
-	ListenAddr           string
-	MirrorDir            string
-	MirrorMaxSize        SizeSpec // Max size (absolute or %), zero means default 80%
-	SyncStaleAfter       time.Duration
-	AllowedUpstreams     []string
-	LogLevel             string
-	AuthMode             string
-	StaticToken          string
-	MetricsPath          string
-	HealthPath           string
-	AWSCloudMapServiceID string // If set, register with AWS Cloud Map and send heartbeats
-	Route53HostedZoneID  string // Route53 hosted zone ID for DNS registration
-	Route53RecordName    string // Route53 record name (e.g., git-proxy.example.com)
-	SerializeUploadPack  bool
-	UploadPackThreads    int
-	MaintainAfterSync    bool
-	MaintenanceRepo      string // If set, run maintenance on this repo (or "all") and exit
+	ConfigFile                string // Optional YAML config file; env and flags override its values
+	ListenAddr                string
+	AdminListenAddr           string // Separate listen address for the admin API, empty disables it
+	GitDaemonListenAddr       string // Listen address of the git:// daemon, with EnableGitDaemon
+	MirrorDir                 string
+	MirrorTempDir             string      // Fast local dir new mirrors are cloned into before moving into MirrorDir (fetches stay in place), empty means clone in place
+	MirrorExtraDirs           []string    // More mirror roots, e.g. on other volumes; new mirrors are spread across them and MirrorDir by hash
+	MirrorFollowSymlinks      bool        // Count what symlinks inside mirror roots point to in cache sizes; roots themselves are always resolved
+	GitBinary                 string      // git to run, a path or a name looked up in PATH
+	GitEnv                    []string    // KEY=VALUE variables set for every git command, e.g. GIT_CONFIG_GLOBAL for a custom config
+	MirrorMaxSize             SizeSpec    // Max size (absolute or % of disk), zero means default 80%
+	CacheDirMode              os.FileMode // Mode of directories created in the mirror dir, zero means 0755
+	CacheFileMode             os.FileMode // Mode of files in mirrors (via git's core.sharedRepository), zero leaves git's defaults
+	MinFreeSpace              SizeSpec    // Free disk space to always keep (absolute or % of disk), zero means default 1GiB
+	MaxRepoCount              int         // Most repos kept in each mirror dir, the coldest evicted past it, zero means no limit
+	CacheLock                 string      // When another instance holds a mirror root's lock: fail, warn or off (don't take it)
+	SyncStaleAfter            time.Duration
+	StaleWhileRevalidate      time.Duration // How long past SyncStaleAfter mirrors are served as is while synced in the background, zero disables
+	GitKilledBackoff          time.Duration // How long syncs of a mirror are held off after its git was killed by a signal, zero disables
+	EvictionFreezeFor         time.Duration // How long cold repos stay frozen (repacked for size) before eviction deletes them, zero deletes right away
+	MinAgeBeforeEvict         time.Duration // Repos created or refreshed from upstream more recently than this are never evicted, zero disables
+	EvictHighWatermark        float64       // Percentage of MirrorMaxSize above which eviction starts
+	EvictLowWatermark         float64       // Percentage of MirrorMaxSize eviction frees space down to
+	EvictionInterval          time.Duration // How often to check cache size and free disk space, zero disables
+	EvictionSizes             string        // How eviction measures the cache: walk it all, or sum the sizes recorded in mirror sidecars
+	CacheMaxAge               time.Duration // Mirrors not refreshed from upstream for this long are refreshed or purged, zero disables
+	VerifyInterval            time.Duration // How often to check a sample of mirrors against upstream
+	VerifySampleRate          float64       // Fraction of mirrors checked against upstream each VerifyInterval, zero disables
+	AllowedUpstreams          []string
+	AllowedServices           []string          // Git services clients may use: git-upload-pack, and git-receive-pack to pass pushes through
+	TrustedProxyCIDRs         []netip.Prefix    // Proxies whose X-Forwarded-* headers are honored
+	UpstreamHostOverrides     map[string]string // Upstream host -> IP to connect to, keeping the real hostname for TLS
+	UpstreamHostAliases       HostAliases       // Request host -> allowed upstream host it stands for, sharing its mirrors
+	KeepGitSuffixHosts        GitSuffixHosts    // Allowed upstream hosts where repo and repo.git are different repos
+	UpstreamResolver          string            // DNS server (host:port) used to resolve upstream hosts
+	UpstreamIPFamily          string            // ipv4 or ipv6 to only connect upstream over that family, empty for both
+	UpstreamFallbackDelay     time.Duration     // How long dual-stack connections wait on IPv6 before racing IPv4, zero for Go's default, negative disables
+	UpstreamSchemes           map[string]string // Upstream host -> transport mirrors are fetched with (https or ssh), https when unset
+	UpstreamFallbacks         Fallbacks         // Upstream host -> base URLs of mirrors of it, syncs fall back to in order when it fails
+	UpstreamQuotas            Quotas            // Upstream host -> what may be fetched from it per UpstreamQuotaWindow, unlimited when unset
+	UpstreamQuotaWindow       time.Duration     // Period UpstreamQuotas apply to, windows aligned on the Unix epoch (24h resets at midnight UTC)
+	UpstreamSSHUser           string            // User for SSH upstreams
+	UpstreamSSHKey            string            // Private key file for SSH upstreams, empty leaves key selection to ssh
+	UpstreamSSHKnownHosts     string            // known_hosts file SSH upstream host keys are checked against, empty uses ssh's defaults
+	UpstreamRewrites          Rewrites          // Map requested repo paths to different upstream paths, first match wins
+	AlternatesNetworks        Rewrites          // Map repo paths to the fork network whose object store they share, first match wins
+	MirrorRefspecs            MirrorRefspecs    // Restrict the refs mirrored for some repos, first match wins
+	DefaultBranch             string            // Branch mirrors' HEAD falls back to when upstream's HEAD is unknown or the mirror lacks its branch, empty disables
+	StripRefPatterns          []string          // Refs ("refs/x/y") or namespaces ("refs/x/*") never advertised to or fetchable by name by clients
+	UpstreamTracing           bool              // Record DNS, connect, TLS and first-byte times of upstream HTTP requests
+	FollowUpstreamRedirects   bool              // Mirror repos upstream redirects (e.g. renamed ones) under their new name; off, redirects fail
+	UpstreamTimeout           time.Duration     // Limit for git operations against upstream (clone, fetch, ls-remote), zero means none
+	UpstreamInfoTimeout       time.Duration     // Limit for fetching ref advertisements from upstream (ls-remote, passed-through info/refs), defaults to UpstreamTimeout
+	UpstreamPackTimeout       time.Duration     // Limit for pack transfers from upstream (clone, fetch, passed-through upload-pack), defaults to UpstreamTimeout
+	PeerProxies               []string          // Base URLs of sibling proxies to fetch new mirrors from before upstream
+	WarmBeforeReady           []string          // host/owner/repo of mirrors cloned at startup before ReadyPath reports ready
+	LogLevel                  string
+	AccessLogSampleRate       float64       // Fraction of successful requests logged, errors are always logged
+	AccessLogSlowThreshold    time.Duration // Requests slower than this are always logged, zero disables
+	SlowRequestThreshold      time.Duration // Requests slower than this get a breakdown of where their time went logged, zero disables
+	AuthMode                  string
+	StaticToken               string
+	SigningKey                string        // HMAC key upstream requests are signed with when AuthMode is hmac
+	SignatureHeader           string        // Header the request signature is sent in when AuthMode is hmac
+	ClientAuth                ClientAuth    // Credentials clients must present to the proxy, none if empty
+	MaxRequestBodyBytes       int64         // Largest accepted git-upload-pack POST body (as sent, before gzip decoding), zero means no limit
+	MaxCloneBytes             int64         // Largest git-upload-pack response sent to a client before it is aborted, zero means no limit
+	MaxCloneBytesOverrides    SizeLimits    // Per-repo MaxCloneBytes, first match wins
+	FilterBlobsOver           SizeSpec      // Blobs larger than this are left out of packs generated from mirrors, zero disables
+	MaxConnections            int           // Most client connections open at once on the git listener, zero means no limit
+	MaxUpstreamFetches        int           // Most clones and syncs running against upstream at once, further ones queued by priority, zero means no limit
+	MinClientRate             int64         // Bytes/s clients must receive responses at, zero disables the slow-client check
+	SlowClientWindow          time.Duration // How long a client may stay below MinClientRate before being disconnected
+	InfoRefsMemCacheBytes     int64         // Memory for caching info/refs advertisements, zero disables
+	CapabilitiesCacheTTL      time.Duration // How long protocol v2 capability advertisements are cached, shared by all repos, zero disables
+	DirectRepos               RepoPatterns  // Repos served straight from upstream, without mirroring them, while they have no mirror
+	DirectInfoRefsTTL         time.Duration // How long info/refs of repos served straight from upstream are kept in memory, zero disables
+	CacheControl              string        // Cache-Control sent on cacheable GET responses (info/refs, dumb HTTP files)
+	BasePath                  string        // Path prefix git and admin routes are served under (e.g. "/git"), empty for the root
+	MetricsPath               string
+	MetricsListenAddr         string        // Separate listen address for metrics, empty serves them on ListenAddr
+	MetricsAuthToken          string        // Token scrapes must present (bearer, or basic auth password), empty leaves metrics open
+	MetricsCacheTTL           time.Duration // How long a rendered metrics response is reused for later scrapes, zero disables
+	HealthPath                string
+	ReadyPath                 string
+	LandingPageFile           string // File served at / instead of the built-in usage text (content type from its extension)
+	AWSCloudMapServiceID      string // If set, register with AWS Cloud Map and send heartbeats
+	Route53HostedZoneID       string // Route53 hosted zone ID for DNS registration
+	Route53RecordName         string // Route53 record name (e.g., git-proxy.example.com)
+	SerializeUploadPack       bool
+	UploadPackThreads         int
+	RequestTimeouts           map[string]time.Duration // Request class (see RequestClasses) -> deadline of its requests, missing means none
+	MaintenanceSchedule       map[string]time.Duration // git maintenance task -> how often it runs on every mirror, empty disables
+	MaintainAfterSync         bool
+	MaintainCommitGraph       bool   // Write an incremental commit-graph after every sync, so negotiation stays fast
+	SkipCurrentSyncs          bool   // List upstream's refs before syncing a stale mirror, and skip the fetch if they match the mirror's
+	SyncEmptyRepos            bool   // Sync mirrors without refs on every request, whatever SyncStaleAfter, to pick up the first push right away
+	ServeStaleOnUpstreamError bool   // Serve the existing mirror when syncing it fails, instead of an error
+	CachePinnedPacks          bool   // Cache upload-pack responses for single-commit fetches and replay them verbatim
+	AllowUploadArchive        bool   // Serve git-upload-archive (git archive --remote) from mirrors
+	CacheUploadArchives       bool   // Cache upload-archive responses for commits and replay them verbatim
+	EnableGitDaemon           bool   // Serve mirrors read-only over the git:// protocol on GitDaemonListenAddr
+	CacheChecksums            bool   // Check cached advertisements and pinned packs against their checksum before serving them
+	EnableAlternates          bool   // Share the objects of mirrors in the same fork network through a common store
+	ExperimentalCASStore      bool   // Keep the objects of every mirror in one store per mirror dir, mirrors holding only refs
+	PrewarmSubmodules         bool   // Clone the submodule repos of new mirrors in the background
+	DiskFullFallback          string // When a new mirror can't be cloned for lack of disk space: passthrough or fail
+	AbandonedFetches          string // Clones and syncs whose clients all went away: abort or finish
+	SpoolLargePacksToDisk     bool   // Read packs passed through from upstream at upstream's pace, spooling them past SpoolPackThreshold to MirrorTempDir
+	SpoolPackThreshold        int64  // Bytes of a spooled pack kept in memory before the rest goes to disk
+	VerifyPacks               bool   // Check packs against their checksum before serving them, generating or fetching corrupt ones again
+	HeadRequests              string // How HEAD info/refs requests are answered: mirror, upstream or full
+	MaintenanceRepo           string // If set, run maintenance on this repo (or "all") and exit
+	ValidateConfig            bool   // If set, validate the configuration and exit without serving
 }
 
 func Load() (*Config, error) {
@@ -38,57 +140,555 @@ func Load() (*Config, error) {
 func LoadArgs(args []string) (*Config, error) {
 	cfg := &Config{}
 
+	// Precedence: flags > env > config file > defaults
+	configFile := configFileArg(args, envOrDefault("CONFIG_FILE", ""))
+	fc, err := loadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+
 	fs := flag.NewFlagSet("smart-git-proxy", flag.ContinueOnError)
 	fs.SetOutput(io.Discard)
 
-	fs.StringVar(&cfg.ListenAddr, "listen-addr", envOrDefault("LISTEN_ADDR", ":8080"), "HTTP listen address")
-	fs.StringVar(&cfg.MirrorDir, "mirror-dir", envOrDefault("MIRROR_DIR", "/mnt/git-mirrors"), "directory for bare git mirrors")
-	fs.StringVar(&cfg.LogLevel, "log-level", envOrDefault("LOG_LEVEL", "info"), "log level: debug,info,warn,error")
-	fs.StringVar(&cfg.AuthMode, "auth-mode", envOrDefault("AUTH_MODE", "pass-through"), "auth mode: pass-through|static|none (for upstream sync)")
-	fs.StringVar(&cfg.StaticToken, "static-token", envOrDefault("STATIC_TOKEN", ""), "static token used when auth-mode=static")
-	fs.StringVar(&cfg.MetricsPath, "metrics-path", envOrDefault("METRICS_PATH", "/metrics"), "path for Prometheus metrics")
-	fs.StringVar(&cfg.HealthPath, "health-path", envOrDefault("HEALTH_PATH", "/healthz"), "path for health checks")
-	fs.StringVar(&cfg.AWSCloudMapServiceID, "aws-cloud-map-service-id", envOrDefault("AWS_CLOUD_MAP_SERVICE_ID", ""), "AWS Cloud Map service ID for registration and health heartbeat")
-	fs.StringVar(&cfg.Route53HostedZoneID, "route53-hosted-zone-id", envOrDefault("ROUTE53_HOSTED_ZONE_ID", ""), "Route53 hosted zone ID for DNS registration")
-	fs.StringVar(&cfg.Route53RecordName, "route53-record-name", envOrDefault("ROUTE53_RECORD_NAME", ""), "Route53 record name (e.g., git-proxy.example.com)")
-	fs.BoolVar(&cfg.SerializeUploadPack, "serialize-upload-pack", envOrDefaultBool("SERIALIZE_UPLOAD_PACK", false), "serialize upload-pack per repo to reduce concurrent packing CPU")
-	fs.IntVar(&cfg.UploadPackThreads, "upload-pack-threads", envOrDefaultInt("UPLOAD_PACK_THREADS", 0), "pack.threads to use for upload-pack (0 means git default)")
-	fs.BoolVar(&cfg.MaintainAfterSync, "maintain-after-sync", envOrDefaultBool("MAINTAIN_AFTER_SYNC", false), "run lightweight maintenance (midx bitmap + commit-graph) after sync")
+	fs.StringVar(&cfg.ConfigFile, "config", configFile, "path to YAML config file (env and flags override its values)")
+	fs.StringVar(&cfg.ListenAddr, "listen-addr", envOrDefault("LISTEN_ADDR", fileOr(fc.ListenAddr, ":8080")), "HTTP listen address")
+	fs.StringVar(&cfg.AdminListenAddr, "admin-listen-addr", envOrDefault("ADMIN_LISTEN_ADDR", fileOr(fc.AdminListenAddr, "")), "listen address for the admin API (default: disabled)")
+	fs.BoolVar(&cfg.EnableGitDaemon, "enable-git-daemon", envOrDefaultBool("ENABLE_GIT_DAEMON", fileOr(fc.EnableGitDaemon, false)), "serve mirrors read-only over the git:// protocol on git-daemon-listen-addr")
+	fs.StringVar(&cfg.GitDaemonListenAddr, "git-daemon-listen-addr", envOrDefault("GIT_DAEMON_LISTEN_ADDR", fileOr(fc.GitDaemonListenAddr, ":9418")), "listen address of the git:// daemon, with enable-git-daemon")
+	fs.StringVar(&cfg.MirrorDir, "mirror-dir", envOrDefault("MIRROR_DIR", fileOr(fc.MirrorDir, "/mnt/git-mirrors")), "directory for bare git mirrors")
+	mirrorExtraDirsStr := fs.String("mirror-extra-dirs", envOrDefault("MIRROR_EXTRA_DIRS", fileOrList(fc.MirrorExtraDirs, "")), "comma-separated extra directories for bare git mirrors (e.g. on other volumes), each with its own size limits and eviction")
+	fs.BoolVar(&cfg.MirrorFollowSymlinks, "mirror-follow-symlinks", envOrDefaultBool("MIRROR_FOLLOW_SYMLINKS", fileOr(fc.MirrorFollowSymlinks, false)), "count files and directories symlinks inside mirror directories point to in cache sizes (default: count the links only, so they can't reach into other volumes)")
+	fs.StringVar(&cfg.MirrorTempDir, "mirror-temp-dir", envOrDefault("MIRROR_TEMP_DIR", fileOr(fc.MirrorTempDir, "")), "local directory to build new mirrors in before moving them into mirror-dir (default: build in place)")
+	fs.StringVar(&cfg.GitBinary, "git-binary", envOrDefault("GIT_BINARY", fileOr(fc.GitBinary, "git")), "git binary to run, a path or a name looked up in PATH")
+	gitEnvStr := fs.String("git-env", envOrDefault("GIT_ENV", fileOrList(fc.GitEnv, "")), "comma-separated KEY=VALUE environment variables set for every git command")
+	fs.StringVar(&cfg.LogLevel, "log-level", envOrDefault("LOG_LEVEL", fileOr(fc.LogLevel, "info")), "log level: debug,info,warn,error")
+	accessLogSampleRateStr := fs.String("access-log-sample-rate", envOrDefault("ACCESS_LOG_SAMPLE_RATE", strconv.FormatFloat(fileOr(fc.AccessLogSampleRate, 1), 'g', -1, 64)), "fraction (0-1) of successful requests written to the access log; errors and slow requests are always logged")
+	slowRequestStr := fs.String("slow-request-threshold", envOrDefault("SLOW_REQUEST_THRESHOLD", fileOr(fc.SlowRequestThreshold, "0")), "git requests taking longer than this get a log line breaking their time down by phase: waits, upstream DNS, connect, TLS, negotiation and git, local git and transfer (0 disables)")
+	accessLogSlowStr := fs.String("access-log-slow-threshold", envOrDefault("ACCESS_LOG_SLOW_THRESHOLD", fileOr(fc.AccessLogSlowThreshold, "1s")), "requests taking longer than this are always written to the access log (0 disables)")
+	fs.StringVar(&cfg.AuthMode, "auth-mode", envOrDefault("AUTH_MODE", fileOr(fc.AuthMode, "pass-through")), "auth mode: pass-through|static|hmac|none (for upstream sync)")
+	fs.StringVar(&cfg.StaticToken, "static-token", envOrDefault("STATIC_TOKEN", fileOr(fc.StaticToken, "")), "static token used when auth-mode=static")
+	fs.StringVar(&cfg.SigningKey, "signing-key", envOrDefault("SIGNING_KEY", fileOr(fc.SigningKey, "")), "HMAC key upstream HTTP requests are signed with when auth-mode=hmac")
+	fs.StringVar(&cfg.SignatureHeader, "signature-header", envOrDefault("SIGNATURE_HEADER", fileOr(fc.SignatureHeader, "X-Signature")), "header upstream HTTP request signatures are sent in when auth-mode=hmac")
+	clientTokensStr := fs.String("client-auth-tokens", envOrDefault("CLIENT_AUTH_TOKENS", fileOrList(fc.ClientAuth.tokens(), "")), "comma-separated tokens clients must present to the proxy, as bearer tokens or basic auth passwords (default: no client auth)")
+	clientUpstreamTokensStr := fs.String("client-auth-upstream-tokens", envOrDefault("CLIENT_AUTH_UPSTREAM_TOKENS", fileOrMap(fc.ClientAuth.upstreamTokens(), "")), "comma-separated token=upstream-token pairs: clients presenting token to the proxy are accepted, and their requests go upstream with upstream-token instead of auth-mode's")
+	clientPrioritiesStr := fs.String("client-auth-priorities", envOrDefault("CLIENT_AUTH_PRIORITIES", fileOrMap(fc.ClientAuth.priorities(), "")), "comma-separated client=priority pairs (interactive or batch) giving the requests of a client-auth token or user their upstream fetch priority, whatever X-Git-Proxy-Priority says")
+	clientUsersStr := fs.String("client-auth-users", envOrDefault("CLIENT_AUTH_USERS", fileOrMap(fc.ClientAuth.users(), "")), "comma-separated user=password pairs clients may authenticate to the proxy with using basic auth")
+	fs.StringVar(&cfg.CacheControl, "cache-control", envOrDefault("CACHE_CONTROL", fileOr(fc.CacheControl, "no-cache")), "Cache-Control header for cacheable GET responses (upload-pack POSTs always use no-store)")
+	basePathStr := fs.String("base-path", envOrDefault("BASE_PATH", fileOr(fc.BasePath, "")), "path prefix to serve git and admin routes under, e.g. /git (default: the root)")
+	fs.StringVar(&cfg.MetricsPath, "metrics-path", envOrDefault("METRICS_PATH", fileOr(fc.MetricsPath, "/metrics")), "path for Prometheus metrics")
+	fs.StringVar(&cfg.LandingPageFile, "landing-page-file", envOrDefault("LANDING_PAGE_FILE", fileOr(fc.LandingPageFile, "")), "file served at / instead of the built-in usage text")
+	fs.StringVar(&cfg.MetricsListenAddr, "metrics-listen-addr", envOrDefault("METRICS_LISTEN_ADDR", fileOr(fc.MetricsListenAddr, "")), "separate listen address for Prometheus metrics (default: served on listen-addr)")
+	fs.StringVar(&cfg.MetricsAuthToken, "metrics-auth-token", envOrDefault("METRICS_AUTH_TOKEN", fileOr(fc.MetricsAuthToken, "")), "token required to scrape metrics, as a bearer token or basic auth password (default: none)")
+	metricsCacheTTLStr := fs.String("metrics-cache-ttl", envOrDefault("METRICS_CACHE_TTL", fileOr(fc.MetricsCacheTTL, "0")), "how long to reuse a rendered metrics response for later scrapes (0 disables)")
+	fs.StringVar(&cfg.HealthPath, "health-path", envOrDefault("HEALTH_PATH", fileOr(fc.HealthPath, "/healthz")), "path for health checks")
+	fs.StringVar(&cfg.ReadyPath, "ready-path", envOrDefault("READY_PATH", fileOr(fc.ReadyPath, "/readyz")), "path for readiness checks")
+	warmBeforeReadyStr := fs.String("warm-before-ready", envOrDefault("WARM_BEFORE_READY", fileOrList(fc.WarmBeforeReady, "")), "comma-separated host/owner/repo of mirrors to clone at startup before ready-path reports ready")
+	fs.StringVar(&cfg.AWSCloudMapServiceID, "aws-cloud-map-service-id", envOrDefault("AWS_CLOUD_MAP_SERVICE_ID", fileOr(fc.AWSCloudMapServiceID, "")), "AWS Cloud Map service ID for registration and health heartbeat")
+	fs.StringVar(&cfg.Route53HostedZoneID, "route53-hosted-zone-id", envOrDefault("ROUTE53_HOSTED_ZONE_ID", fileOr(fc.Route53HostedZoneID, "")), "Route53 hosted zone ID for DNS registration")
+	fs.StringVar(&cfg.Route53RecordName, "route53-record-name", envOrDefault("ROUTE53_RECORD_NAME", fileOr(fc.Route53RecordName, "")), "Route53 record name (e.g., git-proxy.example.com)")
+	fs.BoolVar(&cfg.SerializeUploadPack, "serialize-upload-pack", envOrDefaultBool("SERIALIZE_UPLOAD_PACK", fileOr(fc.SerializeUploadPack, false)), "serialize upload-pack per repo to reduce concurrent packing CPU")
+	fs.IntVar(&cfg.MaxConnections, "max-connections", envOrDefaultInt("MAX_CONNECTIONS", fileOr(fc.MaxConnections, 0)), "most client connections open at once; further ones wait to be accepted (0 means no limit)")
+	fs.IntVar(&cfg.MaxUpstreamFetches, "max-upstream-fetches", envOrDefaultInt("MAX_UPSTREAM_FETCHES", fileOr(fc.MaxUpstreamFetches, 0)), "most clones and syncs running against upstream at once; further ones wait, interactive clients' before batch ones (0 means no limit)")
+	fs.IntVar(&cfg.UploadPackThreads, "upload-pack-threads", envOrDefaultInt("UPLOAD_PACK_THREADS", fileOr(fc.UploadPackThreads, 0)), "pack.threads to use for upload-pack (0 means git default)")
+	fs.BoolVar(&cfg.ServeStaleOnUpstreamError, "serve-stale-on-upstream-error", envOrDefaultBool("SERVE_STALE_ON_UPSTREAM_ERROR", fileOr(fc.ServeStaleOnUpstreamError, true)), "serve the existing mirror when syncing it from upstream fails, instead of an error")
+	fs.BoolVar(&cfg.MaintainAfterSync, "maintain-after-sync", envOrDefaultBool("MAINTAIN_AFTER_SYNC", fileOr(fc.MaintainAfterSync, false)), "run lightweight maintenance (midx bitmap + commit-graph) after sync")
+	fs.BoolVar(&cfg.ExperimentalCASStore, "experimental-cas-store", envOrDefaultBool("EXPERIMENTAL_CAS_STORE", fileOr(fc.ExperimentalCASStore, false)), "experimental: store the objects of all mirrors once, in a single object store per mirror dir, mirrors holding only their refs")
+	fs.BoolVar(&cfg.EnableAlternates, "enable-alternates", envOrDefaultBool("ENABLE_ALTERNATES", fileOr(fc.EnableAlternates, false)), "store the objects of forks once, in an object store shared by mirrors of the same fork network")
+	fs.BoolVar(&cfg.SkipCurrentSyncs, "skip-current-syncs", envOrDefaultBool("SKIP_CURRENT_SYNCS", fileOr(fc.SkipCurrentSyncs, false)), "list upstream's refs before syncing a stale mirror and skip the fetch when the mirror already has them all")
+	fs.BoolVar(&cfg.SyncEmptyRepos, "sync-empty-repos", envOrDefaultBool("SYNC_EMPTY_REPOS", fileOr(fc.SyncEmptyRepos, false)), "sync mirrors of empty repos on every request, whatever sync-stale-after, so the first push to them is served right away")
+	fs.BoolVar(&cfg.MaintainCommitGraph, "maintain-commit-graph", envOrDefaultBool("MAINTAIN_COMMIT_GRAPH", fileOr(fc.MaintainCommitGraph, false)), "write an incremental commit-graph in the background after every sync, keeping upload-pack negotiation fast")
+	fs.BoolVar(&cfg.CacheChecksums, "cache-checksums", envOrDefaultBool("CACHE_CHECKSUMS", fileOr(fc.CacheChecksums, true)), "verify cached info/refs advertisements and pinned packs against their checksum before serving them, regenerating corrupt ones")
+	fs.BoolVar(&cfg.VerifyPacks, "verify-packs", envOrDefaultBool("VERIFY_PACKS", fileOr(fc.VerifyPacks, false)), "buffer packs generated from mirrors, and packs passed through from upstream with spool-large-packs-to-disk, and check them against their checksum before serving them, generating or fetching corrupt ones once more")
+	fs.BoolVar(&cfg.CachePinnedPacks, "cache-pinned-packs", envOrDefaultBool("CACHE_PINNED_PACKS", fileOr(fc.CachePinnedPacks, false)), "cache packs for fetches of a single commit by SHA and replay them byte-for-byte")
+	fs.BoolVar(&cfg.AllowUploadArchive, "allow-upload-archive", envOrDefaultBool("ALLOW_UPLOAD_ARCHIVE", fileOr(fc.AllowUploadArchive, false)), "serve git-upload-archive (git archive --remote) from mirrors")
+	fs.BoolVar(&cfg.CacheUploadArchives, "cache-upload-archives", envOrDefaultBool("CACHE_UPLOAD_ARCHIVES", fileOr(fc.CacheUploadArchives, false)), "cache git-upload-archive responses for a commit and replay them byte-for-byte")
+	fs.StringVar(&cfg.HeadRequests, "head-requests", envOrDefault("HEAD_REQUESTS", fileOr(fc.HeadRequests, "mirror")), "how HEAD info/refs requests are answered: mirror (from the mirror alone, 404 if not mirrored), upstream (unmirrored repos checked upstream without cloning) or full (like GET, updating the mirror)")
+	fs.BoolVar(&cfg.SpoolLargePacksToDisk, "spool-large-packs-to-disk", envOrDefaultBool("SPOOL_LARGE_PACKS_TO_DISK", fileOr(fc.SpoolLargePacksToDisk, false)), "read packs passed through from upstream as fast as upstream sends them, spooling them to mirror-temp-dir past spool-pack-threshold, so slow clients don't hold upstream connections")
+	fs.StringVar(&cfg.AbandonedFetches, "abandoned-fetches", envOrDefault("ABANDONED_FETCHES", fileOr(fc.AbandonedFetches, "abort")), "clones and syncs whose clients all went away: abort or finish (for the next clients)")
+	fs.StringVar(&cfg.DiskFullFallback, "disk-full-fallback", envOrDefault("DISK_FULL_FALLBACK", fileOr(fc.DiskFullFallback, "passthrough")), "when a new mirror can't be cloned for lack of disk space: passthrough (serve from upstream without caching) or fail")
+	fs.BoolVar(&cfg.PrewarmSubmodules, "prewarm-submodules", envOrDefaultBool("PREWARM_SUBMODULES", fileOr(fc.PrewarmSubmodules, false)), "clone the submodule repos listed in new mirrors' .gitmodules in the background")
+	maintenanceScheduleStr := fs.String("maintenance-schedule", envOrDefault("MAINTENANCE_SCHEDULE", fileOrMap(fc.MaintenanceSchedule, "")), "comma-separated task=interval pairs running git maintenance tasks ("+strings.Join(MaintenanceTasks, ", ")+") on every mirror, e.g. commit-graph=1h")
 	fs.StringVar(&cfg.MaintenanceRepo, "maintenance-repo", envOrDefault("MAINTENANCE_REPO", ""), "if set, run maintenance on the given repo key (host/owner/repo) or \"all\" and exit")
 
-	allowedUpstreamsStr := fs.String("allowed-upstreams", envOrDefault("ALLOWED_UPSTREAMS", "github.com"), "comma-separated list of allowed upstream hosts")
-	syncStaleAfterStr := fs.String("sync-stale-after", envOrDefault("SYNC_STALE_AFTER", "2s"), "sync mirror if older than this duration")
-	mirrorMaxSizeStr := fs.String("mirror-max-size", envOrDefault("MIRROR_MAX_SIZE", ""), "max size for mirrors (e.g. 200GiB, 80%), defaults to 80% of available disk")
+	fs.BoolVar(&cfg.ValidateConfig, "validate-config", false, "validate the configuration (including mirror-dir writability) and exit")
+
+	allowedServicesStr := fs.String("allowed-services", envOrDefault("ALLOWED_SERVICES", fileOrList(fc.AllowedServices, "git-upload-pack")), "comma-separated git services clients may use: git-upload-pack, git-receive-pack (pushes, passed through to upstream)")
+	allowedUpstreamsStr := fs.String("allowed-upstreams", envOrDefault("ALLOWED_UPSTREAMS", fileOrList(fc.AllowedUpstreams, "github.com")), "comma-separated list of allowed upstream hosts")
+	hostAliasesStr := fs.String("upstream-host-aliases", envOrDefault("UPSTREAM_HOST_ALIASES", fileOrMap(fc.UpstreamHostAliases, "")), "comma-separated alias=host pairs of request hosts (e.g. www.github.com=github.com) sharing the mirrors of an allowed upstream host")
+	keepGitSuffixStr := fs.String("keep-git-suffix-hosts", envOrDefault("KEEP_GIT_SUFFIX_HOSTS", fileOrList(fc.KeepGitSuffixHosts, "")), "comma-separated allowed upstream hosts whose repo names keep a .git suffix, repo and repo.git being different repos there")
+	hostOverridesStr := fs.String("upstream-host-overrides", envOrDefault("UPSTREAM_HOST_OVERRIDES", fileOrMap(fc.UpstreamHostOverrides, "")), "comma-separated host=ip pairs to connect upstream hosts to specific addresses")
+	networksStr := fs.String("alternates-networks", envOrDefault("ALTERNATES_NETWORKS", strings.Join(fc.AlternatesNetworks, " ")), "whitespace-separated pattern=>host/owner/repo rules naming the fork network of matching host/owner/repo paths for enable-alternates")
+	rewritesStr := fs.String("upstream-rewrites", envOrDefault("UPSTREAM_REWRITES", strings.Join(fc.UpstreamRewrites, " ")), "whitespace-separated pattern=>replacement rules rewriting host/owner/repo paths before going upstream")
+	mirrorRefspecsStr := fs.String("mirror-refspecs", envOrDefault("MIRROR_REFSPECS", strings.Join(fc.MirrorRefspecs, " ")), "whitespace-separated pattern=ref[,ref...] rules mirroring only the listed refs or namespaces (refs/tags/*) of matching host/owner/repo paths")
+	fs.StringVar(&cfg.DefaultBranch, "default-branch", envOrDefault("DEFAULT_BRANCH", fileOr(fc.DefaultBranch, "main")), "branch the HEAD of mirrors points to when upstream's HEAD is unknown or points to a branch the mirror lacks, empty to leave HEAD as it is")
+	fallbacksStr := fs.String("upstream-fallbacks", envOrDefault("UPSTREAM_FALLBACKS", fileOrFallbacks(fc.UpstreamFallbacks, "")), "comma-separated host=url pairs of mirrors syncs fall back to, in order, when the upstream host fails")
+	quotasStr := fs.String("upstream-quotas", envOrDefault("UPSTREAM_QUOTAS", fileOrMap(fc.UpstreamQuotas, "")), "comma-separated host=size[/fetches] pairs (e.g. github.com=500GiB/20000) capping what is fetched from upstream hosts per upstream-quota-window; past them, mirrors are served as is and new ones refused")
+	quotaWindowStr := fs.String("upstream-quota-window", envOrDefault("UPSTREAM_QUOTA_WINDOW", fileOr(fc.UpstreamQuotaWindow, "24h")), "period upstream-quotas apply to, aligned on the Unix epoch (24h resets at midnight UTC)")
+	schemesStr := fs.String("upstream-schemes", envOrDefault("UPSTREAM_SCHEMES", fileOrMap(fc.UpstreamSchemes, "")), "comma-separated host=scheme pairs (https or ssh) selecting how mirrors of each upstream host are fetched")
+	fs.StringVar(&cfg.UpstreamSSHUser, "upstream-ssh-user", envOrDefault("UPSTREAM_SSH_USER", fileOr(fc.UpstreamSSHUser, "git")), "user for SSH upstreams")
+	fs.StringVar(&cfg.UpstreamSSHKey, "upstream-ssh-key", envOrDefault("UPSTREAM_SSH_KEY", fileOr(fc.UpstreamSSHKey, "")), "private key file for SSH upstreams")
+	fs.StringVar(&cfg.UpstreamSSHKnownHosts, "upstream-ssh-known-hosts", envOrDefault("UPSTREAM_SSH_KNOWN_HOSTS", fileOr(fc.UpstreamSSHKnownHosts, "")), "known_hosts file to check SSH upstream host keys against (default: ssh's)")
+	fs.StringVar(&cfg.UpstreamResolver, "upstream-resolver", envOrDefault("UPSTREAM_RESOLVER", fileOr(fc.UpstreamResolver, "")), "DNS server (host:port) used to resolve upstream hosts")
+	fs.StringVar(&cfg.UpstreamIPFamily, "upstream-ip-family", envOrDefault("UPSTREAM_IP_FAMILY", fileOr(fc.UpstreamIPFamily, "")), "only connect to upstream hosts over ipv4 or ipv6 (default: both)")
+	fallbackDelayStr := fs.String("upstream-fallback-delay", envOrDefault("UPSTREAM_FALLBACK_DELAY", fileOr(fc.UpstreamFallbackDelay, "0")), "how long upstream connections wait on IPv6 before racing IPv4 (happy eyeballs); 0 for Go's default of 300ms, negative to disable")
+	stripRefsStr := fs.String("strip-ref-patterns", envOrDefault("STRIP_REF_PATTERNS", fileOrList(fc.StripRefPatterns, "")), "comma-separated refs or namespaces (e.g. refs/pull/*) to hide from clients")
+	trustedProxiesStr := fs.String("trusted-proxy-cidrs", envOrDefault("TRUSTED_PROXY_CIDRS", fileOrList(fc.TrustedProxyCIDRs, "")), "comma-separated CIDRs (or IPs) of load balancers whose X-Forwarded-For/Proto/Host headers are trusted")
+	peerProxiesStr := fs.String("peer-proxies", envOrDefault("PEER_PROXIES", fileOrList(fc.PeerProxies, "")), "comma-separated base URLs of sibling proxies to fetch new mirrors from before falling back to upstream")
+	fs.BoolVar(&cfg.FollowUpstreamRedirects, "follow-upstream-redirects", envOrDefaultBool("FOLLOW_UPSTREAM_REDIRECTS", fileOr(fc.FollowUpstreamRedirects, true)), "mirror repos that upstream redirects to another name on the same host (e.g. renamed or transferred repos) under that name, serving the old one as an alias; disabled, fetches of redirected repos fail")
+	fs.BoolVar(&cfg.UpstreamTracing, "upstream-tracing", envOrDefaultBool("UPSTREAM_TRACING", fileOr(fc.UpstreamTracing, false)), "record DNS, connect, TLS handshake and first-byte times of upstream HTTP requests by host")
+	upstreamTimeoutStr := fs.String("upstream-timeout", envOrDefault("UPSTREAM_TIMEOUT", fileOr(fc.UpstreamTimeout, "0")), "timeout for git operations against upstream (clone, fetch, ls-remote), 0 means none")
+	upstreamInfoTimeoutStr := fs.String("upstream-info-timeout", envOrDefault("UPSTREAM_INFO_TIMEOUT", fileOr(fc.UpstreamInfoTimeout, "")), "timeout for fetching ref advertisements from upstream (ls-remote, passed-through info/refs), 0 means none (default: upstream-timeout)")
+	upstreamPackTimeoutStr := fs.String("upstream-pack-timeout", envOrDefault("UPSTREAM_PACK_TIMEOUT", fileOr(fc.UpstreamPackTimeout, "")), "timeout for pack transfers from upstream (clone, fetch, passed-through upload-pack), 0 means none (default: upstream-timeout)")
+	requestTimeoutsStr := fs.String("request-timeouts", envOrDefault("REQUEST_TIMEOUTS", fileOrMap(fc.RequestTimeouts, "admin=1m,metrics=10s")), "comma-separated class=deadline pairs bounding whole requests by class ("+strings.Join(RequestClasses, ", ")+"), answered with 504 once past it; classes left out have none")
+	syncStaleAfterStr := fs.String("sync-stale-after", envOrDefault("SYNC_STALE_AFTER", fileOr(fc.SyncStaleAfter, "2s")), "sync mirror if older than this duration")
+	gitKilledBackoffStr := fs.String("git-killed-backoff", envOrDefault("GIT_KILLED_BACKOFF", fileOr(fc.GitKilledBackoff, "1m")), "after a git sync of a mirror is killed by a signal (e.g. the OOM killer), serve the mirror as is without syncing it for this long (0 retries on the next request)")
+	staleWhileRevalidateStr := fs.String("stale-while-revalidate", envOrDefault("STALE_WHILE_REVALIDATE", fileOr(fc.StaleWhileRevalidate, "0")), "serve mirrors stale for up to this long past sync-stale-after as they are, syncing them in the background (0 disables)")
+	minAgeBeforeEvictStr := fs.String("min-age-before-evict", envOrDefault("MIN_AGE_BEFORE_EVICT", fileOr(fc.MinAgeBeforeEvict, "0")), "never evict repos created or refreshed from upstream more recently than this (0 disables)")
+	evictionFreezeForStr := fs.String("eviction-freeze-for", envOrDefault("EVICTION_FREEZE_FOR", fileOr(fc.EvictionFreezeFor, "0")), "keep cold repos frozen (repacked for size) this long before eviction deletes them (0 deletes right away)")
+	evictHighStr := fs.String("evict-high-watermark", envOrDefault("EVICT_HIGH_WATERMARK", strconv.FormatFloat(fileOr(fc.EvictHighWatermark, 100), 'g', -1, 64)), "percentage of mirror-max-size above which least recently used mirrors are evicted")
+	evictLowStr := fs.String("evict-low-watermark", envOrDefault("EVICT_LOW_WATERMARK", strconv.FormatFloat(fileOr(fc.EvictLowWatermark, 90), 'g', -1, 64)), "percentage of mirror-max-size eviction frees space down to, below evict-high-watermark")
+	fs.StringVar(&cfg.EvictionSizes, "eviction-sizes", envOrDefault("EVICTION_SIZES", fileOr(fc.EvictionSizes, "walk")), "how eviction measures the cache: walk (every file, on every check) or recorded (mirror sizes recorded after clones, syncs and maintenance)")
+	evictionIntervalStr := fs.String("eviction-interval", envOrDefault("EVICTION_INTERVAL", fileOr(fc.EvictionInterval, "5m")), "how often to check cache size and free disk space for eviction (0 disables)")
+	cacheMaxAgeStr := fs.String("cache-max-age", envOrDefault("CACHE_MAX_AGE", fileOr(fc.CacheMaxAge, "0")), "never serve mirrors last refreshed from upstream longer ago than this: they are refreshed on access, or purged if that fails, and swept every eviction-interval (0 disables)")
+	verifyIntervalStr := fs.String("verify-interval", envOrDefault("VERIFY_INTERVAL", fileOr(fc.VerifyInterval, "1h")), "how often to check a sample of mirrors against upstream")
+	verifySampleRateStr := fs.String("verify-sample-rate", envOrDefault("VERIFY_SAMPLE_RATE", strconv.FormatFloat(fileOr(fc.VerifySampleRate, 0), 'g', -1, 64)), "fraction (0-1) of mirrors whose HEAD is checked against upstream each verify-interval, refreshing mismatches (0 disables)")
+	fs.StringVar(&cfg.CacheLock, "cache-lock", envOrDefault("CACHE_LOCK", fileOr(fc.CacheLock, "fail")), "lock the mirror roots against other instances: fail (refuse to start if another instance holds them), warn (log and start anyway) or off")
+	fs.IntVar(&cfg.MaxRepoCount, "max-repo-count", envOrDefaultInt("MAX_REPO_COUNT", fileOr(fc.MaxRepoCount, 0)), "most repos kept in each mirror directory; past it, the least recently used are evicted down to evict-low-watermark percent of it, whatever their size (0 means no limit)")
+	minFreeSpaceStr := fs.String("min-free-space", envOrDefault("MIN_FREE_SPACE", fileOr(fc.MinFreeSpace, "1GiB")), "free disk space to always keep (e.g. 1GiB, 5%)")
+	cacheDirModeStr := fs.String("cache-dir-mode", envOrDefault("CACHE_DIR_MODE", fileOr(fc.CacheDirMode, "0755")), "octal mode of directories created in the mirror dir")
+	cacheFileModeStr := fs.String("cache-file-mode", envOrDefault("CACHE_FILE_MODE", fileOr(fc.CacheFileMode, "")), "octal mode of files in new mirrors, e.g. 0640 (default: git's, following the umask)")
+	maxRequestBodyStr := fs.String("max-request-body-bytes", envOrDefault("MAX_REQUEST_BODY_BYTES", fileOr(fc.MaxRequestBodyBytes, "64MiB")), "largest accepted git-upload-pack request body (e.g. 64MiB); larger requests get 413 (0 disables)")
+	maxCloneBytesStr := fs.String("max-clone-bytes", envOrDefault("MAX_CLONE_BYTES", fileOr(fc.MaxCloneBytes, "0")), "largest git-upload-pack response (e.g. 20GiB) streamed to a client before the transfer is aborted (0 disables)")
+	filterBlobsOverStr := fs.String("filter-blobs-over", envOrDefault("FILTER_BLOBS_OVER", fileOr(fc.FilterBlobsOver, "0")), "leave blobs larger than this (e.g. 10MiB) out of packs generated from mirrors, as a blob:limit filter would (0 disables)")
+	spoolPackThresholdStr := fs.String("spool-pack-threshold", envOrDefault("SPOOL_PACK_THRESHOLD", fileOr(fc.SpoolPackThreshold, "16MiB")), "bytes of a spooled pack kept in memory before the rest is written to disk (e.g. 16MiB)")
+	maxCloneOverridesStr := fs.String("max-clone-bytes-overrides", envOrDefault("MAX_CLONE_BYTES_OVERRIDES", strings.Join(fc.MaxCloneBytesOverrides, " ")), "whitespace-separated pattern=size rules overriding max-clone-bytes for matching host/owner/repo paths (0 disables)")
+	minClientRateStr := fs.String("min-client-rate", envOrDefault("MIN_CLIENT_RATE", fileOr(fc.MinClientRate, "0")), "minimum rate (bytes/s, e.g. 16KiB) clients must receive responses at, slower ones are disconnected (0 disables)")
+	slowClientWindowStr := fs.String("slow-client-window", envOrDefault("SLOW_CLIENT_WINDOW", fileOr(fc.SlowClientWindow, "30s")), "how long a client may receive slower than min-client-rate before being disconnected")
+	directReposStr := fs.String("direct-repos", envOrDefault("DIRECT_REPOS", strings.Join(fc.DirectRepos, " ")), "whitespace-separated patterns of host/owner/repo paths served straight from upstream without mirroring them, while they have no mirror")
+	directInfoRefsTTLStr := fs.String("direct-info-refs-ttl", envOrDefault("DIRECT_INFO_REFS_TTL", fileOr(fc.DirectInfoRefsTTL, "5s")), "how long to keep info/refs of repos served straight from upstream in memory (0 disables)")
+	capabilitiesCacheTTLStr := fs.String("capabilities-cache-ttl", envOrDefault("CAPABILITIES_CACHE_TTL", fileOr(fc.CapabilitiesCacheTTL, "0")), "how long to cache protocol v2 capability advertisements, which list no refs and are shared by all repos (0 disables)")
+	infoRefsMemCacheStr := fs.String("info-refs-mem-cache-bytes", envOrDefault("INFO_REFS_MEM_CACHE_BYTES", fileOr(fc.InfoRefsMemCacheBytes, "0")), "memory for caching info/refs advertisements (e.g. 16MiB, 0 disables)")
+	mirrorMaxSizeStr := fs.String("mirror-max-size", envOrDefault("MIRROR_MAX_SIZE", fileOr(fc.MirrorMaxSize, "")), "max size for mirrors (e.g. 200GiB, 80%), defaults to 80% of the disk")
 
 	if err := fs.Parse(args); err != nil {
 		return nil, err
 	}
 
-	var err error
+	// Collect all validation errors so they can be reported at once
+	var errs []error
+
+	if cfg.BasePath, err = parseBasePath(*basePathStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid base-path: %w", err))
+	}
+
 	if cfg.SyncStaleAfter, err = time.ParseDuration(*syncStaleAfterStr); err != nil {
-		return nil, fmt.Errorf("invalid sync-stale-after: %w", err)
+		errs = append(errs, fmt.Errorf("invalid sync-stale-after: %w", err))
+	}
+	if cfg.StaleWhileRevalidate, err = time.ParseDuration(*staleWhileRevalidateStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid stale-while-revalidate: %w", err))
+	} else if cfg.StaleWhileRevalidate < 0 {
+		errs = append(errs, errors.New("invalid stale-while-revalidate: must not be negative"))
+	}
+	if cfg.GitKilledBackoff, err = time.ParseDuration(*gitKilledBackoffStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid git-killed-backoff: %w", err))
+	} else if cfg.GitKilledBackoff < 0 {
+		errs = append(errs, errors.New("invalid git-killed-backoff: must not be negative"))
+	}
+
+	for _, c := range strings.Split(*trustedProxiesStr, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		prefix, err := parsePrefix(c)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid trusted-proxy-cidrs: %w", err))
+			continue
+		}
+		cfg.TrustedProxyCIDRs = append(cfg.TrustedProxyCIDRs, prefix)
 	}
 
-	// Parse mirror max size (empty string means use default 80% of available)
+	for _, p := range strings.Split(*stripRefsStr, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if err := validateRefPattern(p); err != nil {
+			errs = append(errs, fmt.Errorf("invalid strip-ref-patterns: %w", err))
+			continue
+		}
+		cfg.StripRefPatterns = append(cfg.StripRefPatterns, p)
+	}
+
+	for _, dir := range strings.Split(*mirrorExtraDirsStr, ",") {
+		dir = filepath.Clean(strings.TrimSpace(dir))
+		if dir == "." {
+			continue
+		}
+		if slices.ContainsFunc(cfg.MirrorDirs(), func(d string) bool { return filepath.Clean(d) == dir }) {
+			errs = append(errs, fmt.Errorf("invalid mirror-extra-dirs: %s is listed twice", dir))
+			continue
+		}
+		cfg.MirrorExtraDirs = append(cfg.MirrorExtraDirs, dir)
+	}
+
+	for _, kv := range strings.Split(*gitEnvStr, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		name, _, ok := strings.Cut(kv, "=")
+		switch {
+		case !ok || name == "":
+			errs = append(errs, fmt.Errorf("invalid git-env %q: want KEY=VALUE", kv))
+		case strings.HasPrefix(name, "GIT_CONFIG_COUNT") || strings.HasPrefix(name, "GIT_CONFIG_KEY_") || strings.HasPrefix(name, "GIT_CONFIG_VALUE_"):
+			// The proxy passes its own per-command config this way
+			errs = append(errs, fmt.Errorf("invalid git-env %q: GIT_CONFIG_COUNT/KEY/VALUE are reserved, point GIT_CONFIG_GLOBAL at a config file instead", kv))
+		default:
+			cfg.GitEnv = append(cfg.GitEnv, kv)
+		}
+	}
+
+	for _, p := range strings.Split(*peerProxiesStr, ",") {
+		p = strings.TrimRight(strings.TrimSpace(p), "/")
+		if p == "" {
+			continue
+		}
+		if u, err := url.Parse(p); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid peer proxy %q: expected http(s)://host[:port]", p))
+			continue
+		}
+		cfg.PeerProxies = append(cfg.PeerProxies, p)
+	}
+
+	if cfg.UpstreamTimeout, err = time.ParseDuration(*upstreamTimeoutStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid upstream-timeout: %w", err))
+	}
+	cfg.UpstreamInfoTimeout, cfg.UpstreamPackTimeout = cfg.UpstreamTimeout, cfg.UpstreamTimeout
+	if *upstreamInfoTimeoutStr != "" {
+		if cfg.UpstreamInfoTimeout, err = time.ParseDuration(*upstreamInfoTimeoutStr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid upstream-info-timeout: %w", err))
+		}
+	}
+	if *upstreamPackTimeoutStr != "" {
+		if cfg.UpstreamPackTimeout, err = time.ParseDuration(*upstreamPackTimeoutStr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid upstream-pack-timeout: %w", err))
+		}
+	}
+
+	if cfg.RequestTimeouts, err = parseRequestTimeouts(*requestTimeoutsStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid request-timeouts: %w", err))
+	}
+
+	if cfg.EvictionFreezeFor, err = time.ParseDuration(*evictionFreezeForStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid eviction-freeze-for: %w", err))
+	}
+	if cfg.MinAgeBeforeEvict, err = time.ParseDuration(*minAgeBeforeEvictStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid min-age-before-evict: %w", err))
+	} else if cfg.MinAgeBeforeEvict < 0 {
+		errs = append(errs, fmt.Errorf("invalid min-age-before-evict: %s is negative", cfg.MinAgeBeforeEvict))
+	}
+	if cfg.EvictHighWatermark, err = strconv.ParseFloat(*evictHighStr, 64); err != nil {
+		errs = append(errs, fmt.Errorf("invalid evict-high-watermark: %w", err))
+	} else if cfg.EvictHighWatermark <= 0 || cfg.EvictHighWatermark > 100 {
+		errs = append(errs, fmt.Errorf("invalid evict-high-watermark: %v is not between 0 and 100", cfg.EvictHighWatermark))
+	}
+	if cfg.EvictLowWatermark, err = strconv.ParseFloat(*evictLowStr, 64); err != nil {
+		errs = append(errs, fmt.Errorf("invalid evict-low-watermark: %w", err))
+	} else if cfg.EvictLowWatermark <= 0 || cfg.EvictLowWatermark >= cfg.EvictHighWatermark {
+		errs = append(errs, fmt.Errorf("invalid evict-low-watermark: %v is not between 0 and evict-high-watermark (%v)", cfg.EvictLowWatermark, cfg.EvictHighWatermark))
+	}
+
+	if cfg.EvictionInterval, err = time.ParseDuration(*evictionIntervalStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid eviction-interval: %w", err))
+	}
+	if cfg.EvictionSizes != "walk" && cfg.EvictionSizes != "recorded" {
+		errs = append(errs, fmt.Errorf("unknown eviction-sizes: %s", cfg.EvictionSizes))
+	}
+
+	if cfg.CacheMaxAge, err = time.ParseDuration(*cacheMaxAgeStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid cache-max-age: %w", err))
+	} else if cfg.CacheMaxAge < 0 {
+		errs = append(errs, errors.New("invalid cache-max-age: must not be negative"))
+	}
+
+	if cfg.VerifyInterval, err = time.ParseDuration(*verifyIntervalStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid verify-interval: %w", err))
+	} else if cfg.VerifyInterval <= 0 {
+		errs = append(errs, errors.New("invalid verify-interval: must be positive"))
+	}
+	if cfg.VerifySampleRate, err = strconv.ParseFloat(*verifySampleRateStr, 64); err != nil {
+		errs = append(errs, fmt.Errorf("invalid verify-sample-rate: %w", err))
+	} else if cfg.VerifySampleRate < 0 || cfg.VerifySampleRate > 1 {
+		errs = append(errs, fmt.Errorf("invalid verify-sample-rate: %v is not between 0 and 1", cfg.VerifySampleRate))
+	}
+
+	if cfg.AccessLogSampleRate, err = strconv.ParseFloat(*accessLogSampleRateStr, 64); err != nil {
+		errs = append(errs, fmt.Errorf("invalid access-log-sample-rate: %w", err))
+	} else if cfg.AccessLogSampleRate < 0 || cfg.AccessLogSampleRate > 1 {
+		errs = append(errs, fmt.Errorf("invalid access-log-sample-rate: %v is not between 0 and 1", cfg.AccessLogSampleRate))
+	}
+	if cfg.AccessLogSlowThreshold, err = time.ParseDuration(*accessLogSlowStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid access-log-slow-threshold: %w", err))
+	}
+	if cfg.SlowRequestThreshold, err = time.ParseDuration(*slowRequestStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid slow-request-threshold: %w", err))
+	} else if cfg.SlowRequestThreshold < 0 {
+		errs = append(errs, errors.New("invalid slow-request-threshold: must not be negative"))
+	}
+
+	// Parse mirror max size (empty string means use default 80% of the disk)
 	if *mirrorMaxSizeStr != "" {
 		if cfg.MirrorMaxSize, err = ParseSizeSpec(*mirrorMaxSizeStr); err != nil {
-			return nil, fmt.Errorf("invalid mirror-max-size: %w", err)
+			errs = append(errs, fmt.Errorf("invalid mirror-max-size: %w", err))
+		}
+	}
+
+	if cfg.MaxRequestBodyBytes, err = ParseSize(*maxRequestBodyStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid max-request-body-bytes: %w", err))
+	}
+
+	if cfg.MaxCloneBytes, err = ParseSize(*maxCloneBytesStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid max-clone-bytes: %w", err))
+	}
+	if cfg.FilterBlobsOver, err = ParseSizeSpec(*filterBlobsOverStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid filter-blobs-over: %w", err))
+	} else if cfg.FilterBlobsOver.IsPercent() {
+		errs = append(errs, errors.New("filter-blobs-over must be an absolute size"))
+	}
+	if cfg.SpoolPackThreshold, err = ParseSize(*spoolPackThresholdStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid spool-pack-threshold: %w", err))
+	}
+
+	if cfg.MaxCloneBytesOverrides, err = parseSizeLimits(*maxCloneOverridesStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid max-clone-bytes-overrides: %w", err))
+	}
+
+	if cfg.MinClientRate, err = ParseSize(*minClientRateStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid min-client-rate: %w", err))
+	}
+	if cfg.SlowClientWindow, err = time.ParseDuration(*slowClientWindowStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid slow-client-window: %w", err))
+	} else if cfg.SlowClientWindow <= 0 {
+		errs = append(errs, errors.New("invalid slow-client-window: must be positive"))
+	}
+	if cfg.MaxRepoCount < 0 {
+		errs = append(errs, errors.New("invalid max-repo-count: must not be negative"))
+	}
+	if cfg.MaxConnections < 0 {
+		errs = append(errs, errors.New("invalid max-connections: must not be negative"))
+	}
+	if cfg.MaxUpstreamFetches < 0 {
+		errs = append(errs, errors.New("invalid max-upstream-fetches: must not be negative"))
+	}
+
+	if cfg.InfoRefsMemCacheBytes, err = ParseSize(*infoRefsMemCacheStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid info-refs-mem-cache-bytes: %w", err))
+	}
+	if cfg.CapabilitiesCacheTTL, err = time.ParseDuration(*capabilitiesCacheTTLStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid capabilities-cache-ttl: %w", err))
+	} else if cfg.CapabilitiesCacheTTL < 0 {
+		errs = append(errs, errors.New("invalid capabilities-cache-ttl: must not be negative"))
+	}
+	if cfg.DirectRepos, err = parseRepoPatterns(*directReposStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid direct-repos: %w", err))
+	}
+	if cfg.DirectInfoRefsTTL, err = time.ParseDuration(*directInfoRefsTTLStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid direct-info-refs-ttl: %w", err))
+	} else if cfg.DirectInfoRefsTTL < 0 {
+		errs = append(errs, errors.New("invalid direct-info-refs-ttl: must not be negative"))
+	}
+	if cfg.MetricsCacheTTL, err = time.ParseDuration(*metricsCacheTTLStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid metrics-cache-ttl: %w", err))
+	} else if cfg.MetricsCacheTTL < 0 {
+		errs = append(errs, errors.New("invalid metrics-cache-ttl: must not be negative"))
+	}
+
+	if cfg.CacheDirMode, err = parseMode(*cacheDirModeStr, 0o700); err != nil {
+		errs = append(errs, fmt.Errorf("invalid cache-dir-mode: %w", err))
+	}
+	if *cacheFileModeStr != "" {
+		if cfg.CacheFileMode, err = parseMode(*cacheFileModeStr, 0o600); err != nil {
+			errs = append(errs, fmt.Errorf("invalid cache-file-mode: %w", err))
 		}
 	}
 
+	if cfg.MinFreeSpace, err = ParseSizeSpec(*minFreeSpaceStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid min-free-space: %w", err))
+	}
+
 	// Parse allowed upstreams
 	for _, h := range strings.Split(*allowedUpstreamsStr, ",") {
 		h = strings.TrimSpace(h)
-		if h != "" {
-			cfg.AllowedUpstreams = append(cfg.AllowedUpstreams, h)
+		if h == "" {
+			continue
 		}
+		if err := validateUpstreamHost(h); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		cfg.AllowedUpstreams = append(cfg.AllowedUpstreams, h)
 	}
 	if len(cfg.AllowedUpstreams) == 0 {
-		return nil, errors.New("at least one allowed upstream is required")
+		errs = append(errs, errors.New("at least one allowed upstream is required"))
+	}
+	if cfg.UpstreamHostAliases, err = parseHostAliases(*hostAliasesStr, cfg.AllowedUpstreams); err != nil {
+		errs = append(errs, fmt.Errorf("invalid upstream-host-aliases: %w", err))
+	}
+	for _, h := range strings.Split(*keepGitSuffixStr, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if !slices.Contains(cfg.AllowedUpstreams, h) {
+			errs = append(errs, fmt.Errorf("invalid keep-git-suffix-hosts: %s is not an allowed upstream", h))
+			continue
+		}
+		cfg.KeepGitSuffixHosts = append(cfg.KeepGitSuffixHosts, h)
+	}
+	for _, r := range strings.Split(*warmBeforeReadyStr, ",") {
+		r = strings.Trim(strings.TrimSpace(r), "/")
+		if r == "" {
+			continue
+		}
+		parts := strings.Split(r, "/")
+		if len(parts) != 3 || slices.Contains(parts, "") || slices.Contains(parts, "..") {
+			errs = append(errs, fmt.Errorf("invalid warm-before-ready repo %q: expected host/owner/repo", r))
+			continue
+		}
+		parts[0] = cfg.UpstreamHostAliases.Canonical(parts[0])
+		if !slices.Contains(cfg.AllowedUpstreams, parts[0]) {
+			errs = append(errs, fmt.Errorf("invalid warm-before-ready repo %q: host not in allowed-upstreams", r))
+			continue
+		}
+		parts[2] = cfg.KeepGitSuffixHosts.RepoName(parts[0], parts[2])
+		cfg.WarmBeforeReady = append(cfg.WarmBeforeReady, strings.Join(parts, "/"))
+	}
+	for _, svc := range strings.Split(*allowedServicesStr, ",") {
+		svc = strings.TrimSpace(svc)
+		switch svc {
+		case "":
+		case "git-upload-pack", "git-receive-pack":
+			cfg.AllowedServices = append(cfg.AllowedServices, svc)
+		default:
+			errs = append(errs, fmt.Errorf("unknown allowed service: %s (expected git-upload-pack or git-receive-pack)", svc))
+		}
+	}
+
+	if cfg.AlternatesNetworks, err = parseRewrites(*networksStr, cfg.AllowedUpstreams); err != nil {
+		errs = append(errs, fmt.Errorf("invalid alternates-networks: %w", err))
+	}
+	if cfg.UpstreamRewrites, err = parseRewrites(*rewritesStr, cfg.AllowedUpstreams); err != nil {
+		errs = append(errs, fmt.Errorf("invalid upstream-rewrites: %w", err))
+	}
+	if cfg.MirrorRefspecs, err = parseMirrorRefspecs(*mirrorRefspecsStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid mirror-refspecs: %w", err))
+	}
+	if err := validateBranchName(cfg.DefaultBranch); err != nil {
+		errs = append(errs, fmt.Errorf("invalid default-branch: %w", err))
+	}
+
+	if cfg.UpstreamHostOverrides, err = parseHostOverrides(*hostOverridesStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid upstream-host-overrides: %w", err))
+	}
+	if cfg.MaintenanceSchedule, err = parseMaintenanceSchedule(*maintenanceScheduleStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid maintenance-schedule: %w", err))
+	}
+	if cfg.UpstreamSchemes, err = parseSchemes(*schemesStr, cfg.AllowedUpstreams); err != nil {
+		errs = append(errs, fmt.Errorf("invalid upstream-schemes: %w", err))
+	}
+	if cfg.UpstreamFallbacks, err = parseFallbacks(*fallbacksStr, cfg.AllowedUpstreams); err != nil {
+		errs = append(errs, fmt.Errorf("invalid upstream-fallbacks: %w", err))
+	}
+	if cfg.UpstreamQuotas, err = parseQuotas(*quotasStr, cfg.AllowedUpstreams); err != nil {
+		errs = append(errs, fmt.Errorf("invalid upstream-quotas: %w", err))
+	}
+	if cfg.UpstreamQuotaWindow, err = time.ParseDuration(*quotaWindowStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid upstream-quota-window: %w", err))
+	} else if cfg.UpstreamQuotaWindow <= 0 {
+		errs = append(errs, errors.New("invalid upstream-quota-window: must be positive"))
+	}
+	if cfg.UpstreamResolver != "" {
+		if _, _, err := net.SplitHostPort(cfg.UpstreamResolver); err != nil {
+			errs = append(errs, fmt.Errorf("invalid upstream-resolver: %w", err))
+		}
+	}
+	switch cfg.UpstreamIPFamily {
+	case "", "ipv4", "ipv6":
+	default:
+		errs = append(errs, fmt.Errorf("invalid upstream-ip-family %q: must be ipv4 or ipv6", cfg.UpstreamIPFamily))
+	}
+	if cfg.UpstreamFallbackDelay, err = time.ParseDuration(*fallbackDelayStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid upstream-fallback-delay: %w", err))
+	}
+
+	if cfg.AdminListenAddr != "" && cfg.AdminListenAddr == cfg.ListenAddr {
+		errs = append(errs, errors.New("admin-listen-addr must differ from listen-addr"))
+	}
+	if cfg.ReadyPath == cfg.HealthPath || cfg.ReadyPath == cfg.MetricsPath {
+		errs = append(errs, errors.New("ready-path must differ from health-path and metrics-path"))
+	}
+	if cfg.ClientAuth, err = parseClientAuth(*clientTokensStr, *clientUsersStr, *clientUpstreamTokensStr, *clientPrioritiesStr); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.ClientAuth.Enabled() {
+		// Clients' Authorization header is then meant for the proxy
+		if cfg.AuthMode == "pass-through" {
+			errs = append(errs, errors.New("client auth requires auth-mode static, hmac or none"))
+		}
+		if slices.Contains(cfg.AllowedServices, "git-receive-pack") {
+			errs = append(errs, errors.New("client auth can't be combined with git-receive-pack in allowed-services"))
+		}
+	}
+	// git:// and upload-archive hand out blobs whatever their size
+	if !cfg.FilterBlobsOver.IsZero() {
+		if cfg.EnableGitDaemon {
+			errs = append(errs, errors.New("filter-blobs-over can't be combined with enable-git-daemon"))
+		}
+		if cfg.AllowUploadArchive {
+			errs = append(errs, errors.New("filter-blobs-over can't be combined with allow-upload-archive"))
+		}
+	}
+	if cfg.ExperimentalCASStore && cfg.EnableAlternates {
+		errs = append(errs, errors.New("experimental-cas-store and enable-alternates are exclusive"))
+	}
+	if cfg.MetricsListenAddr != "" && (cfg.MetricsListenAddr == cfg.ListenAddr || cfg.MetricsListenAddr == cfg.AdminListenAddr) {
+		errs = append(errs, errors.New("metrics-listen-addr must differ from listen-addr and admin-listen-addr"))
+	}
+	if cfg.EnableGitDaemon {
+		if slices.Contains([]string{cfg.ListenAddr, cfg.AdminListenAddr, cfg.MetricsListenAddr}, cfg.GitDaemonListenAddr) {
+			errs = append(errs, errors.New("git-daemon-listen-addr must differ from listen-addr, admin-listen-addr and metrics-listen-addr"))
+		}
+		// git:// has no way to send credentials
+		if cfg.ClientAuth.Enabled() {
+			errs = append(errs, errors.New("enable-git-daemon can't be combined with client auth"))
+		}
+	}
+
+	switch cfg.CacheLock {
+	case "fail", "warn", "off":
+	default:
+		errs = append(errs, fmt.Errorf("unknown cache-lock: %s", cfg.CacheLock))
+	}
+
+	if cfg.DiskFullFallback != "passthrough" && cfg.DiskFullFallback != "fail" {
+		errs = append(errs, fmt.Errorf("unknown disk-full-fallback: %s", cfg.DiskFullFallback))
+	}
+	if cfg.AbandonedFetches != "abort" && cfg.AbandonedFetches != "finish" {
+		errs = append(errs, fmt.Errorf("unknown abandoned-fetches: %s", cfg.AbandonedFetches))
+	}
+	switch cfg.HeadRequests {
+	case "mirror", "upstream", "full":
+	default:
+		errs = append(errs, fmt.Errorf("unknown head-requests: %s", cfg.HeadRequests))
 	}
 
 	if err := validateAuth(cfg); err != nil {
-		return nil, err
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
 	}
 
 	return cfg, nil
@@ -103,11 +703,230 @@ func validateAuth(cfg *Config) error {
 			return errors.New("auth-mode=static requires STATIC_TOKEN")
 		}
 		return nil
+	case "hmac":
+		if cfg.SigningKey == "" {
+			return errors.New("auth-mode=hmac requires SIGNING_KEY")
+		}
+		if cfg.SignatureHeader == "" {
+			return errors.New("auth-mode=hmac requires SIGNATURE_HEADER")
+		}
+		return nil
 	default:
 		return fmt.Errorf("unknown auth-mode: %s", cfg.AuthMode)
 	}
 }
 
+// parseHostOverrides parses "host=ip,host=ip" into a map.
+func parseHostOverrides(s string) (map[string]string, error) {
+	overrides := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		host, ip, ok := strings.Cut(pair, "=")
+		host, ip = strings.TrimSpace(host), strings.TrimSpace(ip)
+		if !ok || host == "" {
+			return nil, fmt.Errorf("expected host=ip, got %q", pair)
+		}
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid ip %q for host %s", ip, host)
+		}
+		overrides[host] = ip
+	}
+	return overrides, nil
+}
+
+// parseSchemes parses host=scheme pairs for upstream transports. Hosts must
+// be allowed upstreams, so a typo doesn't silently fall back to https.
+func parseSchemes(s string, allowed []string) (map[string]string, error) {
+	schemes := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		host, scheme, ok := strings.Cut(pair, "=")
+		host, scheme = strings.TrimSpace(host), strings.TrimSpace(scheme)
+		if !ok || host == "" {
+			return nil, fmt.Errorf("expected host=scheme, got %q", pair)
+		}
+		if scheme != "https" && scheme != "ssh" {
+			return nil, fmt.Errorf("unknown scheme %q for host %s: expected https or ssh", scheme, host)
+		}
+		if !slices.Contains(allowed, host) {
+			return nil, fmt.Errorf("host %s is not an allowed upstream", host)
+		}
+		schemes[host] = scheme
+	}
+	return schemes, nil
+}
+
+// Fallbacks maps upstream hosts to the base URLs of mirrors of them, in the
+// order they are tried.
+type Fallbacks map[string][]string
+
+// parseFallbacks parses comma-separated host=url pairs, a host's URLs kept in
+// the order given.
+func parseFallbacks(s string, allowed []string) (Fallbacks, error) {
+	fallbacks := Fallbacks{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		host, base, ok := strings.Cut(pair, "=")
+		host, base = strings.TrimSpace(host), strings.TrimRight(strings.TrimSpace(base), "/")
+		if !ok || host == "" {
+			return nil, fmt.Errorf("expected host=url, got %q", pair)
+		}
+		if u, err := url.Parse(base); err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "ssh" && u.Scheme != "file") || (u.Host == "" && u.Scheme != "file") {
+			return nil, fmt.Errorf("fallback %q for host %s must be an http(s), ssh or file URL", base, host)
+		}
+		if !slices.Contains(allowed, host) {
+			return nil, fmt.Errorf("host %s is not an allowed upstream", host)
+		}
+		fallbacks[host] = append(fallbacks[host], base)
+	}
+	return fallbacks, nil
+}
+
+// MaintenanceTasks are the git maintenance tasks that can be scheduled on
+// mirrors. gc and prefetch are left out: full repacks are the eviction
+// freezer's and sync's business.
+var MaintenanceTasks = []string{"commit-graph", "incremental-repack", "loose-objects", "pack-refs"}
+
+// parseMaintenanceSchedule parses comma-separated task=interval pairs.
+func parseMaintenanceSchedule(s string) (map[string]time.Duration, error) {
+	schedule := map[string]time.Duration{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		task, every, ok := strings.Cut(pair, "=")
+		task, every = strings.TrimSpace(task), strings.TrimSpace(every)
+		if !ok || task == "" {
+			return nil, fmt.Errorf("expected task=interval, got %q", pair)
+		}
+		if !slices.Contains(MaintenanceTasks, task) {
+			return nil, fmt.Errorf("unknown task %q: expected one of %s", task, strings.Join(MaintenanceTasks, ", "))
+		}
+		d, err := time.ParseDuration(every)
+		if err != nil {
+			return nil, fmt.Errorf("task %s: %w", task, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("task %s: interval must be positive", task)
+		}
+		schedule[task] = d
+	}
+	return schedule, nil
+}
+
+// RequestClasses are the classes of requests RequestTimeouts bound: info/refs
+// and dumb HTTP, packs (upload-pack, upload-archive and pushes), the admin
+// API and metrics.
+var RequestClasses = []string{"info", "pack", "admin", "metrics"}
+
+// parseRequestTimeouts parses comma-separated class=deadline pairs, where a
+// zero deadline means none.
+func parseRequestTimeouts(s string) (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		class, deadline, ok := strings.Cut(pair, "=")
+		class, deadline = strings.TrimSpace(class), strings.TrimSpace(deadline)
+		if !ok || class == "" {
+			return nil, fmt.Errorf("expected class=deadline, got %q", pair)
+		}
+		if !slices.Contains(RequestClasses, class) {
+			return nil, fmt.Errorf("unknown class %q: expected one of %s", class, strings.Join(RequestClasses, ", "))
+		}
+		d, err := time.ParseDuration(deadline)
+		if err != nil {
+			return nil, fmt.Errorf("class %s: %w", class, err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("class %s: deadline must not be negative", class)
+		}
+		if d > 0 {
+			timeouts[class] = d
+		}
+	}
+	return timeouts, nil
+}
+
+// parseMode parses an octal permission mode, which must grant the proxy
+// (owner) at least the bits in required.
+func parseMode(s string, required os.FileMode) (os.FileMode, error) {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0o777 {
+		return 0, fmt.Errorf("expected an octal mode like 0750, got %q", s)
+	}
+	mode := os.FileMode(n)
+	if mode&required != required {
+		return 0, fmt.Errorf("mode %04o must include %04o for the proxy itself", n, required)
+	}
+	return mode, nil
+}
+
+// parseBasePath normalizes a path prefix to "/segment[/segment...]" without
+// a trailing slash, or "" for the root.
+func parseBasePath(p string) (string, error) {
+	p = strings.TrimSuffix(p, "/")
+	if p == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(p, "/") || strings.ContainsAny(p, "?#% ") {
+		return "", fmt.Errorf("%q: expected a path like /git", p)
+	}
+	for _, seg := range strings.Split(p[1:], "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return "", fmt.Errorf("%q: expected a path like /git", p)
+		}
+	}
+	return p, nil
+}
+
+// validateRefPattern accepts a full ref name or a namespace ending in "/*",
+// which is what git's transfer.hideRefs can express.
+func validateRefPattern(p string) error {
+	name := strings.TrimSuffix(p, "/*")
+	if !strings.HasPrefix(name, "refs/") || name == "refs/" || strings.HasSuffix(name, "/") || strings.ContainsAny(name, "*?[\\ ") {
+		return fmt.Errorf("%q: expected a ref name or a namespace like refs/pull/*", p)
+	}
+	return nil
+}
+
+// validateBranchName accepts branch names (main, release/v1) git would take,
+// or an empty one.
+func validateBranchName(name string) error {
+	if name == "" {
+		return nil
+	}
+	if strings.HasPrefix(name, "-") || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") || strings.HasPrefix(name, "refs/") ||
+		strings.HasSuffix(name, ".lock") || strings.Contains(name, "..") || strings.Contains(name, "//") || strings.ContainsAny(name, " ~^:?*[\\") {
+		return fmt.Errorf("%q: expected a branch name like main", name)
+	}
+	return nil
+}
+
+// parsePrefix parses a CIDR, treating a bare IP as a single-address prefix.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
+
 func envOrDefault(key, def string) string {
 	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
 		return v
@@ -140,3 +959,8 @@ func envOrDefaultInt(key string, def int) int {
 	}
 	return def
 }
+
+// MirrorDirs returns every mirror root: MirrorDir, then MirrorExtraDirs.
+func (c *Config) MirrorDirs() []string {
+	return append([]string{c.MirrorDir}, c.MirrorExtraDirs...)
+}
@@ -2,6 +2,8 @@ package config
 
 import (
 	"os"
+	"reflect"
+	"slices"
 	"testing"
 	"time"
 )
@@ -21,6 +23,9 @@ func TestDefaults(t *testing.T) {
 	if cfg.SyncStaleAfter != 2*time.Second {
 		t.Fatalf("sync stale after default mismatch: %v", cfg.SyncStaleAfter)
 	}
+	if cfg.MaxRequestBodyBytes != 64<<20 {
+		t.Fatalf("max request body default mismatch: %d", cfg.MaxRequestBodyBytes)
+	}
 }
 
 func TestStaticAuthRequiresToken(t *testing.T) {
@@ -31,6 +36,20 @@ func TestStaticAuthRequiresToken(t *testing.T) {
 	}
 }
 
+func TestHMACAuth(t *testing.T) {
+	clearEnv(t)
+	if _, err := LoadArgs([]string{"-auth-mode=hmac"}); err == nil {
+		t.Fatalf("expected error when signing key missing")
+	}
+	cfg, err := LoadArgs([]string{"-auth-mode=hmac", "-signing-key=secret"})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.SigningKey != "secret" || cfg.SignatureHeader != "X-Signature" {
+		t.Fatalf("expected key and default header, got %q %q", cfg.SigningKey, cfg.SignatureHeader)
+	}
+}
+
 func TestEnvOverrides(t *testing.T) {
 	clearEnv(t)
 	t.Setenv("SYNC_STALE_AFTER", "5s")
@@ -80,7 +99,7 @@ func TestMirrorMaxSizeDefault(t *testing.T) {
 	if err != nil {
 		t.Fatalf("load: %v", err)
 	}
-	// Default should be zero (means 80% of available disk)
+	// Default should be zero (means 80% of the disk)
 	if !cfg.MirrorMaxSize.IsZero() {
 		t.Fatalf("expected MirrorMaxSize to be zero (default), got %+v", cfg.MirrorMaxSize)
 	}
@@ -89,10 +108,797 @@ func TestMirrorMaxSizeDefault(t *testing.T) {
 func clearEnv(t *testing.T) {
 	t.Helper()
 	for _, k := range []string{
-		"LISTEN_ADDR", "MIRROR_DIR", "MIRROR_MAX_SIZE", "SYNC_STALE_AFTER", "ALLOWED_UPSTREAMS", "LOG_LEVEL",
-		"AUTH_MODE", "STATIC_TOKEN",
-		"SERIALIZE_UPLOAD_PACK", "UPLOAD_PACK_THREADS", "MAINTAIN_AFTER_SYNC", "MAINTENANCE_REPO",
+		"LISTEN_ADDR", "ADMIN_LISTEN_ADDR", "ENABLE_GIT_DAEMON", "GIT_DAEMON_LISTEN_ADDR", "METRICS_LISTEN_ADDR", "METRICS_AUTH_TOKEN", "METRICS_CACHE_TTL", "CLIENT_AUTH_TOKENS", "CLIENT_AUTH_USERS", "CLIENT_AUTH_UPSTREAM_TOKENS", "CLIENT_AUTH_PRIORITIES", "MIRROR_DIR", "MIRROR_TEMP_DIR", "MIRROR_EXTRA_DIRS", "MIRROR_FOLLOW_SYMLINKS", "GIT_BINARY", "GIT_ENV", "MIRROR_MAX_SIZE", "MIN_FREE_SPACE", "MAX_REPO_COUNT", "CACHE_LOCK", "CACHE_DIR_MODE", "CACHE_FILE_MODE", "SYNC_STALE_AFTER", "STALE_WHILE_REVALIDATE", "GIT_KILLED_BACKOFF", "EVICTION_FREEZE_FOR", "MIN_AGE_BEFORE_EVICT", "EVICT_HIGH_WATERMARK", "EVICT_LOW_WATERMARK", "EVICTION_INTERVAL", "EVICTION_SIZES", "CACHE_MAX_AGE", "VERIFY_INTERVAL", "VERIFY_SAMPLE_RATE", "ALLOWED_UPSTREAMS", "ALLOWED_SERVICES", "LOG_LEVEL", "ACCESS_LOG_SAMPLE_RATE", "ACCESS_LOG_SLOW_THRESHOLD", "SLOW_REQUEST_THRESHOLD",
+		"AUTH_MODE", "STATIC_TOKEN", "SIGNING_KEY", "SIGNATURE_HEADER", "CONFIG_FILE", "CACHE_CONTROL", "BASE_PATH", "LANDING_PAGE_FILE", "READY_PATH", "WARM_BEFORE_READY", "MAX_REQUEST_BODY_BYTES", "MAX_CLONE_BYTES", "MAX_CLONE_BYTES_OVERRIDES", "FILTER_BLOBS_OVER", "MAX_CONNECTIONS", "MAX_UPSTREAM_FETCHES", "MIN_CLIENT_RATE", "SLOW_CLIENT_WINDOW", "REQUEST_TIMEOUTS", "INFO_REFS_MEM_CACHE_BYTES", "CAPABILITIES_CACHE_TTL", "DIRECT_REPOS", "DIRECT_INFO_REFS_TTL",
+		"UPSTREAM_HOST_OVERRIDES", "UPSTREAM_HOST_ALIASES", "KEEP_GIT_SUFFIX_HOSTS", "UPSTREAM_RESOLVER", "UPSTREAM_IP_FAMILY", "UPSTREAM_FALLBACK_DELAY", "UPSTREAM_SCHEMES", "UPSTREAM_FALLBACKS", "UPSTREAM_QUOTAS", "UPSTREAM_QUOTA_WINDOW", "UPSTREAM_SSH_USER", "UPSTREAM_SSH_KEY", "UPSTREAM_SSH_KNOWN_HOSTS", "UPSTREAM_REWRITES", "MIRROR_REFSPECS", "DEFAULT_BRANCH", "STRIP_REF_PATTERNS", "UPSTREAM_TIMEOUT", "UPSTREAM_INFO_TIMEOUT", "UPSTREAM_PACK_TIMEOUT", "UPSTREAM_TRACING", "FOLLOW_UPSTREAM_REDIRECTS", "PEER_PROXIES", "TRUSTED_PROXY_CIDRS",
+		"SERIALIZE_UPLOAD_PACK", "UPLOAD_PACK_THREADS", "MAINTAIN_AFTER_SYNC", "MAINTAIN_COMMIT_GRAPH", "SKIP_CURRENT_SYNCS", "SYNC_EMPTY_REPOS", "SERVE_STALE_ON_UPSTREAM_ERROR", "CACHE_PINNED_PACKS", "ALLOW_UPLOAD_ARCHIVE", "CACHE_UPLOAD_ARCHIVES", "CACHE_CHECKSUMS", "ENABLE_ALTERNATES", "EXPERIMENTAL_CAS_STORE", "ALTERNATES_NETWORKS", "PREWARM_SUBMODULES", "DISK_FULL_FALLBACK", "ABANDONED_FETCHES", "HEAD_REQUESTS", "SPOOL_LARGE_PACKS_TO_DISK", "SPOOL_PACK_THRESHOLD", "VERIFY_PACKS", "MAINTENANCE_REPO", "MAINTENANCE_SCHEDULE",
 	} {
 		_ = os.Unsetenv(k)
 	}
 }
+
+func TestUpstreamHostOverrides(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("UPSTREAM_HOST_OVERRIDES", "github.com=10.0.0.5, gitlab.com=::1")
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.UpstreamHostOverrides["github.com"] != "10.0.0.5" || cfg.UpstreamHostOverrides["gitlab.com"] != "::1" {
+		t.Fatalf("unexpected overrides: %v", cfg.UpstreamHostOverrides)
+	}
+
+	for _, bad := range []string{"github.com", "github.com=not-an-ip", "=10.0.0.5"} {
+		if _, err := LoadArgs([]string{"-upstream-host-overrides", bad}); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestUpstreamSchemes(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("ALLOWED_UPSTREAMS", "github.com,git.internal:2222")
+	t.Setenv("UPSTREAM_SCHEMES", "git.internal:2222=ssh, github.com=https")
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.UpstreamSchemes["git.internal:2222"] != "ssh" || cfg.UpstreamSchemes["github.com"] != "https" || cfg.UpstreamSSHUser != "git" {
+		t.Fatalf("unexpected schemes: %v, user %q", cfg.UpstreamSchemes, cfg.UpstreamSSHUser)
+	}
+
+	for _, bad := range []string{"git.internal:2222", "git.internal:2222=git", "gitlab.com=ssh"} {
+		if _, err := LoadArgs([]string{"-upstream-schemes", bad}); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestUpstreamFallbacks(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("UPSTREAM_FALLBACKS", "github.com=https://git-mirror.corp/github.com/, github.com=ssh://git@backup.corp/github")
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	want := []string{"https://git-mirror.corp/github.com", "ssh://git@backup.corp/github"}
+	if !slices.Equal(cfg.UpstreamFallbacks["github.com"], want) {
+		t.Fatalf("unexpected fallbacks: %v", cfg.UpstreamFallbacks)
+	}
+
+	for _, bad := range []string{"github.com", "github.com=git-mirror.corp", "github.com=ftp://git-mirror.corp", "gitlab.com=https://git-mirror.corp"} {
+		if _, err := LoadArgs([]string{"-upstream-fallbacks", bad}); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestUpstreamQuotas(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("ALLOWED_UPSTREAMS", "github.com,gitlab.com")
+	t.Setenv("UPSTREAM_QUOTAS", "github.com=500GiB/20000, gitlab.com=10GiB")
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got := cfg.UpstreamQuotas["github.com"]; got != (Quota{Bytes: 500 << 30, Fetches: 20000}) {
+		t.Fatalf("unexpected github.com quota: %+v", got)
+	}
+	if got := cfg.UpstreamQuotas["gitlab.com"]; got != (Quota{Bytes: 10 << 30}) {
+		t.Fatalf("unexpected gitlab.com quota: %+v", got)
+	}
+	if cfg.UpstreamQuotaWindow != 24*time.Hour {
+		t.Fatalf("expected daily quota windows by default, got %v", cfg.UpstreamQuotaWindow)
+	}
+
+	for _, args := range [][]string{
+		{"-upstream-quotas", "github.com"},
+		{"-upstream-quotas", "bitbucket.org=1GiB"},
+		{"-upstream-quotas", "github.com=lots"},
+		{"-upstream-quotas", "github.com=1GiB/many"},
+		{"-upstream-quota-window", "0s"},
+	} {
+		if _, err := LoadArgs(args); err == nil {
+			t.Errorf("expected error for %v", args)
+		}
+	}
+}
+
+func TestPeerProxies(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("PEER_PROXIES", "http://proxy-a:8080/, https://proxy-b")
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(cfg.PeerProxies) != 2 || cfg.PeerProxies[0] != "http://proxy-a:8080" || cfg.PeerProxies[1] != "https://proxy-b" {
+		t.Fatalf("unexpected peer proxies: %v", cfg.PeerProxies)
+	}
+
+	for _, bad := range []string{"proxy-a:8080", "ftp://proxy-a"} {
+		if _, err := LoadArgs([]string{"-peer-proxies", bad}); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestGitBinaryAndEnv(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.GitBinary != "git" || len(cfg.GitEnv) != 0 {
+		t.Fatalf("unexpected defaults: %q %v", cfg.GitBinary, cfg.GitEnv)
+	}
+
+	t.Setenv("GIT_BINARY", "/opt/git/bin/git")
+	t.Setenv("GIT_ENV", "GIT_CONFIG_GLOBAL=/etc/proxy/gitconfig, GIT_SSL_CAINFO=/etc/ssl/ca.pem")
+	cfg, err = LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.GitBinary != "/opt/git/bin/git" {
+		t.Fatalf("unexpected git binary: %q", cfg.GitBinary)
+	}
+	if len(cfg.GitEnv) != 2 || cfg.GitEnv[0] != "GIT_CONFIG_GLOBAL=/etc/proxy/gitconfig" || cfg.GitEnv[1] != "GIT_SSL_CAINFO=/etc/ssl/ca.pem" {
+		t.Fatalf("unexpected git env: %v", cfg.GitEnv)
+	}
+
+	for _, bad := range []string{"GIT_TRACE", "=1", "GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=http.proxy"} {
+		if _, err := LoadArgs([]string{"-git-env", bad}); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestStripRefPatterns(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("STRIP_REF_PATTERNS", "refs/pull/*, refs/internal/secret")
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(cfg.StripRefPatterns) != 2 || cfg.StripRefPatterns[0] != "refs/pull/*" || cfg.StripRefPatterns[1] != "refs/internal/secret" {
+		t.Fatalf("unexpected strip ref patterns: %v", cfg.StripRefPatterns)
+	}
+
+	for _, bad := range []string{"pull/*", "refs/*", "refs/pull/*/merge", "refs/heads/release-*", "refs/pull/"} {
+		if _, err := LoadArgs([]string{"-strip-ref-patterns", bad}); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestTrustedProxyCIDRs(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("TRUSTED_PROXY_CIDRS", "10.0.0.0/8, 192.168.1.7, fd00::/8")
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(cfg.TrustedProxyCIDRs) != 3 || cfg.TrustedProxyCIDRs[1].String() != "192.168.1.7/32" {
+		t.Fatalf("unexpected trusted proxies: %v", cfg.TrustedProxyCIDRs)
+	}
+	if _, err := LoadArgs([]string{"-trusted-proxy-cidrs", "10.0.0.0/33"}); err == nil {
+		t.Fatalf("expected error for invalid CIDR")
+	}
+}
+
+func TestClientLimits(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("MAX_CONNECTIONS", "500")
+	t.Setenv("MIN_CLIENT_RATE", "16KiB")
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.MaxConnections != 500 || cfg.MinClientRate != 16<<10 || cfg.SlowClientWindow != 30*time.Second {
+		t.Fatalf("unexpected client limits: %d %d %v", cfg.MaxConnections, cfg.MinClientRate, cfg.SlowClientWindow)
+	}
+	for _, args := range [][]string{
+		{"-max-connections", "-1"},
+		{"-max-upstream-fetches", "-1"},
+		{"-min-client-rate", "fast"},
+		{"-slow-client-window", "0"},
+	} {
+		if _, err := LoadArgs(args); err == nil {
+			t.Errorf("expected error for %v", args)
+		}
+	}
+}
+
+func TestUpstreamTimeouts(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("UPSTREAM_TIMEOUT", "30s")
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.UpstreamInfoTimeout != 30*time.Second || cfg.UpstreamPackTimeout != 30*time.Second {
+		t.Fatalf("expected both timeouts to default to the upstream timeout, got %v and %v", cfg.UpstreamInfoTimeout, cfg.UpstreamPackTimeout)
+	}
+	t.Setenv("UPSTREAM_PACK_TIMEOUT", "30m")
+	if cfg, err = LoadArgs([]string{"-upstream-info-timeout", "0"}); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.UpstreamInfoTimeout != 0 || cfg.UpstreamPackTimeout != 30*time.Minute {
+		t.Fatalf("unexpected timeouts: %v and %v", cfg.UpstreamInfoTimeout, cfg.UpstreamPackTimeout)
+	}
+	if _, err := LoadArgs([]string{"-upstream-pack-timeout", "long"}); err == nil {
+		t.Fatalf("expected error for invalid upstream-pack-timeout")
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	clearEnv(t)
+	for in, want := range map[string]string{"": "", "/": "", "/git": "/git", "/git/": "/git", "/a/b": "/a/b"} {
+		cfg, err := LoadArgs([]string{"-base-path", in})
+		if err != nil {
+			t.Fatalf("base path %q: %v", in, err)
+		}
+		if cfg.BasePath != want {
+			t.Errorf("base path %q: got %q, want %q", in, cfg.BasePath, want)
+		}
+	}
+	for _, in := range []string{"git", "/a//b", "/a/../b", "/git?x"} {
+		if _, err := LoadArgs([]string{"-base-path", in}); err == nil {
+			t.Errorf("expected error for base path %q", in)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.VerifySampleRate != 0 || cfg.VerifyInterval != time.Hour {
+		t.Fatalf("expected verification disabled by default, got %v every %v", cfg.VerifySampleRate, cfg.VerifyInterval)
+	}
+	t.Setenv("VERIFY_SAMPLE_RATE", "0.05")
+	if cfg, err = LoadArgs([]string{"-verify-interval", "10m"}); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.VerifySampleRate != 0.05 || cfg.VerifyInterval != 10*time.Minute {
+		t.Fatalf("unexpected verification settings: %v every %v", cfg.VerifySampleRate, cfg.VerifyInterval)
+	}
+	for _, args := range [][]string{
+		{"-verify-sample-rate", "1.5"},
+		{"-verify-sample-rate", "-0.1"},
+		{"-verify-sample-rate", "some"},
+		{"-verify-interval", "0"},
+	} {
+		if _, err := LoadArgs(args); err == nil {
+			t.Errorf("expected error for %v", args)
+		}
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.AccessLogSampleRate != 1 || cfg.AccessLogSlowThreshold != time.Second {
+		t.Fatalf("expected every request logged by default, got %v (slow above %v)", cfg.AccessLogSampleRate, cfg.AccessLogSlowThreshold)
+	}
+	t.Setenv("ACCESS_LOG_SAMPLE_RATE", "0.01")
+	if cfg, err = LoadArgs([]string{"-access-log-slow-threshold", "250ms"}); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.AccessLogSampleRate != 0.01 || cfg.AccessLogSlowThreshold != 250*time.Millisecond {
+		t.Fatalf("unexpected access log settings: %v (slow above %v)", cfg.AccessLogSampleRate, cfg.AccessLogSlowThreshold)
+	}
+	for _, args := range [][]string{
+		{"-access-log-sample-rate", "2"},
+		{"-access-log-sample-rate", "-1"},
+		{"-access-log-slow-threshold", "slow"},
+	} {
+		if _, err := LoadArgs(args); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+func TestEvictWatermarks(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.EvictHighWatermark != 100 || cfg.EvictLowWatermark != 90 {
+		t.Fatalf("expected eviction from 100%% down to 90%% by default, got %v%% and %v%%", cfg.EvictHighWatermark, cfg.EvictLowWatermark)
+	}
+	t.Setenv("EVICT_HIGH_WATERMARK", "95")
+	if cfg, err = LoadArgs([]string{"-evict-low-watermark", "70.5"}); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.EvictHighWatermark != 95 || cfg.EvictLowWatermark != 70.5 {
+		t.Fatalf("unexpected watermarks: %v%% and %v%%", cfg.EvictHighWatermark, cfg.EvictLowWatermark)
+	}
+	for _, args := range [][]string{
+		{"-evict-low-watermark", "95"},
+		{"-evict-low-watermark", "96"},
+		{"-evict-low-watermark", "0"},
+		{"-evict-high-watermark", "101"},
+		{"-evict-high-watermark", "high"},
+	} {
+		if _, err := LoadArgs(args); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+func TestMaintenanceSchedule(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(cfg.MaintenanceSchedule) != 0 {
+		t.Fatalf("expected no scheduled maintenance by default, got %v", cfg.MaintenanceSchedule)
+	}
+	t.Setenv("MAINTENANCE_SCHEDULE", "commit-graph=1h, incremental-repack=24h")
+	if cfg, err = LoadArgs([]string{}); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	want := map[string]time.Duration{"commit-graph": time.Hour, "incremental-repack": 24 * time.Hour}
+	if !reflect.DeepEqual(cfg.MaintenanceSchedule, want) {
+		t.Fatalf("expected %v, got %v", want, cfg.MaintenanceSchedule)
+	}
+	for _, v := range []string{"gc=1h", "commit-graph", "commit-graph=often", "pack-refs=0"} {
+		if _, err := LoadArgs([]string{"-maintenance-schedule", v}); err == nil {
+			t.Fatalf("expected error for %q", v)
+		}
+	}
+}
+
+func TestAdminListenAddr(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.AdminListenAddr != "" {
+		t.Fatalf("expected admin API disabled by default, got %q", cfg.AdminListenAddr)
+	}
+	if _, err := LoadArgs([]string{"-admin-listen-addr", ":8080"}); err == nil {
+		t.Fatalf("expected error when admin and main listen addresses collide")
+	}
+}
+
+func TestMetricsListenAddr(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadArgs([]string{"-metrics-listen-addr", "127.0.0.1:9090"})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.MetricsListenAddr != "127.0.0.1:9090" {
+		t.Fatalf("unexpected metrics listen addr %q", cfg.MetricsListenAddr)
+	}
+	for _, args := range [][]string{
+		{"-metrics-listen-addr", ":8080"},
+		{"-metrics-listen-addr", ":8081", "-admin-listen-addr", ":8081"},
+	} {
+		if _, err := LoadArgs(args); err == nil {
+			t.Errorf("expected error for %v", args)
+		}
+	}
+}
+
+func TestGitDaemon(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadArgs([]string{"-enable-git-daemon"})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !cfg.EnableGitDaemon || cfg.GitDaemonListenAddr != ":9418" {
+		t.Fatalf("unexpected git daemon config %v %q", cfg.EnableGitDaemon, cfg.GitDaemonListenAddr)
+	}
+	for _, args := range [][]string{
+		{"-enable-git-daemon", "-git-daemon-listen-addr", ":8080"},
+		{"-enable-git-daemon", "-auth-mode", "static", "-static-token", "t", "-client-auth-tokens", "secret"},
+	} {
+		if _, err := LoadArgs(args); err == nil {
+			t.Errorf("expected error for %v", args)
+		}
+	}
+}
+
+func TestUpstreamIPFamily(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("UPSTREAM_IP_FAMILY", "ipv4")
+	t.Setenv("UPSTREAM_FALLBACK_DELAY", "-1ms")
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.UpstreamIPFamily != "ipv4" || cfg.UpstreamFallbackDelay >= 0 {
+		t.Fatalf("unexpected upstream dialing config %q %v", cfg.UpstreamIPFamily, cfg.UpstreamFallbackDelay)
+	}
+	for _, args := range [][]string{
+		{"-upstream-ip-family", "tcp4"},
+		{"-upstream-fallback-delay", "soon"},
+	} {
+		if _, err := LoadArgs(args); err == nil {
+			t.Errorf("expected error for %v", args)
+		}
+	}
+}
+
+func TestWarmBeforeReady(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("WARM_BEFORE_READY", "github.com/owner/repo.git, github.com/owner/other")
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if want := []string{"github.com/owner/repo", "github.com/owner/other"}; !slices.Equal(cfg.WarmBeforeReady, want) || cfg.ReadyPath != "/readyz" {
+		t.Fatalf("expected %v warmed before %s, got %v before %s", want, "/readyz", cfg.WarmBeforeReady, cfg.ReadyPath)
+	}
+	for _, args := range [][]string{
+		{"-warm-before-ready", "github.com/owner"},
+		{"-warm-before-ready", "gitlab.com/owner/repo"},
+		{"-ready-path", "/healthz"},
+	} {
+		if _, err := LoadArgs(args); err == nil {
+			t.Errorf("expected error for %v", args)
+		}
+	}
+}
+
+func TestHostAliases(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("UPSTREAM_HOST_ALIASES", "www.github.com=github.com, 140.82.112.3=github.com")
+	t.Setenv("WARM_BEFORE_READY", "www.github.com/owner/repo")
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	for host, want := range map[string]string{"www.github.com": "github.com", "140.82.112.3": "github.com", "github.com": "github.com", "gitlab.com": "gitlab.com"} {
+		if got := cfg.UpstreamHostAliases.Canonical(host); got != want {
+			t.Errorf("Canonical(%s) = %s, want %s", host, got, want)
+		}
+	}
+	if want := []string{"github.com/owner/repo"}; !slices.Equal(cfg.WarmBeforeReady, want) {
+		t.Fatalf("expected aliases resolved in %v, got %v", want, cfg.WarmBeforeReady)
+	}
+	t.Setenv("WARM_BEFORE_READY", "")
+	for _, aliases := range []string{"www.github.com", "www.github.com=gitlab.com", "github.com=github.com", "https://www.github.com=github.com"} {
+		if _, err := LoadArgs([]string{"-upstream-host-aliases", aliases}); err == nil {
+			t.Errorf("expected error for %q", aliases)
+		}
+	}
+}
+
+func TestExperimentalCASStore(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("EXPERIMENTAL_CAS_STORE", "true")
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !cfg.ExperimentalCASStore {
+		t.Fatalf("expected CAS store enabled")
+	}
+	if _, err := LoadArgs([]string{"-enable-alternates"}); err == nil {
+		t.Fatalf("expected error for CAS store with per-network alternates")
+	}
+}
+
+func TestCacheModes(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.CacheDirMode != 0o755 || cfg.CacheFileMode != 0 {
+		t.Fatalf("expected default modes, got %v %v", cfg.CacheDirMode, cfg.CacheFileMode)
+	}
+
+	t.Setenv("CACHE_DIR_MODE", "0750")
+	t.Setenv("CACHE_FILE_MODE", "640")
+	if cfg, err = LoadArgs([]string{}); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.CacheDirMode != 0o750 || cfg.CacheFileMode != 0o640 {
+		t.Fatalf("expected configured modes, got %v %v", cfg.CacheDirMode, cfg.CacheFileMode)
+	}
+
+	for _, args := range [][]string{
+		{"-cache-dir-mode", "rwxr-x---"},
+		{"-cache-dir-mode", "01777"},
+		{"-cache-dir-mode", "0550"}, // proxy couldn't create mirrors
+		{"-cache-file-mode", "0440"},
+	} {
+		if _, err := LoadArgs(args); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("STALE_WHILE_REVALIDATE", "5m")
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.StaleWhileRevalidate != 5*time.Minute {
+		t.Fatalf("expected 5m stale-while-revalidate, got %v", cfg.StaleWhileRevalidate)
+	}
+	for _, v := range []string{"-1s", "soon"} {
+		if _, err := LoadArgs([]string{"-stale-while-revalidate", v}); err == nil {
+			t.Errorf("expected error for %q", v)
+		}
+	}
+}
+
+func TestKeepGitSuffixHosts(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("ALLOWED_UPSTREAMS", "github.com,git.internal")
+	t.Setenv("KEEP_GIT_SUFFIX_HOSTS", "git.internal")
+	t.Setenv("WARM_BEFORE_READY", "github.com/owner/repo.git,git.internal/owner/repo.git")
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	for _, tt := range []struct{ host, repo, want string }{
+		{"github.com", "repo.git", "repo"},
+		{"github.com", "repo", "repo"},
+		{"git.internal", "repo.git", "repo.git"},
+		{"git.internal", "repo", "repo"},
+	} {
+		if got := cfg.KeepGitSuffixHosts.RepoName(tt.host, tt.repo); got != tt.want {
+			t.Errorf("RepoName(%q, %q) = %q, want %q", tt.host, tt.repo, got, tt.want)
+		}
+	}
+	if want := []string{"github.com/owner/repo", "git.internal/owner/repo.git"}; !slices.Equal(cfg.WarmBeforeReady, want) {
+		t.Fatalf("expected %v warmed, got %v", want, cfg.WarmBeforeReady)
+	}
+	if _, err := LoadArgs([]string{"-keep-git-suffix-hosts", "gitlab.com"}); err == nil {
+		t.Errorf("expected error for a host not allowed")
+	}
+}
+
+func TestGitKilledBackoff(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.GitKilledBackoff != time.Minute {
+		t.Fatalf("expected 1m git-killed-backoff by default, got %v", cfg.GitKilledBackoff)
+	}
+	for _, v := range []string{"-1s", "soon"} {
+		if _, err := LoadArgs([]string{"-git-killed-backoff", v}); err == nil {
+			t.Errorf("expected error for %q", v)
+		}
+	}
+}
+
+func TestCapabilitiesCacheTTL(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("CAPABILITIES_CACHE_TTL", "1h")
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.CapabilitiesCacheTTL != time.Hour {
+		t.Fatalf("expected 1h capabilities cache, got %v", cfg.CapabilitiesCacheTTL)
+	}
+	for _, v := range []string{"-1s", "soon"} {
+		if _, err := LoadArgs([]string{"-capabilities-cache-ttl", v}); err == nil {
+			t.Errorf("expected error for %q", v)
+		}
+	}
+}
+
+func TestFilterBlobsOver(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("FILTER_BLOBS_OVER", "10MiB")
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.FilterBlobsOver.Bytes != 10<<20 {
+		t.Fatalf("expected 10MiB blob filter, got %+v", cfg.FilterBlobsOver)
+	}
+	for _, args := range [][]string{
+		{"-filter-blobs-over", "5%"},
+		{"-enable-git-daemon"},
+		{"-allow-upload-archive"},
+	} {
+		if _, err := LoadArgs(args); err == nil {
+			t.Errorf("expected error for %v", args)
+		}
+	}
+}
+
+func TestRequestTimeouts(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	want := map[string]time.Duration{"admin": time.Minute, "metrics": 10 * time.Second}
+	if !reflect.DeepEqual(cfg.RequestTimeouts, want) {
+		t.Fatalf("expected default deadlines %v, got %v", want, cfg.RequestTimeouts)
+	}
+
+	t.Setenv("REQUEST_TIMEOUTS", "info=30s, pack=0, metrics=5s")
+	if cfg, err = LoadArgs([]string{}); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	want = map[string]time.Duration{"info": 30 * time.Second, "metrics": 5 * time.Second}
+	if !reflect.DeepEqual(cfg.RequestTimeouts, want) {
+		t.Fatalf("expected %v, got %v", want, cfg.RequestTimeouts)
+	}
+	for _, v := range []string{"push=1m", "info", "info=-1s", "info=soon"} {
+		if _, err := LoadArgs([]string{"-request-timeouts", v}); err == nil {
+			t.Errorf("expected error for %q", v)
+		}
+	}
+}
+
+func TestDirectRepos(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("DIRECT_REPOS", `github\.com/acme/.*-scratch  github\.com/oneoff/tool`)
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	for path, want := range map[string]bool{
+		"github.com/acme/ci-scratch":       true,
+		"github.com/oneoff/tool":           true,
+		"github.com/oneoff/tool-fork":      false,
+		"mirror.github.com/acme/x-scratch": false,
+	} {
+		if got := cfg.DirectRepos.Match(path); got != want {
+			t.Errorf("match %s: expected %v, got %v", path, want, got)
+		}
+	}
+	if cfg.DirectInfoRefsTTL != 5*time.Second {
+		t.Fatalf("expected 5s default direct info/refs TTL, got %v", cfg.DirectInfoRefsTTL)
+	}
+	for _, args := range [][]string{
+		{"-direct-repos", "github.com/(acme"},
+		{"-direct-info-refs-ttl", "-1s"},
+	} {
+		if _, err := LoadArgs(args); err == nil {
+			t.Errorf("expected error for %v", args)
+		}
+	}
+}
+
+func TestAbandonedFetches(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.AbandonedFetches != "abort" {
+		t.Fatalf("expected abandoned fetches aborted by default, got %q", cfg.AbandonedFetches)
+	}
+	t.Setenv("ABANDONED_FETCHES", "finish")
+	if cfg, err = LoadArgs([]string{}); err != nil || cfg.AbandonedFetches != "finish" {
+		t.Fatalf("expected finish, got %+v (%v)", cfg, err)
+	}
+	if _, err := LoadArgs([]string{"-abandoned-fetches", "drain"}); err == nil {
+		t.Fatal("expected error for unknown abandoned-fetches")
+	}
+}
+
+func TestDefaultBranch(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.DefaultBranch != "main" {
+		t.Fatalf("expected main by default, got %q", cfg.DefaultBranch)
+	}
+	for _, name := range []string{"", "master", "release/v1"} {
+		if cfg, err := LoadArgs([]string{"-default-branch", name}); err != nil || cfg.DefaultBranch != name {
+			t.Fatalf("expected %q accepted, got %+v (%v)", name, cfg, err)
+		}
+	}
+	for _, name := range []string{"refs/heads/main", "-main", "a..b", "a b", "main.lock", "main/"} {
+		if _, err := LoadArgs([]string{"-default-branch", name}); err == nil {
+			t.Fatalf("expected error for %q", name)
+		}
+	}
+}
+
+func TestEvictionSizes(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.EvictionSizes != "walk" {
+		t.Fatalf("expected the cache walked by default, got %q", cfg.EvictionSizes)
+	}
+	t.Setenv("EVICTION_SIZES", "recorded")
+	if cfg, err = LoadArgs([]string{}); err != nil || cfg.EvictionSizes != "recorded" {
+		t.Fatalf("expected recorded, got %+v (%v)", cfg, err)
+	}
+	if _, err := LoadArgs([]string{"-eviction-sizes", "guess"}); err == nil {
+		t.Fatal("expected error for unknown eviction-sizes")
+	}
+}
+
+func TestMinAgeBeforeEvict(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.MinAgeBeforeEvict != 0 {
+		t.Fatalf("expected no minimum age by default, got %v", cfg.MinAgeBeforeEvict)
+	}
+	t.Setenv("MIN_AGE_BEFORE_EVICT", "10m")
+	if cfg, err = LoadArgs([]string{}); err != nil || cfg.MinAgeBeforeEvict != 10*time.Minute {
+		t.Fatalf("expected 10m, got %+v (%v)", cfg, err)
+	}
+	if _, err := LoadArgs([]string{"-min-age-before-evict", "-1m"}); err == nil {
+		t.Fatal("expected error for negative min-age-before-evict")
+	}
+}
+
+func TestSlowRequestThreshold(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.SlowRequestThreshold != 0 {
+		t.Fatalf("expected slow request breakdowns off by default, got %v", cfg.SlowRequestThreshold)
+	}
+	t.Setenv("SLOW_REQUEST_THRESHOLD", "5m")
+	if cfg, err = LoadArgs([]string{}); err != nil || cfg.SlowRequestThreshold != 5*time.Minute {
+		t.Fatalf("expected 5m, got %+v (%v)", cfg, err)
+	}
+	if _, err := LoadArgs([]string{"-slow-request-threshold", "-1s"}); err == nil {
+		t.Fatal("expected error for negative slow-request-threshold")
+	}
+}
+
+func TestMaxRepoCount(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.MaxRepoCount != 0 {
+		t.Fatalf("expected no repo count limit by default, got %d", cfg.MaxRepoCount)
+	}
+	t.Setenv("MAX_REPO_COUNT", "5000")
+	if cfg, err = LoadArgs([]string{}); err != nil || cfg.MaxRepoCount != 5000 {
+		t.Fatalf("expected 5000, got %+v (%v)", cfg, err)
+	}
+	if _, err := LoadArgs([]string{"-max-repo-count", "-1"}); err == nil {
+		t.Fatal("expected error for negative max-repo-count")
+	}
+}
+
+func TestMetricsCacheTTL(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.MetricsCacheTTL != 0 {
+		t.Fatalf("expected metrics rendered for every scrape by default, got %v", cfg.MetricsCacheTTL)
+	}
+	t.Setenv("METRICS_CACHE_TTL", "1s")
+	if cfg, err = LoadArgs([]string{}); err != nil || cfg.MetricsCacheTTL != time.Second {
+		t.Fatalf("expected 1s, got %+v (%v)", cfg, err)
+	}
+	if _, err := LoadArgs([]string{"-metrics-cache-ttl", "-1s"}); err == nil {
+		t.Fatal("expected error for negative metrics-cache-ttl")
+	}
+}
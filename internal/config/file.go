@@ -0,0 +1,249 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// fileConfig mirrors Config as read from a YAML config file.
+// Pointer fields distinguish "unset" from zero values so defaults still apply.
+type fileConfig struct {
+	ListenAddr                *string           `yaml:"listen_addr"`
+	AdminListenAddr           *string           `yaml:"admin_listen_addr"`
+	GitDaemonListenAddr       *string           `yaml:"git_daemon_listen_addr"`
+	MirrorDir                 *string           `yaml:"mirror_dir"`
+	MirrorTempDir             *string           `yaml:"mirror_temp_dir"`
+	MirrorExtraDirs           []string          `yaml:"mirror_extra_dirs"`
+	MirrorFollowSymlinks      *bool             `yaml:"mirror_follow_symlinks"`
+	GitBinary                 *string           `yaml:"git_binary"`
+	GitEnv                    []string          `yaml:"git_env"`
+	MirrorMaxSize             *string           `yaml:"mirror_max_size"`
+	CacheDirMode              *string           `yaml:"cache_dir_mode"`
+	CacheFileMode             *string           `yaml:"cache_file_mode"`
+	MinFreeSpace              *string           `yaml:"min_free_space"`
+	MaxRepoCount              *int              `yaml:"max_repo_count"`
+	CacheLock                 *string           `yaml:"cache_lock"`
+	SyncStaleAfter            *string           `yaml:"sync_stale_after"`
+	StaleWhileRevalidate      *string           `yaml:"stale_while_revalidate"`
+	GitKilledBackoff          *string           `yaml:"git_killed_backoff"`
+	EvictionFreezeFor         *string           `yaml:"eviction_freeze_for"`
+	MinAgeBeforeEvict         *string           `yaml:"min_age_before_evict"`
+	EvictHighWatermark        *float64          `yaml:"evict_high_watermark"`
+	EvictLowWatermark         *float64          `yaml:"evict_low_watermark"`
+	EvictionInterval          *string           `yaml:"eviction_interval"`
+	EvictionSizes             *string           `yaml:"eviction_sizes"`
+	CacheMaxAge               *string           `yaml:"cache_max_age"`
+	VerifyInterval            *string           `yaml:"verify_interval"`
+	VerifySampleRate          *float64          `yaml:"verify_sample_rate"`
+	AllowedUpstreams          []string          `yaml:"allowed_upstreams"`
+	AllowedServices           []string          `yaml:"allowed_services"`
+	TrustedProxyCIDRs         []string          `yaml:"trusted_proxy_cidrs"`
+	UpstreamHostOverrides     map[string]string `yaml:"upstream_host_overrides"`
+	UpstreamHostAliases       map[string]string `yaml:"upstream_host_aliases"`
+	KeepGitSuffixHosts        []string          `yaml:"keep_git_suffix_hosts"`
+	UpstreamResolver          *string           `yaml:"upstream_resolver"`
+	UpstreamIPFamily          *string           `yaml:"upstream_ip_family"`
+	UpstreamFallbackDelay     *string           `yaml:"upstream_fallback_delay"`
+	UpstreamSchemes           map[string]string `yaml:"upstream_schemes"`
+	UpstreamFallbacks         Fallbacks         `yaml:"upstream_fallbacks"`
+	UpstreamQuotas            map[string]string `yaml:"upstream_quotas"`
+	UpstreamQuotaWindow       *string           `yaml:"upstream_quota_window"`
+	MaintenanceSchedule       map[string]string `yaml:"maintenance_schedule"`
+	UpstreamSSHUser           *string           `yaml:"upstream_ssh_user"`
+	UpstreamSSHKey            *string           `yaml:"upstream_ssh_key"`
+	UpstreamSSHKnownHosts     *string           `yaml:"upstream_ssh_known_hosts"`
+	UpstreamRewrites          []string          `yaml:"upstream_rewrites"`
+	AlternatesNetworks        []string          `yaml:"alternates_networks"`
+	MirrorRefspecs            []string          `yaml:"mirror_refspecs"`
+	DefaultBranch             *string           `yaml:"default_branch"`
+	StripRefPatterns          []string          `yaml:"strip_ref_patterns"`
+	UpstreamTracing           *bool             `yaml:"upstream_tracing"`
+	FollowUpstreamRedirects   *bool             `yaml:"follow_upstream_redirects"`
+	UpstreamTimeout           *string           `yaml:"upstream_timeout"`
+	UpstreamInfoTimeout       *string           `yaml:"upstream_info_timeout"`
+	UpstreamPackTimeout       *string           `yaml:"upstream_pack_timeout"`
+	RequestTimeouts           map[string]string `yaml:"request_timeouts"`
+	PeerProxies               []string          `yaml:"peer_proxies"`
+	WarmBeforeReady           []string          `yaml:"warm_before_ready"`
+	LogLevel                  *string           `yaml:"log_level"`
+	AccessLogSampleRate       *float64          `yaml:"access_log_sample_rate"`
+	AccessLogSlowThreshold    *string           `yaml:"access_log_slow_threshold"`
+	SlowRequestThreshold      *string           `yaml:"slow_request_threshold"`
+	AuthMode                  *string           `yaml:"auth_mode"`
+	StaticToken               *string           `yaml:"static_token"`
+	SigningKey                *string           `yaml:"signing_key"`
+	SignatureHeader           *string           `yaml:"signature_header"`
+	ClientAuth                *fileClientAuth   `yaml:"client_auth"`
+	MaxRequestBodyBytes       *string           `yaml:"max_request_body_bytes"`
+	MaxCloneBytes             *string           `yaml:"max_clone_bytes"`
+	MaxCloneBytesOverrides    []string          `yaml:"max_clone_bytes_overrides"`
+	FilterBlobsOver           *string           `yaml:"filter_blobs_over"`
+	MaxConnections            *int              `yaml:"max_connections"`
+	MaxUpstreamFetches        *int              `yaml:"max_upstream_fetches"`
+	MinClientRate             *string           `yaml:"min_client_rate"`
+	SlowClientWindow          *string           `yaml:"slow_client_window"`
+	InfoRefsMemCacheBytes     *string           `yaml:"info_refs_mem_cache_bytes"`
+	CapabilitiesCacheTTL      *string           `yaml:"capabilities_cache_ttl"`
+	DirectRepos               []string          `yaml:"direct_repos"`
+	DirectInfoRefsTTL         *string           `yaml:"direct_info_refs_ttl"`
+	CacheControl              *string           `yaml:"cache_control"`
+	BasePath                  *string           `yaml:"base_path"`
+	MetricsPath               *string           `yaml:"metrics_path"`
+	MetricsListenAddr         *string           `yaml:"metrics_listen_addr"`
+	MetricsAuthToken          *string           `yaml:"metrics_auth_token"`
+	MetricsCacheTTL           *string           `yaml:"metrics_cache_ttl"`
+	HealthPath                *string           `yaml:"health_path"`
+	ReadyPath                 *string           `yaml:"ready_path"`
+	LandingPageFile           *string           `yaml:"landing_page_file"`
+	AWSCloudMapServiceID      *string           `yaml:"aws_cloud_map_service_id"`
+	Route53HostedZoneID       *string           `yaml:"route53_hosted_zone_id"`
+	Route53RecordName         *string           `yaml:"route53_record_name"`
+	SerializeUploadPack       *bool             `yaml:"serialize_upload_pack"`
+	UploadPackThreads         *int              `yaml:"upload_pack_threads"`
+	MaintainAfterSync         *bool             `yaml:"maintain_after_sync"`
+	MaintainCommitGraph       *bool             `yaml:"maintain_commit_graph"`
+	SkipCurrentSyncs          *bool             `yaml:"skip_current_syncs"`
+	SyncEmptyRepos            *bool             `yaml:"sync_empty_repos"`
+	ServeStaleOnUpstreamError *bool             `yaml:"serve_stale_on_upstream_error"`
+	CachePinnedPacks          *bool             `yaml:"cache_pinned_packs"`
+	AllowUploadArchive        *bool             `yaml:"allow_upload_archive"`
+	EnableGitDaemon           *bool             `yaml:"enable_git_daemon"`
+	CacheUploadArchives       *bool             `yaml:"cache_upload_archives"`
+	CacheChecksums            *bool             `yaml:"cache_checksums"`
+	EnableAlternates          *bool             `yaml:"enable_alternates"`
+	ExperimentalCASStore      *bool             `yaml:"experimental_cas_store"`
+	PrewarmSubmodules         *bool             `yaml:"prewarm_submodules"`
+	DiskFullFallback          *string           `yaml:"disk_full_fallback"`
+	AbandonedFetches          *string           `yaml:"abandoned_fetches"`
+	SpoolLargePacksToDisk     *bool             `yaml:"spool_large_packs_to_disk"`
+	SpoolPackThreshold        *string           `yaml:"spool_pack_threshold"`
+	VerifyPacks               *bool             `yaml:"verify_packs"`
+	HeadRequests              *string           `yaml:"head_requests"`
+}
+
+// loadFile reads a YAML config file. An empty path returns an empty fileConfig.
+// Unknown keys are rejected so typos don't silently fall back to defaults.
+func loadFile(path string) (*fileConfig, error) {
+	fc := &fileConfig{}
+	if path == "" {
+		return fc, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+	if err := yaml.UnmarshalStrict(data, fc); err != nil {
+		return nil, fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	return fc, nil
+}
+
+// configFileArg returns the value of -config/--config from args, or def if absent.
+// The file must be known before flags are defined since it provides their defaults.
+func configFileArg(args []string, def string) string {
+	for i, a := range args {
+		if a == "--" {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		if !strings.HasPrefix(a, "-") || name != "config" {
+			continue
+		}
+		if hasValue {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return def
+}
+
+// fileOr returns the file value if set, otherwise def.
+func fileOr[T any](v *T, def T) T {
+	if v != nil {
+		return *v
+	}
+	return def
+}
+
+// fileClientAuth is the client_auth section of a config file.
+type fileClientAuth struct {
+	Tokens         []string          `yaml:"tokens"`
+	Users          map[string]string `yaml:"users"`
+	UpstreamTokens map[string]string `yaml:"upstream_tokens"`
+	Priorities     map[string]string `yaml:"priorities"`
+}
+
+func (a *fileClientAuth) tokens() []string {
+	if a == nil {
+		return nil
+	}
+	return a.Tokens
+}
+
+func (a *fileClientAuth) users() map[string]string {
+	if a == nil {
+		return nil
+	}
+	return a.Users
+}
+
+func (a *fileClientAuth) upstreamTokens() map[string]string {
+	if a == nil {
+		return nil
+	}
+	return a.UpstreamTokens
+}
+
+func (a *fileClientAuth) priorities() map[string]string {
+	if a == nil {
+		return nil
+	}
+	return a.Priorities
+}
+
+// fileOrList joins a file list value for use as a comma-separated default.
+func fileOrList(v []string, def string) string {
+	if v != nil {
+		return strings.Join(v, ",")
+	}
+	return def
+}
+
+// fileOrFallbacks joins file fallbacks as comma-separated host=url pairs,
+// a host's in order, for use as a default.
+func fileOrFallbacks(v Fallbacks, def string) string {
+	if v == nil {
+		return def
+	}
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		for _, val := range v[k] {
+			pairs = append(pairs, k+"="+val)
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+// fileOrMap joins a file map value as comma-separated key=value pairs for use as a default.
+func fileOrMap(v map[string]string, def string) string {
+	if v == nil {
+		return def
+	}
+	pairs := make([]string, 0, len(v))
+	for k, val := range v {
+		pairs = append(pairs, k+"="+val)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
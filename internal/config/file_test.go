@@ -0,0 +1,143 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write config file: %v", err)
+	}
+	return path
+}
+
+func TestConfigFile(t *testing.T) {
+	clearEnv(t)
+	path := writeConfigFile(t, `
+listen_addr: ":9090"
+mirror_max_size: "200GiB"
+sync_stale_after: "30s"
+allowed_upstreams: [github.com, gitlab.com]
+serialize_upload_pack: true
+upload_pack_threads: 4
+`)
+	cfg, err := LoadArgs([]string{"-config", path})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.ListenAddr != ":9090" {
+		t.Fatalf("expected listen addr from file, got %s", cfg.ListenAddr)
+	}
+	if cfg.MirrorMaxSize.Bytes != 200*1024*1024*1024 {
+		t.Fatalf("expected mirror max size from file, got %+v", cfg.MirrorMaxSize)
+	}
+	if cfg.SyncStaleAfter != 30*time.Second {
+		t.Fatalf("expected sync stale after from file, got %v", cfg.SyncStaleAfter)
+	}
+	if len(cfg.AllowedUpstreams) != 2 || cfg.AllowedUpstreams[1] != "gitlab.com" {
+		t.Fatalf("expected allowed upstreams from file, got %v", cfg.AllowedUpstreams)
+	}
+	if !cfg.SerializeUploadPack || cfg.UploadPackThreads != 4 {
+		t.Fatalf("expected upload-pack settings from file, got %v/%d", cfg.SerializeUploadPack, cfg.UploadPackThreads)
+	}
+	// Unset values keep their defaults
+	if cfg.HealthPath != "/healthz" {
+		t.Fatalf("expected default health path, got %s", cfg.HealthPath)
+	}
+}
+
+func TestConfigFilePrecedence(t *testing.T) {
+	clearEnv(t)
+	path := writeConfigFile(t, `
+listen_addr: ":9090"
+mirror_dir: "/from/file"
+log_level: "warn"
+`)
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("LISTEN_ADDR", ":7070")
+	t.Setenv("MIRROR_DIR", "/from/env")
+	cfg, err := LoadArgs([]string{"-listen-addr=:6060"})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.ListenAddr != ":6060" {
+		t.Fatalf("expected flag to override env and file, got %s", cfg.ListenAddr)
+	}
+	if cfg.MirrorDir != "/from/env" {
+		t.Fatalf("expected env to override file, got %s", cfg.MirrorDir)
+	}
+	if cfg.LogLevel != "warn" {
+		t.Fatalf("expected log level from file, got %s", cfg.LogLevel)
+	}
+}
+
+func TestConfigFileUnknownKey(t *testing.T) {
+	clearEnv(t)
+	path := writeConfigFile(t, "listen_adr: \":9090\"\n")
+	if _, err := LoadArgs([]string{"--config=" + path}); err == nil {
+		t.Fatalf("expected error for unknown key")
+	}
+}
+
+func TestConfigReportsAllErrors(t *testing.T) {
+	clearEnv(t)
+	path := writeConfigFile(t, `
+mirror_max_size: "200XB"
+sync_stale_after: "soon"
+auth_mode: "static"
+`)
+	_, err := LoadArgs([]string{"-config", path})
+	if err == nil {
+		t.Fatalf("expected validation errors")
+	}
+	for _, want := range []string{"mirror-max-size", "sync-stale-after", "STATIC_TOKEN"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestConfigFileClientAuth(t *testing.T) {
+	clearEnv(t)
+	path := writeConfigFile(t, `
+auth_mode: none
+client_auth:
+  tokens: [ci-token]
+  users:
+    alice: "p=ss"
+  upstream_tokens:
+    team-token: ghp_team
+  priorities:
+    ci-token: batch
+    alice: interactive
+`)
+	cfg, err := LoadArgs([]string{"-config", path})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !slices.Equal(cfg.ClientAuth.Tokens, []string{"ci-token", "team-token"}) || cfg.ClientAuth.Users["alice"] != "p=ss" ||
+		cfg.ClientAuth.UpstreamTokens["team-token"] != "ghp_team" || cfg.ClientAuth.Priorities["ci-token"] != "batch" || cfg.ClientAuth.Priorities["alice"] != "interactive" {
+		t.Fatalf("unexpected client auth: %+v", cfg.ClientAuth)
+	}
+
+	// The client's Authorization header is for the proxy, so it can't go upstream
+	for _, args := range [][]string{
+		{"-config", path, "-auth-mode", "pass-through"},
+		{"-config", path, "-allowed-services", "git-upload-pack,git-receive-pack"},
+		{"-config", path, "-client-auth-users", "bob"},
+		{"-config", path, "-client-auth-upstream-tokens", "team-token"},
+		{"-config", path, "-client-auth-priorities", "ci-token=urgent"},
+		{"-config", path, "-client-auth-priorities", "unknown-token=batch"},
+	} {
+		if _, err := LoadArgs(args); err == nil {
+			t.Errorf("expected error for %v", args)
+		}
+	}
+}
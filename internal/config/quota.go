@@ -0,0 +1,50 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Quota caps what is fetched from an upstream host per UpstreamQuotaWindow.
+type Quota struct {
+	Bytes   int64 // Bytes fetched, zero means no limit
+	Fetches int64 // Clones, syncs and passed-through requests, zero means no limit
+}
+
+// Quotas maps upstream hosts to their quota.
+type Quotas map[string]Quota
+
+// parseQuotas parses comma-separated host=size[/fetches] pairs, e.g.
+// github.com=500GiB/20000. Hosts must be allowed upstreams.
+func parseQuotas(s string, allowed []string) (Quotas, error) {
+	quotas := Quotas{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		host, spec, ok := strings.Cut(pair, "=")
+		host, spec = strings.TrimSpace(host), strings.TrimSpace(spec)
+		if !ok || host == "" || spec == "" {
+			return nil, fmt.Errorf("expected host=size[/fetches], got %q", pair)
+		}
+		if !slices.Contains(allowed, host) {
+			return nil, fmt.Errorf("host %s is not an allowed upstream", host)
+		}
+		size, fetches, hasFetches := strings.Cut(spec, "/")
+		var q Quota
+		var err error
+		if q.Bytes, err = ParseSize(size); err != nil {
+			return nil, fmt.Errorf("invalid size for %s: %w", host, err)
+		}
+		if hasFetches {
+			if q.Fetches, err = strconv.ParseInt(fetches, 10, 64); err != nil || q.Fetches < 0 {
+				return nil, fmt.Errorf("invalid fetch count for %s: %q", host, fetches)
+			}
+		}
+		quotas[host] = q
+	}
+	return quotas, nil
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MirrorRefs are the refs ("refs/heads/main") and namespaces ("refs/tags/*")
+// a restricted mirror holds.
+type MirrorRefs []string
+
+// Refspecs returns the fetch refspecs mirroring refs.
+func (refs MirrorRefs) Refspecs() []string {
+	specs := make([]string, len(refs))
+	for i, ref := range refs {
+		specs[i] = "+" + ref + ":" + ref
+	}
+	return specs
+}
+
+// Contains reports whether ref is mirrored.
+func (refs MirrorRefs) Contains(ref string) bool {
+	for _, r := range refs {
+		if ns, ok := strings.CutSuffix(r, "*"); ok {
+			if strings.HasPrefix(ref, ns) {
+				return true
+			}
+		} else if ref == r {
+			return true
+		}
+	}
+	return false
+}
+
+// Overlaps reports whether some mirrored refs may start with prefix, as
+// asked by ls-refs ref-prefix arguments.
+func (refs MirrorRefs) Overlaps(prefix string) bool {
+	for _, r := range refs {
+		if ns, ok := strings.CutSuffix(r, "*"); ok {
+			if strings.HasPrefix(prefix, ns) || strings.HasPrefix(ns, prefix) {
+				return true
+			}
+		} else if strings.HasPrefix(r, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// MirrorRefspec restricts the mirrors of repos matching Pattern to Refs.
+type MirrorRefspec struct {
+	Pattern *regexp.Regexp // Matched against the whole host/owner/repo path
+	Refs    MirrorRefs
+}
+
+// MirrorRefspecs is an ordered list of ref restrictions.
+type MirrorRefspecs []MirrorRefspec
+
+// For returns the refs to mirror for path (host/owner/repo) from the first
+// rule matching it, or nil to mirror all of them.
+func (rules MirrorRefspecs) For(path string) MirrorRefs {
+	for _, rule := range rules {
+		if rule.Pattern.MatchString(path) {
+			return rule.Refs
+		}
+	}
+	return nil
+}
+
+// parseMirrorRefspecs parses whitespace-separated pattern=ref[,ref...] rules.
+func parseMirrorRefspecs(s string) (MirrorRefspecs, error) {
+	var rules MirrorRefspecs
+	for _, rule := range strings.Fields(s) {
+		pattern, refs, ok := strings.Cut(rule, "=")
+		if !ok || pattern == "" || refs == "" {
+			return nil, fmt.Errorf("expected pattern=ref[,ref...], got %q", rule)
+		}
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		parsed := MirrorRefspec{Pattern: re}
+		for _, ref := range strings.Split(refs, ",") {
+			if err := validateRefPattern(ref); err != nil {
+				return nil, err
+			}
+			parsed.Refs = append(parsed.Refs, ref)
+		}
+		rules = append(rules, parsed)
+	}
+	return rules, nil
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMirrorRefspecs(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("MIRROR_REFSPECS", `github\.com/huge/.+=refs/heads/main,refs/tags/*
+		github\.com/.+/monorepo=refs/heads/main`)
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	if refs := cfg.MirrorRefspecs.For("github.com/owner/repo"); refs != nil {
+		t.Fatalf("expected unmatched repos to mirror all refs, got %v", refs)
+	}
+	// The first matching rule wins
+	refs := cfg.MirrorRefspecs.For("github.com/huge/monorepo")
+	if !slices.Equal(refs, MirrorRefs{"refs/heads/main", "refs/tags/*"}) {
+		t.Fatalf("unexpected refs: %v", refs)
+	}
+	if got := refs.Refspecs(); !slices.Equal(got, []string{"+refs/heads/main:refs/heads/main", "+refs/tags/*:refs/tags/*"}) {
+		t.Fatalf("unexpected refspecs: %v", got)
+	}
+
+	for ref, want := range map[string]bool{
+		"refs/heads/main":   true,
+		"refs/heads/main2":  false,
+		"refs/heads/other":  false,
+		"refs/tags/v1.0":    true,
+		"refs/tags/a/b":     true,
+		"refs/pull/1/head":  false,
+		"refs/tagsx/v1.0":   false,
+		"refs/heads/main/x": false,
+	} {
+		if got := refs.Contains(ref); got != want {
+			t.Errorf("Contains(%q) = %v, want %v", ref, got, want)
+		}
+	}
+	for prefix, want := range map[string]bool{
+		"refs/heads/":            true,
+		"refs/heads/main":        true,
+		"refs/heads/feature":     false,
+		"refs/tags/":             true,
+		"refs/tags/v1":           true,
+		"refs/":                  true,
+		"refs/pull/":             false,
+		"refs/pull/1/head":       false,
+		"main":                   false,
+		"refs/remotes/main/HEAD": false,
+	} {
+		if got := refs.Overlaps(prefix); got != want {
+			t.Errorf("Overlaps(%q) = %v, want %v", prefix, got, want)
+		}
+	}
+
+	for _, rule := range []string{
+		`github\.com/huge/.+`,             // no refs
+		`github\.com/(.+=refs/heads/main`, // invalid pattern
+		`github\.com/huge/.+=main`,        // not a full ref name
+		`github\.com/huge/.+=refs/*`,      // everything
+		`github\.com/huge/.+=refs/heads/main,`,
+	} {
+		if _, err := LoadArgs([]string{"-mirror-refspecs", rule}); err == nil {
+			t.Errorf("expected error for rule %q", rule)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"reflect"
+	"slices"
+)
+
+// reloadable lists the Config fields that can change while serving: they are
+// read per request or per upstream operation, never baked into listeners,
+// the mirror layout or long-lived clients.
+var reloadable = []string{
+	"AllowedUpstreams",
+	"UpstreamHostAliases",
+	"AllowedServices",
+	"AllowUploadArchive",
+	"CacheUploadArchives",
+	"UpstreamRewrites",
+	"TrustedProxyCIDRs",
+	"SyncStaleAfter",
+	"StaleWhileRevalidate",
+	"SyncEmptyRepos",
+	"DefaultBranch",
+	"UpstreamTimeout",
+	"UpstreamInfoTimeout",
+	"UpstreamPackTimeout",
+	"RequestTimeouts",
+	"AuthMode",
+	"StaticToken",
+	"SigningKey",
+	"SignatureHeader",
+	"ClientAuth",
+	"MetricsAuthToken",
+	"MetricsCacheTTL",
+	"MaxRequestBodyBytes",
+	"MaxCloneBytes",
+	"MaxCloneBytesOverrides",
+	"DirectRepos",
+	"DirectInfoRefsTTL",
+	"CacheControl",
+	"DiskFullFallback",
+	"HeadRequests",
+	"SpoolLargePacksToDisk",
+	"SpoolPackThreshold",
+	"VerifyPacks",
+	"LandingPageFile",
+	"AccessLogSampleRate",
+	"AccessLogSlowThreshold",
+	"SlowRequestThreshold",
+}
+
+// Reload returns a copy of c with the reloadable fields taken from next, and
+// the names of the other fields whose new values were ignored.
+func (c *Config) Reload(next *Config) (*Config, []string) {
+	merged := *c
+	cur, nv, mv := reflect.ValueOf(c).Elem(), reflect.ValueOf(next).Elem(), reflect.ValueOf(&merged).Elem()
+
+	var ignored []string
+	for i := range cur.NumField() {
+		name := cur.Type().Field(i).Name
+		switch {
+		case slices.Contains(reloadable, name):
+			mv.Field(i).Set(nv.Field(i))
+		case !reflect.DeepEqual(cur.Field(i).Interface(), nv.Field(i).Interface()):
+			ignored = append(ignored, name)
+		}
+	}
+	return &merged, ignored
+}
@@ -0,0 +1,26 @@
+package config
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	cur := &Config{ListenAddr: ":8080", MirrorDir: "/a", AllowedUpstreams: []string{"github.com"}, UpstreamTimeout: time.Minute, StaticToken: "old"}
+	next := &Config{ListenAddr: ":9090", MirrorDir: "/a", AllowedUpstreams: []string{"github.com", "gitlab.com"}, StaticToken: "new"}
+
+	merged, ignored := cur.Reload(next)
+	if !slices.Equal(merged.AllowedUpstreams, next.AllowedUpstreams) || merged.UpstreamTimeout != 0 || merged.StaticToken != "new" {
+		t.Fatalf("expected reloadable fields from next, got %+v", merged)
+	}
+	if merged.ListenAddr != ":8080" || merged.MirrorDir != "/a" {
+		t.Fatalf("expected other fields to be kept, got %+v", merged)
+	}
+	if !slices.Equal(ignored, []string{"ListenAddr"}) {
+		t.Fatalf("expected only the listen address change to be ignored, got %v", ignored)
+	}
+	if cur.StaticToken != "old" {
+		t.Fatalf("expected current config to be left untouched")
+	}
+}
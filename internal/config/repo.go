@@ -0,0 +1,20 @@
+package config
+
+import "strings"
+
+// GitSuffixHosts are the upstream hosts whose repo names keep a .git suffix,
+// as repo and repo.git are different repos there (e.g. plain git http-backend
+// servers), where hosts like GitHub serve the same repo under both.
+type GitSuffixHosts []string
+
+// RepoName returns the name of repo on host as its mirror is keyed by:
+// without the .git suffix clients add or not to the same repo, unless host
+// keeps repo names as they are.
+func (h GitSuffixHosts) RepoName(host, repo string) string {
+	for _, keep := range h {
+		if keep == host {
+			return repo
+		}
+	}
+	return strings.TrimSuffix(repo, ".git")
+}
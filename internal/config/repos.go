@@ -0,0 +1,35 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RepoPatterns is a list of patterns matched against whole host/owner/repo
+// paths.
+type RepoPatterns []*regexp.Regexp
+
+// Match reports whether path (host/owner/repo) matches one of the patterns.
+func (patterns RepoPatterns) Match(path string) bool {
+	for _, re := range patterns {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRepoPatterns parses whitespace-separated regexp patterns, anchored at
+// both ends.
+func parseRepoPatterns(s string) (RepoPatterns, error) {
+	var patterns RepoPatterns
+	for _, pattern := range strings.Fields(s) {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Rewrite maps repo paths to a different upstream path.
+type Rewrite struct {
+	Pattern     *regexp.Regexp // Matched against the whole host/owner/repo path
+	Replacement string         // New host/owner/repo, may reference capture groups like $1
+}
+
+// Rewrites is an ordered list of rewrite rules.
+type Rewrites []Rewrite
+
+// Apply returns path rewritten by the first rule matching it, or path unchanged.
+func (rules Rewrites) Apply(path string) string {
+	for _, rw := range rules {
+		if rw.Pattern.MatchString(path) {
+			return rw.Pattern.ReplaceAllString(path, rw.Replacement)
+		}
+	}
+	return path
+}
+
+// parseRewrites parses whitespace-separated pattern=>replacement rules. Each
+// replacement must start with a literal host from allowed, so rewrites can't
+// send requests to upstreams outside the allowlist.
+func parseRewrites(s string, allowed []string) (Rewrites, error) {
+	var rules Rewrites
+	for _, rule := range strings.Fields(s) {
+		pattern, replacement, ok := strings.Cut(rule, "=>")
+		if !ok || pattern == "" || replacement == "" {
+			return nil, fmt.Errorf("expected pattern=>replacement, got %q", rule)
+		}
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		host, _, ok := strings.Cut(replacement, "/")
+		if !ok || strings.Contains(host, "$") || !slices.Contains(allowed, host) {
+			return nil, fmt.Errorf("replacement %q must start with an allowed upstream host and a slash", replacement)
+		}
+		rules = append(rules, Rewrite{Pattern: re, Replacement: replacement})
+	}
+	return rules, nil
+}
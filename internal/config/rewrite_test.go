@@ -0,0 +1,48 @@
+package config
+
+import "testing"
+
+func TestUpstreamRewrites(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadArgs([]string{
+		"-allowed-upstreams", "github.com,example.com,internal.example.com",
+		"-upstream-rewrites", `github\.com/legacy-org/(.+)=>internal.example.com/mirror/$1
+			github\.com/([^/]+)/(.+)-old=>github.com/$1/$2
+			example\.com/(.+)=>internal.example.com/$1`,
+	})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	tests := []struct{ path, want string }{
+		{"github.com/legacy-org/tool", "internal.example.com/mirror/tool"},
+		{"github.com/owner/repo-old", "github.com/owner/repo"},
+		{"github.com/owner/repo", "github.com/owner/repo"},
+		{"example.com/group/sub/repo", "internal.example.com/group/sub/repo"},
+		// Patterns must match the whole path
+		{"github.com/not-legacy-org/tool", "github.com/not-legacy-org/tool"},
+		// The first matching rule wins
+		{"github.com/legacy-org/tool-old", "internal.example.com/mirror/tool-old"},
+	}
+	for _, tt := range tests {
+		if got := cfg.UpstreamRewrites.Apply(tt.path); got != tt.want {
+			t.Errorf("Apply(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestInvalidUpstreamRewrites(t *testing.T) {
+	clearEnv(t)
+	for _, rule := range []string{
+		`github\.com/(.+)`,                           // no replacement
+		`github\.com/(.+=>github.com/$1`,             // invalid pattern
+		`github\.com/(.+)=>evil.example.com/x/$1`,    // host not allowed
+		`([^/]+)/(.+)=>$1/$2`,                        // host not literal
+		`github\.com/(.+)=>github.com.evil.com/x/$1`, // lookalike host
+		`github\.com/(.+)=>github.com`,               // host alone
+	} {
+		if _, err := LoadArgs([]string{"-allowed-upstreams", "github.com", "-upstream-rewrites", rule}); err == nil {
+			t.Errorf("expected error for rewrite %q", rule)
+		}
+	}
+}
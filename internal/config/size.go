@@ -7,10 +7,10 @@ import (
 	"strings"
 )
 
-// SizeSpec represents either an absolute size in bytes or a percentage of available disk.
+// SizeSpec represents either an absolute size in bytes or a percentage of the total disk size.
 type SizeSpec struct {
 	Bytes   int64   // Absolute size in bytes (used if Percent == 0)
-	Percent float64 // Percentage of available disk (0-100, used if > 0)
+	Percent float64 // Percentage of the total disk size (0-100, used if > 0)
 }
 
 // IsPercent returns true if this spec represents a percentage.
@@ -23,6 +23,14 @@ func (s SizeSpec) IsZero() bool {
 	return s.Bytes == 0 && s.Percent == 0
 }
 
+// BytesOf returns the size in bytes, resolving percentages against total.
+func (s SizeSpec) BytesOf(total int64) int64 {
+	if s.IsPercent() {
+		return int64(float64(total) * s.Percent / 100.0)
+	}
+	return s.Bytes
+}
+
 // ParseSizeSpec parses a size string that can be either:
 // - Absolute: "200GiB", "200GB", "500MB", etc.
 // - Percentage: "80%", "50%"
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// SizeLimit overrides a byte limit for repos matching Pattern.
+type SizeLimit struct {
+	Pattern *regexp.Regexp // Matched against the whole host/owner/repo path
+	Bytes   int64          // Zero means no limit
+}
+
+// SizeLimits is an ordered list of per-repo limit overrides.
+type SizeLimits []SizeLimit
+
+// For returns the limit for path (host/owner/repo) from the first rule
+// matching it, or def if none does.
+func (rules SizeLimits) For(path string, def int64) int64 {
+	for _, rule := range rules {
+		if rule.Pattern.MatchString(path) {
+			return rule.Bytes
+		}
+	}
+	return def
+}
+
+// parseSizeLimits parses whitespace-separated pattern=size rules.
+func parseSizeLimits(s string) (SizeLimits, error) {
+	var rules SizeLimits
+	for _, rule := range strings.Fields(s) {
+		pattern, size, ok := strings.Cut(rule, "=")
+		if !ok || pattern == "" || size == "" {
+			return nil, fmt.Errorf("expected pattern=size, got %q", rule)
+		}
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		n, err := ParseSize(size)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size for %q: %w", pattern, err)
+		}
+		rules = append(rules, SizeLimit{Pattern: re, Bytes: n})
+	}
+	return rules, nil
+}
@@ -0,0 +1,31 @@
+package config
+
+import "testing"
+
+func TestMaxCloneBytesOverrides(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("MAX_CLONE_BYTES", "20GiB")
+	t.Setenv("MAX_CLONE_BYTES_OVERRIDES", `github\.com/huge/.+=100GiB github\.com/huge/unbounded=0`)
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	for path, want := range map[string]int64{
+		"github.com/owner/repo":     20 << 30,
+		"github.com/huge/repo":      100 << 30,
+		"github.com/huge/unbounded": 100 << 30, // the first matching rule wins
+		"github.com/hugex/repo":     20 << 30,
+	} {
+		if got := cfg.MaxCloneBytesOverrides.For(path, cfg.MaxCloneBytes); got != want {
+			t.Errorf("For(%q) = %d, want %d", path, got, want)
+		}
+	}
+
+	for _, bad := range []string{"github.com/x", "=1GiB", "(=1GiB", "github.com/x=lots"} {
+		t.Setenv("MAX_CLONE_BYTES_OVERRIDES", bad)
+		if _, err := LoadArgs([]string{}); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
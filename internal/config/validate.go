@@ -0,0 +1,215 @@
+package config
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Validate runs checks that depend on the runtime environment, beyond the
+// static parsing done by LoadArgs. It never creates directories or starts
+// anything, so it is safe to run as a pre-deploy gate.
+func (c *Config) Validate() error {
+	var errs []error
+	if err := checkWritableDir(c.MirrorDir); err != nil {
+		errs = append(errs, fmt.Errorf("mirror-dir: %w", err))
+	}
+	dirs := c.MirrorDirs()
+	for i, dir := range dirs[1:] {
+		if err := checkWritableDir(dir); err != nil {
+			errs = append(errs, fmt.Errorf("mirror-extra-dirs: %w", err))
+		}
+		// Eviction walks each root, so repos in nested roots would be counted twice
+		for _, other := range dirs[:i+1] {
+			if within(dir, other) || within(other, dir) {
+				errs = append(errs, fmt.Errorf("mirror-extra-dirs: %s and %s must not be inside one another", dir, other))
+			}
+		}
+	}
+	if c.MirrorTempDir != "" {
+		if err := checkWritableDir(c.MirrorTempDir); err != nil {
+			errs = append(errs, fmt.Errorf("mirror-temp-dir: %w", err))
+		}
+		// Staged clones end in .git, so eviction would pick them up as mirrors
+		for _, dir := range c.MirrorDirs() {
+			if within(c.MirrorTempDir, dir) {
+				errs = append(errs, fmt.Errorf("mirror-temp-dir: must not be inside mirror dir %s", dir))
+			}
+		}
+	}
+	gitBinary := cmp.Or(c.GitBinary, "git")
+	if _, err := exec.LookPath(gitBinary); err != nil {
+		errs = append(errs, fmt.Errorf("git-binary: %w", err))
+	}
+	// All are implemented with http.curloptResolve, added in git 2.37
+	if len(c.UpstreamHostOverrides) > 0 || c.UpstreamResolver != "" || c.UpstreamIPFamily != "" {
+		if err := checkGitVersion(gitBinary, 2, 37); err != nil {
+			errs = append(errs, fmt.Errorf("upstream-host-overrides/upstream-resolver/upstream-ip-family: %w", err))
+		}
+	}
+	for _, f := range []struct{ name, path string }{
+		{"upstream-ssh-key", c.UpstreamSSHKey},
+		{"upstream-ssh-known-hosts", c.UpstreamSSHKnownHosts},
+		{"landing-page-file", c.LandingPageFile},
+	} {
+		if f.path == "" {
+			continue
+		}
+		if file, err := os.Open(f.path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.name, err))
+		} else {
+			file.Close()
+		}
+	}
+	// Size settings apply to each root's filesystem on its own
+	for _, dir := range c.MirrorDirs() {
+		if dir != "" {
+			errs = append(errs, c.checkDiskSize(nearestExisting(dir))...)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkDiskSize verifies the size settings fit the filesystem holding dir.
+func (c *Config) checkDiskSize(dir string) []error {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return []error{fmt.Errorf("mirror-dir: get disk size: %w", err)}
+	}
+	total := int64(stat.Blocks) * int64(stat.Bsize)
+
+	var errs []error
+	if minFree := c.MinFreeSpace.BytesOf(total); minFree >= total {
+		errs = append(errs, fmt.Errorf("min-free-space: %d bytes must be smaller than the disk (%d bytes)", minFree, total))
+	}
+	if !c.MirrorMaxSize.IsPercent() && c.MirrorMaxSize.Bytes > total {
+		errs = append(errs, fmt.Errorf("mirror-max-size: %d bytes is larger than the disk (%d bytes)", c.MirrorMaxSize.Bytes, total))
+	}
+	return errs
+}
+
+// Warnings returns settings that work but are likely unintended or slow.
+func (c *Config) Warnings() []string {
+	var warnings []string
+	for _, dir := range c.MirrorDirs() {
+		if c.MirrorTempDir != "" && !sameFilesystem(nearestExisting(c.MirrorTempDir), nearestExisting(dir)) {
+			warnings = append(warnings, fmt.Sprintf("mirror-temp-dir and mirror dir %s are on different filesystems: new mirrors are copied into place instead of renamed", dir))
+		}
+	}
+	return warnings
+}
+
+// checkWritableDir verifies dir (or its nearest existing parent, if dir does
+// not exist yet) is a directory we can create files in.
+func checkWritableDir(dir string) error {
+	if dir == "" {
+		return errors.New("not set")
+	}
+	existing := nearestExisting(dir)
+	info, err := os.Stat(existing)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", existing)
+	}
+
+	f, err := os.CreateTemp(existing, ".smart-git-proxy-validate-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", existing, err)
+	}
+	name := f.Name()
+	_ = f.Close()
+	_ = os.Remove(name)
+	return nil
+}
+
+// checkGitVersion verifies the git binary is at least major.minor.
+func checkGitVersion(binary string, major, minor int) error {
+	out, err := exec.Command(binary, "version").Output()
+	if err != nil {
+		return fmt.Errorf("run git version: %w", err)
+	}
+	gotMajor, gotMinor, err := parseGitVersion(string(out))
+	if err != nil {
+		return err
+	}
+	if gotMajor < major || gotMajor == major && gotMinor < minor {
+		return fmt.Errorf("requires git %d.%d or later, found %d.%d", major, minor, gotMajor, gotMinor)
+	}
+	return nil
+}
+
+// parseGitVersion extracts the major and minor version from `git version`
+// output like "git version 2.39.5".
+func parseGitVersion(s string) (major, minor int, err error) {
+	v, ok := strings.CutPrefix(strings.TrimSpace(s), "git version ")
+	parts := strings.SplitN(v, ".", 3)
+	if !ok || len(parts) < 2 {
+		return 0, 0, fmt.Errorf("unexpected git version output %q", s)
+	}
+	if major, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0, fmt.Errorf("unexpected git version output %q", s)
+	}
+	if minor, err = strconv.Atoi(parts[1]); err != nil {
+		return 0, 0, fmt.Errorf("unexpected git version output %q", s)
+	}
+	return major, minor, nil
+}
+
+// within reports whether path is dir or one of its descendants.
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// nearestExisting returns path, or its closest ancestor that exists.
+func nearestExisting(path string) string {
+	existing := filepath.Clean(path)
+	for {
+		if _, err := os.Stat(existing); !os.IsNotExist(err) {
+			return existing
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return existing
+		}
+		existing = parent
+	}
+}
+
+// sameFilesystem reports whether a and b are on the same device. It errs on
+// the side of true when that can't be determined.
+func sameFilesystem(a, b string) bool {
+	ai, aerr := os.Stat(a)
+	bi, berr := os.Stat(b)
+	if aerr != nil || berr != nil {
+		return true
+	}
+	as, aok := ai.Sys().(*syscall.Stat_t)
+	bs, bok := bi.Sys().(*syscall.Stat_t)
+	if !aok || !bok {
+		return true
+	}
+	return as.Dev == bs.Dev
+}
+
+// validateUpstreamHost checks that h is a bare host (optionally with port),
+// not a URL with a scheme or path.
+func validateUpstreamHost(h string) error {
+	if strings.Contains(h, "://") || strings.ContainsAny(h, "/ ") {
+		return fmt.Errorf("invalid allowed upstream %q: expected a host name like github.com", h)
+	}
+	u, err := url.Parse("https://" + h)
+	if err != nil || u.Host != h || u.Hostname() == "" {
+		return fmt.Errorf("invalid allowed upstream %q: expected a host name like github.com", h)
+	}
+	return nil
+}
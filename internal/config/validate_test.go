@@ -0,0 +1,145 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestValidateMirrorDir(t *testing.T) {
+	dir := t.TempDir()
+
+	// Non-existent dir under a writable parent is fine
+	cfg := &Config{MirrorDir: filepath.Join(dir, "does", "not", "exist")}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected valid mirror dir, got %v", err)
+	}
+
+	// A regular file is not
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	cfg = &Config{MirrorDir: file}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for mirror dir that is a file")
+	}
+}
+
+func TestInvalidAllowedUpstreams(t *testing.T) {
+	clearEnv(t)
+	for _, v := range []string{"https://github.com", "github.com/owner", "git hub.com"} {
+		if _, err := LoadArgs([]string{"-allowed-upstreams", v}); err == nil {
+			t.Errorf("expected error for allowed upstream %q", v)
+		}
+	}
+	cfg, err := LoadArgs([]string{"-allowed-upstreams", "github.com, git.example.com:8443"})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(cfg.AllowedUpstreams) != 2 {
+		t.Fatalf("expected 2 allowed upstreams, got %v", cfg.AllowedUpstreams)
+	}
+}
+
+func TestWarningsMirrorTempDir(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{MirrorDir: filepath.Join(dir, "mirrors"), MirrorTempDir: filepath.Join(dir, "tmp")}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected valid temp dir, got %v", err)
+	}
+	if w := cfg.Warnings(); len(w) != 0 {
+		t.Fatalf("expected no warnings for temp dir on the same filesystem, got %v", w)
+	}
+}
+
+func TestValidateDiskSize(t *testing.T) {
+	dir := t.TempDir()
+	for name, cfg := range map[string]*Config{
+		"min free space of the whole disk": {MirrorDir: dir, MinFreeSpace: SizeSpec{Percent: 100}},
+		"min free space larger than disk":  {MirrorDir: dir, MinFreeSpace: SizeSpec{Bytes: 1 << 62}},
+		"max size larger than disk":        {MirrorDir: dir, MirrorMaxSize: SizeSpec{Bytes: 1 << 62}},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	cfg := &Config{MirrorDir: dir, MinFreeSpace: SizeSpec{Percent: 5}, MirrorMaxSize: SizeSpec{Percent: 80}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected percentages to be valid, got %v", err)
+	}
+}
+
+func TestValidateMirrorTempDirInsideMirrorDir(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{MirrorDir: dir, MirrorTempDir: filepath.Join(dir, "tmp")}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected error for temp dir inside mirror dir")
+	}
+}
+
+func TestWarningsMirrorTempDirOtherFilesystem(t *testing.T) {
+	const shm = "/dev/shm"
+	dir := t.TempDir()
+	if _, err := os.Stat(shm); err != nil || sameFilesystem(shm, dir) {
+		t.Skip("no second filesystem available")
+	}
+	cfg := &Config{MirrorDir: dir, MirrorTempDir: filepath.Join(shm, "smart-git-proxy-test")}
+	if w := cfg.Warnings(); len(w) != 1 {
+		t.Fatalf("expected a warning for temp dir on another filesystem, got %v", w)
+	}
+}
+
+func TestParseGitVersion(t *testing.T) {
+	tests := []struct {
+		out          string
+		major, minor int
+		wantErr      bool
+	}{
+		{"git version 2.39.5\n", 2, 39, false},
+		{"git version 2.37.1 (Apple Git-137.1)", 2, 37, false},
+		{"git version 2.45.windows.1", 2, 45, false},
+		{"git version 3", 0, 0, true},
+		{"version 2.39.5", 0, 0, true},
+	}
+	for _, tt := range tests {
+		major, minor, err := parseGitVersion(tt.out)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseGitVersion(%q) error = %v, wantErr %v", tt.out, err, tt.wantErr)
+			continue
+		}
+		if major != tt.major || minor != tt.minor {
+			t.Errorf("parseGitVersion(%q) = %d.%d, want %d.%d", tt.out, major, minor, tt.major, tt.minor)
+		}
+	}
+}
+
+func TestValidateMirrorExtraDirs(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{MirrorDir: filepath.Join(dir, "a"), MirrorExtraDirs: []string{filepath.Join(dir, "b"), filepath.Join(dir, "c")}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected valid extra dirs, got %v", err)
+	}
+
+	for _, nested := range [][]string{{filepath.Join(dir, "a", "b")}, {filepath.Join(dir, "b"), filepath.Join(dir, "b", "c")}, {dir}} {
+		cfg := &Config{MirrorDir: filepath.Join(dir, "a"), MirrorExtraDirs: nested}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("expected error for nested mirror dirs %v", nested)
+		}
+	}
+
+	clearEnv(t)
+	t.Setenv("MIRROR_DIR", "/mnt/a")
+	if _, err := LoadArgs([]string{"-mirror-extra-dirs", "/mnt/b,/mnt/a/"}); err == nil {
+		t.Fatalf("expected error for a mirror dir listed twice")
+	}
+	loaded, err := LoadArgs([]string{"-mirror-extra-dirs", " /mnt/b/ , /mnt/c"})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got := loaded.MirrorDirs(); !slices.Equal(got, []string{"/mnt/a", "/mnt/b", "/mnt/c"}) {
+		t.Fatalf("unexpected mirror dirs: %v", got)
+	}
+}
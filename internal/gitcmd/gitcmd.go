@@ -0,0 +1,87 @@
+// Package gitcmd builds the git commands the proxy runs, with the configured
+// binary and an environment that host git settings can't leak into.
+package gitcmd
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+var (
+	mu       sync.RWMutex
+	binary   = "git"
+	extraEnv []string
+)
+
+// Configure sets the git binary to run (a path or a name looked up in PATH)
+// and KEY=VALUE variables added to the environment of every git command,
+// overriding the defaults of Env. It is meant to be called once at startup.
+func Configure(bin string, env []string) {
+	mu.Lock()
+	defer mu.Unlock()
+	binary = bin
+	extraEnv = env
+}
+
+// Binary returns the configured git binary.
+func Binary() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return binary
+}
+
+// ExtraEnv returns the configured variables, for commands that build their
+// own minimal environment instead of using Env.
+func ExtraEnv() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return extraEnv
+}
+
+// Command returns a command running git with args and Env as its environment.
+func Command(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, Binary(), args...)
+	cmd.Env = Env()
+	return cmd
+}
+
+// leaky are variables that would point git commands at another repo or
+// inject config. Other GIT_* variables (GIT_SSL_CAINFO, GIT_TRACE...) are
+// the operator's and pass through.
+var leaky = []string{
+	"GIT_DIR", "GIT_WORK_TREE", "GIT_INDEX_FILE", "GIT_COMMON_DIR", "GIT_NAMESPACE", "GIT_PROTOCOL",
+	"GIT_OBJECT_DIRECTORY", "GIT_ALTERNATE_OBJECT_DIRECTORIES", "GIT_CEILING_DIRECTORIES",
+	"GIT_CONFIG", "GIT_CONFIG_PARAMETERS", "GIT_CONFIG_COUNT", "GIT_CONFIG_KEY_", "GIT_CONFIG_VALUE_",
+}
+
+// Env returns the base environment for git commands: the process's own
+// without variables changing which repo or config git uses, git's global and
+// system config files disabled, no credential prompts, then the configured
+// variables.
+func Env() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if !isLeaky(kv) {
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_CONFIG_GLOBAL=/dev/null",
+		"GIT_CONFIG_SYSTEM=/dev/null",
+	)
+	return append(env, ExtraEnv()...)
+}
+
+func isLeaky(kv string) bool {
+	name, _, _ := strings.Cut(kv, "=")
+	for _, l := range leaky {
+		if name == l || strings.HasSuffix(l, "_") && strings.HasPrefix(name, l) {
+			return true
+		}
+	}
+	return false
+}
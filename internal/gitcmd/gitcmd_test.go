@@ -0,0 +1,68 @@
+package gitcmd
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCommandUsesConfiguredBinaryAndEnv(t *testing.T) {
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found in PATH")
+	}
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+	wrapper := filepath.Join(dir, "my-git")
+	script := `#!/bin/sh
+echo "$* dir=$GIT_DIR params=$GIT_CONFIG_PARAMETERS global=$GIT_CONFIG_GLOBAL custom=$CUSTOM" >> "` + log + `"
+exec "` + realGit + `" "$@"
+`
+	if err := os.WriteFile(wrapper, []byte(script), 0o755); err != nil {
+		t.Fatalf("write git wrapper: %v", err)
+	}
+	t.Setenv("GIT_DIR", "/somewhere/else.git")
+	t.Setenv("GIT_CONFIG_PARAMETERS", "'core.bare'='false'")
+	Configure(wrapper, []string{"CUSTOM=1", "GIT_CONFIG_GLOBAL=" + filepath.Join(dir, "gitconfig")})
+	t.Cleanup(func() { Configure("git", nil) })
+
+	out, err := Command(context.Background(), "version").CombinedOutput()
+	if err != nil {
+		t.Fatalf("git version: %v: %s", err, out)
+	}
+	if !strings.HasPrefix(string(out), "git version") {
+		t.Fatalf("unexpected output: %s", out)
+	}
+	got, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatalf("wrapper was not run: %v", err)
+	}
+	want := "version dir= params= global=" + filepath.Join(dir, "gitconfig") + " custom=1\n"
+	if string(got) != want {
+		t.Fatalf("wrapper log = %q, want %q", got, want)
+	}
+}
+
+func TestEnvDefaults(t *testing.T) {
+	t.Setenv("GIT_CONFIG_COUNT", "1")
+	t.Setenv("GIT_CONFIG_KEY_0", "http.proxy")
+	t.Setenv("GIT_SSL_CAINFO", "/etc/ssl/ca.pem")
+	env := Env()
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "GIT_CONFIG_COUNT=") || strings.HasPrefix(kv, "GIT_CONFIG_KEY_") {
+			t.Errorf("leaked %s", kv)
+		}
+	}
+	for _, want := range []string{"GIT_SSL_CAINFO=/etc/ssl/ca.pem", "GIT_TERMINAL_PROMPT=0", "GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_SYSTEM=/dev/null"} {
+		found := false
+		for _, kv := range env {
+			found = found || kv == want
+		}
+		if !found {
+			t.Errorf("missing %s in %v", want, env)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package gitproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+// AdminHandler serves the admin API, mounted under the base path's /admin/.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	route := func(method, path string, h http.HandlerFunc) {
+		allow := method
+		if method == http.MethodGet {
+			allow += ", " + http.MethodHead
+		}
+		mux.HandleFunc(method+" "+path, h)
+		// Without a method, the path matches every other method
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Allow", allow)
+			writeAdminError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, fmt.Errorf("method %s not allowed on %s", r.Method, r.URL.Path))
+		})
+	}
+	route(http.MethodPost, "/admin/refresh/{host}/{owner}/{repo}", s.handleRefresh)
+	route(http.MethodGet, "/admin/bundle/{host}/{owner}/{repo}", s.handleBundle)
+	route(http.MethodGet, "/admin/repo/{host}/{owner}/{repo}/head", s.handleHead)
+	route(http.MethodGet, "/admin/repo/{host}/{owner}/{repo}/refs", s.handleRefs)
+	route(http.MethodGet, "/admin/repo/{host}/{owner}/{repo}/packs", s.handlePacks)
+	route(http.MethodPost, "/admin/preload", s.handlePreload)
+	route(http.MethodGet, "/admin/metrics/repos", s.handleTopRepos)
+	mux.HandleFunc("/admin/", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminError(w, http.StatusNotFound, CodeNotFound, fmt.Errorf("no admin endpoint %s", r.URL.Path))
+	})
+	timedOut := func(w http.ResponseWriter, err error) {
+		writeAdminError(w, http.StatusGatewayTimeout, CodeTimeout, err)
+	}
+	return s.withBasePath(s.withTimeout(classAdmin, mux, timedOut), func(w http.ResponseWriter, r *http.Request) {
+		writeAdminError(w, http.StatusNotFound, CodeNotFound, fmt.Errorf("no admin endpoint %s outside %s", r.URL.Path, s.config().BasePath))
+	})
+}
+
+// Admin API error codes. These are part of the API and must stay stable.
+const (
+	CodeNotFound            = "not_found"            // Unknown admin endpoint
+	CodeMethodNotAllowed    = "method_not_allowed"   // Known admin endpoint, wrong method
+	CodeInvalidRequest      = "invalid_request"      // Request body couldn't be read or is too large, or a query parameter is invalid
+	CodeUpstreamNotAllowed  = "upstream_not_allowed" // Host isn't in the allowed upstreams
+	CodeRepoNotFound        = "repo_not_found"       // No (shareable) mirror for the repo
+	CodeAuthRequired        = "auth_required"        // Mirror needs credentials upstream accepts for it
+	CodeDiskFull            = "disk_full"            // Mirror dir ran out of space
+	CodeUpstreamTimeout     = "upstream_timeout"     // Upstream didn't answer within the upstream timeout
+	CodeUpstreamUnreachable = "upstream_unreachable" // Upstream fetch failed (network, auth, missing repo)
+	CodeTimeout             = "timeout"              // Request didn't complete within its REQUEST_TIMEOUTS deadline
+	CodeInternal            = "internal"             // Anything else
+)
+
+// adminError is the JSON body of every admin API error response.
+type adminError struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+func writeAdminError(w http.ResponseWriter, status int, code string, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(adminError{Error: err.Error(), Code: code})
+}
+
+// upstreamError maps an error from fetching upstream to an admin API status and code.
+func upstreamError(err error) (int, string) {
+	switch {
+	case errors.Is(err, mirror.ErrNotMirrored):
+		return http.StatusNotFound, CodeRepoNotFound
+	case errors.Is(err, mirror.ErrAuthRequired):
+		return http.StatusUnauthorized, CodeAuthRequired
+	case errors.Is(err, syscall.ENOSPC):
+		return http.StatusInsufficientStorage, CodeDiskFull
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, CodeUpstreamTimeout
+	default:
+		return http.StatusBadGateway, CodeUpstreamUnreachable
+	}
+}
+
+// handleRefresh syncs a mirror from upstream immediately (cloning it if missing)
+// and responds with its HEAD and ref summary.
+func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	cfg := s.config()
+	host, owner := cfg.UpstreamHostAliases.Canonical(r.PathValue("host")), r.PathValue("owner")
+	repo := cfg.KeepGitSuffixHosts.RepoName(host, r.PathValue("repo"))
+	if err := s.checkAllowed(host); err != nil {
+		writeAdminError(w, http.StatusBadRequest, CodeUpstreamNotAllowed, err)
+		return
+	}
+
+	repoKey := fmt.Sprintf("%s/%s/%s", host, owner, repo)
+	upstreamURL, err := s.mirror.UpstreamURL(host, owner, repo)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, CodeUpstreamNotAllowed, err)
+		return
+	}
+	res, err := s.mirror.Refresh(r.Context(), host, owner, repo, upstreamURL, s.upstreamAuth(r))
+	if err != nil {
+		s.log.Error("refresh failed", "err", err, "repo", repoKey)
+		status, code := upstreamError(err)
+		writeAdminError(w, status, code, err)
+		return
+	}
+	s.statusCache.Store(repoKey, res.Status)
+	s.log.Info("admin refresh", "repo", repoKey, "status", res.Status, "duration_ms", time.Since(start).Milliseconds())
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// mirrorAccess resolves the repo of /admin/repo/ requests, checking its host
+// is allowed and the client may read its mirror as git requests would. It
+// reports false once it answered with an error.
+func (s *Server) mirrorAccess(w http.ResponseWriter, r *http.Request) (host, owner, repo string, ok bool) {
+	cfg := s.config()
+	host, owner = cfg.UpstreamHostAliases.Canonical(r.PathValue("host")), r.PathValue("owner")
+	repo = cfg.KeepGitSuffixHosts.RepoName(host, r.PathValue("repo"))
+	if err := s.checkAllowed(host); err != nil {
+		writeAdminError(w, http.StatusBadRequest, CodeUpstreamNotAllowed, err)
+		return "", "", "", false
+	}
+	upstreamURL, err := s.mirror.UpstreamURL(host, owner, repo)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, CodeUpstreamNotAllowed, err)
+		return "", "", "", false
+	}
+	if err := s.mirror.CheckAccess(r.Context(), host, owner, repo, upstreamURL, s.upstreamAuth(r)); err != nil {
+		status, code := upstreamError(err)
+		writeAdminError(w, status, code, err)
+		return "", "", "", false
+	}
+	return host, owner, repo, true
+}
+
+// handleHead reports a mirror's default branch without contacting upstream.
+func (s *Server) handleHead(w http.ResponseWriter, r *http.Request) {
+	host, owner, repo, ok := s.mirrorAccess(w, r)
+	if !ok {
+		return
+	}
+	head, err := s.mirror.Head(r.Context(), host, owner, repo)
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, CodeRepoNotFound, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(head)
+}
+
+// handleRefs lists a mirror's refs, for debugging it without a shell on the
+// proxy. The prefix query parameter (e.g. refs/heads/) narrows the listing.
+func (s *Server) handleRefs(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	if prefix != "" && !strings.HasPrefix(prefix, "refs/") {
+		writeAdminError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Errorf("invalid prefix %q: expected refs/...", prefix))
+		return
+	}
+	host, owner, repo, ok := s.mirrorAccess(w, r)
+	if !ok {
+		return
+	}
+	refs, err := s.mirror.Refs(r.Context(), host, owner, repo, prefix)
+	if errors.Is(err, mirror.ErrNotMirrored) {
+		writeAdminError(w, http.StatusNotFound, CodeRepoNotFound, err)
+		return
+	} else if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, CodeInternal, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Refs []mirror.RefInfo `json:"refs"`
+	}{refs})
+}
+
+// handlePacks lists a mirror's packfiles and their sizes, for debugging it
+// without a shell on the proxy.
+func (s *Server) handlePacks(w http.ResponseWriter, r *http.Request) {
+	host, owner, repo, ok := s.mirrorAccess(w, r)
+	if !ok {
+		return
+	}
+	packs, err := s.mirror.Packs(host, owner, repo)
+	if errors.Is(err, mirror.ErrNotMirrored) {
+		writeAdminError(w, http.StatusNotFound, CodeRepoNotFound, err)
+		return
+	} else if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, CodeInternal, err)
+		return
+	}
+	var size int64
+	for _, p := range packs {
+		size += p.Size
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Packs []mirror.PackInfo `json:"packs"`
+		Size  int64             `json:"size"`
+	}{packs, size})
+}
+
+// maxTopRepos bounds the limit of /admin/metrics/repos.
+const maxTopRepos = 1000
+
+// handleTopRepos lists the repos with the highest per-repo counter given by
+// the by query parameter (requests by default), for triage without a
+// dashboard. Counts are since startup, as exported on /metrics.
+func (s *Server) handleTopRepos(w http.ResponseWriter, r *http.Request) {
+	by := r.URL.Query().Get("by")
+	if by == "" {
+		by = "requests"
+	}
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTopRepos {
+			writeAdminError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Errorf("invalid limit %q: expected 1 to %d", v, maxTopRepos))
+			return
+		}
+		limit = n
+	}
+	repos, err := s.metrics.TopRepos(by, limit)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, CodeInvalidRequest, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		By    string              `json:"by"`
+		Repos []metrics.RepoCount `json:"repos"`
+	}{by, repos})
+}
+
+// handleBundle streams a mirror as a git bundle so peer proxies can seed their
+// own mirror without going to upstream. Mirrors cloned with credentials are
+// never shared, so the bundle needs no credentials of its own.
+func (s *Server) handleBundle(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config()
+	host, owner := cfg.UpstreamHostAliases.Canonical(r.PathValue("host")), r.PathValue("owner")
+	repo := cfg.KeepGitSuffixHosts.RepoName(host, r.PathValue("repo"))
+	if err := s.checkAllowed(host); err != nil {
+		writeAdminError(w, http.StatusBadRequest, CodeUpstreamNotAllowed, err)
+		return
+	}
+	repoKey := fmt.Sprintf("%s/%s/%s", host, owner, repo)
+
+	w.Header().Set("Content-Type", "application/x-git-bundle")
+	cw := &countingWriter{w: w}
+	err := s.mirror.WriteBundle(r.Context(), cw, host, owner, repo)
+	switch {
+	case err != nil && cw.n > 0:
+		// The peer already has part of the bundle; cut the connection so it
+		// sees a failed transfer rather than a short bundle
+		s.log.Error("write bundle failed mid-stream", "err", err, "repo", repoKey, "bytes", cw.n)
+		panic(http.ErrAbortHandler)
+	case errors.Is(err, mirror.ErrNotMirrored):
+		writeAdminError(w, http.StatusNotFound, CodeRepoNotFound, err)
+	case err != nil:
+		s.log.Error("write bundle failed", "err", err, "repo", repoKey)
+		writeAdminError(w, http.StatusInternalServerError, CodeInternal, err)
+	default:
+		s.log.Info("served mirror bundle to peer", "repo", repoKey, "remote", s.clientIP(r))
+	}
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,85 @@
+package gitproxy
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/gitserve"
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+// handleUploadArchive serves git archive --remote from the mirror, synced
+// first like for a clone as clients don't fetch info/refs before it.
+func (s *Server) handleUploadArchive(w http.ResponseWriter, r *http.Request, host, owner, repo, repoKey string, start time.Time) {
+	if !s.limitBody(w, r, repoKey) {
+		return
+	}
+	upstreamURL, err := s.mirror.UpstreamURL(host, owner, repo)
+	if err != nil {
+		s.fail(w, repoKey, KindArchive, err)
+		return
+	}
+	repoPath, status, err := s.mirror.EnsureRepo(r.Context(), host, owner, repo, upstreamURL, s.upstreamAuth(r))
+	if err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		s.fail(w, repoKey, KindArchive, err)
+		return
+	}
+	decision := decisionFrom(r.Context())
+	decision.mirrored(status)
+
+	req, err := gitserve.ReadArchiveRequest(r)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s.rejectBody(w, repoKey, -1)
+			return
+		}
+		s.metrics.ErrorsTotal.WithLabelValues(repoKey, string(KindArchive)).Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Archives of a commit are replayed from the archive cache
+	cfg := s.config()
+	var cache *gitserve.PackCacheEntry
+	if cfg.CacheUploadArchives {
+		if key, ok := gitserve.ArchiveKey(r.Context(), repoPath, req); ok {
+			cache = &gitserve.PackCacheEntry{
+				Dir:      filepath.Join(repoPath, "archives"),
+				Key:      key,
+				DirMode:  cfg.CacheDirMode,
+				FileMode: cfg.CacheFileMode,
+
+				SkipVerify:  !cfg.CacheChecksums,
+				OnCorrupt:   s.metrics.CacheChecksums.WithLabelValues(string(KindArchive)).Inc,
+				ContentType: gitserve.ArchiveResultType,
+				Ranges:      true,
+			}
+			served, err := gitserve.ServeCachedPack(w, r, *cache, string(mirror.StatusArchiveHit), s.log)
+			if err != nil {
+				s.log.Error("serve cached archive failed", "err", err, "repo", repoKey)
+			}
+			if served {
+				decision.status = mirror.StatusArchiveHit
+				s.metrics.ResponsesTotal.WithLabelValues(repoKey, string(KindArchive), "200").Inc()
+				return
+			}
+		}
+	}
+
+	decision.servingLocally()
+	if err := gitserve.ServeUploadArchive(w, r, repoPath, req, string(status), cache, s.log); err != nil {
+		// Response already started, can't change status
+		s.log.Error("serve upload-archive failed", "err", err, "repo", repoKey)
+		s.metrics.ErrorsTotal.WithLabelValues(repoKey, string(KindArchive)).Inc()
+		return
+	}
+	s.logRequest(r, start, http.StatusOK, "repo", repoKey, "status", status)
+	s.metrics.ResponsesTotal.WithLabelValues(repoKey, string(KindArchive), "200").Inc()
+	s.metrics.UpstreamLatency.WithLabelValues(repoKey, string(KindArchive)).Observe(time.Since(start).Seconds())
+}
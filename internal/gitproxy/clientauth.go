@@ -0,0 +1,57 @@
+package gitproxy
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+)
+
+// authenticateClient checks the credentials r presents against the
+// configured ClientAuth, if any, and answers 401 if they don't match. The
+// Basic challenge makes git ask its credential helper and retry.
+func (s *Server) authenticateClient(w http.ResponseWriter, r *http.Request) bool {
+	auth := s.config().ClientAuth
+	if !auth.Enabled() || clientAuthorized(r, auth) {
+		return true
+	}
+	s.log.Debug("client not authenticated", "path", r.URL.Path, "client", s.clientIP(r), "has_credentials", r.Header.Get("Authorization") != "")
+	w.Header().Set("WWW-Authenticate", `Basic realm="smart-git-proxy"`)
+	http.Error(w, "authentication required", http.StatusUnauthorized)
+	return false
+}
+
+// clientAuthorized reports whether r carries one of auth's tokens, as a bearer
+// token or basic auth password, or the basic auth password of one of its users.
+func clientAuthorized(r *http.Request, auth config.ClientAuth) bool {
+	if user, password, ok := r.BasicAuth(); ok {
+		if want, found := auth.Users[user]; found && secretEqual(password, want) {
+			return true
+		}
+	}
+	_, ok := clientToken(r, auth)
+	return ok
+}
+
+// clientToken returns which of auth's tokens r carries, as a bearer token or
+// basic auth password.
+func clientToken(r *http.Request, auth config.ClientAuth) (string, bool) {
+	secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		if _, secret, ok = r.BasicAuth(); !ok {
+			return "", false
+		}
+	}
+	for _, token := range auth.Tokens {
+		if secretEqual(secret, token) {
+			return token, true
+		}
+	}
+	return "", false
+}
+
+// secretEqual compares secrets in constant time.
+func secretEqual(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
@@ -0,0 +1,119 @@
+package gitproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/gitserve"
+)
+
+// daemonRequestTimeout bounds how long git:// clients take to send their
+// request once connected.
+const daemonRequestTimeout = 15 * time.Second
+
+// ServeDaemon serves mirrors read-only over the git:// protocol on ln, like
+// git daemon, until ln is closed. Repos are addressed as over HTTP
+// (git://proxy/github.com/owner/repo), mirrored and synced the same way and
+// subject to the same allowed upstreams and services. git:// has no way to
+// send credentials, so mirrors are synced as anonymous clients of the proxy
+// are, and ref requests restricted mirrors leave out aren't passed through.
+func (s *Server) ServeDaemon(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.serveDaemonConn(conn)
+	}
+}
+
+func (s *Server) serveDaemonConn(conn net.Conn) {
+	defer conn.Close()
+	start := time.Now()
+	client, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		client = conn.RemoteAddr().String()
+	}
+
+	_ = conn.SetReadDeadline(start.Add(daemonRequestTimeout))
+	req, err := gitserve.ReadDaemonRequest(conn)
+	if err != nil {
+		s.log.Debug("invalid git daemon request", "client", client, "err", err)
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	s.log.Debug("incoming git daemon request", "service", req.Service, "path", req.Path, "client", client)
+
+	host, owner, repo, err := s.resolveDaemonTarget(req)
+	if err != nil {
+		s.log.Warn("git daemon request refused", "path", req.Path, "client", client, "err", err)
+		_ = gitserve.DaemonError(conn, err.Error())
+		return
+	}
+
+	// Connections only end once upload-pack is done, or the client gone
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := s.config()
+	authHeader := s.proxyAuth()
+	owner, repo = s.mirror.Canonical(ctx, host, owner, repo, authHeader)
+	repoKey := fmt.Sprintf("%s/%s/%s", host, owner, repo)
+	s.metrics.RequestsTotal.WithLabelValues(repoKey, string(KindDaemon), client).Inc()
+
+	upstreamURL, err := s.mirror.UpstreamURL(host, owner, repo)
+	if err != nil {
+		s.failDaemon(conn, repoKey, err)
+		return
+	}
+	repoPath, status, err := s.mirror.EnsureRepo(ctx, host, owner, repo, upstreamURL, authHeader)
+	if err != nil {
+		s.failDaemon(conn, repoKey, err)
+		return
+	}
+
+	refInWant := s.mirror.MirroredRefs(host, owner, repo) == nil
+	if err := gitserve.ServeDaemon(ctx, conn, repoPath, req, cfg.UploadPackThreads, cfg.StripRefPatterns, refInWant, s.log); err != nil {
+		s.metrics.ErrorsTotal.WithLabelValues(repoKey, string(KindDaemon)).Inc()
+		s.log.Error("serve git daemon request failed", "err", err, "repo", repoKey)
+		return
+	}
+	s.metrics.UpstreamLatency.WithLabelValues(repoKey, string(KindDaemon)).Observe(time.Since(start).Seconds())
+	s.log.Info("git daemon request", "repo", repoKey, "status", status, "client", client, "duration_ms", time.Since(start).Milliseconds())
+}
+
+// resolveDaemonTarget returns the repo a git:// request is for, if it may be
+// served: git-upload-pack of a repo from an allowed upstream.
+func (s *Server) resolveDaemonTarget(req *gitserve.DaemonRequest) (host, owner, repo string, err error) {
+	if req.Service != serviceUploadPack {
+		return "", "", "", fmt.Errorf("service %q not allowed", req.Service)
+	}
+	if err := s.checkServiceName(req.Service); err != nil {
+		return "", "", "", err
+	}
+	p := strings.TrimSuffix(strings.TrimPrefix(collapseSlashes(req.Path), "/"), "/")
+	host, owner, repo, ok := splitRepoPath(p)
+	if !ok || strings.Contains(p, "..") {
+		return "", "", "", fmt.Errorf("invalid repo path %s, expected /host/owner/repo", req.Path)
+	}
+	cfg := s.config()
+	host = cfg.UpstreamHostAliases.Canonical(host)
+	repo = cfg.KeepGitSuffixHosts.RepoName(host, repo)
+	if err := s.checkAllowed(host); err != nil {
+		return "", "", "", err
+	}
+	return host, owner, repo, nil
+}
+
+// failDaemon reports a git:// request for repoKey failed with err.
+func (s *Server) failDaemon(conn net.Conn, repoKey string, err error) {
+	s.metrics.ErrorsTotal.WithLabelValues(repoKey, string(KindDaemon)).Inc()
+	s.log.Error("git daemon request failed", "err", err, "repo", repoKey)
+	_ = gitserve.DaemonError(conn, err.Error())
+}
@@ -0,0 +1,149 @@
+package gitproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/gitserve"
+	"github.com/crohr/smart-git-proxy/internal/logging"
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+// Where a response came from, as logged in cache decisions.
+const (
+	sourceMemcache     = "memcache"     // In-memory info/refs advertisement
+	sourceCapabilities = "capabilities" // In-memory protocol v2 capabilities, shared by all repos
+	sourceDisk         = "disk"         // Mirror or pinned pack cache
+	sourceUpstream     = "upstream"     // Passed through without a mirror
+	sourceStale        = "stale"        // Mirror whose sync just failed
+)
+
+// cacheDecision records how a git request was served. Handlers fill it in
+// through the request context and it is logged once as the request ends, so
+// why a clone reached upstream can be read off a single line per request.
+type cacheDecision struct {
+	requestID string
+	repo      string
+	kind      Kind
+	status    mirror.Status // What was done to the mirror, as sent in X-Git-Proxy-Status
+	refreshed bool          // Mirror cloned or synced from upstream by this request
+	source    string
+	trace     gitserve.Trace
+	phases    *mirror.Phases // Where the time went, nil unless SlowRequestThreshold is set
+	localFrom time.Time      // When local git started preparing the response, zero if it didn't
+}
+
+type decisionKey struct{}
+
+// decisionFrom returns the cacheDecision of the request ctx belongs to, or a
+// discarded one.
+func decisionFrom(ctx context.Context) *cacheDecision {
+	if d, ok := ctx.Value(decisionKey{}).(*cacheDecision); ok {
+		return d
+	}
+	return &cacheDecision{}
+}
+
+// mirrored records that the request was served from a mirror EnsureRepo left
+// in status.
+func (d *cacheDecision) mirrored(status mirror.Status) {
+	d.status = status
+	d.refreshed = status == mirror.StatusClone || status == mirror.StatusSync
+	d.source = sourceDisk
+	if status == mirror.StatusStale {
+		d.source = sourceStale
+	}
+}
+
+// servingLocally records that local git starts preparing the response, for
+// the local_git phase.
+func (d *cacheDecision) servingLocally() {
+	if d.localFrom.IsZero() {
+		d.localFrom = time.Now()
+	}
+}
+
+// withDecision attaches a new cacheDecision for repo to r, to be served
+// through the returned writer, and returns a func logging it once the response
+// is written, sampled like the access log, and counting it (misses per repo,
+// upload-pack requests by whether they were served from a mirror, requests
+// the client gave up on). The request ID is sent back in X-Request-Id.
+// Requests over SlowRequestThreshold also get where their time went logged.
+func (s *Server) withDecision(w http.ResponseWriter, r *http.Request, repo string, kind Kind, start time.Time) (*statusWriter, *http.Request, func()) {
+	d := &cacheDecision{requestID: requestID(r, s.fromTrustedProxy(r)), repo: repo, kind: kind}
+	ctx := context.WithValue(r.Context(), decisionKey{}, d)
+	ctx = gitserve.WithTrace(ctx, &d.trace)
+	if s.config().SlowRequestThreshold > 0 {
+		d.phases = &mirror.Phases{}
+		ctx = mirror.WithPhases(ctx, d.phases)
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	sw.Header().Set("X-Request-Id", d.requestID)
+	return sw, r.WithContext(ctx), func() {
+		switch {
+		case d.trace.Capabilities:
+			d.source = sourceCapabilities
+		case d.trace.FromMemory:
+			d.source = sourceMemcache
+		}
+		if d.kind == KindPack && d.source != "" {
+			mode := fetchMirrored
+			if d.source == sourceUpstream {
+				mode = fetchDirect
+			}
+			s.metrics.PackFetches.WithLabelValues(mode).Inc()
+		}
+		hit := d.source != "" && d.source != sourceUpstream && !d.refreshed
+		if d.source != "" && !hit {
+			s.metrics.CacheMisses.WithLabelValues(d.repo, string(d.kind)).Inc()
+		}
+		// Until the handler returns, only the client going away cancels it
+		if errors.Is(r.Context().Err(), context.Canceled) {
+			s.metrics.ClientAborts.WithLabelValues(string(d.kind)).Inc()
+		}
+		code := sw.status
+		if code == 0 {
+			code = http.StatusOK
+		}
+		cfg := s.config()
+		took := time.Since(start)
+		if d.phases != nil && cfg.SlowRequestThreshold > 0 && took >= cfg.SlowRequestThreshold {
+			s.logSlow(d, sw, code, took)
+		}
+		if !(logging.Sampler{Rate: cfg.AccessLogSampleRate, Slow: cfg.AccessLogSlowThreshold}).Keep(code, took) {
+			return
+		}
+		s.log.Info("cache decision", "request_id", d.requestID, "repo", d.repo, "kind", d.kind, "hit", hit,
+			"source", d.source, "status", d.status, "refreshed", d.refreshed, "code", code, "bytes", sw.bytes, "duration_ms", took.Milliseconds())
+	}
+}
+
+// logSlow logs where the time of the request d was made for went, took in
+// all, answered through sw with code.
+func (s *Server) logSlow(d *cacheDecision, sw *statusWriter, code int, took time.Duration) {
+	end := time.Now()
+	if !sw.firstByte.IsZero() {
+		d.phases.Add(mirror.PhaseTransfer, end.Sub(sw.firstByte))
+		end = sw.firstByte
+	}
+	if !d.localFrom.IsZero() {
+		d.phases.Add(mirror.PhaseLocalGit, end.Sub(d.localFrom))
+	}
+	s.log.Warn("slow request", append([]any{"request_id", d.requestID, "repo", d.repo, "kind", d.kind, "source", d.source,
+		"code", code, "bytes", sw.bytes, "duration_ms", took.Milliseconds()}, d.phases.LogAttrs(took)...)...)
+}
+
+// requestID returns the ID correlating the log lines of r: the X-Request-Id
+// set by a trusted proxy in front, or a new random one.
+func requestID(r *http.Request, trusted bool) string {
+	if id := r.Header.Get("X-Request-Id"); trusted && id != "" && len(id) <= 128 {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,193 @@
+package gitproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+// directHeader lets clients have one-off clones of repos without a mirror
+// served straight from upstream rather than mirrored, e.g. with
+// git -c http.extraHeader="X-Git-Proxy-Direct: 1".
+const directHeader = "X-Git-Proxy-Direct"
+
+// How git-upload-pack requests were served, as counted in PackFetches.
+const (
+	fetchMirrored = "mirrored"
+	fetchDirect   = "direct"
+)
+
+// maxDirectAdvert is the largest info/refs response kept in memory for
+// DirectInfoRefsTTL; those of repos with many refs are always fetched.
+const maxDirectAdvert = 1 << 20
+
+// maxDirectAdverts bounds how many info/refs responses are kept in memory for
+// DirectInfoRefsTTL.
+const maxDirectAdverts = 256
+
+// direct reports whether r is to be served straight from upstreamURL instead
+// of a mirror: the client asked for it with directHeader or the repo matches
+// DirectRepos, and the repo isn't mirrored yet. Repos fetched over SSH are
+// always mirrored, as they can't be passed through.
+func (s *Server) direct(r *http.Request, repoPath, repoKey, upstreamURL string) bool {
+	if !s.directAsked(r, repoKey) {
+		return false
+	}
+	if !strings.HasPrefix(upstreamURL, "https://") {
+		return false
+	}
+	_, err := os.Stat(repoPath)
+	return os.IsNotExist(err)
+}
+
+// directAsked reports whether r asks for repoKey to be served straight from
+// upstream, with directHeader or by matching DirectRepos.
+func (s *Server) directAsked(r *http.Request, repoKey string) bool {
+	asked, _ := strconv.ParseBool(strings.TrimSpace(r.Header.Get(directHeader)))
+	return asked || s.config().DirectRepos.Match(repoKey)
+}
+
+// directInfoRefs serves info/refs of a repo served straight from upstream,
+// from memory if upstream answered the same request less than
+// DirectInfoRefsTTL ago, so a burst of clones of the repo lists its refs
+// upstream once.
+func (s *Server) directInfoRefs(w http.ResponseWriter, r *http.Request, upstreamURL, repoKey string, start time.Time) {
+	ttl := s.config().DirectInfoRefsTTL
+	if ttl <= 0 {
+		s.passthrough(w, r, upstreamURL, repoKey, KindInfo, start)
+		return
+	}
+	key := directAdvertKey(r, repoKey, s.upstreamAuth(r))
+	if ad, ok := s.directAdverts.get(key); ok {
+		w.Header().Set("Content-Type", ad.contentType)
+		if ad.contentEncoding != "" {
+			w.Header().Set("Content-Encoding", ad.contentEncoding)
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Git-Proxy-Status", string(mirror.StatusPassthrough))
+		decision := decisionFrom(r.Context())
+		decision.status, decision.source = mirror.StatusPassthrough, sourceMemcache
+		if _, err := w.Write(ad.body); err != nil {
+			s.log.Debug("write cached info/refs failed", "err", err, "repo", repoKey)
+		}
+		s.logRequest(r, start, http.StatusOK, "repo", repoKey, "status", mirror.StatusPassthrough)
+		s.metrics.ResponsesTotal.WithLabelValues(repoKey, string(KindInfo), "200").Inc()
+		s.metrics.UpstreamLatency.WithLabelValues(repoKey, string(KindInfo)).Observe(time.Since(start).Seconds())
+		return
+	}
+
+	rec := &advertRecorder{ResponseWriter: w}
+	// Responses cut short, by the client or upstream, are never kept
+	complete := s.passthrough(rec, r, upstreamURL, repoKey, KindInfo, start)
+	if complete && rec.status == http.StatusOK && !rec.tooLarge {
+		s.directAdverts.put(key, directAdvert{
+			contentType:     w.Header().Get("Content-Type"),
+			contentEncoding: w.Header().Get("Content-Encoding"),
+			body:            rec.body.Bytes(),
+			expires:         time.Now().Add(ttl),
+		})
+	}
+}
+
+// directAdvertKey returns the key of the info/refs response upstream sends
+// for r when fetched with auth: it depends on the service, protocol version
+// and encodings asked for, and on what the credentials can see. Nothing else
+// of the query is used by git, so it is left out.
+func directAdvertKey(r *http.Request, repoKey, auth string) string {
+	h := sha256.New()
+	for _, v := range []string{repoKey, r.URL.Query().Get("service"), r.Header.Get("Git-Protocol"), r.Header.Get("Accept-Encoding"), auth} {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type directAdvert struct {
+	contentType     string
+	contentEncoding string
+	body            []byte
+	expires         time.Time
+}
+
+// directAdverts keeps info/refs responses passed through from upstream
+// until they expire, maxDirectAdverts of them at most. Once full, expired
+// entries are dropped as new ones are added, then those expiring first.
+type directAdverts struct {
+	mu      sync.Mutex
+	entries map[string]directAdvert
+}
+
+func (c *directAdverts) get(key string) (directAdvert, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ad, ok := c.entries[key]
+	if !ok || time.Now().After(ad.expires) {
+		return directAdvert{}, false
+	}
+	return ad, true
+}
+
+func (c *directAdverts) put(key string, ad directAdvert) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]directAdvert)
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxDirectAdverts {
+		now := time.Now()
+		oldest := ""
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			} else if oldest == "" || e.expires.Before(c.entries[oldest].expires) {
+				oldest = k
+			}
+		}
+		if len(c.entries) >= maxDirectAdverts {
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[key] = ad
+}
+
+// advertRecorder keeps a copy of the response written through it, up to
+// maxDirectAdvert bytes.
+type advertRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	tooLarge bool // Over maxDirectAdvert, so not kept
+}
+
+func (rec *advertRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *advertRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.body.Len()+len(b) > maxDirectAdvert {
+		rec.tooLarge = true
+		rec.body.Reset()
+	}
+	if !rec.tooLarge {
+		rec.body.Write(b)
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *advertRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
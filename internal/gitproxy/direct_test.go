@@ -0,0 +1,33 @@
+package gitproxy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDirectAdvertsBounded(t *testing.T) {
+	var c directAdverts
+	now := time.Now()
+	// One expired entry, the others expiring in the order they are added
+	c.put("expired", directAdvert{expires: now.Add(-time.Second)})
+	for i := 1; i < maxDirectAdverts; i++ {
+		c.put(fmt.Sprint(i), directAdvert{expires: now.Add(time.Duration(i) * time.Minute)})
+	}
+
+	// Expired entries make room first
+	c.put("new", directAdvert{expires: now.Add(time.Hour)})
+	if _, ok := c.entries["expired"]; ok || len(c.entries) != maxDirectAdverts {
+		t.Fatalf("expected the expired entry dropped, got %d entries", len(c.entries))
+	}
+	// Then those expiring first
+	c.put("newer", directAdvert{expires: now.Add(time.Hour)})
+	if _, ok := c.get("1"); ok || len(c.entries) != maxDirectAdverts {
+		t.Fatalf("expected the entry expiring first dropped, got %d entries", len(c.entries))
+	}
+	for _, key := range []string{"2", "new", "newer"} {
+		if _, ok := c.get(key); !ok {
+			t.Fatalf("expected %s kept", key)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package gitproxy
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+)
+
+func newForwardedServer() *Server {
+	s := &Server{}
+	s.cfg.Store(&config.Config{
+		TrustedProxyCIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+	return s
+}
+
+func TestExternalBaseURL(t *testing.T) {
+	s := newForwardedServer()
+	tests := []struct {
+		name       string
+		remoteAddr string
+		tls        bool
+		headers    map[string]string
+		want       string
+	}{
+		{"direct", "203.0.113.5:1234", false, nil, "http://proxy.internal"},
+		{"direct tls", "203.0.113.5:1234", true, nil, "https://proxy.internal"},
+		{"trusted proxy", "10.1.2.3:1234", false, map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "git.example.com"}, "https://git.example.com"},
+		{"trusted proxy chain", "10.1.2.3:1234", false, map[string]string{"X-Forwarded-Proto": "https, http", "X-Forwarded-Host": "git.example.com, lb.internal"}, "https://git.example.com"},
+		{"untrusted proxy", "203.0.113.5:1234", false, map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example.com"}, "http://proxy.internal"},
+		{"bogus proto", "10.1.2.3:1234", false, map[string]string{"X-Forwarded-Proto": "gopher"}, "http://proxy.internal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://proxy.internal/admin/refresh/github.com/o/r", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := s.externalBaseURL(r); got != tt.want {
+				t.Fatalf("externalBaseURL = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	s := newForwardedServer()
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		{"direct", "203.0.113.5:1234", "", "203.0.113.5"},
+		{"untrusted peer can't spoof", "203.0.113.5:1234", "198.51.100.1", "203.0.113.5"},
+		{"trusted proxy", "10.1.2.3:1234", "198.51.100.1", "198.51.100.1"},
+		{"chain of trusted proxies", "10.1.2.3:1234", "198.51.100.1, 10.9.9.9", "198.51.100.1"},
+		{"spoofed first hop ignored", "10.1.2.3:1234", "1.1.1.1, 198.51.100.1", "198.51.100.1"},
+		{"trusted proxy without header", "10.1.2.3:1234", "", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if got := s.clientIP(r); got != tt.want {
+				t.Fatalf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
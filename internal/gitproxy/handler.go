@@ -5,15 +5,21 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"log/slog"
 
 	"github.com/crohr/smart-git-proxy/internal/config"
 	"github.com/crohr/smart-git-proxy/internal/gitserve"
+	"github.com/crohr/smart-git-proxy/internal/logging"
 	"github.com/crohr/smart-git-proxy/internal/metrics"
 	"github.com/crohr/smart-git-proxy/internal/mirror"
 )
@@ -22,109 +28,271 @@ import (
 type Kind string
 
 const (
-	KindInfo Kind = "info"
-	KindPack Kind = "pack"
+	KindInfo    Kind = "info"
+	KindPack    Kind = "pack"
+	KindDumb    Kind = "dumb"    // Static files of the dumb HTTP protocol (HEAD, objects/...)
+	KindPush    Kind = "push"    // git-receive-pack, passed through to upstream
+	KindArchive Kind = "archive" // git-upload-archive, served from the mirror
+	KindDaemon  Kind = "daemon"  // git-upload-pack over git://, served from the mirror
 )
 
 type Server struct {
-	cfg     *config.Config
+	cfg     atomic.Pointer[config.Config] // Swapped as a whole by Reload
 	mirror  *mirror.Mirror
 	log     *slog.Logger
 	metrics *metrics.Metrics
+	adverts *gitserve.AdvertCache // In-memory info/refs advertisements and capabilities, nil when disabled
+	ready   atomic.Bool           // Set once the WarmBeforeReady repos are mirrored
+
+	// info/refs of repos served straight from upstream, kept for DirectInfoRefsTTL
+	directAdverts directAdverts
 
 	// Track last cache status per repo for display in upload-pack
 	statusCache sync.Map // map[repoKey]mirror.Status
 }
 
 func New(cfg *config.Config, m *mirror.Mirror, log *slog.Logger, metrics *metrics.Metrics) *Server {
-	return &Server{cfg: cfg, mirror: m, log: log, metrics: metrics}
+	s := &Server{mirror: m, log: log, metrics: metrics}
+	s.cfg.Store(cfg)
+	s.ready.Store(len(cfg.WarmBeforeReady) == 0)
+	if cfg.InfoRefsMemCacheBytes > 0 || cfg.CapabilitiesCacheTTL > 0 {
+		// Mirrors aren't synced again before SyncStaleAfter, nor should their advertisements
+		s.adverts = gitserve.NewAdvertCache(cfg.InfoRefsMemCacheBytes, cfg.SyncStaleAfter)
+		s.adverts.CacheCapabilities(cfg.CapabilitiesCacheTTL)
+		if cfg.CacheChecksums {
+			s.adverts.Verify(metrics.CacheChecksums.WithLabelValues(string(KindInfo)).Inc)
+		}
+		m.OnChange(s.adverts.Invalidate)
+	}
+	return s
+}
+
+// config returns the current configuration.
+func (s *Server) config() *config.Config {
+	return s.cfg.Load()
+}
+
+// Reload applies the reloadable settings of next (see config.Config.Reload)
+// to requests and mirror operations started from now on, without recreating
+// listeners or the mirror cache. Changes to other settings are ignored with a
+// warning.
+func (s *Server) Reload(next *config.Config) {
+	cfg, ignored := s.config().Reload(next)
+	for _, name := range ignored {
+		s.log.Warn("config change requires a restart, ignoring it", "field", name)
+	}
+	s.cfg.Store(cfg)
+	s.mirror.Reload(cfg)
+	s.log.Info("config reloaded", "allowed_upstreams", cfg.AllowedUpstreams, "sync_stale_after", cfg.SyncStaleAfter, "upstream_info_timeout", cfg.UpstreamInfoTimeout, "upstream_pack_timeout", cfg.UpstreamPackTimeout)
 }
 
 func (s *Server) Handler() http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	git := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		s.log.Debug("incoming request", "method", r.Method, "path", r.URL.Path, "query", r.URL.RawQuery)
+		s.log.Debug("incoming request", "method", r.Method, "path", r.URL.Path, "query", r.URL.RawQuery, "client", s.clientIP(r))
 
 		host, owner, repo, kind, err := s.resolveTarget(r)
+		if errors.Is(err, errNotGitPath) {
+			if r.URL.Path == "/" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+				s.serveLanding(w, r)
+			} else {
+				s.notGitPath(w, r, err)
+			}
+			return
+		}
+		// Before telling which repos and services are refused
+		if !s.authenticateClient(w, r) {
+			return
+		}
 		if err != nil {
 			s.log.Error("resolve target failed", "err", err, "path", r.URL.Path)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		r = r.WithContext(mirror.WithPriority(r.Context(), s.priority(r)))
 
 		repoKey := fmt.Sprintf("%s/%s/%s", host, owner, repo)
+		sw, r, logDecision := s.withDecision(w, r, repoKey, kind, start)
+		defer logDecision()
+		// Requests past their deadline are logged with the 504 they get
+		w, r, done := s.deadline(sw, r, kind.class(), gatewayTimeout)
+		defer done()
+		// Renamed repos are mirrored under the name upstream redirects them
+		// to. Pushes, dumb HTTP and repos served straight from upstream don't
+		// go through a mirror of their own.
+		if kind != KindPush && kind != KindDumb && !s.directAsked(r, repoKey) {
+			owner, repo = s.mirror.Canonical(r.Context(), host, owner, repo, s.upstreamAuth(r))
+			repoKey = fmt.Sprintf("%s/%s/%s", host, owner, repo)
+			decisionFrom(r.Context()).repo = repoKey
+		}
 		s.log.Debug("resolved target", "host", host, "owner", owner, "repo", repo, "kind", kind)
-		s.metrics.RequestsTotal.WithLabelValues(repoKey, string(kind), r.RemoteAddr).Inc()
+		s.metrics.RequestsTotal.WithLabelValues(repoKey, string(kind), s.clientIP(r)).Inc()
 
 		switch kind {
 		case KindInfo:
 			s.handleInfoRefs(w, r, host, owner, repo, repoKey, start)
 		case KindPack:
 			s.handleUploadPack(w, r, host, owner, repo, repoKey, start)
+		case KindDumb:
+			s.handleDumbFile(w, r, host, owner, repo, repoKey, start)
+		case KindPush:
+			s.handlePush(w, r, host, owner, repo, repoKey, start)
+		case KindArchive:
+			s.handleUploadArchive(w, r, host, owner, repo, repoKey, start)
 		default:
 			http.Error(w, "unsupported path", http.StatusBadRequest)
 		}
 	})
+	return s.withBasePath(git, func(w http.ResponseWriter, r *http.Request) {
+		s.notGitPath(w, r, fmt.Errorf("%w: %s is outside %s", errNotGitPath, r.URL.Path, s.config().BasePath))
+	})
 }
 
-func (s *Server) handleInfoRefs(w http.ResponseWriter, r *http.Request, host, owner, repo, repoKey string, start time.Time) {
-	service := r.URL.Query().Get("service")
-	if service != "git-upload-pack" {
-		http.Error(w, "unsupported service", http.StatusBadRequest)
-		return
+// withBasePath serves h under the configured base path, stripping it from
+// request paths, and answers requests outside of it with notFound.
+func (s *Server) withBasePath(h http.Handler, notFound http.HandlerFunc) http.Handler {
+	base := s.config().BasePath
+	if base == "" {
+		return h
 	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, base)
+		if !ok || (rest != "" && rest[0] != '/') {
+			notFound(w, r)
+			return
+		}
+		if rest == "" {
+			rest = "/"
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = rest
+		r2.URL.RawPath = ""
+		h.ServeHTTP(w, r2)
+	})
+}
+
+func (s *Server) handleInfoRefs(w http.ResponseWriter, r *http.Request, host, owner, repo, repoKey string, start time.Time) {
+	// The service was checked by resolveTarget
+	dumb := r.URL.Query().Get("service") == ""
 
 	// Build upstream URL for cloning/syncing
-	upstreamURL := fmt.Sprintf("https://%s/%s/%s.git", host, owner, repo)
+	upstreamURL, err := s.mirror.UpstreamURL(host, owner, repo)
+	if err != nil {
+		s.fail(w, repoKey, KindInfo, err)
+		return
+	}
+	if isPush(r, KindInfo) {
+		s.passthrough(w, r, upstreamURL, repoKey, KindInfo, start)
+		return
+	}
 
-	// Determine auth for upstream sync
-	authHeader := ""
-	switch s.cfg.AuthMode {
-	case "static":
-		// Use configured static token
-		authHeader = "Bearer " + s.cfg.StaticToken
-	case "pass-through":
-		// Use auth from client request
-		authHeader = r.Header.Get("Authorization")
+	authHeader := s.upstreamAuth(r)
+	s.log.Debug("auth check", "mode", s.config().AuthMode, "hasAuth", authHeader != "", "repo", repoKey)
+	if r.Method == http.MethodHead && s.config().HeadRequests != "full" {
+		s.headInfoRefs(w, r, host, owner, repo, repoKey, upstreamURL, authHeader, dumb, start)
+		return
+	}
+	// One-off clones needn't leave a mirror behind
+	if !dumb && s.direct(r, s.mirror.RepoPath(host, owner, repo), repoKey, upstreamURL) {
+		s.log.Debug("serving repo straight from upstream", "repo", repoKey)
+		s.directInfoRefs(w, r, upstreamURL, repoKey, start)
+		return
 	}
-	s.log.Debug("auth check", "mode", s.cfg.AuthMode, "hasAuth", authHeader != "", "repo", repoKey)
 
 	// Ensure mirror is synced
 	ensureStart := time.Now()
 	repoPath, status, err := s.mirror.EnsureRepo(r.Context(), host, owner, repo, upstreamURL, authHeader)
 	if err != nil {
+		// Upstream work is abandoned once no client waits for it anymore
+		if r.Context().Err() != nil {
+			s.log.Info("client went away during mirror update", "repo", repoKey, "duration_ms", time.Since(ensureStart).Milliseconds())
+			return
+		}
+		if !dumb && errors.Is(err, syscall.ENOSPC) && s.config().DiskFullFallback == "passthrough" {
+			s.log.Warn("no space to mirror repo, passing through to upstream", "repo", repoKey, "err", err)
+			s.passthrough(w, r, upstreamURL, repoKey, KindInfo, start)
+			return
+		}
 		s.fail(w, repoKey, KindInfo, err)
 		return
 	}
 	s.log.Debug("ensure repo done", "repo", repoKey, "status", status, "duration_ms", time.Since(ensureStart).Milliseconds())
+	decisionFrom(r.Context()).mirrored(status)
 
 	// Store status for the upcoming upload-pack request
 	s.statusCache.Store(repoKey, status)
-	s.log.Info("request", "repo", repoKey, "status", status)
+	s.logRequest(r, start, http.StatusOK, "repo", repoKey, "status", status)
+
+	// Dumb HTTP clients read info/refs as a static file generated from the mirror
+	sw := &statusWriter{ResponseWriter: w}
+	cacheControl := s.cacheControl(r, host, owner, repo)
+	if dumb {
+		if err := gitserve.UpdateServerInfo(r.Context(), repoPath, s.config().StripRefPatterns); err != nil {
+			s.fail(w, repoKey, KindInfo, err)
+			return
+		}
+		if err := gitserve.ServeDumbFile(sw, r, repoPath, "info/refs", string(status), cacheControl, s.log); err != nil {
+			s.log.Error("serve dumb info/refs failed", "err", err, "repo", repoKey)
+		}
+		s.metrics.ResponsesTotal.WithLabelValues(repoKey, string(KindInfo), sw.code()).Inc()
+		s.metrics.UpstreamLatency.WithLabelValues(repoKey, string(KindInfo)).Observe(time.Since(start).Seconds())
+		return
+	}
 
-	// Serve refs from local mirror
+	// Serve refs from local mirror. Restricted mirrors don't advertise
+	// ref-in-want, as refs they leave out are fetched from upstream.
 	serveStart := time.Now()
-	if err := gitserve.ServeInfoRefs(w, r, repoPath, string(status), s.cfg.UploadPackThreads, s.log); err != nil {
+	decisionFrom(r.Context()).servingLocally()
+	refInWant := s.mirror.MirroredRefs(host, owner, repo) == nil
+	if err := gitserve.ServeInfoRefs(sw, r, repoPath, string(status), s.config().UploadPackThreads, s.config().StripRefPatterns, refInWant, cacheControl, s.adverts, s.log); err != nil {
 		s.log.Error("serve info/refs failed", "err", err, "repo", repoKey, "duration_ms", time.Since(serveStart).Milliseconds())
-		// Response already started, can't change status
+		// ServeInfoRefs has already written an error response
 	}
 	s.log.Debug("serve info/refs done", "repo", repoKey, "duration_ms", time.Since(serveStart).Milliseconds())
 
-	s.metrics.ResponsesTotal.WithLabelValues(repoKey, string(KindInfo), "200").Inc()
+	s.metrics.ResponsesTotal.WithLabelValues(repoKey, string(KindInfo), sw.code()).Inc()
 	s.metrics.UpstreamLatency.WithLabelValues(repoKey, string(KindInfo)).Observe(time.Since(start).Seconds())
 	s.log.Debug("info/refs complete", "repo", repoKey, "total_duration_ms", time.Since(start).Milliseconds())
 }
 
 func (s *Server) handleUploadPack(w http.ResponseWriter, r *http.Request, host, owner, repo, repoKey string, start time.Time) {
+	if !s.limitBody(w, r, repoKey) {
+		return
+	}
+	w, done := s.limitResponse(w, repoKey)
+	defer done()
+
 	// Get mirror path (should already exist from info/refs)
 	repoPath := s.mirror.RepoPath(host, owner, repo)
 
-	// Optionally serialize upload-pack per repo to avoid parallel pack generation
-	var lock *sync.Mutex
-	if s.cfg.SerializeUploadPack {
-		lock = s.mirror.GetRepoLock(host, owner, repo)
-		lock.Lock()
-		defer lock.Unlock()
+	// Private mirrors are only served to credentials upstream accepts, like
+	// info/refs checked, as clients can skip it
+	if s.mirror.RequiresAuth(host, owner, repo) {
+		upstreamURL, err := s.mirror.UpstreamURL(host, owner, repo)
+		if err == nil {
+			err = s.mirror.CheckAccess(r.Context(), host, owner, repo, upstreamURL, s.upstreamAuth(r))
+		}
+		if err != nil {
+			s.fail(w, repoKey, KindPack, err)
+			return
+		}
+	}
+
+	// Without a mirror (the repo is served directly, info/refs was passed
+	// through for lack of space, or it was evicted since), serve from upstream too
+	if _, err := os.Stat(repoPath); os.IsNotExist(err) {
+		upstreamURL, err := s.mirror.UpstreamURL(host, owner, repo)
+		if err != nil {
+			s.fail(w, repoKey, KindPack, err)
+			return
+		}
+		if s.direct(r, repoPath, repoKey, upstreamURL) || s.config().DiskFullFallback == "passthrough" {
+			s.passthrough(w, r, upstreamURL, repoKey, KindPack, start)
+			return
+		}
 	}
 
 	// Get cached status from info/refs call
@@ -132,11 +300,125 @@ func (s *Server) handleUploadPack(w http.ResponseWriter, r *http.Request, host,
 	if v, ok := s.statusCache.Load(repoKey); ok {
 		cacheStatus = string(v.(mirror.Status))
 	}
+	// The mirror was refreshed, if at all, by the info/refs request
+	decision := decisionFrom(r.Context())
+	decision.status, decision.source = mirror.Status(cacheStatus), sourceDisk
+
+	// Protocol v2 ls-refs only lists refs (git applies any ref-prefix filter
+	// against the mirror), so it never generates a pack and needn't be serialized
+	lsRefs := false
+	if gitserve.IsV2(r) {
+		req, err := gitserve.PeekV2Request(r)
+		if err != nil {
+			s.log.Debug("parse v2 request failed", "repo", repoKey, "err", err)
+		} else if req.Command == "ls-refs" {
+			lsRefs = true
+			s.log.Debug("ls-refs request", "repo", repoKey, "ref_prefixes", req.RefPrefixes)
+			// Default branch lookups are answered from the cached HEAD
+			if req.HeadOnly() {
+				if head, err := s.mirror.Head(r.Context(), host, owner, repo); err == nil && head.SHA != "" {
+					if err := gitserve.ServeHeadRef(w, req, head.Ref, head.SHA, cacheStatus); err != nil {
+						s.log.Error("serve head ref failed", "err", err, "repo", repoKey)
+					}
+					s.metrics.ResponsesTotal.WithLabelValues(repoKey, string(KindPack), "200").Inc()
+					s.metrics.UpstreamLatency.WithLabelValues(repoKey, string(KindPack)).Observe(time.Since(start).Seconds())
+					return
+				}
+			}
+		}
+		if refs := s.mirror.MirroredRefs(host, owner, repo); err == nil && refs != nil && s.beyondMirror(r.Context(), repoPath, refs, req) {
+			s.log.Debug("request beyond restricted mirror, serving from upstream", "repo", repoKey, "command", req.Command)
+			upstreamURL, err := s.mirror.UpstreamURL(host, owner, repo)
+			if err != nil {
+				s.fail(w, repoKey, KindPack, err)
+				return
+			}
+			s.passthrough(w, r, upstreamURL, repoKey, KindPack, start)
+			return
+		}
+	}
+
+	// Large blobs are filtered out of fetches, before their packs are cached
+	if limit := s.config().FilterBlobsOver.Bytes; limit > 0 && !lsRefs {
+		if err := gitserve.FilterBlobs(r, repoPath, limit); err != nil {
+			var tooLarge *http.MaxBytesError
+			switch {
+			case errors.As(err, &tooLarge):
+				s.rejectBody(w, repoKey, -1)
+			case errors.Is(err, gitserve.ErrFilteredBlob):
+				s.metrics.ErrorsTotal.WithLabelValues(repoKey, string(KindPack)).Inc()
+				s.log.Warn("request for filtered blob refused", "repo", repoKey, "err", err)
+				http.Error(w, err.Error(), http.StatusForbidden)
+			default:
+				s.metrics.ErrorsTotal.WithLabelValues(repoKey, string(KindPack)).Inc()
+				s.log.Error("filter request failed", "repo", repoKey, "err", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+	}
+
+	// Fetches of a single pinned commit are replayed from the pack cache
+	var pinned *gitserve.PackCacheEntry
+	if s.config().CachePinnedPacks && !lsRefs {
+		if key, ok := gitserve.PinnedPackKey(r); ok {
+			pinned = &gitserve.PackCacheEntry{
+				Dir:      filepath.Join(repoPath, "pinned-packs"),
+				Key:      key,
+				DirMode:  s.config().CacheDirMode,
+				FileMode: s.config().CacheFileMode,
+
+				SkipVerify: !s.config().CacheChecksums,
+				OnCorrupt:  s.metrics.CacheChecksums.WithLabelValues(string(KindPack)).Inc,
+			}
+			served, err := gitserve.ServeCachedPack(w, r, *pinned, string(mirror.StatusPinnedHit), s.log)
+			if err != nil {
+				s.log.Error("serve cached pack failed", "err", err, "repo", repoKey)
+			}
+			if served {
+				decision.status = mirror.StatusPinnedHit
+				s.metrics.PinnedPacks.WithLabelValues("hit").Inc()
+				s.metrics.ResponsesTotal.WithLabelValues(repoKey, string(KindPack), "200").Inc()
+				s.metrics.UpstreamLatency.WithLabelValues(repoKey, string(KindPack)).Observe(time.Since(start).Seconds())
+				return
+			}
+			s.metrics.PinnedPacks.WithLabelValues("miss").Inc()
+		}
+	}
+
+	// Optionally serialize upload-pack per repo to avoid parallel pack generation
+	var lock *sync.Mutex
+	if s.config().SerializeUploadPack && !lsRefs {
+		lock = s.mirror.GetRepoLock(host, owner, repo)
+		lockStart := time.Now()
+		lock.Lock()
+		defer lock.Unlock()
+		s.metrics.LockWait.WithLabelValues("upload-pack").Observe(time.Since(lockStart).Seconds())
+		decisionFrom(r.Context()).phases.Since(mirror.PhaseWait, lockStart)
+	}
 
 	// Serve pack from local mirror
 	serveStart := time.Now()
-	if err := gitserve.ServeUploadPack(w, r, repoPath, cacheStatus, s.cfg.UploadPackThreads, s.log); err != nil {
-		s.log.Error("serve upload-pack failed", "err", err, "repo", repoKey, "duration_ms", time.Since(serveStart).Milliseconds())
+	decisionFrom(r.Context()).servingLocally()
+	refInWant := s.mirror.MirroredRefs(host, owner, repo) == nil
+	var verify *gitserve.PackVerify
+	if !lsRefs {
+		verify = s.packVerify()
+	}
+	if err := gitserve.ServeUploadPack(w, r, repoPath, cacheStatus, s.config().UploadPackThreads, s.config().StripRefPatterns, refInWant, pinned, verify, s.log); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s.rejectBody(w, repoKey, -1)
+			return
+		}
+		// Corrupt packs are never served, so the response hasn't started
+		if errors.Is(err, gitserve.ErrCorruptPack) {
+			s.fail(w, repoKey, KindPack, err)
+			return
+		}
+		if !errors.Is(err, gitserve.ErrResponseTooLarge) {
+			s.log.Error("serve upload-pack failed", "err", err, "repo", repoKey, "duration_ms", time.Since(serveStart).Milliseconds())
+		}
 		// Response already started, can't change status
 	}
 	s.log.Debug("serve upload-pack done", "repo", repoKey, "duration_ms", time.Since(serveStart).Milliseconds())
@@ -146,11 +428,176 @@ func (s *Server) handleUploadPack(w http.ResponseWriter, r *http.Request, host,
 	s.log.Debug("upload-pack complete", "repo", repoKey, "total_duration_ms", time.Since(start).Milliseconds())
 }
 
+// limitBody caps the request body at the configured maximum. Bodies declaring
+// a larger Content-Length are rejected right away; others (e.g. chunked) are cut
+// off while streaming to upload-pack, which ServeUploadPack reports before
+// sending any response so they get a 413 too.
+func (s *Server) limitBody(w http.ResponseWriter, r *http.Request, repoKey string) bool {
+	limit := s.config().MaxRequestBodyBytes
+	if limit <= 0 {
+		return true
+	}
+	if r.ContentLength > limit {
+		s.rejectBody(w, repoKey, r.ContentLength)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return true
+}
+
+// limitResponse caps the response at the repo's max clone size. The returned
+// func logs and counts the response if it was cut off.
+func (s *Server) limitResponse(w http.ResponseWriter, repoKey string) (http.ResponseWriter, func()) {
+	cfg := s.config()
+	limit := cfg.MaxCloneBytesOverrides.For(repoKey, cfg.MaxCloneBytes)
+	if limit <= 0 {
+		return w, func() {}
+	}
+	lw := gitserve.LimitResponse(w, limit)
+	return lw, func() {
+		if lw.Exceeded() {
+			s.metrics.CloneAborts.WithLabelValues(repoKey).Inc()
+			s.log.Warn("response exceeds max clone size, aborted", "repo", repoKey, "limit", limit, "bytes", lw.Written())
+		}
+	}
+}
+
+func (s *Server) rejectBody(w http.ResponseWriter, repoKey string, size int64) {
+	s.metrics.ErrorsTotal.WithLabelValues(repoKey, string(KindPack)).Inc()
+	s.log.Warn("request body too large", "repo", repoKey, "content_length", size, "limit", s.config().MaxRequestBodyBytes)
+	http.Error(w, fmt.Sprintf("request body exceeds %d bytes", s.config().MaxRequestBodyBytes), http.StatusRequestEntityTooLarge)
+}
+
+// handlePush passes a push straight through to upstream, as mirrors are
+// read-only. Mirrors pick pushed refs up on their next sync.
+func (s *Server) handlePush(w http.ResponseWriter, r *http.Request, host, owner, repo, repoKey string, start time.Time) {
+	upstreamURL, err := s.mirror.UpstreamURL(host, owner, repo)
+	if err != nil {
+		s.fail(w, repoKey, KindPush, err)
+		return
+	}
+	s.passthrough(w, r, upstreamURL, repoKey, KindPush, start)
+}
+
+func (s *Server) handleDumbFile(w http.ResponseWriter, r *http.Request, host, owner, repo, repoKey string, start time.Time) {
+	// Served straight from the mirror, which the preceding info/refs request
+	// synced, after the same credential check info/refs does for private mirrors
+	upstreamURL, err := s.mirror.UpstreamURL(host, owner, repo)
+	if err != nil {
+		s.fail(w, repoKey, KindDumb, err)
+		return
+	}
+	if err := s.mirror.CheckAccess(r.Context(), host, owner, repo, upstreamURL, s.upstreamAuth(r)); err != nil {
+		s.fail(w, repoKey, KindDumb, err)
+		return
+	}
+	repoPath := s.mirror.RepoPath(host, owner, repo)
+	decisionFrom(r.Context()).source = sourceDisk
+	sw := &statusWriter{ResponseWriter: w}
+	if err := gitserve.ServeDumbFile(sw, r, repoPath, dumbFile(r.URL.Path), "", s.cacheControl(r, host, owner, repo), s.log); err != nil {
+		s.log.Error("serve dumb http file failed", "err", err, "repo", repoKey)
+		s.metrics.ErrorsTotal.WithLabelValues(repoKey, string(KindDumb)).Inc()
+		return
+	}
+	s.metrics.ResponsesTotal.WithLabelValues(repoKey, string(KindDumb), sw.code()).Inc()
+	s.metrics.UpstreamLatency.WithLabelValues(repoKey, string(KindDumb)).Observe(time.Since(start).Seconds())
+}
+
+// cacheControl returns the Cache-Control for a cacheable GET about a repo.
+// Responses to credentialed requests or about repos cloned with credentials
+// must not be stored by shared caches in front of the proxy.
+func (s *Server) cacheControl(r *http.Request, host, owner, repo string) string {
+	if r.Header.Get("Authorization") != "" || s.mirror.RequiresAuth(host, owner, repo) {
+		return "private, no-cache"
+	}
+	return s.config().CacheControl
+}
+
+// statusWriter records the status code of a response for metrics.
+type statusWriter struct {
+	http.ResponseWriter
+	status    int
+	bytes     int64     // Body bytes written
+	firstByte time.Time // When the first body byte was written
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	if sw.firstByte.IsZero() && len(b) > 0 {
+		sw.firstByte = time.Now()
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// code returns the recorded status as a metrics label.
+func (sw *statusWriter) code() string {
+	if sw.status == 0 {
+		return "200"
+	}
+	return strconv.Itoa(sw.status)
+}
+
+// dumbFile returns the repo-relative file requested by a dumb HTTP client
+// (e.g. "HEAD" or "objects/pack/pack-x.pack"), or "" if the path isn't one.
+func dumbFile(p string) string {
+	if i := strings.Index(p, "/objects/"); i >= 0 {
+		return p[i+1:]
+	}
+	if strings.HasSuffix(p, "/HEAD") {
+		return "HEAD"
+	}
+	return ""
+}
+
+// upstreamAuth returns the Authorization header to use for upstream sync.
+func (s *Server) upstreamAuth(r *http.Request) string {
+	cfg := s.config()
+	// Clients whose token maps to an upstream identity fetch as that identity
+	if token, ok := clientToken(r, cfg.ClientAuth); ok {
+		if upstream, ok := cfg.ClientAuth.UpstreamTokens[token]; ok {
+			return "Bearer " + upstream
+		}
+	}
+	switch cfg.AuthMode {
+	case "static":
+		// Use configured static token
+		return "Bearer " + cfg.StaticToken
+	case "pass-through":
+		// Use auth from client request
+		return r.Header.Get("Authorization")
+	}
+	return ""
+}
+
+// proxyAuth returns the Authorization header to use for upstream syncs the
+// proxy starts itself, on behalf of no client with credentials.
+func (s *Server) proxyAuth() string {
+	if cfg := s.config(); cfg.AuthMode == "static" {
+		return "Bearer " + cfg.StaticToken
+	}
+	return ""
+}
+
 func (s *Server) resolveTarget(r *http.Request) (host, owner, repo string, kind Kind, err error) {
 	// Path format: /{host}/{owner}/{repo}/info/refs or /{host}/{owner}/{repo}/git-upload-pack
 	pathStr := strings.TrimPrefix(r.URL.Path, "/")
 	if pathStr == "" {
-		return "", "", "", "", errors.New("empty path")
+		return "", "", "", "", fmt.Errorf("%w: /", errNotGitPath)
 	}
 
 	// Parse the path to extract components
@@ -160,53 +607,107 @@ func (s *Server) resolveTarget(r *http.Request) (host, owner, repo string, kind
 	}
 
 	// Determine kind from suffix
+	repoPath := strings.TrimPrefix(u.Path, "/")
 	switch {
 	case strings.HasSuffix(u.Path, "/info/refs"):
 		kind = KindInfo
 	case strings.HasSuffix(u.Path, "/git-upload-pack"):
 		kind = KindPack
+	case strings.HasSuffix(u.Path, "/git-receive-pack"):
+		kind = KindPush
+	case strings.HasSuffix(u.Path, "/git-upload-archive"):
+		kind = KindArchive
+	case dumbFile(u.Path) != "" && r.Method == http.MethodGet:
+		kind = KindDumb
+		repoPath = strings.TrimSuffix(repoPath, "/"+dumbFile(u.Path))
 	default:
-		return "", "", "", "", fmt.Errorf("unsupported endpoint: %s", u.Path)
+		return "", "", "", "", fmt.Errorf("%w: %s", errNotGitPath, u.Path)
 	}
 
 	// Remove git endpoint suffix to get repo path
-	repoPath := strings.TrimPrefix(u.Path, "/")
 	repoPath = strings.TrimSuffix(repoPath, "/info/refs")
 	repoPath = strings.TrimSuffix(repoPath, "/git-upload-pack")
-	repoPath = strings.TrimSuffix(repoPath, ".git")
+	repoPath = strings.TrimSuffix(repoPath, "/git-receive-pack")
+	repoPath = strings.TrimSuffix(repoPath, "/git-upload-archive")
+	// Remote URLs joined sloppily leave empty segments, e.g. //host/owner/repo
+	// or host/owner/repo//info/refs for one with a trailing slash
+	repoPath = strings.Trim(collapseSlashes(repoPath), "/")
+
+	host, owner, repo, ok := splitRepoPath(repoPath)
+	if !ok {
+		return "", "", "", "", fmt.Errorf("%w: %s is missing the host, owner or repo", errNotGitPath, u.Path)
+	}
+	cfg := s.config()
+	host = cfg.UpstreamHostAliases.Canonical(host)
+	repo = cfg.KeepGitSuffixHosts.RepoName(host, repo)
 
-	// Split into host/owner/repo
-	parts := strings.SplitN(repoPath, "/", 3)
+	if err := s.checkAllowed(host); err != nil {
+		return "", "", "", "", err
+	}
+	if err := s.checkService(r, kind); err != nil {
+		return "", "", "", "", err
+	}
+
+	return host, owner, repo, kind, nil
+}
+
+// collapseSlashes replaces every run of slashes in p with a single one.
+func collapseSlashes(p string) string {
+	for strings.Contains(p, "//") {
+		p = strings.ReplaceAll(p, "//", "/")
+	}
+	return p
+}
+
+// splitRepoPath splits a repo path into host/owner/repo, leaving any .git
+// suffix for config.GitSuffixHosts to normalize once the host is known.
+func splitRepoPath(p string) (host, owner, repo string, ok bool) {
+	parts := strings.SplitN(p, "/", 3)
 	if len(parts) < 3 {
-		return "", "", "", "", errors.New("invalid path: expected /{host}/{owner}/{repo}/...")
+		return "", "", "", false
 	}
-	host = parts[0]
-	owner = parts[1]
-	repo = parts[2]
+	host, owner, repo = parts[0], parts[1], parts[2]
 
 	// Handle nested paths (e.g., owner/repo/subgroup)
 	if strings.Contains(repo, "/") {
 		// For GitLab-style nested groups, combine them
 		repo = path.Base(repo)
 	}
+	return host, owner, repo, true
+}
 
-	// Validate against allowed upstreams
-	allowed := false
-	for _, h := range s.cfg.AllowedUpstreams {
+// checkAllowed validates host against the allowed upstreams.
+func (s *Server) checkAllowed(host string) error {
+	for _, h := range s.config().AllowedUpstreams {
 		if h == host {
-			allowed = true
-			break
+			return nil
 		}
 	}
-	if !allowed {
-		return "", "", "", "", fmt.Errorf("upstream %q not in allowed list", host)
-	}
+	return fmt.Errorf("upstream %q not in allowed list", host)
+}
 
-	return host, owner, repo, kind, nil
+// logRequest writes the access log line of r, started at start and answered
+// with code, unless sampling leaves it out (see logging.Sampler). Failures are
+// logged at error level regardless.
+func (s *Server) logRequest(r *http.Request, start time.Time, code int, args ...any) {
+	cfg := s.config()
+	took := time.Since(start)
+	if !(logging.Sampler{Rate: cfg.AccessLogSampleRate, Slow: cfg.AccessLogSlowThreshold}).Keep(code, took) {
+		return
+	}
+	s.log.Info("request", append(args, "request_id", decisionFrom(r.Context()).requestID, "duration_ms", took.Milliseconds())...)
 }
 
 func (s *Server) fail(w http.ResponseWriter, repo string, kind Kind, err error) {
 	s.metrics.ErrorsTotal.WithLabelValues(repo, string(kind)).Inc()
+	// Clients are told when the upstream quota refusing them resets
+	var quota *mirror.QuotaError
+	if errors.As(err, &quota) {
+		s.log.Warn("request refused", "err", err, "repo", repo, "kind", kind)
+		w.Header().Set("Retry-After", strconv.Itoa(int(max(time.Until(quota.Reset).Seconds(), 1))))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
 	s.log.Error("request failed", "err", err, "repo", repo, "kind", kind)
 	http.Error(w, err.Error(), http.StatusBadGateway)
 }
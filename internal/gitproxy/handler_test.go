@@ -1,14 +1,35 @@
 package gitproxy_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/cgi"
 	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
 	"github.com/crohr/smart-git-proxy/internal/config"
 	"github.com/crohr/smart-git-proxy/internal/gitproxy"
 	"github.com/crohr/smart-git-proxy/internal/logging"
@@ -45,12 +66,13 @@ func TestE2E_ClonePublicRepo(t *testing.T) {
 		t.Fatalf("logger init: %v", err)
 	}
 
-	mirrorStore, err := mirror.New(cfg.MirrorDir, cfg.SyncStaleAfter, config.SizeSpec{}, 0, false, logger)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
 	if err != nil {
 		t.Fatalf("mirror init: %v", err)
 	}
+	t.Cleanup(mirrorStore.Wait)
 
-	metricsRegistry := metrics.NewUnregistered()
 	server := gitproxy.New(cfg, mirrorStore, logger, metricsRegistry)
 
 	// Start test server
@@ -137,8 +159,9 @@ func TestE2E_FetchPublicRepo(t *testing.T) {
 	}
 
 	logger, _ := logging.New(cfg.LogLevel)
-	mirrorStore, _ := mirror.New(cfg.MirrorDir, cfg.SyncStaleAfter, config.SizeSpec{}, 0, false, logger)
 	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, _ := mirror.New(cfg, metricsRegistry, logger)
+	t.Cleanup(mirrorStore.Wait)
 	server := gitproxy.New(cfg, mirrorStore, logger, metricsRegistry)
 
 	ts := httptest.NewServer(server.Handler())
@@ -196,8 +219,9 @@ func TestE2E_LsRemote(t *testing.T) {
 	}
 
 	logger, _ := logging.New(cfg.LogLevel)
-	mirrorStore, _ := mirror.New(cfg.MirrorDir, cfg.SyncStaleAfter, config.SizeSpec{}, 0, false, logger)
 	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, _ := mirror.New(cfg, metricsRegistry, logger)
+	t.Cleanup(mirrorStore.Wait)
 	server := gitproxy.New(cfg, mirrorStore, logger, metricsRegistry)
 
 	ts := httptest.NewServer(server.Handler())
@@ -249,8 +273,9 @@ func TestE2E_CloneFullDepth(t *testing.T) {
 	}
 
 	logger, _ := logging.New(cfg.LogLevel)
-	mirrorStore, _ := mirror.New(cfg.MirrorDir, cfg.SyncStaleAfter, config.SizeSpec{}, 0, false, logger)
 	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, _ := mirror.New(cfg, metricsRegistry, logger)
+	t.Cleanup(mirrorStore.Wait)
 	server := gitproxy.New(cfg, mirrorStore, logger, metricsRegistry)
 
 	ts := httptest.NewServer(server.Handler())
@@ -319,8 +344,9 @@ func TestE2E_DifferentRefsSameMirror(t *testing.T) {
 	}
 
 	logger, _ := logging.New(cfg.LogLevel)
-	mirrorStore, _ := mirror.New(cfg.MirrorDir, cfg.SyncStaleAfter, config.SizeSpec{}, 0, false, logger)
 	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, _ := mirror.New(cfg, metricsRegistry, logger)
+	t.Cleanup(mirrorStore.Wait)
 	server := gitproxy.New(cfg, mirrorStore, logger, metricsRegistry)
 
 	ts := httptest.NewServer(server.Handler())
@@ -372,3 +398,3095 @@ func TestE2E_DifferentRefsSameMirror(t *testing.T) {
 
 	t.Log("E2E different refs same mirror test passed")
 }
+
+// newDumbUpstream serves a bare repo at /{owner}/{repo}.git over the dumb HTTP protocol
+// (plain static files, no application/x-git-* content types).
+func newDumbUpstream(t *testing.T, owner, repo string) *httptest.Server {
+	t.Helper()
+	return httptest.NewTLSServer(http.FileServer(http.Dir(dumbUpstreamRoot(t, owner, repo))))
+}
+
+// newPrivateUpstream is like newDumbUpstream but requires "Authorization: Bearer <token>".
+func newPrivateUpstream(t *testing.T, owner, repo, token string) *httptest.Server {
+	t.Helper()
+	files := http.FileServer(http.Dir(dumbUpstreamRoot(t, owner, repo)))
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+}
+
+// dumbUpstreamRoot creates a bare repo with one commit, prepared for dumb HTTP, under a temp root.
+func dumbUpstreamRoot(t *testing.T, owner, repo string) string {
+	t.Helper()
+	root := t.TempDir()
+	work := filepath.Join(t.TempDir(), "work")
+	bare := filepath.Join(root, owner, repo+".git")
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main", work},
+		{"-C", work, "commit", "-q", "--allow-empty", "-m", "initial"},
+		{"clone", "-q", "--bare", work, bare},
+		{"-C", bare, "update-server-info"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	return root
+}
+
+func TestDumbHTTP(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	// The fixture uses a self-signed certificate; mirror git commands inherit this
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	upstream := newDumbUpstream(t, "owner", "legacy")
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg := &config.Config{
+		AllowedUpstreams: []string{upstreamHost},
+		MirrorDir:        t.TempDir(),
+		SyncStaleAfter:   2 * time.Second,
+		AuthMode:         "none",
+		LogLevel:         "info",
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+	defer ts.Close()
+
+	repoURL := ts.URL + "/" + upstreamHost + "/owner/legacy.git"
+	cloneDir := t.TempDir()
+
+	// Smart client: proxy mirrors the dumb upstream and serves it over smart HTTP
+	cmd := exec.Command("git", "clone", repoURL, filepath.Join(cloneDir, "smart"))
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("smart clone from dumb upstream failed: %v\noutput: %s", err, out)
+	}
+
+	// Dumb client: proxy serves static files from the mirror
+	cmd = exec.Command("git", "clone", repoURL, filepath.Join(cloneDir, "dumb"))
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_SMART_HTTP=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("dumb clone failed: %v\noutput: %s", err, out)
+	}
+
+	logCmd := exec.Command("git", "-C", filepath.Join(cloneDir, "dumb"), "log", "--oneline")
+	out, err := logCmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "initial") {
+		t.Fatalf("expected dumb clone to contain history: %v\n%s", err, out)
+	}
+}
+
+func TestRefInWantFetch(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	upstream := newDumbUpstream(t, "owner", "repo")
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg := &config.Config{
+		AllowedUpstreams: []string{upstreamHost},
+		MirrorDir:        t.TempDir(),
+		SyncStaleAfter:   2 * time.Second,
+		AuthMode:         "none",
+		LogLevel:         "info",
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+	defer ts.Close()
+
+	// git only sends want-ref for exact ref names when the server advertises ref-in-want
+	work := t.TempDir()
+	if out, err := exec.Command("git", "init", "-q", work).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v\n%s", err, out)
+	}
+	repoURL := ts.URL + "/" + upstreamHost + "/owner/repo.git"
+	cmd := exec.Command("git", "-C", work, "-c", "protocol.version=2", "fetch", repoURL, "refs/heads/main")
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_TRACE_PACKET=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("fetch failed: %v\noutput: %s", err, out)
+	}
+	if !strings.Contains(string(out), "want-ref refs/heads/main") {
+		t.Fatalf("expected fetch to use want-ref, trace:\n%s", out)
+	}
+
+	logCmd := exec.Command("git", "-C", work, "log", "--oneline", "FETCH_HEAD")
+	if out, err := logCmd.CombinedOutput(); err != nil || !strings.Contains(string(out), "initial") {
+		t.Fatalf("expected fetched history: %v\n%s", err, out)
+	}
+}
+
+func TestDumbHTTPPrivate(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	upstream := newPrivateUpstream(t, "owner", "private", "secret")
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg := &config.Config{
+		AllowedUpstreams: []string{upstreamHost},
+		MirrorDir:        t.TempDir(),
+		SyncStaleAfter:   time.Hour,
+		AuthMode:         "pass-through",
+		LogLevel:         "info",
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+	defer ts.Close()
+
+	get := func(file, auth string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/"+upstreamHost+"/owner/private.git/"+file, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get %s: %v", file, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Mirrored with credentials through dumb info/refs
+	if code := get("info/refs", "Bearer secret"); code != http.StatusOK {
+		t.Fatalf("expected dumb info/refs with credentials to succeed, got %d", code)
+	}
+	for _, file := range []string{"info/refs", "HEAD"} {
+		if code := get(file, ""); code == http.StatusOK {
+			t.Errorf("expected %s without credentials to be refused", file)
+		}
+	}
+	if code := get("HEAD", "Bearer secret"); code != http.StatusOK {
+		t.Fatalf("expected HEAD with credentials to succeed, got %d", code)
+	}
+}
+
+// fakeSSH puts an ssh first in PATH that runs the requested git command
+// locally against repos under root, standing in for an SSH git server. Each
+// invocation's arguments are appended to the returned log file.
+func fakeSSH(t *testing.T, root string) string {
+	t.Helper()
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "ssh.log")
+	script := `#!/bin/sh
+echo "$@" >> "` + logFile + `"
+for cmd; do :; done
+cd "` + root + `" && eval "$(printf '%s' "$cmd" | sed "s#'/#'#")"
+`
+	if err := os.WriteFile(filepath.Join(dir, "ssh"), []byte(script), 0o755); err != nil {
+		t.Fatalf("write ssh: %v", err)
+	}
+	t.Setenv("PATH", dir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+	return logFile
+}
+
+func TestSSHUpstream(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	sshLog := fakeSSH(t, dumbUpstreamRoot(t, "owner", "repo"))
+	key := filepath.Join(t.TempDir(), "deploy key")
+	if err := os.WriteFile(key, []byte("key"), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+
+	cfg := &config.Config{
+		AllowedUpstreams:      []string{"git.internal"},
+		UpstreamSchemes:       map[string]string{"git.internal": "ssh"},
+		UpstreamSSHUser:       "deploy",
+		UpstreamSSHKey:        key,
+		UpstreamHostOverrides: map[string]string{"git.internal": "10.0.0.7"},
+		MirrorDir:             t.TempDir(),
+		SyncStaleAfter:        time.Nanosecond,
+		AuthMode:              "pass-through",
+		LogLevel:              "info",
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+	defer ts.Close()
+
+	// Clients speak smart HTTP; the mirror is cloned, then synced, over SSH
+	repoURL := ts.URL + "/git.internal/owner/repo.git"
+	for _, dir := range []string{"first", "second"} {
+		cmd := exec.Command("git", "-c", "http.extraHeader=Authorization: Bearer client-token", "clone", repoURL, filepath.Join(t.TempDir(), dir))
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("clone through ssh upstream failed: %v\noutput: %s", err, out)
+		}
+	}
+
+	data, err := os.ReadFile(sshLog)
+	if err != nil {
+		t.Fatalf("expected ssh to be used upstream: %v", err)
+	}
+	calls := strings.Split(strings.TrimSpace(string(data)), "\n")
+	// The sync is followed by a lookup of upstream's HEAD
+	if len(calls) != 3 {
+		t.Fatalf("expected a clone, a sync and a HEAD lookup over ssh, got:\n%s", data)
+	}
+	for _, want := range []string{"BatchMode=yes", "-i " + key, "HostName=10.0.0.7", "HostKeyAlias=git.internal", "deploy@git.internal", "git-upload-pack '/owner/repo.git'"} {
+		if !strings.Contains(calls[0], want) {
+			t.Fatalf("expected ssh arguments to contain %q, got %s", want, calls[0])
+		}
+	}
+	// Client credentials play no part upstream, so they don't make the mirror private
+	if mirrorStore.RequiresAuth("git.internal", "owner", "repo") {
+		t.Fatalf("expected ssh mirror not to be marked as requiring auth")
+	}
+}
+
+func TestLandingAndUnknownPaths(t *testing.T) {
+	cfg := &config.Config{
+		AllowedUpstreams: []string{"github.com"},
+		MirrorDir:        t.TempDir(),
+		SyncStaleAfter:   time.Minute,
+		AuthMode:         "none",
+		LogLevel:         "info",
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	server := gitproxy.New(cfg, mirrorStore, logger, metricsRegistry)
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("get %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	code, body := get("/")
+	if code != http.StatusOK || !strings.Contains(body, "url.\""+ts.URL+"/github.com/\".insteadOf https://github.com/") || !strings.Contains(body, "Allowed upstream hosts: github.com") {
+		t.Fatalf("expected usage at /, got %d:\n%s", code, body)
+	}
+	for _, path := range []string{"/favicon.ico", "/github.com/owner", "/github.com/owner/repo/tree/main"} {
+		if code, body := get(path); code != http.StatusNotFound || !strings.Contains(body, "/{host}/{owner}/{repo}.git") {
+			t.Fatalf("expected 404 with guidance for %s, got %d:\n%s", path, code, body)
+		}
+	}
+	// Git requests the proxy refuses keep their error
+	if code, _ := get("/example.com/owner/repo.git/info/refs?service=git-upload-pack"); code != http.StatusBadRequest {
+		t.Fatalf("expected disallowed upstream to be rejected, got %d", code)
+	}
+
+	landing := filepath.Join(t.TempDir(), "landing.html")
+	if err := os.WriteFile(landing, []byte("<h1>Internal git cache</h1>"), 0o644); err != nil {
+		t.Fatalf("write landing page: %v", err)
+	}
+	next := *cfg
+	next.LandingPageFile = landing
+	server.Reload(&next)
+	resp, err := http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatalf("get /: %v", err)
+	}
+	defer resp.Body.Close()
+	body2, _ := io.ReadAll(resp.Body)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") || string(body2) != "<h1>Internal git cache</h1>" {
+		t.Fatalf("expected configured landing page, got %s: %s", resp.Header.Get("Content-Type"), body2)
+	}
+}
+
+func TestInfoRefsCacheHeaders(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	upstream := newDumbUpstream(t, "owner", "repo")
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg := &config.Config{
+		AllowedUpstreams: []string{upstreamHost},
+		MirrorDir:        t.TempDir(),
+		SyncStaleAfter:   time.Hour,
+		AuthMode:         "none",
+		LogLevel:         "info",
+		CacheControl:     "public, max-age=60",
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+	defer ts.Close()
+
+	repoKey := upstreamHost + "/owner/repo"
+	get := func(header http.Header) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/"+repoKey+".git/info/refs?service=git-upload-pack", nil)
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("info/refs: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get(http.Header{})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Cache-Control") != "public, max-age=60" {
+		t.Fatalf("expected configured Cache-Control, got %d %q", resp.StatusCode, resp.Header.Get("Cache-Control"))
+	}
+
+	// Revalidation is counted as a 304, not a 200
+	resp = get(http.Header{"If-None-Match": {resp.Header.Get("ETag")}})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("expected 304, got %d", resp.StatusCode)
+	}
+	if got := testutil.ToFloat64(metricsRegistry.ResponsesTotal.WithLabelValues(repoKey, string(gitproxy.KindInfo), "304")); got != 1 {
+		t.Fatalf("expected one 304 response recorded, got %v", got)
+	}
+	if got := testutil.ToFloat64(metricsRegistry.ResponsesTotal.WithLabelValues(repoKey, string(gitproxy.KindInfo), "200")); got != 1 {
+		t.Fatalf("expected one 200 response recorded, got %v", got)
+	}
+
+	// Credentialed responses stay out of shared caches
+	resp = get(http.Header{"Authorization": {"Bearer token"}})
+	if resp.Header.Get("Cache-Control") != "private, no-cache" {
+		t.Fatalf("expected private Cache-Control for credentialed request, got %q", resp.Header.Get("Cache-Control"))
+	}
+}
+
+func TestReload(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	upstream := newDumbUpstream(t, "owner", "repo")
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg := &config.Config{
+		AllowedUpstreams: []string{"github.com"},
+		MirrorDir:        t.TempDir(),
+		SyncStaleAfter:   time.Hour,
+		AuthMode:         "none",
+		LogLevel:         "info",
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	server := gitproxy.New(cfg, mirrorStore, logger, metricsRegistry)
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	get := func() int {
+		t.Helper()
+		resp, err := http.Get(ts.URL + "/" + upstreamHost + "/owner/repo.git/info/refs?service=git-upload-pack")
+		if err != nil {
+			t.Fatalf("info/refs: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get(); code != http.StatusBadRequest {
+		t.Fatalf("expected upstream outside the allowlist to be rejected, got %d", code)
+	}
+
+	// Reload as on SIGHUP: the allowlist applies right away, the mirror dir needs a restart
+	next, err := config.LoadArgs([]string{"-allowed-upstreams", upstreamHost, "-auth-mode", "none", "-mirror-dir", t.TempDir()})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	server.Reload(next)
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("expected reloaded allowlist to take effect, got %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.MirrorDir, upstreamHost, "owner", "repo.git")); err != nil {
+		t.Fatalf("expected mirror in the original mirror dir: %v", err)
+	}
+}
+
+func TestAdminRefresh(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	upstream := newDumbUpstream(t, "owner", "repo")
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg := &config.Config{
+		AllowedUpstreams: []string{upstreamHost},
+		MirrorDir:        t.TempDir(),
+		SyncStaleAfter:   time.Hour,
+		AuthMode:         "none",
+		LogLevel:         "info",
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).AdminHandler())
+	defer ts.Close()
+
+	refresh := func(path string) (int, mirror.RefreshResult) {
+		t.Helper()
+		resp, err := http.Post(ts.URL+path, "", nil)
+		if err != nil {
+			t.Fatalf("refresh request: %v", err)
+		}
+		defer resp.Body.Close()
+		var res mirror.RefreshResult
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				t.Fatalf("decode refresh response: %v", err)
+			}
+		}
+		return resp.StatusCode, res
+	}
+
+	// Missing mirror is cloned
+	code, res := refresh("/admin/refresh/" + upstreamHost + "/owner/repo")
+	if code != http.StatusOK || res.Status != mirror.StatusClone {
+		t.Fatalf("expected clone, got %d %+v", code, res)
+	}
+	if res.Head != "refs/heads/main" || len(res.HeadSHA) != 40 || res.Refs != 1 {
+		t.Fatalf("unexpected ref summary: %+v", res)
+	}
+
+	resp, err := http.Get(ts.URL + "/admin/repo/" + upstreamHost + "/owner/repo/head")
+	if err != nil {
+		t.Fatalf("head request: %v", err)
+	}
+	var head mirror.HeadInfo
+	err = json.NewDecoder(resp.Body).Decode(&head)
+	resp.Body.Close()
+	if err != nil || head.Ref != res.Head || head.SHA != res.HeadSHA {
+		t.Fatalf("expected head endpoint to match refresh summary, got %+v (%v)", head, err)
+	}
+
+	// Existing mirror is synced even though it isn't stale
+	code, res = refresh("/admin/refresh/" + upstreamHost + "/owner/repo.git")
+	if code != http.StatusOK || res.Status != mirror.StatusSync {
+		t.Fatalf("expected sync, got %d %+v", code, res)
+	}
+	if n := testutil.CollectAndCount(metricsRegistry.SyncDuration); n != 1 {
+		t.Fatalf("expected one sync duration series, got %d", n)
+	}
+	if n := testutil.CollectAndCount(metricsRegistry.MirrorStaleness); n != 1 {
+		t.Fatalf("expected staleness of the refreshed mirror, got %d series", n)
+	}
+
+	// Errors are JSON with a stable code
+	for _, tt := range []struct {
+		method, path string
+		status       int
+		code         string
+	}{
+		{http.MethodPost, "/admin/refresh/example.com/owner/repo", http.StatusBadRequest, gitproxy.CodeUpstreamNotAllowed},
+		{http.MethodGet, "/admin/bundle/example.com/owner/repo", http.StatusBadRequest, gitproxy.CodeUpstreamNotAllowed},
+		{http.MethodGet, "/admin/repo/example.com/owner/repo/head", http.StatusBadRequest, gitproxy.CodeUpstreamNotAllowed},
+		{http.MethodGet, "/admin/repo/" + upstreamHost + "/owner/missing/head", http.StatusNotFound, gitproxy.CodeRepoNotFound},
+		{http.MethodGet, "/admin/nope", http.StatusNotFound, gitproxy.CodeNotFound},
+		{http.MethodGet, "/admin/refresh/" + upstreamHost + "/owner/repo", http.StatusMethodNotAllowed, gitproxy.CodeMethodNotAllowed},
+		{http.MethodPost, "/admin/repo/" + upstreamHost + "/owner/repo/head", http.StatusMethodNotAllowed, gitproxy.CodeMethodNotAllowed},
+	} {
+		req, _ := http.NewRequest(tt.method, ts.URL+tt.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.method, tt.path, err)
+		}
+		var body struct{ Error, Code string }
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != tt.status || body.Code != tt.code || body.Error == "" {
+			t.Errorf("%s %s: got %d %+v (%v), want %d %s", tt.method, tt.path, resp.StatusCode, body, err, tt.status, tt.code)
+		}
+		if tt.status == http.StatusMethodNotAllowed && resp.Header.Get("Allow") == "" {
+			t.Errorf("%s %s: expected an Allow header", tt.method, tt.path)
+		}
+	}
+}
+
+func TestAdminPreload(t *testing.T) {
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	root := dumbUpstreamRoot(t, "owner", "repo")
+	bare := filepath.Join(root, "owner", "repo.git")
+	backend := &cgi.Handler{
+		Path: realGit,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	upstream := httptest.NewTLSServer(backend)
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", bare}, args...)...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("git %v: %v", args, err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	cfg := &config.Config{
+		AllowedUpstreams: []string{upstreamHost},
+		MirrorDir:        t.TempDir(),
+		SyncStaleAfter:   time.Hour,
+		AuthMode:         "none",
+		LogLevel:         "info",
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).AdminHandler())
+	defer ts.Close()
+
+	preload := func(lines ...string) map[string]string {
+		t.Helper()
+		resp, err := http.Post(ts.URL+"/admin/preload", "text/plain", strings.NewReader(strings.Join(lines, "\n")))
+		if err != nil {
+			t.Fatalf("preload request: %v", err)
+		}
+		defer resp.Body.Close()
+		var res struct {
+			Entries []struct{ Entry, Status, Error string }
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected preload results, got %d (%v)", resp.StatusCode, err)
+		}
+		statuses := map[string]string{}
+		for _, e := range res.Entries {
+			statuses[e.Entry] = e.Status
+		}
+		return statuses
+	}
+
+	// Pinned commits of a missing mirror come with its clone
+	first := upstreamHost + "/owner/repo@" + git("rev-parse", "HEAD")
+	if got := preload("# lockfile", first); got[first] != string(mirror.PreloadFetched) {
+		t.Fatalf("expected %s fetched, got %v", first, got)
+	}
+
+	// A commit pushed since is synced in, one on no ref reported missing
+	git("update-ref", "refs/heads/main", git("commit-tree", "HEAD^{tree}", "-p", "HEAD", "-m", "second"))
+	second := upstreamHost + "/owner/repo.git@" + git("rev-parse", "HEAD")
+	unknown := upstreamHost + "/owner/repo@" + strings.Repeat("ab", 20)
+	want := map[string]string{
+		first:                             string(mirror.PreloadPresent),
+		second:                            string(mirror.PreloadFetched),
+		unknown:                           string(mirror.PreloadMissing),
+		upstreamHost + "/owner/repo@main": "invalid",
+		"example.com/owner/repo@" + strings.Repeat("ab", 20): "invalid",
+	}
+	lines := slices.Collect(maps.Keys(want))
+	if got := preload(lines...); !maps.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestAdminPrivateRepo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	upstream := newPrivateUpstream(t, "owner", "private", "secret")
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg := &config.Config{
+		AllowedUpstreams: []string{upstreamHost},
+		MirrorDir:        t.TempDir(),
+		SyncStaleAfter:   time.Hour,
+		AuthMode:         "pass-through",
+		LogLevel:         "info",
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).AdminHandler())
+	defer ts.Close()
+
+	do := func(method, path, auth string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		var body struct{ Code string }
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.Code
+	}
+
+	refresh := "/admin/refresh/" + upstreamHost + "/owner/private"
+	if code, _ := do(http.MethodPost, refresh, "Bearer secret"); code != http.StatusOK {
+		t.Fatalf("expected refresh with credentials to succeed, got %d", code)
+	}
+	if code, errCode := do(http.MethodPost, refresh, ""); code != http.StatusUnauthorized || errCode != gitproxy.CodeAuthRequired {
+		t.Fatalf("expected refresh without credentials to be rejected, got %d %s", code, errCode)
+	}
+	head := "/admin/repo/" + upstreamHost + "/owner/private/head"
+	if code, _ := do(http.MethodGet, head, "Bearer secret"); code != http.StatusOK {
+		t.Fatalf("expected head with credentials to succeed, got %d", code)
+	}
+	if code, errCode := do(http.MethodGet, head, "Bearer wrong"); code != http.StatusUnauthorized || errCode != gitproxy.CodeAuthRequired {
+		t.Fatalf("expected head with bad credentials to be rejected, got %d %s", code, errCode)
+	}
+	for _, listing := range []string{"refs", "packs"} {
+		path := "/admin/repo/" + upstreamHost + "/owner/private/" + listing
+		if code, _ := do(http.MethodGet, path, "Bearer secret"); code != http.StatusOK {
+			t.Fatalf("expected %s with credentials to succeed, got %d", listing, code)
+		}
+		if code, errCode := do(http.MethodGet, path, ""); code != http.StatusUnauthorized || errCode != gitproxy.CodeAuthRequired {
+			t.Fatalf("expected %s without credentials to be rejected, got %d %s", listing, code, errCode)
+		}
+	}
+	// Peers can't prove access, so private mirrors are never bundled
+	if code, errCode := do(http.MethodGet, "/admin/bundle/"+upstreamHost+"/owner/private", "Bearer secret"); code != http.StatusNotFound || errCode != gitproxy.CodeRepoNotFound {
+		t.Fatalf("expected private mirror bundle to be refused, got %d %s", code, errCode)
+	}
+}
+
+func TestPeerProxyClone(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	upstream := newDumbUpstream(t, "owner", "repo")
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	newProxy := func(peers ...string) (*httptest.Server, *metrics.Metrics) {
+		cfg := &config.Config{
+			AllowedUpstreams: []string{upstreamHost},
+			MirrorDir:        t.TempDir(),
+			SyncStaleAfter:   time.Hour,
+			AuthMode:         "none",
+			LogLevel:         "info",
+			PeerProxies:      peers,
+		}
+		logger, _ := logging.New(cfg.LogLevel)
+		metricsRegistry := metrics.NewUnregistered()
+		mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+		if err != nil {
+			t.Fatalf("mirror init: %v", err)
+		}
+		t.Cleanup(mirrorStore.Wait)
+		server := gitproxy.New(cfg, mirrorStore, logger, metricsRegistry)
+		mux := http.NewServeMux()
+		mux.Handle("/admin/", server.AdminHandler())
+		mux.Handle("/", server.Handler())
+		ts := httptest.NewServer(mux)
+		t.Cleanup(ts.Close)
+		return ts, metricsRegistry
+	}
+	clone := func(proxy *httptest.Server) {
+		t.Helper()
+		cmd := exec.Command("git", "clone", proxy.URL+"/"+upstreamHost+"/owner/repo.git", filepath.Join(t.TempDir(), "repo"))
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("clone via proxy failed: %v\noutput: %s", err, out)
+		}
+	}
+
+	warm, warmMetrics := newProxy()
+	clone(warm)
+	if got := testutil.ToFloat64(warmMetrics.MirrorFetches.WithLabelValues("upstream")); got != 1 {
+		t.Fatalf("expected warm proxy to fetch from upstream, got %v", got)
+	}
+
+	// With upstream gone, the cold proxy can only get the repo from its peer
+	upstream.Close()
+	cold, coldMetrics := newProxy(warm.URL)
+	clone(cold)
+	if got := testutil.ToFloat64(coldMetrics.MirrorFetches.WithLabelValues("peer")); got != 1 {
+		t.Fatalf("expected cold proxy to fetch from peer, got %v", got)
+	}
+}
+
+func TestUploadPackBodyTooLarge(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	// Use an existing mirror so upload-pack really consumes the streamed body
+	mirrorDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(mirrorDir, "github.com"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.Rename(filepath.Join(dumbUpstreamRoot(t, "owner", "repo"), "owner"), filepath.Join(mirrorDir, "github.com", "owner")); err != nil {
+		t.Fatalf("move fixture into mirror dir: %v", err)
+	}
+	out, err := exec.Command("git", "-C", filepath.Join(mirrorDir, "github.com", "owner", "repo.git"), "rev-parse", "HEAD").Output()
+	if err != nil {
+		t.Fatalf("rev-parse: %v", err)
+	}
+	want := "0032want " + strings.TrimSpace(string(out)) + "\n"
+
+	cfg := &config.Config{
+		AllowedUpstreams:    []string{"github.com"},
+		MirrorDir:           mirrorDir,
+		SyncStaleAfter:      time.Minute,
+		AuthMode:            "none",
+		LogLevel:            "info",
+		MaxRequestBodyBytes: 1024,
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+	defer ts.Close()
+
+	url := ts.URL + "/github.com/owner/repo.git/git-upload-pack"
+	body := strings.Repeat(want, 100)
+
+	// With Content-Length
+	resp, err := http.Post(url, "application/x-git-upload-pack-request", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", resp.StatusCode)
+	}
+
+	// Chunked, so the size is only known while reading
+	req, _ := http.NewRequest(http.MethodPost, url, io.MultiReader(strings.NewReader(body)))
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("post chunked: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for chunked body, got %d", resp.StatusCode)
+	}
+
+	// Bodies within the limit are streamed to upload-pack as usual
+	resp, err = http.Post(url, "application/x-git-upload-pack-request", strings.NewReader(want+"0000"+"0009done\n"))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	pack, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(pack), "PACK") {
+		t.Fatalf("expected pack for body within limit, got %d %q", resp.StatusCode, pack)
+	}
+}
+
+func TestMaxCloneBytes(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	mirrorDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(mirrorDir, "github.com"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.Rename(filepath.Join(dumbUpstreamRoot(t, "owner", "repo"), "owner"), filepath.Join(mirrorDir, "github.com", "owner")); err != nil {
+		t.Fatalf("move fixture into mirror dir: %v", err)
+	}
+	out, err := exec.Command("git", "-C", filepath.Join(mirrorDir, "github.com", "owner", "repo.git"), "rev-parse", "HEAD").Output()
+	if err != nil {
+		t.Fatalf("rev-parse: %v", err)
+	}
+	want := "want " + strings.TrimSpace(string(out)) + " side-band-64k\n"
+	body := fmt.Sprintf("%04x%s00000009done\n", len(want)+4, want)
+
+	cfg := &config.Config{
+		AllowedUpstreams: []string{"github.com"},
+		MirrorDir:        mirrorDir,
+		SyncStaleAfter:   time.Minute,
+		AuthMode:         "none",
+		LogLevel:         "info",
+		MaxCloneBytes:    16,
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	srv := gitproxy.New(cfg, mirrorStore, logger, metricsRegistry)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	post := func() string {
+		resp, err := http.Post(ts.URL+"/github.com/owner/repo.git/git-upload-pack", "application/x-git-upload-pack-request", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		defer resp.Body.Close()
+		got, _ := io.ReadAll(resp.Body)
+		return string(got)
+	}
+
+	// The pack is cut off with an error on the progress sideband
+	got := post()
+	if !strings.Contains(got, "\x03smart-git-proxy: response exceeds the 16 byte limit") || strings.HasSuffix(got, "0000") {
+		t.Fatalf("expected an aborted response, got %q", got)
+	}
+	if n := testutil.ToFloat64(metricsRegistry.CloneAborts.WithLabelValues("github.com/owner/repo")); n != 1 {
+		t.Fatalf("expected 1 abort counted, got %v", n)
+	}
+
+	// Overrides lift the limit for matching repos
+	next := *cfg
+	next.MaxCloneBytesOverrides = config.SizeLimits{{Pattern: regexp.MustCompile(`^github\.com/owner/.+$`), Bytes: 0}}
+	srv.Reload(&next)
+	if got := post(); !strings.Contains(got, "PACK") || !strings.HasSuffix(got, "0000") {
+		t.Fatalf("expected a complete pack with the override, got %q", got)
+	}
+}
+
+func TestHostAliases(t *testing.T) {
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	backend := &cgi.Handler{
+		Path: realGit,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + dumbUpstreamRoot(t, "owner", "repo"), "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	var fetches atomic.Int32
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/git-upload-pack") {
+			fetches.Add(1)
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+	_, port, _ := net.SplitHostPort(upstreamHost)
+	alias := "localhost:" + port
+
+	cfg := &config.Config{
+		AllowedUpstreams:    []string{upstreamHost},
+		UpstreamHostAliases: config.HostAliases{alias: upstreamHost},
+		MirrorDir:           t.TempDir(),
+		SyncStaleAfter:      time.Minute,
+		AuthMode:            "none",
+		LogLevel:            "info",
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+	defer ts.Close()
+
+	// Both hosts are served the same repo, from a single mirror
+	var cloneFetches int32
+	for _, host := range []string{alias, upstreamHost} {
+		cloneDir := filepath.Join(t.TempDir(), "clone")
+		cmd := exec.Command("git", "clone", ts.URL+"/"+host+"/owner/repo.git", cloneDir)
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("clone through %s failed: %v\n%s", host, err, out)
+		}
+		if cloneFetches == 0 {
+			cloneFetches = fetches.Load()
+		}
+	}
+	if _, err := os.Stat(mirrorStore.RepoPath(upstreamHost, "owner", "repo")); err != nil {
+		t.Fatalf("expected the mirror under the aliased host: %v", err)
+	}
+	if _, err := os.Stat(mirrorStore.RepoPath(alias, "owner", "repo")); !os.IsNotExist(err) {
+		t.Fatalf("expected no mirror under the alias, got %v", err)
+	}
+	if n := fetches.Load(); n != cloneFetches {
+		t.Fatalf("expected the mirror to be fetched only for the first clone, got %d fetches after %d", n, cloneFetches)
+	}
+}
+
+func TestGitSuffix(t *testing.T) {
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	for _, keep := range []bool{false, true} {
+		t.Run(fmt.Sprintf("keep=%v", keep), func(t *testing.T) {
+			backend := &cgi.Handler{
+				Path: realGit,
+				Args: []string{"http-backend"},
+				Env:  []string{"GIT_PROJECT_ROOT=" + dumbUpstreamRoot(t, "owner", "repo"), "GIT_HTTP_EXPORT_ALL=1"},
+			}
+			var mu sync.Mutex
+			var fetched []string
+			upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if p, ok := strings.CutSuffix(r.URL.Path, "/info/refs"); ok {
+					mu.Lock()
+					fetched = append(fetched, p)
+					mu.Unlock()
+				}
+				backend.ServeHTTP(w, r)
+			}))
+			defer upstream.Close()
+			upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+			cfg := &config.Config{
+				AllowedUpstreams: []string{upstreamHost},
+				MirrorDir:        t.TempDir(),
+				SyncStaleAfter:   time.Minute,
+				AuthMode:         "none",
+				LogLevel:         "info",
+			}
+			if keep {
+				cfg.KeepGitSuffixHosts = config.GitSuffixHosts{upstreamHost}
+			}
+			logger, _ := logging.New(cfg.LogLevel)
+			metricsRegistry := metrics.NewUnregistered()
+			mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+			if err != nil {
+				t.Fatalf("mirror init: %v", err)
+			}
+			t.Cleanup(mirrorStore.Wait)
+			ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+			defer ts.Close()
+
+			for _, name := range []string{"repo", "repo.git"} {
+				cloneDir := filepath.Join(t.TempDir(), "clone")
+				cmd := exec.Command("git", "clone", ts.URL+"/"+upstreamHost+"/owner/"+name, cloneDir)
+				cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+				if out, err := cmd.CombinedOutput(); err != nil {
+					t.Fatalf("clone of %s failed: %v\n%s", name, err, out)
+				}
+			}
+
+			// Both forms share a mirror, fetched once from the .git URL, unless
+			// the host keeps them apart
+			want := []string{"/owner/repo.git"}
+			if keep {
+				want = []string{"/owner/repo", "/owner/repo.git"}
+			}
+			if !slices.Equal(fetched, want) {
+				t.Fatalf("expected upstream fetched as %v, got %v", want, fetched)
+			}
+			_, err = os.Stat(mirrorStore.RepoPath(upstreamHost, "owner", "repo.git"))
+			if keep && err != nil {
+				t.Fatalf("expected a mirror of repo.git of its own: %v", err)
+			}
+			if !keep && !os.IsNotExist(err) {
+				t.Fatalf("expected no mirror of repo.git of its own, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSloppyPaths(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	upstream := newDumbUpstream(t, "owner", "repo")
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg := &config.Config{
+		AllowedUpstreams: []string{upstreamHost},
+		MirrorDir:        t.TempDir(),
+		SyncStaleAfter:   time.Minute,
+		AuthMode:         "none",
+		LogLevel:         "info",
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+	defer ts.Close()
+
+	// Empty segments anywhere in the repo path, as left by remote URLs
+	// joined with an extra slash, map to the same repo
+	for _, p := range []string{
+		"/" + upstreamHost + "/owner/repo.git/info/refs",
+		"//" + upstreamHost + "/owner/repo.git/info/refs",
+		"/" + upstreamHost + "//owner/repo.git/info/refs",
+		"/" + upstreamHost + "/owner///repo/info/refs",
+		"/" + upstreamHost + "/owner/repo.git//info/refs",
+		"/" + upstreamHost + "/owner/repo//info/refs",
+		"/" + upstreamHost + "/owner/repo.git//HEAD",
+	} {
+		query := "?service=git-upload-pack"
+		if strings.HasSuffix(p, "/HEAD") {
+			query = ""
+		}
+		resp, err := http.Get(ts.URL + p + query)
+		if err != nil {
+			t.Fatalf("GET %s: %v", p, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: expected 200, got %d: %s", p, resp.StatusCode, body)
+		}
+	}
+	mirrors, _ := filepath.Glob(filepath.Join(cfg.MirrorDir, "*", "*", "*.git"))
+	if want := mirrorStore.RepoPath(upstreamHost, "owner", "repo"); len(mirrors) != 1 || mirrors[0] != want {
+		t.Fatalf("expected a single mirror at %s, got %v", want, mirrors)
+	}
+
+	// Clones from such URLs work end to end
+	cloneDir := filepath.Join(t.TempDir(), "clone")
+	cmd := exec.Command("git", "clone", ts.URL+"//"+upstreamHost+"//owner/repo.git/", cloneDir)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("clone failed: %v\n%s", err, out)
+	}
+
+	// The git endpoint itself must be spelled out as is
+	for _, p := range []string{
+		"/" + upstreamHost + "/owner/repo.git/info//refs?service=git-upload-pack",
+		"/" + upstreamHost + "/owner/repo.git/info/refs/?service=git-upload-pack",
+	} {
+		resp, err := http.Get(ts.URL + p)
+		if err != nil {
+			t.Fatalf("GET %s: %v", p, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("GET %s: expected 404, got %d", p, resp.StatusCode)
+		}
+	}
+}
+
+func TestDiskFullPassthrough(t *testing.T) {
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	// Smart HTTP upstream
+	upstream := httptest.NewTLSServer(&cgi.Handler{
+		Path: realGit,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + dumbUpstreamRoot(t, "owner", "repo"), "GIT_HTTP_EXPORT_ALL=1"},
+	})
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	// Mirror clones always run out of space
+	bin := t.TempDir()
+	script := "#!/bin/sh\ncase \"$*\" in *--mirror*) echo 'fatal: No space left on device' >&2; exit 128;; esac\nexec \"" + realGit + "\" \"$@\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "git"), []byte(script), 0o755); err != nil {
+		t.Fatalf("write git wrapper: %v", err)
+	}
+	t.Setenv("PATH", bin+string(filepath.ListSeparator)+os.Getenv("PATH"))
+
+	cfg := &config.Config{
+		AllowedUpstreams: []string{upstreamHost},
+		MirrorDir:        t.TempDir(),
+		SyncStaleAfter:   time.Minute,
+		AuthMode:         "none",
+		LogLevel:         "info",
+		DiskFullFallback: "passthrough",
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+	defer ts.Close()
+
+	for _, version := range []string{"1", "2"} {
+		cloneDir := filepath.Join(t.TempDir(), "clone")
+		cmd := exec.Command("git", "-c", "protocol.version="+version, "clone", ts.URL+"/"+upstreamHost+"/owner/repo.git", cloneDir)
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("clone (protocol v%s) through passthrough failed: %v\n%s", version, err, out)
+		}
+	}
+	if _, err := os.Stat(mirrorStore.RepoPath(upstreamHost, "owner", "repo")); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing to be mirrored, got %v", err)
+	}
+
+	// Without the fallback, the clone fails
+	cfg.DiskFullFallback = "fail"
+	cmd := exec.Command("git", "clone", ts.URL+"/"+upstreamHost+"/owner/repo.git", filepath.Join(t.TempDir(), "clone"))
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Fatalf("expected clone to fail without passthrough\n%s", out)
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	fakeSSH(t, dumbUpstreamRoot(t, "owner", "repo"))
+	cfg := &config.Config{
+		BasePath:         "/git",
+		AllowedUpstreams: []string{"git.internal"},
+		UpstreamSchemes:  map[string]string{"git.internal": "ssh"},
+		MirrorDir:        t.TempDir(),
+		SyncStaleAfter:   time.Minute,
+		AuthMode:         "none",
+		LogLevel:         "info",
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	server := gitproxy.New(cfg, mirrorStore, logger, metricsRegistry)
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+	admin := httptest.NewServer(server.AdminHandler())
+	defer admin.Close()
+
+	get := func(url string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("get %s: %v", url, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	cmd := exec.Command("git", "clone", ts.URL+"/git/git.internal/owner/repo.git", filepath.Join(t.TempDir(), "clone"))
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("clone under base path failed: %v\noutput: %s", err, out)
+	}
+
+	// Self-referential URLs include the base path
+	for _, path := range []string{"/git", "/git/"} {
+		if code, body := get(ts.URL + path); code != http.StatusOK || !strings.Contains(body, ts.URL+"/git/github.com/owner/repo.git") {
+			t.Fatalf("expected landing page at %s, got %d:\n%s", path, code, body)
+		}
+	}
+	for _, path := range []string{"/git.internal/owner/repo.git/info/refs?service=git-upload-pack", "/gitx/git.internal/owner/repo.git/info/refs"} {
+		if code, body := get(ts.URL + path); code != http.StatusNotFound || !strings.Contains(body, ts.URL+"/git/github.com/") {
+			t.Fatalf("expected 404 with guidance for %s outside the base path, got %d:\n%s", path, code, body)
+		}
+	}
+
+	if code, body := get(admin.URL + "/git/admin/repo/git.internal/owner/repo/head"); code != http.StatusOK || !strings.Contains(body, `"ref":"refs/heads/main"`) {
+		t.Fatalf("expected admin API under the base path, got %d: %s", code, body)
+	}
+	if code, body := get(admin.URL + "/admin/repo/git.internal/owner/repo/head"); code != http.StatusNotFound || !strings.Contains(body, `"code":"not_found"`) {
+		t.Fatalf("expected admin API outside the base path to be not found, got %d: %s", code, body)
+	}
+}
+
+func TestRestrictedMirrorFallThrough(t *testing.T) {
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com", "GIT_TERMINAL_PROMPT=0")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	// Smart HTTP upstream with a pull request ref
+	root := dumbUpstreamRoot(t, "owner", "repo")
+	bare := filepath.Join(root, "owner", "repo.git")
+	pull := git("-C", bare, "commit-tree", "HEAD^{tree}", "-p", "HEAD", "-m", "pull request")
+	git("-C", bare, "update-ref", "refs/pull/1/head", pull)
+	upstream := httptest.NewTLSServer(&cgi.Handler{
+		Path: realGit,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	})
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg := &config.Config{
+		AllowedUpstreams: []string{upstreamHost},
+		MirrorDir:        t.TempDir(),
+		SyncStaleAfter:   time.Minute,
+		AuthMode:         "none",
+		LogLevel:         "info",
+		MirrorRefspecs: config.MirrorRefspecs{{
+			Pattern: regexp.MustCompile(`^.*/owner/repo$`),
+			Refs:    config.MirrorRefs{"refs/heads/main", "refs/tags/*"},
+		}},
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+	defer ts.Close()
+
+	cloneDir := filepath.Join(t.TempDir(), "clone")
+	git("-c", "protocol.version=2", "clone", "-q", ts.URL+"/"+upstreamHost+"/owner/repo.git", cloneDir)
+	repoPath := mirrorStore.RepoPath(upstreamHost, "owner", "repo")
+	if got := git("-C", repoPath, "for-each-ref", "--format=%(refname)"); got != "refs/heads/main" {
+		t.Fatalf("expected only main to be mirrored, got:\n%s", got)
+	}
+
+	// Refs left out of the mirror are fetched from upstream
+	git("-C", cloneDir, "-c", "protocol.version=2", "fetch", "-q", "origin", "refs/pull/1/head")
+	if got := git("-C", cloneDir, "rev-parse", "FETCH_HEAD"); got != pull {
+		t.Fatalf("expected pull request ref at %s, got %s", pull, got)
+	}
+	if mirrorStore.HasObjects(context.Background(), repoPath, []string{pull}) {
+		t.Fatalf("expected the pull request not to be mirrored")
+	}
+}
+
+// lockedBuffer is a log destination safe to read while handlers write to it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// lines returns the logged JSON records with the given message.
+func (b *lockedBuffer) lines(t *testing.T, msg string) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("parse log line %q: %v", line, err)
+		}
+		if record["msg"] == msg {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func TestCacheDecisionLog(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	upstream := newDumbUpstream(t, "owner", "repo")
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg, err := config.LoadArgs([]string{"-allowed-upstreams", upstreamHost, "-auth-mode", "none", "-mirror-dir", t.TempDir(),
+		"-info-refs-mem-cache-bytes", "1MiB", "-trusted-proxy-cidrs", "127.0.0.1/32"})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	var logs lockedBuffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+	defer ts.Close()
+
+	repoKey := upstreamHost + "/owner/repo"
+	get := func(requestID string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/"+repoKey+".git/info/refs?service=git-upload-pack", nil)
+		req.Header.Set("X-Request-Id", requestID)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("info/refs: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	// The first request clones from upstream, the second is answered from memory
+	if resp := get("first"); resp.StatusCode != http.StatusOK || resp.Header.Get("X-Request-Id") != "first" {
+		t.Fatalf("expected 200 with the proxy's request ID, got %d %q", resp.StatusCode, resp.Header.Get("X-Request-Id"))
+	}
+	get("second")
+
+	decisions := logs.lines(t, "cache decision")
+	if len(decisions) != 2 {
+		t.Fatalf("expected 2 cache decisions, got %d", len(decisions))
+	}
+	for i, want := range []map[string]any{
+		{"request_id": "first", "repo": repoKey, "kind": "info", "hit": false, "source": "disk", "status": "mirror-clone", "refreshed": true},
+		{"request_id": "second", "repo": repoKey, "kind": "info", "hit": true, "source": "memcache", "status": "mirror-hit", "refreshed": false},
+	} {
+		for k, v := range want {
+			if decisions[i][k] != v {
+				t.Errorf("decision %d: expected %s=%v, got %v", i, k, v, decisions[i][k])
+			}
+		}
+		if n, _ := decisions[i]["bytes"].(float64); n <= 0 {
+			t.Errorf("decision %d: expected bytes served, got %v", i, decisions[i]["bytes"])
+		}
+	}
+	// The access log line carries the same request ID
+	if requests := logs.lines(t, "request"); len(requests) != 2 || requests[0]["request_id"] != "first" {
+		t.Fatalf("expected access log lines with the request ID, got %v", requests)
+	}
+}
+
+func TestSlowRequestLog(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	// Every upstream response takes a while
+	const delay = 20 * time.Millisecond
+	files := http.FileServer(http.Dir(dumbUpstreamRoot(t, "owner", "repo")))
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		files.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg := &config.Config{
+		AllowedUpstreams:     []string{upstreamHost},
+		MirrorDir:            t.TempDir(),
+		SyncStaleAfter:       time.Minute,
+		AuthMode:             "none",
+		SlowRequestThreshold: time.Nanosecond,
+	}
+	var logs lockedBuffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+	defer ts.Close()
+
+	get := func(direct bool) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/"+upstreamHost+"/owner/repo.git/info/refs?service=git-upload-pack", nil)
+		if direct {
+			req.Header.Set("X-Git-Proxy-Direct", "1")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("info/refs: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+	}
+	// Passed through, then cloned from upstream
+	get(true)
+	get(false)
+
+	slow := logs.lines(t, "slow request")
+	if len(slow) != 2 {
+		t.Fatalf("expected 2 slow request lines, got %d", len(slow))
+	}
+	ms := func(record map[string]any, key string) time.Duration {
+		t.Helper()
+		v, ok := record[key].(float64)
+		if !ok {
+			t.Fatalf("expected %s in %v", key, record)
+		}
+		return time.Duration(v) * time.Millisecond
+	}
+	for i, want := range []struct{ source, phase, idle string }{
+		{"upstream", "upstream_negotiation_ms", "upstream_git_ms"},
+		{"disk", "upstream_git_ms", "upstream_negotiation_ms"},
+	} {
+		record := slow[i]
+		if record["source"] != want.source || ms(record, want.phase) < delay || ms(record, want.idle) != 0 {
+			t.Fatalf("request %d: expected %s over %v and no %s, got %v", i, want.phase, delay, want.idle, record)
+		}
+		// The phases and the rest add up to the whole, give or take rounding
+		var sum time.Duration
+		for _, key := range []string{"wait_ms", "dns_ms", "connect_ms", "tls_ms", "upstream_negotiation_ms", "upstream_git_ms", "local_git_ms", "transfer_ms", "other_ms"} {
+			sum += ms(record, key)
+		}
+		if total := ms(record, "duration_ms"); sum > total || sum < total-9*time.Millisecond {
+			t.Fatalf("request %d: expected phases adding up to %v, got %v: %v", i, total, sum, record)
+		}
+	}
+}
+
+func TestServiceAllowlist(t *testing.T) {
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	// Smart HTTP upstream accepting pushes, with the credentials it got
+	root := dumbUpstreamRoot(t, "owner", "repo")
+	bare := filepath.Join(root, "owner", "repo.git")
+	if out, err := exec.Command("git", "-C", bare, "config", "http.receivepack", "true").CombinedOutput(); err != nil {
+		t.Fatalf("enable receive-pack: %v\n%s", err, out)
+	}
+	backend := &cgi.Handler{
+		Path: realGit,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	var pushAuth []string
+	var mu sync.Mutex
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/git-receive-pack") {
+			mu.Lock()
+			pushAuth = append(pushAuth, r.Header.Get("Authorization"))
+			mu.Unlock()
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg, err := config.LoadArgs([]string{"-allowed-upstreams", upstreamHost, "-auth-mode", "static", "-static-token", "proxy-token", "-mirror-dir", t.TempDir()})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	server := gitproxy.New(cfg, mirrorStore, logger, metricsRegistry)
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	repoURL := ts.URL + "/" + upstreamHost + "/owner/repo.git"
+	for _, tc := range []struct{ method, path string }{
+		{http.MethodGet, "/info/refs?service=bogus"},
+		{http.MethodGet, "/info/refs?service=git-upload-pack%00"},
+		{http.MethodGet, "/info/refs?service=git-receive-pack"},
+		{http.MethodPost, "/info/refs?service=git-upload-pack"},
+		{http.MethodGet, "/git-upload-pack"},
+		{http.MethodPost, "/git-receive-pack"},
+	} {
+		req, _ := http.NewRequest(tc.method, repoURL+tc.path, strings.NewReader(""))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tc.method, tc.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s %s: expected 400, got %d", tc.method, tc.path, resp.StatusCode)
+		}
+	}
+	if _, err := os.Stat(mirrorStore.RepoPath(upstreamHost, "owner", "repo")); !os.IsNotExist(err) {
+		t.Fatalf("expected rejected requests not to mirror anything, got %v", err)
+	}
+
+	// Once allowed, pushes go through to upstream with the client's credentials
+	next, err := config.LoadArgs([]string{"-allowed-upstreams", upstreamHost, "-auth-mode", "static", "-static-token", "proxy-token", "-mirror-dir", cfg.MirrorDir,
+		"-allowed-services", "git-upload-pack,git-receive-pack"})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	server.Reload(next)
+	work := filepath.Join(t.TempDir(), "work")
+	for _, args := range [][]string{
+		{"clone", "-q", repoURL, work},
+		{"-C", work, "commit", "-q", "--allow-empty", "-m", "pushed"},
+		{"-C", work, "-c", "http.extraHeader=Authorization: Bearer client-token", "push", "-q", "origin", "HEAD:main"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	pushed, err := exec.Command("git", "-C", bare, "log", "-1", "--format=%s", "main").Output()
+	if err != nil || strings.TrimSpace(string(pushed)) != "pushed" {
+		t.Fatalf("expected push to reach upstream, got %q: %v", pushed, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(pushAuth) == 0 || pushAuth[0] != "Bearer client-token" {
+		t.Fatalf("expected push made with the client's credentials, got %v", pushAuth)
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	upstream := newDumbUpstream(t, "owner", "repo")
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg, err := config.LoadArgs([]string{"-allowed-upstreams", upstreamHost, "-auth-mode", "none", "-mirror-dir", t.TempDir(),
+		"-client-auth-tokens", "ci-token", "-client-auth-users", "alice=s3cret"})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+	defer ts.Close()
+
+	repoURL := ts.URL + "/" + upstreamHost + "/owner/repo.git"
+	get := func(path string, setAuth func(*http.Request)) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		setAuth(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	infoRefs := "/" + upstreamHost + "/owner/repo.git/info/refs?service=git-upload-pack"
+	for name, setAuth := range map[string]func(*http.Request){
+		"none":          func(*http.Request) {},
+		"wrong token":   func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") },
+		"wrong user":    func(r *http.Request) { r.SetBasicAuth("bob", "s3cret") },
+		"wrong passwd":  func(r *http.Request) { r.SetBasicAuth("alice", "nope") },
+		"token as user": func(r *http.Request) { r.SetBasicAuth("ci-token", "") },
+	} {
+		resp := get(infoRefs, setAuth)
+		if resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Basic ") {
+			t.Errorf("%s: expected 401 with a Basic challenge, got %d %q", name, resp.StatusCode, resp.Header.Get("WWW-Authenticate"))
+		}
+	}
+	// Refused before saying why the request would be refused otherwise
+	if resp := get("/gitlab.com/owner/repo.git/info/refs?service=git-upload-pack", func(*http.Request) {}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a disallowed upstream, got %d", resp.StatusCode)
+	}
+	// The landing page stays open
+	if resp := get("/", func(*http.Request) {}); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected landing page served, got %d", resp.StatusCode)
+	}
+	for name, setAuth := range map[string]func(*http.Request){
+		"bearer token": func(r *http.Request) { r.Header.Set("Authorization", "Bearer ci-token") },
+		"token":        func(r *http.Request) { r.SetBasicAuth("x-access-token", "ci-token") },
+		"user":         func(r *http.Request) { r.SetBasicAuth("alice", "s3cret") },
+	} {
+		if resp := get(infoRefs, setAuth); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", name, resp.StatusCode)
+		}
+	}
+
+	// git gets its credentials from a helper after the challenge
+	clone := func(args ...string) error {
+		cmd := exec.Command("git", append(args, "clone", "-q", repoURL, filepath.Join(t.TempDir(), "clone"))...)
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ASKPASS=", "SSH_ASKPASS=")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, out)
+		}
+		return nil
+	}
+	if err := clone("-c", "credential.helper="); err == nil {
+		t.Fatalf("expected clone without credentials to fail")
+	}
+	if err := clone("-c", "credential.helper=", "-c", "credential.helper=!f() { echo username=alice; echo password=s3cret; }; f"); err != nil {
+		t.Fatalf("clone with credential helper: %v", err)
+	}
+}
+
+func TestClientUpstreamIdentities(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	// Each team's private repo, readable with that team's upstream token only
+	upstreamA := newPrivateUpstream(t, "team-a", "app", "upstream-a")
+	defer upstreamA.Close()
+	upstreamB := newPrivateUpstream(t, "team-b", "app", "upstream-b")
+	defer upstreamB.Close()
+	hostA := strings.TrimPrefix(upstreamA.URL, "https://")
+	hostB := strings.TrimPrefix(upstreamB.URL, "https://")
+
+	cfg, err := config.LoadArgs([]string{"-allowed-upstreams", hostA + "," + hostB, "-auth-mode", "none", "-mirror-dir", t.TempDir(),
+		"-client-auth-upstream-tokens", "proxy-a=upstream-a,proxy-b=upstream-b"})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+	defer ts.Close()
+
+	repoA := ts.URL + "/" + hostA + "/team-a/app.git"
+	repoB := ts.URL + "/" + hostB + "/team-b/app.git"
+	clone := func(token, url string) error {
+		cmd := exec.Command("git", "-c", "http.extraHeader=Authorization: Bearer "+token, "clone", "-q", url, filepath.Join(t.TempDir(), "clone"))
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%w: %s", err, out)
+		}
+		return nil
+	}
+	if err := clone("proxy-a", repoA); err != nil {
+		t.Fatalf("team A cloning its repo: %v", err)
+	}
+	if err := clone("proxy-b", repoB); err != nil {
+		t.Fatalf("team B cloning its repo: %v", err)
+	}
+	// Mirrored and fresh, yet each team's repo stays out of reach of the other
+	if err := clone("proxy-b", repoA); err == nil {
+		t.Fatalf("expected team B to be refused team A's repo")
+	}
+	if err := clone("proxy-a", repoB); err == nil {
+		t.Fatalf("expected team A to be refused team B's repo")
+	}
+	// Even when skipping info/refs
+	req, _ := http.NewRequest(http.MethodPost, repoA+"/git-upload-pack", strings.NewReader("0000"))
+	req.Header.Set("Authorization", "Bearer proxy-b")
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("upload-pack: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Fatalf("expected team B's upload-pack for team A's repo to be refused")
+	}
+}
+
+func TestUpstreamRedirects(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	// Upstream renamed old-org/app to new-org/app
+	files := http.FileServer(http.Dir(dumbUpstreamRoot(t, "new-org", "app")))
+	var missingChecks atomic.Int64
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Redirect checks are the proxy's own requests, not git's
+		if strings.HasPrefix(r.URL.Path, "/missing/") && strings.HasPrefix(r.UserAgent(), "Go-http-client") {
+			missingChecks.Add(1)
+		}
+		if rest, ok := strings.CutPrefix(r.URL.Path, "/old-org/app.git/"); ok {
+			http.Redirect(w, r, "/new-org/app.git/"+rest+"?"+r.URL.RawQuery, http.StatusMovedPermanently)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	for _, follow := range []bool{true, false} {
+		t.Run(fmt.Sprintf("follow=%v", follow), func(t *testing.T) {
+			cfg := &config.Config{
+				AllowedUpstreams:        []string{upstreamHost},
+				MirrorDir:               t.TempDir(),
+				SyncStaleAfter:          2 * time.Second,
+				AuthMode:                "none",
+				LogLevel:                "info",
+				FollowUpstreamRedirects: follow,
+			}
+			logger, _ := logging.New(cfg.LogLevel)
+			metricsRegistry := metrics.NewUnregistered()
+			mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+			if err != nil {
+				t.Fatalf("mirror init: %v", err)
+			}
+			t.Cleanup(mirrorStore.Wait)
+			ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+			defer ts.Close()
+
+			clone := func(owner string) error {
+				cmd := exec.Command("git", "clone", "-q", ts.URL+"/"+upstreamHost+"/"+owner+"/app.git", filepath.Join(t.TempDir(), "clone"))
+				cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+				if out, err := cmd.CombinedOutput(); err != nil {
+					return fmt.Errorf("%w: %s", err, out)
+				}
+				return nil
+			}
+			err = clone("old-org")
+			if !follow {
+				if err == nil {
+					t.Fatalf("expected clone of a redirected repo to fail with redirects disabled")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("clone under the old name: %v", err)
+			}
+			// Mirrored once, under the new name, which the old one stays an alias of
+			if _, err := os.Stat(mirrorStore.RepoPath(upstreamHost, "new-org", "app")); err != nil {
+				t.Fatalf("expected mirror under the new name: %v", err)
+			}
+			if _, err := os.Stat(mirrorStore.RepoPath(upstreamHost, "old-org", "app")); !os.IsNotExist(err) {
+				t.Fatalf("expected no mirror under the old name, got %v", err)
+			}
+			if err := clone("new-org"); err != nil {
+				t.Fatalf("clone under the new name: %v", err)
+			}
+			if err := clone("old-org"); err != nil {
+				t.Fatalf("clone under the old name again: %v", err)
+			}
+
+			// Upstream not redirecting a repo is remembered
+			for range 3 {
+				resp, err := http.Get(ts.URL + "/" + upstreamHost + "/missing/app.git/info/refs?service=git-upload-pack")
+				if err != nil {
+					t.Fatalf("info/refs: %v", err)
+				}
+				resp.Body.Close()
+			}
+			if n := missingChecks.Load(); n != 1 {
+				t.Fatalf("expected upstream asked once whether it redirects, got %d", n)
+			}
+		})
+	}
+}
+
+func TestHeadRequests(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	var upstreamRequests atomic.Int64
+	files := http.FileServer(http.Dir(dumbUpstreamRoot(t, "owner", "repo")))
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests.Add(1)
+		files.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+	repoKey := upstreamHost + "/owner/repo"
+
+	for _, mode := range []string{"mirror", "upstream"} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := &config.Config{
+				AllowedUpstreams: []string{upstreamHost},
+				MirrorDir:        t.TempDir(),
+				// Any GET would sync the mirror
+				SyncStaleAfter: time.Nanosecond,
+				AuthMode:       "none",
+				LogLevel:       "info",
+				CacheControl:   "public, max-age=60",
+				HeadRequests:   mode,
+			}
+			logger, _ := logging.New(cfg.LogLevel)
+			metricsRegistry := metrics.NewUnregistered()
+			mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+			if err != nil {
+				t.Fatalf("mirror init: %v", err)
+			}
+			t.Cleanup(mirrorStore.Wait)
+			ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+			defer ts.Close()
+
+			head := func(name string) *http.Response {
+				t.Helper()
+				resp, err := http.Head(ts.URL + "/" + upstreamHost + "/owner/" + name + ".git/info/refs?service=git-upload-pack")
+				if err != nil {
+					t.Fatalf("HEAD info/refs: %v", err)
+				}
+				resp.Body.Close()
+				return resp
+			}
+
+			// Not mirrored: only checked upstream if asked to, never cloned
+			want := http.StatusNotFound
+			if mode == "upstream" {
+				want = http.StatusOK
+			}
+			if resp := head("repo"); resp.StatusCode != want {
+				t.Fatalf("expected %d for an unmirrored repo, got %d", want, resp.StatusCode)
+			}
+			if resp := head("missing"); resp.StatusCode != http.StatusNotFound {
+				t.Fatalf("expected 404 for a repo upstream doesn't have, got %d", resp.StatusCode)
+			}
+			if _, err := os.Stat(mirrorStore.RepoPath(upstreamHost, "owner", "repo")); !os.IsNotExist(err) {
+				t.Fatalf("expected HEAD not to clone a mirror, got %v", err)
+			}
+
+			cmd := exec.Command("git", "clone", "-q", ts.URL+"/"+repoKey+".git", filepath.Join(t.TempDir(), "clone"))
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("clone: %v\n%s", err, out)
+			}
+			mirrorStore.Wait()
+
+			// Mirrored: answered with GET's headers, without syncing the stale mirror
+			before := upstreamRequests.Load()
+			resp := head("repo")
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200 for a mirrored repo, got %d", resp.StatusCode)
+			}
+			if got := resp.Header.Get("Content-Type"); got != "application/x-git-upload-pack-advertisement" {
+				t.Fatalf("expected advertisement Content-Type, got %q", got)
+			}
+			if got := resp.Header.Get("Cache-Control"); got != "public, max-age=60" {
+				t.Fatalf("expected configured Cache-Control, got %q", got)
+			}
+			if got := resp.Header.Get("X-Git-Proxy-Status"); got != string(mirror.StatusHit) {
+				t.Fatalf("expected %s, got %q", mirror.StatusHit, got)
+			}
+			if got := upstreamRequests.Load() - before; got != 0 {
+				t.Fatalf("expected HEAD not to reach upstream, got %d requests", got)
+			}
+		})
+	}
+}
+
+func TestSpoolLargePacks(t *testing.T) {
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	// Upstream sends a pack far larger than the socket buffers in between
+	pack := bytes.Repeat([]byte("0123456789abcdef"), 1<<20)
+	upstreamDone := make(chan struct{}, 1)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+		w.Write(pack)
+		upstreamDone <- struct{}{}
+	}))
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	for _, spool := range []bool{true, false} {
+		t.Run(fmt.Sprintf("spool=%v", spool), func(t *testing.T) {
+			spoolDir := t.TempDir()
+			cfg := &config.Config{
+				AllowedUpstreams: []string{upstreamHost},
+				MirrorDir:        t.TempDir(),
+				MirrorTempDir:    spoolDir,
+				SyncStaleAfter:   time.Minute,
+				AuthMode:         "none",
+				LogLevel:         "info",
+				// Unmirrored repos are passed through
+				DiskFullFallback:      "passthrough",
+				SpoolLargePacksToDisk: spool,
+				SpoolPackThreshold:    64 << 10,
+			}
+			logger, _ := logging.New(cfg.LogLevel)
+			metricsRegistry := metrics.NewUnregistered()
+			mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+			if err != nil {
+				t.Fatalf("mirror init: %v", err)
+			}
+			t.Cleanup(mirrorStore.Wait)
+			ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+			defer ts.Close()
+
+			resp, err := http.Post(ts.URL+"/"+upstreamHost+"/owner/repo.git/git-upload-pack", "application/x-git-upload-pack-request", strings.NewReader("0000"))
+			if err != nil {
+				t.Fatalf("upload-pack: %v", err)
+			}
+			defer resp.Body.Close()
+
+			// The client doesn't read yet: upstream only finishes if spooled
+			select {
+			case <-upstreamDone:
+				if !spool {
+					t.Fatalf("expected upstream to wait for the client without spooling")
+				}
+			case <-time.After(2 * time.Second):
+				if spool {
+					t.Fatalf("expected upstream to be read without waiting for the client")
+				}
+			}
+			if spool {
+				// Spool files are never visible, let alone left behind
+				if entries, _ := os.ReadDir(spoolDir); len(entries) != 0 {
+					t.Fatalf("expected no spool files in %s, got %v", spoolDir, entries)
+				}
+			}
+
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("read pack: %v", err)
+			}
+			if !bytes.Equal(got, pack) {
+				t.Fatalf("expected the pack relayed intact, got %d bytes", len(got))
+			}
+			if !spool {
+				<-upstreamDone
+			}
+		})
+	}
+}
+
+func TestVerifyPacks(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	// A real pack, sent on side-band 1 as upload-pack does
+	work := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q", work},
+		{"-C", work, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "initial"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	packCmd := exec.Command("git", "-C", work, "pack-objects", "--revs", "--stdout")
+	packCmd.Stdin = strings.NewReader("HEAD\n")
+	pack, err := packCmd.Output()
+	if err != nil {
+		t.Fatalf("pack-objects: %v", err)
+	}
+	good := []byte("0008NAK\n" + fmt.Sprintf("%04x\x01", len(pack)+5) + string(pack) + "0000")
+	corrupt := bytes.Clone(good)
+	corrupt[len(corrupt)-30] ^= 0xff
+
+	for _, tt := range []struct {
+		name      string
+		responses [][]byte
+		status    int
+	}{
+		{"refetched", [][]byte{corrupt, good}, http.StatusOK},
+		{"still corrupt", [][]byte{corrupt, corrupt}, http.StatusBadGateway},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(requests.Add(1))
+				if body, _ := io.ReadAll(r.Body); string(body) != "0000" {
+					t.Errorf("expected the request body replayed, got %q", body)
+				}
+				w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+				w.Write(tt.responses[min(n, len(tt.responses))-1])
+			}))
+			defer upstream.Close()
+			upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+			cfg := &config.Config{
+				AllowedUpstreams: []string{upstreamHost},
+				MirrorDir:        t.TempDir(),
+				MirrorTempDir:    t.TempDir(),
+				SyncStaleAfter:   time.Minute,
+				AuthMode:         "none",
+				LogLevel:         "info",
+				// Unmirrored repos are passed through
+				DiskFullFallback:      "passthrough",
+				SpoolLargePacksToDisk: true,
+				SpoolPackThreshold:    64 << 10,
+				VerifyPacks:           true,
+			}
+			logger, _ := logging.New(cfg.LogLevel)
+			metricsRegistry := metrics.NewUnregistered()
+			mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+			if err != nil {
+				t.Fatalf("mirror init: %v", err)
+			}
+			t.Cleanup(mirrorStore.Wait)
+			ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+			defer ts.Close()
+
+			resp, err := http.Post(ts.URL+"/"+upstreamHost+"/owner/repo.git/git-upload-pack", "application/x-git-upload-pack-request", strings.NewReader("0000"))
+			if err != nil {
+				t.Fatalf("upload-pack: %v", err)
+			}
+			defer resp.Body.Close()
+			got, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, resp.StatusCode, got)
+			}
+			if tt.status == http.StatusOK && !bytes.Equal(got, good) {
+				t.Fatalf("expected the intact pack, got %d bytes", len(got))
+			}
+			if n := requests.Load(); n != 2 {
+				t.Fatalf("expected 2 upstream requests, got %d", n)
+			}
+			wantCorrupt := 0
+			for _, r := range tt.responses {
+				if bytes.Equal(r, corrupt) {
+					wantCorrupt++
+				}
+			}
+			if got := testutil.ToFloat64(metricsRegistry.CorruptPacks.WithLabelValues("upstream")); got != float64(wantCorrupt) {
+				t.Fatalf("expected %d corrupt packs counted, got %v", wantCorrupt, got)
+			}
+		})
+	}
+}
+
+func TestWarmBeforeReady(t *testing.T) {
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	// Upstream holds the critical repo's clone until released
+	release := make(chan struct{})
+	backend := &cgi.Handler{
+		Path: realGit,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + dumbUpstreamRoot(t, "owner", "repo"), "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		backend.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg := &config.Config{
+		AllowedUpstreams: []string{upstreamHost},
+		MirrorDir:        t.TempDir(),
+		SyncStaleAfter:   time.Minute,
+		AuthMode:         "none",
+		LogLevel:         "info",
+		WarmBeforeReady:  []string{upstreamHost + "/owner/repo"},
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	srv := gitproxy.New(cfg, mirrorStore, logger, metricsRegistry)
+	ready := func() int {
+		w := httptest.NewRecorder()
+		srv.ReadyHandler().ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+		return w.Code
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	warmed := make(chan struct{})
+	go func() {
+		srv.WarmBeforeReady(ctx)
+		close(warmed)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while the critical repo is cloning, got %d", code)
+	}
+
+	close(release)
+	select {
+	case <-warmed:
+	case <-time.After(30 * time.Second):
+		t.Fatalf("critical repo not warmed")
+	}
+	if code := ready(); code != http.StatusOK {
+		t.Fatalf("expected 200 once warmed, got %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(mirrorStore.RepoPath(upstreamHost, "owner", "repo"), "HEAD")); err != nil {
+		t.Fatalf("expected the critical repo mirrored before ready: %v", err)
+	}
+
+	// Without critical repos, the proxy is ready right away
+	cfg.WarmBeforeReady = nil
+	srv = gitproxy.New(cfg, mirrorStore, logger, metricsRegistry)
+	if code := ready(); code != http.StatusOK {
+		t.Fatalf("expected 200 without repos to warm, got %d", code)
+	}
+}
+
+func TestUploadArchive(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+	git := func(dir string, args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com", "GIT_TERMINAL_PROMPT=0")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	root := dumbUpstreamRoot(t, "owner", "repo")
+	bare := filepath.Join(root, "owner", "repo.git")
+	work := filepath.Join(t.TempDir(), "work")
+	git(t.TempDir(), "clone", "-q", bare, work)
+	if err := os.WriteFile(filepath.Join(work, "README"), []byte("hello\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	git(work, "add", "README")
+	git(work, "commit", "-q", "-m", "readme")
+	git(work, "push", "-q", "origin", "main")
+	git(bare, "update-server-info")
+	upstream := httptest.NewTLSServer(http.FileServer(http.Dir(root)))
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg := &config.Config{
+		AllowedUpstreams:    []string{upstreamHost},
+		MirrorDir:           t.TempDir(),
+		SyncStaleAfter:      time.Minute,
+		AuthMode:            "none",
+		LogLevel:            "info",
+		AllowUploadArchive:  true,
+		CacheUploadArchives: true,
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+	defer ts.Close()
+	repoURL := ts.URL + "/" + upstreamHost + "/owner/repo.git"
+
+	// What git archive --remote sends: its arguments, then a flush
+	archiveWith := func(header http.Header, args ...string) (*http.Response, []byte) {
+		t.Helper()
+		var body strings.Builder
+		for _, arg := range args {
+			line := "argument " + arg + "\n"
+			fmt.Fprintf(&body, "%04x%s", len(line)+4, line)
+		}
+		body.WriteString("0000")
+		req, _ := http.NewRequest(http.MethodPost, repoURL+"/git-upload-archive", strings.NewReader(body.String()))
+		maps.Copy(req.Header, header)
+		req.Header.Set("Content-Type", "application/x-git-upload-archive-request")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("upload-archive: %v", err)
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("read upload-archive response: %v", err)
+		}
+		return resp, data
+	}
+	archive := func(args ...string) (*http.Response, []byte) {
+		t.Helper()
+		return archiveWith(nil, args...)
+	}
+	// The tar archive in an upload-archive response: an ACK, a flush, then
+	// the archive on sideband 1
+	untar := func(data []byte) map[string]string {
+		t.Helper()
+		var tarData bytes.Buffer
+		for i := 0; len(data) > 0; i++ {
+			n, err := strconv.ParseUint(string(data[:4]), 16, 16)
+			if err != nil {
+				t.Fatalf("invalid pkt-line in %q", data)
+			}
+			if n == 0 {
+				data = data[4:]
+				continue
+			}
+			line := data[4:n]
+			data = data[n:]
+			switch {
+			case i == 0:
+				if string(line) != "ACK\n" {
+					t.Fatalf("expected ACK, got %q", line)
+				}
+			case line[0] == 1:
+				tarData.Write(line[1:])
+			case line[0] == 3:
+				t.Fatalf("upload-archive error: %s", line[1:])
+			}
+		}
+		files := map[string]string{}
+		tr := tar.NewReader(&tarData)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return files
+			}
+			if err != nil {
+				t.Fatalf("read tar: %v", err)
+			}
+			content, _ := io.ReadAll(tr)
+			files[hdr.Name] = string(content)
+		}
+	}
+
+	resp, data := archive("--format=tar", "--prefix=repo/", "main")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-git-upload-archive-result" {
+		t.Fatalf("expected an upload-archive result, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if files := untar(data); files["repo/README"] != "hello\n" {
+		t.Fatalf("expected README in the archive, got %v", files)
+	}
+	// Replayed from the cache the second time
+	resp, cached := archive("--format=tar", "--prefix=repo/", "main")
+	if got := resp.Header.Get("X-Git-Proxy-Status"); got != string(mirror.StatusArchiveHit) {
+		t.Fatalf("expected %s, got %q", mirror.StatusArchiveHit, got)
+	}
+	if !bytes.Equal(cached, data) {
+		t.Fatalf("expected the cached archive to match the first one")
+	}
+	// Cached archives are served in ranges, so downloads can be resumed
+	ranged := func(ranges, ifRange string) (*http.Response, []byte) {
+		t.Helper()
+		header := http.Header{"Range": {ranges}}
+		if ifRange != "" {
+			header.Set("If-Range", ifRange)
+		}
+		return archiveWith(header, "--format=tar", "--prefix=repo/", "main")
+	}
+	resp, part := ranged("bytes=10-19", resp.Header.Get("ETag"))
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Range") != fmt.Sprintf("bytes 10-19/%d", len(data)) || !bytes.Equal(part, data[10:20]) {
+		t.Fatalf("expected bytes 10-19 of %d, got %d %q: %q", len(data), resp.StatusCode, resp.Header.Get("Content-Range"), part)
+	}
+	if resp, part = ranged("bytes=-5", ""); resp.StatusCode != http.StatusPartialContent || !bytes.Equal(part, data[len(data)-5:]) {
+		t.Fatalf("expected the last 5 bytes, got %d %q", resp.StatusCode, part)
+	}
+	resp, part = ranged("bytes=0-3,10-13", "")
+	mediaType, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusPartialContent || mediaType != "multipart/byteranges" {
+		t.Fatalf("expected a multipart response, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(bytes.NewReader(part), params["boundary"])
+	for _, want := range [][2]int{{0, 4}, {10, 14}} {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("read part: %v", err)
+		}
+		got, _ := io.ReadAll(p)
+		if p.Header.Get("Content-Range") != fmt.Sprintf("bytes %d-%d/%d", want[0], want[1]-1, len(data)) || !bytes.Equal(got, data[want[0]:want[1]]) {
+			t.Fatalf("expected bytes %v, got %q: %q", want, p.Header.Get("Content-Range"), got)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Fatalf("expected two parts, got %v", err)
+	}
+	if resp, _ = ranged(fmt.Sprintf("bytes=%d-", len(data)), ""); resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("expected 416 past the end, got %d", resp.StatusCode)
+	}
+	// Archives generated for the request are sent whole
+	if resp, part = archiveWith(http.Header{"Range": {"bytes=10-19"}}, "--format=tar", "--prefix=other/", "main"); resp.StatusCode != http.StatusOK || untar(part)["other/README"] != "hello\n" {
+		t.Fatalf("expected a whole generated archive, got %d", resp.StatusCode)
+	}
+	// A download resumed from another archive starts over
+	if resp, part = ranged("bytes=10-19", `"stale"`); resp.StatusCode != http.StatusOK || !bytes.Equal(part, data) {
+		t.Fatalf("expected the whole archive for a stale If-Range, got %d", resp.StatusCode)
+	}
+	// Only ref names can be archived, also when the commit is cached
+	if _, data := archive("--format=tar", "--prefix=repo/", git(bare, "rev-parse", "main")); !bytes.Contains(data, []byte("no such ref")) {
+		t.Fatalf("expected upload-archive to refuse a commit SHA, got %q", data)
+	}
+
+	// git archive --remote speaks it over HTTP since git 2.44
+	version := strings.TrimPrefix(git(t.TempDir(), "version"), "git version ")
+	var major, minor int
+	fmt.Sscanf(version, "%d.%d", &major, &minor)
+	if major > 2 || (major == 2 && minor >= 44) {
+		out := filepath.Join(t.TempDir(), "archive.tar")
+		git(t.TempDir(), "archive", "--remote="+repoURL, "-o", out, "main", "README")
+		if f, err := os.ReadFile(out); err != nil || !bytes.Contains(f, []byte("hello\n")) {
+			t.Fatalf("expected git archive --remote to fetch README, got %v", err)
+		}
+	}
+
+	// Refused unless allowed
+	cfg.AllowUploadArchive = false
+	if resp, _ := archive("--format=tar", "main"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected upload-archive refused when not allowed, got %d", resp.StatusCode)
+	}
+}
+
+func TestEmptyRepo(t *testing.T) {
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	// Smart HTTP upstream with an empty repo whose HEAD is an unborn branch
+	root := t.TempDir()
+	bare := filepath.Join(root, "owner", "empty.git")
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q", "--bare", "-b", "trunk", bare)
+	backend := &cgi.Handler{
+		Path: realGit,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	upstream := httptest.NewTLSServer(backend)
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg := &config.Config{
+		AllowedUpstreams: []string{upstreamHost},
+		MirrorDir:        t.TempDir(),
+		// Only empty mirrors are synced again
+		SyncStaleAfter: time.Hour,
+		SyncEmptyRepos: true,
+		HeadRequests:   "upstream",
+		AuthMode:       "none",
+		LogLevel:       "info",
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+	defer ts.Close()
+	repoURL := ts.URL + "/" + upstreamHost + "/owner/empty.git"
+
+	// Listing no refs doesn't make upstream's answer a failure
+	resp, err := http.Head(repoURL + "/info/refs?service=git-upload-pack")
+	if err != nil {
+		t.Fatalf("HEAD info/refs: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for an empty upstream repo, got %d", resp.StatusCode)
+	}
+
+	for _, proto := range []string{"2", "0", "2"} {
+		out := git("-c", "protocol.version="+proto, "clone", repoURL, filepath.Join(t.TempDir(), "clone"))
+		mirrorStore.Wait()
+		if !strings.Contains(out, "You appear to have cloned an empty repository") {
+			t.Fatalf("expected protocol v%s clone to warn about an empty repo, got %s", proto, out)
+		}
+	}
+	// Protocol v2 advertises the unborn branch, from the mirror's HEAD
+	dir := filepath.Join(t.TempDir(), "clone")
+	git("clone", "-q", repoURL, dir)
+	if got := git("-C", dir, "symbolic-ref", "HEAD"); got != "refs/heads/trunk" {
+		t.Fatalf("expected clone on upstream's unborn branch, got %s", got)
+	}
+
+	// The first push is served right away, later ones once the mirror is stale
+	work := filepath.Join(t.TempDir(), "work")
+	push := func(msg string) string {
+		t.Helper()
+		git("-C", dir, "commit", "-q", "--allow-empty", "-m", msg)
+		git("-C", dir, "push", "-q", bare, "trunk")
+		return git("-C", dir, "rev-parse", "HEAD")
+	}
+	first := push("first")
+	git("clone", "-q", repoURL, work)
+	mirrorStore.Wait()
+	if got := git("-C", work, "rev-parse", "HEAD"); got != first {
+		t.Fatalf("expected first push %s served, got %s", first, got)
+	}
+	push("second")
+	git("-C", work, "pull", "-q")
+	if got := git("-C", work, "rev-parse", "HEAD"); got != first {
+		t.Fatalf("expected mirror with refs kept until stale at %s, got %s", first, got)
+	}
+}
+
+func TestGitDaemon(t *testing.T) {
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	root := t.TempDir()
+	bare := filepath.Join(root, "owner", "repo.git")
+	git := func(args ...string) (string, error) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		return strings.TrimSpace(string(out)), err
+	}
+	mustGit := func(args ...string) string {
+		t.Helper()
+		out, err := git(args...)
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return out
+	}
+	work := t.TempDir()
+	mustGit("init", "-q", "-b", "main", work)
+	if err := os.WriteFile(filepath.Join(work, "README"), []byte("hello\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	mustGit("-C", work, "add", "README")
+	mustGit("-C", work, "commit", "-q", "-m", "initial")
+	mustGit("clone", "-q", "--bare", work, bare)
+	backend := &cgi.Handler{
+		Path: realGit,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	upstream := httptest.NewTLSServer(backend)
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg := &config.Config{
+		AllowedUpstreams: []string{upstreamHost},
+		MirrorDir:        t.TempDir(),
+		SyncStaleAfter:   time.Hour,
+		EnableGitDaemon:  true,
+		AuthMode:         "none",
+		LogLevel:         "info",
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).ServeDaemon(ln) }()
+	defer func() {
+		ln.Close()
+		if err := <-done; err != nil {
+			t.Errorf("serve daemon: %v", err)
+		}
+	}()
+	daemonURL := "git://" + ln.Addr().String() + "/"
+	want := mustGit("-C", bare, "rev-parse", "main")
+
+	// Both protocol versions clone through the mirror
+	for _, version := range []string{"2", "0"} {
+		dest := filepath.Join(t.TempDir(), "clone")
+		mustGit("-c", "protocol.version="+version, "clone", "-q", daemonURL+upstreamHost+"/owner/repo.git", dest)
+		if got := mustGit("-C", dest, "rev-parse", "HEAD"); got != want {
+			t.Fatalf("protocol v%s: expected HEAD %s, got %s", version, want, got)
+		}
+	}
+	if _, err := os.Stat(mirrorStore.RepoPath(upstreamHost, "owner", "repo")); err != nil {
+		t.Fatalf("expected the repo mirrored: %v", err)
+	}
+	if out := mustGit("ls-remote", daemonURL+upstreamHost+"/owner/repo"); !strings.Contains(out, want+"\trefs/heads/main") {
+		t.Fatalf("unexpected ls-remote output %q", out)
+	}
+	if out := mustGit("ls-remote", daemonURL+upstreamHost+"//owner/repo/"); !strings.Contains(out, want+"\trefs/heads/main") {
+		t.Fatalf("unexpected ls-remote output %q for a path with empty segments", out)
+	}
+
+	// Refusals reach clients as remote errors
+	for path, msg := range map[string]string{
+		"example.com/owner/repo.git": "not in allowed list",
+		"owner/repo.git":             "invalid repo path",
+	} {
+		out, err := git("ls-remote", daemonURL+path)
+		if err == nil || !strings.Contains(out, "remote error") || !strings.Contains(out, msg) {
+			t.Fatalf("expected remote error %q for %s, got %v: %s", msg, path, err, out)
+		}
+	}
+	// Pushes aren't served
+	out, err := git("-C", work, "push", daemonURL+upstreamHost+"/owner/repo.git", "main:other")
+	if err == nil || !strings.Contains(out, "not allowed") {
+		t.Fatalf("expected push refused, got %v: %s", err, out)
+	}
+}
+
+func TestFilterBlobsOver(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	upstream := newDumbUpstream(t, "owner", "repo")
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg := &config.Config{
+		AllowedUpstreams: []string{upstreamHost},
+		MirrorDir:        t.TempDir(),
+		SyncStaleAfter:   time.Minute,
+		AuthMode:         "none",
+		LogLevel:         "info",
+		FilterBlobsOver:  config.SizeSpec{Bytes: 1},
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+	defer ts.Close()
+
+	repoURL := ts.URL + "/" + upstreamHost + "/owner/repo.git"
+	cloneDir := t.TempDir()
+	cmd := exec.Command("git", "clone", "--bare", "--filter=blob:limit=1m", repoURL, filepath.Join(cloneDir, "partial"))
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("partial clone failed: %v\noutput: %s", err, out)
+	}
+	if out, err := exec.Command("git", "-C", filepath.Join(cloneDir, "partial"), "config", "remote.origin.promisor").Output(); err != nil || strings.TrimSpace(string(out)) != "true" {
+		t.Fatalf("expected a partial clone: %v %s", err, out)
+	}
+
+	// Dumb HTTP would hand out mirror packs as they are
+	cmd = exec.Command("git", "clone", repoURL, filepath.Join(cloneDir, "dumb"))
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_SMART_HTTP=0")
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Fatalf("expected dumb clone to be refused\noutput: %s", out)
+	}
+}
+
+func TestDirectClones(t *testing.T) {
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	// Smart HTTP upstream counting the ref advertisements it sends
+	var infoRefs atomic.Int32
+	backend := &cgi.Handler{
+		Path: realGit,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + dumbUpstreamRoot(t, "owner", "repo"), "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/info/refs") {
+			infoRefs.Add(1)
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg := &config.Config{
+		AllowedUpstreams:  []string{upstreamHost},
+		MirrorDir:         t.TempDir(),
+		SyncStaleAfter:    time.Minute,
+		AuthMode:          "none",
+		LogLevel:          "info",
+		DiskFullFallback:  "fail",
+		DirectInfoRefsTTL: time.Minute,
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+	defer ts.Close()
+
+	clone := func(args ...string) {
+		t.Helper()
+		args = append(args, "clone", "-q", ts.URL+"/"+upstreamHost+"/owner/repo.git", filepath.Join(t.TempDir(), "clone"))
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("clone %v failed: %v\n%s", args, err, out)
+		}
+	}
+	mirrored := func() bool {
+		_, err := os.Stat(mirrorStore.RepoPath(upstreamHost, "owner", "repo"))
+		return err == nil
+	}
+	fetches := func(mode string) float64 {
+		return testutil.ToFloat64(metricsRegistry.PackFetches.WithLabelValues(mode))
+	}
+
+	// Asked for by the client, for both protocol versions
+	for _, version := range []string{"1", "2"} {
+		clone("-c", "protocol.version="+version, "-c", "http.extraHeader=X-Git-Proxy-Direct: 1")
+	}
+	if mirrored() {
+		t.Fatal("expected direct clones to leave no mirror")
+	}
+	if fetches("direct") == 0 || fetches("mirrored") != 0 {
+		t.Fatalf("expected only direct fetches, got %v direct, %v mirrored", fetches("direct"), fetches("mirrored"))
+	}
+	// The advertisement is kept for DirectInfoRefsTTL
+	seen := infoRefs.Load()
+	clone("-c", "protocol.version=2", "-c", "http.extraHeader=X-Git-Proxy-Direct: 1")
+	if got := infoRefs.Load(); got != seen {
+		t.Fatalf("expected info/refs served from memory, upstream sent %d more", got-seen)
+	}
+	// Query parameters git doesn't use don't make for another advertisement
+	for _, query := range []string{"x=1", "x=2"} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/"+upstreamHost+"/owner/repo.git/info/refs?service=git-upload-pack&"+query, nil)
+		req.Header.Set("X-Git-Proxy-Direct", "1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("info/refs: %v", err)
+		}
+		resp.Body.Close()
+	}
+	if got := infoRefs.Load(); got != seen+1 {
+		t.Fatalf("expected info/refs fetched once for both queries, upstream sent %d", got-seen)
+	}
+
+	// Configured for the repo
+	cfg.DirectRepos = config.RepoPatterns{regexp.MustCompile(`^.*/owner/repo$`)}
+	clone()
+	if mirrored() {
+		t.Fatal("expected clone of a direct repo to leave no mirror")
+	}
+
+	// Repos already mirrored are served from their mirror
+	cfg.DirectRepos = nil
+	clone()
+	if !mirrored() {
+		t.Fatal("expected clone to mirror the repo")
+	}
+	before := fetches("direct")
+	clone("-c", "http.extraHeader=X-Git-Proxy-Direct: 1")
+	if fetches("direct") != before || fetches("mirrored") == 0 {
+		t.Fatalf("expected mirrored fetches only once mirrored, got %v direct, %v mirrored", fetches("direct")-before, fetches("mirrored"))
+	}
+}
+
+func TestAdminTopRepos(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	upstream := newDumbUpstream(t, "owner", "repo")
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg := &config.Config{
+		AllowedUpstreams: []string{upstreamHost},
+		MirrorDir:        t.TempDir(),
+		SyncStaleAfter:   time.Hour,
+		AuthMode:         "none",
+		LogLevel:         "info",
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	server := gitproxy.New(cfg, mirrorStore, logger, metricsRegistry)
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+	admin := httptest.NewServer(server.AdminHandler())
+	defer admin.Close()
+
+	// The first clone misses, the second one is served from the mirror
+	repoKey := upstreamHost + "/owner/repo"
+	for range 2 {
+		cmd := exec.Command("git", "clone", "-q", ts.URL+"/"+repoKey+".git", filepath.Join(t.TempDir(), "clone"))
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("clone failed: %v\n%s", err, out)
+		}
+	}
+	metricsRegistry.CacheMisses.WithLabelValues("github.com/acme/busy", "info").Add(5)
+	metricsRegistry.CacheMisses.WithLabelValues("github.com/acme/busy", "pack").Add(2)
+	metricsRegistry.CacheMisses.WithLabelValues("github.com/acme/quiet", "info").Add(1)
+
+	type top struct {
+		By    string
+		Repos []struct {
+			Repo  string
+			Count float64
+		}
+	}
+	get := func(query string) (int, top) {
+		t.Helper()
+		resp, err := http.Get(admin.URL + "/admin/metrics/repos" + query)
+		if err != nil {
+			t.Fatalf("get %s: %v", query, err)
+		}
+		defer resp.Body.Close()
+		var body top
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("decode %s: %v", query, err)
+			}
+		}
+		return resp.StatusCode, body
+	}
+
+	code, body := get("?by=misses&limit=2")
+	if code != http.StatusOK || body.By != "misses" || len(body.Repos) != 2 {
+		t.Fatalf("expected the top 2 repos by misses, got %d %+v", code, body)
+	}
+	if body.Repos[0].Repo != "github.com/acme/busy" || body.Repos[0].Count != 7 {
+		t.Fatalf("expected busy repo first with its misses summed, got %+v", body.Repos[0])
+	}
+	if body.Repos[1].Repo != repoKey || body.Repos[1].Count != 1 {
+		t.Fatalf("expected the cloned repo's info/refs miss second, got %+v", body.Repos[1])
+	}
+
+	code, body = get("")
+	if code != http.StatusOK || body.By != "requests" || len(body.Repos) != 1 || body.Repos[0].Repo != repoKey || body.Repos[0].Count < 4 {
+		t.Fatalf("expected requests of the cloned repo by default, got %d %+v", code, body)
+	}
+
+	for _, query := range []string{"?by=bytes", "?limit=0", "?limit=1001", "?limit=ten"} {
+		if code, _ := get(query); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, code)
+		}
+	}
+}
+
+func TestClientDisconnectMidPack(t *testing.T) {
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	// Smart HTTP upstream with a pack far larger than socket buffers
+	root := t.TempDir()
+	work := filepath.Join(t.TempDir(), "work")
+	git("init", "-q", "-b", "main", work)
+	large := make([]byte, 16<<20)
+	rand.Read(large)
+	if err := os.WriteFile(filepath.Join(work, "large"), large, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	git("-C", work, "add", "large")
+	git("-C", work, "-c", "core.compression=0", "commit", "-q", "-m", "large")
+	git("clone", "-q", "--bare", work, filepath.Join(root, "owner", "repo.git"))
+	head := git("-C", work, "rev-parse", "HEAD")
+	upstream := httptest.NewTLSServer(&cgi.Handler{
+		Path: realGit,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	})
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg := &config.Config{
+		AllowedUpstreams: []string{upstreamHost},
+		MirrorDir:        t.TempDir(),
+		SyncStaleAfter:   time.Hour,
+		AuthMode:         "none",
+		LogLevel:         "info",
+		CachePinnedPacks: true,
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+	defer ts.Close()
+
+	repoURL := ts.URL + "/" + upstreamHost + "/owner/repo.git"
+	resp, err := http.Get(repoURL + "/info/refs?service=git-upload-pack")
+	if err != nil {
+		t.Fatalf("info/refs: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	repoPath := mirrorStore.RepoPath(upstreamHost, "owner", "repo")
+	pinned := filepath.Join(repoPath, "pinned-packs")
+
+	// A fetch of the pinned commit, which the proxy records for replay
+	want := "want " + head + " ofs-delta\n"
+	body := fmt.Sprintf("%04x%s0000%04xdone\n", len(want)+4, want, len("done\n")+4)
+
+	// The client reads the start of the pack, then goes away
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	fmt.Fprintf(conn, "POST /%s/owner/repo.git/git-upload-pack HTTP/1.1\r\nHost: proxy\r\nContent-Type: application/x-git-upload-pack-request\r\nContent-Length: %d\r\n\r\n%s", upstreamHost, len(body), body)
+	if _, err := io.ReadFull(conn, make([]byte, 64<<10)); err != nil {
+		t.Fatalf("read start of response: %v", err)
+	}
+	conn.Close()
+	aborts := metricsRegistry.ClientAborts.WithLabelValues(string(gitproxy.KindPack))
+	for deadline := time.Now().Add(10 * time.Second); testutil.ToFloat64(aborts) != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the aborted transfer to be counted")
+		}
+	}
+
+	// Nothing of the partial pack is kept, and the mirror is intact
+	if entries, _ := os.ReadDir(pinned); len(entries) != 0 {
+		t.Fatalf("expected no pinned pack kept from the aborted transfer, got %v", entries)
+	}
+	git("-C", repoPath, "fsck", "--no-progress")
+
+	// A complete transfer is recorded
+	resp, err = http.Post(repoURL+"/git-upload-pack", "application/x-git-upload-pack-request", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("upload-pack: %v", err)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil || n < int64(len(large)) {
+		t.Fatalf("expected the whole pack, got %d bytes (%v)", n, err)
+	}
+	if entries, _ := os.ReadDir(pinned); len(entries) != 1 || !strings.HasSuffix(entries[0].Name(), ".pack") {
+		t.Fatalf("expected the complete pack kept, got %v", entries)
+	}
+	if got := testutil.ToFloat64(aborts); got != 1 {
+		t.Fatalf("expected only the first transfer counted as aborted, got %v", got)
+	}
+}
+
+func TestAdminRepoListings(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	upstream := newDumbUpstream(t, "owner", "repo")
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg := &config.Config{
+		AllowedUpstreams: []string{upstreamHost},
+		MirrorDir:        t.TempDir(),
+		SyncStaleAfter:   time.Hour,
+		AuthMode:         "none",
+		LogLevel:         "info",
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	metricsRegistry := metrics.NewUnregistered()
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).AdminHandler())
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/admin/refresh/"+upstreamHost+"/owner/repo", "", nil)
+	if err != nil {
+		t.Fatalf("refresh request: %v", err)
+	}
+	var res mirror.RefreshResult
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected refresh to clone, got %d (%v)", resp.StatusCode, err)
+	}
+	repoPath := mirrorStore.RepoPath(upstreamHost, "owner", "repo")
+	tag := exec.Command("git", "-C", repoPath, "tag", "v1", "HEAD")
+	if out, err := tag.CombinedOutput(); err != nil {
+		t.Fatalf("git tag: %v\n%s", err, out)
+	}
+	get := func(path string, v any) {
+		t.Helper()
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+			t.Fatalf("GET %s: got %d %s", path, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("GET %s: decode: %v", path, err)
+		}
+	}
+
+	var refs struct{ Refs []mirror.RefInfo }
+	get("/admin/repo/"+upstreamHost+"/owner/repo.git/refs", &refs)
+	want := []mirror.RefInfo{
+		{Ref: "refs/heads/main", SHA: res.HeadSHA, Type: "commit"},
+		{Ref: "refs/tags/v1", SHA: res.HeadSHA, Type: "commit"},
+	}
+	if !slices.Equal(refs.Refs, want) {
+		t.Fatalf("expected refs %+v, got %+v", want, refs.Refs)
+	}
+	get("/admin/repo/"+upstreamHost+"/owner/repo/refs?prefix=refs/tags/", &refs)
+	if !slices.Equal(refs.Refs, want[1:]) {
+		t.Fatalf("expected only tags, got %+v", refs.Refs)
+	}
+
+	var packs struct {
+		Packs []mirror.PackInfo
+		Size  int64
+	}
+	get("/admin/repo/"+upstreamHost+"/owner/repo/packs", &packs)
+	entries, _ := filepath.Glob(filepath.Join(repoPath, "objects", "pack", "*.pack"))
+	if len(packs.Packs) != len(entries) || len(entries) == 0 {
+		t.Fatalf("expected %d packs listed, got %+v", len(entries), packs)
+	}
+	var size int64
+	for _, p := range packs.Packs {
+		info, err := os.Stat(filepath.Join(repoPath, "objects", "pack", p.Name))
+		if err != nil || info.Size() != p.Size || p.ModTime.IsZero() {
+			t.Fatalf("pack %+v doesn't match the mirror's (%v)", p, err)
+		}
+		size += p.Size
+	}
+	if packs.Size != size {
+		t.Fatalf("expected total size %d, got %d", size, packs.Size)
+	}
+
+	// Listings are read-only and fail like the other repo endpoints
+	for _, tt := range []struct {
+		method, path string
+		status       int
+		code         string
+	}{
+		{http.MethodGet, "/admin/repo/" + upstreamHost + "/owner/missing/refs", http.StatusNotFound, gitproxy.CodeRepoNotFound},
+		{http.MethodGet, "/admin/repo/" + upstreamHost + "/owner/missing/packs", http.StatusNotFound, gitproxy.CodeRepoNotFound},
+		{http.MethodGet, "/admin/repo/example.com/owner/repo/packs", http.StatusBadRequest, gitproxy.CodeUpstreamNotAllowed},
+		{http.MethodGet, "/admin/repo/" + upstreamHost + "/owner/repo/refs?prefix=--all", http.StatusBadRequest, gitproxy.CodeInvalidRequest},
+		{http.MethodPost, "/admin/repo/" + upstreamHost + "/owner/repo/refs", http.StatusMethodNotAllowed, gitproxy.CodeMethodNotAllowed},
+		{http.MethodDelete, "/admin/repo/" + upstreamHost + "/owner/repo/packs", http.StatusMethodNotAllowed, gitproxy.CodeMethodNotAllowed},
+	} {
+		req, _ := http.NewRequest(tt.method, ts.URL+tt.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.method, tt.path, err)
+		}
+		var body struct{ Code string }
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != tt.status || body.Code != tt.code {
+			t.Errorf("%s %s: got %d %+v (%v), want %d %s", tt.method, tt.path, resp.StatusCode, body, err, tt.status, tt.code)
+		}
+	}
+}
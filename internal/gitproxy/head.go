@@ -0,0 +1,49 @@
+package gitproxy
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+// headInfoRefs answers a HEAD request for info/refs, as monitoring tools send
+// to check a repo exists, without building the advertisement or updating the
+// mirror: 200 with the headers a GET would get if the repo is mirrored (or,
+// with HeadRequests "upstream", served by upstream), 404 otherwise. Private
+// mirrors are checked against upstream like for a GET.
+func (s *Server) headInfoRefs(w http.ResponseWriter, r *http.Request, host, owner, repo, repoKey, upstreamURL, authHeader string, dumb bool, start time.Time) {
+	d := decisionFrom(r.Context())
+	code := http.StatusOK
+	var status mirror.Status
+	if _, err := os.Stat(s.mirror.RepoPath(host, owner, repo)); err == nil {
+		if err := s.mirror.CheckAccess(r.Context(), host, owner, repo, upstreamURL, authHeader); err != nil {
+			code = http.StatusNotFound
+		} else {
+			status = mirror.StatusHit
+			d.mirrored(status)
+		}
+	} else if s.config().HeadRequests == "upstream" && s.mirror.Probe(r.Context(), upstreamURL, authHeader) == nil {
+		status = mirror.StatusPassthrough
+		d.status, d.source = status, sourceUpstream
+	} else {
+		code = http.StatusNotFound
+	}
+
+	if code == http.StatusOK {
+		contentType := "application/x-git-upload-pack-advertisement"
+		if dumb {
+			contentType = "text/plain; charset=utf-8"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("X-Git-Proxy-Status", string(status))
+		if cc := s.cacheControl(r, host, owner, repo); cc != "" {
+			w.Header().Set("Cache-Control", cc)
+		}
+	}
+	w.WriteHeader(code)
+	s.logRequest(r, start, code, "repo", repoKey, "status", status)
+	s.metrics.ResponsesTotal.WithLabelValues(repoKey, string(KindInfo), strconv.Itoa(code)).Inc()
+}
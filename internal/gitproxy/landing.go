@@ -0,0 +1,66 @@
+package gitproxy
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/crohr/smart-git-proxy/internal/version"
+)
+
+// errNotGitPath is wrapped by resolveTarget errors for paths that aren't git
+// endpoints at all, as opposed to git requests the proxy refuses.
+var errNotGitPath = errors.New("not a git endpoint")
+
+// pathHelp explains the URLs the proxy serves, for people hitting wrong ones.
+const pathHelp = `Git repos are served at /{host}/{owner}/{repo}.git, e.g.:
+
+  git clone %[1]s/github.com/owner/repo.git
+
+or, to route all clones of a host through the proxy:
+
+  git config --global url."%[1]s/github.com/".insteadOf https://github.com/
+`
+
+// serveLanding answers GET / with LandingPageFile if configured, or a short
+// description of the proxy and how to use it.
+func (s *Server) serveLanding(w http.ResponseWriter, r *http.Request) {
+	if file := s.config().LandingPageFile; file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			s.log.Error("read landing page failed", "err", err, "file", file)
+			http.Error(w, "landing page unavailable", http.StatusInternalServerError)
+			return
+		}
+		contentType := mime.TypeByExtension(filepath.Ext(file))
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
+		}
+		w.Header().Set("Content-Type", contentType)
+		_, _ = w.Write(data)
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "smart-git-proxy %s\n\n", version.Get().Version)
+	b.WriteString("A caching proxy for git clones and fetches: repos are mirrored from upstream and served from local disk.\n\n")
+	fmt.Fprintf(&b, pathHelp, s.externalBaseURL(r))
+	fmt.Fprintf(&b, "\nAllowed upstream hosts: %s\n", strings.Join(s.config().AllowedUpstreams, ", "))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte(b.String()))
+}
+
+// notGitPath answers requests for paths that aren't git endpoints with a 404
+// pointing at the expected layout.
+func (s *Server) notGitPath(w http.ResponseWriter, r *http.Request, err error) {
+	s.log.Debug("not a git path", "err", err, "path", r.URL.Path)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, "%v\n\n", err)
+	fmt.Fprintf(w, pathHelp, s.externalBaseURL(r))
+}
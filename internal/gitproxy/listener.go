@@ -0,0 +1,116 @@
+package gitproxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+)
+
+// errSlowClient is returned by writes to clients receiving slower than the
+// configured minimum rate, after their connection has been closed.
+var errSlowClient = errors.New("client receiving below minimum rate")
+
+// NewListener wraps the git listener to count open connections and, as
+// configured, cap them at cfg.MaxConnections and disconnect clients receiving
+// slower than cfg.MinClientRate. Like netutil.LimitListener, Accept waits for
+// a connection to close once the cap is reached, leaving new ones in the
+// kernel backlog.
+func NewListener(l net.Listener, cfg *config.Config, m *metrics.Metrics) net.Listener {
+	ll := &listener{Listener: l, metrics: m, minRate: cfg.MinClientRate, window: cfg.SlowClientWindow, done: make(chan struct{})}
+	if cfg.MaxConnections > 0 {
+		ll.sem = make(chan struct{}, cfg.MaxConnections)
+	}
+	return ll
+}
+
+type listener struct {
+	net.Listener
+	metrics *metrics.Metrics
+	sem     chan struct{} // one slot per open connection, nil when unlimited
+	minRate int64
+	window  time.Duration
+
+	done      chan struct{} // closed with the listener, to stop waiting for a slot
+	closeOnce sync.Once
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	if l.sem != nil {
+		select {
+		case l.sem <- struct{}{}:
+		case <-l.done:
+			return nil, net.ErrClosed
+		}
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		if l.sem != nil {
+			<-l.sem
+		}
+		return nil, err
+	}
+	l.metrics.Connections.Inc()
+	return &conn{Conn: c, l: l}, nil
+}
+
+func (l *listener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+// conn releases its listener slot once closed and enforces the minimum
+// receive rate: only time spent blocked writing to the client counts, so
+// waiting on git or idling between requests is never held against it.
+type conn struct {
+	net.Conn
+	l         *listener
+	closeOnce sync.Once
+
+	spent time.Duration // time blocked in writes during the current window
+	sent  int64         // bytes written during the current window
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	if c.l.minRate <= 0 {
+		return c.Conn.Write(p)
+	}
+	total := 0
+	for {
+		// Give up on the write where the current window ends, to check the rate
+		start := time.Now()
+		_ = c.Conn.SetWriteDeadline(start.Add(c.l.window - c.spent))
+		n, err := c.Conn.Write(p[total:])
+		total += n
+		c.spent += time.Since(start)
+		c.sent += int64(n)
+		if c.spent >= c.l.window {
+			if float64(c.sent) < float64(c.l.minRate)*c.spent.Seconds() {
+				c.l.metrics.SlowClientsClosed.Inc()
+				c.Close()
+				return total, errSlowClient
+			}
+			c.spent, c.sent = 0, 0
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) && total < len(p) {
+			continue
+		}
+		return total, err
+	}
+}
+
+func (c *conn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.l.metrics.Connections.Dec()
+		if c.l.sem != nil {
+			<-c.l.sem
+		}
+	})
+	return err
+}
@@ -0,0 +1,136 @@
+package gitproxy_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/gitproxy"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+)
+
+func newTestListener(t *testing.T, cfg *config.Config) (net.Listener, *metrics.Metrics) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	m := metrics.NewUnregistered()
+	l := gitproxy.NewListener(ln, cfg, m)
+	t.Cleanup(func() { l.Close() })
+	return l, m
+}
+
+func TestListenerMaxConnections(t *testing.T) {
+	l, m := newTestListener(t, &config.Config{MaxConnections: 1, SlowClientWindow: time.Second})
+
+	for range 2 {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer c.Close()
+	}
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	first := <-accepted
+	if got := testutil.ToFloat64(m.Connections); got != 1 {
+		t.Fatalf("expected 1 open connection, got %v", got)
+	}
+	select {
+	case <-accepted:
+		t.Fatalf("expected second connection to wait for a free slot")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	first.Close()
+	first.Close() // closing twice must not free two slots
+	select {
+	case second := <-accepted:
+		defer second.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected second connection to be accepted once the first closed")
+	}
+	if got := testutil.ToFloat64(m.Connections); got != 1 {
+		t.Fatalf("expected 1 open connection, got %v", got)
+	}
+}
+
+func TestListenerSlowClient(t *testing.T) {
+	const window = 200 * time.Millisecond
+	l, m := newTestListener(t, &config.Config{MinClientRate: 1 << 20, SlowClientWindow: window})
+
+	// serve writes 64MiB to the next client, returning the write's error
+	serve := func() chan error {
+		result := make(chan error, 1)
+		go func() {
+			c, err := l.Accept()
+			if err != nil {
+				result <- err
+				return
+			}
+			defer c.Close()
+			_, err = c.Write(make([]byte, 64<<20))
+			result <- err
+		}()
+		return result
+	}
+
+	// A fast client gets everything
+	result := serve()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if n, err := io.Copy(io.Discard, c); err != nil || n != 64<<20 {
+		t.Fatalf("expected fast client to receive everything, got %d bytes: %v", n, err)
+	}
+	c.Close()
+	if err := <-result; err != nil {
+		t.Fatalf("expected write to a fast client to succeed, got %v", err)
+	}
+
+	// A client reading 1KiB every 50ms (20KiB/s) is disconnected
+	result = serve()
+	c, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := c.Read(buf); err != nil {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Fatalf("expected write to a slow client to fail")
+		}
+	case <-time.After(20 * window):
+		t.Fatalf("expected slow client to be disconnected")
+	}
+	if got := testutil.ToFloat64(m.SlowClientsClosed); got != 1 {
+		t.Fatalf("expected 1 slow client closed, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.Connections); got != 0 {
+		t.Fatalf("expected no open connections, got %v", got)
+	}
+}
@@ -0,0 +1,139 @@
+package gitproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsHandler serves metrics with h, requiring the configured
+// MetricsAuthToken if any. Scrapers present it as a bearer token or as the
+// password of basic auth, with any user name, matching Prometheus'
+// authorization and basic_auth scrape settings. Scrapes are bounded by the
+// metrics RequestTimeouts deadline. With a MetricsCacheTTL, what h renders is
+// reused for the scrapes that follow within it, with an ETag they can send
+// back to be answered 304 Not Modified.
+func (s *Server) MetricsHandler(h http.Handler) http.Handler {
+	cache := &metricsCache{}
+	return s.withTimeout(classMetrics, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.config()
+		if token := cfg.MetricsAuthToken; token != "" && !metricsAuthorized(r, token) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if cfg.MetricsCacheTTL > 0 && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			if snap := cache.get(h, r, cfg.MetricsCacheTTL); snap != nil {
+				snap.serve(w, r)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	}), gatewayTimeout)
+}
+
+// metricsAuthorized reports whether r carries token.
+func metricsAuthorized(r *http.Request, token string) bool {
+	got, ok := "", false
+	if bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		got, ok = bearer, true
+	} else {
+		_, got, ok = r.BasicAuth()
+	}
+	return ok && secretEqual(got, token)
+}
+
+// metricsCache keeps what the metrics handler rendered for MetricsCacheTTL,
+// by the Accept and Accept-Encoding headers the format was negotiated from,
+// so scrapes in quick succession reuse a serialized snapshot instead of
+// gathering every series again.
+type metricsCache struct {
+	mu        sync.Mutex // Held while rendering, so concurrent scrapes wait for one snapshot
+	snapshots map[string]*metricsSnapshot
+}
+
+// metricsSnapshot is a metrics response rendered at a point in time.
+type metricsSnapshot struct {
+	at     time.Time
+	header http.Header
+	body   []byte
+	etag   string
+}
+
+// get returns the snapshot of what h renders for r, rendering it again if the
+// last one is ttl old. Only successful responses are kept: failures, nil, are
+// served by h directly.
+func (c *metricsCache) get(h http.Handler, r *http.Request, ttl time.Duration) *metricsSnapshot {
+	key := r.Header.Get("Accept") + "\x00" + r.Header.Get("Accept-Encoding")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if snap, ok := c.snapshots[key]; ok && time.Since(snap.at) < ttl {
+		return snap
+	}
+	rec := &metricsRecorder{header: http.Header{}}
+	at := time.Now()
+	h.ServeHTTP(rec, r)
+	if rec.status != 0 && rec.status != http.StatusOK {
+		delete(c.snapshots, key)
+		return nil
+	}
+	sum := sha256.Sum256(rec.body.Bytes())
+	snap := &metricsSnapshot{at: at, header: rec.header, body: rec.body.Bytes(), etag: `"` + hex.EncodeToString(sum[:8]) + `"`}
+	if c.snapshots == nil {
+		c.snapshots = map[string]*metricsSnapshot{}
+	}
+	c.snapshots[key] = snap
+	return snap
+}
+
+// serve writes snap as the response to r, or 304 Not Modified if the client
+// already has it.
+func (snap *metricsSnapshot) serve(w http.ResponseWriter, r *http.Request) {
+	maps.Copy(w.Header(), snap.header)
+	w.Header().Set("ETag", snap.etag)
+	if etagMatches(r.Header.Get("If-None-Match"), snap.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	_, _ = w.Write(snap.body)
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// metricsRecorder keeps the response written to it in memory.
+type metricsRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *metricsRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *metricsRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+}
+
+func (rec *metricsRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
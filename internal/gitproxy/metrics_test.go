@@ -0,0 +1,185 @@
+package gitproxy_test
+
+import (
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/gitproxy"
+	"github.com/crohr/smart-git-proxy/internal/logging"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+func TestMetricsAuth(t *testing.T) {
+	cfg, err := config.LoadArgs([]string{"-auth-mode", "none", "-mirror-dir", t.TempDir(), "-metrics-auth-token", "s3cret"})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	reg := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewWithRegistry(reg, logger)
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	server := gitproxy.New(cfg, mirrorStore, logger, metricsRegistry)
+	metricsRegistry.RequestsTotal.WithLabelValues("github.com/owner/repo", "info-refs", "127.0.0.1").Inc()
+	ts := httptest.NewServer(server.MetricsHandler(promhttp.HandlerFor(reg, promhttp.HandlerOpts{})))
+	defer ts.Close()
+
+	scrape := func(setAuth func(*http.Request)) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		setAuth(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("scrape: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	for name, setAuth := range map[string]func(*http.Request){
+		"none":         func(*http.Request) {},
+		"wrong bearer": func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") },
+		"wrong basic":  func(r *http.Request) { r.SetBasicAuth("prometheus", "nope") },
+	} {
+		if code, _ := scrape(setAuth); code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", name, code)
+		}
+	}
+	for name, setAuth := range map[string]func(*http.Request){
+		"bearer": func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") },
+		"basic":  func(r *http.Request) { r.SetBasicAuth("prometheus", "s3cret") },
+	} {
+		code, body := scrape(setAuth)
+		if code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", name, code)
+		}
+		if !strings.Contains(body, "smart_git_proxy_requests_total") {
+			t.Errorf("%s: expected metrics in body, got %q", name, body)
+		}
+	}
+}
+
+func TestMetricsRegistrationConflict(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+	upstream := newDumbUpstream(t, "owner", "repo")
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	cfg, err := config.LoadArgs([]string{"-auth-mode", "none", "-mirror-dir", t.TempDir(), "-allowed-upstreams", upstreamHost})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	// Something else got the name first, with other labels
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "smart_git_proxy_requests_total"}, []string{"other"}))
+	metricsRegistry := metrics.NewWithRegistry(reg, logger)
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(mirrorStore.Wait)
+	ts := httptest.NewServer(gitproxy.New(cfg, mirrorStore, logger, metricsRegistry).Handler())
+	defer ts.Close()
+
+	cmd := exec.Command("git", "clone", ts.URL+"/"+upstreamHost+"/owner/repo.git", filepath.Join(t.TempDir(), "clone"))
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("clone failed: %v\noutput: %s", err, out)
+	}
+
+	// The other metrics are still exported
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "smart_git_proxy_responses_total") {
+		t.Fatalf("expected registered metrics exported, got %q", body)
+	}
+}
+
+func TestMetricsCache(t *testing.T) {
+	const ttl = 200 * time.Millisecond
+	cfg, err := config.LoadArgs([]string{"-auth-mode", "none", "-mirror-dir", t.TempDir(), "-metrics-cache-ttl", ttl.String()})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	logger, _ := logging.New(cfg.LogLevel)
+	reg := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewWithRegistry(reg, logger)
+	mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	server := gitproxy.New(cfg, mirrorStore, logger, metricsRegistry)
+	// Counts the times metrics are gathered
+	var gathered atomic.Int64
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "test_gathered"}, func() float64 {
+		return float64(gathered.Add(1))
+	}))
+	h := server.MetricsHandler(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+
+	scrape := func(header http.Header) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		maps.Copy(req.Header, header)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	first := scrape(nil)
+	if first.Code != http.StatusOK || !strings.Contains(first.Body.String(), "test_gathered 1") || first.Header().Get("ETag") == "" {
+		t.Fatalf("expected 200 with an ETag, got %d %v: %s", first.Code, first.Header(), first.Body)
+	}
+
+	// Within the TTL, the same response is served without gathering again
+	start := time.Now()
+	again := scrape(nil)
+	if time.Since(start) < ttl {
+		if again.Body.String() != first.Body.String() || gathered.Load() != 1 {
+			t.Fatalf("expected the first response reused, gathered %d times: %s", gathered.Load(), again.Body)
+		}
+		if rec := scrape(http.Header{"If-None-Match": {first.Header().Get("ETag")}}); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Fatalf("expected 304, got %d: %s", rec.Code, rec.Body)
+		}
+	}
+	// Another encoding is rendered on its own
+	if rec := scrape(http.Header{"Accept-Encoding": {"gzip"}}); rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a gzip response, got %v", rec.Header())
+	}
+
+	// Past the TTL, metrics are gathered afresh
+	time.Sleep(ttl)
+	gathered.Store(10)
+	rec := scrape(http.Header{"If-None-Match": {first.Header().Get("ETag")}})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "test_gathered 11") || rec.Header().Get("ETag") == first.Header().Get("ETag") {
+		t.Fatalf("expected fresh metrics, got %d %v: %s", rec.Code, rec.Header(), rec.Body)
+	}
+
+	// Without a TTL, every scrape gathers them
+	next := *cfg
+	next.MetricsCacheTTL = 0
+	server.Reload(&next)
+	for want := int64(12); want < 14; want++ {
+		if scrape(nil); gathered.Load() != want {
+			t.Fatalf("expected metrics gathered %d times, got %d", want, gathered.Load())
+		}
+	}
+}
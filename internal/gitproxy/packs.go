@@ -0,0 +1,27 @@
+package gitproxy
+
+import "github.com/crohr/smart-git-proxy/internal/gitserve"
+
+// packVerifyAttempts is how many times a pack failing verification is
+// generated or fetched before the request fails.
+const packVerifyAttempts = 2
+
+// Sources of corrupt packs, as counted in metrics.
+const (
+	packSourceMirror   = "mirror"
+	packSourceUpstream = "upstream"
+)
+
+// packVerify returns how packs generated from mirrors are checked before
+// being served, or nil if they aren't.
+func (s *Server) packVerify() *gitserve.PackVerify {
+	cfg := s.config()
+	if !cfg.VerifyPacks {
+		return nil
+	}
+	return &gitserve.PackVerify{
+		Dir:       cfg.MirrorTempDir,
+		Attempts:  packVerifyAttempts,
+		OnCorrupt: s.metrics.CorruptPacks.WithLabelValues(packSourceMirror).Inc,
+	}
+}
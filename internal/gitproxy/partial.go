@@ -0,0 +1,33 @@
+package gitproxy
+
+import (
+	"context"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/gitserve"
+)
+
+// beyondMirror reports whether a protocol v2 request to a mirror restricted
+// to refs asks for more than it has: refs it leaves out, or objects only
+// reachable from them. Those requests are served from upstream instead.
+func (s *Server) beyondMirror(ctx context.Context, repoPath string, refs config.MirrorRefs, req *gitserve.V2Request) bool {
+	switch req.Command {
+	case "ls-refs":
+		if len(req.RefPrefixes) == 0 {
+			return true
+		}
+		for _, prefix := range req.RefPrefixes {
+			if prefix != "HEAD" && !refs.Overlaps(prefix) {
+				return true
+			}
+		}
+	case "fetch":
+		for _, ref := range req.WantRefs {
+			if ref != "HEAD" && !refs.Contains(ref) {
+				return true
+			}
+		}
+		return !s.mirror.HasObjects(ctx, repoPath, req.Wants)
+	}
+	return false
+}
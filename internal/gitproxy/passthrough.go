@@ -0,0 +1,186 @@
+package gitproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/gitserve"
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+// passthroughHeaders are the request headers forwarded upstream, besides auth.
+var passthroughHeaders = []string{"Accept", "Accept-Encoding", "Content-Type", "Content-Encoding", "Git-Protocol", "User-Agent"}
+
+// passthrough serves a smart HTTP request straight from upstream, for repos
+// served directly or that can't be mirrored because the disk is full, for
+// refs restricted mirrors leave out and for pushes. Nothing is cached. It
+// reports whether upstream's whole response was relayed: not if the client or
+// upstream went away mid-response.
+// Upstreams fetched over SSH can't be passed through to HTTP clients.
+func (s *Server) passthrough(w http.ResponseWriter, r *http.Request, upstreamURL, repoKey string, kind Kind, start time.Time) bool {
+	if !strings.HasPrefix(upstreamURL, "https://") {
+		s.fail(w, repoKey, kind, fmt.Errorf("passthrough: upstream %s isn't fetched over https", upstreamURL))
+		return false
+	}
+	target := upstreamURL + "/git-upload-pack"
+	switch kind {
+	case KindInfo:
+		target = upstreamURL + "/info/refs?" + r.URL.RawQuery
+	case KindPush:
+		target = upstreamURL + "/git-receive-pack"
+	}
+	cfg := s.config()
+	timeout := cfg.UpstreamPackTimeout
+	if kind == KindInfo {
+		timeout = cfg.UpstreamInfoTimeout
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	// Verified packs are read whole before anything is sent, and fetched
+	// again if corrupt, so the request is kept to be sent again
+	spoolDir := cfg.MirrorTempDir
+	if spoolDir == "" {
+		spoolDir = os.TempDir()
+	}
+	verify := kind == KindPack && cfg.SpoolLargePacksToDisk && cfg.VerifyPacks
+	var reqBody []byte
+	if verify {
+		var err error
+		if reqBody, err = io.ReadAll(r.Body); err != nil {
+			s.fail(w, repoKey, kind, fmt.Errorf("passthrough: read request body: %w", err))
+			return false
+		}
+	}
+	auth := s.upstreamAuth(r)
+	if isPush(r, kind) {
+		// Pushes are made with the client's own credentials, never the proxy's
+		auth = r.Header.Get("Authorization")
+	}
+	newRequest := func() (*http.Request, error) {
+		var body io.Reader = r.Body
+		if verify {
+			body = bytes.NewReader(reqBody)
+		}
+		req, err := http.NewRequestWithContext(ctx, r.Method, target, body)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = r.ContentLength
+		for _, h := range passthroughHeaders {
+			if v := r.Header.Get(h); v != "" {
+				req.Header.Set(h, v)
+			}
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		return req, nil
+	}
+
+	// Pushes send data upstream rather than fetch it, and aren't counted
+	host, _, _ := strings.Cut(repoKey, "/")
+	fetch := func() (*http.Response, error) {
+		if kind != KindPush {
+			if err := s.mirror.AcquireUpstream(host); err != nil {
+				return nil, err
+			}
+		}
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.mirror.UpstreamClient().Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("passthrough: %w", err)
+		}
+		return resp, nil
+	}
+
+	resp, err := fetch()
+	var verified *spool
+	for attempt := 1; err == nil && verify && resp.StatusCode == http.StatusOK; attempt++ {
+		sp := newSpool(spoolDir, cfg.SpoolPackThreshold)
+		sp.fill(resp.Body)
+		resp.Body.Close()
+		if err = sp.verify(resp.Header.Get("Content-Encoding")); err == nil {
+			verified = sp
+			break
+		}
+		sp.Close()
+		s.mirror.ChargeUpstream(host, sp.size)
+		if !errors.Is(err, gitserve.ErrCorruptPack) {
+			break
+		}
+		s.metrics.CorruptPacks.WithLabelValues(packSourceUpstream).Inc()
+		if attempt >= packVerifyAttempts {
+			break
+		}
+		s.log.Warn("corrupt pack from upstream, fetching it again", "repo", repoKey, "attempt", attempt, "err", err)
+		resp, err = fetch()
+	}
+	if err != nil {
+		s.fail(w, repoKey, kind, err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	for _, h := range []string{"Content-Type", "Content-Encoding", "WWW-Authenticate"} {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Git-Proxy-Status", string(mirror.StatusPassthrough))
+	decision := decisionFrom(r.Context())
+	decision.status, decision.source, decision.refreshed = mirror.StatusPassthrough, sourceUpstream, false
+	w.WriteHeader(resp.StatusCode)
+
+	// Packs are spooled when asked to, so slow clients don't hold the
+	// upstream connection
+	var body io.Reader = resp.Body
+	if verified != nil {
+		defer verified.Close()
+		body = verified
+	} else if kind == KindPack && resp.StatusCode == http.StatusOK && cfg.SpoolLargePacksToDisk {
+		sp := newSpool(spoolDir, cfg.SpoolPackThreshold)
+		filled := make(chan struct{})
+		go func() {
+			defer close(filled)
+			sp.fill(resp.Body)
+			resp.Body.Close()
+		}()
+		defer func() {
+			// Upstream is abandoned along with the client
+			cancel()
+			<-filled
+			if sp.spilled() {
+				s.log.Debug("pack spooled to disk", "repo", repoKey, "bytes", sp.size)
+			}
+			sp.Close()
+		}()
+		body = sp
+	}
+	// Relayed as it arrives, keeping upstream's progress live
+	n, err := io.Copy(gitserve.Flushing(w), body)
+	if err != nil {
+		s.log.Error("passthrough copy failed", "err", err, "repo", repoKey, "kind", kind)
+	}
+	if kind != KindPush {
+		s.mirror.ChargeUpstream(host, n)
+	}
+	s.logRequest(r, start, resp.StatusCode, "repo", repoKey, "status", mirror.StatusPassthrough, "upstream_status", resp.StatusCode)
+	s.metrics.ResponsesTotal.WithLabelValues(repoKey, string(kind), fmt.Sprint(resp.StatusCode)).Inc()
+	s.metrics.UpstreamLatency.WithLabelValues(repoKey, string(kind)).Observe(time.Since(start).Seconds())
+	return err == nil
+}
@@ -0,0 +1,117 @@
+package gitproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPreloadBody bounds the size of the list POST /admin/preload reads.
+const maxPreloadBody = 1 << 20
+
+// preloadEntry reports on one host/owner/repo@sha line of a preload request.
+type preloadEntry struct {
+	Entry  string `json:"entry"`
+	Repo   string `json:"repo,omitempty"`
+	Commit string `json:"commit,omitempty"`
+	Status string `json:"status"` // A mirror.PreloadStatus, or invalid or error
+	Error  string `json:"error,omitempty"`
+	Code   string `json:"code,omitempty"` // Admin error code of the failure, for error
+}
+
+// handlePreload makes sure mirrors have the commits a lockfile pins, one
+// host/owner/repo@sha per line, cloning or syncing them as batch fetches.
+// Repos are preloaded concurrently, within the prewarm limit, and go on if the
+// caller disconnects; the response reports on every entry once all are done.
+func (s *Server) handlePreload(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	entries := []*preloadEntry{}
+	repos := map[string][]*preloadEntry{}
+	var order []string
+	sc := bufio.NewScanner(http.MaxBytesReader(w, r.Body, maxPreloadBody))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		e := &preloadEntry{Entry: line}
+		entries = append(entries, e)
+		if err := s.parsePreloadEntry(e); err != nil {
+			e.Status, e.Error = "invalid", err.Error()
+			continue
+		}
+		if _, ok := repos[e.Repo]; !ok {
+			order = append(order, e.Repo)
+		}
+		repos[e.Repo] = append(repos[e.Repo], e)
+	}
+	if err := sc.Err(); err != nil {
+		writeAdminError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Errorf("read preload list: %w", err))
+		return
+	}
+
+	ctx := context.WithoutCancel(r.Context())
+	authHeader := s.upstreamAuth(r)
+	var wg sync.WaitGroup
+	for _, repoKey := range order {
+		wg.Go(func() {
+			repoEntries := repos[repoKey]
+			parts := strings.SplitN(repoKey, "/", 3)
+			commits := make([]string, len(repoEntries))
+			for i, e := range repoEntries {
+				commits[i] = e.Commit
+			}
+			res, err := s.mirror.Preload(ctx, parts[0], parts[1], parts[2], authHeader, commits)
+			if err != nil {
+				s.log.Warn("preload failed", "repo", repoKey, "err", err)
+				_, code := upstreamError(err)
+				for _, e := range repoEntries {
+					e.Status, e.Error, e.Code = "error", err.Error(), code
+				}
+				return
+			}
+			for _, e := range repoEntries {
+				e.Status = string(res[e.Commit])
+			}
+		})
+	}
+	wg.Wait()
+	s.log.Info("admin preload", "entries", len(entries), "repos", len(order), "duration_ms", time.Since(start).Milliseconds())
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Entries []*preloadEntry `json:"entries"`
+	}{entries})
+}
+
+// parsePreloadEntry fills in the repo and commit of a host/owner/repo@sha
+// entry, if it names a full commit SHA of a repo on an allowed upstream.
+func (s *Server) parsePreloadEntry(e *preloadEntry) error {
+	repoPath, sha, ok := strings.Cut(e.Entry, "@")
+	if !ok {
+		return fmt.Errorf("expected host/owner/repo@sha")
+	}
+	sha = strings.ToLower(sha)
+	if _, err := hex.DecodeString(sha); err != nil || (len(sha) != 40 && len(sha) != 64) {
+		return fmt.Errorf("invalid commit %q: expected a full SHA", sha)
+	}
+	parts := strings.Split(strings.Trim(repoPath, "/"), "/")
+	if len(parts) != 3 || slices.Contains(parts, "") || slices.Contains(parts, "..") {
+		return fmt.Errorf("invalid repo %q: expected host/owner/repo", repoPath)
+	}
+	cfg := s.config()
+	host := cfg.UpstreamHostAliases.Canonical(parts[0])
+	if err := s.checkAllowed(host); err != nil {
+		return err
+	}
+	e.Repo = host + "/" + parts[1] + "/" + cfg.KeepGitSuffixHosts.RepoName(host, parts[2])
+	e.Commit = sha
+	return nil
+}
@@ -0,0 +1,37 @@
+package gitproxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+// priorityHeader lets clients say how urgent the upstream fetches made for
+// them are, e.g. with git -c http.extraHeader="X-Git-Proxy-Priority: batch".
+const priorityHeader = "X-Git-Proxy-Priority"
+
+// priority returns the upstream fetch priority of r: the one configured for
+// the client auth credentials it carries, if any, so CI tokens can't jump the
+// queue, else the one it asks for, interactive by default.
+func (s *Server) priority(r *http.Request) mirror.Priority {
+	auth := s.config().ClientAuth
+	if len(auth.Priorities) > 0 {
+		client := ""
+		if user, password, ok := r.BasicAuth(); ok {
+			if want, found := auth.Users[user]; found && secretEqual(password, want) {
+				client = user
+			}
+		}
+		if client == "" {
+			client, _ = clientToken(r, auth)
+		}
+		if p, ok := mirror.ParsePriority(auth.Priorities[client]); ok {
+			return p
+		}
+	}
+	if p, ok := mirror.ParsePriority(strings.ToLower(strings.TrimSpace(r.Header.Get(priorityHeader)))); ok {
+		return p
+	}
+	return mirror.PriorityInteractive
+}
@@ -0,0 +1,66 @@
+package gitproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// warmRetryInterval is how long repos that failed to warm before the proxy
+// is ready wait before being tried again.
+const warmRetryInterval = 30 * time.Second
+
+// WarmBeforeReady clones the missing mirrors of the WarmBeforeReady repos,
+// trying failed ones again every warmRetryInterval, until all are mirrored or
+// ctx is done. ReadyHandler reports the proxy as not ready until then, so
+// load balancers don't send clients to a replica that would clone them cold.
+func (s *Server) WarmBeforeReady(ctx context.Context) {
+	pending := s.config().WarmBeforeReady
+	for len(pending) > 0 {
+		var mu sync.Mutex
+		var failed []string
+		var wg sync.WaitGroup
+		for _, key := range pending {
+			wg.Go(func() {
+				start := time.Now()
+				host, owner, repo, _ := splitRepoPath(key)
+				status, err := s.mirror.Warm(ctx, host, owner, repo, s.proxyAuth())
+				if err != nil {
+					s.log.Warn("warming repo before ready failed", "repo", key, "err", err)
+					mu.Lock()
+					failed = append(failed, key)
+					mu.Unlock()
+					return
+				}
+				s.log.Info("repo warmed before ready", "repo", key, "status", status, "duration_ms", time.Since(start).Milliseconds())
+			})
+		}
+		wg.Wait()
+		if pending = failed; len(pending) == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(warmRetryInterval):
+		}
+	}
+	if !s.ready.Swap(true) {
+		s.log.Info("critical repos warmed, ready", "repos", len(s.config().WarmBeforeReady))
+	}
+}
+
+// ReadyHandler answers readiness checks: 503 until the WarmBeforeReady repos
+// are mirrored, 200 from then on.
+func (s *Server) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if !s.ready.Load() {
+			http.Error(w, fmt.Sprintf("warming %d repos", len(s.config().WarmBeforeReady)), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok\n"))
+	})
+}
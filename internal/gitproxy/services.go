@@ -0,0 +1,79 @@
+package gitproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// Git services, as named in info/refs?service= and by the endpoint clients
+// POST to.
+const (
+	serviceUploadPack    = "git-upload-pack"
+	serviceReceivePack   = "git-receive-pack"
+	serviceUploadArchive = "git-upload-archive"
+)
+
+// checkService rejects requests for a git service outside AllowedServices
+// (git-upload-pack only if unset) or, for git-upload-archive, without
+// AllowUploadArchive, or made with a method git never uses for it, and dumb
+// HTTP requests with FilterBlobsOver, before any work is done for them.
+func (s *Server) checkService(r *http.Request, kind Kind) error {
+	service := ""
+	switch kind {
+	case KindInfo:
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			return fmt.Errorf("method %s not allowed for info/refs", r.Method)
+		}
+		// Dumb HTTP clients don't name a service
+		service = r.URL.Query().Get("service")
+		if service == "" {
+			return nil
+		}
+	case KindPack, KindPush:
+		service = serviceUploadPack
+		if kind == KindPush {
+			service = serviceReceivePack
+		}
+		if r.Method != http.MethodPost {
+			return fmt.Errorf("method %s not allowed for %s", r.Method, service)
+		}
+	case KindArchive:
+		if r.Method != http.MethodPost {
+			return fmt.Errorf("method %s not allowed for %s", r.Method, serviceUploadArchive)
+		}
+		if !s.config().AllowUploadArchive {
+			return fmt.Errorf("service %q not allowed", serviceUploadArchive)
+		}
+		return nil
+	case KindDumb:
+		// Dumb HTTP serves mirror packs as they are, with blobs of any size
+		if !s.config().FilterBlobsOver.IsZero() {
+			return errors.New("dumb http not allowed with filter-blobs-over")
+		}
+		return nil
+	default:
+		return nil
+	}
+	return s.checkServiceName(service)
+}
+
+// checkServiceName rejects service if it is outside AllowedServices
+// (git-upload-pack only if unset).
+func (s *Server) checkServiceName(service string) error {
+	allowed := s.config().AllowedServices
+	if len(allowed) == 0 {
+		allowed = []string{serviceUploadPack}
+	}
+	if !slices.Contains(allowed, service) {
+		return fmt.Errorf("service %q not allowed", service)
+	}
+	return nil
+}
+
+// isPush reports whether r is part of a push: the receive-pack advertisement
+// or the push itself.
+func isPush(r *http.Request, kind Kind) bool {
+	return kind == KindPush || (kind == KindInfo && r.URL.Query().Get("service") == serviceReceivePack)
+}
@@ -0,0 +1,152 @@
+package gitproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/crohr/smart-git-proxy/internal/gitserve"
+)
+
+// spool buffers an upstream response so that upstream is read at its own
+// pace, not the client's, and its connection released as soon as it is done.
+// The first threshold bytes are kept in memory and the rest in a temp file,
+// and the client is served from them as they arrive.
+type spool struct {
+	dir       string
+	threshold int64
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	mem  []byte
+	file *os.File // Bytes past mem, unlinked as soon as created so nothing is left behind
+	size int64    // Bytes spooled so far
+	err  error    // Why filling stopped, io.EOF once upstream was read to the end
+	read int64    // Bytes served so far, only touched by the reader
+}
+
+func newSpool(dir string, threshold int64) *spool {
+	s := &spool{dir: dir, threshold: threshold}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// fill reads src to the end into the spool.
+func (s *spool) fill(src io.Reader) {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if werr := s.write(buf[:n]); werr != nil {
+				err = werr
+			}
+		}
+		if err != nil {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+			s.cond.Broadcast()
+			return
+		}
+	}
+}
+
+// write appends p to the spool. Only fill writes, so size and file can be
+// read without the lock; readers only go by size, updated once p is written.
+func (s *spool) write(p []byte) error {
+	defer s.cond.Broadcast()
+	if room := s.threshold - s.size; room > 0 {
+		n := int(min(room, int64(len(p))))
+		s.mu.Lock()
+		s.mem = append(s.mem, p[:n]...)
+		s.size += int64(n)
+		s.mu.Unlock()
+		p = p[n:]
+	}
+	if len(p) == 0 {
+		return nil
+	}
+	if s.file == nil {
+		f, err := os.CreateTemp(s.dir, "pack-spool-*")
+		if err != nil {
+			return err
+		}
+		os.Remove(f.Name())
+		s.mu.Lock()
+		s.file = f
+		s.mu.Unlock()
+	}
+	if _, err := s.file.WriteAt(p, s.size-s.threshold); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.size += int64(len(p))
+	s.mu.Unlock()
+	return nil
+}
+
+// Read serves the spooled bytes in order, waiting for more until upstream
+// was read to the end.
+func (s *spool) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for s.read == s.size && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.read == s.size {
+		defer s.mu.Unlock()
+		return 0, s.err
+	}
+	if s.read < int64(len(s.mem)) {
+		n := copy(p, s.mem[s.read:])
+		s.read += int64(n)
+		s.mu.Unlock()
+		return n, nil
+	}
+	file, size := s.file, s.size
+	s.mu.Unlock()
+
+	n, err := file.ReadAt(p[:min(int64(len(p)), size-s.read)], s.read-s.threshold)
+	s.read += int64(n)
+	return n, err
+}
+
+// verify checks the pack of the upload-pack response spooled, sent with
+// contentEncoding, once fill has returned.
+func (s *spool) verify(contentEncoding string) error {
+	if s.err != io.EOF {
+		return s.err
+	}
+	var rd io.Reader = bytes.NewReader(s.mem)
+	if s.file != nil {
+		rd = io.MultiReader(rd, io.NewSectionReader(s.file, 0, s.size-s.threshold))
+	}
+	if strings.Contains(contentEncoding, "gzip") {
+		gz, err := gzip.NewReader(rd)
+		if err != nil {
+			return fmt.Errorf("%w: %w", gitserve.ErrCorruptPack, err)
+		}
+		defer gz.Close()
+		rd = gz
+	}
+	return gitserve.CheckPackResponse(rd)
+}
+
+// spilled reports whether the spool outgrew memory into a temp file.
+func (s *spool) spilled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file != nil
+}
+
+// Close releases the spool, once fill has returned.
+func (s *spool) Close() error {
+	s.mem = nil
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
@@ -0,0 +1,100 @@
+package gitproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Request classes RequestTimeouts bound, see config.RequestClasses.
+const (
+	classInfo    = "info"
+	classPack    = "pack"
+	classAdmin   = "admin"
+	classMetrics = "metrics"
+)
+
+// class returns the request class of git requests of kind k.
+func (k Kind) class() string {
+	if k == KindInfo || k == KindDumb {
+		return classInfo
+	}
+	return classPack
+}
+
+// withTimeout bounds requests to h by the RequestTimeouts deadline of class,
+// see deadline, reporting those past it with timedOut.
+func (s *Server) withTimeout(class string, h http.Handler, timedOut func(http.ResponseWriter, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w, r, done := s.deadline(w, r, class, timedOut)
+		defer done()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// deadline sets the RequestTimeouts deadline of class, if any, on the context
+// of r. Once it passes, what is written to the returned writer is held back
+// if the response hadn't started, and the returned func, called when the
+// handler is done, reports the request with timedOut instead: clients get a
+// 504 rather than whatever error the handler made of the cancellation.
+// Responses already streaming are just cut off.
+func (s *Server) deadline(w http.ResponseWriter, r *http.Request, class string, timedOut func(http.ResponseWriter, error)) (http.ResponseWriter, *http.Request, func()) {
+	timeout := s.config().RequestTimeouts[class]
+	if timeout <= 0 {
+		return w, r, func() {}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	tw := &timeoutWriter{ResponseWriter: w, ctx: ctx}
+	return tw, r.WithContext(ctx), func() {
+		expired := tw.expired()
+		cancel()
+		if !expired {
+			return
+		}
+		s.log.Warn("request deadline exceeded", "class", class, "timeout", timeout, "method", r.Method, "path", r.URL.Path)
+		timedOut(w, fmt.Errorf("request not completed within %s", timeout))
+	}
+}
+
+// timeoutWriter holds back writes once its context's deadline passed, unless
+// the response had already started.
+type timeoutWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	started bool
+	held    bool
+}
+
+// expired reports whether writes are held back, or would be.
+func (tw *timeoutWriter) expired() bool {
+	if !tw.started && errors.Is(tw.ctx.Err(), context.DeadlineExceeded) {
+		tw.held = true
+	}
+	return tw.held
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	if tw.expired() {
+		return
+	}
+	tw.started = true
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	if tw.expired() {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.started = true
+	return tw.ResponseWriter.Write(b)
+}
+
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// gatewayTimeout reports git and metrics requests past their deadline.
+func gatewayTimeout(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), http.StatusGatewayTimeout)
+}
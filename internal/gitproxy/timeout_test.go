@@ -0,0 +1,112 @@
+package gitproxy_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/gitproxy"
+	"github.com/crohr/smart-git-proxy/internal/logging"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+func TestRequestTimeouts(t *testing.T) {
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+	// Upstream never answers, until its clients give up or the test is over
+	stop := make(chan struct{})
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+	defer upstream.Close()
+	defer close(stop)
+	upstreamHost := strings.TrimPrefix(upstream.URL, "https://")
+
+	const deadline = 200 * time.Millisecond
+	newServer := func(t *testing.T, class string) *gitproxy.Server {
+		t.Helper()
+		cfg := &config.Config{
+			AllowedUpstreams: []string{upstreamHost},
+			MirrorDir:        t.TempDir(),
+			SyncStaleAfter:   time.Minute,
+			AuthMode:         "none",
+			LogLevel:         "info",
+			DiskFullFallback: "passthrough",
+			RequestTimeouts:  map[string]time.Duration{class: deadline},
+		}
+		logger, _ := logging.New(cfg.LogLevel)
+		metricsRegistry := metrics.NewUnregistered()
+		mirrorStore, err := mirror.New(cfg, metricsRegistry, logger)
+		if err != nil {
+			t.Fatalf("mirror init: %v", err)
+		}
+		t.Cleanup(mirrorStore.Wait)
+		return gitproxy.New(cfg, mirrorStore, logger, metricsRegistry)
+	}
+	do := func(t *testing.T, h http.Handler, method, path, body string) (*httptest.ResponseRecorder, time.Duration) {
+		t.Helper()
+		start := time.Now()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		took := time.Since(start)
+		if took > 10*deadline {
+			t.Fatalf("expected the request cut off after %v, took %v", deadline, took)
+		}
+		return rec, took
+	}
+	repoPath := "/" + upstreamHost + "/owner/repo.git"
+
+	t.Run("info", func(t *testing.T) {
+		rec, took := do(t, newServer(t, "info").Handler(), http.MethodGet, repoPath+"/info/refs?service=git-upload-pack", "")
+		if rec.Code != http.StatusGatewayTimeout || took < deadline {
+			t.Fatalf("expected 504 after %v, got %d after %v: %s", deadline, rec.Code, took, rec.Body)
+		}
+	})
+
+	t.Run("pack", func(t *testing.T) {
+		// Without a mirror, upload-pack is passed through to upstream
+		rec, took := do(t, newServer(t, "pack").Handler(), http.MethodPost, repoPath+"/git-upload-pack", "0000")
+		if rec.Code != http.StatusGatewayTimeout || took < deadline {
+			t.Fatalf("expected 504 after %v, got %d after %v: %s", deadline, rec.Code, took, rec.Body)
+		}
+	})
+
+	t.Run("admin", func(t *testing.T) {
+		rec, _ := do(t, newServer(t, "admin").AdminHandler(), http.MethodPost, "/admin/refresh"+repoPath, "")
+		var body struct{ Code string }
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || rec.Code != http.StatusGatewayTimeout || body.Code != gitproxy.CodeTimeout {
+			t.Fatalf("expected 504 with code %s, got %d: %+v (%v)", gitproxy.CodeTimeout, rec.Code, body, err)
+		}
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			_, _ = io.WriteString(w, "too late")
+		})
+		rec, _ := do(t, newServer(t, "metrics").MetricsHandler(slow), http.MethodGet, "/metrics", "")
+		if rec.Code != http.StatusGatewayTimeout || strings.Contains(rec.Body.String(), "too late") {
+			t.Fatalf("expected 504, got %d: %s", rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("other classes", func(t *testing.T) {
+		// The info deadline doesn't bound metrics
+		ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, set := r.Context().Deadline(); set {
+				http.Error(w, "deadline set", http.StatusInternalServerError)
+			}
+		})
+		if rec, _ := do(t, newServer(t, "info").MetricsHandler(ok), http.MethodGet, "/metrics", ""); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+	})
+}
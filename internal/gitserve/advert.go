@@ -0,0 +1,200 @@
+package gitserve
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// AdvertCache keeps recent info/refs advertisements in memory, so repeated
+// requests for small repos are answered without running git upload-pack.
+// Entries are keyed by repo path, service and Git-Protocol header, expire after ttl and
+// must be invalidated whenever the mirror changes. Once the total size exceeds
+// maxBytes, the least recently used entries are dropped.
+type AdvertCache struct {
+	maxBytes  int64
+	ttl       time.Duration
+	onCorrupt func()        // Set by Verify, nil when advertisements aren't checked
+	capsTTL   time.Duration // Set by CacheCapabilities, zero when capabilities aren't kept apart
+
+	mu      sync.Mutex
+	size    int64
+	gen     uint64                                 // bumped by every invalidation
+	lru     *list.List                             // of *advert, most recently used first
+	entries map[string]map[advertKey]*list.Element // repo path -> service and Git-Protocol -> entry
+	caps    map[capsKey]*advert
+}
+
+// advertKey identifies one of a repo's advertisements: each service (e.g.
+// git-upload-pack, git-receive-pack) and protocol version advertises differently.
+type advertKey struct {
+	service     string
+	gitProtocol string
+}
+
+// capsKey identifies a protocol v2 capability advertisement. It lists no refs,
+// so it is the same for every repo of an object format served alike.
+type capsKey struct {
+	gitProtocol  string
+	refInWant    bool
+	objectFormat string
+}
+
+type advert struct {
+	repoPath string
+	advertKey
+	body    []byte
+	etag    string
+	sum     [sha256.Size]byte // Of body when stored, checked by get if Verify was called
+	expires time.Time
+}
+
+// NewAdvertCache returns a cache holding up to maxBytes of advertisements for
+// at most ttl each.
+func NewAdvertCache(maxBytes int64, ttl time.Duration) *AdvertCache {
+	return &AdvertCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		lru:      list.New(),
+		entries:  make(map[string]map[advertKey]*list.Element),
+		caps:     make(map[capsKey]*advert),
+	}
+}
+
+// CacheCapabilities makes the cache keep protocol v2 capability
+// advertisements for ttl, apart from the budget and shared by all repos, as
+// they only change with the git version or config: tools probing many repos
+// for capabilities then don't run git upload-pack for each. Syncs don't drop
+// them. Call it before using the cache.
+func (c *AdvertCache) CacheCapabilities(ttl time.Duration) {
+	c.capsTTL = ttl
+}
+
+// Verify makes the cache check advertisements against a checksum taken when
+// they were stored before returning them, so memory corruption is answered
+// with a fresh advertisement rather than served. Corrupt entries are dropped
+// and reported to onCorrupt. Call it before using the cache.
+func (c *AdvertCache) Verify(onCorrupt func()) {
+	c.onCorrupt = onCorrupt
+}
+
+// get returns the cached advertisement, if any. When there is none, gen must
+// be passed to put so an advertisement generated while the repo was being
+// invalidated isn't stored.
+func (c *AdvertCache) get(repoPath string, key advertKey) (a *advert, gen uint64) {
+	c.mu.Lock()
+	el, ok := c.entries[repoPath][key]
+	if !ok {
+		defer c.mu.Unlock()
+		return nil, c.gen
+	}
+	a = el.Value.(*advert)
+	if !time.Now().Before(a.expires) {
+		defer c.mu.Unlock()
+		c.remove(el)
+		return nil, c.gen
+	}
+	c.lru.MoveToFront(el)
+	gen = c.gen
+	c.mu.Unlock()
+
+	// Hashed outside the lock, as advertisements of big repos take a while
+	if c.onCorrupt == nil || sha256.Sum256(a.body) == a.sum {
+		return a, gen
+	}
+	c.onCorrupt()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cur, ok := c.entries[repoPath][key]; ok && cur == el {
+		c.remove(el)
+	}
+	return nil, c.gen
+}
+
+// capabilities returns the cached capability advertisement for key, if any.
+func (c *AdvertCache) capabilities(key capsKey) *advert {
+	c.mu.Lock()
+	a, ok := c.caps[key]
+	if ok && !time.Now().Before(a.expires) {
+		delete(c.caps, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok || c.onCorrupt == nil || sha256.Sum256(a.body) == a.sum {
+		return a
+	}
+	c.onCorrupt()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.caps[key] == a {
+		delete(c.caps, key)
+	}
+	return nil
+}
+
+// putCapabilities stores the capability advertisement for key.
+func (c *AdvertCache) putCapabilities(key capsKey, body []byte, etag string) {
+	a := &advert{body: body, etag: etag, expires: time.Now().Add(c.capsTTL)}
+	if c.onCorrupt != nil {
+		a.sum = sha256.Sum256(body)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.caps[key] = a
+}
+
+// put stores an advertisement generated after a get that returned gen.
+// Advertisements larger than an eighth of the budget aren't kept, so a few
+// big repos can't flush all the small ones.
+func (c *AdvertCache) put(repoPath string, key advertKey, body []byte, etag string, gen uint64) {
+	size := int64(len(body))
+	if c.ttl <= 0 || size > c.maxBytes/8 {
+		return
+	}
+
+	var sum [sha256.Size]byte
+	if c.onCorrupt != nil {
+		sum = sha256.Sum256(body)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+	if el, ok := c.entries[repoPath][key]; ok {
+		c.remove(el)
+	}
+	a := &advert{repoPath: repoPath, advertKey: key, body: body, etag: etag, sum: sum, expires: time.Now().Add(c.ttl)}
+	if c.entries[repoPath] == nil {
+		c.entries[repoPath] = make(map[advertKey]*list.Element)
+	}
+	c.entries[repoPath][key] = c.lru.PushFront(a)
+	c.size += size
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Invalidate drops every advertisement of the repo at repoPath.
+func (c *AdvertCache) Invalidate(repoPath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for _, el := range c.entries[repoPath] {
+		c.remove(el)
+	}
+}
+
+// remove drops el from the cache. Callers must hold c.mu.
+func (c *AdvertCache) remove(el *list.Element) {
+	a := c.lru.Remove(el).(*advert)
+	c.size -= int64(len(a.body))
+	delete(c.entries[a.repoPath], a.advertKey)
+	if len(c.entries[a.repoPath]) == 0 {
+		delete(c.entries, a.repoPath)
+	}
+}
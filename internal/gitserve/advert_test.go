@@ -0,0 +1,120 @@
+package gitserve
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdvertCache(t *testing.T) {
+	c := NewAdvertCache(80, time.Minute)
+	v1, v2 := advertKey{"git-upload-pack", ""}, advertKey{"git-upload-pack", "version=2"}
+	body := func(s string) []byte { return []byte(strings.Repeat(s, 10)) }
+
+	_, gen := c.get("a.git", v1)
+	c.put("a.git", v1, body("a"), `"a"`, gen)
+	c.put("a.git", v2, body("A"), `"A"`, gen)
+	if a, _ := c.get("a.git", v1); a == nil || a.etag != `"a"` {
+		t.Fatalf("expected cached v1 advertisement, got %+v", a)
+	}
+	if a, _ := c.get("a.git", v2); a == nil || a.etag != `"A"` {
+		t.Fatalf("expected cached v2 advertisement, got %+v", a)
+	}
+
+	// Too large for the budget
+	c.put("big.git", v1, body("bb"), `"b"`, gen)
+	if a, _ := c.get("big.git", v1); a != nil {
+		t.Fatalf("expected oversized advertisement not to be cached")
+	}
+
+	// Least recently used entries go first once over budget
+	for _, repo := range []string{"b.git", "c.git", "d.git", "e.git", "f.git", "g.git", "h.git"} {
+		c.get("a.git", v1)
+		c.put(repo, v1, body("x"), `"x"`, gen)
+	}
+	if a, _ := c.get("a.git", v1); a == nil {
+		t.Fatalf("expected recently used advertisement to be kept")
+	}
+	if a, _ := c.get("a.git", v2); a != nil {
+		t.Fatalf("expected least recently used advertisement to be evicted")
+	}
+	if c.size > c.maxBytes {
+		t.Fatalf("cache size %d exceeds budget %d", c.size, c.maxBytes)
+	}
+
+	// Invalidation drops the repo, and anything generated before it
+	_, gen = c.get("b.git", v2)
+	c.Invalidate("a.git")
+	if a, _ := c.get("a.git", v1); a != nil {
+		t.Fatalf("expected invalidated advertisement to be dropped")
+	}
+	c.put("b.git", v2, body("s"), `"s"`, gen)
+	if a, _ := c.get("b.git", v2); a != nil {
+		t.Fatalf("expected advertisement generated before an invalidation not to be cached")
+	}
+}
+
+func TestAdvertCacheServices(t *testing.T) {
+	c := NewAdvertCache(1024, time.Minute)
+	upload, receive := advertKey{"git-upload-pack", ""}, advertKey{"git-receive-pack", ""}
+
+	_, gen := c.get("a.git", upload)
+	c.put("a.git", upload, []byte("upload"), `"u"`, gen)
+	if a, _ := c.get("a.git", receive); a != nil {
+		t.Fatalf("expected no receive-pack advertisement, got %q", a.body)
+	}
+	c.put("a.git", receive, []byte("receive"), `"r"`, gen)
+	if len(c.entries["a.git"]) != 2 {
+		t.Fatalf("expected distinct entries per service, got %d", len(c.entries["a.git"]))
+	}
+	if a, _ := c.get("a.git", upload); a == nil || string(a.body) != "upload" {
+		t.Fatalf("expected upload-pack advertisement, got %+v", a)
+	}
+	if a, _ := c.get("a.git", receive); a == nil || string(a.body) != "receive" {
+		t.Fatalf("expected receive-pack advertisement, got %+v", a)
+	}
+	c.Invalidate("a.git")
+	if c.size != 0 || len(c.entries) != 0 {
+		t.Fatalf("expected invalidation to drop both services, got %d bytes in %d repos", c.size, len(c.entries))
+	}
+}
+
+func TestAdvertCacheExpiry(t *testing.T) {
+	c := NewAdvertCache(1024, time.Millisecond)
+	key := advertKey{"git-upload-pack", ""}
+	_, gen := c.get("a.git", key)
+	c.put("a.git", key, []byte("refs"), `"r"`, gen)
+	time.Sleep(5 * time.Millisecond)
+	if a, _ := c.get("a.git", key); a != nil {
+		t.Fatalf("expected expired advertisement to be dropped")
+	}
+	if c.size != 0 || len(c.entries) != 0 {
+		t.Fatalf("expected empty cache, got %d bytes in %d repos", c.size, len(c.entries))
+	}
+}
+
+func TestAdvertCacheVerify(t *testing.T) {
+	c := NewAdvertCache(1024, time.Minute)
+	corrupted := 0
+	c.Verify(func() { corrupted++ })
+	key := advertKey{"git-upload-pack", ""}
+	_, gen := c.get("a.git", key)
+	c.put("a.git", key, []byte("refs"), `"r"`, gen)
+	if a, _ := c.get("a.git", key); a == nil || corrupted != 0 {
+		t.Fatalf("expected intact advertisement served, got %+v with %d corrupt", a, corrupted)
+	}
+
+	// A flipped bit is caught, and the entry dropped so it gets regenerated
+	c.entries["a.git"][key].Value.(*advert).body[0] ^= 1
+	if a, _ := c.get("a.git", key); a != nil {
+		t.Fatalf("expected corrupt advertisement not to be served")
+	}
+	if corrupted != 1 || c.size != 0 || len(c.entries) != 0 {
+		t.Fatalf("expected corrupt advertisement reported and dropped, got %d reports, %d bytes left", corrupted, c.size)
+	}
+	_, gen = c.get("a.git", key)
+	c.put("a.git", key, []byte("refs"), `"r"`, gen)
+	if a, _ := c.get("a.git", key); a == nil {
+		t.Fatalf("expected regenerated advertisement to be cached")
+	}
+}
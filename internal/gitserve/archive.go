@@ -0,0 +1,164 @@
+package gitserve
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/crohr/smart-git-proxy/internal/gitcmd"
+)
+
+// maxArchiveRequest bounds the upload-archive request body: the arguments of
+// a git archive command line.
+const maxArchiveRequest = 64 << 10
+
+// archiveValueOptions are the git archive options taking their value as the
+// next argument.
+var archiveValueOptions = []string{"--format", "--prefix", "--add-file", "--add-virtual-file", "--mtime"}
+
+// ArchiveRequest is a git-upload-archive request: the git archive arguments
+// sent by git archive --remote, one "argument" pkt-line each, up to a flush.
+type ArchiveRequest struct {
+	Args []string
+	body []byte // As received, decompressed, replayed to upload-archive
+}
+
+// ReadArchiveRequest reads the upload-archive request of r.
+func ReadArchiveRequest(r *http.Request) (*ArchiveRequest, error) {
+	body, err := decodedBody(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxArchiveRequest+1))
+	if err != nil {
+		return nil, fmt.Errorf("read request body: %w", err)
+	}
+	if len(data) > maxArchiveRequest {
+		return nil, fmt.Errorf("upload-archive request exceeds %d bytes", maxArchiveRequest)
+	}
+
+	req := &ArchiveRequest{body: data}
+	rd := bytes.NewReader(data)
+	for {
+		line, special, err := readPktLine(rd)
+		if err != nil {
+			return nil, err
+		}
+		if special == pktFlush {
+			return req, nil
+		}
+		arg, ok := strings.CutPrefix(strings.TrimSuffix(line, "\n"), "argument ")
+		if special != pktData || !ok {
+			return nil, fmt.Errorf("unexpected upload-archive request line %q", line)
+		}
+		req.Args = append(req.Args, arg)
+	}
+}
+
+// Treeish returns the tree-ish to archive: the first argument that isn't an
+// option, or "" if there is none.
+func (a *ArchiveRequest) Treeish() string {
+	for i := 0; i < len(a.Args); i++ {
+		arg := a.Args[i]
+		switch {
+		case arg == "--":
+			if i+1 < len(a.Args) {
+				return a.Args[i+1]
+			}
+			return ""
+		case strings.HasPrefix(arg, "-"):
+			for _, o := range archiveValueOptions {
+				if arg == o {
+					i++
+				}
+			}
+		default:
+			return arg
+		}
+	}
+	return ""
+}
+
+// ArchiveKey returns the cache key of an upload-archive request in the repo at
+// repoPath, with its tree-ish resolved to the commit it names: archives of a
+// commit are the same every time, taking their timestamps from it, so they
+// are cached until the ref moves. Archives
+// of bare trees are stamped with the current time and not cached.
+func ArchiveKey(ctx context.Context, repoPath string, req *ArchiveRequest) (string, bool) {
+	rev, _, _ := strings.Cut(req.Treeish(), ":")
+	if rev == "" {
+		return "", false
+	}
+	cmd := gitcmd.Command(ctx, "-C", repoPath, "rev-parse", "--verify", "--quiet", "--end-of-options", rev+"^{commit}")
+	cmd.Env = gitEnv("", nil, false)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", false
+	}
+
+	// The tree-ish is kept as sent too: upload-archive only takes ref names
+	h := sha256.New()
+	io.WriteString(h, strings.TrimSpace(string(out))+"\n")
+	for _, arg := range req.Args {
+		io.WriteString(h, arg+"\n")
+	}
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// ServeUploadArchive runs git upload-archive against the repo at repoPath and
+// streams its output, recording it into cache if set. Like with git
+// http-backend, upload-archive isn't stateless-rpc aware: it reads the whole
+// request and answers it in one go.
+func ServeUploadArchive(w http.ResponseWriter, r *http.Request, repoPath string, req *ArchiveRequest, cacheStatus string, cache *PackCacheEntry, log *slog.Logger) error {
+	cmd := gitcmd.Command(r.Context(), "upload-archive", repoPath)
+	cmd.Stdin = bytes.NewReader(req.body)
+	cmd.Env = gitEnv("", nil, false)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("stdout pipe: %w", err)
+	}
+	var stderrBuf bytes.Buffer
+	cmd.Stderr = &stderrBuf
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start git upload-archive: %w", err)
+	}
+
+	resp := &lazyResponse{ResponseWriter: w, contentType: ArchiveResultType, cacheStatus: cacheStatus}
+	out := Flushing(resp)
+	var rec *packRecorder
+	if cache != nil {
+		if rec, err = newPackRecorder(*cache); err != nil {
+			log.Warn("cannot record archive for caching", "dir", cache.Dir, "err", err)
+		} else {
+			out = io.MultiWriter(out, rec)
+		}
+	}
+
+	n, err := io.Copy(out, stdout)
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		if rec != nil {
+			_ = rec.commit(false)
+		}
+		return fmt.Errorf("copy stdout: %w, stderr: %s", err, stderrBuf.String())
+	}
+	err = cmd.Wait()
+	resp.start()
+	if rec != nil {
+		if cerr := rec.commit(err == nil); cerr != nil {
+			log.Warn("caching archive failed", "dir", cache.Dir, "err", cerr)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("wait git upload-archive: %w, stderr: %s", err, stderrBuf.String())
+	}
+	log.Debug("git upload-archive complete", "path", repoPath, "bytes", n)
+	return nil
+}
@@ -0,0 +1,93 @@
+package gitserve
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/gitcmd"
+)
+
+// daemonWaitDelay bounds how long the client is read from once upload-pack
+// exits, as clients may keep git:// connections open.
+const daemonWaitDelay = 5 * time.Second
+
+// DaemonRequest is the request opening a git:// connection:
+// "git-upload-pack /path\0host=example.com\0\0version=2\0" in one pkt-line.
+type DaemonRequest struct {
+	Service  string // e.g. git-upload-pack
+	Path     string
+	Host     string // As the client was told to connect to, if sent
+	Protocol string // Extra parameters, as GIT_PROTOCOL takes them
+}
+
+// ReadDaemonRequest reads the request of a git:// connection from r, and
+// nothing past it.
+func ReadDaemonRequest(r io.Reader) (*DaemonRequest, error) {
+	line, special, err := readPktLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if special != pktData {
+		return nil, fmt.Errorf("expected git daemon request, got special packet %d", special)
+	}
+	command, params, _ := strings.Cut(strings.TrimSuffix(line, "\n"), "\x00")
+	service, path, ok := strings.Cut(command, " ")
+	if !ok || !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("invalid git daemon request %q", command)
+	}
+	req := &DaemonRequest{Service: service, Path: path}
+	// host= comes first, then extra parameters after an empty one
+	hostParam, extra, _ := strings.Cut(params, "\x00\x00")
+	for _, p := range strings.Split(hostParam, "\x00") {
+		if host, ok := strings.CutPrefix(p, "host="); ok {
+			req.Host = host
+		}
+	}
+	var protocol []string
+	for _, p := range strings.Split(extra, "\x00") {
+		if p != "" {
+			protocol = append(protocol, p)
+		}
+	}
+	req.Protocol = strings.Join(protocol, ":")
+	return req, nil
+}
+
+// DaemonError sends msg to a git:// client, which shows it as
+// "fatal: remote error: msg".
+func DaemonError(w io.Writer, msg string) error {
+	_, err := io.WriteString(w, pktLine("ERR "+msg+"\n"))
+	return err
+}
+
+// ServeDaemon runs git upload-pack against the repo at repoPath over conn,
+// the rest of the git:// connection req opened, until the client is done.
+// Refs matching stripRefs are hidden like over HTTP, and refInWant must be
+// set like for ServeInfoRefs.
+func ServeDaemon(ctx context.Context, conn io.ReadWriter, repoPath string, req *DaemonRequest, packThreads int, stripRefs []string, refInWant bool, log *slog.Logger) error {
+	start := time.Now()
+	args := []string{"upload-pack", "--strict", repoPath}
+	if packThreads > 0 {
+		args = append([]string{"-c", fmt.Sprintf("pack.threads=%d", packThreads)}, args...)
+	}
+	cmd := gitcmd.Command(ctx, args...)
+	cmd.Stdin = conn
+	cmd.Stdout = conn
+	var stderrBuf bytes.Buffer
+	cmd.Stderr = &stderrBuf
+	cmd.Env = gitEnv(req.Protocol, stripRefs, refInWant)
+	cmd.WaitDelay = daemonWaitDelay
+	// Clients hanging on once upload-pack is done are left to the caller
+	if err := cmd.Run(); err != nil && !errors.Is(err, exec.ErrWaitDelay) {
+		return fmt.Errorf("git upload-pack: %w, stderr: %s", err, stderrBuf.String())
+	}
+	log.Debug("git daemon upload-pack complete", "path", repoPath, "total_duration_ms", time.Since(start).Milliseconds())
+	return nil
+}
@@ -0,0 +1,144 @@
+package gitserve
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/crohr/smart-git-proxy/internal/gitcmd"
+)
+
+// ErrFilteredBlob is returned by FilterBlobs for requests wanting a blob over
+// the limit by its ID, which filters don't apply to.
+var ErrFilteredBlob = errors.New("wanted blob exceeds the filter limit")
+
+// FilterBlobs rewrites the fetch request of r for upload-pack to leave blobs
+// over limit bytes out of the pack, as if the client had sent
+// --filter=blob:limit=<limit>. A filter the client sent is combined with it,
+// so partial clones get neither the blobs they left out nor the large ones.
+// Wants are checked against the repo at repoPath first, as git sends objects
+// wanted by ID whatever the filter. Other requests, like ls-refs, are left
+// as they are. The body is replaced with an equivalent (decompressed) reader.
+func FilterBlobs(r *http.Request, repoPath string, limit int64) error {
+	orig := r.Body
+	body, err := decodedBody(r)
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(body)
+	head, wants, err := filterRequest(br, IsV2(r), limit)
+	r.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(head), br), Closer: orig}
+	if err != nil {
+		return err
+	}
+	return checkWantedBlobs(r, repoPath, wants, limit)
+}
+
+// filterRequest reads the request from rd up to the end of its wants, and
+// returns it with a filter added, along with the object IDs and refs (with
+// ref-in-want) wanted. The
+// haves that may follow are left to read from rd.
+func filterRequest(rd io.Reader, v2 bool, limit int64) ([]byte, []string, error) {
+	var out bytes.Buffer
+	var wants []string
+	clientFilter := ""
+	// Protocol v0 requests open with their wants, v2 ones with a command
+	inArgs, fetch := !v2, !v2
+	for {
+		line, special, err := readPktLine(rd)
+		if err != nil {
+			return out.Bytes(), nil, fmt.Errorf("read request: %w", err)
+		}
+		switch special {
+		case pktFlush:
+			// The end of the wants, which the filter goes with
+			if inArgs && len(wants) > 0 {
+				out.WriteString(pktLine("filter " + filterSpec(limit, clientFilter) + "\n"))
+			}
+			out.WriteString("0000")
+			if inArgs || !fetch {
+				return out.Bytes(), wants, nil
+			}
+			continue
+		case pktDelim:
+			inArgs = fetch
+			out.WriteString("0001")
+			continue
+		case pktResponseEnd:
+			out.WriteString("0002")
+			continue
+		}
+		text := strings.TrimSuffix(line, "\n")
+		switch {
+		case v2 && !inArgs && strings.HasPrefix(text, "command="):
+			fetch = text == "command=fetch"
+		case inArgs && strings.HasPrefix(text, "filter "):
+			clientFilter = strings.TrimPrefix(text, "filter ")
+			continue
+		case inArgs && v2 && strings.HasPrefix(text, "want-ref "):
+			wants = append(wants, strings.TrimPrefix(text, "want-ref "))
+		case inArgs && strings.HasPrefix(text, "want "):
+			fields := strings.Fields(text)
+			if len(fields) < 2 {
+				return out.Bytes(), nil, fmt.Errorf("invalid want %q", text)
+			}
+			wants = append(wants, fields[1])
+			// Protocol v0 filters are only taken once asked for with the first want
+			if !v2 && len(wants) == 1 && !slices.Contains(fields[2:], "filter") {
+				line = text + " filter\n"
+			}
+		}
+		out.WriteString(pktLine(line))
+	}
+}
+
+// filterSpec returns the filter limiting blobs to limit bytes, combined with
+// clientFilter if set. Sub-filters of a combined filter are URL-encoded.
+func filterSpec(limit int64, clientFilter string) string {
+	spec := fmt.Sprintf("blob:limit=%d", limit)
+	if clientFilter == "" {
+		return spec
+	}
+	var b strings.Builder
+	for _, c := range []byte(clientFilter) {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte(":=.-_", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return "combine:" + spec + "+" + b.String()
+}
+
+// checkWantedBlobs returns ErrFilteredBlob if one of wants, object IDs or
+// refs, peeled, is a blob
+// over limit bytes in the repo at repoPath. Wants the repo doesn't have are
+// left to upload-pack to refuse.
+func checkWantedBlobs(r *http.Request, repoPath string, wants []string, limit int64) error {
+	if len(wants) == 0 {
+		return nil
+	}
+	var in strings.Builder
+	for _, want := range wants {
+		in.WriteString(want + "^{}\n")
+	}
+	cmd := gitcmd.Command(r.Context(), "-C", repoPath, "cat-file", "--batch-check=%(objecttype) %(objectsize)")
+	cmd.Env = gitEnv("", nil, false)
+	cmd.Stdin = strings.NewReader(in.String())
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("check wanted objects: %w", err)
+	}
+	for i, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		var size int64
+		if _, err := fmt.Sscanf(line, "blob %d", &size); err == nil && size > limit {
+			return fmt.Errorf("%w: %s is %d bytes", ErrFilteredBlob, wants[i], size)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package gitserve
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFilterSpec(t *testing.T) {
+	if got := filterSpec(1024, ""); got != "blob:limit=1024" {
+		t.Fatalf("unexpected spec %q", got)
+	}
+	if got := filterSpec(1024, "combine:blob:none+tree:1"); got != "combine:blob:limit=1024+combine:blob:none%2Btree:1" {
+		t.Fatalf("unexpected combined spec %q", got)
+	}
+}
+
+func TestFilterBlobs(t *testing.T) {
+	repo := newTestRepo(t)
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(gitEnv("", nil, false), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	work := filepath.Join(dir, "work")
+	git("clone", "-q", repo, work)
+	if err := os.WriteFile(filepath.Join(work, "small"), []byte("small"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(work, "large"), []byte(strings.Repeat("large", 1000)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	git("-C", work, "add", ".")
+	git("-C", work, "commit", "-q", "-m", "blobs")
+	git("-C", work, "push", "-q", "origin", "HEAD:main")
+	small, large := git("-C", work, "rev-parse", "HEAD:small"), git("-C", work, "rev-parse", "HEAD:large")
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			_ = ServeInfoRefs(w, r, repo, "", 0, nil, true, "", nil, log)
+			return
+		}
+		if err := FilterBlobs(r, repo, 1024); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		_ = ServeUploadPack(w, r, repo, "", 0, nil, true, nil, nil, log)
+	}))
+	defer srv.Close()
+
+	for _, protocol := range []string{"0", "2"} {
+		t.Run("protocol="+protocol, func(t *testing.T) {
+			clone := filepath.Join(dir, "clone-v"+protocol)
+			// Partial clones accept what the proxy leaves out
+			git("-c", "protocol.version="+protocol, "clone", "-q", "--bare", "--filter=tree:1", srv.URL, clone)
+			missing := git("-C", clone, "rev-list", "--objects", "--missing=print", "--all")
+			if !strings.Contains(missing, "?"+large) {
+				t.Fatalf("expected large blob left out, got\n%s", missing)
+			}
+			// The client's filter still applies: tree:1 leaves out every blob
+			if !strings.Contains(missing, "?"+small) {
+				t.Fatalf("expected client filter applied, got\n%s", missing)
+			}
+		})
+	}
+
+	clone := filepath.Join(dir, "clone")
+	git("clone", "-q", "--bare", "--filter=blob:limit=1m", srv.URL, clone)
+	missing := git("-C", clone, "rev-list", "--objects", "--missing=print", "--all")
+	if !strings.Contains(missing, "?"+large) || strings.Contains(missing, "?"+small) {
+		t.Fatalf("expected only large blob left out, got\n%s", missing)
+	}
+
+	// Blobs wanted by ID, as partial clones fetch missing ones, are refused
+	r := httptest.NewRequest("POST", "/git-upload-pack", strings.NewReader(pinnedFetchBody(large)))
+	if err := FilterBlobs(r, repo, 1024); !errors.Is(err, ErrFilteredBlob) {
+		t.Fatalf("expected ErrFilteredBlob, got %v", err)
+	}
+	git("-C", work, "tag", "large", large)
+	git("-C", work, "push", "-q", "origin", "large")
+	r = httptest.NewRequest("POST", "/git-upload-pack", strings.NewReader(pktLine("command=fetch\n")+"0001"+pktLine("want-ref refs/tags/large\n")+pktLine("done\n")+"0000"))
+	r.Header.Set("Git-Protocol", "version=2")
+	if err := FilterBlobs(r, repo, 1024); !errors.Is(err, ErrFilteredBlob) {
+		t.Fatalf("expected ErrFilteredBlob for ref to large blob, got %v", err)
+	}
+	r = httptest.NewRequest("POST", "/git-upload-pack", strings.NewReader(pinnedFetchBody(small)))
+	if err := FilterBlobs(r, repo, 1024); err != nil {
+		t.Fatalf("expected small blob allowed, got %v", err)
+	}
+}
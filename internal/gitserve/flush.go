@@ -0,0 +1,33 @@
+package gitserve
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// Flushing returns a writer to w that flushes it after every write, so what
+// upload-pack sends reaches the client as it is produced rather than once
+// net/http's buffer fills. git clients show the progress upload-pack sends on
+// sideband 2 (side-band-64k) as it arrives: buffered, a long clone looks hung
+// until the pack starts flowing. Response writers wrapping w must implement
+// Unwrap for the flush to reach it.
+func Flushing(w http.ResponseWriter) io.Writer {
+	return &flushWriter{w: w, rc: http.NewResponseController(w)}
+}
+
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if err := f.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return n, err
+	}
+	return n, nil
+}
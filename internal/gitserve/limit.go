@@ -0,0 +1,111 @@
+package gitserve
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// ErrResponseTooLarge is returned by writes to a LimitedResponse past its limit.
+var ErrResponseTooLarge = errors.New("response exceeds size limit")
+
+// LimitedResponse cuts off a git-upload-pack response once more than Limit
+// bytes have been written. The response is followed as pkt-lines so it is cut
+// at a packet boundary, where the client is sent an error it reports instead
+// of a truncated pack: on the progress sideband once the pack is being sent,
+// as an ERR packet before that. Responses that turn out not to be pkt-lines
+// are just cut.
+type LimitedResponse struct {
+	http.ResponseWriter
+	Limit int64
+
+	written  int64
+	hdr      []byte // Length bytes of the packet being read
+	left     int    // Payload bytes left in the current packet
+	first    bool   // The next payload byte is the first of a packet
+	sideband bool   // Packets carry a sideband channel byte
+	raw      bool   // The response isn't pkt-lines
+	exceeded bool
+}
+
+// LimitResponse wraps w so at most limit bytes of response are sent.
+func LimitResponse(w http.ResponseWriter, limit int64) *LimitedResponse {
+	return &LimitedResponse{ResponseWriter: w, Limit: limit}
+}
+
+// Exceeded reports whether the response was cut off.
+func (l *LimitedResponse) Exceeded() bool {
+	return l.exceeded
+}
+
+func (l *LimitedResponse) Unwrap() http.ResponseWriter {
+	return l.ResponseWriter
+}
+
+// Written returns the number of bytes written through l.
+func (l *LimitedResponse) Written() int64 {
+	return l.written
+}
+
+func (l *LimitedResponse) Write(p []byte) (int, error) {
+	if l.exceeded {
+		return 0, ErrResponseTooLarge
+	}
+	n := 0
+	for len(p) > 0 {
+		if l.written >= l.Limit && (l.raw || (l.left == 0 && len(l.hdr) == 0)) {
+			l.abort()
+			return n, ErrResponseTooLarge
+		}
+		var k int
+		switch {
+		case l.raw:
+			k = len(p)
+		case l.left > 0:
+			k = min(l.left, len(p))
+			if l.first {
+				// Pack data, progress and errors are sent on channels 1 to 3
+				l.sideband = p[0] >= 1 && p[0] <= 3
+				l.first = false
+			}
+			l.left -= k
+		default:
+			k = min(4-len(l.hdr), len(p))
+			l.hdr = append(l.hdr, p[:k]...)
+			if len(l.hdr) == 4 {
+				size, err := strconv.ParseUint(string(l.hdr), 16, 16)
+				switch {
+				case err != nil:
+					l.raw = true
+				case size > 4:
+					l.left, l.first = int(size)-4, true
+				}
+				l.hdr = l.hdr[:0]
+			}
+		}
+		m, err := l.ResponseWriter.Write(p[:k])
+		n += m
+		l.written += int64(m)
+		if err != nil {
+			return n, err
+		}
+		p = p[k:]
+	}
+	return n, nil
+}
+
+// abort sends the client an error explaining why the response ends.
+func (l *LimitedResponse) abort() {
+	l.exceeded = true
+	if l.raw {
+		return
+	}
+	msg := fmt.Sprintf("smart-git-proxy: response exceeds the %d byte limit for this repository, clone it from upstream directly\n", l.Limit)
+	if l.sideband {
+		msg = "\x03" + msg
+	} else {
+		msg = "ERR " + msg
+	}
+	_, _ = fmt.Fprintf(l.ResponseWriter, "%04x%s", len(msg)+4, msg)
+}
@@ -0,0 +1,57 @@
+package gitserve
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitedResponse(t *testing.T) {
+	data := "\x01" + strings.Repeat("p", 95)
+	stream := "0008NAK\n" + "0064" + data + "0064" + data + "0000"
+
+	for name, chunk := range map[string]int{"whole": len(stream), "bytewise": 1} {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			lw := LimitResponse(w, 20)
+			var err error
+			for s := stream; s != "" && err == nil; {
+				n := min(chunk, len(s))
+				_, err = lw.Write([]byte(s[:n]))
+				s = s[n:]
+			}
+			if !errors.Is(err, ErrResponseTooLarge) || !lw.Exceeded() {
+				t.Fatalf("expected the response to be cut off, got %v", err)
+			}
+			// Cut after the packet crossing the limit, with an error on the progress channel
+			got := w.Body.String()
+			if !strings.HasPrefix(got, "0008NAK\n0064"+data+"006e\x03smart-git-proxy: response exceeds the 20 byte limit") {
+				t.Fatalf("unexpected response: %q", got)
+			}
+		})
+	}
+
+	// Errors before any sideband packet use ERR
+	w := httptest.NewRecorder()
+	lw := LimitResponse(w, 4)
+	if _, err := lw.Write([]byte("0008NAK\n0008NAK\n")); !errors.Is(err, ErrResponseTooLarge) {
+		t.Fatalf("expected the response to be cut off, got %v", err)
+	}
+	if got := w.Body.String(); !strings.HasPrefix(got, "0008NAK\n0070ERR smart-git-proxy:") {
+		t.Fatalf("unexpected response: %q", got)
+	}
+
+	// Anything else is just cut
+	w = httptest.NewRecorder()
+	lw = LimitResponse(w, 4)
+	if _, err := lw.Write([]byte("PACK")); err != nil {
+		t.Fatalf("write within limit: %v", err)
+	}
+	if _, err := lw.Write([]byte("more")); !errors.Is(err, ErrResponseTooLarge) {
+		t.Fatalf("expected the response to be cut off, got %v", err)
+	}
+	if got := w.Body.String(); got != "PACK" {
+		t.Fatalf("unexpected response: %q", got)
+	}
+}
@@ -0,0 +1,147 @@
+package gitserve
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// ErrCorruptPack is returned for upload-pack responses whose pack doesn't
+// match its trailing checksum, or is cut short.
+var ErrCorruptPack = errors.New("corrupt pack")
+
+// PackVerify has upload-pack responses buffered and checked with
+// CheckPackResponse before they are served, rather than streamed.
+type PackVerify struct {
+	Dir       string // Where responses are buffered, empty for the system temp dir
+	Attempts  int    // Times a pack is generated before giving up on it, zero means once
+	OnCorrupt func() // Called for each corrupt pack, if set
+}
+
+// CheckPackResponse reads an upload-pack response to the end, protocol v0 or
+// v2, and checks the pack it carries, if any, against its trailing SHA-1.
+// That catches packs corrupted or cut short on their way, without the cost
+// of indexing them (which thin packs can't be without their bases anyway).
+func CheckPackResponse(rd io.Reader) error {
+	var pack packChecker
+	var hdr [4]byte
+	for {
+		if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+			if err == io.EOF {
+				return pack.check()
+			}
+			return fmt.Errorf("%w: response cut short: %w", ErrCorruptPack, err)
+		}
+		// Without a side-band, the pack follows the negotiation as is
+		if string(hdr[:]) == "PACK" {
+			pack.Write(hdr[:])
+			if _, err := io.Copy(&pack, rd); err != nil {
+				return fmt.Errorf("%w: %w", ErrCorruptPack, err)
+			}
+			return pack.check()
+		}
+		n, err := strconv.ParseUint(string(hdr[:]), 16, 16)
+		if err != nil {
+			return fmt.Errorf("%w: invalid pkt-line header %q", ErrCorruptPack, hdr)
+		}
+		if n <= 4 {
+			continue // Flush, delimiter and response end packets
+		}
+		payload := make([]byte, n-4)
+		if _, err := io.ReadFull(rd, payload); err != nil {
+			return fmt.Errorf("%w: response cut short: %w", ErrCorruptPack, err)
+		}
+		// Pack data goes on band 1, which no other line starts with
+		if payload[0] == 1 {
+			pack.Write(payload[1:])
+		}
+	}
+}
+
+// packChecker hashes a pack as it is written, but for the checksum at its end.
+type packChecker struct {
+	h    hash.Hash
+	head []byte // First bytes, up to the version
+	tail []byte // Last sha1.Size bytes written, not hashed yet
+	n    int64
+}
+
+func (p *packChecker) Write(b []byte) (int, error) {
+	if p.h == nil {
+		p.h = sha1.New()
+	}
+	if len(p.head) < 8 {
+		p.head = append(p.head, b[:min(8-len(p.head), len(b))]...)
+	}
+	p.n += int64(len(b))
+	p.tail = append(p.tail, b...)
+	if extra := len(p.tail) - sha1.Size; extra > 0 {
+		p.h.Write(p.tail[:extra])
+		p.tail = append(p.tail[:0], p.tail[extra:]...)
+	}
+	return len(b), nil
+}
+
+// check reports whether what was written is a whole pack, if anything was.
+func (p *packChecker) check() error {
+	if p.n == 0 {
+		return nil
+	}
+	// Signature, version, object count and checksum
+	if p.n < 12+sha1.Size || !bytes.HasPrefix(p.head, []byte("PACK")) || (p.head[7] != 2 && p.head[7] != 3) {
+		return fmt.Errorf("%w: invalid pack of %d bytes", ErrCorruptPack, p.n)
+	}
+	if !bytes.Equal(p.h.Sum(nil), p.tail) {
+		return fmt.Errorf("%w: checksum mismatch over %d bytes", ErrCorruptPack, p.n)
+	}
+	return nil
+}
+
+// verifiedUploadPack runs the upload-pack command newCmd returns, reading the
+// request from in, into a temp file until its response passes
+// CheckPackResponse, and returns that file rewound. The request is kept to
+// be replayed to the next attempts.
+func verifiedUploadPack(in io.Reader, newCmd func() *exec.Cmd, verify *PackVerify) (*os.File, error) {
+	var req bytes.Buffer
+	src := io.TeeReader(in, &req)
+	for attempt := 1; ; attempt++ {
+		f, err := os.CreateTemp(verify.Dir, "pack-verify-*")
+		if err != nil {
+			return nil, fmt.Errorf("buffer pack: %w", err)
+		}
+		os.Remove(f.Name())
+
+		cmd := newCmd()
+		cmd.Stdin = src
+		cmd.Stdout = f
+		var stderrBuf bytes.Buffer
+		cmd.Stderr = &stderrBuf
+		if err := cmd.Run(); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("git upload-pack: %w, stderr: %s", err, stderrBuf.String())
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if err == nil {
+			err = CheckPackResponse(f)
+		}
+		if err == nil {
+			if _, err = f.Seek(0, io.SeekStart); err == nil {
+				return f, nil
+			}
+		}
+		f.Close()
+		if errors.Is(err, ErrCorruptPack) && verify.OnCorrupt != nil {
+			verify.OnCorrupt()
+		}
+		if !errors.Is(err, ErrCorruptPack) || attempt >= verify.Attempts {
+			return nil, err
+		}
+		src = bytes.NewReader(req.Bytes())
+	}
+}
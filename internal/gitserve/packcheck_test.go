@@ -0,0 +1,119 @@
+package gitserve
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fetchResponse returns the response of the repo at repoPath to a fetch of
+// its HEAD, with the pack on a side-band or not.
+func fetchResponse(t *testing.T, repoPath string, sideBand bool) []byte {
+	t.Helper()
+	sha := headSHA(t, repoPath)
+	body := pinnedFetchBody(sha)
+	if sideBand {
+		body = pktLine("want "+sha+" side-band-64k no-progress ofs-delta\n") + "0000" + pktLine("done\n")
+	}
+	r := httptest.NewRequest("POST", "/git-upload-pack", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := ServeUploadPack(w, r, repoPath, "", 0, nil, false, nil, nil, log); err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+	return w.Body.Bytes()
+}
+
+func TestCheckPackResponse(t *testing.T) {
+	repo := newTestRepo(t)
+	for _, sideBand := range []bool{false, true} {
+		t.Run(fmt.Sprintf("side-band=%v", sideBand), func(t *testing.T) {
+			resp := fetchResponse(t, repo, sideBand)
+			if !bytes.Contains(resp, []byte("PACK")) {
+				t.Fatalf("expected a pack in the response, got %q", resp)
+			}
+			if err := CheckPackResponse(bytes.NewReader(resp)); err != nil {
+				t.Fatalf("expected intact response to pass, got %v", err)
+			}
+
+			// A byte flipped in the pack, before its trailer and final flush
+			flipped := bytes.Clone(resp)
+			flipped[len(flipped)-30] ^= 0xff
+			if err := CheckPackResponse(bytes.NewReader(flipped)); !errors.Is(err, ErrCorruptPack) {
+				t.Fatalf("expected flipped byte to be caught, got %v", err)
+			}
+			truncated := resp[:len(resp)-10]
+			if err := CheckPackResponse(bytes.NewReader(truncated)); !errors.Is(err, ErrCorruptPack) {
+				t.Fatalf("expected truncated response to be caught, got %v", err)
+			}
+		})
+	}
+
+	// Responses without a pack, like ls-refs, have nothing to check
+	if err := CheckPackResponse(strings.NewReader(pktLine("0000000000000000000000000000000000000000 HEAD\n") + "0000")); err != nil {
+		t.Fatalf("expected response without a pack to pass, got %v", err)
+	}
+}
+
+func TestVerifiedUploadPack(t *testing.T) {
+	resp := fetchResponse(t, newTestRepo(t), true)
+	corrupt := bytes.Clone(resp)
+	corrupt[len(corrupt)-30] ^= 0xff
+
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{"good": resp, "corrupt": corrupt} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	// Each run records the request it got and answers with the next response
+	run := func(t *testing.T, responses []string, attempts int) (*os.File, int, error) {
+		var runs, corrupted int
+		newCmd := func() *exec.Cmd {
+			runs++
+			script := fmt.Sprintf("cat >%q; cat %q", filepath.Join(dir, fmt.Sprintf("req-%d", runs)), filepath.Join(dir, responses[runs-1]))
+			return exec.Command("sh", "-c", script)
+		}
+		verify := &PackVerify{Dir: dir, Attempts: attempts, OnCorrupt: func() { corrupted++ }}
+		f, err := verifiedUploadPack(strings.NewReader("request"), newCmd, verify)
+		if runs != len(responses) {
+			t.Fatalf("expected %d runs, got %d", len(responses), runs)
+		}
+		return f, corrupted, err
+	}
+
+	t.Run("retried", func(t *testing.T) {
+		f, corrupted, err := run(t, []string{"corrupt", "good"}, 2)
+		if err != nil {
+			t.Fatalf("verify: %v", err)
+		}
+		defer f.Close()
+		if got, _ := io.ReadAll(f); !bytes.Equal(got, resp) {
+			t.Fatalf("expected the intact response to be served")
+		}
+		if corrupted != 1 {
+			t.Fatalf("expected 1 corrupt pack reported, got %d", corrupted)
+		}
+		if req, _ := os.ReadFile(filepath.Join(dir, "req-2")); string(req) != "request" {
+			t.Fatalf("expected the request to be replayed, got %q", req)
+		}
+	})
+
+	t.Run("exhausted", func(t *testing.T) {
+		_, corrupted, err := run(t, []string{"corrupt", "corrupt"}, 2)
+		if !errors.Is(err, ErrCorruptPack) {
+			t.Fatalf("expected ErrCorruptPack, got %v", err)
+		}
+		if corrupted != 2 {
+			t.Fatalf("expected 2 corrupt packs reported, got %d", corrupted)
+		}
+	})
+}
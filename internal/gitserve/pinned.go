@@ -0,0 +1,278 @@
+package gitserve
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxPinnedRequest bounds how much of a (decompressed) request body is read to
+// decide whether it is a pinned-commit fetch. Such requests are a few hundred
+// bytes; anything larger is streamed to upload-pack uncached.
+const maxPinnedRequest = 64 << 10
+
+// PackCacheEntry locates the cached response of a pinned-commit fetch. Entries
+// are stored as {Dir}/{Key}-{sha256 of contents}.pack, so a pack and its
+// checksum are always published together by a single rename.
+type PackCacheEntry struct {
+	Dir string
+	Key string
+
+	DirMode  os.FileMode // Mode Dir is created with, zero means 0755
+	FileMode os.FileMode // Mode of stored packs, zero keeps them private (0600)
+
+	SkipVerify  bool   // Serve packs without checking them against their digest first
+	OnCorrupt   func() // Called for each cached pack failing its integrity check, if set
+	ContentType string // Of the cached responses, zero means upload-pack results
+	Ranges      bool   // Serve byte ranges of cached responses to Range requests, for resuming downloads
+}
+
+// PinnedPackKey reports whether an upload-pack request fetches a single commit
+// by SHA from scratch (one want, no haves, done), whose response can be cached
+// and replayed byte-for-byte. The key hashes the whole request, so capabilities,
+// depth and filters are part of it. The body is replaced with an equivalent
+// (decompressed) reader, or left as sent if it isn't valid gzip.
+func PinnedPackKey(r *http.Request) (string, bool) {
+	orig := r.Body
+	body, err := decodedBody(r)
+	if err != nil {
+		return "", false
+	}
+
+	// Everything read while deciding is replayed ahead of the remaining body
+	br := bufio.NewReader(body)
+	data, err := io.ReadAll(io.LimitReader(br, maxPinnedRequest+1))
+	r.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(data), br), Closer: orig}
+	if err != nil || len(data) > maxPinnedRequest {
+		return "", false
+	}
+
+	wants, done := 0, false
+	rd := bytes.NewReader(data)
+	for rd.Len() > 0 {
+		line, special, err := readPktLine(rd)
+		if err != nil {
+			return "", false
+		}
+		if special != pktData {
+			continue
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "want "):
+			wants++
+		case strings.HasPrefix(line, "have "), strings.HasPrefix(line, "want-ref "):
+			// Depends on client or ref state, not just the commit
+			return "", false
+		case line == "done":
+			done = true
+		}
+	}
+	if wants != 1 || !done {
+		return "", false
+	}
+
+	h := sha256.New()
+	io.WriteString(h, r.Header.Get("Git-Protocol")+"\n")
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// ServeCachedPack replays the cached response for entry to r after checking
+// its contents against the digest in its file name, unless entry.SkipVerify.
+// Corrupt files are removed, so the pack is generated and recorded again.
+// With entry.Ranges, Range requests get the bytes they ask for, the digest
+// serving as ETag for If-Range. It returns false if nothing was served.
+func ServeCachedPack(w http.ResponseWriter, r *http.Request, entry PackCacheEntry, cacheStatus string, log *slog.Logger) (bool, error) {
+	for _, name := range entry.files() {
+		path := filepath.Join(entry.Dir, name)
+		f, err := os.Open(path)
+		if err != nil {
+			// Replaced by a concurrent recorder since listing
+			continue
+		}
+		digest := entry.digest(name)
+		var rangeReq *http.Request
+		if entry.Ranges && r != nil {
+			etag := `"` + digest + `"`
+			w.Header().Set("ETag", etag)
+			rangeReq = r
+			// net/http only honors If-Range on GETs, and archives are POSTed:
+			// downloads resumed from another response start over
+			if ifRange := r.Header.Get("If-Range"); ifRange != "" && ifRange != etag {
+				rangeReq = nil
+			}
+		}
+		if entry.SkipVerify {
+			digest = ""
+		}
+		served, err := serveVerifiedPack(w, rangeReq, f, digest, entry.ContentType, cacheStatus)
+		f.Close()
+		if err != nil {
+			return served, err
+		}
+		if served {
+			log.Debug("served cached pack", "path", path)
+			return true, nil
+		}
+		w.Header().Del("ETag")
+		log.Warn("cached pack failed integrity check, discarding", "path", path)
+		_ = os.Remove(path)
+		if entry.OnCorrupt != nil {
+			entry.OnCorrupt()
+		}
+	}
+	return false, nil
+}
+
+// serveVerifiedPack serves f if its contents hash to digest, or right away if
+// digest is empty. The byte ranges r asks for are served, unless r is nil.
+func serveVerifiedPack(w http.ResponseWriter, r *http.Request, f *os.File, digest, contentType, cacheStatus string) (bool, error) {
+	var size int64
+	if digest == "" {
+		info, err := f.Stat()
+		if err != nil {
+			return false, fmt.Errorf("stat cached pack: %w", err)
+		}
+		size = info.Size()
+	} else {
+		h := sha256.New()
+		n, err := io.Copy(h, f)
+		if err != nil {
+			return false, fmt.Errorf("read cached pack: %w", err)
+		}
+		if hex.EncodeToString(h.Sum(nil)) != digest {
+			return false, nil
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return false, fmt.Errorf("rewind cached pack: %w", err)
+		}
+		size = n
+	}
+
+	if contentType == "" {
+		contentType = PackResultType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	if cacheStatus != "" {
+		w.Header().Set("X-Git-Proxy-Status", cacheStatus)
+	}
+	if r != nil {
+		info, err := f.Stat()
+		if err != nil {
+			return false, fmt.Errorf("stat cached pack: %w", err)
+		}
+		http.ServeContent(w, r, "", info.ModTime(), f)
+		return true, nil
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, f); err != nil {
+		return true, fmt.Errorf("write cached pack: %w", err)
+	}
+	return true, nil
+}
+
+// files lists the cached packs for the entry's key.
+func (e PackCacheEntry) files() []string {
+	dirents, err := os.ReadDir(e.Dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, d := range dirents {
+		if strings.HasPrefix(d.Name(), e.Key+"-") && strings.HasSuffix(d.Name(), ".pack") {
+			names = append(names, d.Name())
+		}
+	}
+	return names
+}
+
+func (e PackCacheEntry) digest(name string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(name, e.Key+"-"), ".pack")
+}
+
+// packRecorder copies an upload-pack response into a temp file in the cache
+// dir, giving up quietly on write errors so the client response is never affected.
+type packRecorder struct {
+	entry PackCacheEntry
+	f     *os.File
+	hash  hash.Hash
+	err   error
+}
+
+func newPackRecorder(entry PackCacheEntry) (*packRecorder, error) {
+	if _, err := os.Stat(entry.Dir); os.IsNotExist(err) {
+		mode := entry.DirMode
+		if mode == 0 {
+			mode = 0o755
+		}
+		if err := os.Mkdir(entry.Dir, mode); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+		// Not subject to the umask, like the rest of the mirror
+		if err := os.Chmod(entry.Dir, mode); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.CreateTemp(entry.Dir, ".pack-*")
+	if err != nil {
+		return nil, err
+	}
+	if entry.FileMode != 0 {
+		if err := f.Chmod(entry.FileMode); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return nil, err
+		}
+	}
+	return &packRecorder{entry: entry, f: f, hash: sha256.New()}, nil
+}
+
+func (p *packRecorder) Write(b []byte) (int, error) {
+	if p.err == nil {
+		if _, p.err = p.f.Write(b); p.err == nil {
+			p.hash.Write(b)
+		}
+	}
+	return len(b), nil
+}
+
+// commit publishes the recorded response under its digest, or discards it if
+// ok is false or recording failed. Entries left by concurrent recorders for the
+// same key (upload-pack output isn't always byte-identical) are replaced.
+func (p *packRecorder) commit(ok bool) error {
+	tmp := p.f.Name()
+	defer os.Remove(tmp)
+	if err := p.f.Close(); err != nil && p.err == nil {
+		p.err = err
+	}
+	if !ok {
+		return nil
+	}
+	if p.err != nil {
+		return p.err
+	}
+
+	name := p.entry.Key + "-" + hex.EncodeToString(p.hash.Sum(nil)) + ".pack"
+	if err := os.Rename(tmp, filepath.Join(p.entry.Dir, name)); err != nil {
+		return err
+	}
+	for _, other := range p.entry.files() {
+		if other != name {
+			_ = os.Remove(filepath.Join(p.entry.Dir, other))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package gitserve
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// pinnedFetchBody is a protocol v0 request for a single commit with no haves.
+func pinnedFetchBody(sha string) string {
+	return pktLine("want "+sha+" no-progress ofs-delta\n") + "0000" + pktLine("done\n")
+}
+
+func headSHA(t *testing.T, repoPath string) string {
+	t.Helper()
+	out, err := exec.Command("git", "-C", repoPath, "rev-parse", "HEAD").Output()
+	if err != nil {
+		t.Fatalf("rev-parse: %v", err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestPinnedPackKey(t *testing.T) {
+	sha := strings.Repeat("a", 40)
+	pinned := pinnedFetchBody(sha)
+	tests := []struct {
+		name     string
+		body     string
+		encoding string
+		want     bool
+	}{
+		{"single want", pinned, "", true},
+		{"two wants", pktLine("want "+sha+"\n") + pktLine("want "+strings.Repeat("b", 40)+"\n") + "0000" + pktLine("done\n"), "", false},
+		{"with haves", pktLine("want "+sha+"\n") + "0000" + pktLine("have "+strings.Repeat("b", 40)+"\n") + pktLine("done\n"), "", false},
+		{"negotiation round", pktLine("want "+sha+"\n") + "0000", "", false},
+		{"oversized", pinned + strings.Repeat("0000", maxPinnedRequest), "", false},
+		{"invalid gzip", "not gzip", "gzip", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/git-upload-pack", strings.NewReader(tt.body))
+			r.Header.Set("Content-Encoding", tt.encoding)
+			_, ok := PinnedPackKey(r)
+			if ok != tt.want {
+				t.Fatalf("PinnedPackKey = %v, want %v", ok, tt.want)
+			}
+			replayed, _ := io.ReadAll(r.Body)
+			if string(replayed) != tt.body {
+				t.Fatalf("body not replayed intact")
+			}
+		})
+	}
+
+	// Gzip-encoded requests get the same key as plain ones
+	plain := httptest.NewRequest("POST", "/git-upload-pack", strings.NewReader(pinned))
+	plainKey, _ := PinnedPackKey(plain)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(pinned))
+	gz.Close()
+	compressed := httptest.NewRequest("POST", "/git-upload-pack", &buf)
+	compressed.Header.Set("Content-Encoding", "gzip")
+	if key, ok := PinnedPackKey(compressed); !ok || key != plainKey {
+		t.Fatalf("expected gzip request to share key %s, got %s (%v)", plainKey, key, ok)
+	}
+}
+
+func TestPinnedPackCache(t *testing.T) {
+	repoPath := newTestRepo(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	body := pinnedFetchBody(headSHA(t, repoPath))
+
+	r := httptest.NewRequest("POST", "/git-upload-pack", strings.NewReader(body))
+	key, ok := PinnedPackKey(r)
+	if !ok {
+		t.Fatalf("expected pinned request")
+	}
+	entry := PackCacheEntry{Dir: filepath.Join(t.TempDir(), "pinned-packs"), Key: key}
+
+	// Miss: nothing cached yet, so the pack is generated and recorded
+	if served, err := ServeCachedPack(httptest.NewRecorder(), nil, entry, "", log); served || err != nil {
+		t.Fatalf("expected miss, got served=%v err=%v", served, err)
+	}
+	first := httptest.NewRecorder()
+	if err := ServeUploadPack(first, r, repoPath, "", 0, nil, true, &entry, nil, log); err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+	if files := entry.files(); len(files) != 1 {
+		t.Fatalf("expected one cached pack, got %v", files)
+	}
+
+	// Hit: replayed byte-for-byte, whole as it is an upload-pack response
+	hit := httptest.NewRecorder()
+	ranged := httptest.NewRequest("POST", "/git-upload-pack", nil)
+	ranged.Header.Set("Range", "bytes=0-9")
+	if served, err := ServeCachedPack(hit, ranged, entry, "pinned-pack-hit", log); !served || err != nil || hit.Code != http.StatusOK {
+		t.Fatalf("expected hit, got served=%v err=%v", served, err)
+	}
+	if !bytes.Equal(hit.Body.Bytes(), first.Body.Bytes()) {
+		t.Fatalf("cached response differs from original")
+	}
+	if hit.Header().Get("X-Git-Proxy-Status") != "pinned-pack-hit" {
+		t.Fatalf("expected cache status header")
+	}
+
+	// Unverified: served as stored
+	path := filepath.Join(entry.Dir, entry.files()[0])
+	if err := os.WriteFile(path, []byte("garbage"), 0o644); err != nil {
+		t.Fatalf("corrupt: %v", err)
+	}
+	trusted := entry
+	trusted.SkipVerify = true
+	unverified := httptest.NewRecorder()
+	if served, err := ServeCachedPack(unverified, nil, trusted, "", log); !served || err != nil || unverified.Body.String() != "garbage" {
+		t.Fatalf("expected unverified hit, got served=%v err=%v body=%q", served, err, unverified.Body.String())
+	}
+
+	// Corrupt: checksum mismatch is discarded instead of served
+	corrupted := 0
+	entry.OnCorrupt = func() { corrupted++ }
+	corrupt := httptest.NewRecorder()
+	if served, err := ServeCachedPack(corrupt, nil, entry, "", log); served || err != nil {
+		t.Fatalf("expected corrupt entry to be a miss, got served=%v err=%v", served, err)
+	}
+	if corrupt.Body.Len() != 0 {
+		t.Fatalf("expected nothing written for corrupt entry")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected corrupt entry to be removed")
+	}
+	if corrupted != 1 {
+		t.Fatalf("expected one corrupt entry reported, got %d", corrupted)
+	}
+}
+
+func TestPinnedPackConcurrentWriters(t *testing.T) {
+	repoPath := newTestRepo(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	body := pinnedFetchBody(headSHA(t, repoPath))
+	key, _ := PinnedPackKey(httptest.NewRequest("POST", "/git-upload-pack", strings.NewReader(body)))
+	entry := PackCacheEntry{Dir: filepath.Join(t.TempDir(), "pinned-packs"), Key: key}
+
+	var wg sync.WaitGroup
+	responses := make([][]byte, 8)
+	for i := range responses {
+		wg.Go(func() {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/git-upload-pack", strings.NewReader(body))
+			if err := ServeUploadPack(w, r, repoPath, "", 2, nil, true, &entry, nil, log); err != nil {
+				t.Errorf("serve: %v", err)
+			}
+			responses[i] = w.Body.Bytes()
+		})
+	}
+	wg.Wait()
+
+	// Whichever recorder won, the cache holds one self-consistent entry
+	files := entry.files()
+	if len(files) != 1 {
+		t.Fatalf("expected exactly one cached pack, got %v", files)
+	}
+	hit := httptest.NewRecorder()
+	if served, err := ServeCachedPack(hit, nil, entry, "", log); !served || err != nil {
+		t.Fatalf("expected hit, got served=%v err=%v", served, err)
+	}
+	for _, resp := range responses {
+		if bytes.Equal(resp, hit.Body.Bytes()) {
+			return
+		}
+	}
+	t.Fatalf("cached pack matches none of the generated responses")
+}
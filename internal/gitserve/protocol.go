@@ -0,0 +1,201 @@
+package gitserve
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// V2Request describes the command section of a protocol v2 upload-pack request.
+type V2Request struct {
+	Command     string   // e.g. "ls-refs" or "fetch"
+	RefPrefixes []string // ref-prefix arguments of an ls-refs command
+	Args        []string // Other arguments of an ls-refs command, e.g. "symrefs"
+	Wants       []string // Object IDs wanted by a fetch command
+	WantRefs    []string // Refs wanted by name by a fetch command (ref-in-want)
+}
+
+// HeadOnly reports whether req is an ls-refs request for HEAD alone, which
+// ServeHeadRef can answer without running upload-pack.
+func (req *V2Request) HeadOnly() bool {
+	if req.Command != "ls-refs" || len(req.RefPrefixes) != 1 || req.RefPrefixes[0] != "HEAD" {
+		return false
+	}
+	for _, arg := range req.Args {
+		if arg != "symrefs" && arg != "peel" && arg != "unborn" {
+			return false
+		}
+	}
+	return true
+}
+
+// ServeHeadRef answers a HeadOnly ls-refs request from an already resolved
+// HEAD, producing the same response as git upload-pack. HEAD always points
+// at a commit, so there is nothing to peel.
+func ServeHeadRef(w http.ResponseWriter, req *V2Request, ref, sha, cacheStatus string) error {
+	line := sha + " HEAD"
+	if ref != "" && slices.Contains(req.Args, "symrefs") {
+		line += " symref-target:" + ref
+	}
+	w.Header().Set("Content-Type", PackResultType)
+	w.Header().Set("Cache-Control", "no-store")
+	if cacheStatus != "" {
+		w.Header().Set("X-Git-Proxy-Status", cacheStatus)
+	}
+	_, err := io.WriteString(w, pktLine(line+"\n")+"0000")
+	return err
+}
+
+// pktLine encodes s as a pkt-line.
+func pktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
+// IsV2 returns true if the client negotiated Git protocol version 2.
+func IsV2(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Git-Protocol"), "version=2")
+}
+
+// PeekV2Request parses the command of a protocol v2 request without consuming it.
+// The request body is replaced with an equivalent (decompressed) reader so it can
+// still be streamed to git upload-pack unchanged, which applies ref-prefix
+// filtering natively when listing refs from the mirror.
+func PeekV2Request(r *http.Request) (*V2Request, error) {
+	orig := r.Body
+	body, err := decodedBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Everything read while parsing is replayed ahead of the remaining body
+	var consumed bytes.Buffer
+	br := bufio.NewReader(body)
+	req, err := parseV2Request(io.TeeReader(br, &consumed))
+	r.Body = readCloser{Reader: io.MultiReader(&consumed, br), Closer: orig}
+	return req, err
+}
+
+// decodedBody returns r's body with any gzip encoding removed, clearing the
+// Content-Encoding header. If the gzip header is invalid, r is left exactly as
+// the client sent it so the error surfaces where the body is finally consumed.
+func decodedBody(r *http.Request) (io.Reader, error) {
+	if !strings.Contains(r.Header.Get("Content-Encoding"), "gzip") {
+		return r.Body, nil
+	}
+	orig := r.Body
+	rec := &recordingReader{r: orig, buf: &bytes.Buffer{}}
+	gz, err := gzip.NewReader(rec)
+	if err != nil {
+		r.Body = readCloser{Reader: io.MultiReader(rec.buf, orig), Closer: orig}
+		return nil, fmt.Errorf("gzip reader: %w", err)
+	}
+	rec.buf = nil
+	r.Header.Del("Content-Encoding")
+	return gz, nil
+}
+
+// recordingReader keeps a copy of what is read through it while buf is set.
+type recordingReader struct {
+	r   io.Reader
+	buf *bytes.Buffer
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if rr.buf != nil {
+		rr.buf.Write(p[:n])
+	}
+	return n, err
+}
+
+// parseV2Request reads the command line, capabilities and, for ls-refs, the
+// arguments. Of fetch arguments, only the wants are read: git sends them
+// first, and the haves that follow can be many.
+func parseV2Request(rd io.Reader) (*V2Request, error) {
+	req := &V2Request{}
+	inArgs := false
+	for {
+		line, special, err := readPktLine(rd)
+		if err != nil {
+			return req, err
+		}
+		switch special {
+		case pktFlush:
+			return req, nil
+		case pktDelim:
+			if req.Command != "ls-refs" && req.Command != "fetch" {
+				return req, nil
+			}
+			inArgs = true
+			continue
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case req.Command == "":
+			cmd, ok := strings.CutPrefix(line, "command=")
+			if !ok {
+				return req, fmt.Errorf("expected command, got %q", line)
+			}
+			req.Command = cmd
+		case inArgs && req.Command == "fetch":
+			if oid, ok := strings.CutPrefix(line, "want "); ok {
+				req.Wants = append(req.Wants, oid)
+			} else if ref, ok := strings.CutPrefix(line, "want-ref "); ok {
+				req.WantRefs = append(req.WantRefs, ref)
+			} else if strings.HasPrefix(line, "have ") || line == "done" {
+				return req, nil
+			}
+		case inArgs:
+			if prefix, ok := strings.CutPrefix(line, "ref-prefix "); ok {
+				req.RefPrefixes = append(req.RefPrefixes, prefix)
+			} else {
+				req.Args = append(req.Args, line)
+			}
+		}
+	}
+}
+
+const (
+	pktData = iota
+	pktFlush
+	pktDelim
+	pktResponseEnd
+)
+
+// readPktLine reads a single pkt-line, returning its payload or the special packet kind.
+func readPktLine(rd io.Reader) (string, int, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+		return "", 0, fmt.Errorf("read pkt-line header: %w", err)
+	}
+	n, err := strconv.ParseUint(string(hdr[:]), 16, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid pkt-line header %q", hdr)
+	}
+	switch n {
+	case 0:
+		return "", pktFlush, nil
+	case 1:
+		return "", pktDelim, nil
+	case 2:
+		return "", pktResponseEnd, nil
+	case 3:
+		return "", 0, fmt.Errorf("invalid pkt-line length %d", n)
+	}
+	payload := make([]byte, n-4)
+	if _, err := io.ReadFull(rd, payload); err != nil {
+		return "", 0, fmt.Errorf("read pkt-line payload: %w", err)
+	}
+	return string(payload), pktData, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,171 @@
+package gitserve
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func lsRefsBody(prefixes ...string) string {
+	body := pktLine("command=ls-refs\n") + pktLine("agent=git/test\n") + "0001" + pktLine("symrefs\n")
+	for _, p := range prefixes {
+		body += pktLine("ref-prefix " + p + "\n")
+	}
+	return body + "0000"
+}
+
+// newTestRepo creates a bare repo with a couple of branches and a tag.
+func newTestRepo(t testing.TB) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	dir := t.TempDir()
+	work := filepath.Join(dir, "work")
+	bare := filepath.Join(dir, "repo.git")
+	run := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(gitEnv("", nil, true), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	run("init", "-q", "-b", "main", work)
+	run("-C", work, "commit", "-q", "--allow-empty", "-m", "initial")
+	run("-C", work, "branch", "feature")
+	run("-C", work, "tag", "v1.0.0")
+	run("clone", "-q", "--bare", work, bare)
+	return bare
+}
+
+func TestPeekV2Request(t *testing.T) {
+	body := lsRefsBody("refs/heads/", "HEAD")
+	r := httptest.NewRequest("POST", "/git-upload-pack", strings.NewReader(body))
+	r.Header.Set("Git-Protocol", "version=2")
+
+	req, err := PeekV2Request(r)
+	if err != nil {
+		t.Fatalf("peek: %v", err)
+	}
+	if req.Command != "ls-refs" {
+		t.Fatalf("expected ls-refs, got %q", req.Command)
+	}
+	if len(req.RefPrefixes) != 2 || req.RefPrefixes[0] != "refs/heads/" || req.RefPrefixes[1] != "HEAD" {
+		t.Fatalf("unexpected ref prefixes: %v", req.RefPrefixes)
+	}
+
+	// Body must be replayed unchanged
+	replayed, _ := io.ReadAll(r.Body)
+	if string(replayed) != body {
+		t.Fatalf("body not replayed:\ngot  %q\nwant %q", replayed, body)
+	}
+}
+
+func TestPeekV2RequestGzip(t *testing.T) {
+	body := pktLine("command=fetch\n") + "0001" + pktLine("want 0000000000000000000000000000000000000000\n") + "0000"
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write([]byte(body))
+	_ = zw.Close()
+
+	r := httptest.NewRequest("POST", "/git-upload-pack", &gz)
+	r.Header.Set("Content-Encoding", "gzip")
+
+	req, err := PeekV2Request(r)
+	if err != nil {
+		t.Fatalf("peek: %v", err)
+	}
+	if req.Command != "fetch" {
+		t.Fatalf("expected fetch, got %q", req.Command)
+	}
+	if r.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("expected Content-Encoding to be cleared after decoding")
+	}
+	replayed, _ := io.ReadAll(r.Body)
+	if string(replayed) != body {
+		t.Fatalf("body not replayed:\ngot  %q\nwant %q", replayed, body)
+	}
+}
+
+func TestPeekV2RequestInvalidGzip(t *testing.T) {
+	body := "not gzip at all"
+	r := httptest.NewRequest("POST", "/git-upload-pack", strings.NewReader(body))
+	r.Header.Set("Content-Encoding", "gzip")
+
+	if _, err := PeekV2Request(r); err == nil {
+		t.Fatalf("expected error for invalid gzip body")
+	}
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected Content-Encoding to be kept when decoding fails")
+	}
+	replayed, _ := io.ReadAll(r.Body)
+	if string(replayed) != body {
+		t.Fatalf("body not restored:\ngot  %q\nwant %q", replayed, body)
+	}
+}
+
+func TestServeUploadPackLsRefsPrefix(t *testing.T) {
+	repoPath := newTestRepo(t)
+
+	r := httptest.NewRequest("POST", "/git-upload-pack", strings.NewReader(lsRefsBody("refs/tags/")))
+	r.Header.Set("Git-Protocol", "version=2")
+	if _, err := PeekV2Request(r); err != nil {
+		t.Fatalf("peek: %v", err)
+	}
+	w := httptest.NewRecorder()
+	if err := ServeUploadPack(w, r, repoPath, "", 0, nil, true, nil, nil, slog.New(slog.NewTextHandler(io.Discard, nil))); err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+
+	out := w.Body.String()
+	if !strings.Contains(out, "refs/tags/v1.0.0") {
+		t.Fatalf("expected tag in ls-refs output:\n%s", out)
+	}
+	if strings.Contains(out, "refs/heads/") {
+		t.Fatalf("expected ref-prefix to filter out branches:\n%s", out)
+	}
+}
+
+func TestServeHeadRef(t *testing.T) {
+	repoPath := newTestRepo(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for _, body := range []string{lsRefsBody("HEAD"), pktLine("command=ls-refs\n") + "0001" + pktLine("ref-prefix HEAD\n") + "0000"} {
+		r := httptest.NewRequest("POST", "/git-upload-pack", strings.NewReader(body))
+		r.Header.Set("Git-Protocol", "version=2")
+		req, err := PeekV2Request(r)
+		if err != nil || !req.HeadOnly() {
+			t.Fatalf("expected HEAD-only ls-refs, got %+v (%v)", req, err)
+		}
+		want := httptest.NewRecorder()
+		if err := ServeUploadPack(want, r, repoPath, "", 0, nil, true, nil, nil, log); err != nil {
+			t.Fatalf("serve: %v", err)
+		}
+		got := httptest.NewRecorder()
+		if err := ServeHeadRef(got, req, "refs/heads/main", headSHA(t, repoPath), ""); err != nil {
+			t.Fatalf("serve head ref: %v", err)
+		}
+		if got.Body.String() != want.Body.String() {
+			t.Fatalf("response differs from upload-pack:\ngot  %q\nwant %q", got.Body.String(), want.Body.String())
+		}
+	}
+
+	for _, req := range []*V2Request{
+		{Command: "ls-refs", RefPrefixes: []string{"HEAD", "refs/heads/"}},
+		{Command: "ls-refs"},
+		{Command: "ls-refs", RefPrefixes: []string{"HEAD"}, Args: []string{"symrefs", "unknown"}},
+		{Command: "fetch", RefPrefixes: []string{"HEAD"}},
+	} {
+		if req.HeadOnly() {
+			t.Errorf("expected %+v not to be HEAD-only", req)
+		}
+	}
+}
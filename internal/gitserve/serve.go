@@ -3,19 +3,31 @@ package gitserve
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/gitcmd"
 )
 
 // ServeInfoRefs handles GET /info/refs?service=git-upload-pack
 // It runs git-upload-pack --stateless-rpc --advertise-refs and adds the pkt-line header.
-func ServeInfoRefs(w http.ResponseWriter, r *http.Request, repoPath string, cacheStatus string, packThreads int, log *slog.Logger) error {
+// The advertisement is buffered so its content hash can be sent as an ETag, letting
+// intermediaries revalidate with If-None-Match; cacheControl sets Cache-Control.
+// If adverts is set, advertisements are served from and saved to it.
+// Refs matching stripRefs (see StripRefs) are left out of the advertisement.
+// refInWant advertises ref-in-want, for mirrors that hold every upstream ref.
+func ServeInfoRefs(w http.ResponseWriter, r *http.Request, repoPath string, cacheStatus string, packThreads int, stripRefs []string, refInWant bool, cacheControl string, adverts *AdvertCache, log *slog.Logger) error {
 	start := time.Now()
 
 	service := r.URL.Query().Get("service")
@@ -26,29 +38,74 @@ func ServeInfoRefs(w http.ResponseWriter, r *http.Request, repoPath string, cach
 
 	// Check for Git protocol version
 	gitProtocol := r.Header.Get("Git-Protocol")
-	isV2 := strings.Contains(gitProtocol, "version=2")
+
+	// Protocol v2 advertises capabilities only, refs being listed by ls-refs
+	var cached *advert
+	var gen uint64
+	var caps *capsKey
+	switch {
+	case adverts != nil && adverts.capsTTL > 0 && IsV2(r):
+		caps = &capsKey{gitProtocol, refInWant, objectFormat(repoPath)}
+		cached = adverts.capabilities(*caps)
+	case adverts != nil:
+		cached, gen = adverts.get(repoPath, advertKey{service, gitProtocol})
+	}
+	if cached == nil {
+		body, err := advertiseRefs(r, repoPath, gitProtocol, packThreads, stripRefs, refInWant, log)
+		if err != nil {
+			http.Error(w, "git upload-pack failed", http.StatusBadGateway)
+			return err
+		}
+		sum := sha256.Sum256(body)
+		cached = &advert{body: body, etag: `"` + hex.EncodeToString(sum[:16]) + `"`}
+		switch {
+		case caps != nil:
+			adverts.putCapabilities(*caps, cached.body, cached.etag)
+		case adverts != nil:
+			adverts.put(repoPath, advertKey{service, gitProtocol}, cached.body, cached.etag, gen)
+		}
+	} else {
+		trace := traceFrom(r.Context())
+		trace.FromMemory, trace.Capabilities = true, caps != nil
+		log.Debug("advertisement served from memory", "path", repoPath, "bytes", len(cached.body), "capabilities", caps != nil)
+	}
 
 	w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
-	w.Header().Set("Cache-Control", "no-cache")
+	if cacheControl != "" {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+	w.Header().Set("ETag", cached.etag)
+	w.Header().Add("Vary", "Git-Protocol")
 	if cacheStatus != "" {
 		w.Header().Set("X-Git-Proxy-Status", cacheStatus)
 	}
+	if etagMatches(r.Header.Get("If-None-Match"), cached.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
 	w.WriteHeader(http.StatusOK)
 
+	if _, err := w.Write(cached.body); err != nil {
+		return fmt.Errorf("write advertisement: %w", err)
+	}
+	log.Debug("advertisement sent", "path", repoPath, "total_duration_ms", time.Since(start).Milliseconds())
+
+	return nil
+}
+
+// advertiseRefs returns the info/refs advertisement of the repo at repoPath.
+func advertiseRefs(r *http.Request, repoPath, gitProtocol string, packThreads int, stripRefs []string, refInWant bool, log *slog.Logger) ([]byte, error) {
+	var body bytes.Buffer
+
 	// For protocol v1, write the service announcement
 	// Protocol v2 doesn't need this prefix
-	if !isV2 {
+	if !IsV2(r) {
 		// Write pkt-line service announcement
 		// Format: 4-digit hex length + "# service=git-upload-pack\n" + flush
 		announcement := "# service=git-upload-pack\n"
-		pktLine := fmt.Sprintf("%04x%s", len(announcement)+4, announcement)
-		if _, err := w.Write([]byte(pktLine)); err != nil {
-			return err
-		}
+		fmt.Fprintf(&body, "%04x%s", len(announcement)+4, announcement)
 		// Flush packet (0000)
-		if _, err := w.Write([]byte("0000")); err != nil {
-			return err
-		}
+		body.WriteString("0000")
 	}
 
 	// Run git upload-pack to get refs
@@ -57,49 +114,60 @@ func ServeInfoRefs(w http.ResponseWriter, r *http.Request, repoPath string, cach
 	if packThreads > 0 {
 		args = append([]string{"-c", fmt.Sprintf("pack.threads=%d", packThreads)}, args...)
 	}
-	cmd := exec.CommandContext(r.Context(), "git", args...)
-	cmd.Env = gitEnv(gitProtocol)
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("stdout pipe: %w", err)
-	}
+	cmd := gitcmd.Command(r.Context(), args...)
+	cmd.Env = gitEnv(gitProtocol, stripRefs, refInWant)
+	cmd.Stdout = &body
 	var stderrBuf bytes.Buffer
 	cmd.Stderr = &stderrBuf
 
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("start git upload-pack: %w", err)
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("run git upload-pack: %w, stderr: %s", err, stderrBuf.String())
 	}
-	log.Debug("git upload-pack started (advertise-refs)", "path", repoPath, "startup_duration_ms", time.Since(cmdStart).Milliseconds())
+	log.Debug("git upload-pack complete (advertise-refs)", "path", repoPath, "bytes", body.Len(), "cmd_duration_ms", time.Since(cmdStart).Milliseconds())
+	return body.Bytes(), nil
+}
 
-	// Stream output to client
-	copyStart := time.Now()
-	n, err := io.Copy(w, stdout)
+// objectFormat returns the object format of the repo at repoPath as set in
+// its config (extensions.objectFormat), sha1 if it isn't.
+func objectFormat(repoPath string) string {
+	data, err := os.ReadFile(filepath.Join(repoPath, "config"))
 	if err != nil {
-		_ = cmd.Wait()
-		return fmt.Errorf("copy stdout: %w", err)
+		return "sha1"
 	}
-	log.Debug("git upload-pack output streamed (advertise-refs)", "path", repoPath, "bytes", n, "copy_duration_ms", time.Since(copyStart).Milliseconds())
-
-	if err := cmd.Wait(); err != nil {
-		return fmt.Errorf("wait git upload-pack: %w, stderr: %s", err, stderrBuf.String())
+	for line := range strings.Lines(strings.ToLower(string(data))) {
+		name, value, ok := strings.Cut(line, "=")
+		if ok && strings.TrimSpace(name) == "objectformat" {
+			return strings.TrimSpace(value)
+		}
 	}
-	log.Debug("git upload-pack complete (advertise-refs)", "path", repoPath, "total_duration_ms", time.Since(start).Milliseconds())
+	return "sha1"
+}
 
-	return nil
+// etagMatches reports whether an If-None-Match header value matches etag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
 }
 
 // ServeUploadPack handles POST /git-upload-pack
 // It runs git-upload-pack --stateless-rpc with the request body as stdin.
-func ServeUploadPack(w http.ResponseWriter, r *http.Request, repoPath string, cacheStatus string, packThreads int, log *slog.Logger) error {
+// If cache is set, a successful response is also saved there for ServeCachedPack.
+// upload-pack reads the whole request before answering, so if reading the body
+// fails before any output (e.g. with *http.MaxBytesError), nothing is written
+// and the returned error wraps the read error for the caller to report.
+// Refs matching stripRefs are neither listed by ls-refs nor fetchable by name.
+// refInWant must match what ServeInfoRefs advertised.
+// If verify is set, the response is buffered and checked first, and a pack
+// still corrupt after verify.Attempts is never served: the returned error
+// wraps ErrCorruptPack and nothing is written.
+func ServeUploadPack(w http.ResponseWriter, r *http.Request, repoPath string, cacheStatus string, packThreads int, stripRefs []string, refInWant bool, cache *PackCacheEntry, verify *PackVerify, log *slog.Logger) error {
 	start := time.Now()
 
-	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
-	w.Header().Set("Cache-Control", "no-cache")
-	if cacheStatus != "" {
-		w.Header().Set("X-Git-Proxy-Status", cacheStatus)
-	}
-
 	// Handle gzip-compressed request body
 	var body io.Reader = r.Body
 	if strings.Contains(r.Header.Get("Content-Encoding"), "gzip") {
@@ -112,39 +180,90 @@ func ServeUploadPack(w http.ResponseWriter, r *http.Request, repoPath string, ca
 		body = gz
 		log.Debug("gzip reader initialized", "path", repoPath, "duration_ms", time.Since(gzStart).Milliseconds())
 	}
+	in := &bodyReader{r: body}
 
 	cmdStart := time.Now()
 	args := []string{"upload-pack", "--stateless-rpc", repoPath}
 	if packThreads > 0 {
 		args = append([]string{"-c", fmt.Sprintf("pack.threads=%d", packThreads)}, args...)
 	}
-	cmd := exec.CommandContext(r.Context(), "git", args...)
-	cmd.Stdin = body
-	cmd.Env = gitEnv(r.Header.Get("Git-Protocol"))
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("stdout pipe: %w", err)
+	newCmd := func() *exec.Cmd {
+		cmd := gitcmd.Command(r.Context(), args...)
+		cmd.Env = gitEnv(r.Header.Get("Git-Protocol"), stripRefs, refInWant)
+		return cmd
 	}
-	var stderrBuf bytes.Buffer
-	cmd.Stderr = &stderrBuf
 
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("start git upload-pack: %w", err)
+	// Verified responses are served once complete, streamed ones as they come
+	var stdout io.Reader
+	var stderrBuf bytes.Buffer
+	wait, kill := func() error { return nil }, func() {}
+	if verify != nil {
+		f, err := verifiedUploadPack(in, newCmd, verify)
+		if err != nil {
+			if in.err != nil {
+				return fmt.Errorf("read request body: %w", in.err)
+			}
+			return err
+		}
+		defer f.Close()
+		stdout = f
+	} else {
+		cmd := newCmd()
+		cmd.Stdin = in
+		pipe, err := cmd.StdoutPipe()
+		if err != nil {
+			return fmt.Errorf("stdout pipe: %w", err)
+		}
+		cmd.Stderr = &stderrBuf
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("start git upload-pack: %w", err)
+		}
+		stdout, wait = pipe, cmd.Wait
+		kill = func() { _ = cmd.Process.Kill() }
 	}
 	log.Debug("git upload-pack started", "path", repoPath, "startup_duration_ms", time.Since(cmdStart).Milliseconds())
 
+	// Headers go out with the first byte of output, and output as it comes
+	resp := &lazyResponse{ResponseWriter: w, cacheStatus: cacheStatus}
+	out := Flushing(resp)
+	var rec *packRecorder
+	if cache != nil {
+		var err error
+		if rec, err = newPackRecorder(*cache); err != nil {
+			log.Warn("cannot record pack for caching", "dir", cache.Dir, "err", err)
+		} else {
+			out = io.MultiWriter(out, rec)
+		}
+	}
+
 	// Stream stdout to response
-	w.WriteHeader(http.StatusOK)
 	copyStart := time.Now()
-	n, err := io.Copy(w, stdout)
+	n, err := io.Copy(out, stdout)
 	if err != nil {
-		_ = cmd.Wait()
+		// upload-pack may still be writing, e.g. when the response was cut off
+		kill()
+		_ = wait()
+		if rec != nil {
+			_ = rec.commit(false)
+		}
 		return fmt.Errorf("copy stdout: %w, stderr: %s", err, stderrBuf.String())
 	}
 	log.Debug("git upload-pack output streamed", "path", repoPath, "bytes", n, "copy_duration_ms", time.Since(copyStart).Milliseconds())
 
-	if err := cmd.Wait(); err != nil {
+	err = wait()
+	if n == 0 && in.err != nil {
+		if rec != nil {
+			_ = rec.commit(false)
+		}
+		return fmt.Errorf("read request body: %w", in.err)
+	}
+	resp.start()
+	if rec != nil {
+		if cerr := rec.commit(err == nil); cerr != nil {
+			log.Warn("caching pack failed", "dir", cache.Dir, "err", cerr)
+		}
+	}
+	if err != nil {
 		return fmt.Errorf("wait git upload-pack: %w, stderr: %s", err, stderrBuf.String())
 	}
 	log.Debug("git upload-pack complete", "path", repoPath, "total_duration_ms", time.Since(start).Milliseconds())
@@ -152,16 +271,164 @@ func ServeUploadPack(w http.ResponseWriter, r *http.Request, repoPath string, ca
 	return nil
 }
 
+// bodyReader remembers the first error reading the request body, which exec
+// would otherwise hide behind upload-pack's own exit status.
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+	return n, err
+}
+
+// Content types of upload-pack and upload-archive responses.
+const (
+	PackResultType    = "application/x-git-upload-pack-result"
+	ArchiveResultType = "application/x-git-upload-archive-result"
+)
+
+// lazyResponse sends the result headers and a 200 status on the first write,
+// or on start if there was no output.
+type lazyResponse struct {
+	http.ResponseWriter
+	contentType string // Zero means an upload-pack result
+	cacheStatus string
+	started     bool
+}
+
+func (l *lazyResponse) start() {
+	if l.started {
+		return
+	}
+	l.started = true
+	contentType := l.contentType
+	if contentType == "" {
+		contentType = PackResultType
+	}
+	l.Header().Set("Content-Type", contentType)
+	// Pack responses depend on the request body and must never be cached by intermediaries
+	l.Header().Set("Cache-Control", "no-store")
+	if l.cacheStatus != "" {
+		l.Header().Set("X-Git-Proxy-Status", l.cacheStatus)
+	}
+	l.WriteHeader(http.StatusOK)
+}
+
+func (l *lazyResponse) Write(p []byte) (int, error) {
+	l.start()
+	return l.ResponseWriter.Write(p)
+}
+
+func (l *lazyResponse) Unwrap() http.ResponseWriter {
+	return l.ResponseWriter
+}
+
 // gitEnv returns a minimal environment for local git commands.
-// Isolates from user/system git config to avoid interference.
-func gitEnv(gitProtocol string) []string {
+// Isolates from user/system git config to avoid interference; only PATH and
+// the configured GIT_ENV variables are passed on.
+// With refInWant, upload-pack advertises ref-in-want so protocol v2 clients
+// can fetch with want-ref; mirrors hold every upstream ref, so those resolve
+// locally. Restricted mirrors don't: requests for the refs they leave out are
+// passed through, and upstream may not support want-ref.
+// Refs matching stripRefs are hidden with transfer.hideRefs, which git applies
+// to both v0 and v2 advertisements while keeping them well-formed.
+// Filters are allowed, as mirrors hold every object: partial clones are
+// served as such, and FilterBlobs can have upload-pack filter packs.
+func gitEnv(gitProtocol string, stripRefs []string, refInWant bool) []string {
+	configs := [][2]string{{"uploadpack.allowFilter", "true"}}
+	if refInWant {
+		configs = append(configs, [2]string{"uploadpack.allowRefInWant", "true"})
+	}
+	for _, p := range stripRefs {
+		configs = append(configs, [2]string{"transfer.hideRefs", hiddenPrefix(p)})
+	}
 	env := []string{
 		"PATH=" + os.Getenv("PATH"),
 		"GIT_CONFIG_GLOBAL=/dev/null",
 		"GIT_CONFIG_SYSTEM=/dev/null",
+		fmt.Sprintf("GIT_CONFIG_COUNT=%d", len(configs)),
+	}
+	env = append(env, gitcmd.ExtraEnv()...)
+	for i, c := range configs {
+		env = append(env,
+			fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", i, c[0]),
+			fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i, c[1]),
+		)
 	}
 	if gitProtocol != "" {
 		env = append(env, "GIT_PROTOCOL="+gitProtocol)
 	}
 	return env
 }
+
+// dumbContentTypes maps dumb HTTP protocol files to the content types git http-backend uses.
+var dumbContentTypes = []struct {
+	match       func(file string) bool
+	contentType string
+}{
+	{func(f string) bool { return f == "HEAD" || f == "info/refs" || strings.HasPrefix(f, "objects/info/") }, "text/plain; charset=utf-8"},
+	{func(f string) bool { return strings.HasPrefix(f, "objects/pack/") && strings.HasSuffix(f, ".pack") }, "application/x-git-packed-objects"},
+	{func(f string) bool { return strings.HasPrefix(f, "objects/pack/") && strings.HasSuffix(f, ".idx") }, "application/x-git-packed-objects-toc"},
+	{func(f string) bool { return strings.HasPrefix(f, "objects/") }, "application/x-git-loose-object"},
+}
+
+// ServeDumbFile handles dumb HTTP protocol GETs (info/refs without service, HEAD, objects/...)
+// by serving the static file from the mirror.
+func ServeDumbFile(w http.ResponseWriter, r *http.Request, repoPath, file, cacheStatus, cacheControl string, log *slog.Logger) error {
+	contentType := ""
+	if path.Clean("/"+file) == "/"+file {
+		for _, ct := range dumbContentTypes {
+			if ct.match(file) {
+				contentType = ct.contentType
+				break
+			}
+		}
+	}
+	if contentType == "" {
+		http.Error(w, "unsupported path", http.StatusBadRequest)
+		return fmt.Errorf("unsupported dumb http file: %s", file)
+	}
+
+	f, err := os.Open(filepath.Join(repoPath, filepath.FromSlash(file)))
+	if err != nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	if cacheControl != "" {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+	if cacheStatus != "" {
+		w.Header().Set("X-Git-Proxy-Status", cacheStatus)
+	}
+	http.ServeContent(w, r, "", info.ModTime(), f)
+	log.Debug("served dumb http file", "path", repoPath, "file", file, "bytes", info.Size())
+	return nil
+}
+
+// UpdateServerInfo regenerates info/refs and objects/info/packs, which dumb HTTP clients need.
+// update-server-info ignores transfer.hideRefs, so refs matching stripRefs are
+// removed from info/refs afterwards.
+func UpdateServerInfo(ctx context.Context, repoPath string, stripRefs []string) error {
+	cmd := gitcmd.Command(ctx, "-C", repoPath, "update-server-info")
+	cmd.Env = gitEnv("", nil, false)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git update-server-info failed: %w\noutput: %s", err, output)
+	}
+	if len(stripRefs) > 0 {
+		return stripInfoRefs(filepath.Join(repoPath, "info", "refs"), stripRefs)
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package gitserve
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/gitcmd"
+)
+
+func TestServeInfoRefsCacheHeaders(t *testing.T) {
+	repoPath := newTestRepo(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	r := httptest.NewRequest("GET", "/info/refs?service=git-upload-pack", nil)
+	w := httptest.NewRecorder()
+	if err := ServeInfoRefs(w, r, repoPath, "", 0, nil, true, "public, max-age=5", nil, log); err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=5" {
+		t.Fatalf("expected configured Cache-Control, got %q", got)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("expected ETag header")
+	}
+	if !strings.Contains(w.Body.String(), "refs/heads/main") {
+		t.Fatalf("expected advertisement body, got %q", w.Body.String())
+	}
+
+	// Same content revalidates to 304
+	r = httptest.NewRequest("GET", "/info/refs?service=git-upload-pack", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	if err := ServeInfoRefs(w, r, repoPath, "", 0, nil, true, "public, max-age=5", nil, log); err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("expected empty 304, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+
+	// Protocol v2 advertisement differs, so does its ETag
+	r = httptest.NewRequest("GET", "/info/refs?service=git-upload-pack", nil)
+	r.Header.Set("Git-Protocol", "version=2")
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	if err := ServeInfoRefs(w, r, repoPath, "", 0, nil, true, "public, max-age=5", nil, log); err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Fatalf("expected fresh v2 response with a different ETag, got %d %s", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestServeInfoRefsCapabilities(t *testing.T) {
+	repos := []string{newTestRepo(t), newTestRepo(t)}
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	adverts := NewAdvertCache(0, time.Minute)
+	adverts.CacheCapabilities(time.Hour)
+
+	serve := func(repoPath, gitProtocol string) (*httptest.ResponseRecorder, Trace) {
+		t.Helper()
+		var trace Trace
+		r := httptest.NewRequest("GET", "/info/refs?service=git-upload-pack", nil)
+		r = r.WithContext(WithTrace(r.Context(), &trace))
+		r.Header.Set("Git-Protocol", gitProtocol)
+		w := httptest.NewRecorder()
+		if err := ServeInfoRefs(w, r, repoPath, "", 0, nil, true, "", adverts, log); err != nil {
+			t.Fatalf("serve: %v", err)
+		}
+		return w, trace
+	}
+	first, trace := serve(repos[0], "version=2")
+	if trace.Capabilities || !strings.Contains(first.Body.String(), "ls-refs") {
+		t.Fatalf("expected capabilities generated, got %q (%+v)", first.Body.String(), trace)
+	}
+
+	// Probes of other repos don't run git upload-pack at all
+	gitcmd.Configure(filepath.Join(t.TempDir(), "no-git"), nil)
+	t.Cleanup(func() { gitcmd.Configure("git", nil) })
+	probe, trace := serve(repos[1], "version=2")
+	if !trace.Capabilities || probe.Body.String() != first.Body.String() || probe.Header().Get("ETag") != first.Header().Get("ETag") {
+		t.Fatalf("expected the cached capabilities, got %q (%+v)", probe.Body.String(), trace)
+	}
+	adverts.Invalidate(repos[1])
+	if _, trace := serve(repos[1], "version=2"); !trace.Capabilities {
+		t.Fatalf("expected capabilities to outlive syncs")
+	}
+
+	// Protocol v0 advertisements list refs, so they aren't shared
+	r := httptest.NewRequest("GET", "/info/refs?service=git-upload-pack", nil)
+	if err := ServeInfoRefs(httptest.NewRecorder(), r, repos[1], "", 0, nil, true, "", adverts, log); err == nil {
+		t.Fatalf("expected v0 advertisement to run git upload-pack")
+	}
+}
+
+func TestServeUploadPackNoStore(t *testing.T) {
+	repoPath := newTestRepo(t)
+
+	r := httptest.NewRequest("POST", "/git-upload-pack", strings.NewReader(lsRefsBody()))
+	r.Header.Set("Git-Protocol", "version=2")
+	w := httptest.NewRecorder()
+	if err := ServeUploadPack(w, r, repoPath, "", 0, nil, true, nil, nil, slog.New(slog.NewTextHandler(io.Discard, nil))); err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		t.Fatalf("expected no-store on upload-pack responses, got %q", got)
+	}
+}
+
+func TestServeInfoRefsMemoryCache(t *testing.T) {
+	repoPath := newTestRepo(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	adverts := NewAdvertCache(1<<20, time.Minute)
+
+	serve := func(gitProtocol string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/info/refs?service=git-upload-pack", nil)
+		r.Header.Set("Git-Protocol", gitProtocol)
+		w := httptest.NewRecorder()
+		if err := ServeInfoRefs(w, r, repoPath, "", 0, nil, true, "", adverts, log); err != nil {
+			t.Fatalf("serve: %v", err)
+		}
+		return w
+	}
+	v1 := serve("").Body.String()
+	v2 := serve("version=2").Body.String()
+	if v1 == v2 {
+		t.Fatalf("expected protocol versions to be cached separately")
+	}
+
+	// Other services never get the cached upload-pack advertisement
+	r := httptest.NewRequest("GET", "/info/refs?service=git-receive-pack", nil)
+	w := httptest.NewRecorder()
+	if err := ServeInfoRefs(w, r, repoPath, "", 0, nil, true, "", adverts, log); err == nil || w.Code != http.StatusBadRequest {
+		t.Fatalf("expected receive-pack to be rejected, got %d: %v", w.Code, err)
+	}
+
+	// New refs aren't advertised until the repo is invalidated
+	if out, err := exec.Command("git", "-C", repoPath, "branch", "new-branch", "main").CombinedOutput(); err != nil {
+		t.Fatalf("git branch: %v\n%s", err, out)
+	}
+	if got := serve("").Body.String(); got != v1 {
+		t.Fatalf("expected cached advertisement, got %q", got)
+	}
+	adverts.Invalidate(repoPath)
+	if got := serve("").Body.String(); !strings.Contains(got, "refs/heads/new-branch") {
+		t.Fatalf("expected fresh advertisement after invalidation, got %q", got)
+	}
+}
+
+func BenchmarkServeInfoRefs(b *testing.B) {
+	repoPath := newTestRepo(b)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for _, bc := range []struct {
+		name    string
+		adverts *AdvertCache
+	}{
+		{"git", nil},
+		{"memory", NewAdvertCache(1<<20, time.Hour)},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			for b.Loop() {
+				r := httptest.NewRequest("GET", "/info/refs?service=git-upload-pack", nil)
+				w := httptest.NewRecorder()
+				if err := ServeInfoRefs(w, r, repoPath, "", 0, nil, true, "", bc.adverts, log); err != nil {
+					b.Fatalf("serve: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestServeUploadPackStreamsProgress(t *testing.T) {
+	// A git whose upload-pack reports progress, then holds the rest of its
+	// output until released
+	dir := t.TempDir()
+	release := filepath.Join(dir, "release")
+	progress := "\x02Counting objects: 50% (1/2)\r"
+	script := fmt.Sprintf("#!/bin/sh\ncat >/dev/null\nprintf '%%04x%%s' %d '%s'\nwhile [ ! -e %q ]; do sleep 0.01; done\nprintf 0000\n",
+		len(progress)+4, progress, release)
+	if err := os.WriteFile(filepath.Join(dir, "git"), []byte(script), 0o755); err != nil {
+		t.Fatalf("write git: %v", err)
+	}
+	gitcmd.Configure(filepath.Join(dir, "git"), nil)
+	t.Cleanup(func() { gitcmd.Configure("git", nil) })
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Through a wrapper, as the proxy serves it
+		if err := ServeUploadPack(LimitResponse(w, 1<<20), r, dir, "", 0, nil, false, nil, nil, log); err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	}))
+	defer ts.Close()
+	defer os.WriteFile(release, nil, 0o644)
+
+	// Headers and progress must both arrive before upload-pack is done
+	var body io.ReadCloser
+	got := make(chan string, 1)
+	go func() {
+		resp, err := http.Post(ts.URL, "application/x-git-upload-pack-request", strings.NewReader("0000"))
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		body = resp.Body
+		buf := make([]byte, 4+len(progress))
+		n, _ := io.ReadFull(body, buf)
+		got <- string(buf[:n])
+	}()
+	select {
+	case pkt := <-got:
+		if want := fmt.Sprintf("%04x%s", len(progress)+4, progress); pkt != want {
+			t.Fatalf("expected progress packet %q, got %q", want, pkt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("progress not received while upload-pack is still running")
+	}
+	defer body.Close()
+	if err := os.WriteFile(release, nil, 0o644); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if rest, _ := io.ReadAll(body); string(rest) != "0000" {
+		t.Fatalf("expected the response to end with a flush, got %q", rest)
+	}
+}
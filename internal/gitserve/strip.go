@@ -0,0 +1,71 @@
+package gitserve
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Ref strip patterns are full ref names or namespaces ending in "/*", e.g.
+// "refs/pull/*" hides refs/pull/1/head but not refs/pullx.
+
+// hiddenPrefix converts a strip pattern to git's transfer.hideRefs form, which
+// matches the ref itself and everything below it.
+func hiddenPrefix(pattern string) string {
+	return strings.TrimSuffix(pattern, "/*")
+}
+
+// refStripped reports whether ref matches one of the strip patterns, the same
+// way transfer.hideRefs does.
+func refStripped(ref string, patterns []string) bool {
+	for _, p := range patterns {
+		prefix := hiddenPrefix(p)
+		if rest, ok := strings.CutPrefix(ref, prefix); ok && (rest == "" || rest[0] == '/') {
+			return true
+		}
+	}
+	return false
+}
+
+// stripInfoRefs rewrites the dumb HTTP info/refs file at path ("<sha>\t<ref>"
+// lines, peeled tags as "<ref>^{}") without the refs matching patterns.
+func stripInfoRefs(path string, patterns []string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	for line := range bytes.Lines(data) {
+		_, ref, _ := strings.Cut(strings.TrimSuffix(string(line), "\n"), "\t")
+		if refStripped(strings.TrimSuffix(ref, "^{}"), patterns) {
+			continue
+		}
+		out.Write(line)
+	}
+	if out.Len() == len(data) {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	// Concurrent dumb requests may rewrite it at the same time, so each writes
+	// its own temp file and renames it into place
+	tmp, err := os.CreateTemp(filepath.Dir(path), "refs.strip-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(out.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,114 @@
+package gitserve
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRefStripped(t *testing.T) {
+	patterns := []string{"refs/pull/*", "refs/internal/secret"}
+	for ref, want := range map[string]bool{
+		"refs/pull/1/head":         true,
+		"refs/pull":                true,
+		"refs/pullx/1":             false,
+		"refs/internal/secret":     true,
+		"refs/internal/secret/sub": true,
+		"refs/internal/other":      false,
+		"refs/heads/main":          false,
+	} {
+		if got := refStripped(ref, patterns); got != want {
+			t.Errorf("refStripped(%q) = %v, want %v", ref, got, want)
+		}
+	}
+}
+
+func TestStripRefs(t *testing.T) {
+	repoPath := newTestRepo(t)
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", repoPath}, args...)...)
+		cmd.Env = gitEnv("", nil, true)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	git("update-ref", "refs/pull/1/head", "refs/heads/main")
+	git("update-ref", "refs/internal/x", "refs/heads/main")
+	// refs/a/x sorts first: with an unborn HEAD it would carry the v0
+	// capabilities, which must move to the next advertised ref
+	git("update-ref", "refs/a/x", "refs/heads/main")
+	git("symbolic-ref", "HEAD", "refs/heads/unborn")
+
+	strip := []string{"refs/pull/*", "refs/internal/*", "refs/a/*"}
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		if strings.HasSuffix(r.URL.Path, "/info/refs") {
+			err = ServeInfoRefs(w, r, repoPath, "", 0, strip, true, "", nil, log)
+		} else {
+			err = ServeUploadPack(w, r, repoPath, "", 0, strip, true, nil, nil, log)
+		}
+		if err != nil {
+			t.Errorf("serve %s: %v", r.URL.Path, err)
+		}
+	}))
+	defer ts.Close()
+
+	r := httptest.NewRequest("GET", "/info/refs?service=git-upload-pack", nil)
+	w := httptest.NewRecorder()
+	if err := ServeInfoRefs(w, r, repoPath, "", 0, strip, true, "", nil, log); err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+	if _, first, _ := strings.Cut(w.Body.String(), "0000"); !strings.Contains(first[:strings.Index(first, "\n")], "refs/heads/feature\x00") {
+		t.Fatalf("expected capabilities on the first advertised ref, got %q", w.Body.String())
+	}
+
+	for _, version := range []string{"0", "2"} {
+		cmd := exec.Command("git", "-c", "protocol.version="+version, "ls-remote", ts.URL+"/repo.git")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("v%s ls-remote of filtered advertisement failed: %v\n%s", version, err, out)
+		}
+		if strings.Contains(string(out), "refs/pull/") || strings.Contains(string(out), "refs/internal/") || strings.Contains(string(out), "refs/a/") {
+			t.Fatalf("v%s: expected stripped refs to be hidden, got:\n%s", version, out)
+		}
+		if !strings.Contains(string(out), "refs/heads/main") || !strings.Contains(string(out), "refs/tags/v1.0.0") {
+			t.Fatalf("v%s: expected other refs to be listed, got:\n%s", version, out)
+		}
+
+		// Stripped refs can't be fetched by name either
+		work := t.TempDir()
+		if out, err := exec.Command("git", "init", "-q", work).CombinedOutput(); err != nil {
+			t.Fatalf("git init: %v\n%s", err, out)
+		}
+		fetch := func(ref string) ([]byte, error) {
+			return exec.Command("git", "-C", work, "-c", "protocol.version="+version, "fetch", ts.URL+"/repo.git", ref).CombinedOutput()
+		}
+		if out, err := fetch("refs/heads/main"); err != nil {
+			t.Fatalf("v%s fetch from filtered advertisement failed: %v\n%s", version, err, out)
+		}
+		if out, err := fetch("refs/pull/1/head"); err == nil {
+			t.Fatalf("v%s: expected fetching a stripped ref to fail, got:\n%s", version, out)
+		}
+	}
+
+	// Dumb HTTP clients read info/refs, which update-server-info writes in full
+	if err := UpdateServerInfo(context.Background(), repoPath, strip); err != nil {
+		t.Fatalf("update server info: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(repoPath, "info", "refs"))
+	if err != nil {
+		t.Fatalf("read info/refs: %v", err)
+	}
+	if strings.Contains(string(data), "refs/pull/") || !strings.Contains(string(data), "refs/heads/main") {
+		t.Fatalf("unexpected dumb info/refs:\n%s", data)
+	}
+}
@@ -0,0 +1,25 @@
+package gitserve
+
+import "context"
+
+// Trace records how a request was answered, for callers logging it. Attach
+// one to the request context with WithTrace.
+type Trace struct {
+	FromMemory   bool // info/refs advertisement served from the AdvertCache
+	Capabilities bool // The advertisement was the protocol v2 capabilities shared by all repos
+}
+
+type traceKey struct{}
+
+// WithTrace returns a context in which requests served record into t.
+func WithTrace(ctx context.Context, t *Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// traceFrom returns the Trace attached to ctx, or a discarded one.
+func traceFrom(ctx context.Context) *Trace {
+	if t, ok := ctx.Value(traceKey{}).(*Trace); ok {
+		return t
+	}
+	return &Trace{}
+}
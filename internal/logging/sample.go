@@ -0,0 +1,23 @@
+package logging
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Sampler decides which requests make it to the access log, so busy proxies
+// don't flood their log pipeline with successes. Failed requests (status 400
+// and above) and requests slower than Slow are always logged; a Rate fraction
+// of the others is.
+type Sampler struct {
+	Rate float64       // Fraction of successful requests logged, 1 logs all of them
+	Slow time.Duration // Zero disables the latency override
+}
+
+// Keep reports whether a request answered with status after took should be logged.
+func (s Sampler) Keep(status int, took time.Duration) bool {
+	if status >= 400 || (s.Slow > 0 && took >= s.Slow) {
+		return true
+	}
+	return s.Rate >= 1 || rand.Float64() < s.Rate
+}
@@ -0,0 +1,40 @@
+package logging
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSampler(t *testing.T) {
+	s := Sampler{Rate: 0.1, Slow: time.Second}
+	const n = 20000
+	kept := 0
+	for range n {
+		if s.Keep(http.StatusOK, time.Millisecond) {
+			kept++
+		}
+	}
+	// Within 5 standard deviations of the expected 2000
+	if kept < 1790 || kept > 2210 {
+		t.Fatalf("expected about 10%% of %d requests kept, got %d", n, kept)
+	}
+
+	for _, tc := range []struct {
+		sampler Sampler
+		status  int
+		took    time.Duration
+		want    bool
+	}{
+		{Sampler{Rate: 0}, http.StatusOK, time.Millisecond, false},
+		{Sampler{Rate: 1}, http.StatusOK, time.Millisecond, true},
+		{Sampler{Rate: 0}, http.StatusNotFound, time.Millisecond, true},
+		{Sampler{Rate: 0}, http.StatusBadGateway, time.Millisecond, true},
+		{Sampler{Rate: 0, Slow: time.Second}, http.StatusOK, 2 * time.Second, true},
+		{Sampler{Rate: 0}, http.StatusOK, time.Hour, false},
+	} {
+		if got := tc.sampler.Keep(tc.status, tc.took); got != tc.want {
+			t.Errorf("%+v.Keep(%d, %v) = %v, want %v", tc.sampler, tc.status, tc.took, got, tc.want)
+		}
+	}
+}
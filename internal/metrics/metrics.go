@@ -1,28 +1,78 @@
 package metrics
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 type Metrics struct {
-	RequestsTotal   *prometheus.CounterVec
-	ResponsesTotal  *prometheus.CounterVec
-	ErrorsTotal     *prometheus.CounterVec
-	UpstreamLatency *prometheus.HistogramVec
-	SyncTotal       *prometheus.CounterVec
+	RequestsTotal      *prometheus.CounterVec
+	ResponsesTotal     *prometheus.CounterVec
+	ErrorsTotal        *prometheus.CounterVec
+	CacheMisses        *prometheus.CounterVec
+	UpstreamLatency    *prometheus.HistogramVec
+	SyncTotal          *prometheus.CounterVec
+	SyncSkipped        *prometheus.CounterVec
+	MirrorFetches      *prometheus.CounterVec
+	PackFetches        *prometheus.CounterVec
+	SyncUpstreams      *prometheus.CounterVec
+	PinnedPacks        *prometheus.CounterVec
+	CacheChecksums     *prometheus.CounterVec
+	CorruptPacks       *prometheus.CounterVec
+	CloneAborts        *prometheus.CounterVec
+	ClientAborts       *prometheus.CounterVec
+	SyncDuration       *prometheus.HistogramVec
+	StaleServed        *prometheus.CounterVec
+	Revalidations      *prometheus.CounterVec
+	GitKilled          *prometheus.CounterVec
+	VerifyTotal        *prometheus.CounterVec
+	OriginCollisions   *prometheus.CounterVec
+	MaintenanceTotal   *prometheus.CounterVec
+	MaintenanceTime    *prometheus.HistogramVec
+	MirrorStaleness    *Staleness
+	UpstreamQuota      *Quota
+	QuotaBlocked       *prometheus.CounterVec
+	UpstreamQueueDepth *prometheus.GaugeVec
+	LockWait           *prometheus.HistogramVec
+
+	// Phases of requests sent upstream by the proxy itself, when tracing is enabled
+	UpstreamDNS     *prometheus.HistogramVec
+	UpstreamConnect *prometheus.HistogramVec
+	UpstreamTLS     *prometheus.HistogramVec
+	UpstreamTTFB    *prometheus.HistogramVec
+
+	EvictionsTotal          prometheus.Counter
+	EvictedBytesTotal       prometheus.Counter
+	EvictionIncompleteTotal prometheus.Counter
+	FreezesTotal            prometheus.Counter
+	UnfreezesTotal          prometheus.Counter
+	ExpiredPurgesTotal      prometheus.Counter
+	MirroredRepos           *prometheus.GaugeVec
+
+	Connections       prometheus.Gauge
+	SlowClientsClosed prometheus.Counter
 }
 
 // New creates metrics registered with the default prometheus registry.
-func New() *Metrics {
-	return NewWithRegistry(prometheus.DefaultRegisterer)
+func New(log *slog.Logger) *Metrics {
+	return NewWithRegistry(prometheus.DefaultRegisterer, log)
 }
 
 // NewUnregistered creates metrics without registering them (useful for tests).
 func NewUnregistered() *Metrics {
-	return NewWithRegistry(nil)
+	return NewWithRegistry(nil, nil)
 }
 
 // NewWithRegistry creates metrics and registers them with the given registerer.
-// Pass nil to skip registration.
-func NewWithRegistry(reg prometheus.Registerer) *Metrics {
+// Pass nil to skip registration. Collectors that fail to register, e.g. as
+// another one is registered under the same name, are logged and left out:
+// they are still updated, but never exported, so metrics can't keep git
+// requests from being served.
+func NewWithRegistry(reg prometheus.Registerer, log *slog.Logger) *Metrics {
 	m := &Metrics{
 		RequestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "smart_git_proxy_requests_total",
@@ -36,6 +86,10 @@ func NewWithRegistry(reg prometheus.Registerer) *Metrics {
 			Name: "smart_git_proxy_errors_total",
 			Help: "errors by repo/kind",
 		}, []string{"repo", "kind"}),
+		CacheMisses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_cache_misses_total",
+			Help: "git requests that refreshed the mirror or were served from upstream, by repo/kind",
+		}, []string{"repo", "kind"}),
 		UpstreamLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Name:    "smart_git_proxy_request_seconds",
 			Help:    "request latency",
@@ -45,16 +99,281 @@ func NewWithRegistry(reg prometheus.Registerer) *Metrics {
 			Name: "smart_git_proxy_sync_total",
 			Help: "mirror sync operations",
 		}, []string{"repo", "result"}),
+		SyncSkipped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_sync_skipped_total",
+			Help: "stale mirror syncs skipped because upstream's refs matched the mirror's",
+		}, []string{"repo"}),
+		MirrorFetches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_mirror_fetches_total",
+			Help: "new mirrors by where they were fetched from (peer or upstream)",
+		}, []string{"source"}),
+		PackFetches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_pack_fetches_total",
+			Help: "git-upload-pack requests by how they were served (mirrored or direct from upstream)",
+		}, []string{"mode"}),
+		SyncUpstreams: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_sync_upstreams_total",
+			Help: "successful mirror syncs by host and the upstream that served them (origin or a fallback's host)",
+		}, []string{"host", "upstream"}),
+		PinnedPacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_pinned_packs_total",
+			Help: "pinned-commit fetches by pack cache result (hit or miss)",
+		}, []string{"result"}),
+		CacheChecksums: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_cache_checksum_failures_total",
+			Help: "cached entries discarded for failing their checksum, by kind (info or pack)",
+		}, []string{"kind"}),
+		CorruptPacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_corrupt_packs_total",
+			Help: "packs failing verification before being served, by source (mirror or upstream)",
+		}, []string{"source"}),
+		CloneAborts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_clone_aborts_total",
+			Help: "pack transfers to clients aborted for exceeding the max clone size",
+		}, []string{"repo"}),
+		ClientAborts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_client_aborts_total",
+			Help: "git requests whose client went away before the response was complete, by kind",
+		}, []string{"kind"}),
+		SyncDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "smart_git_proxy_mirror_sync_seconds",
+			Help:    "git fetch duration when syncing an existing mirror from upstream, by host",
+			Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		}, []string{"host", "result"}),
+		StaleServed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_stale_served_total",
+			Help: "requests served from an existing mirror after syncing it from upstream failed",
+		}, []string{"repo"}),
+		GitKilled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_git_killed_total",
+			Help: "git subprocesses updating mirrors killed by a signal the proxy didn't send, e.g. by the OOM killer, by operation",
+		}, []string{"op"}),
+		Revalidations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_stale_while_revalidate_total",
+			Help: "requests served from a stale mirror as is while it was synced in the background",
+		}, []string{"repo"}),
+		VerifyTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_verify_total",
+			Help: "mirrors checked against upstream HEAD by result (match, behind, diverged or error)",
+		}, []string{"result"}),
+		OriginCollisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_origin_collisions_total",
+			Help: "mirrors found holding another upstream than the one their key maps to, and fetched again",
+		}, []string{"repo"}),
+		MaintenanceTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_maintenance_total",
+			Help: "scheduled maintenance task runs on mirrors by task and result (ok, error, or skipped while the mirror was being fetched into)",
+		}, []string{"task", "result"}),
+		MaintenanceTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "smart_git_proxy_maintenance_seconds",
+			Help:    "duration of scheduled maintenance tasks run on a mirror, by task",
+			Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		}, []string{"task"}),
+		MirrorStaleness: &Staleness{desc: prometheus.NewDesc(
+			"smart_git_proxy_mirror_staleness_seconds",
+			"seconds since the mirror's last successful sync from upstream",
+			[]string{"repo"}, nil,
+		)},
+		UpstreamQuota: &Quota{
+			remaining: prometheus.NewDesc(
+				"smart_git_proxy_upstream_quota_remaining",
+				"what may still be fetched from the upstream host in the current quota window, by unit (bytes or fetches)",
+				[]string{"host", "unit"}, nil,
+			),
+			reset: prometheus.NewDesc(
+				"smart_git_proxy_upstream_quota_reset_timestamp_seconds",
+				"Unix time the upstream host's quota window resets at",
+				[]string{"host"}, nil,
+			),
+		},
+		QuotaBlocked: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_upstream_quota_blocked_total",
+			Help: "upstream fetches refused for exceeding the host's quota, by host",
+		}, []string{"host"}),
+		UpstreamQueueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "smart_git_proxy_upstream_queue_depth",
+			Help: "clones and syncs waiting for an upstream fetch slot, by priority",
+		}, []string{"priority"}),
+		LockWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "smart_git_proxy_lock_wait_seconds",
+			Help:    "time spent blocked on per-repo locks, upstream fetch slots or syncs and clones already in flight, by phase",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		}, []string{"phase"}),
+		UpstreamDNS: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "smart_git_proxy_upstream_dns_seconds",
+			Help:    "DNS lookup time of upstream requests, by host",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"host"}),
+		UpstreamConnect: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "smart_git_proxy_upstream_connect_seconds",
+			Help:    "TCP connect time of upstream requests, by host",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"host"}),
+		UpstreamTLS: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "smart_git_proxy_upstream_tls_handshake_seconds",
+			Help:    "TLS handshake time of upstream requests, by host",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"host"}),
+		UpstreamTTFB: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "smart_git_proxy_upstream_first_byte_seconds",
+			Help:    "time from sending an upstream request to the first response byte, by host",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"host"}),
+		EvictionsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "smart_git_proxy_evictions_total",
+			Help: "mirror repos evicted from the cache",
+		}),
+		EvictedBytesTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "smart_git_proxy_evicted_bytes_total",
+			Help: "bytes freed by cache eviction",
+		}),
+		EvictionIncompleteTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "smart_git_proxy_eviction_incomplete_total",
+			Help: "eviction runs that could not get under the target size or repo count",
+		}),
+		FreezesTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "smart_git_proxy_freezes_total",
+			Help: "cold mirror repos frozen (repacked for size) instead of evicted",
+		}),
+		UnfreezesTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "smart_git_proxy_unfreezes_total",
+			Help: "frozen mirror repos accessed again",
+		}),
+		ExpiredPurgesTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "smart_git_proxy_expired_purges_total",
+			Help: "mirror repos purged for not having been refreshed within the cache max age",
+		}),
+		MirroredRepos: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "smart_git_proxy_mirrored_repos",
+			Help: "mirror repos in the cache as of the last eviction check, by mirror directory",
+		}, []string{"dir"}),
+		Connections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "smart_git_proxy_connections",
+			Help: "client connections currently open on the git listener",
+		}),
+		SlowClientsClosed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "smart_git_proxy_slow_clients_closed_total",
+			Help: "client connections closed for receiving slower than the minimum rate",
+		}),
 	}
 
 	if reg != nil {
-		reg.MustRegister(
+		for _, c := range []prometheus.Collector{
 			m.RequestsTotal,
 			m.ResponsesTotal,
 			m.ErrorsTotal,
+			m.CacheMisses,
 			m.UpstreamLatency,
 			m.SyncTotal,
-		)
+			m.SyncSkipped,
+			m.MirrorFetches,
+			m.PackFetches,
+			m.SyncUpstreams,
+			m.PinnedPacks,
+			m.CacheChecksums,
+			m.CorruptPacks,
+			m.CloneAborts,
+			m.ClientAborts,
+			m.SyncDuration,
+			m.StaleServed,
+			m.Revalidations,
+			m.GitKilled,
+			m.VerifyTotal,
+			m.OriginCollisions,
+			m.MaintenanceTotal,
+			m.MaintenanceTime,
+			m.MirrorStaleness,
+			m.UpstreamQuota,
+			m.QuotaBlocked,
+			m.UpstreamQueueDepth,
+			m.LockWait,
+			m.UpstreamDNS,
+			m.UpstreamConnect,
+			m.UpstreamTLS,
+			m.UpstreamTTFB,
+			m.EvictionsTotal,
+			m.EvictedBytesTotal,
+			m.EvictionIncompleteTotal,
+			m.FreezesTotal,
+			m.UnfreezesTotal,
+			m.ExpiredPurgesTotal,
+			m.MirroredRepos,
+			m.Connections,
+			m.SlowClientsClosed,
+		} {
+			if err := reg.Register(c); err != nil {
+				log.Warn("metric not registered, it won't be exported", "err", err)
+			}
+		}
 	}
 	return m
 }
+
+// Staleness reports each mirror's time since its last successful sync,
+// computed when scraped so the value keeps growing between syncs. Only mirrors
+// synced since the proxy started are reported.
+type Staleness struct {
+	desc     *prometheus.Desc
+	lastSync sync.Map // map[repo]time.Time
+}
+
+// Synced records a successful sync of repo at t.
+func (s *Staleness) Synced(repo string, t time.Time) {
+	s.lastSync.Store(repo, t)
+}
+
+// Forget stops reporting repo, e.g. once its mirror is evicted.
+func (s *Staleness) Forget(repo string) {
+	s.lastSync.Delete(repo)
+}
+
+func (s *Staleness) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.desc
+}
+
+func (s *Staleness) Collect(ch chan<- prometheus.Metric) {
+	s.lastSync.Range(func(k, v any) bool {
+		ch <- prometheus.MustNewConstMetric(s.desc, prometheus.GaugeValue, time.Since(v.(time.Time)).Seconds(), k.(string))
+		return true
+	})
+}
+
+// QuotaState is the usage of an upstream host's quota in the current window.
+type QuotaState struct {
+	Host           string
+	Bytes, Fetches int64 // Left in the window, -1 when unlimited
+	Reset          time.Time
+}
+
+// Quota reports the upstream quotas left per host and when they reset,
+// computed when scraped so windows rolling over show without traffic.
+type Quota struct {
+	remaining, reset *prometheus.Desc
+	state            atomic.Pointer[func() []QuotaState]
+}
+
+// Report sets the func returning the quota states to report.
+func (q *Quota) Report(state func() []QuotaState) {
+	q.state.Store(&state)
+}
+
+func (q *Quota) Describe(ch chan<- *prometheus.Desc) {
+	ch <- q.remaining
+	ch <- q.reset
+}
+
+func (q *Quota) Collect(ch chan<- prometheus.Metric) {
+	state := q.state.Load()
+	if state == nil {
+		return
+	}
+	for _, s := range (*state)() {
+		if s.Bytes >= 0 {
+			ch <- prometheus.MustNewConstMetric(q.remaining, prometheus.GaugeValue, float64(s.Bytes), s.Host, "bytes")
+		}
+		if s.Fetches >= 0 {
+			ch <- prometheus.MustNewConstMetric(q.remaining, prometheus.GaugeValue, float64(s.Fetches), s.Host, "fetches")
+		}
+		ch <- prometheus.MustNewConstMetric(q.reset, prometheus.GaugeValue, float64(s.Reset.Unix()), s.Host)
+	}
+}
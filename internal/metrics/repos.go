@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// RepoCounters are the per-repo counters TopRepos ranks repos by.
+var RepoCounters = []string{"requests", "misses", "errors", "syncs"}
+
+// RepoCount is a repo's total for a per-repo counter, across its other labels.
+type RepoCount struct {
+	Repo  string  `json:"repo"`
+	Count float64 `json:"count"`
+}
+
+// TopRepos returns the limit repos with the highest totals for the per-repo
+// counter by (one of RepoCounters), highest first, ties by repo name. Only
+// repos counted since startup are listed.
+func (m *Metrics) TopRepos(by string, limit int) ([]RepoCount, error) {
+	var vec *prometheus.CounterVec
+	switch by {
+	case "requests":
+		vec = m.RequestsTotal
+	case "misses":
+		vec = m.CacheMisses
+	case "errors":
+		vec = m.ErrorsTotal
+	case "syncs":
+		vec = m.SyncTotal
+	default:
+		return nil, fmt.Errorf("unknown counter %q, expected one of %v", by, RepoCounters)
+	}
+
+	totals := make(map[string]float64)
+	ch := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+	for metric := range ch {
+		var pb dto.Metric
+		if err := metric.Write(&pb); err != nil {
+			continue
+		}
+		for _, label := range pb.GetLabel() {
+			if label.GetName() == "repo" {
+				totals[label.GetValue()] += pb.GetCounter().GetValue()
+			}
+		}
+	}
+
+	counts := make([]RepoCount, 0, len(totals))
+	for repo, count := range totals {
+		counts = append(counts, RepoCount{Repo: repo, Count: count})
+	}
+	slices.SortFunc(counts, func(a, b RepoCount) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Repo, b.Repo)
+	})
+	if len(counts) > limit {
+		counts = counts[:limit]
+	}
+	return counts, nil
+}
@@ -0,0 +1,184 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/crohr/smart-git-proxy/internal/gitcmd"
+)
+
+// alternatesDir is the top-level directory of a mirror root holding the
+// object stores shared by groups of mirrors (see sharedObjects), at
+// {root}/.alternates/{group}. Stores don't end in .git, so eviction and
+// maintenance leave them alone.
+const alternatesDir = ".alternates"
+
+// network returns the fork network of the mirror of key: the host/owner/repo
+// of the first AlternatesNetworks rule matching it, or host/repo otherwise, as
+// forks usually keep the name of the repo they were forked from. Unrelated
+// repos sharing a name end up sharing a store too, which only costs the
+// store's negotiation some extra refs.
+func (m *Mirror) network(key string) string {
+	for _, rw := range m.networks {
+		if rw.Pattern.MatchString(key) {
+			return rw.Pattern.ReplaceAllString(key, rw.Replacement)
+		}
+	}
+	host, rest, _ := strings.Cut(key, "/")
+	_, repo, _ := strings.Cut(rest, "/")
+	return host + "/" + repo
+}
+
+// storePath returns the object store of network in the mirror root.
+func storePath(root, network string) string {
+	return filepath.Join(root, alternatesDir, filepath.FromSlash(network))
+}
+
+// rootOf returns the mirror root holding the mirror of key at repoPath.
+func rootOf(key, repoPath string) string {
+	return strings.TrimSuffix(repoPath, string(filepath.Separator)+filepath.FromSlash(key)+".git")
+}
+
+// casStore names the single store every mirror of a root keeps its objects in
+// with ExperimentalCASStore. Fork networks always contain a slash, so it
+// can't collide with theirs.
+const casStore = "all"
+
+// sharedObjects is the objectStore keeping the objects of mirrors in stores
+// shared by a group of mirrors, which group names from a repo key: its fork
+// network (see network) with EnableAlternates, or casStore with
+// ExperimentalCASStore.
+type sharedObjects struct {
+	m     *Mirror
+	group func(key string) string
+}
+
+// storeLock returns the mutex serializing changes to the store at path.
+func (m *Mirror) storeLock(path string) *sync.Mutex {
+	lock, _ := m.stores.LoadOrStore(path, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+// adopt moves the objects of the mirror of key at repoPath into the store of
+// its group, which the mirror then borrows them from through
+// objects/info/alternates. The store fetches the mirror's refs under
+// refs/members/{key}/, keeping everything a member needs reachable there, and
+// only then is the mirror linked to it and repacked without what the store
+// has. Run after every clone and sync: objects are still downloaded from
+// upstream by each fork, but stored once.
+func (s sharedObjects) adopt(ctx context.Context, key, repoPath string) error {
+	m := s.m
+	store := storePath(rootOf(key, repoPath), s.group(key))
+	lock := m.storeLock(store)
+	m.lock("objects-store", lock)
+	defer lock.Unlock()
+
+	git := func(dir string, config []string, args ...string) error {
+		cmd := gitcmd.Command(ctx, append(append([]string{"-C", dir}, config...), args...)...)
+		cmd.Env = gitEnv("", "")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return gitError("git "+args[0], err, output)
+		}
+		return nil
+	}
+	// A mirror without refs would be linked to a store release can't
+	// tell it uses
+	cmd := gitcmd.Command(ctx, "-C", repoPath, "for-each-ref", "--count=1")
+	cmd.Env = gitEnv("", "")
+	if out, err := cmd.Output(); err != nil || len(out) == 0 {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(store, "HEAD")); err != nil {
+		if err := mkdirAll(filepath.Dir(store), m.dirMode); err != nil {
+			return fmt.Errorf("create store dir: %w", err)
+		}
+		cmd = gitcmd.Command(ctx, append(m.sharedRepoArgs(), "init", "-q", "--bare", store)...)
+		cmd.Env = gitEnv("", "")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return gitError("git init", err, output)
+		}
+	}
+	// Kept as a pack even when small, as the mirror drops its copies of
+	// objects only once they are packed in the store
+	if err := git(store, []string{"-c", "gc.auto=0", "-c", "fetch.unpackLimit=1"}, "fetch", "-q", "--prune", "--force", "--no-tags", repoPath, "+refs/*:refs/members/"+key+"/*"); err != nil {
+		return err
+	}
+
+	// Relative, so the root can be moved or archived as a whole
+	rel, err := filepath.Rel(filepath.Join(repoPath, "objects"), filepath.Join(store, "objects"))
+	if err != nil {
+		return err
+	}
+	info := filepath.Join(repoPath, "objects", "info")
+	if err := mkdirAll(info, m.dirMode); err != nil {
+		return fmt.Errorf("create objects/info: %w", err)
+	}
+	if err := m.writeFile(filepath.Join(info, "alternates"), []byte(rel+"\n")); err != nil {
+		return fmt.Errorf("write alternates: %w", err)
+	}
+	// Bitmaps need every object in the pack, which borrowed ones aren't
+	if err := git(repoPath, []string{"-c", "repack.writeBitmaps=false"}, "repack", "-a", "-d", "-l", "-q"); err != nil {
+		return err
+	}
+	if err := git(repoPath, nil, "prune-packed"); err != nil {
+		return err
+	}
+	// Objects of forks gone from the store are pruned after git's usual grace
+	// period, as members fetching may still build on them
+	return git(store, nil, "gc", "--auto", "--quiet")
+}
+
+// release drops the refs of the evicted mirror of key at repoPath from its
+// group's store, removing the store along with its last member.
+func (s sharedObjects) release(key, repoPath string) {
+	m := s.m
+	store := storePath(rootOf(key, repoPath), s.group(key))
+	if _, err := os.Stat(store); err != nil {
+		return
+	}
+	lock := m.storeLock(store)
+	m.lock("objects-store", lock)
+	defer lock.Unlock()
+
+	ctx := context.Background()
+	cmd := gitcmd.Command(ctx, "-C", store, "for-each-ref", "--format=delete %(refname)", "refs/members/")
+	cmd.Env = gitEnv("", "")
+	out, err := cmd.Output()
+	if err != nil {
+		m.log.Warn("list store refs failed", "store", store, "err", err)
+		return
+	}
+	var deletes, others int
+	var stdin strings.Builder
+	prefix := "delete refs/members/" + key + "/"
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, prefix):
+			stdin.WriteString(line + "\n")
+			deletes++
+		default:
+			others++
+		}
+	}
+	if others == 0 {
+		// Linked members always have refs in the store, so nothing uses it
+		if err := os.RemoveAll(store); err != nil {
+			m.log.Warn("remove store failed", "store", store, "err", err)
+		}
+		return
+	}
+	if deletes == 0 {
+		return
+	}
+	cmd = gitcmd.Command(ctx, "-C", store, "update-ref", "--stdin")
+	cmd.Env = gitEnv("", "")
+	cmd.Stdin = strings.NewReader(stdin.String())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		m.log.Warn("drop evicted mirror from store failed", "repo", key, "store", store, "err", err, "output", string(output))
+	}
+}
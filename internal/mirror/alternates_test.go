@@ -0,0 +1,209 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+)
+
+func TestAlternatesShareForkObjects(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	// Objects a mirror holds itself, loose or packed
+	localObjects := func(repoPath string) int {
+		t.Helper()
+		n := 0
+		for _, line := range strings.Split(git("-C", repoPath, "count-objects", "-v"), "\n") {
+			if v, ok := strings.CutPrefix(line, "count: "); ok && v != "0" {
+				n++
+			}
+			if v, ok := strings.CutPrefix(line, "in-pack: "); ok && v != "0" {
+				n++
+			}
+		}
+		return n
+	}
+
+	work := filepath.Join(t.TempDir(), "work")
+	upstream := filepath.Join(t.TempDir(), "upstream.git")
+	fork := filepath.Join(t.TempDir(), "fork.git")
+	git("init", "-q", "-b", "main", work)
+	for _, f := range []string{"a", "b", "c"} {
+		if err := os.WriteFile(filepath.Join(work, f), []byte(strings.Repeat(f, 4096)), 0o644); err != nil {
+			t.Fatalf("write %s: %v", f, err)
+		}
+		git("-C", work, "add", f)
+		git("-C", work, "commit", "-q", "-m", f)
+	}
+	git("clone", "-q", "--bare", work, upstream)
+	git("-C", work, "commit", "-q", "--allow-empty", "-m", "fork only")
+	git("clone", "-q", "--bare", work, fork)
+
+	root := t.TempDir()
+	cfg := &config.Config{MirrorDir: root, EnableAlternates: true}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	ctx := context.Background()
+	upstreamPath, _, err := m.EnsureRepo(ctx, "local", "owner", "proj", upstream, "")
+	if err != nil {
+		t.Fatalf("clone upstream: %v", err)
+	}
+	forkPath, _, err := m.EnsureRepo(ctx, "local", "forker", "proj", fork, "")
+	if err != nil {
+		t.Fatalf("clone fork: %v", err)
+	}
+	m.Wait()
+
+	store := storePath(root, "local/proj")
+	for _, p := range []string{upstreamPath, forkPath} {
+		if n := localObjects(p); n != 0 {
+			t.Errorf("expected %s to keep no objects of its own, found %d kinds", p, n)
+		}
+		git("-C", p, "fsck", "--no-dangling")
+	}
+	if got, want := git("-C", forkPath, "rev-parse", "main"), git("-C", work, "rev-parse", "HEAD"); got != want {
+		t.Fatalf("expected fork at %s, got %s", want, got)
+	}
+	// Every object is stored once: the store has as many as the fork needs
+	if got, want := git("-C", store, "rev-list", "--objects", "--all", "--count"), git("-C", fork, "rev-list", "--objects", "--all", "--count"); got != want {
+		t.Fatalf("expected %s objects in the store, got %s", want, got)
+	}
+
+	// Archives carry the store along
+	var archive bytes.Buffer
+	if _, err := Export(root, &archive); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	imported := t.TempDir()
+	if _, err := Import(ctx, imported, &archive, false); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	git("-C", filepath.Join(imported, "local", "forker", "proj.git"), "fsck", "--no-dangling")
+
+	// Evicting a member keeps the store for the others, the last one removes it
+	evict := func(key, repoPath string) {
+		t.Helper()
+		if err := os.RemoveAll(repoPath); err != nil {
+			t.Fatalf("remove %s: %v", repoPath, err)
+		}
+		m.forget(key, repoPath)
+	}
+	evict("local/owner/proj", upstreamPath)
+	if refs := git("-C", store, "for-each-ref", "--format=%(refname)", "refs/members/local/owner/"); refs != "" {
+		t.Fatalf("expected evicted mirror's refs dropped from the store, got %s", refs)
+	}
+	git("-C", forkPath, "fsck", "--no-dangling")
+	evict("local/forker/proj", forkPath)
+	if _, err := os.Stat(store); !os.IsNotExist(err) {
+		t.Fatalf("expected store removed with its last member, got %v", err)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	cfg, err := config.LoadArgs([]string{"-alternates-networks", `github\.com/[^/]+/linux=>github.com/torvalds/linux`})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	m := &Mirror{networks: cfg.AlternatesNetworks}
+	for key, want := range map[string]string{
+		"github.com/torvalds/linux": "github.com/torvalds/linux",
+		"github.com/someone/linux":  "github.com/torvalds/linux",
+		"github.com/someone/proj":   "github.com/proj",
+		"gitlab.com/other/proj":     "gitlab.com/proj",
+	} {
+		if got := m.network(key); got != want {
+			t.Errorf("network(%s) = %s, want %s", key, got, want)
+		}
+	}
+}
+
+func TestCASStoreSharesAcrossRepos(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	// Two repos sharing history under names no fork network would match
+	work := filepath.Join(t.TempDir(), "work")
+	app := filepath.Join(t.TempDir(), "app.git")
+	lib := filepath.Join(t.TempDir(), "lib.git")
+	git("init", "-q", "-b", "main", work)
+	if err := os.WriteFile(filepath.Join(work, "shared"), []byte(strings.Repeat("x", 4096)), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	git("-C", work, "add", "shared")
+	git("-C", work, "commit", "-q", "-m", "shared")
+	git("clone", "-q", "--bare", work, app)
+	git("-C", work, "commit", "-q", "--allow-empty", "-m", "lib only")
+	git("clone", "-q", "--bare", work, lib)
+
+	root := t.TempDir()
+	cfg := &config.Config{MirrorDir: root, ExperimentalCASStore: true}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	ctx := context.Background()
+	appPath, _, err := m.EnsureRepo(ctx, "local", "team", "app", app, "")
+	if err != nil {
+		t.Fatalf("clone app: %v", err)
+	}
+	libPath, _, err := m.EnsureRepo(ctx, "local", "other", "lib", lib, "")
+	if err != nil {
+		t.Fatalf("clone lib: %v", err)
+	}
+	m.Wait()
+
+	store := storePath(root, casStore)
+	for _, p := range []string{appPath, libPath} {
+		if out := git("-C", p, "count-objects", "-v"); !strings.Contains(out, "count: 0") || !strings.Contains(out, "in-pack: 0") {
+			t.Errorf("expected %s to hold only refs, got\n%s", p, out)
+		}
+		git("-C", p, "fsck", "--no-dangling")
+	}
+	if got, want := git("-C", store, "rev-list", "--objects", "--all", "--count"), git("-C", lib, "rev-list", "--objects", "--all", "--count"); got != want {
+		t.Fatalf("expected %s objects in the store, got %s", want, got)
+	}
+
+	for key, path := range map[string]string{"local/team/app": appPath, "local/other/lib": libPath} {
+		if err := os.RemoveAll(path); err != nil {
+			t.Fatalf("remove %s: %v", path, err)
+		}
+		m.forget(key, path)
+	}
+	if _, err := os.Stat(store); !os.IsNotExist(err) {
+		t.Fatalf("expected store removed with its last member, got %v", err)
+	}
+}
@@ -0,0 +1,335 @@
+package mirror
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/gitcmd"
+)
+
+// ErrNotEmpty is returned by Import for mirror roots that already have mirrors.
+var ErrNotEmpty = errors.New("mirror root already has mirrors")
+
+// Export writes the mirrors under root to w as a tar archive for seeding
+// another proxy with Import, returning how many it wrote. Files keep their
+// modification times, which eviction falls back to for access times, so the
+// least recently used mirrors are still evicted first after importing.
+// Leftovers of interrupted operations are skipped. The proxy using root
+// should be stopped: mirrors synced while exporting may be archived broken.
+func Export(root string, w io.Writer) (int, error) {
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return 0, fmt.Errorf("resolve mirror root: %w", err)
+	}
+	tw := tar.NewWriter(w)
+	repos := 0
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		// Top-level dot entries are staging dirs and temp files, but for
+		// the layout version and the stores mirrors share objects through
+		if !strings.ContainsRune(rel, filepath.Separator) && strings.HasPrefix(rel, ".") && rel != layoutVersionFile && rel != alternatesDir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && isFetchLeftover(p) {
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return fmt.Errorf("export %s: not a regular file", p)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			hdr.Name += "/"
+			if isRepo(p) {
+				repos++
+			}
+		}
+		hdr.Uname, hdr.Gname = "", ""
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return repos, fmt.Errorf("export %s: %w", root, err)
+	}
+	return repos, tw.Close()
+}
+
+// Import extracts an archive written by Export into root and returns the
+// keys of the mirrors it added. Every mirror is checked with git fsck first,
+// and broken ones are left out and reported in the returned error, after the
+// others have been imported. Import refuses to write into a root that
+// already has mirrors unless force is set, in which case mirrors from the
+// archive replace existing ones with the same key.
+func Import(ctx context.Context, root string, r io.Reader, force bool) ([]string, error) {
+	if err := mkdirAll(root, defaultDirMode); err != nil {
+		return nil, fmt.Errorf("create mirror root: %w", err)
+	}
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, fmt.Errorf("resolve mirror root: %w", err)
+	}
+	existing, err := repoKeys(root)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 && !force {
+		return nil, fmt.Errorf("%w: %d in %s", ErrNotEmpty, len(existing), root)
+	}
+
+	// Extract next to the mirrors, so they can be moved into place atomically
+	staging, err := os.MkdirTemp(root, ".import-*")
+	if err != nil {
+		return nil, fmt.Errorf("create import dir: %w", err)
+	}
+	defer os.RemoveAll(staging)
+	if err := extract(staging, r); err != nil {
+		return nil, fmt.Errorf("extract archive: %w", err)
+	}
+	if err := checkArchiveLayout(staging); err != nil {
+		return nil, err
+	}
+
+	keys, err := repoKeys(staging)
+	if err != nil {
+		return nil, err
+	}
+	var good, imported []string
+	var errs []error
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return imported, err
+		}
+		src := filepath.Join(staging, filepath.FromSlash(key)+".git")
+		cmd := gitcmd.Command(ctx, "-C", src, "fsck", "--no-dangling", "--no-progress")
+		cmd.Env = gitEnv("", "")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, gitError("git fsck", err, output)))
+			continue
+		}
+		good = append(good, key)
+	}
+	// Mirrors find their shared stores relative to themselves, so stores go
+	// first, once the mirrors using them have been checked
+	if err := importStores(ctx, staging, root); err != nil {
+		return imported, err
+	}
+	for _, key := range good {
+		src := filepath.Join(staging, filepath.FromSlash(key)+".git")
+		dst := filepath.Join(root, filepath.FromSlash(key)+".git")
+		if err := mkdirAll(filepath.Dir(dst), defaultDirMode); err != nil {
+			return imported, fmt.Errorf("create parent dir: %w", err)
+		}
+		if err := os.RemoveAll(dst); err != nil {
+			return imported, fmt.Errorf("replace %s: %w", key, err)
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return imported, fmt.Errorf("move %s into place: %w", key, err)
+		}
+		imported = append(imported, key)
+	}
+	return imported, errors.Join(errs...)
+}
+
+// importStores moves the shared object stores extracted to staging into
+// root. The refs of stores root already has are fetched into them instead,
+// which keeps the objects of both the existing and the imported mirrors.
+func importStores(ctx context.Context, staging, root string) error {
+	base := filepath.Join(staging, alternatesDir)
+	return filepath.WalkDir(base, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) && p == base {
+			return nil
+		}
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(p, "HEAD")); err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(staging, p)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(root, rel)
+		if _, err := os.Stat(filepath.Join(dst, "HEAD")); err != nil {
+			if err := mkdirAll(filepath.Dir(dst), defaultDirMode); err != nil {
+				return fmt.Errorf("create store dir: %w", err)
+			}
+			if err := os.Rename(p, dst); err != nil {
+				return fmt.Errorf("move store %s into place: %w", rel, err)
+			}
+			return filepath.SkipDir
+		}
+		cmd := gitcmd.Command(ctx, "-C", dst, "-c", "gc.auto=0", "fetch", "-q", "--force", "--no-tags", p, "+refs/members/*:refs/members/*")
+		cmd.Env = gitEnv("", "")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("merge store %s: %w", rel, gitError("git fetch", err, output))
+		}
+		return filepath.SkipDir
+	})
+}
+
+// extract writes the directories and regular files of the tar archive r
+// under dir, with their modes and modification times.
+func extract(dir string, r io.Reader) error {
+	tr := tar.NewReader(r)
+	var dirs []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(strings.TrimSuffix(hdr.Name, "/"))
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("invalid path %q", hdr.Name)
+		}
+		p := filepath.Join(dir, name)
+		mode := hdr.FileInfo().Mode().Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(p, 0o700); err != nil {
+				return err
+			}
+			dirs = append(dirs, hdr)
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+				return err
+			}
+			if err := writeEntry(p, tr, mode, hdr.ModTime); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported entry %q of type %q", hdr.Name, hdr.Typeflag)
+		}
+	}
+	// Directory modes last, so read-only ones could still be filled
+	for _, hdr := range dirs {
+		p := filepath.Join(dir, filepath.FromSlash(strings.TrimSuffix(hdr.Name, "/")))
+		if err := os.Chmod(p, hdr.FileInfo().Mode().Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(p, hdr.ModTime, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeEntry(p string, r io.Reader, mode os.FileMode, modTime time.Time) error {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(p, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(p, modTime, modTime)
+}
+
+// checkArchiveLayout refuses archives exported from a mirror root with a
+// different layout than this proxy's, which would mis-key their mirrors.
+func checkArchiveLayout(dir string) error {
+	version := 1
+	data, err := os.ReadFile(filepath.Join(dir, layoutVersionFile))
+	switch {
+	case err == nil:
+		if version, err = strconv.Atoi(strings.TrimSpace(string(data))); err != nil {
+			return fmt.Errorf("invalid layout version in archive: %q", data)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf("read layout version: %w", err)
+	}
+	if version != LayoutVersion {
+		return fmt.Errorf("archive uses mirror layout version %d, expected %d", version, LayoutVersion)
+	}
+	return nil
+}
+
+// repoKeys returns the keys (host/owner/repo) of the mirrors under root.
+func repoKeys(root string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || p == root {
+			return nil
+		}
+		if filepath.Dir(p) == root && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !isRepo(p) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, strings.TrimSuffix(filepath.ToSlash(rel), ".git"))
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list mirrors in %s: %w", root, err)
+	}
+	return keys, nil
+}
+
+// isFetchLeftover reports whether the file at p is a temporary pack left by
+// an interrupted fetch (see removeFetchLeftovers).
+func isFetchLeftover(p string) bool {
+	return strings.HasPrefix(filepath.Base(p), "tmp_") && filepath.Base(filepath.Dir(p)) == "pack"
+}
+
+// isRepo reports whether dir is a bare mirror.
+func isRepo(dir string) bool {
+	if filepath.Ext(dir) != ".git" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(dir, "HEAD"))
+	return err == nil
+}
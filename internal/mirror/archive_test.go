@@ -0,0 +1,121 @@
+package mirror
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	src := t.TempDir()
+	work := filepath.Join(t.TempDir(), "work")
+	git("init", "-q", "-b", "main", work)
+	git("-C", work, "commit", "-q", "--allow-empty", "-m", "first")
+	for _, key := range []string{"github.com/owner/repo", "github.com/owner/.github"} {
+		git("clone", "-q", "--mirror", work, filepath.Join(src, key+".git"))
+	}
+	head := git("-C", work, "rev-parse", "HEAD")
+	if err := writeLayoutVersion(filepath.Join(src, layoutVersionFile), LayoutVersion); err != nil {
+		t.Fatal(err)
+	}
+	// An old access time and leftovers that must not be exported
+	old := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	headFile := filepath.Join(src, "github.com", "owner", "repo.git", "HEAD")
+	if err := os.Chtimes(headFile, old, old); err != nil {
+		t.Fatal(err)
+	}
+	leftover := filepath.Join("github.com", "owner", "repo.git", "objects", "pack", "tmp_pack_test")
+	for _, p := range []string{leftover, ".peer-1.bundle"} {
+		if err := os.WriteFile(filepath.Join(src, p), []byte("partial"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var archive bytes.Buffer
+	if n, err := Export(src, &archive); err != nil || n != 2 {
+		t.Fatalf("expected 2 mirrors exported, got %d (%v)", n, err)
+	}
+
+	dst := t.TempDir()
+	ctx := context.Background()
+	imported, err := Import(ctx, dst, bytes.NewReader(archive.Bytes()), false)
+	if err != nil || !slices.Equal(imported, []string{"github.com/owner/.github", "github.com/owner/repo"}) {
+		t.Fatalf("expected both mirrors imported, got %v (%v)", imported, err)
+	}
+	if got := git("-C", filepath.Join(dst, "github.com", "owner", "repo.git"), "rev-parse", "main"); got != head {
+		t.Fatalf("expected imported mirror at %s, got %s", head, got)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "github.com", "owner", "repo.git", "HEAD")); err != nil || !info.ModTime().Equal(old) {
+		t.Fatalf("expected HEAD to keep its modification time %v, got %v (%v)", old, info.ModTime(), err)
+	}
+	for _, p := range []string{leftover, ".peer-1.bundle"} {
+		if _, err := os.Stat(filepath.Join(dst, p)); !os.IsNotExist(err) {
+			t.Fatalf("expected %s not to be imported, got %v", p, err)
+		}
+	}
+	if entries, _ := filepath.Glob(filepath.Join(dst, ".import-*")); len(entries) != 0 {
+		t.Fatalf("expected import dir to be cleaned up, got %v", entries)
+	}
+
+	// Existing mirrors are only replaced when forced
+	if _, err := Import(ctx, dst, bytes.NewReader(archive.Bytes()), false); !errors.Is(err, ErrNotEmpty) {
+		t.Fatalf("expected import into a non-empty mirror root to be refused, got %v", err)
+	}
+	if imported, err := Import(ctx, dst, bytes.NewReader(archive.Bytes()), true); err != nil || len(imported) != 2 {
+		t.Fatalf("expected forced import to replace both mirrors, got %v (%v)", imported, err)
+	}
+
+	// Broken mirrors are left out, the others still imported
+	objects, _ := filepath.Glob(filepath.Join(src, "github.com", "owner", "repo.git", "objects", "??", "*"))
+	for _, p := range objects {
+		if err := os.Remove(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive.Reset()
+	if _, err := Export(src, &archive); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	imported, err = Import(ctx, t.TempDir(), &archive, false)
+	if err == nil || !strings.Contains(err.Error(), "github.com/owner/repo:") || !slices.Equal(imported, []string{"github.com/owner/.github"}) {
+		t.Fatalf("expected only the intact mirror to be imported, got %v (%v)", imported, err)
+	}
+}
+
+func TestImportRejectsUnsafePaths(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	if err := tw.WriteHeader(&tar.Header{Name: "../escape", Mode: 0o644, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	root := t.TempDir()
+	if _, err := Import(context.Background(), root, &archive, false); err == nil || !strings.Contains(err.Error(), "invalid path") {
+		t.Fatalf("expected paths outside the mirror root to be rejected, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(root), "escape")); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing written outside the mirror root, got %v", err)
+	}
+}
@@ -1,121 +1,457 @@
 package mirror
 
 import (
+	"context"
 	"fmt"
 	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/gitcmd"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
 )
 
 const (
-	// DefaultMaxSizePercent is the default percentage of available disk space to use
+	// DefaultMaxSizePercent is the default percentage of the disk to use
 	DefaultMaxSizePercent = 80.0
-	// MinFreeSpace is the minimum free space to maintain (1GB)
-	MinFreeSpace = 1024 * 1024 * 1024
+	// DefaultMinFreeSpace is the default minimum free space to maintain (1GiB)
+	DefaultMinFreeSpace = 1024 * 1024 * 1024
 )
 
 // Cache manages LRU eviction of mirror repositories.
 type Cache struct {
 	root       string
 	maxSize    config.SizeSpec
+	minFree    config.SizeSpec
 	log        *slog.Logger
+	metrics    *metrics.Metrics
 	mu         sync.Mutex
 	accessTime sync.Map // map[repoKey]time.Time
+
+	metaMu   sync.Mutex  // Serializes sidecar changes
+	metas    sync.Map    // map[repoKey]repoMeta, sidecars as last read or written
+	fileMode os.FileMode // Of the sidecars written
+
+	// followSymlinks counts what symlinks under root point to in sizes,
+	// rather than the links themselves
+	followSymlinks bool
+	// recordedSizes measures the cache by the sizes recorded in mirror
+	// sidecars instead of walking every mirror, see cacheSize
+	recordedSizes bool
+
+	// onEvict is called with the key and path of every evicted repo
+	onEvict func(key, path string)
+
+	// freezeFor is how long MaybeEvict keeps cold repos frozen (repacked for
+	// size) before deleting them; zero deletes them right away
+	freezeFor time.Duration
+	// freeze repacks the repo at path for size (overridable in tests)
+	freeze func(path string) error
+	// maxRepos is how many repos MaybeEvict keeps at most, evicting the
+	// coldest down to the low watermark of it past that; zero means no limit
+	maxRepos int
+	// minAge is how long after being created or refreshed from upstream
+	// repos are kept from eviction; zero doesn't protect them
+	minAge time.Duration
+
+	// highWatermark and lowWatermark are the percentages of the max size
+	// above which MaybeEvict starts evicting, and down to which it evicts;
+	// zero means 100 and 90
+	highWatermark float64
+	lowWatermark  float64
+
+	// maxAge is how long after its last refresh from upstream a repo is
+	// purged, whatever the cache size; zero keeps repos regardless of age
+	maxAge time.Duration
+	// refreshedAt returns when the repo of key at path was last refreshed
+	refreshedAt func(key, path string) time.Time
+
+	// diskStats reports total and available bytes on the mirror filesystem (overridable in tests)
+	diskStats func() (total, available int64, err error)
+
+	lockFile *os.File // Holding the lock of root, nil if not taken
 }
 
-// NewCache creates a new cache manager.
-func NewCache(root string, maxSize config.SizeSpec, log *slog.Logger) *Cache {
-	return &Cache{
+// NewCache creates a new cache manager for root, resolved to its real path
+// so walking it and relating paths to it agree when it is a symlink.
+// minFree is the free disk space to always keep (absolute or percentage of the disk, zero = 1GiB).
+// It locks root against other instances as lockMode says (see config.Config.CacheLock),
+// until Close, then checks its on-disk layout version, migrating it if needed.
+func NewCache(root string, maxSize, minFree config.SizeSpec, lockMode string, metrics *metrics.Metrics, log *slog.Logger) (*Cache, error) {
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, fmt.Errorf("resolve mirror root: %w", err)
+	}
+	c := &Cache{
 		root:    root,
 		maxSize: maxSize,
+		minFree: minFree,
 		log:     log,
+		metrics: metrics,
+		diskStats: func() (int64, int64, error) {
+			return statfs(root)
+		},
+		freeze:   freezeRepo,
+		fileMode: defaultFileMode,
+	}
+	if err := c.lock(lockMode); err != nil {
+		return nil, err
+	}
+	if err := c.checkLayout(); err != nil {
+		c.Close()
+		return nil, err
 	}
+	return c, nil
 }
 
-// Touch updates the access time for a repository.
+// Touch updates the access time for a repository, recording it in its
+// sidecar at most every accessPersistInterval.
 func (c *Cache) Touch(key string) {
-	c.accessTime.Store(key, time.Now())
+	now := time.Now()
+	c.accessTime.Store(key, now)
+	path := filepath.Join(c.root, key+".git")
+	if now.Sub(c.meta(key, path).AccessedAt) < accessPersistInterval {
+		return
+	}
+	if err := c.updateMeta(key, path, func(meta *repoMeta) { meta.AccessedAt = now }); err != nil {
+		c.log.Warn("failed to record repo access", "key", key, "err", err)
+	}
 }
 
-// MaybeEvict checks disk usage and evicts LRU repositories if needed.
-// Should be called after cloning a new repo.
+// MaybeEvict checks the repo count and disk usage and evicts LRU
+// repositories if needed. Should be called after cloning a new repo.
 func (c *Cache) MaybeEvict() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	c.evictExcessRepos()
+
 	maxBytes := c.getMaxSize()
 	if maxBytes <= 0 {
 		return // No limit configured and couldn't determine disk size
 	}
 
-	currentSize, err := c.getDirSize()
+	currentSize, err := c.cacheSize()
 	if err != nil {
 		c.log.Warn("failed to get mirror dir size", "err", err)
 		return
 	}
 
-	if currentSize <= maxBytes {
+	highSize, targetSize := c.watermarks(maxBytes)
+	if currentSize <= highSize {
 		c.log.Debug("cache size within limits", "current", formatSize(currentSize), "max", formatSize(maxBytes))
 		return
 	}
 
-	c.log.Info("cache size exceeded, starting eviction", "current", formatSize(currentSize), "max", formatSize(maxBytes))
+	c.log.Info("cache size exceeded, starting eviction", "current", formatSize(currentSize), "max", formatSize(maxBytes), "high_watermark", formatSize(highSize))
+
+	// Evict down to the low watermark, leaving room before the next eviction
+	freed, _ := c.evictLRU(currentSize-targetSize, 0, c.freezeFor > 0)
+	currentSize -= freed
+
+	if currentSize > targetSize {
+		c.metrics.EvictionIncompleteTotal.Inc()
+		c.log.Warn("eviction could not reach target size", "current", formatSize(currentSize), "target", formatSize(targetSize))
+	}
+
+	c.log.Info("eviction complete", "newSize", formatSize(currentSize))
+}
+
+// evictExcessRepos evicts the least recently used repos down to the low
+// watermark of maxRepos if there are more than that, whatever their size,
+// and sets the MirroredRepos gauge to how many are left. Freezing a repo doesn't make one less, so
+// they are deleted right away. Callers must hold c.mu.
+func (c *Cache) evictExcessRepos() {
+	repos, err := c.listReposWithAccessTime()
+	if err != nil {
+		c.log.Warn("failed to list repos", "err", err)
+		return
+	}
+	count := len(repos)
+	if c.maxRepos > 0 && count > c.maxRepos {
+		_, low := c.watermarks(int64(c.maxRepos))
+		target := int(low)
+		c.log.Info("repo count exceeded, starting eviction", "count", count, "max", c.maxRepos, "target", target)
+		_, evicted := c.evictLRU(0, count-target, false)
+		count -= evicted
+		if count > target {
+			c.metrics.EvictionIncompleteTotal.Inc()
+			c.log.Warn("eviction could not reach target repo count", "count", count, "target", target)
+		}
+	}
+	c.metrics.MirroredRepos.WithLabelValues(c.root).Set(float64(count))
+}
+
+// watermarks returns the cache sizes above which eviction starts and down to
+// which it evicts, given the max size.
+func (c *Cache) watermarks(maxBytes int64) (high, low int64) {
+	highPct, lowPct := c.highWatermark, c.lowWatermark
+	if highPct == 0 {
+		highPct = 100
+	}
+	if lowPct == 0 {
+		lowPct = 90
+	}
+	return int64(float64(maxBytes) * highPct / 100), int64(float64(maxBytes) * lowPct / 100)
+}
+
+// EnsureFreeSpace evicts LRU repositories when free disk space drops below
+// the configured minimum, regardless of the size target. This covers the disk being
+// filled by something other than our own clones.
+func (c *Cache) EnsureFreeSpace() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	total, available, err := c.diskStats()
+	if err != nil {
+		c.log.Warn("failed to get disk stats", "err", err)
+		return
+	}
+	minFree := c.minFreeBytes(total)
+	if available >= minFree {
+		return
+	}
 
+	need := minFree - available
+	c.log.Warn("low disk space, forcing eviction", "available", formatSize(available), "min_free", formatSize(minFree))
+	// Free space is a hard floor, so repos are deleted right away
+	freed, _ := c.evictLRU(need, 0, false)
+	if freed < need {
+		c.metrics.EvictionIncompleteTotal.Inc()
+		c.log.Warn("eviction could not free enough space", "freed", formatSize(freed), "needed", formatSize(need))
+	}
+}
+
+// PurgeExpired removes the repos last refreshed more than maxAge ago.
+func (c *Cache) PurgeExpired() {
+	if c.maxAge <= 0 || c.refreshedAt == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	repos, err := c.listReposWithAccessTime()
+	if err != nil {
+		c.log.Warn("failed to list repos for expiry", "err", err)
+		return
+	}
+	for _, repo := range repos {
+		if age := time.Since(c.refreshedAt(repo.key, repo.path)); age > c.maxAge {
+			c.purge(repo.key, repo.path, age)
+		}
+	}
+}
+
+// Purge removes the repo of key at path, last refreshed age ago, for being
+// too old to serve.
+func (c *Cache) Purge(key, path string, age time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.purge(key, path, age)
+}
+
+// purge is Purge for callers holding c.mu.
+func (c *Cache) purge(key, path string, age time.Duration) {
+	c.log.Info("purging expired repo", "key", key, "age", age.Round(time.Second), "max_age", c.maxAge)
+	if err := c.remove(key, path); err != nil {
+		c.log.Warn("failed to remove repo", "path", path, "err", err)
+		return
+	}
+	c.metrics.ExpiredPurgesTotal.Inc()
+}
+
+// Run periodically purges expired repos and checks the cache size and free
+// disk space until ctx is done, so cleanup doesn't depend on clone traffic.
+func (c *Cache) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.PurgeExpired()
+			c.EnsureFreeSpace()
+			c.MaybeEvict()
+		}
+	}
+}
+
+// evictLRU removes repos, least recently used first, until at least need bytes
+// have been freed and count repos deleted, or no repos are left. Returns the
+// number of bytes freed and of repos deleted.
+// With tiered set, repos are frozen first and only deleted once they have
+// been frozen for freezeFor. Repos created or refreshed within minAge are
+// skipped. Callers must hold c.mu.
+func (c *Cache) evictLRU(need int64, count int, tiered bool) (int64, int) {
 	// Get all repos sorted by access time (oldest first)
 	repos, err := c.listReposWithAccessTime()
 	if err != nil {
 		c.log.Warn("failed to list repos for eviction", "err", err)
-		return
+		return 0, 0
 	}
 
-	// Sort by access time (oldest first)
+	// Sort by last use (oldest first)
 	sort.Slice(repos, func(i, j int) bool {
-		return repos[i].accessTime.Before(repos[j].accessTime)
+		return repos[i].lastUsed().Before(repos[j].lastUsed())
 	})
 
-	// Evict until we're under the limit
-	targetSize := int64(float64(maxBytes) * 0.90) // Aim for 90% of max to avoid thrashing
+	var freed int64
+	var evicted int
 	for _, repo := range repos {
-		if currentSize <= targetSize {
+		if freed >= need && evicted >= count {
 			break
 		}
 
-		repoSize, err := getDirSize(repo.path)
-		if err != nil {
-			c.log.Warn("failed to get repo size", "path", repo.path, "err", err)
+		if c.minAge > 0 && time.Since(repo.fetchedAt()) < c.minAge {
+			continue
+		}
+		repoSize := repo.size
+		if tiered && repo.frozenAt.IsZero() {
+			freed += c.freezeLRU(repo, repoSize)
+			continue
+		}
+		if tiered && time.Since(repo.frozenAt) < c.freezeFor {
 			continue
 		}
 
 		c.log.Info("evicting repo", "key", repo.key, "size", formatSize(repoSize), "lastAccess", repo.accessTime)
-		if err := os.RemoveAll(repo.path); err != nil {
+		if err := c.remove(repo.key, repo.path); err != nil {
 			c.log.Warn("failed to remove repo", "path", repo.path, "err", err)
 			continue
 		}
 
-		// Clean up empty parent directories
-		c.cleanEmptyParents(repo.path)
+		freed += repoSize
+		evicted++
+		c.metrics.EvictionsTotal.Inc()
+		c.metrics.EvictedBytesTotal.Add(float64(repoSize))
+	}
+	return freed, evicted
+}
+
+// remove deletes the repo of key at path and what is remembered about it.
+// Callers must hold c.mu.
+func (c *Cache) remove(key, path string) error {
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	// Clean up empty parent directories
+	c.cleanEmptyParents(path)
 
-		currentSize -= repoSize
-		c.accessTime.Delete(repo.key)
+	c.accessTime.Delete(key)
+	c.metas.Delete(key)
+	if c.onEvict != nil {
+		c.onEvict(key, path)
 	}
+	return nil
+}
 
-	c.log.Info("eviction complete", "newSize", formatSize(currentSize))
+// freezeLRU freezes a cold repo of repoSize bytes, returning the bytes freed.
+// Callers must hold c.mu.
+func (c *Cache) freezeLRU(repo repoInfo, repoSize int64) int64 {
+	c.log.Info("freezing repo", "key", repo.key, "size", formatSize(repoSize), "lastAccess", repo.accessTime)
+	if err := c.freeze(repo.path); err != nil {
+		c.log.Warn("failed to freeze repo", "path", repo.path, "err", err)
+		return 0
+	}
+	frozenSize, err := c.dirSize(repo.path)
+	if err != nil {
+		frozenSize = repoSize
+	}
+	if err := c.updateMeta(repo.key, repo.path, func(meta *repoMeta) {
+		meta.FrozenAt = time.Now()
+		meta.Size = frozenSize
+	}); err != nil {
+		c.log.Warn("failed to mark repo as frozen", "path", repo.path, "err", err)
+		return 0
+	}
+	c.metrics.FreezesTotal.Inc()
+
+	if frozenSize > repoSize {
+		return 0
+	}
+	c.log.Info("froze repo", "key", repo.key, "size", formatSize(frozenSize))
+	return repoSize - frozenSize
+}
+
+// Unfreeze returns a frozen repo to the active tier on access, reporting
+// whether it was frozen.
+func (c *Cache) Unfreeze(key, path string) bool {
+	if c.meta(key, path).FrozenAt.IsZero() {
+		return false
+	}
+	wasFrozen := false
+	if err := c.updateMeta(key, path, func(meta *repoMeta) {
+		wasFrozen = !meta.FrozenAt.IsZero()
+		meta.FrozenAt = time.Time{}
+	}); err != nil {
+		c.log.Warn("failed to unfreeze repo", "key", key, "err", err)
+		return false
+	}
+	if !wasFrozen {
+		return false // Unfrozen by a concurrent access
+	}
+	c.metrics.UnfreezesTotal.Inc()
+	c.log.Info("unfroze repo", "key", key)
+	return true
+}
+
+// frozenMarker is the file older versions marked frozen repos with, with the
+// time they were frozen as its mtime. Sidecars record it now.
+const frozenMarker = ".frozen"
+
+// freezeRepo repacks the repo at path into a single, tightly compressed pack
+// without bitmaps, trading serving speed for disk space. Objects borrowed from
+// a shared store stay there.
+func freezeRepo(path string) error {
+	cmd := gitcmd.Command(context.Background(), "-C", path,
+		"-c", "pack.compression=9", "-c", "repack.writeBitmaps=false",
+		"repack", "-a", "-d", "-l", "-f", "-q", "--window=250", "--depth=50")
+	cmd.Env = gitEnv("", "")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git repack failed: %w\noutput: %s", err, output)
+	}
+	return nil
 }
 
 type repoInfo struct {
-	key        string
-	path       string
-	accessTime time.Time
+	key         string
+	path        string
+	accessTime  time.Time
+	createdAt   time.Time
+	refreshedAt time.Time
+	frozenAt    time.Time // Zero unless the repo is frozen
+	size        int64     // As last recorded
+}
+
+// lastUsed returns when the repo was last accessed, or created if later: an
+// access time older than the repo, say restored from a backup, doesn't make
+// a fresh clone the coldest repo.
+func (r repoInfo) lastUsed() time.Time {
+	if r.createdAt.After(r.accessTime) {
+		return r.createdAt
+	}
+	return r.accessTime
+}
+
+// fetchedAt returns when the repo was last created or refreshed from upstream.
+func (r repoInfo) fetchedAt() time.Time {
+	if r.createdAt.After(r.refreshedAt) {
+		return r.createdAt
+	}
+	return r.refreshedAt
 }
 
-// listReposWithAccessTime returns all repos with their access times.
+// listReposWithAccessTime returns all repos with their access times, sizes
+// and whether they are frozen, as recorded in their sidecars.
 func (c *Cache) listReposWithAccessTime() ([]repoInfo, error) {
 	var repos []repoInfo
 
@@ -124,22 +460,31 @@ func (c *Cache) listReposWithAccessTime() ([]repoInfo, error) {
 		if err != nil {
 			return nil // Skip errors
 		}
-
-		// Look for bare repos (directories ending in .git or containing HEAD file)
-		if d.IsDir() && filepath.Ext(path) == ".git" {
-			// Check if it's actually a git repo
-			if _, err := os.Stat(filepath.Join(path, "HEAD")); err == nil {
-				key := c.pathToKey(path)
-				accessTime := c.getAccessTime(key, path)
-				repos = append(repos, repoInfo{
-					key:        key,
-					path:       path,
-					accessTime: accessTime,
-				})
-				return filepath.SkipDir
-			}
+		if !d.IsDir() || filepath.Ext(path) != ".git" {
+			return nil
 		}
-		return nil
+		// Directories without a sidecar or a HEAD aren't repos
+		key := c.pathToKey(path)
+		c.metaMu.Lock()
+		meta, ok := c.loadMeta(key, path)
+		c.metaMu.Unlock()
+		if !ok {
+			return nil
+		}
+		accessTime := meta.AccessedAt
+		if t, ok := c.accessTime.Load(key); ok {
+			accessTime = t.(time.Time)
+		}
+		repos = append(repos, repoInfo{
+			key:         key,
+			path:        path,
+			accessTime:  accessTime,
+			createdAt:   meta.CreatedAt,
+			refreshedAt: meta.RefreshedAt,
+			frozenAt:    meta.FrozenAt,
+			size:        meta.Size,
+		})
+		return filepath.SkipDir
 	})
 
 	return repos, err
@@ -156,87 +501,175 @@ func (c *Cache) pathToKey(path string) string {
 	return rel
 }
 
-// getAccessTime returns the access time for a repo, falling back to mtime.
-func (c *Cache) getAccessTime(key, path string) time.Time {
-	if t, ok := c.accessTime.Load(key); ok {
-		return t.(time.Time)
+// getMaxSize returns the maximum size in bytes. Percentages are of the total
+// size of the mirror filesystem, like those of the minimum free space, so the
+// limit doesn't shift as the cache itself fills the disk.
+func (c *Cache) getMaxSize() int64 {
+	if !c.maxSize.IsZero() && !c.maxSize.IsPercent() {
+		return c.maxSize.Bytes
 	}
 
-	// Fall back to modification time of HEAD file
-	info, err := os.Stat(filepath.Join(path, "HEAD"))
-	if err == nil {
-		return info.ModTime()
+	total, _, err := c.diskStats()
+	if err != nil {
+		c.log.Warn("failed to get disk stats", "err", err)
+		return 0
 	}
 
-	// Fall back to directory modification time
-	info, err = os.Stat(path)
-	if err == nil {
-		return info.ModTime()
+	percent := DefaultMaxSizePercent
+	if c.maxSize.IsPercent() {
+		percent = c.maxSize.Percent
 	}
+	maxBytes := int64(float64(total) * percent / 100.0)
 
-	return time.Time{}
-}
-
-// getMaxSize returns the maximum size in bytes.
-func (c *Cache) getMaxSize() int64 {
-	// Get disk stats for percentage calculations
-	var stat syscall.Statfs_t
-	if err := syscall.Statfs(c.root, &stat); err != nil {
-		c.log.Warn("failed to get disk stats", "err", err)
-		return 0
+	// Never plan to use the space that must stay free
+	if limit := total - c.minFreeBytes(total); maxBytes > limit {
+		maxBytes = limit
+	}
+	if maxBytes < 0 {
+		maxBytes = 0
 	}
-	available := int64(stat.Bavail) * int64(stat.Bsize)
 
-	var totalUsable int64
+	c.log.Debug("calculated max cache size", "total", formatSize(total), "max", formatSize(maxBytes))
+	return maxBytes
+}
 
-	if !c.maxSize.IsZero() {
-		if c.maxSize.IsPercent() {
-			// Use configured percentage
-			totalUsable = int64(float64(available) * c.maxSize.Percent / 100.0)
-		} else {
-			// Use absolute size
-			return c.maxSize.Bytes
-		}
-	} else {
-		// Default: 80% of available disk space
-		totalUsable = int64(float64(available) * DefaultMaxSizePercent / 100.0)
+// minFreeBytes returns the minimum free space to keep, given the total disk size.
+func (c *Cache) minFreeBytes(total int64) int64 {
+	if c.minFree.IsZero() {
+		return DefaultMinFreeSpace
 	}
+	return c.minFree.BytesOf(total)
+}
 
-	// Ensure we leave at least MinFreeSpace
-	if available-totalUsable < MinFreeSpace {
-		totalUsable = available - MinFreeSpace
-	}
-	if totalUsable < 0 {
-		totalUsable = 0
+// statfs returns the total size and the bytes available to unprivileged users
+// on the filesystem holding path.
+func statfs(path string) (total, available int64, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
 	}
-
-	c.log.Debug("calculated max cache size", "available", formatSize(available), "max", formatSize(totalUsable))
-	return totalUsable
+	return int64(stat.Blocks) * int64(stat.Bsize), int64(stat.Bavail) * int64(stat.Bsize), nil
 }
 
 // getDirSize returns the total size of the mirror directory.
 func (c *Cache) getDirSize() (int64, error) {
-	return getDirSize(c.root)
+	return c.dirSize(c.root)
 }
 
-// getDirSize returns the total size of a directory.
-func getDirSize(path string) (int64, error) {
+// cacheSize returns the size of the mirror directory eviction goes by. With
+// recordedSizes, mirrors count as the size recorded in their sidecar, updated
+// whenever they are cloned, synced, maintained or frozen, so only what isn't
+// a mirror (shared object stores, clones in progress) is walked. A missing
+// sidecar is rebuilt, walking its mirror once. Files hardlinked across
+// mirrors are then counted once per mirror.
+func (c *Cache) cacheSize() (int64, error) {
+	if !c.recordedSizes {
+		return c.getDirSize()
+	}
 	var size int64
-	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
-		if err != nil {
+	err := filepath.WalkDir(c.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == c.root {
 			return nil // Skip errors
 		}
-		if !d.IsDir() {
-			info, err := d.Info()
-			if err == nil {
-				size += info.Size()
+		if d.IsDir() && filepath.Ext(path) == ".git" {
+			c.metaMu.Lock()
+			meta, ok := c.loadMeta(c.pathToKey(path), path)
+			c.metaMu.Unlock()
+			if ok {
+				size += meta.Size
+				return filepath.SkipDir
 			}
 		}
+		if d.IsDir() && !strings.HasPrefix(d.Name(), ".") && filepath.Ext(path) != ".git" {
+			return nil
+		}
+		// Everything else is walked as dirSize would
+		n, _ := c.dirSize(path)
+		size += n
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
 		return nil
 	})
 	return size, err
 }
 
+// dirSize returns the size of a directory under root, following symlinks if
+// configured to.
+func (c *Cache) dirSize(path string) (int64, error) {
+	return dirSize(path, c.followSymlinks)
+}
+
+// getDirSize returns the total size of a directory, not following symlinks.
+func getDirSize(path string) (int64, error) {
+	return dirSize(path, false)
+}
+
+// dirSize returns the total size of a directory. Files hardlinked more than
+// once under it (by local clones, for one) are counted once, and mirror
+// sidecars not at all. Symlinks count as themselves unless followSymlinks is
+// set, in which case what they point to is counted instead, once, wherever
+// it is.
+func dirSize(path string, followSymlinks bool) (int64, error) {
+	var size int64
+	type inode struct{ dev, ino uint64 }
+	seen := map[inode]bool{} // Files linked more than once, and directories walked
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil // Skip errors
+			}
+			var info fs.FileInfo
+			switch {
+			case d.IsDir():
+				if !followSymlinks {
+					return nil
+				}
+				// Directories are only tracked to break symlink cycles
+				if info, err = d.Info(); err == nil {
+					if st, ok := info.Sys().(*syscall.Stat_t); ok {
+						id := inode{uint64(st.Dev), st.Ino}
+						if seen[id] {
+							return filepath.SkipDir
+						}
+						seen[id] = true
+					}
+				}
+				return nil
+			case strings.HasPrefix(d.Name(), metaFile):
+				return nil
+			case followSymlinks && d.Type()&fs.ModeSymlink != 0:
+				if info, err = os.Stat(p); err != nil {
+					return nil // Dangling
+				}
+				if info.IsDir() {
+					target, err := filepath.EvalSymlinks(p)
+					if err != nil {
+						return nil
+					}
+					return walk(target)
+				}
+			default:
+				if info, err = d.Info(); err != nil {
+					return nil
+				}
+			}
+			if st, ok := info.Sys().(*syscall.Stat_t); ok && (followSymlinks || st.Nlink > 1) {
+				id := inode{uint64(st.Dev), st.Ino}
+				if seen[id] {
+					return nil
+				}
+				seen[id] = true
+			}
+			size += info.Size()
+			return nil
+		})
+	}
+	err := walk(path)
+	return size, err
+}
+
 // cleanEmptyParents removes empty parent directories up to the root.
 func (c *Cache) cleanEmptyParents(path string) {
 	dir := filepath.Dir(path)
@@ -0,0 +1,489 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestCache creates a cache with fake repos, oldest first, each repoSize bytes.
+func newTestCache(t testing.TB, repoSize int, keys ...string) *Cache {
+	t.Helper()
+	root := t.TempDir()
+	c, err := NewCache(root, config.SizeSpec{}, config.SizeSpec{}, "fail", metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("new cache: %v", err)
+	}
+	base := time.Now().Add(-time.Hour)
+	for i, key := range keys {
+		path := filepath.Join(root, key+".git")
+		if err := os.MkdirAll(path, 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(path, "HEAD"), make([]byte, repoSize), 0o644); err != nil {
+			t.Fatalf("write HEAD: %v", err)
+		}
+		c.accessTime.Store(key, base.Add(time.Duration(i)*time.Minute))
+	}
+	return c
+}
+
+func repoExists(c *Cache, key string) bool {
+	_, err := os.Stat(filepath.Join(c.root, key+".git"))
+	return err == nil
+}
+
+func TestEnsureFreeSpaceEvictsOnExternalFill(t *testing.T) {
+	c := newTestCache(t, 100, "github.com/o/oldest", "github.com/o/middle", "github.com/o/newest")
+
+	// Plenty of free space: nothing happens
+	c.diskStats = func() (int64, int64, error) { return 10 * DefaultMinFreeSpace, DefaultMinFreeSpace * 2, nil }
+	c.EnsureFreeSpace()
+	if !repoExists(c, "github.com/o/oldest") {
+		t.Fatalf("expected no eviction while disk has free space")
+	}
+
+	// Something else fills the disk: we're 150 bytes short of the minimum
+	c.diskStats = func() (int64, int64, error) { return 10 * DefaultMinFreeSpace, DefaultMinFreeSpace - 150, nil }
+	c.EnsureFreeSpace()
+
+	if repoExists(c, "github.com/o/oldest") || repoExists(c, "github.com/o/middle") {
+		t.Fatalf("expected the two least recently used repos to be evicted")
+	}
+	if !repoExists(c, "github.com/o/newest") {
+		t.Fatalf("expected most recently used repo to be kept")
+	}
+}
+
+func TestRunTriggersEviction(t *testing.T) {
+	c := newTestCache(t, 100, "github.com/o/oldest", "github.com/o/newest")
+	// Disk pressure is relieved once the oldest repo is gone
+	c.diskStats = func() (int64, int64, error) {
+		if repoExists(c, "github.com/o/oldest") {
+			return 10 * DefaultMinFreeSpace, DefaultMinFreeSpace - 50, nil
+		}
+		return 10 * DefaultMinFreeSpace, DefaultMinFreeSpace, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx, 10*time.Millisecond)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for repoExists(c, "github.com/o/oldest") {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected background loop to evict under disk pressure")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !repoExists(c, "github.com/o/newest") {
+		t.Fatalf("expected most recently used repo to be kept")
+	}
+}
+
+func TestMinFreeBytes(t *testing.T) {
+	c := newTestCache(t, 0)
+
+	if got := c.minFreeBytes(1000); got != DefaultMinFreeSpace {
+		t.Fatalf("expected default min free space, got %d", got)
+	}
+	c.minFree = config.SizeSpec{Percent: 10}
+	if got := c.minFreeBytes(1000); got != 100 {
+		t.Fatalf("expected 10%% of disk, got %d", got)
+	}
+	c.minFree = config.SizeSpec{Bytes: 200}
+	if got := c.minFreeBytes(1000); got != 200 {
+		t.Fatalf("expected absolute min free space, got %d", got)
+	}
+}
+
+func TestGetDirSizeCountsHardlinksOnce(t *testing.T) {
+	dir := t.TempDir()
+	pack := filepath.Join(dir, "a.git", "pack")
+	if err := os.MkdirAll(filepath.Dir(pack), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(pack, make([]byte, 1000), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "b.git"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.Link(pack, filepath.Join(dir, "b.git", "pack")); err != nil {
+		t.Skipf("hardlinks not supported: %v", err)
+	}
+	if size, err := getDirSize(dir); err != nil || size != 1000 {
+		t.Fatalf("expected 1000 bytes, got %d (%v)", size, err)
+	}
+	// Each repo on its own still counts the file
+	if size, err := getDirSize(filepath.Join(dir, "b.git")); err != nil || size != 1000 {
+		t.Fatalf("expected 1000 bytes for b.git, got %d (%v)", size, err)
+	}
+}
+
+func TestRecordedCacheSize(t *testing.T) {
+	c := newTestCache(t, 100, "github.com/o/a", "github.com/o/b")
+	c.recordedSizes = true
+	write := func(path string, size int) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, make([]byte, size), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	// What isn't a mirror is walked: a shared object store and a clone in progress
+	write(filepath.Join(c.root, alternatesDir, "github.com", "o", "a", "objects", "pack"), 50)
+	write(filepath.Join(c.root, "github.com", "o", "new.git", "objects", "pack"), 20)
+	size := func() int64 {
+		t.Helper()
+		n, err := c.cacheSize()
+		if err != nil {
+			t.Fatalf("cache size: %v", err)
+		}
+		return n
+	}
+
+	// Mirrors without a sidecar are walked once to record their size
+	walked, _ := c.getDirSize()
+	if got := size(); got != walked || walked < 270 {
+		t.Fatalf("expected %d bytes, got %d", walked, got)
+	}
+	if meta := c.meta("github.com/o/a", filepath.Join(c.root, "github.com/o/a.git")); meta.Size != 100 {
+		t.Fatalf("expected the size recorded in the sidecar, got %+v", meta)
+	}
+
+	// Mirrors aren't walked again until their size is recorded anew
+	pack := filepath.Join(c.root, "github.com", "o", "a.git", "objects", "pack")
+	write(pack, 1000)
+	if got := size(); got != walked {
+		t.Fatalf("expected the recorded sizes, got %d", got)
+	}
+	if err := c.updateMeta("github.com/o/a", filepath.Join(c.root, "github.com/o/a.git"), func(meta *repoMeta) { meta.Size = 1100 }); err != nil {
+		t.Fatalf("update sidecar: %v", err)
+	}
+	if got := size(); got != walked+1000 {
+		t.Fatalf("expected the new recorded size, got %d", got)
+	}
+	if now, _ := c.getDirSize(); now != walked+1000 {
+		t.Fatalf("expected recorded sizes to match a walk, got %d", now)
+	}
+}
+
+// BenchmarkCacheSize measures a cache of many mirrors, by walking it and by
+// recorded sizes.
+func BenchmarkCacheSize(b *testing.B) {
+	keys := make([]string, 500)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("github.com/o%d/repo%d", i%20, i)
+	}
+	c := newTestCache(b, 100, keys...)
+	for _, key := range keys {
+		// Loose objects and packs, as mirrors have between repacks
+		for j := range 40 {
+			path := filepath.Join(c.root, key+".git", "objects", fmt.Sprintf("%02x", j), "object")
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				b.Fatal(err)
+			}
+			if err := os.WriteFile(path, make([]byte, 100), 0o644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	for _, recorded := range []bool{false, true} {
+		name := "walk"
+		if recorded {
+			name = "recorded"
+		}
+		b.Run(name, func(b *testing.B) {
+			c.recordedSizes = recorded
+			// Sidecars are written on first use, as after clones
+			want, _ := c.getDirSize()
+			if got, err := c.cacheSize(); err != nil || got != want {
+				b.Fatalf("expected %d bytes, got %d (%v)", want, got, err)
+			}
+			b.ResetTimer()
+			for range b.N {
+				if _, err := c.cacheSize(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSymlinkedRoot(t *testing.T) {
+	volume := t.TempDir()
+	root := filepath.Join(t.TempDir(), "mirrors")
+	if err := os.Symlink(volume, root); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	c, err := NewCache(root, config.SizeSpec{}, config.SizeSpec{}, "fail", metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("new cache: %v", err)
+	}
+	defer c.Close()
+	if want, _ := filepath.EvalSymlinks(volume); c.root != want {
+		t.Fatalf("expected root resolved to %s, got %s", want, c.root)
+	}
+
+	// A repo created through the link, with a symlink into another volume
+	// and one back to itself
+	repo := filepath.Join(root, "github.com/o/a.git")
+	if err := os.MkdirAll(repo, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, "HEAD"), make([]byte, 100), 0o644); err != nil {
+		t.Fatalf("write HEAD: %v", err)
+	}
+	other := t.TempDir()
+	if err := os.WriteFile(filepath.Join(other, "pack"), make([]byte, 1000), 0o644); err != nil {
+		t.Fatalf("write pack: %v", err)
+	}
+	if err := os.Symlink(other, filepath.Join(repo, "objects")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if err := os.Symlink(repo, filepath.Join(repo, "loop")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	repos, err := c.listReposWithAccessTime()
+	if err != nil || len(repos) != 1 || repos[0].key != "github.com/o/a" || repos[0].path != filepath.Join(c.root, "github.com/o/a.git") {
+		t.Fatalf("expected github.com/o/a under the resolved root, got %+v (%v)", repos, err)
+	}
+	if size, err := c.getDirSize(); err != nil || size >= 1000 {
+		t.Fatalf("expected the symlinked volume not counted, got %d (%v)", size, err)
+	}
+
+	c.followSymlinks = true
+	if size, err := c.getDirSize(); err != nil || size < 1100 {
+		t.Fatalf("expected the symlinked volume counted, got %d (%v)", size, err)
+	}
+	if size, err := c.dirSize(repos[0].path); err != nil || size != 1100 {
+		t.Fatalf("expected the symlinked volume counted once, got %d (%v)", size, err)
+	}
+}
+
+func TestGetMaxSize(t *testing.T) {
+	c := newTestCache(t, 0)
+	// A mostly full disk: percentages don't depend on how much is available
+	c.diskStats = func() (int64, int64, error) { return 100 * DefaultMinFreeSpace, 10 * DefaultMinFreeSpace, nil }
+
+	if got := c.getMaxSize(); got != 80*DefaultMinFreeSpace {
+		t.Fatalf("expected default 80%% of disk, got %d", got)
+	}
+	c.maxSize = config.SizeSpec{Percent: 50}
+	if got := c.getMaxSize(); got != 50*DefaultMinFreeSpace {
+		t.Fatalf("expected 50%% of disk, got %d", got)
+	}
+	c.maxSize = config.SizeSpec{Percent: 100}
+	c.minFree = config.SizeSpec{Percent: 5}
+	if got := c.getMaxSize(); got != 95*DefaultMinFreeSpace {
+		t.Fatalf("expected disk minus min free space, got %d", got)
+	}
+	c.maxSize = config.SizeSpec{Bytes: 1234}
+	if got := c.getMaxSize(); got != 1234 {
+		t.Fatalf("expected absolute size, got %d", got)
+	}
+}
+
+func TestEvictionWatermarks(t *testing.T) {
+	c := newTestCache(t, 0)
+	for _, tc := range []struct {
+		high, low         float64
+		wantHigh, wantLow int64
+	}{
+		{0, 0, 1000, 900},
+		{95, 70, 950, 700},
+		{100, 99.5, 1000, 995},
+	} {
+		c.highWatermark, c.lowWatermark = tc.high, tc.low
+		if high, low := c.watermarks(1000); high != tc.wantHigh || low != tc.wantLow {
+			t.Errorf("watermarks(%v%%, %v%%) = %d, %d, want %d, %d", tc.high, tc.low, high, low, tc.wantHigh, tc.wantLow)
+		}
+	}
+
+	keys := []string{"github.com/o/a", "github.com/o/b", "github.com/o/c", "github.com/o/d", "github.com/o/e"}
+	c = newTestCache(t, 100, keys...)
+	c.maxSize = config.SizeSpec{Bytes: 1000}
+
+	// Below the high watermark nothing is evicted, even past the low one
+	c.highWatermark, c.lowWatermark = 60, 25
+	c.MaybeEvict()
+	for _, key := range keys {
+		if !repoExists(c, key) {
+			t.Fatalf("expected no eviction below the high watermark, %s is gone", key)
+		}
+	}
+
+	// Past it, repos are evicted down to the low watermark
+	c.highWatermark = 40
+	c.MaybeEvict()
+	for i, key := range keys {
+		if want := i >= 3; repoExists(c, key) != want {
+			t.Fatalf("expected only the two most recently used repos kept, %s exists: %v", key, !want)
+		}
+	}
+}
+
+func TestMaxRepoCount(t *testing.T) {
+	var keys []string
+	for i := range 20 {
+		keys = append(keys, fmt.Sprintf("github.com/o/repo%02d", i))
+	}
+	c := newTestCache(t, 10, keys...)
+	// Way under any size limit, and frozen repos would still count
+	c.maxSize = config.SizeSpec{Bytes: 1 << 30}
+	c.freezeFor = time.Hour
+	c.maxRepos = 10
+
+	// Past the limit, the coldest are deleted down to 90% of it
+	c.MaybeEvict()
+	for i, key := range keys {
+		if want := i >= 11; repoExists(c, key) != want {
+			t.Fatalf("expected only the 9 most recently used repos kept, %s exists: %v", key, !want)
+		}
+	}
+	if got := testutil.ToFloat64(c.metrics.MirroredRepos.WithLabelValues(c.root)); got != 9 {
+		t.Fatalf("expected 9 repos reported, got %v", got)
+	}
+	if got := testutil.ToFloat64(c.metrics.EvictionsTotal); got != 11 {
+		t.Fatalf("expected 11 evictions, got %v", got)
+	}
+
+	// Within it, nothing more goes
+	c.MaybeEvict()
+	if got := testutil.ToFloat64(c.metrics.EvictionsTotal); got != 11 {
+		t.Fatalf("expected no more evictions, got %v", got)
+	}
+}
+
+func TestTieredEviction(t *testing.T) {
+	c := newTestCache(t, 100, "github.com/o/oldest", "github.com/o/middle", "github.com/o/newest")
+	c.freezeFor = time.Hour
+	// Freezing shrinks the fake repos to a tenth of their size
+	c.freeze = func(path string) error {
+		return os.Truncate(filepath.Join(path, "HEAD"), 10)
+	}
+	frozen := func(key string) bool {
+		return !c.meta(key, filepath.Join(c.root, key+".git")).FrozenAt.IsZero()
+	}
+
+	// Over the limit: the coldest repo is frozen, not deleted
+	c.maxSize = config.SizeSpec{Bytes: 250}
+	c.MaybeEvict()
+	if !repoExists(c, "github.com/o/oldest") || !frozen("github.com/o/oldest") || frozen("github.com/o/middle") {
+		t.Fatalf("expected only the oldest repo to be frozen")
+	}
+
+	// Recently frozen repos are kept, the next coldest one is frozen instead
+	c.maxSize = config.SizeSpec{Bytes: 150}
+	c.MaybeEvict()
+	if !repoExists(c, "github.com/o/oldest") || !frozen("github.com/o/middle") || frozen("github.com/o/newest") {
+		t.Fatalf("expected the middle repo to be frozen next")
+	}
+
+	// Repos frozen for long enough are deleted
+	old := time.Now().Add(-2 * time.Hour)
+	if err := c.updateMeta("github.com/o/oldest", filepath.Join(c.root, "github.com/o/oldest.git"), func(meta *repoMeta) { meta.FrozenAt = old }); err != nil {
+		t.Fatalf("backdate freeze: %v", err)
+	}
+	c.maxSize = config.SizeSpec{Bytes: 100}
+	c.MaybeEvict()
+	if repoExists(c, "github.com/o/oldest") || !repoExists(c, "github.com/o/middle") || !frozen("github.com/o/newest") {
+		t.Fatalf("expected the long frozen repo to be deleted and the newest one frozen")
+	}
+	if got := testutil.ToFloat64(c.metrics.FreezesTotal); got != 3 {
+		t.Fatalf("expected 3 freezes, got %v", got)
+	}
+	if got := testutil.ToFloat64(c.metrics.EvictionsTotal); got != 1 {
+		t.Fatalf("expected 1 deletion, got %v", got)
+	}
+
+	// Access unfreezes
+	if !c.Unfreeze("github.com/o/middle", filepath.Join(c.root, "github.com/o/middle.git")) || frozen("github.com/o/middle") {
+		t.Fatalf("expected accessed repo to be unfrozen")
+	}
+	if c.Unfreeze("github.com/o/middle", filepath.Join(c.root, "github.com/o/middle.git")) {
+		t.Fatalf("expected active repo not to be reported as unfrozen")
+	}
+	if got := testutil.ToFloat64(c.metrics.UnfreezesTotal); got != 1 {
+		t.Fatalf("expected 1 unfreeze, got %v", got)
+	}
+}
+
+func TestMinAgeBeforeEvict(t *testing.T) {
+	// The fresh repo was just cloned, but its access time is the oldest, as
+	// if left over from a restored backup
+	keys := []string{"github.com/o/fresh", "github.com/o/old", "github.com/o/older"}
+	c := newTestCache(t, 100, keys...)
+	c.minAge = time.Hour
+	old := time.Now().Add(-2 * time.Hour)
+	for _, key := range keys[1:] {
+		if err := c.updateMeta(key, filepath.Join(c.root, key+".git"), func(meta *repoMeta) { meta.CreatedAt, meta.RefreshedAt = old, old }); err != nil {
+			t.Fatalf("backdate creation: %v", err)
+		}
+	}
+
+	// Evicting everything still leaves the fresh repo
+	c.maxSize = config.SizeSpec{Bytes: 1}
+	c.MaybeEvict()
+	if !repoExists(c, "github.com/o/fresh") || repoExists(c, "github.com/o/old") || repoExists(c, "github.com/o/older") {
+		t.Fatalf("expected only the fresh repo kept")
+	}
+	c.diskStats = func() (int64, int64, error) { return 10 * DefaultMinFreeSpace, 0, nil }
+	c.EnsureFreeSpace()
+	if !repoExists(c, "github.com/o/fresh") {
+		t.Fatalf("expected the fresh repo kept on low disk space")
+	}
+
+	// Once old enough, it goes like any other
+	c.minAge = time.Nanosecond
+	c.MaybeEvict()
+	if repoExists(c, "github.com/o/fresh") {
+		t.Fatalf("expected the repo evicted past the minimum age")
+	}
+}
+
+func TestFreezeRepo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	work := filepath.Join(t.TempDir(), "work")
+	repo := filepath.Join(t.TempDir(), "repo.git")
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	git("init", "-q", "-b", "main", work)
+	git("-C", work, "commit", "-q", "--allow-empty", "-m", "first")
+	git("-C", work, "commit", "-q", "--allow-empty", "-m", "second")
+	git("clone", "-q", "--mirror", work, repo)
+	git("-C", repo, "repack", "-q", "-a", "-d", "--write-bitmap-index")
+
+	if err := freezeRepo(repo); err != nil {
+		t.Fatalf("freeze: %v", err)
+	}
+	packs, _ := filepath.Glob(filepath.Join(repo, "objects", "pack", "*.pack"))
+	bitmaps, _ := filepath.Glob(filepath.Join(repo, "objects", "pack", "*.bitmap"))
+	if len(packs) != 1 || len(bitmaps) != 0 {
+		t.Fatalf("expected a single pack without bitmaps, got %v %v", packs, bitmaps)
+	}
+	git("-C", repo, "fsck", "--no-progress")
+}
@@ -0,0 +1,64 @@
+package mirror
+
+import (
+	"context"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/gitcmd"
+)
+
+// isCurrent reports whether upstream advertises exactly the refs the mirror
+// at repoPath holds, its HEAD pointing to the same branch, so syncing would
+// change nothing, and the ref upstream's HEAD points to, "" if unknown, for
+// the sync to follow. Listing refs is much cheaper than a fetch for
+// up-to-date mirrors, and any error counts as not current, leaving the fetch
+// to report it.
+func (m *Mirror) isCurrent(ctx context.Context, key, repoPath, upstreamURL, authHeader string) (bool, string) {
+	ctx, cancel := m.upstreamContext(ctx, opInfo)
+	defer cancel()
+	env, err := m.upstreamEnv(ctx, upstreamURL, authHeader)
+	if err != nil {
+		return false, ""
+	}
+	cmd := upstreamCommand(ctx, env, "ls-remote", "--symref", upstreamURL)
+	gitStart := time.Now()
+	out, err := cmd.Output()
+	phasesFrom(ctx).Since(PhaseUpstreamGit, gitStart)
+	if err != nil {
+		m.log.Debug("list upstream refs failed", "repo", key, "err", err)
+		return false, ""
+	}
+	remote := map[string]string{}
+	restricted := m.refspecs.For(key)
+	// A default branch switched upstream only shows in HEAD
+	head := headSymref(string(out))
+	if head != "" && (restricted == nil || restricted.Contains(head)) && head != readHead(ctx, repoPath).Ref {
+		return false, head
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		sha, ref, ok := strings.Cut(line, "\t")
+		// HEAD and peeled tags aren't refs of their own in the mirror
+		if !ok || !strings.HasPrefix(ref, "refs/") || strings.HasSuffix(ref, "^{}") {
+			continue
+		}
+		if restricted != nil && !restricted.Contains(ref) {
+			continue
+		}
+		remote[ref] = sha
+	}
+
+	cmd = gitcmd.Command(ctx, "-C", repoPath, "for-each-ref", "--format=%(objectname)\t%(refname)")
+	cmd.Env = gitEnv("", "")
+	if out, err = cmd.Output(); err != nil {
+		return false, head
+	}
+	local := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if sha, ref, ok := strings.Cut(line, "\t"); ok {
+			local[ref] = sha
+		}
+	}
+	return maps.Equal(local, remote), head
+}
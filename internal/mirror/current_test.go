@@ -0,0 +1,88 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSkipCurrentSyncs(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	work := filepath.Join(t.TempDir(), "work")
+	upstream := filepath.Join(t.TempDir(), "upstream.git")
+	git("init", "-q", "-b", "main", work)
+	git("-C", work, "commit", "-q", "--allow-empty", "-m", "first")
+	git("-C", work, "tag", "-a", "-m", "v1", "v1")
+	git("clone", "-q", "--bare", work, upstream)
+
+	// Every request finds the mirror stale
+	cfg := &config.Config{MirrorDir: t.TempDir(), SkipCurrentSyncs: true}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(m.Wait)
+	var changed int
+	m.OnChange(func(string) { changed++ })
+	ctx := context.Background()
+	repoPath, _, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, "")
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	skipped := func() float64 { return testutil.ToFloat64(m.metrics.SyncSkipped.WithLabelValues("local/owner/repo")) }
+	// Clones aren't timed as syncs, so any SyncDuration sample is a fetch
+	fetched := func() bool { return testutil.CollectAndCount(m.metrics.SyncDuration) > 0 }
+
+	// Up to date: no fetch, and nothing derived from the mirror is dropped
+	changed = 0
+	if _, status, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, ""); err != nil || status != StatusHit {
+		t.Fatalf("expected a hit for an up-to-date mirror, got %s (%v)", status, err)
+	}
+	if skipped() != 1 || fetched() || changed != 0 {
+		t.Fatalf("expected the sync to be skipped, got %v skipped, fetched %v, %d changes", skipped(), fetched(), changed)
+	}
+
+	// Upstream moved on: fetched as usual
+	git("-C", work, "commit", "-q", "--allow-empty", "-m", "second")
+	git("-C", work, "push", "-q", upstream, "main")
+	if _, status, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, ""); err != nil || status != StatusSync {
+		t.Fatalf("expected a sync once upstream moved, got %s (%v)", status, err)
+	}
+	if got, want := git("-C", repoPath, "rev-parse", "main"), git("-C", work, "rev-parse", "HEAD"); got != want {
+		t.Fatalf("expected mirror at %s, got %s", want, got)
+	}
+	if skipped() != 1 || !fetched() {
+		t.Fatalf("expected a fetch, got %v skipped, fetched %v", skipped(), fetched())
+	}
+
+	// So does a new branch, even with HEAD unchanged
+	git("-C", work, "push", "-q", upstream, "main:feature")
+	if _, status, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, ""); err != nil || status != StatusSync {
+		t.Fatalf("expected a sync for a new branch, got %s (%v)", status, err)
+	}
+	if _, status, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, ""); err != nil || status != StatusHit || skipped() != 2 {
+		t.Fatalf("expected the caught up mirror to skip its sync, got %s (%v), %v skipped", status, err, skipped())
+	}
+}
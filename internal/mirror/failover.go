@@ -0,0 +1,64 @@
+package mirror
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+)
+
+// failoverCooldown is how long an upstream host that failed a sync is tried
+// after its fallbacks rather than before.
+const failoverCooldown = 30 * time.Second
+
+// failover picks the upstreams a sync is fetched from: the repo's own, then
+// the fallback mirrors configured for its host, in order.
+type failover struct {
+	fallbacks config.Fallbacks
+
+	mu     sync.Mutex
+	failed map[string]time.Time // Upstream host -> when a sync from it last failed
+}
+
+func newFailover(fallbacks config.Fallbacks) *failover {
+	return &failover{fallbacks: fallbacks, failed: map[string]time.Time{}}
+}
+
+// upstreams returns the URLs to fetch the repo at key from, upstreamURL
+// first unless its host failed within failoverCooldown, in which case it is
+// tried last. Fallback URLs are a fallback's base URL followed by
+// /owner/repo.git.
+func (f *failover) upstreams(key, upstreamURL string) []string {
+	host, path, _ := strings.Cut(key, "/")
+	bases := f.fallbacks[host]
+	if len(bases) == 0 {
+		return []string{upstreamURL}
+	}
+	urls := make([]string, 0, len(bases)+1)
+	for _, base := range bases {
+		urls = append(urls, base+"/"+path+".git")
+	}
+	f.mu.Lock()
+	down := time.Since(f.failed[host]) < failoverCooldown
+	f.mu.Unlock()
+	if down {
+		return append(urls, upstreamURL)
+	}
+	return append([]string{upstreamURL}, urls...)
+}
+
+// report records whether a sync from the upstream host of key succeeded.
+func (f *failover) report(key string, ok bool) {
+	host, _, _ := strings.Cut(key, "/")
+	if len(f.fallbacks[host]) == 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if ok {
+		delete(f.failed, host)
+	} else {
+		f.failed[host] = time.Now()
+	}
+}
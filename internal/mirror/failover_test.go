@@ -0,0 +1,92 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSyncFallsBackWhenUpstreamFails(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	work := filepath.Join(t.TempDir(), "work")
+	upstream := filepath.Join(t.TempDir(), "upstream.git")
+	fallbackRoot := t.TempDir()
+	fallback := filepath.Join(fallbackRoot, "owner", "repo.git")
+	git("init", "-q", "-b", "main", work)
+	git("-C", work, "commit", "-q", "--allow-empty", "-m", "first")
+	git("clone", "-q", "--bare", work, upstream)
+	git("clone", "-q", "--bare", work, fallback)
+
+	cfg := &config.Config{
+		MirrorDir:         t.TempDir(),
+		UpstreamFallbacks: config.Fallbacks{"local": {"file://" + fallbackRoot}},
+	}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(m.Wait)
+	ctx := context.Background()
+	repoPath, _, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, "")
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	served := func(upstream string) float64 {
+		return testutil.ToFloat64(m.metrics.SyncUpstreams.WithLabelValues("local", upstream))
+	}
+
+	// Upstream works: synced from it
+	if _, err := m.Refresh(ctx, "local", "owner", "repo", upstream, ""); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if served("origin") != 1 || served("fallback") != 0 {
+		t.Fatalf("expected a sync from origin, got %v origin, %v fallback", served("origin"), served("fallback"))
+	}
+
+	// Upstream is gone while the fallback moved on: synced from the fallback
+	git("-C", work, "commit", "-q", "--allow-empty", "-m", "second")
+	git("-C", work, "push", "-q", fallback, "main")
+	if err := os.RemoveAll(upstream); err != nil {
+		t.Fatalf("remove upstream: %v", err)
+	}
+	if _, err := m.Refresh(ctx, "local", "owner", "repo", upstream, ""); err != nil {
+		t.Fatalf("refresh with failing upstream: %v", err)
+	}
+	if served("origin") != 1 || served("fallback") != 1 {
+		t.Fatalf("expected a sync from the fallback, got %v origin, %v fallback", served("origin"), served("fallback"))
+	}
+	if got, want := git("-C", repoPath, "rev-parse", "main"), git("-C", work, "rev-parse", "HEAD"); got != want {
+		t.Fatalf("expected mirror at %s, got %s", want, got)
+	}
+	// The mirror still points at upstream
+	if got := git("-C", repoPath, "config", "remote.origin.url"); got != upstream {
+		t.Fatalf("expected origin %s, got %s", upstream, got)
+	}
+
+	// While upstream is considered down, the fallback is tried first
+	if urls := m.failover.upstreams("local/owner/repo", upstream); len(urls) != 2 || urls[1] != upstream {
+		t.Fatalf("expected upstream to be tried last, got %v", urls)
+	}
+}
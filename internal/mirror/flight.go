@@ -0,0 +1,112 @@
+package mirror
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// flight is the context of a singleflight call, cancelled once every caller
+// waiting for the call has given up, unless abandoned calls are finished.
+type flight struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+}
+
+// flights tracks the contexts of in-flight calls of a singleflight group.
+type flights struct {
+	mu     sync.Mutex
+	calls  map[string]*flight
+	finish bool // Let calls nobody waits for anymore run to completion, for later callers to join
+}
+
+// join returns the flight for key, starting one detached from ctx's
+// cancellation (but keeping its values) if there is none, and whether one was
+// already in flight.
+func (fs *flights) join(ctx context.Context, key string) (*flight, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.calls == nil {
+		fs.calls = map[string]*flight{}
+	}
+	f, ok := fs.calls[key]
+	if !ok {
+		f = &flight{}
+		f.ctx, f.cancel = context.WithCancel(context.WithoutCancel(ctx))
+		fs.calls[key] = f
+	}
+	f.waiters++
+	return f, ok
+}
+
+// leave drops a waiter from f, cancelling it when it was the last one,
+// unless abandoned calls are finished. The cancelled call is forgotten by
+// group too, so callers arriving before it returns start a new one rather
+// than joining it only to get its cancellation.
+func (fs *flights) leave(key string, f *flight, group *singleflight.Group) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f.waiters--
+	if f.waiters > 0 || fs.finish {
+		return
+	}
+	f.cancel()
+	if fs.calls[key] == f {
+		delete(fs.calls, key)
+		group.Forget(key)
+	}
+}
+
+// done forgets f once its call has finished, so later callers start anew,
+// and releases its context.
+func (fs *flights) done(key string, f *flight) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f.cancel()
+	if fs.calls[key] == f {
+		delete(fs.calls, key)
+	}
+}
+
+// do runs fn once for concurrent callers with the same key, like
+// singleflight's Do, but returns as soon as ctx is done. fn gets a context
+// that is only cancelled once all callers have returned, so work for clients
+// that disconnected stops without failing those still waiting for it (with
+// AbandonedFetches "finish", it is never cancelled).
+// Callers joining a call already in flight have their wait recorded under the
+// phase key starts with, e.g. "sync" for "sync:host/owner/repo".
+func (m *Mirror) do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error, bool) {
+	f, joined := m.flights.join(ctx, key)
+	defer m.flights.leave(key, f, &m.group)
+	if joined {
+		phase, _, _ := strings.Cut(key, ":")
+		defer m.observeWait(phase, time.Now())
+		defer phasesFrom(ctx).Since(PhaseWait, time.Now())
+	}
+	ch := m.group.DoChan(key, func() (interface{}, error) {
+		defer m.flights.done(key, f)
+		return fn(f.ctx)
+	})
+	select {
+	case res := <-ch:
+		return res.Val, res.Err, res.Shared
+	case <-ctx.Done():
+		return nil, context.Cause(ctx), false
+	}
+}
+
+// lock locks l, recording how long it waited for it under phase.
+func (m *Mirror) lock(phase string, l sync.Locker) {
+	start := time.Now()
+	l.Lock()
+	m.observeWait(phase, start)
+}
+
+// observeWait records a wait under phase that began at start.
+func (m *Mirror) observeWait(phase string, start time.Time) {
+	m.metrics.LockWait.WithLabelValues(phase).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,237 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestClientCancellationStopsUpstreamFetch(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	// An upstream that hangs until git gives up on it
+	started := make(chan struct{}, 10)
+	cancelled := make(chan struct{}, 10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-r.Context().Done()
+		cancelled <- struct{}{}
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{MirrorDir: t.TempDir(), SyncStaleAfter: time.Minute}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(m.Wait)
+
+	ensure := func(ctx context.Context) chan error {
+		errc := make(chan error, 1)
+		go func() {
+			_, _, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream.URL+"/owner/repo.git", "")
+			errc <- err
+		}()
+		return errc
+	}
+	wait := func(what string, ch <-chan struct{}) {
+		t.Helper()
+		select {
+		case <-ch:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+
+	// Two clients share the clone; the first one leaving doesn't stop it
+	first, cancelFirst := context.WithCancel(context.Background())
+	second, cancelSecond := context.WithCancel(context.Background())
+	defer cancelSecond()
+	firstErr := ensure(first)
+	wait("upstream request", started)
+	secondErr := ensure(second)
+	time.Sleep(50 * time.Millisecond) // let the second client join
+
+	cancelFirst()
+	select {
+	case err := <-firstErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected the cancelled client to get context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("cancelled client still waiting for the clone")
+	}
+	select {
+	case <-cancelled:
+		t.Fatalf("upstream request cancelled while another client waits for it")
+	case err := <-secondErr:
+		t.Fatalf("remaining client returned early: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Once the last client leaves, the upstream request is dropped
+	cancelSecond()
+	if err := <-secondErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	wait("upstream request cancellation", cancelled)
+}
+
+func TestAbandonedFetchesFinish(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	// An upstream that hangs until git gives up on it or the test is over
+	started := make(chan struct{}, 10)
+	cancelled := make(chan struct{}, 10)
+	stop := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-stop:
+		}
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{MirrorDir: t.TempDir(), SyncStaleAfter: time.Minute, AbandonedFetches: "finish"}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(m.Wait)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream.URL+"/owner/repo.git", "")
+		errc <- err
+	}()
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for upstream request")
+	}
+
+	// The client doesn't wait, but the clone goes on for the next ones
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancelled client to get context.Canceled, got %v", err)
+	}
+	select {
+	case <-cancelled:
+		t.Fatal("upstream request cancelled, expected the clone finished")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Let it end, waiting for it as the next client would
+	close(stop)
+	_, _, _ = m.EnsureRepo(context.Background(), "local", "owner", "repo", upstream.URL+"/owner/repo.git", "")
+}
+
+func TestJoinWhileCancelling(t *testing.T) {
+	cfg := &config.Config{MirrorDir: t.TempDir(), SyncStaleAfter: time.Minute}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+
+	// The only caller leaves, and the call takes a while to wind down
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	release := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() {
+		_, err, _ := m.do(ctx, "clone:host/owner/repo", func(ctx context.Context) (interface{}, error) {
+			<-ctx.Done()
+			close(stopped)
+			<-release
+			return nil, ctx.Err()
+		})
+		errc <- err
+	}()
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	<-stopped
+	defer close(release)
+
+	// A caller arriving meanwhile gets a call of its own, rather than waiting
+	// for the cancelled one
+	joinCtx, cancelJoin := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelJoin()
+	v, err, _ := m.do(joinCtx, "clone:host/owner/repo", func(context.Context) (interface{}, error) {
+		return "fresh", nil
+	})
+	if err != nil || v != "fresh" {
+		t.Fatalf("expected a new call, got %v (%v)", v, err)
+	}
+}
+
+func TestLockWaitMetrics(t *testing.T) {
+	cfg := &config.Config{MirrorDir: t.TempDir(), SyncStaleAfter: time.Minute}
+	reg := metrics.NewUnregistered()
+	m, err := New(cfg, reg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+
+	// The second caller waits on the call the first one started
+	release := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		m.do(context.Background(), "sync:host/owner/repo", func(context.Context) (interface{}, error) {
+			close(started)
+			<-release
+			return nil, nil
+		})
+		close(done)
+	}()
+	<-started
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	if _, _, shared := m.do(context.Background(), "sync:host/owner/repo", func(context.Context) (interface{}, error) {
+		t.Error("expected the call in flight to be joined")
+		return nil, nil
+	}); !shared {
+		t.Fatalf("expected a shared call")
+	}
+	<-done
+
+	var mu sync.Mutex
+	m.lock("maintenance", &mu)
+	mu.Unlock()
+
+	gatherer := prometheus.NewRegistry()
+	gatherer.MustRegister(reg.LockWait)
+	families, err := gatherer.Gather()
+	if err != nil || len(families) != 1 {
+		t.Fatalf("gather: %v", err)
+	}
+	waits := map[string]float64{}
+	for _, metric := range families[0].GetMetric() {
+		if h := metric.GetHistogram(); h.GetSampleCount() == 1 {
+			waits[metric.GetLabel()[0].GetValue()] = h.GetSampleSum()
+		}
+	}
+	if len(waits) != 2 || waits["sync"] < 0.04 {
+		t.Fatalf("expected one wait of each phase, the sync one of at least 50ms, got %v", waits)
+	}
+}
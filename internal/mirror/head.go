@@ -0,0 +1,225 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/gitcmd"
+)
+
+// headCacheTTL bounds how long a resolved HEAD is served without re-reading the mirror.
+const headCacheTTL = 30 * time.Second
+
+// HeadInfo is the default branch of a mirror.
+type HeadInfo struct {
+	Ref string `json:"ref,omitempty"` // Ref HEAD points to, e.g. refs/heads/main
+	SHA string `json:"sha,omitempty"` // Empty for repos without commits
+}
+
+type cachedHead struct {
+	head    HeadInfo
+	expires time.Time
+}
+
+// Head returns the mirror's HEAD symref and the commit it points to, cached
+// for a short while and dropped whenever the mirror is synced.
+func (m *Mirror) Head(ctx context.Context, host, owner, repo string) (HeadInfo, error) {
+	key := fmt.Sprintf("%s/%s/%s", host, owner, repo)
+	if v, ok := m.headCache.Load(key); ok && time.Now().Before(v.(cachedHead).expires) {
+		return v.(cachedHead).head, nil
+	}
+
+	repoPath := m.RepoPath(host, owner, repo)
+	if _, err := os.Stat(repoPath); err != nil {
+		return HeadInfo{}, ErrNotMirrored
+	}
+	head := readHead(ctx, repoPath)
+	m.headCache.Store(key, cachedHead{head: head, expires: time.Now().Add(headCacheTTL)})
+	return head, nil
+}
+
+// markSynced records that key was just fetched from upstream. Its new size is
+// recorded in the background, walking a large mirror taking a while.
+func (m *Mirror) markSynced(key string) {
+	m.markCurrent(key)
+	repoPath := m.repoPath(key)
+	m.bg.Go(func() { m.recordSize(repoPath) })
+	m.headCache.Delete(key)
+	m.changed(key)
+}
+
+// markCurrent records that key was just found to match upstream, which makes
+// it fresh without anything derived from its content changing.
+func (m *Mirror) markCurrent(key string) {
+	now := time.Now()
+	m.lastSync.Store(key, now)
+	m.touchRefreshed(key, now)
+	m.metrics.MirrorStaleness.Synced(key, now)
+}
+
+// forget drops what is remembered about the mirror of key evicted from
+// repoPath, so a re-clone starts fresh and no stale HEAD is served for it,
+// and drops it from the object store.
+func (m *Mirror) forget(key, repoPath string) {
+	m.lastSync.Delete(key)
+	m.headCache.Delete(key)
+	m.origins.Delete(key)
+	for _, c := range m.caches {
+		c.metas.Delete(key)
+	}
+	m.metrics.MirrorStaleness.Forget(key)
+	m.objects.release(key, repoPath)
+	if m.onChange != nil {
+		m.onChange(repoPath)
+	}
+}
+
+// changed notifies the OnChange callback, if any, that the mirror of key changed.
+func (m *Mirror) changed(key string) {
+	if m.onChange != nil {
+		m.onChange(m.repoPath(key))
+	}
+}
+
+// hasRefs reports whether the repo at repoPath has any ref, counting repos it
+// can't read as having some.
+func hasRefs(ctx context.Context, repoPath string) bool {
+	cmd := gitcmd.Command(ctx, "-C", repoPath, "for-each-ref", "--count=1", "--format=%(refname)")
+	cmd.Env = gitEnv("", "")
+	out, err := cmd.Output()
+	return err != nil || len(out) > 0
+}
+
+// readHead resolves HEAD in the repo at repoPath. Missing values are left empty.
+func readHead(ctx context.Context, repoPath string) HeadInfo {
+	git := func(args ...string) (string, error) {
+		cmd := gitcmd.Command(ctx, append([]string{"-C", repoPath}, args...)...)
+		cmd.Env = gitEnv("", "")
+		out, err := cmd.Output()
+		return strings.TrimSpace(string(out)), err
+	}
+	var head HeadInfo
+	if ref, err := git("symbolic-ref", "-q", "HEAD"); err == nil {
+		head.Ref = ref
+	}
+	if sha, err := git("rev-parse", "-q", "--verify", "HEAD"); err == nil {
+		head.SHA = sha
+	}
+	return head
+}
+
+// updateHead points HEAD of the mirror of key at repoPath where upstream's
+// points to after a sync, which git fetch leaves alone: upstream may have
+// switched its default branch, or deleted the one HEAD pointed to.
+// upstreamRef is where upstream's HEAD points to if the refs were just listed
+// to decide on the sync, "" if unknown. Listing it again upstream is only
+// waited for when the mirror's HEAD no longer resolves; otherwise it is done
+// in the background, the mirror being served with HEAD as it is meanwhile.
+func (m *Mirror) updateHead(ctx context.Context, key, repoPath, upstreamURL, authHeader, upstreamRef string) {
+	if upstreamRef != "" {
+		if err := setHead(ctx, repoPath, upstreamRef, m.settings.Load().defaultBranch); err != nil {
+			m.log.Warn("updating mirror HEAD failed", "repo", key, "err", err)
+		}
+		return
+	}
+	if readHead(ctx, repoPath).SHA == "" && hasRefs(ctx, repoPath) {
+		m.followUpstreamHead(ctx, key, repoPath, upstreamURL, authHeader)
+		return
+	}
+	m.bg.Go(func() {
+		before := readHead(context.Background(), repoPath).Ref
+		m.followUpstreamHead(context.Background(), key, repoPath, upstreamURL, authHeader)
+		if readHead(context.Background(), repoPath).Ref != before {
+			m.headCache.Delete(key)
+			m.changed(key)
+		}
+	})
+}
+
+// followUpstreamHead points HEAD of the mirror of key at repoPath where
+// upstream's points to, listing it upstream. Failures are logged, the mirror
+// being served with HEAD as it is.
+func (m *Mirror) followUpstreamHead(ctx context.Context, key, repoPath, upstreamURL, authHeader string) {
+	infoCtx, cancel := m.upstreamContext(ctx, opInfo)
+	defer cancel()
+	upstreamRef := ""
+	env, err := m.upstreamEnv(infoCtx, upstreamURL, authHeader)
+	if err == nil {
+		upstreamRef, err = upstreamHeadRef(infoCtx, env, upstreamURL)
+	}
+	if err != nil {
+		// Still make sure HEAD resolves
+		m.log.Warn("listing upstream HEAD failed", "repo", key, "err", err)
+	}
+	if err := setHead(ctx, repoPath, upstreamRef, m.settings.Load().defaultBranch); err != nil {
+		m.log.Warn("updating mirror HEAD failed", "repo", key, "err", err)
+	}
+}
+
+// upstreamHeadRef returns the ref upstream's HEAD points to, "" if upstream
+// has no HEAD or doesn't tell (dumb HTTP servers, old git).
+func upstreamHeadRef(ctx context.Context, env []string, upstreamURL string) (string, error) {
+	cmd := upstreamCommand(ctx, env, "ls-remote", "--symref", upstreamURL, "HEAD")
+	gitStart := time.Now()
+	out, err := cmd.Output()
+	phasesFrom(ctx).Since(PhaseUpstreamGit, gitStart)
+	if err != nil {
+		return "", fmt.Errorf("git ls-remote --symref failed: %w", err)
+	}
+	return headSymref(string(out)), nil
+}
+
+// headSymref returns the target of HEAD in the output of git ls-remote
+// --symref, "" if it has none.
+func headSymref(out string) string {
+	for line := range strings.Lines(out) {
+		target, ok := strings.CutPrefix(strings.TrimSuffix(line, "\n"), "ref: ")
+		if ref, name, _ := strings.Cut(target, "\t"); ok && name == "HEAD" {
+			return ref
+		}
+	}
+	return ""
+}
+
+// setHead points HEAD of the mirror at dir to upstreamRef, the ref upstream's
+// HEAD points to, as git clone does, even for empty repos whose branch is yet
+// to be pushed. When upstreamRef is unknown ("") or not in the mirror (left
+// out by its refspecs), a HEAD that
+// resolves is kept, and a dangling one (its branch deleted or renamed
+// upstream) falls back to the fallback branch if the mirror has it, so
+// clones still check out a branch.
+func setHead(ctx context.Context, dir, upstreamRef, fallback string) error {
+	git := func(args ...string) (string, error) {
+		cmd := gitcmd.Command(ctx, append([]string{"-C", dir}, args...)...)
+		cmd.Env = gitEnv("", "")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return "", gitError("git "+strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	exists := func(ref string) bool {
+		_, err := git("rev-parse", "-q", "--verify", ref+"^{commit}")
+		return err == nil
+	}
+	current, _ := git("symbolic-ref", "-q", "HEAD")
+	target := ""
+	switch {
+	case upstreamRef != "" && (exists(upstreamRef) || !hasRefs(ctx, dir)):
+		target = upstreamRef
+	case current != "" && exists(current):
+		return nil
+	case fallback != "" && exists("refs/heads/"+fallback):
+		target = "refs/heads/" + fallback
+	default:
+		return nil
+	}
+	if target == current {
+		return nil
+	}
+	_, err := git("symbolic-ref", "HEAD", target)
+	return err
+}
@@ -0,0 +1,182 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHeadCachedUntilSync(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	cfg := &config.Config{MirrorDir: t.TempDir(), SyncStaleAfter: time.Minute}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	var changed []string
+	m.OnChange(func(repoPath string) { changed = append(changed, repoPath) })
+	ctx := context.Background()
+
+	if _, err := m.Head(ctx, "github.com", "owner", "repo"); !errors.Is(err, ErrNotMirrored) {
+		t.Fatalf("expected ErrNotMirrored for missing mirror, got %v", err)
+	}
+
+	repoPath := m.RepoPath("github.com", "owner", "repo")
+	git := func(args ...string) {
+		t.Helper()
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	git("init", "-q", "--bare", "-b", "main", repoPath)
+
+	head, err := m.Head(ctx, "github.com", "owner", "repo")
+	if err != nil || head.Ref != "refs/heads/main" || head.SHA != "" {
+		t.Fatalf("unexpected head: %+v, %v", head, err)
+	}
+
+	// Changes aren't picked up until the cache entry expires or the mirror syncs
+	git("-C", repoPath, "symbolic-ref", "HEAD", "refs/heads/trunk")
+	if head, _ := m.Head(ctx, "github.com", "owner", "repo"); head.Ref != "refs/heads/main" {
+		t.Fatalf("expected cached head, got %+v", head)
+	}
+	m.markSynced("github.com/owner/repo")
+	if n := testutil.CollectAndCount(m.metrics.MirrorStaleness); n != 1 {
+		t.Fatalf("expected staleness of the synced mirror, got %d series", n)
+	}
+	if len(changed) != 1 || changed[0] != repoPath {
+		t.Fatalf("expected sync to report a change of %s, got %v", repoPath, changed)
+	}
+	if head, _ := m.Head(ctx, "github.com", "owner", "repo"); head.Ref != "refs/heads/trunk" {
+		t.Fatalf("expected head to be re-read after sync, got %+v", head)
+	}
+
+	// Eviction drops the cached head along with the mirror
+	m.caches[0].diskStats = func() (int64, int64, error) { return 10 * DefaultMinFreeSpace, DefaultMinFreeSpace - 1, nil }
+	m.caches[0].EnsureFreeSpace()
+	if _, err := m.Head(ctx, "github.com", "owner", "repo"); !errors.Is(err, ErrNotMirrored) {
+		t.Fatalf("expected evicted mirror to have no head, got %v", err)
+	}
+	if n := testutil.CollectAndCount(m.metrics.MirrorStaleness); n != 0 {
+		t.Fatalf("expected evicted mirror to drop its staleness, got %d series", n)
+	}
+	if len(changed) != 2 || changed[1] != repoPath {
+		t.Fatalf("expected eviction to report a change of %s, got %v", repoPath, changed)
+	}
+}
+
+func TestHeadFollowsUpstream(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	work := filepath.Join(t.TempDir(), "work")
+	upstream := filepath.Join(t.TempDir(), "upstream.git")
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	commit := func(file string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(work, file), []byte(file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		git("-C", work, "add", file)
+		git("-C", work, "commit", "-q", "-m", file)
+	}
+	git("init", "-q", "-b", "master", work)
+	commit("first")
+	git("init", "-q", "--bare", "-b", "master", upstream)
+	git("-C", work, "push", "-q", upstream, "master")
+
+	cfg := &config.Config{MirrorDir: t.TempDir(), DefaultBranch: "develop"}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(m.Wait)
+	ctx := context.Background()
+	repoPath, _, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, "")
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	// Clones of the mirror check out the branch HEAD points to, with file in it
+	checkout := func(branch, file string) {
+		t.Helper()
+		if err := m.syncRepo(ctx, "local/owner/repo", repoPath, upstream, "", ""); err != nil {
+			t.Fatalf("sync: %v", err)
+		}
+		// HEAD that still resolves is updated in the background
+		m.Wait()
+		clone := filepath.Join(t.TempDir(), "clone")
+		git("clone", "-q", repoPath, clone)
+		if got := git("-C", clone, "rev-parse", "--abbrev-ref", "HEAD"); got != branch {
+			t.Fatalf("expected %s checked out, got %q", branch, got)
+		}
+		if _, err := os.Stat(filepath.Join(clone, file)); err != nil {
+			t.Fatalf("expected %s in the checkout: %v", file, err)
+		}
+	}
+	checkout("master", "first")
+
+	// The default branch is replaced by a force-pushed history under another
+	// name, the old one deleted
+	git("-C", work, "checkout", "-q", "--orphan", "main")
+	git("-C", work, "rm", "-q", "-rf", ".")
+	commit("rewritten")
+	git("-C", work, "push", "-q", "--force", upstream, "main")
+	git("-C", upstream, "symbolic-ref", "HEAD", "refs/heads/main")
+	git("-C", work, "push", "-q", upstream, ":master")
+	checkout("main", "rewritten")
+
+	// Upstream's HEAD is dangling, so it isn't advertised: the mirror's one,
+	// left dangling too by the fetch, falls back to the default branch
+	git("-C", work, "checkout", "-q", "-b", "develop")
+	commit("develop")
+	git("-C", work, "push", "-q", upstream, "develop")
+	git("-C", upstream, "symbolic-ref", "HEAD", "refs/heads/gone")
+	git("-C", work, "push", "-q", upstream, ":main")
+	checkout("develop", "develop")
+
+	// Switching the default branch upstream is a change to sync
+	git("-C", work, "push", "-q", upstream, "develop:main")
+	if err := m.syncRepo(ctx, "local/owner/repo", repoPath, upstream, "", ""); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	m.Wait()
+	if current, _ := m.isCurrent(ctx, "local/owner/repo", repoPath, upstream, ""); !current {
+		t.Fatal("expected mirror matching upstream to be current")
+	}
+	git("-C", upstream, "symbolic-ref", "HEAD", "refs/heads/main")
+	current, head := m.isCurrent(ctx, "local/owner/repo", repoPath, upstream, "")
+	if current || head != "refs/heads/main" {
+		t.Fatalf("expected mirror not current once upstream's HEAD moved to main, got HEAD %q", head)
+	}
+	// The sync that follows uses the HEAD listed, without asking upstream again
+	if err := m.syncRepo(ctx, "local/owner/repo", repoPath, upstream, "", head); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if got := readHead(ctx, repoPath).Ref; got != "refs/heads/main" {
+		t.Fatalf("expected HEAD moved to main by the sync, got %q", got)
+	}
+	checkout("main", "develop")
+}
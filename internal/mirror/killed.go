@@ -0,0 +1,71 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrKilled marks git commands killed by a signal rather than exiting with
+// an error, as the OOM killer does under memory pressure.
+var ErrKilled = errors.New("killed by signal")
+
+// killedBy returns the signal that killed the command err is from, if any.
+func killedBy(err error) (syscall.Signal, bool) {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ProcessState == nil {
+		return 0, false
+	}
+	ws, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return 0, false
+	}
+	return ws.Signal(), true
+}
+
+// gitKilled handles an op (fetch, clone) of the mirror of key at repoPath
+// failing with err: if git was killed by a signal the proxy didn't send
+// through ctx, it is counted and logged as such, what it left half-written in
+// the mirror removed so it stays as it was, and syncs held off for a while.
+func (m *Mirror) gitKilled(ctx context.Context, key, repoPath, op string, err error) {
+	if !errors.Is(err, ErrKilled) || ctx.Err() != nil {
+		return
+	}
+	m.metrics.GitKilled.WithLabelValues(op).Inc()
+	m.log.Error("git killed by a signal, likely out of memory", "repo", key, "op", op, "err", err)
+	if op == "fetch" {
+		removeFetchLeftovers(repoPath)
+		removeStaleLocks(repoPath)
+	}
+	if m.killedBackoff > 0 {
+		m.killed.Store(key, time.Now())
+	}
+}
+
+// backingOff reports whether syncs of the mirror of key are held off, its git
+// having been killed less than GitKilledBackoff ago.
+func (m *Mirror) backingOff(key string) bool {
+	killedAt, ok := m.killed.Load(key)
+	return ok && time.Since(killedAt.(time.Time)) < m.killedBackoff
+}
+
+// removeStaleLocks deletes the lock files a killed fetch leaves in the mirror
+// at repoPath, which would fail every later fetch. The locked files themselves
+// are only replaced once complete, so they are as before the fetch.
+func removeStaleLocks(repoPath string) {
+	for _, name := range []string{"packed-refs.lock", "shallow.lock", "config.lock", "HEAD.lock", "FETCH_HEAD.lock"} {
+		_ = os.Remove(filepath.Join(repoPath, name))
+	}
+	_ = filepath.WalkDir(filepath.Join(repoPath, "refs"), func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && strings.HasSuffix(p, ".lock") {
+			_ = os.Remove(p)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,231 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGitErrorKilled(t *testing.T) {
+	err := exec.Command("sh", "-c", "kill -9 $$").Run()
+	if err := gitError("git fetch", err, nil); !errors.Is(err, ErrKilled) || !strings.Contains(err.Error(), "killed") {
+		t.Fatalf("expected a killed command to match ErrKilled, got %v", err)
+	}
+	err = exec.Command("sh", "-c", "exit 128").Run()
+	if err := gitError("git fetch", err, nil); errors.Is(err, ErrKilled) {
+		t.Fatalf("expected an error exit not to match ErrKilled, got %v", err)
+	}
+}
+
+// killedGit puts a git wrapper first in PATH that SIGKILLs itself on the
+// first kills fetches, after taking the packed-refs lock like a fetch
+// killed while updating refs would, and counts the fetches run.
+func killedGit(t *testing.T, kills int) (fetches func() int) {
+	t.Helper()
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found in PATH")
+	}
+	dir := t.TempDir()
+	count := filepath.Join(dir, "count")
+	script := `#!/bin/sh
+case "$*" in
+*"fetch --all"*)
+	n=$(cat "` + count + `" 2>/dev/null || echo 0)
+	echo $((n + 1)) > "` + count + `"
+	if [ "$n" -lt ` + strconv.Itoa(kills) + ` ]; then
+		touch "$2/packed-refs.lock"
+		kill -9 $$
+	fi
+	;;
+esac
+exec "` + realGit + `" "$@"
+`
+	if err := os.WriteFile(filepath.Join(dir, "git"), []byte(script), 0o755); err != nil {
+		t.Fatalf("write git wrapper: %v", err)
+	}
+	t.Setenv("PATH", dir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+	return func() int {
+		data, _ := os.ReadFile(count)
+		n, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+		return n
+	}
+}
+
+func TestGitKilledDuringSync(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	work := filepath.Join(t.TempDir(), "work")
+	upstream := filepath.Join(t.TempDir(), "upstream.git")
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	commit := func(msg string) string {
+		git("-C", work, "commit", "-q", "--allow-empty", "-m", msg)
+		git("-C", work, "push", "-q", upstream, "main")
+		return git("-C", work, "rev-parse", "HEAD")
+	}
+	git("init", "-q", "-b", "main", work)
+	git("init", "-q", "--bare", upstream)
+	first := commit("first")
+
+	// Every request syncs, and failures aren't served stale otherwise
+	const key = "local/owner/repo"
+	cfg := &config.Config{MirrorDir: t.TempDir(), GitKilledBackoff: time.Hour}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(m.Wait)
+	ctx := context.Background()
+	repoPath, _, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, "")
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	second := commit("second")
+	fetches := killedGit(t, 1)
+
+	// A killed fetch leaves the previous mirror served, without its lock
+	if _, status, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, ""); err != nil || status != StatusStale {
+		t.Fatalf("expected the mirror served as is, got %s (%v)", status, err)
+	}
+	if got := git("-C", repoPath, "rev-parse", "main"); got != first {
+		t.Fatalf("expected mirror to stay at %s, got %s", first, got)
+	}
+	if _, err := os.Stat(filepath.Join(repoPath, "packed-refs.lock")); !os.IsNotExist(err) {
+		t.Fatalf("expected the lock of the killed fetch to be removed, got %v", err)
+	}
+	if got := testutil.ToFloat64(m.metrics.GitKilled.WithLabelValues("fetch")); got != 1 {
+		t.Fatalf("expected 1 killed fetch counted, got %v", got)
+	}
+
+	// Syncs are held off for a while
+	if _, status, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, ""); err != nil || status != StatusStale || fetches() != 1 {
+		t.Fatalf("expected the mirror served as is without fetching, got %s (%v) after %d fetches", status, err, fetches())
+	}
+
+	// Then the mirror syncs again
+	m.killed.Store(key, time.Now().Add(-2*time.Hour))
+	if _, status, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, ""); err != nil || status != StatusSync {
+		t.Fatalf("expected sync after the backoff, got %s (%v)", status, err)
+	}
+	if got := git("-C", repoPath, "rev-parse", "main"); got != second {
+		t.Fatalf("expected mirror at %s, got %s", second, got)
+	}
+}
+
+func TestAbandonedSyncLeavesMirrorClean(t *testing.T) {
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found in PATH")
+	}
+	work := filepath.Join(t.TempDir(), "work")
+	upstream := filepath.Join(t.TempDir(), "upstream.git")
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q", "-b", "main", work)
+	git("init", "-q", "--bare", upstream)
+	git("-C", work, "commit", "-q", "--allow-empty", "-m", "first")
+	git("-C", work, "push", "-q", upstream, "main")
+
+	cfg := &config.Config{MirrorDir: t.TempDir(), AbandonedFetches: "abort"}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(m.Wait)
+	repoPath, _, err := m.EnsureRepo(context.Background(), "local", "owner", "repo", upstream, "")
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	git("-C", work, "commit", "-q", "--allow-empty", "-m", "second")
+	git("-C", work, "push", "-q", upstream, "main")
+
+	// The first fetch takes the packed-refs lock, then hangs until killed
+	dir := t.TempDir()
+	hung := filepath.Join(dir, "hung")
+	script := `#!/bin/sh
+case "$*" in
+*"fetch --all"*)
+	if [ ! -e "` + hung + `" ]; then
+		touch "` + hung + `" "$2/packed-refs.lock"
+		exec sleep 30
+	fi
+	;;
+esac
+exec "` + realGit + `" "$@"
+`
+	if err := os.WriteFile(filepath.Join(dir, "git"), []byte(script), 0o755); err != nil {
+		t.Fatalf("write git wrapper: %v", err)
+	}
+	t.Setenv("PATH", dir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, "")
+		errc <- err
+	}()
+	lock := filepath.Join(repoPath, "packed-refs.lock")
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(lock); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the fetch to start")
+		}
+	}
+
+	// The client going away kills the fetch, which must leave nothing behind
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(lock); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the lock of the abandoned fetch to be removed")
+		}
+	}
+	git("-C", repoPath, "fsck", "--no-progress")
+
+	// So the next sync goes through
+	if _, status, err := m.EnsureRepo(context.Background(), "local", "owner", "repo", upstream, ""); err != nil || status != StatusSync {
+		t.Fatalf("expected a sync, got %s (%v)", status, err)
+	}
+	if got, want := git("-C", repoPath, "rev-parse", "main"), git("-C", work, "rev-parse", "HEAD"); got != want {
+		t.Fatalf("expected mirror at %s, got %s", want, got)
+	}
+}
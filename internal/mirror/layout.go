@@ -0,0 +1,71 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// LayoutVersion is the on-disk layout of the mirror root this code expects.
+	// Version 1: {root}/{host}/{owner}/{repo}.git
+	LayoutVersion = 1
+
+	layoutVersionFile = ".layout-version"
+)
+
+// layoutMigrations upgrades a mirror root from the keyed version to the next one.
+// Add an entry here whenever LayoutVersion is bumped.
+var layoutMigrations = map[int]func(c *Cache) error{}
+
+// checkLayout reads the layout version of the mirror root and migrates it to
+// LayoutVersion, refusing to continue if that isn't possible so repos are never
+// silently mis-keyed. Roots predating the version file use layout 1.
+func (c *Cache) checkLayout() error {
+	path := filepath.Join(c.root, layoutVersionFile)
+	version := 1
+	data, err := os.ReadFile(path)
+	missing := errors.Is(err, os.ErrNotExist)
+	switch {
+	case err == nil:
+		if version, err = strconv.Atoi(strings.TrimSpace(string(data))); err != nil {
+			return fmt.Errorf("invalid layout version in %s: %q", path, data)
+		}
+	case !missing:
+		return fmt.Errorf("read layout version: %w", err)
+	}
+
+	if version > LayoutVersion {
+		return fmt.Errorf("mirror root %s uses layout version %d, newer than supported version %d", c.root, version, LayoutVersion)
+	}
+	for version < LayoutVersion {
+		migrate, ok := layoutMigrations[version]
+		if !ok {
+			return fmt.Errorf("no migration from layout version %d to %d for mirror root %s", version, LayoutVersion, c.root)
+		}
+		c.log.Info("migrating mirror layout", "root", c.root, "from", version, "to", version+1)
+		if err := migrate(c); err != nil {
+			return fmt.Errorf("migrate layout version %d: %w", version, err)
+		}
+		version++
+		if err := writeLayoutVersion(path, version); err != nil {
+			return err
+		}
+	}
+
+	if missing {
+		// No version file yet: record the current layout
+		return writeLayoutVersion(path, version)
+	}
+	return nil
+}
+
+func writeLayoutVersion(path string, version int) error {
+	if err := os.WriteFile(path, []byte(strconv.Itoa(version)+"\n"), 0o644); err != nil {
+		return fmt.Errorf("write layout version: %w", err)
+	}
+	return nil
+}
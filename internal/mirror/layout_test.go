@@ -0,0 +1,75 @@
+package mirror
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+)
+
+func newLayoutTestCache(root string) (*Cache, error) {
+	return NewCache(root, config.SizeSpec{}, config.SizeSpec{}, "fail", metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func readLayoutVersion(t *testing.T, root string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(root, layoutVersionFile))
+	if err != nil {
+		t.Fatalf("read layout version: %v", err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func TestLayoutVersionWrittenOnFreshRoot(t *testing.T) {
+	root := t.TempDir()
+	if _, err := newLayoutTestCache(root); err != nil {
+		t.Fatalf("new cache: %v", err)
+	}
+	if got := readLayoutVersion(t, root); got != "1" {
+		t.Fatalf("expected layout version 1, got %q", got)
+	}
+}
+
+func TestLayoutVersionNewerRefused(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, layoutVersionFile), []byte("99\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := newLayoutTestCache(root); err == nil {
+		t.Fatalf("expected error for unsupported layout version")
+	}
+}
+
+func TestLayoutMigration(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, layoutVersionFile), []byte("0\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	// Without a registered migration, startup is refused
+	if _, err := newLayoutTestCache(root); err == nil {
+		t.Fatalf("expected error when no migration is available")
+	}
+
+	migrated := false
+	layoutMigrations[0] = func(c *Cache) error {
+		migrated = true
+		return nil
+	}
+	defer delete(layoutMigrations, 0)
+
+	if _, err := newLayoutTestCache(root); err != nil {
+		t.Fatalf("new cache: %v", err)
+	}
+	if !migrated {
+		t.Fatalf("expected migration to run")
+	}
+	if got := readLayoutVersion(t, root); got != "1" {
+		t.Fatalf("expected layout version 1 after migration, got %q", got)
+	}
+}
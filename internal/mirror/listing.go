@@ -0,0 +1,94 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/gitcmd"
+)
+
+// RefInfo is a ref of a mirror, as listed for debugging.
+type RefInfo struct {
+	Ref  string `json:"ref"`
+	SHA  string `json:"sha"`
+	Type string `json:"type"` // Of the object the ref points to: commit, tag (annotated), tree or blob
+}
+
+// Refs lists the refs of the mirror of host/owner/repo, only those under
+// prefix (refs/heads/) unless empty, without contacting upstream.
+func (m *Mirror) Refs(ctx context.Context, host, owner, repo, prefix string) ([]RefInfo, error) {
+	repoPath := m.RepoPath(host, owner, repo)
+	if _, err := os.Stat(repoPath); err != nil {
+		return nil, ErrNotMirrored
+	}
+	args := []string{"-C", repoPath, "for-each-ref", "--format=%(objectname) %(objecttype) %(refname)"}
+	if prefix != "" {
+		args = append(args, prefix)
+	}
+	cmd := gitcmd.Command(ctx, args...)
+	cmd.Env = gitEnv("", "")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git for-each-ref failed: %w", err)
+	}
+	refs := []RefInfo{}
+	for line := range strings.Lines(string(out)) {
+		fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 3)
+		if len(fields) == 3 {
+			refs = append(refs, RefInfo{Ref: fields[2], SHA: fields[0], Type: fields[1]})
+		}
+	}
+	return refs, nil
+}
+
+// PackInfo is a packfile of a mirror, as listed for debugging.
+type PackInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Bitmap  bool      `json:"bitmap,omitempty"` // Has a reachability bitmap
+	Keep    bool      `json:"keep,omitempty"`   // Kept out of repacks by a .keep file
+}
+
+// Packs lists the packfiles of the mirror of host/owner/repo in name order.
+// Objects it borrows from a shared object store aren't listed, nor are the
+// temporary packs of fetches in flight.
+func (m *Mirror) Packs(host, owner, repo string) ([]PackInfo, error) {
+	repoPath := m.RepoPath(host, owner, repo)
+	if _, err := os.Stat(repoPath); err != nil {
+		return nil, ErrNotMirrored
+	}
+	dir := filepath.Join(repoPath, "objects", "pack")
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read pack dir: %w", err)
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+	packs := []PackInfo{}
+	for _, e := range entries {
+		base, ok := strings.CutSuffix(e.Name(), ".pack")
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			// Removed by a repack since the dir was read
+			continue
+		}
+		packs = append(packs, PackInfo{
+			Name:    e.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime().UTC(),
+			Bitmap:  exists(base + ".bitmap"),
+			Keep:    exists(base + ".keep"),
+		})
+	}
+	return packs, nil
+}
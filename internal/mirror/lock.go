@@ -0,0 +1,65 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// lockFile is the file of a mirror root that the instance using the root
+// holds an exclusive flock on, with its PID as content.
+const lockFile = ".lock"
+
+// ErrCacheLocked is returned by NewCache when another instance holds the
+// mirror root: their evictions and syncs would collide.
+var ErrCacheLocked = errors.New("mirror root in use by another instance")
+
+// lock takes the lock of the mirror root, held until Close. With mode "warn",
+// failing to is logged rather than returned; "off" doesn't take it.
+func (c *Cache) lock(mode string) error {
+	if mode == "off" {
+		return nil
+	}
+	err := c.tryLock()
+	if err != nil && mode == "warn" {
+		c.log.Warn("could not lock mirror root, starting anyway", "root", c.root, "err", err)
+		return nil
+	}
+	return err
+}
+
+func (c *Cache) tryLock() error {
+	path := filepath.Join(c.root, lockFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("open lock file: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			holder, _ := os.ReadFile(path)
+			return fmt.Errorf("%w: %s held by pid %s", ErrCacheLocked, path, strings.TrimSpace(string(holder)))
+		}
+		return fmt.Errorf("lock %s: %w", path, err)
+	}
+	// Tell whoever finds it locked who holds it
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	c.lockFile = f
+	return nil
+}
+
+// Close releases the lock of the mirror root, if held.
+func (c *Cache) Close() error {
+	if c.lockFile == nil {
+		return nil
+	}
+	err := c.lockFile.Close()
+	c.lockFile = nil
+	return err
+}
@@ -0,0 +1,46 @@
+package mirror
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+)
+
+func TestCacheLock(t *testing.T) {
+	root := t.TempDir()
+	newCache := func(mode string) (*Cache, error) {
+		return NewCache(root, config.SizeSpec{}, config.SizeSpec{}, mode, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+	first, err := newCache("fail")
+	if err != nil {
+		t.Fatalf("first cache: %v", err)
+	}
+
+	// A second instance on the same root is refused, or warned about
+	if _, err := newCache("fail"); !errors.Is(err, ErrCacheLocked) {
+		t.Fatalf("expected second cache refused with ErrCacheLocked, got %v", err)
+	}
+	for _, mode := range []string{"warn", "off"} {
+		c, err := newCache(mode)
+		if err != nil {
+			t.Fatalf("%s: expected second cache to start, got %v", mode, err)
+		}
+		if c.lockFile != nil {
+			t.Fatalf("%s: expected second cache not to hold the lock", mode)
+		}
+	}
+
+	// Released on close
+	if err := first.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	second, err := newCache("fail")
+	if err != nil {
+		t.Fatalf("expected root free after close, got %v", err)
+	}
+	second.Close()
+}
@@ -0,0 +1,121 @@
+package mirror
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/gitcmd"
+)
+
+// StartMaintenanceLoop runs each git maintenance task in schedule (see
+// config.MaintenanceTasks) on every mirror at the task's own cadence, until
+// ctx is done. Tasks keep fetches fast between the full repacks done after
+// cloning, without their cost.
+func (m *Mirror) StartMaintenanceLoop(ctx context.Context, schedule map[string]time.Duration) {
+	for task, every := range schedule {
+		if every <= 0 {
+			continue
+		}
+		go func() {
+			ticker := time.NewTicker(every)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					m.maintainAllWith(ctx, task)
+				}
+			}
+		}()
+	}
+}
+
+// maintainAllWith runs task on every mirror but frozen ones, which are packed
+// for size until they are used again.
+func (m *Mirror) maintainAllWith(ctx context.Context, task string) {
+	repos, err := m.listRepos()
+	if err != nil {
+		m.log.Warn("list mirrors to maintain failed", "task", task, "err", err)
+		return
+	}
+	for _, r := range repos {
+		if ctx.Err() != nil {
+			return
+		}
+		if !r.frozenAt.IsZero() {
+			continue
+		}
+		m.metrics.MaintenanceTotal.WithLabelValues(task, m.runMaintenanceTask(ctx, r.key, r.path, task)).Inc()
+	}
+}
+
+// runMaintenanceTask runs git maintenance task on the mirror of key and
+// returns "ok" or "error". Tasks on a mirror run one at a time, and yield to
+// fetches from upstream into it: those return "skipped", to run next time.
+func (m *Mirror) runMaintenanceTask(ctx context.Context, key, repoPath, task string) string {
+	lock, _ := m.taskLocks.LoadOrStore(key, &sync.Mutex{})
+	m.lock("maintenance", lock.(*sync.Mutex))
+	defer lock.(*sync.Mutex).Unlock()
+	if m.fetching(key) {
+		m.log.Debug("mirror being fetched into, skipping maintenance", "repo", key, "task", task)
+		return "skipped"
+	}
+
+	start := time.Now()
+	cmds := [][]string{{"-C", repoPath, "maintenance", "run", "--task=" + task}}
+	if task == "incremental-repack" {
+		// It rewrites the multi-pack-index without the bitmap fetches rely on
+		cmds = append(cmds, []string{"-C", repoPath, "multi-pack-index", "write", "--bitmap"})
+	}
+	for _, args := range cmds {
+		cmd := gitcmd.Command(ctx, args...)
+		cmd.Env = gitEnv("", "")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			m.log.Warn("maintenance task failed", "repo", key, "task", task, "err", gitError("git "+args[2], err, output))
+			return "error"
+		}
+	}
+	m.metrics.MaintenanceTime.WithLabelValues(task).Observe(time.Since(start).Seconds())
+	// Repacks and gc change what the mirror takes on disk
+	m.recordSize(repoPath)
+	m.log.Debug("maintenance task complete", "repo", key, "task", task, "duration_ms", time.Since(start).Milliseconds())
+	return "ok"
+}
+
+// beginFetch records a fetch from upstream into the mirror of key until the
+// returned func is called.
+func (m *Mirror) beginFetch(key string) func() {
+	v, _ := m.fetches.LoadOrStore(key, &atomic.Int32{})
+	n := v.(*atomic.Int32)
+	n.Add(1)
+	return func() { n.Add(-1) }
+}
+
+// fetching reports whether a fetch from upstream into the mirror of key is in flight.
+func (m *Mirror) fetching(key string) bool {
+	v, ok := m.fetches.Load(key)
+	return ok && v.(*atomic.Int32).Load() > 0
+}
+
+// writeCommitGraph adds the commits of the mirror of key missing from its
+// commit-graph, so upload-pack negotiation walks history by generation
+// numbers instead of parsing commits. It is skipped while a maintenance task
+// holds the mirror; the next sync catches up.
+func (m *Mirror) writeCommitGraph(ctx context.Context, key, repoPath string) {
+	lock, _ := m.taskLocks.LoadOrStore(key, &sync.Mutex{})
+	if !lock.(*sync.Mutex).TryLock() {
+		return
+	}
+	defer lock.(*sync.Mutex).Unlock()
+	start := time.Now()
+	cmd := gitcmd.Command(ctx, "-C", repoPath, "commit-graph", "write", "--reachable", "--split", "--no-progress")
+	cmd.Env = gitEnv("", "")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		m.log.Warn("git commit-graph write failed", "path", repoPath, "err", err, "output", string(output))
+		return
+	}
+	m.log.Debug("git commit-graph complete", "path", repoPath, "duration_ms", time.Since(start).Milliseconds())
+}
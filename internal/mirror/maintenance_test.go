@@ -0,0 +1,208 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMaintenanceTasks(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	work := filepath.Join(t.TempDir(), "work")
+	upstream := filepath.Join(t.TempDir(), "upstream.git")
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q", "-b", "main", work)
+	git("init", "-q", "--bare", upstream)
+	commit := func(msg string) {
+		if err := os.WriteFile(filepath.Join(work, msg), []byte(msg), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		git("-C", work, "add", msg)
+		git("-C", work, "commit", "-q", "-m", msg)
+		git("-C", work, "push", "-q", upstream, "main")
+	}
+	commit("first")
+
+	cfg := &config.Config{MirrorDir: t.TempDir()}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(m.Wait)
+	ctx := context.Background()
+	repoPath, _, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, "")
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	m.Wait()
+	// Each sync adds a pack
+	for _, msg := range []string{"second", "third"} {
+		commit(msg)
+		if err := m.syncRepo(ctx, "local/owner/repo", repoPath, upstream, "", ""); err != nil {
+			t.Fatalf("sync: %v", err)
+		}
+	}
+
+	for _, task := range config.MaintenanceTasks {
+		if result := m.runMaintenanceTask(ctx, "local/owner/repo", repoPath, task); result != "ok" {
+			t.Fatalf("expected %s to succeed, got %s", task, result)
+		}
+	}
+	// git maintenance writes split commit-graphs
+	if _, err := os.Stat(filepath.Join(repoPath, "objects", "info", "commit-graphs", "commit-graph-chain")); err != nil {
+		t.Fatalf("expected a commit-graph, got %v", err)
+	}
+	if bitmaps, _ := filepath.Glob(filepath.Join(repoPath, "objects", "pack", "multi-pack-index-*.bitmap")); len(bitmaps) == 0 {
+		t.Fatalf("expected incremental repacks to keep a multi-pack-index bitmap")
+	}
+	git("-C", repoPath, "fsck", "--no-dangling")
+	if n := testutil.CollectAndCount(m.metrics.MaintenanceTime); n != len(config.MaintenanceTasks) {
+		t.Fatalf("expected a duration recorded per task, got %d", n)
+	}
+
+	// Mirrors being fetched into are left for next time
+	done := m.beginFetch("local/owner/repo")
+	if result := m.runMaintenanceTask(ctx, "local/owner/repo", repoPath, "commit-graph"); result != "skipped" {
+		t.Fatalf("expected maintenance to yield to the fetch, got %s", result)
+	}
+	done()
+	m.maintainAllWith(ctx, "commit-graph")
+	if n := testutil.ToFloat64(m.metrics.MaintenanceTotal.WithLabelValues("commit-graph", "ok")); n != 1 {
+		t.Fatalf("expected the scheduled run to be counted, got %v", n)
+	}
+}
+
+func TestMaintainCommitGraph(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	work := filepath.Join(t.TempDir(), "work")
+	upstream := filepath.Join(t.TempDir(), "upstream.git")
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q", "-b", "main", work)
+	git("-C", work, "commit", "-q", "--allow-empty", "-m", "first")
+	git("clone", "-q", "--bare", work, upstream)
+
+	cfg := &config.Config{MirrorDir: t.TempDir(), MaintainCommitGraph: true}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(m.Wait)
+	ctx := context.Background()
+	repoPath, _, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, "")
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	m.Wait()
+
+	git("-C", work, "commit", "-q", "--allow-empty", "-m", "second")
+	git("-C", work, "push", "-q", upstream, "main")
+	if err := m.syncRepo(ctx, "local/owner/repo", repoPath, upstream, "", ""); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	m.Wait()
+	// Syncs add a layer to a split commit-graph
+	if _, err := os.Stat(filepath.Join(repoPath, "objects", "info", "commit-graphs", "commit-graph-chain")); err != nil {
+		t.Fatalf("expected a commit-graph written after the sync, got %v", err)
+	}
+	git("-C", repoPath, "commit-graph", "verify")
+}
+
+// BenchmarkNegotiation times protocol v2 fetch negotiations against a mirror
+// with a long history, as an outdated CI checkout sends them, with and
+// without a commit-graph.
+func BenchmarkNegotiation(b *testing.B) {
+	if _, err := exec.LookPath("git"); err != nil {
+		b.Skip("git not found in PATH")
+	}
+	repo := filepath.Join(b.TempDir(), "repo.git")
+	git := func(stdin io.Reader, args ...string) string {
+		b.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = gitEnv("", "")
+		cmd.Stdin = stdin
+		out, err := cmd.Output()
+		if err != nil {
+			b.Fatalf("git %v: %v", args, err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git(nil, "init", "-q", "--bare", repo)
+	// A linear history touching a few files now and then
+	var stream bytes.Buffer
+	const commits = 50000
+	for i := 1; i <= commits; i++ {
+		fmt.Fprintf(&stream, "commit refs/heads/main\nmark :%d\ncommitter test <test@example.com> %d +0000\ndata <<EOM\ncommit %d\nEOM\n", i, 1700000000+i, i)
+		if i > 1 {
+			fmt.Fprintf(&stream, "from :%d\n", i-1)
+		}
+		if i%50 == 1 {
+			fmt.Fprintf(&stream, "M 644 inline f%d\ndata <<EOM\nv%d\nEOM\n", i%97, i)
+		}
+		stream.WriteString("\n")
+	}
+	git(&stream, "-C", repo, "fast-import", "--quiet")
+	tip := git(nil, "-C", repo, "rev-parse", "main")
+
+	for _, graph := range []bool{false, true} {
+		if graph {
+			git(nil, "-C", repo, "commit-graph", "write", "--reachable", "--split")
+		}
+		for _, behind := range []int{100, 10000} {
+			have := git(nil, "-C", repo, "rev-parse", fmt.Sprintf("main~%d", behind))
+			var req bytes.Buffer
+			for _, line := range []string{"command=fetch", "", "want " + tip, "have " + have, "done"} {
+				if line == "" {
+					req.WriteString("0001")
+					continue
+				}
+				fmt.Fprintf(&req, "%04x%s\n", len(line)+5, line)
+			}
+			req.WriteString("0000")
+			b.Run(fmt.Sprintf("commit-graph=%v/behind=%d", graph, behind), func(b *testing.B) {
+				for b.Loop() {
+					cmd := exec.Command("git", "upload-pack", "--stateless-rpc", repo)
+					cmd.Env = append(gitEnv("", ""), "GIT_PROTOCOL=version=2")
+					cmd.Stdin = bytes.NewReader(req.Bytes())
+					if out, err := cmd.Output(); err != nil || len(out) == 0 {
+						b.Fatalf("upload-pack: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package mirror
+
+import (
+	"time"
+)
+
+// refreshedMarker is the file whose mtime older versions recorded when a
+// mirror was last refreshed from upstream with. Sidecars record it now.
+const refreshedMarker = ".refreshed"
+
+// touchRefreshed records in the sidecar of the mirror of key that it was just
+// refreshed, so its age survives restarts.
+func (m *Mirror) touchRefreshed(key string, now time.Time) {
+	m.recordMeta(key, func(meta *repoMeta) { meta.RefreshedAt = now })
+}
+
+// refreshedAt returns when the mirror of key at repoPath was last cloned,
+// synced or found to match upstream.
+func (m *Mirror) refreshedAt(key, repoPath string) time.Time {
+	if t, ok := m.lastSync.Load(key); ok {
+		return t.(time.Time)
+	}
+	return m.cacheFor(key).meta(key, repoPath).RefreshedAt
+}
+
+// expired reports how long ago the mirror of key at repoPath was refreshed,
+// and whether that is longer than CacheMaxAge, making it unfit to serve.
+func (m *Mirror) expired(key, repoPath string) (time.Duration, bool) {
+	if m.maxAge <= 0 {
+		return 0, false
+	}
+	age := time.Since(m.refreshedAt(key, repoPath))
+	return age, age > m.maxAge
+}
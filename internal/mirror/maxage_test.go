@@ -0,0 +1,123 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCacheMaxAge(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	work := filepath.Join(t.TempDir(), "work")
+	upstream := filepath.Join(t.TempDir(), "upstream.git")
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q", "-b", "main", work)
+	git("-C", work, "commit", "-q", "--allow-empty", "-m", "initial")
+	git("clone", "-q", "--bare", work, upstream)
+
+	const maxAge = 30 * 24 * time.Hour
+	// Syncs on access alone would never happen within the max age
+	cfg := &config.Config{MirrorDir: t.TempDir(), SyncStaleAfter: 2 * maxAge, ServeStaleOnUpstreamError: true, CacheMaxAge: maxAge}
+	var m *Mirror
+	// Restarts the proxy
+	newMirror := func() *Mirror {
+		t.Helper()
+		if m != nil {
+			m.Close()
+		}
+		next, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+		if err != nil {
+			t.Fatalf("mirror init: %v", err)
+		}
+		return next
+	}
+	m = newMirror()
+	ctx := context.Background()
+	const key = "local/owner/repo"
+	repoPath, _, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, "")
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	m.Wait()
+	// Backdate the mirror as if last refreshed 40 days ago, before a restart
+	backdate := func() {
+		t.Helper()
+		old := time.Now().Add(-40 * 24 * time.Hour)
+		if err := m.cacheFor(key).updateMeta(key, repoPath, func(meta *repoMeta) { meta.RefreshedAt = old }); err != nil {
+			t.Fatalf("backdate: %v", err)
+		}
+	}
+	backdate()
+	m = newMirror()
+
+	// On access, an expired mirror is refreshed although not stale
+	if _, status, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, ""); err != nil || status != StatusSync {
+		t.Fatalf("expected expired mirror synced, got %s, %v", status, err)
+	}
+	if age, expired := m.expired(key, repoPath); expired {
+		t.Fatalf("expected refreshed mirror not to be expired, aged %s", age)
+	}
+	m.Wait()
+
+	// If that fails, it is purged rather than served stale
+	backdate()
+	m = newMirror()
+	if err := os.Rename(upstream, upstream+".gone"); err != nil {
+		t.Fatalf("rename upstream: %v", err)
+	}
+	if _, status, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, ""); err == nil {
+		t.Fatalf("expected expired mirror not served when upstream is down, got %s", status)
+	}
+	if _, err := os.Stat(repoPath); !os.IsNotExist(err) {
+		t.Fatalf("expected expired mirror purged, got %v", err)
+	}
+	if got := testutil.ToFloat64(m.metrics.ExpiredPurgesTotal); got != 1 {
+		t.Fatalf("expected 1 expired purge, got %v", got)
+	}
+
+	// The sweeper purges expired mirrors without waiting for them to be accessed
+	if err := os.Rename(upstream+".gone", upstream); err != nil {
+		t.Fatalf("rename upstream: %v", err)
+	}
+	if _, _, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, ""); err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	m.Wait()
+	cache := m.cacheFor(key)
+	cache.PurgeExpired()
+	if _, err := os.Stat(repoPath); err != nil {
+		t.Fatalf("expected fresh mirror kept: %v", err)
+	}
+	backdate()
+	m = newMirror()
+	cache = m.cacheFor(key)
+	cache.PurgeExpired()
+	if _, err := os.Stat(repoPath); !os.IsNotExist(err) {
+		t.Fatalf("expected expired mirror swept, got %v", err)
+	}
+	if got := testutil.ToFloat64(m.metrics.ExpiredPurgesTotal); got != 1 {
+		t.Fatalf("expected 1 expired purge, got %v", got)
+	}
+}
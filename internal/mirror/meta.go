@@ -0,0 +1,181 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/gitcmd"
+)
+
+// metaFile is the sidecar of a mirror, recording what is known about it so
+// listing mirrors needs neither statting nor walking them. It is replaced
+// atomically on every change, and rebuilt from the mirror itself when missing
+// or unreadable.
+const metaFile = ".meta.json"
+
+// accessPersistInterval bounds how often accesses to a mirror are written to
+// its sidecar; in between, they are only kept in memory.
+const accessPersistInterval = time.Minute
+
+// repoMeta is the content of a mirror's sidecar.
+type repoMeta struct {
+	Origin      string    `json:"origin,omitempty"` // Upstream URL the mirror is fetched from
+	CreatedAt   time.Time `json:"created_at"`
+	RefreshedAt time.Time `json:"refreshed_at"` // Last cloned, synced or found to match upstream
+	AccessedAt  time.Time `json:"accessed_at"`
+	Size        int64     `json:"size"`               // Bytes on disk as of the last clone, sync or freeze
+	FrozenAt    time.Time `json:"frozen_at,omitzero"` // Zero in the active tier
+}
+
+// meta returns the sidecar of the mirror of key at path, rebuilding it if
+// needed.
+func (c *Cache) meta(key, path string) repoMeta {
+	if v, ok := c.metas.Load(key); ok {
+		return v.(repoMeta)
+	}
+	c.metaMu.Lock()
+	defer c.metaMu.Unlock()
+	meta, _ := c.loadMeta(key, path)
+	return meta
+}
+
+// updateMeta applies fn to the sidecar of the mirror of key at path.
+func (c *Cache) updateMeta(key, path string, fn func(*repoMeta)) error {
+	c.metaMu.Lock()
+	defer c.metaMu.Unlock()
+	meta, _ := c.loadMeta(key, path)
+	fn(&meta)
+	return c.writeMeta(key, path, meta)
+}
+
+// loadMeta returns the sidecar of the mirror of key at path, as last read or
+// written, and whether path is a mirror at all. Missing or unreadable
+// sidecars of mirrors are rebuilt. Callers must hold c.metaMu.
+func (c *Cache) loadMeta(key, path string) (repoMeta, bool) {
+	if v, ok := c.metas.Load(key); ok {
+		return v.(repoMeta), true
+	}
+	var meta repoMeta
+	data, err := os.ReadFile(filepath.Join(path, metaFile))
+	if err == nil {
+		if err = json.Unmarshal(data, &meta); err == nil {
+			c.metas.Store(key, meta)
+			return meta, true
+		}
+		c.log.Warn("mirror sidecar unreadable, rebuilding it", "repo", key, "err", err)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		c.log.Warn("failed to read mirror sidecar, rebuilding it", "repo", key, "err", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(path, "HEAD")); err != nil {
+		return repoMeta{}, false
+	}
+	meta = rebuildMeta(path, c.followSymlinks)
+	if err := c.writeMeta(key, path, meta); err != nil {
+		c.log.Warn("failed to write mirror sidecar", "repo", key, "err", err)
+		return meta, true
+	}
+	// The sidecar supersedes the markers older versions kept
+	for _, name := range []string{frozenMarker, refreshedMarker} {
+		_ = os.Remove(filepath.Join(path, name))
+	}
+	return meta, true
+}
+
+// writeMeta replaces the sidecar of the mirror of key at path with meta.
+// Callers must hold c.metaMu.
+func (c *Cache) writeMeta(key, path string, meta repoMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(path, metaFile+".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(c.fileMode)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(path, metaFile))
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	c.metas.Store(key, meta)
+	return nil
+}
+
+// rebuildMeta recovers what it can of the sidecar of the mirror at path from
+// the mirror itself: its HEAD is written when it is cloned, and older versions
+// dated refreshes and freezes with marker files.
+func rebuildMeta(path string, followSymlinks bool) repoMeta {
+	modTime := func(name string) time.Time {
+		if info, err := os.Stat(filepath.Join(path, name)); err == nil {
+			return info.ModTime()
+		}
+		return time.Time{}
+	}
+	head := modTime("HEAD")
+	meta := repoMeta{CreatedAt: head, RefreshedAt: head, AccessedAt: head, FrozenAt: modTime(frozenMarker)}
+	if t := modTime(refreshedMarker); !t.IsZero() {
+		meta.RefreshedAt = t
+	}
+	cmd := gitcmd.Command(context.Background(), "config", "--file", filepath.Join(path, "config"), "--get", "remote.origin.url")
+	cmd.Env = gitEnv("", "")
+	if out, err := cmd.Output(); err == nil {
+		meta.Origin = strings.TrimSpace(string(out))
+	}
+	meta.Size, _ = dirSize(path, followSymlinks)
+	return meta
+}
+
+// recordMeta applies fn to the sidecar of the mirror of key, logging failures:
+// a sidecar that can't be written is rebuilt from the mirror when next read.
+func (m *Mirror) recordMeta(key string, fn func(*repoMeta)) {
+	if err := m.cacheFor(key).updateMeta(key, m.repoPath(key), fn); err != nil {
+		m.log.Warn("failed to update mirror sidecar", "repo", key, "err", err)
+	}
+}
+
+// initMeta writes the sidecar of the mirror of key just cloned from
+// upstreamURL. There is nothing to recover from a new mirror, so unlike
+// recordMeta it isn't walked: its size is recorded once it is marked synced.
+func (m *Mirror) initMeta(key, upstreamURL string) {
+	c := m.cacheFor(key)
+	now := time.Now()
+	meta := repoMeta{Origin: upstreamURL, CreatedAt: now, RefreshedAt: now, AccessedAt: now}
+	c.metaMu.Lock()
+	defer c.metaMu.Unlock()
+	if err := c.writeMeta(key, m.repoPath(key), meta); err != nil {
+		m.log.Warn("failed to write mirror sidecar", "repo", key, "err", err)
+	}
+}
+
+// recordSize stores the current size of the mirror at repoPath in its sidecar.
+func (m *Mirror) recordSize(repoPath string) {
+	for _, c := range m.caches {
+		if rel, err := filepath.Rel(c.root, repoPath); err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		size, err := c.dirSize(repoPath)
+		if err != nil {
+			return
+		}
+		key := c.pathToKey(repoPath)
+		if err := c.updateMeta(key, repoPath, func(meta *repoMeta) { meta.Size = size }); err != nil {
+			m.log.Warn("failed to update mirror sidecar", "repo", key, "err", err)
+		}
+		return
+	}
+}
@@ -0,0 +1,151 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+)
+
+func TestRepoMetaSidecar(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	work := filepath.Join(t.TempDir(), "work")
+	upstream := filepath.Join(t.TempDir(), "upstream.git")
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	git("init", "-q", "-b", "main", work)
+	git("-C", work, "commit", "-q", "--allow-empty", "-m", "initial")
+	git("clone", "-q", "--bare", work, upstream)
+
+	cfg := &config.Config{MirrorDir: t.TempDir(), SyncStaleAfter: time.Hour}
+	var m *Mirror
+	// Restarts the proxy, forgetting what it kept in memory
+	restart := func() {
+		t.Helper()
+		if m != nil {
+			m.Close()
+		}
+		var err error
+		if m, err = New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil))); err != nil {
+			t.Fatalf("mirror init: %v", err)
+		}
+	}
+	restart()
+	defer func() { m.Close() }()
+	const key = "local/owner/repo"
+	repoPath, _, err := m.EnsureRepo(context.Background(), "local", "owner", "repo", upstream, "")
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	m.Wait()
+	sidecar := filepath.Join(repoPath, metaFile)
+	read := func() repoMeta {
+		t.Helper()
+		data, err := os.ReadFile(sidecar)
+		if err != nil {
+			t.Fatalf("read sidecar: %v", err)
+		}
+		var meta repoMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			t.Fatalf("parse sidecar: %v\n%s", err, data)
+		}
+		return meta
+	}
+	listed := func() repoInfo {
+		t.Helper()
+		repos, err := m.listRepos()
+		if err != nil || len(repos) != 1 || repos[0].key != key {
+			t.Fatalf("expected the mirror listed, got %+v, %v", repos, err)
+		}
+		return repos[0]
+	}
+
+	// Written on clone
+	meta := read()
+	if meta.Origin != upstream || meta.CreatedAt.IsZero() || meta.RefreshedAt.Before(meta.CreatedAt) || meta.Size <= 0 || !meta.FrozenAt.IsZero() {
+		t.Fatalf("unexpected sidecar after clone: %+v", meta)
+	}
+	size, _ := getDirSize(repoPath)
+	if meta.Size != size {
+		t.Fatalf("expected size %d recorded, got %d", size, meta.Size)
+	}
+
+	// Listing reads accesses and tiers from it
+	old := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	if err := m.cacheFor(key).updateMeta(key, repoPath, func(meta *repoMeta) {
+		meta.AccessedAt = old
+		meta.FrozenAt = old
+	}); err != nil {
+		t.Fatalf("update sidecar: %v", err)
+	}
+	restart()
+	if r := listed(); !r.accessTime.Equal(old) || !r.frozenAt.Equal(old) || r.size != size {
+		t.Fatalf("expected listing from the sidecar, got %+v", r)
+	}
+	// Accesses are recorded, at most every accessPersistInterval
+	m.cacheFor(key).Touch(key)
+	if got := read().AccessedAt; !got.After(old) {
+		t.Fatalf("expected access recorded, got %v", got)
+	}
+
+	// Corrupt or missing sidecars are rebuilt from the mirror, along with the
+	// markers of older versions
+	for _, damage := range []func() error{
+		func() error { return os.WriteFile(sidecar, []byte(`{"origin": "trunc`), 0o644) },
+		func() error { return os.Remove(sidecar) },
+	} {
+		if err := damage(); err != nil {
+			t.Fatalf("damage sidecar: %v", err)
+		}
+		frozen := filepath.Join(repoPath, frozenMarker)
+		if err := os.WriteFile(frozen, nil, 0o644); err != nil {
+			t.Fatalf("write marker: %v", err)
+		}
+		if err := os.Chtimes(frozen, old, old); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+		restart()
+		if r := listed(); !r.frozenAt.Equal(old) || r.size != size {
+			t.Fatalf("expected rebuilt frozen mirror of %d bytes, got %+v", size, r)
+		}
+		meta := read()
+		if meta.Origin != upstream || meta.CreatedAt.IsZero() || meta.RefreshedAt.IsZero() || !meta.FrozenAt.Equal(old) {
+			t.Fatalf("unexpected rebuilt sidecar: %+v", meta)
+		}
+		if _, err := os.Stat(frozen); !os.IsNotExist(err) {
+			t.Fatalf("expected marker superseded by the sidecar, got %v", err)
+		}
+	}
+
+	// Unfreezing goes through it, and temp files don't linger
+	if !m.cacheFor(key).Unfreeze(key, repoPath) || !read().FrozenAt.IsZero() {
+		t.Fatalf("expected mirror unfrozen in its sidecar")
+	}
+	entries, err := os.ReadDir(repoPath)
+	if err != nil {
+		t.Fatalf("read mirror: %v", err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), metaFile+".tmp") {
+			t.Fatalf("expected no temp sidecar left, found %s", e.Name())
+		}
+	}
+}
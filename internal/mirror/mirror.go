@@ -2,16 +2,24 @@ package mirror
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/gitcmd"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
 	"golang.org/x/sync/singleflight"
 )
 
@@ -22,41 +30,241 @@ const (
 	StatusHit   Status = "mirror-hit"   // Served from existing fresh mirror
 	StatusClone Status = "mirror-clone" // Had to clone new mirror
 	StatusSync  Status = "mirror-sync"  // Had to sync stale mirror
+	StatusStale Status = "mirror-stale" // Sync failed, served the existing stale mirror
+
+	StatusRevalidate Status = "mirror-revalidate" // Served the existing stale mirror while syncing it in the background
+
+	StatusPinnedHit   Status = "pinned-pack-hit" // Pack replayed from the pinned-commit pack cache
+	StatusArchiveHit  Status = "archive-hit"     // Archive replayed from the upload-archive cache
+	StatusPassthrough Status = "passthrough"     // Served straight from upstream without a mirror
 )
 
+// ErrAuthRequired is returned when a mirror cloned with credentials is accessed
+// without credentials that upstream accepts for it.
+var ErrAuthRequired = errors.New("authentication required")
+
 // Mirror manages bare git repository mirrors.
 type Mirror struct {
-	root              string
-	staleAfter        time.Duration
 	log               *slog.Logger
-	cache             *Cache
+	caches            []*Cache // One per mirror root, new mirrors are spread across them by hash
 	packThreads       int
 	maintainAfterSync bool
+	syncCommitGraph   bool // Write an incremental commit-graph after every sync
+	skipCurrent       bool // Check upstream's refs before fetching, skipping fetches that wouldn't change anything
+	serveStale        bool // Serve the existing mirror when syncing it fails
+	resolver          *upstreamResolver
+	tempDir           string   // Where new mirrors are built before moving into root, empty means in place
+	peers             []string // Sibling proxies to seed new mirrors from
+	metrics           *metrics.Metrics
+	prewarmSubmodules bool // Clone the submodule repos of new mirrors in the background
+	prewarmSem        chan struct{}
+	upstreamSlots     *fetchQueue  // Bounds clones and syncs running against upstream, nil when unlimited
+	upstreamHTTP      *http.Client // For requests sent upstream without git
+	ssh               *sshUpstream // Upstream hosts fetched over SSH
+	refspecs          config.MirrorRefspecs
+	failover          *failover // Fallback mirrors syncs turn to when upstream fails
+	onChange          func(repoPath string)
+	dirMode           os.FileMode              // Of directories created in the mirror dir
+	fileMode          os.FileMode              // Of files in mirrors, zero leaves git's defaults
+	objects           objectStore              // Where mirrors keep their objects
+	maxAge            time.Duration            // How long after their last refresh mirrors may be served, zero means forever
+	killedBackoff     time.Duration            // How long syncs are held off after a git was killed, zero means not at all
+	followRedirects   bool                     // Mirror repos upstream redirects under their new name, rather than failing
+	notRedirected     redirectChecks           // Repos upstream recently answered it doesn't redirect
+	quotas            *quotas                  // Upstream usage of hosts with a quota, nil when none has
+	networks          config.Rewrites          // Map repo keys to their fork network
+	settings          atomic.Pointer[settings] // Swapped as a whole by Reload
 
 	group     singleflight.Group
-	lastSync  sync.Map // map[repoKey]time.Time
-	repoLocks sync.Map // map[repoKey]*sync.Mutex
+	flights   flights        // Contexts of the group's calls, cancelled once nobody waits for them unless finished
+	bg        sync.WaitGroup // background maintenance/eviction started by requests
+	lastSync  sync.Map       // map[repoKey]time.Time
+	headCache sync.Map       // map[repoKey]cachedHead
+	origins   sync.Map       // map[repoKey]string, upstream URL each mirror was fetched from
+	aliases   sync.Map       // map[repoKey]string, owner/repo upstream redirects a repo to
+	repoLocks sync.Map       // map[repoKey]*sync.Mutex
+	taskLocks sync.Map       // map[repoKey]*sync.Mutex, serializing scheduled maintenance tasks
+	fetches   sync.Map       // map[repoKey]*atomic.Int32, syncs from upstream in flight
+	stores    sync.Map       // map[storePath]*sync.Mutex, serializing changes to shared object stores
+	killed    sync.Map       // map[repoKey]time.Time, when a git updating the mirror was last killed by a signal
 }
 
-// New creates a new Mirror manager.
-// maxSize is the maximum cache size (absolute or percentage, zero = 80% of available disk).
-func New(root string, staleAfter time.Duration, maxSize config.SizeSpec, packThreads int, maintainAfterSync bool, log *slog.Logger) (*Mirror, error) {
-	if err := os.MkdirAll(root, 0o755); err != nil {
-		return nil, fmt.Errorf("create mirror root: %w", err)
+// New creates a new Mirror manager from the mirror-related settings in cfg.
+func New(cfg *config.Config, metrics *metrics.Metrics, log *slog.Logger) (*Mirror, error) {
+	dirMode := cfg.CacheDirMode
+	if dirMode == 0 {
+		dirMode = defaultDirMode
+	}
+	var caches []*Cache
+	started := false
+	defer func() {
+		// Leave the roots unlocked when failing to start
+		if !started {
+			for _, cache := range caches {
+				cache.Close()
+			}
+		}
+	}()
+	for _, root := range cfg.MirrorDirs() {
+		if err := mkdirAll(root, dirMode); err != nil {
+			return nil, fmt.Errorf("create mirror root: %w", err)
+		}
+		cache, err := NewCache(root, cfg.MirrorMaxSize, cfg.MinFreeSpace, cfg.CacheLock, metrics, log)
+		if err != nil {
+			return nil, err
+		}
+		caches = append(caches, cache)
+	}
+	if cfg.MirrorTempDir != "" {
+		if err := mkdirAll(cfg.MirrorTempDir, dirMode); err != nil {
+			return nil, fmt.Errorf("create mirror temp dir: %w", err)
+		}
+	}
+	resolver := newUpstreamResolver(cfg.UpstreamHostOverrides, cfg.UpstreamResolver)
+	resolver.family, resolver.fallbackDelay = cfg.UpstreamIPFamily, cfg.UpstreamFallbackDelay
+	upstreamHTTP, err := resolver.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	// Traced for the Phases of the requests they are sent for, and for
+	// metrics with UpstreamTracing
+	tracing := &tracingTransport{base: upstreamHTTP.Transport}
+	if cfg.UpstreamTracing {
+		tracing.metrics = metrics
 	}
-	return &Mirror{
-		root:              root,
-		staleAfter:        staleAfter,
+	upstreamHTTP.Transport = tracing
+	m := &Mirror{
 		log:               log,
-		cache:             NewCache(root, maxSize, log),
-		packThreads:       packThreads,
-		maintainAfterSync: maintainAfterSync,
-	}, nil
+		caches:            caches,
+		packThreads:       cfg.UploadPackThreads,
+		maintainAfterSync: cfg.MaintainAfterSync,
+		syncCommitGraph:   cfg.MaintainCommitGraph,
+		skipCurrent:       cfg.SkipCurrentSyncs,
+		serveStale:        cfg.ServeStaleOnUpstreamError,
+		resolver:          resolver,
+		tempDir:           cfg.MirrorTempDir,
+		peers:             cfg.PeerProxies,
+		metrics:           metrics,
+		prewarmSubmodules: cfg.PrewarmSubmodules,
+		prewarmSem:        make(chan struct{}, prewarmConcurrency),
+		upstreamSlots:     newFetchQueue(cfg.MaxUpstreamFetches, metrics),
+		upstreamHTTP:      upstreamHTTP,
+		ssh:               newSSHUpstream(cfg),
+		refspecs:          cfg.MirrorRefspecs,
+		failover:          newFailover(cfg.UpstreamFallbacks),
+		networks:          cfg.AlternatesNetworks,
+		dirMode:           dirMode,
+		fileMode:          cfg.CacheFileMode,
+		maxAge:            cfg.CacheMaxAge,
+		killedBackoff:     cfg.GitKilledBackoff,
+		followRedirects:   cfg.FollowUpstreamRedirects,
+	}
+	// Signed per request, with the signer in effect when it is sent
+	m.upstreamHTTP.Transport = &signingTransport{base: upstreamHTTP.Transport, signer: func() requestSigner { return m.settings.Load().signer }}
+	if len(cfg.UpstreamQuotas) > 0 {
+		m.quotas = newQuotas(cfg.UpstreamQuotas, cfg.UpstreamQuotaWindow, metrics)
+	}
+	m.flights.finish = cfg.AbandonedFetches == "finish"
+	m.objects = newObjectStore(cfg, m)
+	m.Reload(cfg)
+	for _, cache := range caches {
+		cache.onEvict = m.forget
+		cache.freezeFor = cfg.EvictionFreezeFor
+		cache.minAge = cfg.MinAgeBeforeEvict
+		cache.maxRepos = cfg.MaxRepoCount
+		cache.highWatermark = cfg.EvictHighWatermark
+		cache.lowWatermark = cfg.EvictLowWatermark
+		cache.maxAge = cfg.CacheMaxAge
+		cache.refreshedAt = m.refreshedAt
+		if cfg.CacheFileMode != 0 {
+			cache.fileMode = cfg.CacheFileMode
+		}
+		cache.followSymlinks = cfg.MirrorFollowSymlinks
+		cache.recordedSizes = cfg.EvictionSizes == "recorded"
+	}
+	started = true
+	return m, nil
+}
+
+// settings are the mirror settings that can be reloaded while serving.
+type settings struct {
+	staleAfter       time.Duration
+	revalidateFor    time.Duration // How long past staleAfter mirrors are served while synced in the background
+	syncEmpty        bool          // Sync mirrors without refs whatever staleAfter
+	defaultBranch    string        // Branch HEAD falls back to when upstream's is unknown or missing, empty for none
+	infoTimeout      time.Duration // Bounds ref advertisements fetched from upstream
+	packTimeout      time.Duration // Bounds pack transfers from upstream
+	allowedUpstreams []string      // Hosts mirrors may be fetched from
+	aliases          config.HostAliases
+	gitSuffixHosts   config.GitSuffixHosts
+	rewrites         config.Rewrites
+	signer           requestSigner // Signs requests sent upstream without git, nil for none
+}
+
+// Reload applies the reloadable settings of cfg (see config.Config.Reload) to
+// operations started from now on.
+func (m *Mirror) Reload(cfg *config.Config) {
+	m.settings.Store(&settings{
+		staleAfter:       cfg.SyncStaleAfter,
+		revalidateFor:    cfg.StaleWhileRevalidate,
+		syncEmpty:        cfg.SyncEmptyRepos,
+		defaultBranch:    cfg.DefaultBranch,
+		infoTimeout:      cfg.UpstreamInfoTimeout,
+		packTimeout:      cfg.UpstreamPackTimeout,
+		allowedUpstreams: cfg.AllowedUpstreams,
+		aliases:          cfg.UpstreamHostAliases,
+		gitSuffixHosts:   cfg.KeepGitSuffixHosts,
+		rewrites:         cfg.UpstreamRewrites,
+		signer:           newRequestSigner(cfg),
+	})
+}
+
+// OnChange registers fn to be called with the path of every mirror that was
+// synced or evicted, for dropping what was derived from its previous content.
+// It must be called before the mirror is used.
+func (m *Mirror) OnChange(fn func(repoPath string)) {
+	m.onChange = fn
+}
+
+// UpstreamClient returns the HTTP client for talking to upstream directly,
+// resolving hosts the same way git commands do.
+func (m *Mirror) UpstreamClient() *http.Client {
+	return m.upstreamHTTP
+}
+
+// UpstreamURL returns the URL the mirror of host/owner/repo is fetched from,
+// after applying the first matching upstream rewrite. The resulting host must
+// be an allowed upstream too. Hosts configured for SSH get an ssh:// URL. Repo
+// names get a .git suffix, unless host keeps them as they are.
+func (m *Mirror) UpstreamURL(host, owner, repo string) (string, error) {
+	cur := m.settings.Load()
+	target := cur.rewrites.Apply(host + "/" + owner + "/" + repo)
+	upstreamHost, _, _ := strings.Cut(target, "/")
+	if !slices.Contains(cur.allowedUpstreams, upstreamHost) {
+		return "", fmt.Errorf("upstream %q not in allowed list", upstreamHost)
+	}
+	segs := strings.Split(target, "/")
+	for _, seg := range segs {
+		if seg == "" || seg == "." || seg == ".." {
+			return "", fmt.Errorf("invalid upstream path %q", target)
+		}
+	}
+	if len(segs) < 3 {
+		return "", fmt.Errorf("invalid upstream path %q: expected host/owner/repo", target)
+	}
+	suffix := ".git"
+	if slices.Contains(cur.gitSuffixHosts, host) {
+		suffix = ""
+	}
+	if u := m.ssh.url(target); u != "" {
+		return u + suffix, nil
+	}
+	return "https://" + target + suffix, nil
 }
 
 // RepoPath returns the filesystem path for a repo mirror.
 func (m *Mirror) RepoPath(host, owner, repo string) string {
-	return filepath.Join(m.root, host, owner, repo+".git")
+	return m.repoPath(host + "/" + owner + "/" + repo)
 }
 
 // EnsureRepo ensures the mirror exists and is synced.
@@ -69,95 +277,270 @@ func (m *Mirror) EnsureRepo(ctx context.Context, host, owner, repo, upstreamURL,
 
 	m.log.Debug("ensure repo started", "repo", key)
 
-	// Use singleflight for clone to handle the race where:
-	// 1. Client A sees repo doesn't exist, starts clone
-	// 2. Git creates the directory (but clone isn't done)
-	// 3. Client B sees directory exists, skips singleflight, tries to serve incomplete repo
-	// By always going through singleflight for clone, Client B will wait for Client A's clone to complete.
-	cloneCheckStart := time.Now()
-	result, err, shared := m.group.Do("clone:"+key, func() (interface{}, error) {
-		// Check inside singleflight to avoid TOCTOU race
-		if _, err := os.Stat(repoPath); os.IsNotExist(err) {
-			if err := m.cloneRepo(ctx, repoPath, upstreamURL, authHeader); err != nil {
-				return StatusClone, err
-			}
-			m.lastSync.Store(key, time.Now())
-			m.cache.Touch(key)
-			// Trigger LRU eviction check in background after clone
-			go m.cache.MaybeEvict()
-			return StatusClone, nil
-		}
-		// Repo already exists, signal that no clone was needed
-		return StatusHit, nil
-	})
-	m.log.Debug("clone check complete", "repo", key, "duration_ms", time.Since(cloneCheckStart).Milliseconds(), "shared", shared)
+	status, err := m.ensureCloned(ctx, key, repoPath, upstreamURL, authHeader)
 	if err != nil {
 		return "", "", err
 	}
-	status := result.(Status)
-	if shared {
-		m.log.Info("waited for in-flight clone check", "repo", key, "status", status, "wait_duration_ms", time.Since(cloneCheckStart).Milliseconds())
-	}
 	if status == StatusClone {
 		m.log.Debug("ensure repo complete (clone)", "repo", key, "total_duration_ms", time.Since(start).Milliseconds())
 		return repoPath, StatusClone, nil
 	}
 
 	// Touch cache on access (for LRU tracking)
-	m.cache.Touch(key)
+	cache := m.cacheFor(key)
+	cache.Touch(key)
+	if cache.Unfreeze(key, repoPath) {
+		// Frozen repos have no bitmaps; restore them for fast serving
+		m.bg.Go(func() { m.optimizeRepo(context.Background(), repoPath, true) })
+	}
+
+	// Never serve another upstream's refs
+	if refreshed, err := m.checkOrigin(ctx, key, repoPath, upstreamURL, authHeader); err != nil {
+		m.log.Warn("refresh from new origin failed", "repo", key, "err", err)
+		return "", "", err
+	} else if refreshed {
+		return repoPath, StatusSync, nil
+	}
+
+	// Mirrors past CacheMaxAge are refreshed whatever SyncStaleAfter says, and
+	// purged rather than served if that fails
+	age, expired := m.expired(key, repoPath)
+	if expired {
+		m.log.Info("mirror exceeds max age, refreshing", "repo", key, "age", age.Round(time.Second))
+	}
 
 	// Check if we need to sync first - sync validates auth implicitly via git fetch
-	// This avoids a separate ls-remote call (~110ms) when we're going to fetch anyway
-	if m.isStale(key) {
+	// This avoids a separate ls-remote call (~110ms) when we're going to fetch anyway.
+	// Empty repos are usually pushed to right after being created, so their
+	// mirrors can be kept syncing until they have refs
+	if expired || m.isStale(key) || (m.settings.Load().syncEmpty && !hasRefs(ctx, repoPath)) {
+		// Syncing right after being killed would likely run out of memory again
+		if !expired && m.backingOff(key) {
+			if err := m.checkAccess(ctx, key, repoPath, upstreamURL, authHeader); err != nil {
+				return "", "", err
+			}
+			m.log.Debug("sync held off after git was killed, serving mirror as is", "repo", key)
+			m.metrics.StaleServed.WithLabelValues(key).Inc()
+			return repoPath, StatusStale, nil
+		}
+		if !expired && m.revalidating(key, repoPath) {
+			return m.serveRevalidating(ctx, key, repoPath, upstreamURL, authHeader, start)
+		}
 		syncStart := time.Now()
 		// Sync using singleflight (concurrent requests share same fetch)
-		_, err, shared := m.group.Do("sync:"+key, func() (interface{}, error) {
-			return nil, m.syncRepo(ctx, repoPath, upstreamURL, authHeader)
+		current, err, shared := m.do(ctx, "sync:"+key, func(ctx context.Context) (interface{}, error) {
+			return m.syncUnlessCurrent(ctx, key, repoPath, upstreamURL, authHeader)
 		})
 		if shared {
 			m.log.Debug("waited for in-flight sync", "repo", key, "wait_duration_ms", time.Since(syncStart).Milliseconds())
 		}
 		if err != nil {
+			// Past their host's quota, mirrors are served as they are
+			if errors.Is(err, ErrQuotaExceeded) {
+				if err := m.checkAccess(ctx, key, repoPath, upstreamURL, authHeader); err != nil {
+					return "", "", err
+				}
+				m.log.Info("upstream quota exceeded, serving mirror as is", "repo", key, "err", err)
+				m.metrics.StaleServed.WithLabelValues(key).Inc()
+				return repoPath, StatusStale, nil
+			}
+			// So are mirrors whose fetch was killed, which left them as they were
+			if errors.Is(err, ErrKilled) && !expired && ctx.Err() == nil {
+				if err := m.checkAccess(ctx, key, repoPath, upstreamURL, authHeader); err != nil {
+					return "", "", err
+				}
+				m.log.Warn("sync killed, serving mirror as is", "repo", key, "duration_ms", time.Since(syncStart).Milliseconds())
+				m.metrics.StaleServed.WithLabelValues(key).Inc()
+				return repoPath, StatusStale, nil
+			}
 			// For private repos, sync failure likely means auth failed
 			if m.requiresAuth(repoPath) {
 				m.log.Warn("sync failed (auth required)", "repo", key, "err", err, "duration_ms", time.Since(syncStart).Milliseconds())
-				return "", "", fmt.Errorf("authentication required: %w", err)
+				return "", "", fmt.Errorf("%w: %w", ErrAuthRequired, err)
 			}
+			if expired {
+				m.log.Warn("sync of expired mirror failed, purging", "repo", key, "err", err, "duration_ms", time.Since(syncStart).Milliseconds())
+				cache.Purge(key, repoPath, age)
+				return "", "", err
+			}
+			if !m.serveStale {
+				m.log.Warn("sync failed", "repo", key, "err", err, "duration_ms", time.Since(syncStart).Milliseconds())
+				return "", "", err
+			}
+			// Not marked as synced, so the next request tries upstream again
 			m.log.Warn("sync failed, serving stale", "repo", key, "err", err, "duration_ms", time.Since(syncStart).Milliseconds())
-			// Continue serving stale data, but still report as hit
-			return repoPath, StatusHit, nil
+			m.metrics.StaleServed.WithLabelValues(key).Inc()
+			return repoPath, StatusStale, nil
+		}
+		// Refreshes joined here return no result
+		if skipped, _ := current.(bool); skipped {
+			// Nothing was fetched, so serve it like a fresh mirror, checking
+			// access in case the refs were listed with another client's credentials
+			m.log.Debug("mirror matches upstream, sync skipped", "repo", key, "check_duration_ms", time.Since(syncStart).Milliseconds())
+			return m.serveFresh(ctx, key, repoPath, upstreamURL, authHeader, start)
+		}
+		// A sync joined was made with another client's credentials
+		if shared {
+			if err := m.checkAccess(ctx, key, repoPath, upstreamURL, authHeader); err != nil {
+				return "", "", err
+			}
 		}
-		m.lastSync.Store(key, time.Now())
+		m.markSynced(key)
 		m.log.Debug("ensure repo complete (sync)", "repo", key, "sync_duration_ms", time.Since(syncStart).Milliseconds(), "total_duration_ms", time.Since(start).Milliseconds())
 
 		if m.maintainAfterSync {
-			go m.optimizeRepo(context.Background(), repoPath, false)
+			m.bg.Go(func() { m.optimizeRepo(context.Background(), repoPath, false) })
 		}
 
 		return repoPath, StatusSync, nil
 	}
 
+	return m.serveFresh(ctx, key, repoPath, upstreamURL, authHeader, start)
+}
+
+// syncUnlessCurrent syncs the mirror of key at repoPath from upstream, and
+// reports whether that was skipped for the mirror already matching it.
+func (m *Mirror) syncUnlessCurrent(ctx context.Context, key, repoPath, upstreamURL, authHeader string) (bool, error) {
+	if !m.skipCurrent {
+		return false, m.syncRepo(ctx, key, repoPath, upstreamURL, authHeader, "")
+	}
+	current, upstreamHead := m.isCurrent(ctx, key, repoPath, upstreamURL, authHeader)
+	if current {
+		m.markCurrent(key)
+		m.metrics.SyncSkipped.WithLabelValues(key).Inc()
+		return true, nil
+	}
+	return false, m.syncRepo(ctx, key, repoPath, upstreamURL, authHeader, upstreamHead)
+}
+
+// serveFresh completes EnsureRepo for a mirror that needn't be synced.
+func (m *Mirror) serveFresh(ctx context.Context, key, repoPath, upstreamURL, authHeader string, start time.Time) (string, Status, error) {
 	// Repo is fresh - validate auth only for private repos (cache hit case)
-	if m.requiresAuth(repoPath) {
-		authStart := time.Now()
-		if err := m.validateAuth(ctx, upstreamURL, authHeader); err != nil {
-			m.log.Warn("auth validation failed", "repo", key, "err", err, "duration_ms", time.Since(authStart).Milliseconds())
-			return "", "", fmt.Errorf("authentication required: %w", err)
-		}
-		m.log.Debug("auth validation passed", "repo", key, "duration_ms", time.Since(authStart).Milliseconds())
+	if err := m.checkAccess(ctx, key, repoPath, upstreamURL, authHeader); err != nil {
+		return "", "", err
 	}
 
 	m.log.Debug("ensure repo complete (hit)", "repo", key, "total_duration_ms", time.Since(start).Milliseconds())
 	return repoPath, StatusHit, nil
 }
 
+// ensureCloned clones the mirror if it doesn't exist yet, returning StatusClone
+// if it did so and StatusHit if the mirror was already there.
+func (m *Mirror) ensureCloned(ctx context.Context, key, repoPath, upstreamURL, authHeader string) (Status, error) {
+	// Use singleflight for clone to handle the race where:
+	// 1. Client A sees repo doesn't exist, starts clone
+	// 2. Git creates the directory (but clone isn't done)
+	// 3. Client B sees directory exists, skips singleflight, tries to serve incomplete repo
+	// By always going through singleflight for clone, Client B will wait for Client A's clone to complete.
+	cloneCheckStart := time.Now()
+	result, err, shared := m.do(ctx, "clone:"+key, func(ctx context.Context) (interface{}, error) {
+		// Check inside singleflight to avoid TOCTOU race
+		if _, err := os.Stat(repoPath); os.IsNotExist(err) {
+			if err := m.fetchMirror(ctx, key, repoPath, upstreamURL, authHeader); err != nil {
+				return StatusClone, err
+			}
+			m.initMeta(key, upstreamURL)
+			m.markSynced(key)
+			cache := m.cacheFor(key)
+			cache.Touch(key)
+			// Trigger LRU eviction check in background after clone
+			m.bg.Go(cache.MaybeEvict)
+			if m.prewarmSubmodules {
+				m.bg.Go(func() { m.warmSubmodules(key, repoPath, upstreamURL) })
+			}
+			return StatusClone, nil
+		}
+		// Repo already exists, signal that no clone was needed
+		return StatusHit, nil
+	})
+	m.log.Debug("clone check complete", "repo", key, "duration_ms", time.Since(cloneCheckStart).Milliseconds(), "shared", shared)
+	if err != nil {
+		return "", err
+	}
+	status := result.(Status)
+	if shared {
+		m.log.Info("waited for in-flight clone check", "repo", key, "status", status, "wait_duration_ms", time.Since(cloneCheckStart).Milliseconds())
+		// The clone was made with another client's credentials
+		if status == StatusClone {
+			if err := m.checkAccess(ctx, key, repoPath, upstreamURL, authHeader); err != nil {
+				return "", err
+			}
+		}
+	}
+	return status, nil
+}
+
+// RefreshResult summarizes a mirror's refs after a forced refresh.
+type RefreshResult struct {
+	Repo    string `json:"repo"`
+	Status  Status `json:"status"`
+	Head    string `json:"head,omitempty"`     // Ref HEAD points to, e.g. refs/heads/main
+	HeadSHA string `json:"head_sha,omitempty"` // Empty for repos without commits
+	Refs    int    `json:"refs"`
+}
+
+// Refresh fetches the mirror from upstream right away regardless of staleness,
+// cloning it if missing. A refresh already in flight for the repo (including a
+// staleness-triggered sync) is joined rather than started again.
+func (m *Mirror) Refresh(ctx context.Context, host, owner, repo, upstreamURL, authHeader string) (*RefreshResult, error) {
+	start := time.Now()
+	repoPath := m.RepoPath(host, owner, repo)
+	key := fmt.Sprintf("%s/%s/%s", host, owner, repo)
+
+	status, err := m.ensureCloned(ctx, key, repoPath, upstreamURL, authHeader)
+	if err != nil {
+		return nil, err
+	}
+	// A joined clone or sync may have run with another client's credentials
+	if err := m.checkAccess(ctx, key, repoPath, upstreamURL, authHeader); err != nil {
+		return nil, err
+	}
+	refreshed, err := m.checkOrigin(ctx, key, repoPath, upstreamURL, authHeader)
+	if err != nil {
+		return nil, err
+	}
+	if refreshed {
+		status = StatusSync
+	} else if status != StatusClone {
+		_, err, shared := m.do(ctx, "sync:"+key, func(ctx context.Context) (interface{}, error) {
+			return nil, m.syncRepo(ctx, key, repoPath, upstreamURL, authHeader, "")
+		})
+		if shared {
+			m.log.Debug("waited for in-flight sync", "repo", key, "wait_duration_ms", time.Since(start).Milliseconds())
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.markSynced(key)
+		m.cacheFor(key).Touch(key)
+		status = StatusSync
+	}
+	m.log.Info("refresh complete", "repo", key, "status", status, "duration_ms", time.Since(start).Milliseconds())
+
+	head := readHead(ctx, repoPath)
+	res := &RefreshResult{Repo: key, Status: status, Head: head.Ref, HeadSHA: head.SHA}
+	cmd := gitcmd.Command(ctx, "-C", repoPath, "for-each-ref", "--format=%(refname)")
+	cmd.Env = gitEnv("", "")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git for-each-ref failed: %w", err)
+	}
+	res.Refs = len(strings.Fields(string(out)))
+	return res, nil
+}
+
 // isStale returns true if the repo needs syncing.
 func (m *Mirror) isStale(key string) bool {
 	lastSync, ok := m.lastSync.Load(key)
 	if !ok {
 		return true
 	}
-	return time.Since(lastSync.(time.Time)) > m.staleAfter
+	return time.Since(lastSync.(time.Time)) > m.settings.Load().staleAfter
+}
+
+// RequiresAuth reports whether the mirror of host/owner/repo was cloned with credentials.
+func (m *Mirror) RequiresAuth(host, owner, repo string) bool {
+	return m.requiresAuth(m.RepoPath(host, owner, repo))
 }
 
 // requiresAuth checks if a repo was cloned with authentication.
@@ -168,18 +551,54 @@ func (m *Mirror) requiresAuth(repoPath string) bool {
 
 // markRequiresAuth marks a repo as requiring authentication.
 func (m *Mirror) markRequiresAuth(repoPath string) error {
-	return os.WriteFile(filepath.Join(repoPath, ".requires-auth"), []byte("1"), 0o644)
+	return m.writeFile(filepath.Join(repoPath, ".requires-auth"), []byte("1"))
+}
+
+// CheckAccess verifies that authHeader may read the mirror of host/owner/repo,
+// for callers serving mirror data without going through EnsureRepo.
+func (m *Mirror) CheckAccess(ctx context.Context, host, owner, repo, upstreamURL, authHeader string) error {
+	key := fmt.Sprintf("%s/%s/%s", host, owner, repo)
+	return m.checkAccess(ctx, key, m.RepoPath(host, owner, repo), upstreamURL, authHeader)
+}
+
+// Probe verifies that upstream serves the repo at upstreamURL to authHeader,
+// without fetching anything from it.
+func (m *Mirror) Probe(ctx context.Context, upstreamURL, authHeader string) error {
+	return m.validateAuth(ctx, upstreamURL, authHeader)
+}
+
+// checkAccess verifies that authHeader may read the mirror at repoPath. Only
+// mirrors cloned with credentials need checking; public ones are open to all.
+func (m *Mirror) checkAccess(ctx context.Context, key, repoPath, upstreamURL, authHeader string) error {
+	if !m.requiresAuth(repoPath) {
+		return nil
+	}
+	start := time.Now()
+	if err := m.validateAuth(ctx, upstreamURL, authHeader); err != nil {
+		m.log.Warn("auth validation failed", "repo", key, "err", err, "duration_ms", time.Since(start).Milliseconds())
+		return fmt.Errorf("%w: %w", ErrAuthRequired, err)
+	}
+	m.log.Debug("auth validation passed", "repo", key, "duration_ms", time.Since(start).Milliseconds())
+	return nil
 }
 
 // validateAuth validates the auth token can access the upstream repo using git ls-remote.
+// Empty repos list no HEAD, so only failing to list refs counts.
 func (m *Mirror) validateAuth(ctx context.Context, upstreamURL, authHeader string) error {
 	start := time.Now()
-	args := []string{"ls-remote", "--exit-code", "-q", upstreamURL, "HEAD"}
+	ctx, cancel := m.upstreamContext(ctx, opInfo)
+	defer cancel()
+	args := []string{"ls-remote", "-q", upstreamURL, "HEAD"}
 
-	cmd := exec.CommandContext(ctx, "git", args...)
-	cmd.Env = gitEnv(authHeader)
+	env, err := m.upstreamEnv(ctx, upstreamURL, authHeader)
+	if err != nil {
+		return err
+	}
+	cmd := upstreamCommand(ctx, env, args...)
 
+	gitStart := time.Now()
 	output, err := cmd.CombinedOutput()
+	phasesFrom(ctx).Since(PhaseUpstreamGit, gitStart)
 	if err != nil {
 		m.log.Debug("auth validation failed", "duration_ms", time.Since(start).Milliseconds(), "upstream", upstreamURL)
 		return fmt.Errorf("git ls-remote failed: %w\noutput: %s", err, output)
@@ -188,17 +607,113 @@ func (m *Mirror) validateAuth(ctx context.Context, upstreamURL, authHeader strin
 	return nil
 }
 
-// cloneRepo creates a new bare mirror.
-func (m *Mirror) cloneRepo(ctx context.Context, repoPath, upstreamURL, authHeader string) error {
+// fetchMirror creates a new mirror, seeding it from a peer proxy if one has it
+// and cloning from upstream otherwise. Restricted mirrors always come from
+// upstream, as peers share all of their refs.
+func (m *Mirror) fetchMirror(ctx context.Context, key, repoPath, upstreamURL, authHeader string) error {
+	refs := m.refspecs.For(key)
+	if refs == nil && m.cloneFromPeers(ctx, key, repoPath, upstreamURL) {
+		m.metrics.MirrorFetches.WithLabelValues("peer").Inc()
+		// Catch up with anything pushed since the peer last synced
+		syncErr := m.syncRepo(ctx, key, repoPath, upstreamURL, authHeader, "")
+		if syncErr != nil {
+			m.log.Warn("sync after peer clone failed, serving peer copy", "repo", key, "err", syncErr)
+		}
+		// Optimized like upstream clones; the sync shares the objects when it succeeds
+		m.bg.Go(func() {
+			if syncErr != nil {
+				m.share(key, repoPath)
+			}
+			m.optimizeRepo(context.Background(), repoPath, true)
+		})
+		return nil
+	}
+	host, _, _ := strings.Cut(key, "/")
+	if err := m.quotas.acquire(host); err != nil {
+		return err
+	}
+	release, err := m.upstreamSlots.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	m.metrics.MirrorFetches.WithLabelValues("upstream").Inc()
+	// A failed clone leaves nothing behind, whether staged or in place
+	charge := m.measureFetch(host, repoPath)
+	err = m.retryOnDiskFull(key, func() error {
+		return m.cloneRepo(ctx, repoPath, upstreamURL, authHeader, refs)
+	}, func() {})
+	if err != nil {
+		m.gitKilled(ctx, key, repoPath, "clone", err)
+		return err
+	}
+	charge()
+	// Optimize repo in background (bitmap index, commit-graph, maintenance)
+	m.bg.Go(func() {
+		m.share(key, repoPath)
+		m.optimizeRepo(context.Background(), repoPath, true)
+	})
+	return nil
+}
+
+// share hands the objects of the mirror of key over to the object store,
+// logging failures: the mirror keeps working with its own objects.
+func (m *Mirror) share(key, repoPath string) {
+	if err := m.objects.adopt(context.Background(), key, repoPath); err != nil {
+		m.log.Warn("sharing mirror objects failed", "repo", key, "err", err)
+		return
+	}
+	m.recordSize(repoPath)
+}
+
+// retryOnDiskFull runs op and, if it ran out of disk space, calls cleanup to
+// discard what it wrote, evicts mirrors to free space and runs op once more.
+func (m *Mirror) retryOnDiskFull(key string, op func() error, cleanup func()) error {
+	err := op()
+	if !errors.Is(err, syscall.ENOSPC) {
+		return err
+	}
+	m.log.Warn("disk full, evicting mirrors and retrying", "repo", key, "err", err)
+	cleanup()
+	cache := m.cacheFor(key)
+	cache.EnsureFreeSpace()
+	cache.MaybeEvict()
+	if err = op(); errors.Is(err, syscall.ENOSPC) {
+		cleanup()
+	}
+	return err
+}
+
+// removeFetchLeftovers deletes the temporary packs a failed fetch leaves in
+// the mirror at repoPath. Refs are only updated once all objects are written,
+// so what remains is the mirror as it was before the fetch.
+func removeFetchLeftovers(repoPath string) {
+	leftovers, _ := filepath.Glob(filepath.Join(repoPath, "objects", "pack", "tmp_*"))
+	for _, p := range leftovers {
+		_ = os.Remove(p)
+	}
+}
+
+// cloneRepo creates a new bare mirror, of only refs unless nil.
+func (m *Mirror) cloneRepo(ctx context.Context, repoPath, upstreamURL, authHeader string, refs config.MirrorRefs) error {
 	start := time.Now()
 	m.log.Info("cloning mirror", "path", repoPath, "upstream", upstreamURL, "hasAuth", authHeader != "")
+	ctx, cancel := m.upstreamContext(ctx, opPack)
+	defer cancel()
 
 	// Create parent directory
-	if err := os.MkdirAll(filepath.Dir(repoPath), 0o755); err != nil {
+	if err := mkdirAll(filepath.Dir(repoPath), m.dirMode); err != nil {
 		return fmt.Errorf("create parent dir: %w", err)
 	}
 	m.log.Debug("parent directory ready", "duration_ms", time.Since(start).Milliseconds())
 
+	// Clone into the temp dir if configured, then move into the cache root
+	staged, cleanup, err := m.stage(repoPath)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
 	// Disable GC and reduce memory pressure for large repos
 	args := []string{
 		"-c", "gc.auto=0",
@@ -207,34 +722,72 @@ func (m *Mirror) cloneRepo(ctx context.Context, repoPath, upstreamURL, authHeade
 		"-c", "pack.depth=0",
 		"-c", "pack.deltaCacheSize=1",
 		"-c", "pack.threads=1",
-		"clone", "--bare", "--mirror", upstreamURL, repoPath,
+	}
+	if refs == nil {
+		args = append(append(args, m.sharedRepoArgs()...), "clone", "--bare", "--mirror", upstreamURL, staged)
+	} else {
+		if err := m.initRestricted(ctx, staged, upstreamURL, refs); err != nil {
+			return err
+		}
+		args = append(args, "-C", staged, "fetch", "--prune", "--force", "origin")
+	}
+
+	env, err := m.upstreamEnv(ctx, upstreamURL, authHeader)
+	if err != nil {
+		return err
 	}
 
 	cloneStart := time.Now()
-	cmd := exec.CommandContext(ctx, "git", args...)
-	cmd.Env = gitEnv(authHeader)
+	cmd := upstreamCommand(ctx, env, args...)
 	output, err := cmd.CombinedOutput()
+	phasesFrom(ctx).Since(PhaseUpstreamGit, cloneStart)
 	if err != nil {
 		m.log.Debug("git clone failed", "duration_ms", time.Since(cloneStart).Milliseconds(), "path", repoPath)
-		return fmt.Errorf("git clone failed: %w\noutput: %s", err, output)
+		return gitError("git clone", err, output)
 	}
 	m.log.Debug("git clone command complete", "duration_ms", time.Since(cloneStart).Milliseconds(), "path", repoPath)
+	// git clone --mirror points HEAD where upstream's does, fetching into an
+	// empty repo doesn't
+	upstreamRef := ""
+	if refs != nil {
+		if upstreamRef, err = upstreamHeadRef(ctx, env, upstreamURL); err != nil {
+			return err
+		}
+	}
+	if err := setHead(ctx, staged, upstreamRef, m.settings.Load().defaultBranch); err != nil {
+		return err
+	}
 
-	// Mark repo as requiring auth if it was cloned with auth
-	if authHeader != "" {
-		if err := m.markRequiresAuth(repoPath); err != nil {
+	// Mark repo as requiring auth if it was cloned with auth (SSH upstreams
+	// only see the proxy's key, so client credentials play no part)
+	if authHeader != "" && !isSSH(upstreamURL) {
+		if err := m.markRequiresAuth(staged); err != nil {
 			m.log.Warn("failed to mark repo as requiring auth", "path", repoPath, "err", err)
 		}
 	}
 
-	m.log.Info("clone complete", "path", repoPath, "total_duration_ms", time.Since(start).Milliseconds())
-
-	// Optimize repo in background (bitmap index, commit-graph, maintenance)
-	go m.optimizeRepo(context.Background(), repoPath, true)
+	if err := m.publish(staged, repoPath); err != nil {
+		return fmt.Errorf("move clone into mirror dir: %w", err)
+	}
 
+	m.log.Info("clone complete", "path", repoPath, "total_duration_ms", time.Since(start).Milliseconds())
 	return nil
 }
 
+// gitError wraps the failure of a git command that writes to the mirror dir.
+// Git only reports a full disk in its output, so that case is also wrapped as
+// syscall.ENOSPC for callers to match with errors.Is. Commands killed by a
+// signal are wrapped as ErrKilled.
+func gitError(op string, err error, output []byte) error {
+	if strings.Contains(string(output), "No space left on device") {
+		return fmt.Errorf("%s failed: %w: %w\noutput: %s", op, syscall.ENOSPC, err, output)
+	}
+	if sig, ok := killedBy(err); ok {
+		return fmt.Errorf("%s failed: %w (%s): %w\noutput: %s", op, ErrKilled, sig, err, output)
+	}
+	return fmt.Errorf("%s failed: %w\noutput: %s", op, err, output)
+}
+
 // optimizeRepo runs maintenance tasks; if full is true, run repack+bitmap, otherwise only midx+commit-graph.
 // Should be called in background after clone to not block the first request.
 func (m *Mirror) optimizeRepo(ctx context.Context, repoPath string, full bool) {
@@ -243,11 +796,13 @@ func (m *Mirror) optimizeRepo(ctx context.Context, repoPath string, full bool) {
 
 	if full {
 		repackStart := time.Now()
-		args := []string{"-C", repoPath, "repack", "-a", "-d", "-b", "--write-bitmap-index"}
+		// -l leaves objects borrowed from a shared store out, where bitmaps
+		// can't be written and git skips them with a warning
+		args := []string{"-C", repoPath, "repack", "-a", "-d", "-l", "-b", "--write-bitmap-index"}
 		if m.packThreads > 0 {
 			args = append([]string{"-c", fmt.Sprintf("pack.threads=%d", m.packThreads)}, args...)
 		}
-		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd := gitcmd.Command(ctx, args...)
 		if output, err := cmd.CombinedOutput(); err != nil {
 			m.log.Warn("git repack failed", "path", repoPath, "err", err, "output", string(output))
 		} else {
@@ -257,7 +812,7 @@ func (m *Mirror) optimizeRepo(ctx context.Context, repoPath string, full bool) {
 
 	// Commit graph
 	graphStart := time.Now()
-	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "commit-graph", "write", "--reachable")
+	cmd := gitcmd.Command(ctx, "-C", repoPath, "commit-graph", "write", "--reachable")
 	if output, err := cmd.CombinedOutput(); err != nil {
 		m.log.Warn("git commit-graph write failed", "path", repoPath, "err", err, "output", string(output))
 	} else {
@@ -266,20 +821,41 @@ func (m *Mirror) optimizeRepo(ctx context.Context, repoPath string, full bool) {
 
 	// Multi-pack-index bitmap (Git >=2.43)
 	midxStart := time.Now()
-	cmd = exec.CommandContext(ctx, "git", "-C", repoPath, "multi-pack-index", "write", "--bitmap")
+	cmd = gitcmd.Command(ctx, "-C", repoPath, "multi-pack-index", "write", "--bitmap")
 	if output, err := cmd.CombinedOutput(); err != nil {
 		m.log.Warn("git multi-pack-index write failed", "path", repoPath, "err", err, "output", string(output))
 	} else {
 		m.log.Debug("git multi-pack-index complete", "path", repoPath, "duration_ms", time.Since(midxStart).Milliseconds())
 	}
 
+	m.recordSize(repoPath)
 	m.log.Info("repo optimization complete", "path", repoPath, "full", full, "total_duration_ms", time.Since(start).Milliseconds())
 }
 
-// syncRepo fetches updates from upstream.
-func (m *Mirror) syncRepo(ctx context.Context, repoPath, upstreamURL, authHeader string) error {
+// syncRepo fetches updates from upstream, recording how long the fetch took.
+// upstreamHead is the ref upstream's HEAD points to if known, "" otherwise.
+func (m *Mirror) syncRepo(ctx context.Context, key, repoPath, upstreamURL, authHeader, upstreamHead string) (err error) {
+	host, _, _ := strings.Cut(key, "/")
+	if err := m.quotas.acquire(host); err != nil {
+		return err
+	}
+	release, err := m.upstreamSlots.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
 	start := time.Now()
+	defer func() {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		m.metrics.SyncDuration.WithLabelValues(host, result).Observe(time.Since(start).Seconds())
+	}()
 	m.log.Debug("syncing mirror", "path", repoPath, "hasAuth", authHeader != "")
+	defer m.beginFetch(key)()
+	ctx, cancel := m.upstreamContext(ctx, opPack)
+	defer cancel()
 
 	// Disable GC and reduce memory pressure for large repos
 	args := []string{
@@ -293,18 +869,110 @@ func (m *Mirror) syncRepo(ctx context.Context, repoPath, upstreamURL, authHeader
 		"fetch", "--all", "--prune", "--force",
 	}
 
-	cmd := exec.CommandContext(ctx, "git", args...)
-	cmd.Env = gitEnv(authHeader)
-	output, err := cmd.CombinedOutput()
+	charge := m.measureFetch(host, repoPath)
+	err = m.retryOnDiskFull(key, func() error {
+		return m.fetchWithFailover(ctx, key, upstreamURL, authHeader, args)
+	}, func() { removeFetchLeftovers(repoPath) })
+	charge()
 	if err != nil {
+		m.gitKilled(ctx, key, repoPath, "fetch", err)
+		// Given up on (clients gone, or past the upstream timeout), git was
+		// killed mid-fetch: what it left would fail the next fetches
+		if ctx.Err() != nil {
+			removeFetchLeftovers(repoPath)
+			removeStaleLocks(repoPath)
+		}
 		m.log.Debug("git fetch failed", "duration_ms", time.Since(start).Milliseconds(), "path", repoPath)
-		return fmt.Errorf("git fetch failed: %w\noutput: %s", err, output)
+		return err
 	}
 
+	m.updateHead(ctx, key, repoPath, upstreamURL, authHeader, upstreamHead)
 	m.log.Debug("sync complete", "path", repoPath, "duration_ms", time.Since(start).Milliseconds())
+	if m.syncCommitGraph {
+		m.bg.Go(func() { m.writeCommitGraph(context.Background(), key, repoPath) })
+	}
+	if _, local := m.objects.(localObjects); !local {
+		m.bg.Go(func() { m.share(key, repoPath) })
+	}
 	return nil
 }
 
+// fetchWithFailover runs git fetch with args from upstreamURL, falling back to
+// the mirrors configured for its host in order when it fails. Fallbacks are
+// fetched from in place of upstreamURL with url.insteadOf, so the mirror's
+// origin is left alone, and without the client's credentials, which are for
+// upstream only.
+func (m *Mirror) fetchWithFailover(ctx context.Context, key, upstreamURL, authHeader string, args []string) error {
+	host, _, _ := strings.Cut(key, "/")
+	var errs []error
+	for _, u := range m.failover.upstreams(key, upstreamURL) {
+		fetchArgs, auth, served := args, authHeader, "origin"
+		if u != upstreamURL {
+			fetchArgs = append([]string{"-c", "url." + u + ".insteadOf=" + upstreamURL}, args...)
+			auth, served = "", fallbackName(u)
+		}
+		env, err := m.upstreamEnv(ctx, u, auth)
+		if err == nil {
+			cmd := upstreamCommand(ctx, env, fetchArgs...)
+			gitStart := time.Now()
+			output, cmdErr := cmd.CombinedOutput()
+			phasesFrom(ctx).Since(PhaseUpstreamGit, gitStart)
+			if cmdErr != nil {
+				err = gitError("git fetch", cmdErr, output)
+			}
+		}
+		if u == upstreamURL {
+			m.failover.report(key, err == nil)
+		}
+		if err == nil {
+			m.metrics.SyncUpstreams.WithLabelValues(host, served).Inc()
+			return nil
+		}
+		// Out of disk space or given up on, another upstream won't do better
+		if errors.Is(err, syscall.ENOSPC) || ctx.Err() != nil {
+			return err
+		}
+		errs = append(errs, err)
+		m.log.Warn("sync from upstream failed", "repo", key, "upstream", served, "err", err)
+	}
+	return errors.Join(errs...)
+}
+
+// fallbackName identifies the fallback at u in metrics and logs without the
+// credentials or path its URL may hold.
+func fallbackName(u string) string {
+	if parsed, err := url.Parse(u); err == nil && parsed.Host != "" {
+		return parsed.Host
+	}
+	return "fallback"
+}
+
+// StartEvictionLoop runs periodic cache eviction and low-disk checks in the
+// background until ctx is done. A non-positive interval disables it.
+func (m *Mirror) StartEvictionLoop(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for _, cache := range m.caches {
+		go cache.Run(ctx, interval)
+	}
+}
+
+// Close releases the locks of the mirror roots for other instances.
+func (m *Mirror) Close() error {
+	var errs []error
+	for _, cache := range m.caches {
+		errs = append(errs, cache.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Wait blocks until background work started by requests (post-clone
+// optimization, eviction) has finished.
+func (m *Mirror) Wait() {
+	m.bg.Wait()
+}
+
 // GetRepoLock returns a mutex for the given repo (for exclusive operations).
 func (m *Mirror) GetRepoLock(host, owner, repo string) *sync.Mutex {
 	key := fmt.Sprintf("%s/%s/%s", host, owner, repo)
@@ -327,33 +995,103 @@ func (m *Mirror) MaintainRepo(ctx context.Context, repoKey string, full bool) er
 	return nil
 }
 
-// MaintainAll scans mirror root and runs maintenance on every *.git repo.
+// MaintainAll scans the mirror roots and runs maintenance on every *.git repo.
 func (m *Mirror) MaintainAll(ctx context.Context, full bool) error {
-	return filepath.WalkDir(m.root, func(p string, d os.DirEntry, err error) error {
+	for _, cache := range m.caches {
+		err := filepath.WalkDir(cache.root, func(p string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() && strings.HasSuffix(d.Name(), ".git") {
+				m.optimizeRepo(ctx, p, full)
+			}
+			return nil
+		})
 		if err != nil {
 			return err
 		}
-		if d.IsDir() && strings.HasSuffix(d.Name(), ".git") {
-			m.optimizeRepo(ctx, p, full)
+	}
+	return nil
+}
+
+// upstreamOp is the kind of operation run against upstream, which decides
+// its timeout.
+type upstreamOp int
+
+const (
+	opInfo upstreamOp = iota // Ref advertisements (ls-remote)
+	opPack                   // Pack transfers (clone, fetch, peer bundles)
+)
+
+// upstreamContext bounds ctx by the configured timeout for op, if any.
+func (m *Mirror) upstreamContext(ctx context.Context, op upstreamOp) (context.Context, context.CancelFunc) {
+	cur := m.settings.Load()
+	timeout := cur.packTimeout
+	if op == opInfo {
+		timeout = cur.infoTimeout
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// upstreamEnv returns the git environment for commands talking to upstreamURL,
+// including any host override or custom DNS resolution.
+func (m *Mirror) upstreamEnv(ctx context.Context, upstreamURL, authHeader string) ([]string, error) {
+	if isSSH(upstreamURL) {
+		sshCommand, err := m.sshCommand(ctx, upstreamURL)
+		if err != nil {
+			return nil, err
 		}
-		return nil
-	})
+		return append(gitEnv("", ""), "GIT_SSH_COMMAND="+sshCommand), nil
+	}
+	resolve, err := m.resolver.curlResolve(ctx, upstreamURL)
+	if err != nil {
+		return nil, err
+	}
+	if !m.followRedirects {
+		return gitEnv(authHeader, resolve, [2]string{"http.followRedirects", "false"}), nil
+	}
+	return gitEnv(authHeader, resolve), nil
+}
+
+// upstreamCommand returns a git command talking to upstream with env. git
+// runs transports in child processes (git-remote-https, ssh) that a kill of
+// git alone leaves running, holding the connection and git's output open, so
+// the whole process group is killed when ctx is done.
+func upstreamCommand(ctx context.Context, env []string, args ...string) *exec.Cmd {
+	cmd := gitcmd.Command(ctx, args...)
+	cmd.Env = env
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// Don't wait forever on output held open by anything that escaped the group
+	cmd.WaitDelay = 5 * time.Second
+	return cmd
 }
 
 // gitEnv returns environment variables for git commands.
-// Uses GIT_CONFIG_* env vars to pass auth without persisting to repo config.
-func gitEnv(authHeader string) []string {
-	env := append(os.Environ(),
-		"GIT_TERMINAL_PROMPT=0",
-		"GIT_CONFIG_GLOBAL=/dev/null",
-		"GIT_CONFIG_SYSTEM=/dev/null",
-	)
+// Uses GIT_CONFIG_* env vars to pass auth, host resolution and any extra
+// settings without persisting to repo config.
+func gitEnv(authHeader, curlResolve string, extra ...[2]string) []string {
+	env := gitcmd.Env()
+	configs := extra
 	if authHeader != "" {
-		env = append(env,
-			"GIT_CONFIG_COUNT=1",
-			"GIT_CONFIG_KEY_0=http.extraheader",
-			fmt.Sprintf("GIT_CONFIG_VALUE_0=Authorization: %s", authHeader),
-		)
+		configs = append(configs, [2]string{"http.extraheader", "Authorization: " + authHeader})
+	}
+	if curlResolve != "" {
+		configs = append(configs, [2]string{"http.curloptResolve", curlResolve})
+	}
+	if len(configs) > 0 {
+		env = append(env, fmt.Sprintf("GIT_CONFIG_COUNT=%d", len(configs)))
+		for i, c := range configs {
+			env = append(env,
+				fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", i, c[0]),
+				fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i, c[1]),
+			)
+		}
 	}
 	return env
 }
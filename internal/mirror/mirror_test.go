@@ -0,0 +1,258 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGitErrorDiskFull(t *testing.T) {
+	exitErr := &exec.ExitError{}
+	err := gitError("git fetch", exitErr, []byte("error: unable to write file objects/ab/cdef: No space left on device\n"))
+	if !errors.Is(err, syscall.ENOSPC) || !errors.As(err, &exitErr) {
+		t.Fatalf("expected a full disk to match ENOSPC and keep the exit error, got %v", err)
+	}
+	if err := gitError("git fetch", exitErr, []byte("fatal: repository not found\n")); errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expected other failures not to match ENOSPC, got %v", err)
+	}
+}
+
+// diskFullGit puts a git wrapper first in PATH that fails the first failures
+// invocations whose arguments contain match as if the disk were full, leaving
+// a temporary pack behind like an interrupted fetch does.
+func diskFullGit(t *testing.T, match string, failures int) {
+	t.Helper()
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found in PATH")
+	}
+	dir := t.TempDir()
+	count := filepath.Join(dir, "count")
+	script := `#!/bin/sh
+case "$*" in
+*"` + match + `"*)
+	n=$(cat "` + count + `" 2>/dev/null || echo 0)
+	if [ "$n" -lt ` + strconv.Itoa(failures) + ` ]; then
+		echo $((n + 1)) > "` + count + `"
+		[ "$1" = "-C" ] && touch "$2/objects/pack/tmp_pack_test"
+		echo "fatal: write error: No space left on device" >&2
+		exit 128
+	fi
+	;;
+esac
+exec "` + realGit + `" "$@"
+`
+	if err := os.WriteFile(filepath.Join(dir, "git"), []byte(script), 0o755); err != nil {
+		t.Fatalf("write git wrapper: %v", err)
+	}
+	t.Setenv("PATH", dir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+}
+
+func TestDiskFullDuringSync(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	work := filepath.Join(t.TempDir(), "work")
+	upstream := filepath.Join(t.TempDir(), "upstream.git")
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	commit := func(msg string) string {
+		git("-C", work, "commit", "-q", "--allow-empty", "-m", msg)
+		git("-C", work, "push", "-q", upstream, "main")
+		return git("-C", work, "rev-parse", "HEAD")
+	}
+	git("init", "-q", "-b", "main", work)
+	git("init", "-q", "--bare", upstream)
+	commit("first")
+
+	// Every request syncs
+	cfg := &config.Config{MirrorDir: t.TempDir(), ServeStaleOnUpstreamError: true}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(m.Wait)
+	ctx := context.Background()
+	repoPath, _, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, "")
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	leftover := filepath.Join(repoPath, "objects", "pack", "tmp_pack_test")
+
+	// A single failure is retried after eviction
+	second := commit("second")
+	diskFullGit(t, "fetch --all", 1)
+	if _, status, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, ""); err != nil || status != StatusSync {
+		t.Fatalf("expected retried sync, got %s (%v)", status, err)
+	}
+	if got := git("-C", repoPath, "rev-parse", "main"); got != second {
+		t.Fatalf("expected mirror at %s after retry, got %s", second, got)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Fatalf("expected leftovers of the failed fetch to be removed, got %v", err)
+	}
+
+	// Failing twice keeps the previous mirror, without leftovers
+	commit("third")
+	diskFullGit(t, "fetch --all", 2)
+	if _, status, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, ""); err != nil || status != StatusStale {
+		t.Fatalf("expected stale mirror to be served, got %s (%v)", status, err)
+	}
+	if got := git("-C", repoPath, "rev-parse", "main"); got != second {
+		t.Fatalf("expected mirror to stay at %s, got %s", second, got)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Fatalf("expected leftovers of the failed fetch to be removed, got %v", err)
+	}
+}
+
+func TestServeStaleOnUpstreamError(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	upstream := filepath.Join(t.TempDir(), "upstream.git")
+	if out, err := exec.Command("git", "init", "-q", "--bare", upstream).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v\n%s", err, out)
+	}
+	ctx := context.Background()
+
+	for _, serveStale := range []bool{true, false} {
+		// Every request syncs
+		cfg := &config.Config{MirrorDir: t.TempDir(), ServeStaleOnUpstreamError: serveStale}
+		m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+		if err != nil {
+			t.Fatalf("mirror init: %v", err)
+		}
+		t.Cleanup(m.Wait)
+		if _, _, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, ""); err != nil {
+			t.Fatalf("clone: %v", err)
+		}
+
+		// Upstream outage
+		hidden := upstream + ".down"
+		if err := os.Rename(upstream, hidden); err != nil {
+			t.Fatalf("hide upstream: %v", err)
+		}
+		_, status, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, "")
+		stale := testutil.ToFloat64(m.metrics.StaleServed.WithLabelValues("local/owner/repo"))
+		if serveStale && (err != nil || status != StatusStale || stale != 1) {
+			t.Fatalf("expected stale mirror to be served and counted, got %s (%v), %v counted", status, err, stale)
+		}
+		if !serveStale && (err == nil || stale != 0) {
+			t.Fatalf("expected sync failure to be an error, got %s, %v counted", status, stale)
+		}
+
+		// Fresh data again as soon as upstream is back
+		if err := os.Rename(hidden, upstream); err != nil {
+			t.Fatalf("restore upstream: %v", err)
+		}
+		if _, status, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, ""); err != nil || status != StatusSync {
+			t.Fatalf("expected sync once upstream is back, got %s (%v)", status, err)
+		}
+	}
+}
+
+func TestDiskFullDuringClone(t *testing.T) {
+	diskFullGit(t, "--mirror", 2)
+	cfg := &config.Config{MirrorDir: t.TempDir()}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(m.Wait)
+
+	_, _, err = m.EnsureRepo(context.Background(), "local", "owner", "repo", t.TempDir(), "")
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expected disk full error after retry, got %v", err)
+	}
+	if _, err := os.Stat(m.RepoPath("local", "owner", "repo")); !os.IsNotExist(err) {
+		t.Fatalf("expected no partial mirror, got %v", err)
+	}
+}
+
+func TestUpstreamURL(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	cfg, err := config.LoadArgs([]string{
+		"-mirror-dir", t.TempDir(),
+		"-allowed-upstreams", "github.com,internal.example.com",
+		"-upstream-rewrites", `github\.com/legacy-org/(.+)=>internal.example.com/mirror/$1 github\.com/flat/(.+)=>internal.example.com/$1 github\.com/up/(.+)=>github.com/../$1`,
+	})
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+
+	tests := []struct {
+		host, owner, repo string
+		want              string
+		wantErr           bool
+	}{
+		{"github.com", "owner", "repo", "https://github.com/owner/repo.git", false},
+		{"github.com", "legacy-org", "tool", "https://internal.example.com/mirror/tool.git", false},
+		{"github.com", "flat", "tool", "", true},  // rewritten to host/repo only
+		{"github.com", "up", "tool", "", true},    // dot segments
+		{"gitlab.com", "owner", "repo", "", true}, // never allowed
+		{"internal.example.com", "a", "b", "https://internal.example.com/a/b.git", false},
+	}
+	for _, tt := range tests {
+		got, err := m.UpstreamURL(tt.host, tt.owner, tt.repo)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("UpstreamURL(%s/%s/%s) = %q, %v; want %q (error %v)", tt.host, tt.owner, tt.repo, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestUpstreamContext(t *testing.T) {
+	cfg := &config.Config{MirrorDir: t.TempDir(), UpstreamInfoTimeout: time.Minute, UpstreamPackTimeout: time.Hour}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	deadline := func(op upstreamOp) time.Duration {
+		t.Helper()
+		ctx, cancel := m.upstreamContext(context.Background(), op)
+		defer cancel()
+		d, ok := ctx.Deadline()
+		if !ok {
+			return 0
+		}
+		return time.Until(d).Round(time.Minute)
+	}
+	if got := deadline(opInfo); got != time.Minute {
+		t.Fatalf("expected ref advertisements to be bounded by 1m, got %v", got)
+	}
+	if got := deadline(opPack); got != time.Hour {
+		t.Fatalf("expected pack transfers to be bounded by 1h, got %v", got)
+	}
+
+	// Zero means no deadline
+	m.Reload(&config.Config{UpstreamPackTimeout: time.Hour})
+	if got := deadline(opInfo); got != 0 {
+		t.Fatalf("expected no deadline for ref advertisements, got %v", got)
+	}
+}
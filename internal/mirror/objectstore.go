@@ -0,0 +1,42 @@
+package mirror
+
+import (
+	"context"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+)
+
+// objectStore is where mirrors keep their objects. Mirrors always hold their
+// own refs, so they can be served, synced and evicted on their own; a store
+// may take their objects off them once cloned or synced, leaving them to
+// borrow objects from it through objects/info/alternates. Objects are
+// addressed by OID in any store, so each is kept once per store.
+type objectStore interface {
+	// adopt hands the objects of the mirror of key at repoPath over to the
+	// store, after it was cloned or synced. On failure the mirror keeps its
+	// own objects.
+	adopt(ctx context.Context, key, repoPath string) error
+	// release drops what the store keeps for the mirror of key evicted from
+	// repoPath.
+	release(key, repoPath string)
+}
+
+// newObjectStore returns the object store cfg asks for: one shared by every
+// mirror of a root with ExperimentalCASStore, one per fork network with
+// EnableAlternates, and each mirror's own objects directory otherwise.
+func newObjectStore(cfg *config.Config, m *Mirror) objectStore {
+	switch {
+	case cfg.ExperimentalCASStore:
+		return sharedObjects{m: m, group: func(string) string { return casStore }}
+	case cfg.EnableAlternates:
+		return sharedObjects{m: m, group: m.network}
+	}
+	return localObjects{}
+}
+
+// localObjects is the default objectStore: mirrors keep their objects.
+type localObjects struct{}
+
+func (localObjects) adopt(context.Context, string, string) error { return nil }
+
+func (localObjects) release(string, string) {}
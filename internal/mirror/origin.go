@@ -0,0 +1,74 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/crohr/smart-git-proxy/internal/gitcmd"
+)
+
+// origin returns the upstream URL the mirror of key was fetched from, as
+// stored in its git config by git clone --mirror. It is remembered after the
+// first read.
+func (m *Mirror) origin(ctx context.Context, key, repoPath string) (string, error) {
+	if v, ok := m.origins.Load(key); ok {
+		return v.(string), nil
+	}
+	cmd := gitcmd.Command(ctx, "-C", repoPath, "config", "--get", "remote.origin.url")
+	cmd.Env = gitEnv("", "")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("read mirror origin: %w", err)
+	}
+	origin := strings.TrimSpace(string(out))
+	m.origins.Store(key, origin)
+	return origin, nil
+}
+
+// checkOrigin makes sure the mirror of key holds upstreamURL's refs. When two
+// upstreams map to the same key (e.g. after changing a rewrite or a host's
+// scheme), the mirror still holds the other one's: it is then logged, counted
+// and fetched again from upstreamURL, returning true. If that fails, the
+// mirror is left pointing at its previous origin and must not be served.
+func (m *Mirror) checkOrigin(ctx context.Context, key, repoPath, upstreamURL, authHeader string) (bool, error) {
+	origin, err := m.origin(ctx, key, repoPath)
+	if err != nil || origin == upstreamURL {
+		return false, err
+	}
+	m.log.Warn("mirror origin differs from upstream, refreshing", "repo", key, "origin", origin, "upstream", upstreamURL)
+	m.metrics.OriginCollisions.WithLabelValues(key).Inc()
+	_, err, _ = m.do(ctx, "sync:"+key, func(ctx context.Context) (interface{}, error) {
+		if origin, _ := m.origin(ctx, key, repoPath); origin == upstreamURL {
+			return nil, nil // Refreshed by a concurrent request
+		}
+		if err := setOrigin(ctx, repoPath, upstreamURL); err != nil {
+			return nil, err
+		}
+		if err := m.syncRepo(ctx, key, repoPath, upstreamURL, authHeader, ""); err != nil {
+			// Even when the fetch failed because every client left
+			if rerr := setOrigin(context.WithoutCancel(ctx), repoPath, origin); rerr != nil {
+				m.log.Error("restore mirror origin failed", "repo", key, "err", rerr)
+			}
+			return nil, err
+		}
+		m.origins.Store(key, upstreamURL)
+		m.recordMeta(key, func(meta *repoMeta) { meta.Origin = upstreamURL })
+		return nil, nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("refresh mirror from new origin %s: %w", upstreamURL, err)
+	}
+	m.markSynced(key)
+	return true, nil
+}
+
+// setOrigin points the mirror at repoPath to upstreamURL.
+func setOrigin(ctx context.Context, repoPath, upstreamURL string) error {
+	cmd := gitcmd.Command(ctx, "-C", repoPath, "remote", "set-url", "origin", upstreamURL)
+	cmd.Env = gitEnv("", "")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return gitError("git remote set-url", err, output)
+	}
+	return nil
+}
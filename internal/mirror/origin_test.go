@@ -0,0 +1,88 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestOriginCollision(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	// Two upstreams with unrelated histories
+	upstream := func(msg string) (string, string) {
+		work := filepath.Join(t.TempDir(), "work")
+		bare := filepath.Join(t.TempDir(), "upstream.git")
+		git("init", "-q", "-b", "main", work)
+		git("-C", work, "commit", "-q", "--allow-empty", "-m", msg)
+		git("clone", "-q", "--bare", work, bare)
+		return bare, git("-C", work, "rev-parse", "HEAD")
+	}
+	first, _ := upstream("first")
+	second, secondHead := upstream("second")
+
+	// Mirrors stay fresh, so only a collision fetches again
+	cfg := &config.Config{MirrorDir: t.TempDir(), SyncStaleAfter: time.Hour, ServeStaleOnUpstreamError: true}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(m.Wait)
+	ctx := context.Background()
+	repoPath, _, err := m.EnsureRepo(ctx, "local", "owner", "repo", first, "")
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	if _, status, err := m.EnsureRepo(ctx, "local", "owner", "repo", first, ""); err != nil || status != StatusHit {
+		t.Fatalf("expected a hit for the same upstream, got %s (%v)", status, err)
+	}
+
+	// Another upstream mapping to the same key replaces the mirror's refs
+	if _, status, err := m.EnsureRepo(ctx, "local", "owner", "repo", second, ""); err != nil || status != StatusSync {
+		t.Fatalf("expected a sync from the new upstream, got %s (%v)", status, err)
+	}
+	if got := git("-C", repoPath, "rev-parse", "main"); got != secondHead {
+		t.Fatalf("expected mirror at %s, got %s", secondHead, got)
+	}
+	if got := git("-C", repoPath, "config", "remote.origin.url"); got != second {
+		t.Fatalf("expected origin %s to be stored, got %s", second, got)
+	}
+	if n := testutil.ToFloat64(m.metrics.OriginCollisions.WithLabelValues("local/owner/repo")); n != 1 {
+		t.Fatalf("expected 1 collision counted, got %v", n)
+	}
+
+	// Failing to fetch from a new upstream is an error even when serving
+	// stale mirrors, and keeps the previous origin
+	missing := filepath.Join(t.TempDir(), "missing.git")
+	if _, _, err := m.EnsureRepo(ctx, "local", "owner", "repo", missing, ""); err == nil {
+		t.Fatalf("expected a failed refresh from the new upstream to be an error")
+	}
+	if got := git("-C", repoPath, "config", "remote.origin.url"); got != second {
+		t.Fatalf("expected origin %s to be kept, got %s", second, got)
+	}
+	if _, status, err := m.EnsureRepo(ctx, "local", "owner", "repo", second, ""); err != nil || status != StatusHit {
+		t.Fatalf("expected a hit for the kept upstream, got %s (%v)", status, err)
+	}
+}
@@ -0,0 +1,105 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/gitcmd"
+)
+
+// ErrNotMirrored is returned when a repo has no mirror that can be shared.
+var ErrNotMirrored = errors.New("repo not mirrored")
+
+// WriteBundle writes the mirror of host/owner/repo to w as a git bundle, for a
+// sibling proxy to seed its own mirror from. Bundles carry the mirror's packed
+// objects, which are already compressed. Mirrors cloned with credentials are
+// never shared since peers can't check the client may read them.
+func (m *Mirror) WriteBundle(ctx context.Context, w io.Writer, host, owner, repo string) error {
+	repoPath := m.RepoPath(host, owner, repo)
+	if _, err := os.Stat(repoPath); err != nil || m.requiresAuth(repoPath) {
+		return ErrNotMirrored
+	}
+
+	cmd := gitcmd.Command(ctx, "-C", repoPath, "bundle", "create", "-", "--all")
+	cmd.Env = gitEnv("", "")
+	cmd.Stdout = w
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git bundle create failed: %w", err)
+	}
+	return nil
+}
+
+// cloneFromPeers tries to create the mirror at repoPath from a sibling proxy's
+// bundle, pointing it at upstreamURL afterwards. Returns false if no peer had it.
+func (m *Mirror) cloneFromPeers(ctx context.Context, key, repoPath, upstreamURL string) bool {
+	for _, peer := range m.peers {
+		start := time.Now()
+		if err := m.cloneFromPeer(ctx, peer, key, repoPath, upstreamURL); err != nil {
+			m.log.Debug("peer clone failed", "peer", peer, "repo", key, "err", err)
+			_ = os.RemoveAll(repoPath)
+			continue
+		}
+		m.log.Info("cloned mirror from peer", "peer", peer, "repo", key, "duration_ms", time.Since(start).Milliseconds())
+		return true
+	}
+	return false
+}
+
+func (m *Mirror) cloneFromPeer(ctx context.Context, peer, key, repoPath, upstreamURL string) error {
+	ctx, cancel := m.upstreamContext(ctx, opPack)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+"/admin/bundle/"+key, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer returned %s", resp.Status)
+	}
+
+	// Stage the bundle on disk; git needs a seekable file to clone from
+	bundleDir := m.cacheFor(key).root
+	if m.tempDir != "" {
+		bundleDir = m.tempDir
+	}
+	bundle, err := os.CreateTemp(bundleDir, ".peer-*.bundle")
+	if err != nil {
+		return fmt.Errorf("create bundle file: %w", err)
+	}
+	defer os.Remove(bundle.Name())
+	_, err = io.Copy(bundle, resp.Body)
+	if cerr := bundle.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("download bundle: %w", err)
+	}
+
+	staged, cleanup, err := m.stage(repoPath)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	args := append(m.sharedRepoArgs(), "clone", "--bare", "--mirror", bundle.Name(), staged)
+	cmd := gitcmd.Command(ctx, args...)
+	cmd.Env = gitEnv("", "")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return gitError("git clone from bundle", err, output)
+	}
+	cmd = gitcmd.Command(ctx, "-C", staged, "remote", "set-url", "origin", upstreamURL)
+	cmd.Env = gitEnv("", "")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git remote set-url failed: %w\noutput: %s", err, output)
+	}
+	return m.publish(staged, repoPath)
+}
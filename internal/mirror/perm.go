@@ -0,0 +1,59 @@
+package mirror
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Default permissions of what the proxy creates in the mirror dir itself.
+// Files written by git follow its defaults unless a file mode is configured.
+const (
+	defaultDirMode  os.FileMode = 0o755
+	defaultFileMode os.FileMode = 0o644
+)
+
+// mkdirAll creates dir and any missing parents with mode, regardless of the
+// process umask. Existing directories are left alone.
+func mkdirAll(dir string, mode os.FileMode) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil || filepath.Dir(d) == d {
+			break
+		}
+		missing = append(missing, d)
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return err
+	}
+	for _, d := range missing {
+		if err := os.Chmod(d, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFile writes a file with the configured file mode, regardless of the
+// process umask.
+func (m *Mirror) writeFile(path string, data []byte) error {
+	mode := m.fileMode
+	if mode == 0 {
+		mode = defaultFileMode
+	}
+	if err := os.WriteFile(path, data, mode); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
+
+// sharedRepoArgs returns the git options to clone new mirrors with, making git
+// create their files with the configured file mode and directories with the
+// matching execute bits. git records the setting in the mirror's config, so
+// later fetches and maintenance follow it too.
+func (m *Mirror) sharedRepoArgs() []string {
+	if m.fileMode == 0 {
+		return nil
+	}
+	return []string{"-c", fmt.Sprintf("core.sharedRepository=0%o", m.fileMode.Perm())}
+}
@@ -0,0 +1,57 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+)
+
+func TestCacheModes(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	upstream := filepath.Join(t.TempDir(), "upstream.git")
+	if out, err := exec.Command("git", "init", "-q", "--bare", upstream).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v\n%s", err, out)
+	}
+	// Modes apply regardless of a restrictive umask
+	defer syscall.Umask(syscall.Umask(0o077))
+
+	root := filepath.Join(t.TempDir(), "mirrors")
+	cfg := &config.Config{MirrorDir: root, SyncStaleAfter: time.Minute, CacheDirMode: 0o750, CacheFileMode: 0o640}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(m.Wait)
+	repoPath, _, err := m.EnsureRepo(context.Background(), "local", "owner", "repo", upstream, "")
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	m.Wait()
+
+	for _, dir := range []string{root, filepath.Join(root, "local"), filepath.Join(root, "local", "owner")} {
+		if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0o750 {
+			t.Fatalf("expected %s to have mode 0750, got %v (%v)", dir, info.Mode(), err)
+		}
+	}
+	// git derives directory modes from the file mode
+	for path, want := range map[string]os.FileMode{
+		filepath.Join(repoPath, "HEAD"):    0o640,
+		filepath.Join(repoPath, "config"):  0o640,
+		filepath.Join(repoPath, "objects"): 0o750,
+	} {
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != want {
+			t.Fatalf("expected %s to have mode %04o, got %v (%v)", path, want, info.Mode(), err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package mirror
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Phase is a part of the time spent answering a request, see Phases.
+type Phase int
+
+const (
+	PhaseWait                Phase = iota // Joining other requests' syncs, clones and redirect checks, waiting for upstream slots and locks
+	PhaseDNS                              // Resolving upstream hosts
+	PhaseConnect                          // Connecting to upstream
+	PhaseTLS                              // TLS handshakes with upstream
+	PhaseUpstreamNegotiation              // From upstream HTTP requests sent to the first byte of their responses
+	PhaseUpstreamGit                      // git clones, fetches and ref listings against upstream, negotiation and transfer alike
+	PhaseLocalGit                         // Local git preparing responses, up to their first byte
+	PhaseTransfer                         // Sending responses to the client, from their first byte
+	numPhases
+)
+
+var phaseNames = [numPhases]string{"wait", "dns", "connect", "tls", "upstream_negotiation", "upstream_git", "local_git", "transfer"}
+
+func (p Phase) String() string {
+	return phaseNames[p]
+}
+
+// Phases accumulates how long a request spent in each Phase, from the
+// request itself and the upstream work it started. Recording is an atomic
+// add, so it can be left on for every request. Methods of a nil Phases do
+// nothing.
+type Phases struct {
+	d [numPhases]atomic.Int64
+}
+
+type phasesKey struct{}
+
+// WithPhases returns ctx with the Phases the work done for it records into.
+// Syncs and clones shared by several requests record into that of the request
+// that started them, the others recording their wait.
+func WithPhases(ctx context.Context, p *Phases) context.Context {
+	return context.WithValue(ctx, phasesKey{}, p)
+}
+
+// phasesFrom returns the Phases attached to ctx, nil if none.
+func phasesFrom(ctx context.Context) *Phases {
+	p, _ := ctx.Value(phasesKey{}).(*Phases)
+	return p
+}
+
+// Add records d spent in phase.
+func (p *Phases) Add(phase Phase, d time.Duration) {
+	if p == nil || d <= 0 {
+		return
+	}
+	p.d[phase].Add(int64(d))
+}
+
+// Since records the time since start as spent in phase.
+func (p *Phases) Since(phase Phase, start time.Time) {
+	p.Add(phase, time.Since(start))
+}
+
+// Get returns the time recorded in phase.
+func (p *Phases) Get(phase Phase) time.Duration {
+	if p == nil {
+		return 0
+	}
+	return time.Duration(p.d[phase].Load())
+}
+
+// LogAttrs returns the time recorded in each phase as <phase>_ms key-value
+// pairs, then the rest of took as other_ms.
+func (p *Phases) LogAttrs(took time.Duration) []any {
+	attrs := make([]any, 0, 2*numPhases+2)
+	rest := took
+	for phase := range numPhases {
+		d := p.Get(phase)
+		rest -= d
+		attrs = append(attrs, phase.String()+"_ms", d.Milliseconds())
+	}
+	return append(attrs, "other_ms", max(rest, 0).Milliseconds())
+}
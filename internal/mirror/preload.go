@@ -0,0 +1,68 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// PreloadStatus is what Preload found or did for a commit.
+type PreloadStatus string
+
+const (
+	PreloadPresent PreloadStatus = "present" // Already in the mirror
+	PreloadFetched PreloadStatus = "fetched" // Brought in by cloning or syncing the mirror
+	PreloadMissing PreloadStatus = "missing" // Not on any mirrored ref upstream, even after syncing
+)
+
+// Preload makes sure the mirror of host/owner/repo has commits, ahead of
+// clients fetching them by SHA: it is cloned if missing, like Warm does, and
+// synced if any commit isn't in it yet. Mirrors only hold what upstream refs
+// reach, so commits no ref leads to any more are reported missing rather
+// than fetched on their own. The result has a status for every commit.
+func (m *Mirror) Preload(ctx context.Context, host, owner, repo, authHeader string, commits []string) (map[string]PreloadStatus, error) {
+	start := time.Now()
+	status, err := m.Warm(ctx, host, owner, repo, authHeader)
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%s/%s/%s", host, owner, repo)
+	repoPath := m.RepoPath(host, owner, repo)
+	upstreamURL, err := m.UpstreamURL(host, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	// A joined clone may have run with another client's credentials
+	if err := m.checkAccess(ctx, key, repoPath, upstreamURL, authHeader); err != nil {
+		return nil, err
+	}
+	m.cacheFor(key).Touch(key)
+
+	missing := m.missingObjects(ctx, repoPath, commits)
+	unreachable := missing
+	if status != StatusClone && len(missing) > 0 {
+		_, err, _ := m.do(WithPriority(ctx, PriorityBatch), "sync:"+key, func(ctx context.Context) (interface{}, error) {
+			return nil, m.syncRepo(ctx, key, repoPath, upstreamURL, authHeader, "")
+		})
+		if err != nil {
+			return nil, err
+		}
+		m.markSynced(key)
+		unreachable = m.missingObjects(ctx, repoPath, missing)
+	}
+
+	res := make(map[string]PreloadStatus, len(commits))
+	for _, c := range commits {
+		switch {
+		case slices.Contains(unreachable, c):
+			res[c] = PreloadMissing
+		case status == StatusClone || slices.Contains(missing, c):
+			res[c] = PreloadFetched
+		default:
+			res[c] = PreloadPresent
+		}
+	}
+	m.log.Info("preload complete", "repo", key, "commits", len(commits), "missing", len(unreachable), "status", status, "duration_ms", time.Since(start).Milliseconds())
+	return res, nil
+}
@@ -0,0 +1,136 @@
+package mirror
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+)
+
+// Priority orders the upstream fetches waiting for a slot when
+// MaxUpstreamFetches is set: every waiting fetch of a priority starts before
+// any of the next one.
+type Priority int
+
+const (
+	PriorityInteractive Priority = iota // Developers waiting at their terminal
+	PriorityBatch                       // CI and other bulk clients, which can wait
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"interactive", "batch"}
+
+func (p Priority) String() string {
+	return priorityNames[p]
+}
+
+// ParsePriority returns the Priority named s.
+func ParsePriority(s string) (Priority, bool) {
+	for p, name := range priorityNames {
+		if s == name {
+			return Priority(p), true
+		}
+	}
+	return 0, false
+}
+
+type priorityKey struct{}
+
+// WithPriority returns ctx with the priority of the upstream fetches made for
+// it. Fetches shared by several requests keep the priority of the first one.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// priorityOf returns the priority set on ctx, interactive by default.
+func priorityOf(ctx context.Context) Priority {
+	p, _ := ctx.Value(priorityKey{}).(Priority)
+	return p
+}
+
+// fetchQueue bounds the clones and syncs running against upstream at once.
+// Fetches past the limit wait in FIFO order within their priority, and a
+// freed slot goes to the highest priority waiting.
+type fetchQueue struct {
+	metrics *metrics.Metrics
+
+	mu      sync.Mutex
+	free    int
+	waiting [numPriorities][]chan struct{}
+}
+
+// newFetchQueue returns a queue running n fetches at once, or nil, which
+// never waits, if n is zero.
+func newFetchQueue(n int, m *metrics.Metrics) *fetchQueue {
+	if n <= 0 {
+		return nil
+	}
+	for _, name := range priorityNames {
+		m.UpstreamQueueDepth.WithLabelValues(name).Set(0)
+	}
+	return &fetchQueue{metrics: m, free: n}
+}
+
+// acquire waits for a fetch slot at ctx's priority and returns the func
+// releasing it, or ctx's error if it is done first.
+func (q *fetchQueue) acquire(ctx context.Context) (func(), error) {
+	if q == nil {
+		return func() {}, nil
+	}
+	p := priorityOf(ctx)
+	start := time.Now()
+	q.mu.Lock()
+	// Slots are only free while no fetch waits
+	if q.free > 0 {
+		q.free--
+		q.mu.Unlock()
+		q.observeWait(ctx, start)
+		return q.release, nil
+	}
+	ready := make(chan struct{})
+	q.waiting[p] = append(q.waiting[p], ready)
+	q.metrics.UpstreamQueueDepth.WithLabelValues(p.String()).Inc()
+	q.mu.Unlock()
+
+	select {
+	case <-ready:
+		q.observeWait(ctx, start)
+		return q.release, nil
+	case <-ctx.Done():
+	}
+	q.mu.Lock()
+	for i, c := range q.waiting[p] {
+		if c == ready {
+			q.waiting[p] = append(q.waiting[p][:i], q.waiting[p][i+1:]...)
+			q.metrics.UpstreamQueueDepth.WithLabelValues(p.String()).Dec()
+			q.mu.Unlock()
+			return nil, context.Cause(ctx)
+		}
+	}
+	q.mu.Unlock()
+	// Handed a slot while giving up: pass it on
+	q.release()
+	return nil, context.Cause(ctx)
+}
+
+// observeWait records the wait for a slot that began at start, for ctx too.
+func (q *fetchQueue) observeWait(ctx context.Context, start time.Time) {
+	q.metrics.LockWait.WithLabelValues("upstream-slot").Observe(time.Since(start).Seconds())
+	phasesFrom(ctx).Since(PhaseWait, start)
+}
+
+// release hands the slot of a finished fetch to the next one waiting.
+func (q *fetchQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for p, waiting := range q.waiting {
+		if len(waiting) > 0 {
+			close(waiting[0])
+			q.waiting[p] = waiting[1:]
+			q.metrics.UpstreamQueueDepth.WithLabelValues(Priority(p).String()).Dec()
+			return
+		}
+	}
+	q.free++
+}
@@ -0,0 +1,97 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFetchQueuePriority(t *testing.T) {
+	m := metrics.NewUnregistered()
+	q := newFetchQueue(1, m)
+	depth := func(p Priority) int {
+		return int(testutil.ToFloat64(m.UpstreamQueueDepth.WithLabelValues(p.String())))
+	}
+	waitDepth := func(p Priority, n int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for depth(p) != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d %s fetches waiting, got %d", n, p, depth(p))
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	release, err := q.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("acquire free slot: %v", err)
+	}
+
+	// Batch fetches queue first, then interactive ones arrive under contention
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	enqueue := func(name string, p Priority) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := q.acquire(WithPriority(context.Background(), p))
+			if err != nil {
+				t.Errorf("acquire %s: %v", name, err)
+				return
+			}
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			release()
+		}()
+	}
+	enqueue("batch-1", PriorityBatch)
+	waitDepth(PriorityBatch, 1)
+	enqueue("batch-2", PriorityBatch)
+	waitDepth(PriorityBatch, 2)
+	enqueue("interactive-1", PriorityInteractive)
+	waitDepth(PriorityInteractive, 1)
+	enqueue("interactive-2", PriorityInteractive)
+	waitDepth(PriorityInteractive, 2)
+
+	// A fetch giving up leaves the queue
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := q.acquire(ctx)
+		done <- err
+	}()
+	waitDepth(PriorityInteractive, 3)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancelled wait to fail, got %v", err)
+	}
+	waitDepth(PriorityInteractive, 2)
+
+	release()
+	wg.Wait()
+	want := []string{"interactive-1", "interactive-2", "batch-1", "batch-2"}
+	if len(order) != len(want) {
+		t.Fatalf("expected %v, got %v", want, order)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("expected fetches to start in order %v, got %v", want, order)
+		}
+	}
+	if depth(PriorityInteractive) != 0 || depth(PriorityBatch) != 0 {
+		t.Fatalf("expected empty queue, got %d interactive and %d batch", depth(PriorityInteractive), depth(PriorityBatch))
+	}
+	// Every slot came back
+	if release, err = q.acquire(context.Background()); err != nil {
+		t.Fatalf("acquire after queue drained: %v", err)
+	}
+	release()
+}
@@ -0,0 +1,160 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+)
+
+// ErrQuotaExceeded is returned for upstream fetches refused because their
+// host used up its UpstreamQuotas for the current window.
+var ErrQuotaExceeded = errors.New("upstream quota exceeded")
+
+// QuotaError is the ErrQuotaExceeded returned for a host.
+type QuotaError struct {
+	Host  string
+	Reset time.Time // When the host's quota window resets
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s for %s until %s", ErrQuotaExceeded, e.Host, e.Reset.UTC().Format(time.RFC3339))
+}
+
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// quotas tracks what is fetched from hosts with an upstream quota, over
+// fixed windows aligned on the Unix epoch. Fetched bytes are measured as the
+// objects they add to mirrors, which git keeps as received, or as relayed
+// for passed-through requests; ref listings aren't counted.
+type quotas struct {
+	limits  config.Quotas
+	window  time.Duration
+	metrics *metrics.Metrics
+	now     func() time.Time // Overridable in tests
+
+	mu    sync.Mutex
+	usage map[string]*quotaUsage
+}
+
+type quotaUsage struct {
+	start          time.Time // Of the window counted
+	bytes, fetches int64
+}
+
+func newQuotas(limits config.Quotas, window time.Duration, m *metrics.Metrics) *quotas {
+	q := &quotas{limits: limits, window: window, metrics: m, now: time.Now, usage: map[string]*quotaUsage{}}
+	m.UpstreamQuota.Report(q.state)
+	return q
+}
+
+// limited reports whether host has a byte quota, so fetches from it need
+// measuring. A nil quotas limits nothing.
+func (q *quotas) limited(host string) bool {
+	if q == nil {
+		return false
+	}
+	return q.limits[host].Bytes > 0
+}
+
+// acquire counts a fetch from host, or returns a *QuotaError if its quota is
+// used up.
+func (q *quotas) acquire(host string) error {
+	if q == nil {
+		return nil
+	}
+	limit, ok := q.limits[host]
+	if !ok {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.current(host)
+	if (limit.Bytes > 0 && u.bytes >= limit.Bytes) || (limit.Fetches > 0 && u.fetches >= limit.Fetches) {
+		q.metrics.QuotaBlocked.WithLabelValues(host).Inc()
+		return &QuotaError{Host: host, Reset: u.start.Add(q.window)}
+	}
+	u.fetches++
+	return nil
+}
+
+// charge counts n bytes fetched from host.
+func (q *quotas) charge(host string, n int64) {
+	if q == nil || n <= 0 {
+		return
+	}
+	if _, ok := q.limits[host]; !ok {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.current(host).bytes += n
+}
+
+// current returns the usage of host in the current window, starting a new
+// one if the last has passed. Called with mu held.
+func (q *quotas) current(host string) *quotaUsage {
+	start := q.now().Truncate(q.window)
+	u := q.usage[host]
+	if u == nil || !u.start.Equal(start) {
+		u = &quotaUsage{start: start}
+		q.usage[host] = u
+	}
+	return u
+}
+
+// state returns what is left of every host's quota, for metrics.
+func (q *quotas) state() []metrics.QuotaState {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	hosts := make([]string, 0, len(q.limits))
+	for host := range q.limits {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	states := make([]metrics.QuotaState, 0, len(hosts))
+	for _, host := range hosts {
+		limit, u := q.limits[host], q.current(host)
+		s := metrics.QuotaState{Host: host, Bytes: -1, Fetches: -1, Reset: u.start.Add(q.window)}
+		if limit.Bytes > 0 {
+			s.Bytes = max(limit.Bytes-u.bytes, 0)
+		}
+		if limit.Fetches > 0 {
+			s.Fetches = max(limit.Fetches-u.fetches, 0)
+		}
+		states = append(states, s)
+	}
+	return states
+}
+
+// AcquireUpstream counts a request passed through to host against its quota,
+// or returns a *QuotaError if it is used up.
+func (m *Mirror) AcquireUpstream(host string) error {
+	return m.quotas.acquire(host)
+}
+
+// ChargeUpstream counts n bytes passed through from host against its quota.
+func (m *Mirror) ChargeUpstream(host string, n int64) {
+	m.quotas.charge(host, n)
+}
+
+// measureFetch returns a func charging host's quota for the objects fetched
+// into repoPath since it was called.
+func (m *Mirror) measureFetch(host, repoPath string) func() {
+	if !m.quotas.limited(host) {
+		return func() {}
+	}
+	objects := filepath.Join(repoPath, "objects")
+	before, _ := getDirSize(objects)
+	return func() {
+		after, _ := getDirSize(objects)
+		m.quotas.charge(host, after-before)
+	}
+}
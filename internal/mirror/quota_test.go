@@ -0,0 +1,93 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestUpstreamQuota(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	work := filepath.Join(t.TempDir(), "work")
+	upstream := filepath.Join(t.TempDir(), "upstream.git")
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q", "-b", "main", work)
+	git("-C", work, "commit", "-q", "--allow-empty", "-m", "initial")
+	git("clone", "-q", "--bare", work, upstream)
+
+	// Any fetched byte uses the quota up; every access syncs
+	cfg := &config.Config{
+		MirrorDir:           t.TempDir(),
+		SyncStaleAfter:      time.Nanosecond,
+		UpstreamQuotas:      config.Quotas{"local": {Bytes: 1}},
+		UpstreamQuotaWindow: time.Hour,
+	}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	defer m.Close()
+	now := time.Date(2026, 1, 1, 10, 30, 0, 0, time.UTC)
+	m.quotas.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	repoPath, _, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, "")
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	m.Wait()
+	state := m.quotas.state()
+	if len(state) != 1 || state[0].Bytes != 0 || state[0].Fetches != -1 || !state[0].Reset.Equal(now.Truncate(time.Hour).Add(time.Hour)) {
+		t.Fatalf("expected the clone to use the quota up until 11:00, got %+v", state)
+	}
+
+	// Existing mirrors are served as they are, new ones refused
+	git("-C", work, "commit", "-q", "--allow-empty", "-m", "second")
+	git("-C", work, "push", "-q", upstream, "main")
+	if _, status, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, ""); err != nil || status != StatusStale {
+		t.Fatalf("expected mirror served as is, got %s, %v", status, err)
+	}
+	if got, want := git("-C", repoPath, "rev-parse", "main"), git("-C", upstream, "rev-parse", "main~1"); got != want {
+		t.Fatalf("expected mirror not synced past the quota, at %s", got)
+	}
+	_, _, err = m.EnsureRepo(ctx, "local", "owner", "other", upstream, "")
+	var quotaErr *QuotaError
+	if !errors.As(err, &quotaErr) || !errors.Is(err, ErrQuotaExceeded) || quotaErr.Host != "local" {
+		t.Fatalf("expected new mirror refused for exceeding the quota, got %v", err)
+	}
+	if got := testutil.ToFloat64(m.metrics.QuotaBlocked.WithLabelValues("local")); got != 2 {
+		t.Fatalf("expected 2 blocked fetches, got %v", got)
+	}
+
+	// Once the window resets, mirrors are synced again
+	now = now.Add(time.Hour)
+	if _, status, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, ""); err != nil || status != StatusSync {
+		t.Fatalf("expected mirror synced in the next window, got %s, %v", status, err)
+	}
+	if got, want := git("-C", repoPath, "rev-parse", "main"), git("-C", upstream, "rev-parse", "main"); got != want {
+		t.Fatalf("expected mirror synced to %s, at %s", want, got)
+	}
+}
@@ -0,0 +1,155 @@
+package mirror
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// notRedirectedTTL is how long upstream answering that it doesn't
+	// redirect a repo is trusted, so requests for repos that aren't mirrored,
+	// like those served straight from upstream, don't each ask again.
+	notRedirectedTTL = 5 * time.Minute
+	// maxRedirectChecks bounds the answers kept for notRedirectedTTL.
+	maxRedirectChecks = 10000
+)
+
+// Canonical returns the owner and repo under which host/owner/repo is
+// mirrored. Upstreams redirect renamed or transferred repos to their new
+// name; rather than keying a mirror under a name upstream no longer uses,
+// and mirroring the repo twice once clients switch, the redirect is followed
+// and the old name is remembered as an alias of the new one. Only names not
+// mirrored yet are checked, with one request upstream per credentials, and
+// only when FollowUpstreamRedirects is set. Upstream not redirecting a name
+// is remembered for notRedirectedTTL.
+func (m *Mirror) Canonical(ctx context.Context, host, owner, repo, authHeader string) (string, string) {
+	key := host + "/" + owner + "/" + repo
+	if v, ok := m.aliases.Load(key); ok {
+		owner, repo, _ := strings.Cut(v.(string), "/")
+		return owner, repo
+	}
+	if !m.followRedirects {
+		return owner, repo
+	}
+	if _, err := os.Stat(m.repoPath(key)); err == nil {
+		return owner, repo
+	}
+	// Rewritten names don't map back from the URL they are redirected to
+	upstreamURL, err := m.UpstreamURL(host, owner, repo)
+	if err != nil || upstreamURL != "https://"+key+".git" {
+		return owner, repo
+	}
+
+	// What upstream redirects to may depend on what the credentials can see
+	sum := sha256.Sum256([]byte(authHeader))
+	checkKey := key + "@" + hex.EncodeToString(sum[:8])
+	if m.notRedirected.has(checkKey) {
+		return owner, repo
+	}
+	v, err, _ := m.do(ctx, "redirect:"+checkKey, func(ctx context.Context) (interface{}, error) {
+		return m.redirectedTo(ctx, upstreamURL, authHeader)
+	})
+	if err != nil {
+		m.log.Debug("upstream redirect check failed", "repo", key, "err", err)
+		return owner, repo
+	}
+	target, _ := v.(string)
+	if target == "" || target == owner+"/"+repo {
+		m.notRedirected.add(checkKey, time.Now().Add(notRedirectedTTL))
+		return owner, repo
+	}
+	m.log.Info("upstream redirects repo, mirroring it under its new name", "repo", key, "canonical", host+"/"+target)
+	m.aliases.Store(key, target)
+	owner, repo, _ = strings.Cut(target, "/")
+	return owner, repo
+}
+
+// redirectedTo returns the owner/repo that upstream redirects upstreamURL's
+// ref advertisement to on the same host, or "" if it isn't redirected.
+func (m *Mirror) redirectedTo(ctx context.Context, upstreamURL, authHeader string) (string, error) {
+	ctx, cancel := m.upstreamContext(ctx, opInfo)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstreamURL+"/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		return "", err
+	}
+	// Protocol v2 advertises capabilities only, keeping unredirected answers small
+	req.Header.Set("Git-Protocol", "version=2")
+	if authHeader != "" {
+		req.Header.Set("Authorization", authHeader)
+	}
+	client := *m.upstreamHTTP
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return "", nil
+	}
+
+	loc, err := resp.Location()
+	if err != nil {
+		return "", fmt.Errorf("redirect without location: %w", err)
+	}
+	if loc.Host != req.URL.Host {
+		return "", fmt.Errorf("redirected to another host: %s", loc.Host)
+	}
+	p, ok := strings.CutSuffix(loc.Path, "/info/refs")
+	if !ok {
+		return "", fmt.Errorf("redirected outside a repo: %s", loc.Path)
+	}
+	target := strings.TrimSuffix(strings.TrimPrefix(p, "/"), ".git")
+	segs := strings.Split(target, "/")
+	if len(segs) != 2 || slices.ContainsFunc(segs, func(s string) bool { return s == "" || s == "." || s == ".." }) {
+		return "", fmt.Errorf("redirected to unexpected path: %s", loc.Path)
+	}
+	return target, nil
+}
+
+// redirectChecks remembers, until they expire, the repos and credentials
+// upstream answered it doesn't redirect. Expired entries are dropped as new
+// ones are added, and none are added past maxRedirectChecks.
+type redirectChecks struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+}
+
+func (c *redirectChecks) has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().Before(c.expires[key])
+}
+
+func (c *redirectChecks) add(key string, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.expires == nil {
+		c.expires = make(map[string]time.Time)
+	}
+	if len(c.expires) >= maxRedirectChecks {
+		now := time.Now()
+		for k, exp := range c.expires {
+			if !now.Before(exp) {
+				delete(c.expires, k)
+			}
+		}
+		if len(c.expires) >= maxRedirectChecks {
+			return
+		}
+	}
+	c.expires[key] = expires
+}
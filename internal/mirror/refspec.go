@@ -0,0 +1,65 @@
+package mirror
+
+import (
+	"context"
+	"strings"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/gitcmd"
+)
+
+// MirroredRefs returns the refs the mirror of host/owner/repo is restricted
+// to, or nil if it mirrors all of them. Mirrors keep the refs they were
+// cloned with, so this only applies to mirrors cloned since it was set.
+func (m *Mirror) MirroredRefs(host, owner, repo string) config.MirrorRefs {
+	return m.refspecs.For(host + "/" + owner + "/" + repo)
+}
+
+// initRestricted creates an empty bare mirror at dir fetching only refs from
+// upstreamURL, for cloneRepo to fetch into. git clone --mirror can't restrict
+// its refspec.
+func (m *Mirror) initRestricted(ctx context.Context, dir, upstreamURL string, refs config.MirrorRefs) error {
+	cmds := [][]string{
+		append(m.sharedRepoArgs(), "init", "-q", "--bare", dir),
+		{"-C", dir, "config", "remote.origin.url", upstreamURL},
+		{"-C", dir, "config", "remote.origin.mirror", "true"},
+	}
+	for _, spec := range refs.Refspecs() {
+		cmds = append(cmds, []string{"-C", dir, "config", "--add", "remote.origin.fetch", spec})
+	}
+	for _, args := range cmds {
+		cmd := gitcmd.Command(ctx, args...)
+		cmd.Env = gitEnv("", "")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return gitError("git "+strings.Join(args, " "), err, output)
+		}
+	}
+	return nil
+}
+
+// HasObjects reports whether the mirror at repoPath has all the objects oids.
+func (m *Mirror) HasObjects(ctx context.Context, repoPath string, oids []string) bool {
+	return len(m.missingObjects(ctx, repoPath, oids)) == 0
+}
+
+// missingObjects returns which of oids the mirror at repoPath lacks, all of
+// them if it can't be read.
+func (m *Mirror) missingObjects(ctx context.Context, repoPath string, oids []string) []string {
+	if len(oids) == 0 {
+		return nil
+	}
+	cmd := gitcmd.Command(ctx, "-C", repoPath, "cat-file", "--batch-check")
+	cmd.Env = gitEnv("", "")
+	cmd.Stdin = strings.NewReader(strings.Join(oids, "\n") + "\n")
+	out, err := cmd.Output()
+	if err != nil {
+		return oids
+	}
+	var missing []string
+	for line := range strings.Lines(string(out)) {
+		if oid, ok := strings.CutSuffix(line, " missing\n"); ok {
+			missing = append(missing, oid)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,92 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+)
+
+func TestRestrictedMirror(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	work := filepath.Join(t.TempDir(), "work")
+	upstream := filepath.Join(t.TempDir(), "upstream.git")
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q", "-b", "trunk", work)
+	git("-C", work, "commit", "-q", "--allow-empty", "-m", "first")
+	git("-C", work, "tag", "v1")
+	git("-C", work, "checkout", "-q", "-b", "feature")
+	git("-C", work, "commit", "-q", "--allow-empty", "-m", "feature")
+	pull := git("-C", work, "rev-parse", "HEAD")
+	git("init", "-q", "--bare", "-b", "trunk", upstream)
+	git("-C", work, "push", "-q", upstream, "trunk", "feature", "v1", "feature:refs/pull/1/head")
+
+	cfg := &config.Config{
+		MirrorDir: t.TempDir(),
+		MirrorRefspecs: config.MirrorRefspecs{{
+			Pattern: regexp.MustCompile(`^local/owner/.+$`),
+			Refs:    config.MirrorRefs{"refs/heads/trunk", "refs/tags/*"},
+		}},
+	}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(m.Wait)
+	ctx := context.Background()
+	repoPath, _, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, "")
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+
+	if got := git("-C", repoPath, "for-each-ref", "--format=%(refname)"); got != "refs/heads/trunk\nrefs/tags/v1" {
+		t.Fatalf("expected only the trunk branch and tags to be mirrored, got:\n%s", got)
+	}
+	if got := git("-C", repoPath, "symbolic-ref", "HEAD"); got != "refs/heads/trunk" {
+		t.Fatalf("expected HEAD to follow upstream, got %s", got)
+	}
+	if m.HasObjects(ctx, repoPath, []string{pull}) {
+		t.Fatalf("expected commits only reachable from left out refs not to be mirrored")
+	}
+
+	// Syncs keep to the same refs
+	git("-C", work, "checkout", "-q", "trunk")
+	git("-C", work, "commit", "-q", "--allow-empty", "-m", "second")
+	git("-C", work, "tag", "v2")
+	git("-C", work, "push", "-q", upstream, "trunk", "v2", "trunk:refs/pull/2/head")
+	head := git("-C", work, "rev-parse", "HEAD")
+	if err := m.syncRepo(ctx, "local/owner/repo", repoPath, upstream, "", ""); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if got := git("-C", repoPath, "for-each-ref", "--format=%(refname)"); got != "refs/heads/trunk\nrefs/tags/v1\nrefs/tags/v2" {
+		t.Fatalf("expected only the trunk branch and tags to be synced, got:\n%s", got)
+	}
+	if !m.HasObjects(ctx, repoPath, []string{head}) {
+		t.Fatalf("expected trunk to be synced to %s", head)
+	}
+
+	// Other repos are mirrored in full
+	if m.MirroredRefs("local", "other", "repo") != nil {
+		t.Fatalf("expected repos not matching any rule to mirror all refs")
+	}
+}
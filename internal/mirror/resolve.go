@@ -0,0 +1,137 @@
+package mirror
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// upstreamResolver pins upstream hosts to addresses via git's http.curloptResolve,
+// so connections go to the chosen IP while TLS SNI and certificate validation
+// still use the real hostname.
+type upstreamResolver struct {
+	overrides     map[string]string // host -> IP, takes precedence over dns
+	dns           *net.Resolver     // custom DNS server, nil leaves resolution to git
+	family        string            // ipv4 or ipv6 to only connect over that family, empty for both
+	fallbackDelay time.Duration     // net.Dialer.FallbackDelay of connections the proxy opens itself
+}
+
+func newUpstreamResolver(overrides map[string]string, resolverAddr string) *upstreamResolver {
+	u := &upstreamResolver{overrides: overrides}
+	if resolverAddr != "" {
+		u.dns = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, resolverAddr)
+			},
+		}
+	}
+	return u
+}
+
+// curlResolve returns the http.curloptResolve entry ("host:port:addr[,addr]") for
+// upstreamURL, or "" if the host should be resolved normally.
+func (u *upstreamResolver) curlResolve(ctx context.Context, upstreamURL string) (string, error) {
+	parsed, err := url.Parse(upstreamURL)
+	if err != nil {
+		return "", fmt.Errorf("parse upstream url: %w", err)
+	}
+	host, port := parsed.Hostname(), parsed.Port()
+	if port == "" {
+		port = "443"
+		if parsed.Scheme == "http" {
+			port = "80"
+		}
+	}
+
+	addrs, err := u.lookup(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return "", err
+	}
+	for i, a := range addrs {
+		if strings.Contains(a, ":") {
+			addrs[i] = "[" + a + "]" // IPv6 addresses must be bracketed
+		}
+	}
+	return fmt.Sprintf("%s:%s:%s", host, port, strings.Join(addrs, ",")), nil
+}
+
+// lookup returns the addresses to connect to host at, or nil if the host
+// should be resolved normally. Git has no setting for the IP family, so hosts
+// are resolved here, to addresses of that family, when one is forced.
+func (u *upstreamResolver) lookup(ctx context.Context, host string) ([]string, error) {
+	if ip, ok := u.overrides[host]; ok {
+		return []string{ip}, nil
+	}
+	resolver := u.dns
+	if resolver == nil {
+		if u.family == "" {
+			return nil, nil
+		}
+		resolver = net.DefaultResolver
+	}
+	ips, err := resolver.LookupIP(ctx, u.network("ip"), host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", host, err)
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, ip.String())
+	}
+	return addrs, nil
+}
+
+// network narrows network ("tcp" or "ip") to the forced IP family, if any.
+func (u *upstreamResolver) network(network string) string {
+	switch u.family {
+	case "ipv4":
+		return network + "4"
+	case "ipv6":
+		return network + "6"
+	}
+	return network
+}
+
+// dialContext connects to addr like git does with curlResolve: overridden
+// hosts go to their configured address and others through the custom DNS
+// server, if any, over the forced IP family, if any.
+func (u *upstreamResolver) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{Resolver: u.dns, FallbackDelay: u.fallbackDelay}
+	if ip, ok := u.overrides[host]; ok {
+		addr = net.JoinHostPort(ip, port)
+	}
+	return d.DialContext(ctx, u.network(network), addr)
+}
+
+// httpClient returns a client for requests the proxy sends upstream itself.
+// It resolves hosts like git commands do and honors git's TLS environment
+// (GIT_SSL_NO_VERIFY, GIT_SSL_CAINFO), so it trusts the same servers.
+func (u *upstreamResolver) httpClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: os.Getenv("GIT_SSL_NO_VERIFY") != ""}
+	if caFile := os.Getenv("GIT_SSL_CAINFO"); caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read GIT_SSL_CAINFO: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in GIT_SSL_CAINFO %s", caFile)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = u.dialContext
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,200 @@
+package mirror
+
+import (
+	"cmp"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+)
+
+func TestCurlResolve(t *testing.T) {
+	u := newUpstreamResolver(map[string]string{"github.com": "10.0.0.5", "v6.example.com": "::1"}, "")
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://github.com/owner/repo.git", "github.com:443:10.0.0.5"},
+		{"https://github.com:8443/owner/repo.git", "github.com:8443:10.0.0.5"},
+		{"https://v6.example.com/owner/repo.git", "v6.example.com:443:[::1]"},
+		{"https://gitlab.com/owner/repo.git", ""},
+	}
+	for _, tt := range tests {
+		got, err := u.curlResolve(context.Background(), tt.url)
+		if err != nil {
+			t.Fatalf("curlResolve(%s): %v", tt.url, err)
+		}
+		if got != tt.want {
+			t.Errorf("curlResolve(%s) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestUpstreamIPFamily(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	tests := []struct {
+		family  string
+		network string
+		dials   bool // to the IPv4 listener
+	}{
+		{"", "tcp", true},
+		{"ipv4", "tcp4", true},
+		{"ipv6", "tcp6", false},
+	}
+	for _, tt := range tests {
+		t.Run(cmp.Or(tt.family, "both"), func(t *testing.T) {
+			u := newUpstreamResolver(nil, "")
+			u.family = tt.family
+			if got := u.network("tcp"); got != tt.network {
+				t.Fatalf("expected dialer network %s, got %s", tt.network, got)
+			}
+			conn, err := u.dialContext(context.Background(), "tcp", ln.Addr().String())
+			if err == nil {
+				conn.Close()
+			}
+			if dialed := err == nil; dialed != tt.dials {
+				t.Fatalf("expected dial to %s to succeed: %v, got err %v", ln.Addr(), tt.dials, err)
+			}
+		})
+	}
+
+	// Git is pinned to addresses of the forced family, even without a custom
+	// DNS server
+	u := newUpstreamResolver(nil, "")
+	u.family = "ipv4"
+	addrs, err := u.lookup(context.Background(), "127.0.0.1")
+	if err != nil || len(addrs) != 1 || addrs[0] != "127.0.0.1" {
+		t.Fatalf("expected lookup to 127.0.0.1, got %v (%v)", addrs, err)
+	}
+	u.family = "ipv6"
+	if addrs, err := u.lookup(context.Background(), "127.0.0.1"); err == nil {
+		t.Fatalf("expected no IPv6 address for 127.0.0.1, got %v", addrs)
+	}
+}
+
+func TestHostOverrideRoutesToTestServer(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	// Trust a certificate issued for the overridden name only, so the clone
+	// fails unless TLS validates against the real hostname
+	const host = "git.example.invalid"
+	cert, caFile := newHostCert(t, host)
+	t.Setenv("GIT_SSL_CAINFO", caFile)
+
+	// Bare repo served as static files (dumb HTTP) by a local TLS server
+	root := t.TempDir()
+	work := filepath.Join(t.TempDir(), "work")
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main", work},
+		{"-C", work, "commit", "-q", "--allow-empty", "-m", "initial"},
+		{"clone", "-q", "--bare", work, filepath.Join(root, "owner", "repo.git")},
+		{"-C", filepath.Join(root, "owner", "repo.git"), "update-server-info"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	var hits atomic.Int32
+	fileServer := http.FileServer(http.Dir(root))
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		fileServer.ServeHTTP(w, r)
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.StartTLS()
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+
+	cfg := &config.Config{
+		MirrorDir:             t.TempDir(),
+		SyncStaleAfter:        time.Minute,
+		UpstreamHostOverrides: map[string]string{host: "127.0.0.1"},
+	}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(m.Wait)
+
+	// The .invalid TLD never resolves, so a successful clone must have used the override
+	upstreamURL := "https://" + host + ":" + srvURL.Port() + "/owner/repo.git"
+	_, status, err := m.EnsureRepo(context.Background(), host, "owner", "repo", upstreamURL, "")
+	if err != nil {
+		t.Fatalf("ensure repo: %v", err)
+	}
+	if status != StatusClone {
+		t.Fatalf("expected clone, got %s", status)
+	}
+	if hits.Load() == 0 {
+		t.Fatalf("expected requests to land on the test server")
+	}
+}
+
+// newHostCert returns a self-signed certificate for host, and the path of a
+// PEM file holding it for use as a CA bundle.
+func newHostCert(t *testing.T, host string) (tls.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatalf("write ca: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, caFile
+}
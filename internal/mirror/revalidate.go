@@ -0,0 +1,50 @@
+package mirror
+
+import (
+	"context"
+	"time"
+)
+
+// revalidating reports whether the stale mirror of key at repoPath may be
+// served as is while synced in the background: it went stale less than
+// StaleWhileRevalidate ago, and is open to all clients. Mirrors cloned with
+// credentials are synced first, as that is what checks the client's.
+func (m *Mirror) revalidating(key, repoPath string) bool {
+	s := m.settings.Load()
+	if s.revalidateFor <= 0 || m.requiresAuth(repoPath) {
+		return false
+	}
+	refreshed := m.refreshedAt(key, repoPath)
+	if refreshed.IsZero() {
+		return false
+	}
+	age := time.Since(refreshed)
+	return age > s.staleAfter && age <= s.staleAfter+s.revalidateFor
+}
+
+// serveRevalidating completes EnsureRepo for a mirror served while a sync of
+// it runs in the background, joining any sync already running.
+func (m *Mirror) serveRevalidating(ctx context.Context, key, repoPath, upstreamURL, authHeader string, start time.Time) (string, Status, error) {
+	bgCtx := context.WithoutCancel(ctx)
+	m.bg.Go(func() {
+		syncStart := time.Now()
+		current, err, _ := m.do(bgCtx, "sync:"+key, func(ctx context.Context) (interface{}, error) {
+			skipped, err := m.syncUnlessCurrent(ctx, key, repoPath, upstreamURL, authHeader)
+			if err == nil && !skipped {
+				m.markSynced(key)
+			}
+			return skipped, err
+		})
+		if err != nil {
+			m.log.Warn("background sync failed", "repo", key, "err", err, "duration_ms", time.Since(syncStart).Milliseconds())
+			return
+		}
+		m.log.Debug("background sync complete", "repo", key, "duration_ms", time.Since(syncStart).Milliseconds())
+		if skipped, _ := current.(bool); !skipped && m.maintainAfterSync {
+			m.optimizeRepo(context.Background(), repoPath, false)
+		}
+	})
+	m.metrics.Revalidations.WithLabelValues(key).Inc()
+	m.log.Debug("ensure repo complete (revalidate)", "repo", key, "total_duration_ms", time.Since(start).Milliseconds())
+	return repoPath, StatusRevalidate, nil
+}
@@ -0,0 +1,129 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// blockedFetchGit puts a git wrapper first in PATH that holds fetches until
+// the returned file exists.
+func blockedFetchGit(t *testing.T) string {
+	t.Helper()
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found in PATH")
+	}
+	dir := t.TempDir()
+	release := filepath.Join(dir, "release")
+	script := `#!/bin/sh
+case "$*" in
+*"fetch --all"*)
+	while [ ! -e "` + release + `" ]; do sleep 0.01; done
+	;;
+esac
+exec "` + realGit + `" "$@"
+`
+	if err := os.WriteFile(filepath.Join(dir, "git"), []byte(script), 0o755); err != nil {
+		t.Fatalf("write git wrapper: %v", err)
+	}
+	t.Setenv("PATH", dir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+	return release
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	work := filepath.Join(t.TempDir(), "work")
+	upstream := filepath.Join(t.TempDir(), "upstream.git")
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	commit := func(msg string) string {
+		git("-C", work, "commit", "-q", "--allow-empty", "-m", msg)
+		git("-C", work, "push", "-q", upstream, "main")
+		return git("-C", work, "rev-parse", "HEAD")
+	}
+	git("init", "-q", "-b", "main", work)
+	git("init", "-q", "--bare", upstream)
+	first := commit("first")
+
+	const staleAfter = time.Minute
+	cfg := &config.Config{MirrorDir: t.TempDir(), SyncStaleAfter: staleAfter, StaleWhileRevalidate: time.Hour}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(m.Wait)
+	ctx := context.Background()
+	const key = "local/owner/repo"
+	repoPath, _, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, "")
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	m.Wait()
+	second := commit("second")
+	release := blockedFetchGit(t)
+
+	// Just stale, the mirror is served as is while the sync is held
+	m.lastSync.Store(key, time.Now().Add(-2*staleAfter))
+	done := make(chan Status, 1)
+	go func() {
+		_, status, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, "")
+		if err != nil {
+			t.Errorf("ensure: %v", err)
+		}
+		done <- status
+	}()
+	select {
+	case status := <-done:
+		if status != StatusRevalidate {
+			t.Fatalf("expected %s, got %s", StatusRevalidate, status)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the request not to wait for the sync")
+	}
+	if got := git("-C", repoPath, "rev-parse", "main"); got != first {
+		t.Fatalf("expected mirror still at %s while syncing, got %s", first, got)
+	}
+	if got := testutil.ToFloat64(m.metrics.Revalidations.WithLabelValues(key)); got != 1 {
+		t.Fatalf("expected 1 stale-while-revalidate serve counted, got %v", got)
+	}
+
+	// The sync completes in the background
+	if err := os.WriteFile(release, nil, 0o644); err != nil {
+		t.Fatalf("release fetch: %v", err)
+	}
+	m.Wait()
+	if got := git("-C", repoPath, "rev-parse", "main"); got != second {
+		t.Fatalf("expected mirror at %s after the background sync, got %s", second, got)
+	}
+	if m.isStale(key) {
+		t.Fatalf("expected mirror to be fresh after the background sync")
+	}
+
+	// Past the window, requests wait for the sync again
+	m.lastSync.Store(key, time.Now().Add(-2*time.Hour))
+	if _, status, err := m.EnsureRepo(ctx, "local", "owner", "repo", upstream, ""); err != nil || status != StatusSync {
+		t.Fatalf("expected sync past the window, got %s (%v)", status, err)
+	}
+}
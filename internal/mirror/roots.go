@@ -0,0 +1,42 @@
+package mirror
+
+import (
+	"hash/fnv"
+	"os"
+	"path/filepath"
+)
+
+// cacheFor returns the cache of the mirror root holding key (host/owner/repo).
+// Existing mirrors stay in the root they were cloned into, so adding a root
+// doesn't orphan them; new ones go to a root picked by hashing key.
+func (m *Mirror) cacheFor(key string) *Cache {
+	if len(m.caches) == 1 {
+		return m.caches[0]
+	}
+	for _, c := range m.caches {
+		if _, err := os.Stat(filepath.Join(c.root, key+".git")); err == nil {
+			return c
+		}
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return m.caches[h.Sum32()%uint32(len(m.caches))]
+}
+
+// repoPath returns the filesystem path for the mirror of key.
+func (m *Mirror) repoPath(key string) string {
+	return filepath.Join(m.cacheFor(key).root, key+".git")
+}
+
+// listRepos returns the repos of every mirror root.
+func (m *Mirror) listRepos() ([]repoInfo, error) {
+	var all []repoInfo
+	for _, c := range m.caches {
+		repos, err := c.listReposWithAccessTime()
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, repos...)
+	}
+	return all, nil
+}
@@ -0,0 +1,99 @@
+package mirror
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+)
+
+func newTwoRootMirror(t *testing.T) *Mirror {
+	t.Helper()
+	cfg := &config.Config{
+		MirrorDir:       t.TempDir(),
+		MirrorExtraDirs: []string{t.TempDir()},
+		MirrorMaxSize:   config.SizeSpec{Percent: 50},
+		MinFreeSpace:    config.SizeSpec{Bytes: 1},
+	}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("new mirror: %v", err)
+	}
+	return m
+}
+
+func TestMirrorRootsDistribution(t *testing.T) {
+	m := newTwoRootMirror(t)
+	a, b := m.caches[0].root, m.caches[1].root
+
+	counts := map[string]int{}
+	for i := range 100 {
+		key := fmt.Sprintf("github.com/owner/repo%d", i)
+		path := m.repoPath(key)
+		if path != m.repoPath(key) {
+			t.Fatalf("expected a stable root for %s", key)
+		}
+		counts[filepath.Dir(filepath.Dir(filepath.Dir(path)))]++
+	}
+	if counts[a] < 25 || counts[b] < 25 {
+		t.Fatalf("expected repos spread across both roots, got %v", counts)
+	}
+
+	// Mirrors stay in the root they already exist in
+	key := "github.com/owner/repo0"
+	other := a
+	if strings.HasPrefix(m.repoPath(key), a) {
+		other = b
+	}
+	if err := os.MkdirAll(filepath.Join(other, key+".git"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if got := m.RepoPath("github.com", "owner", "repo0"); got != filepath.Join(other, key+".git") {
+		t.Fatalf("expected existing mirror in %s to be used, got %s", other, got)
+	}
+}
+
+func TestMirrorRootsEvictIndependently(t *testing.T) {
+	m := newTwoRootMirror(t)
+	var changed []string
+	m.OnChange(func(repoPath string) { changed = append(changed, repoPath) })
+
+	// Both roots hold 80KiB of repos; only the first one's volume is too small for that
+	base := time.Now().Add(-time.Hour)
+	for i, c := range m.caches {
+		for j, name := range []string{"oldest", "newest"} {
+			key := fmt.Sprintf("github.com/root%d/%s", i, name)
+			path := filepath.Join(c.root, key+".git")
+			if err := os.MkdirAll(path, 0o755); err != nil {
+				t.Fatalf("mkdir: %v", err)
+			}
+			if err := os.WriteFile(filepath.Join(path, "HEAD"), make([]byte, 40<<10), 0o644); err != nil {
+				t.Fatalf("write HEAD: %v", err)
+			}
+			c.accessTime.Store(key, base.Add(time.Duration(j)*time.Minute))
+		}
+	}
+	m.caches[0].diskStats = func() (int64, int64, error) { return 100 << 10, 20 << 10, nil }
+	m.caches[1].diskStats = func() (int64, int64, error) { return 1 << 20, 900 << 10, nil }
+
+	for _, c := range m.caches {
+		c.MaybeEvict()
+	}
+
+	if repoExists(m.caches[0], "github.com/root0/oldest") || !repoExists(m.caches[0], "github.com/root0/newest") {
+		t.Fatalf("expected the least recently used repo of the full root to be evicted")
+	}
+	if !repoExists(m.caches[1], "github.com/root1/oldest") || !repoExists(m.caches[1], "github.com/root1/newest") {
+		t.Fatalf("expected the other root to be left alone")
+	}
+	if len(changed) != 1 || changed[0] != filepath.Join(m.caches[0].root, "github.com/root0/oldest.git") {
+		t.Fatalf("expected the evicted mirror's path to be reported, got %v", changed)
+	}
+}
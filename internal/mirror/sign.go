@@ -0,0 +1,68 @@
+package mirror
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+)
+
+// requestSigner attaches a signature to requests sent upstream, for upstreams
+// that authenticate requests by signature rather than by token.
+type requestSigner interface {
+	Sign(req *http.Request) error
+}
+
+// newRequestSigner returns the signer AuthMode selects, nil for none.
+func newRequestSigner(cfg *config.Config) requestSigner {
+	switch cfg.AuthMode {
+	case "hmac":
+		return &hmacSigner{key: []byte(cfg.SigningKey), header: cfg.SignatureHeader, now: time.Now}
+	}
+	return nil
+}
+
+// hmacSigner sets the Date header of requests to the current time, and their
+// header to the hex HMAC-SHA256, with key, of their path and that date
+// separated by a newline.
+type hmacSigner struct {
+	key    []byte
+	header string
+	now    func() time.Time
+}
+
+func (s *hmacSigner) Sign(req *http.Request) error {
+	date := s.now().UTC().Format(http.TimeFormat)
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(req.URL.EscapedPath() + "\n" + date))
+	req.Header.Set("Date", date)
+	req.Header.Set(s.header, hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// signingTransport signs every request it sends with the signer in effect,
+// if any. Requests sent again, as retries or to follow redirects, go through
+// it again and are signed afresh.
+type signingTransport struct {
+	base   http.RoundTripper
+	signer func() requestSigner
+}
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	signer := t.signer()
+	if signer == nil {
+		return t.base.RoundTrip(req)
+	}
+	// RoundTrippers must leave the request they are given as it is
+	req = req.Clone(req.Context())
+	if err := signer.Sign(req); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
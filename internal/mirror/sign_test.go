@@ -0,0 +1,90 @@
+package mirror
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+)
+
+func TestRequestSigning(t *testing.T) {
+	type signed struct{ path, date, sig string }
+	var got []signed
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, signed{r.URL.Path, r.Header.Get("Date"), r.Header.Get("X-Sig")})
+		if r.URL.Path == "/old/repo.git/info/refs" {
+			http.Redirect(w, r, "/new/repo.git/info/refs", http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := &config.Config{MirrorDir: t.TempDir(), AuthMode: "hmac", SigningKey: "secret", SignatureHeader: "X-Sig"}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(m.Wait)
+	// Every request is signed a second later than the one before
+	clock := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	m.settings.Load().signer.(*hmacSigner).now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+	want := func(path string, at time.Time) signed {
+		date := at.Format(http.TimeFormat)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(path + "\n" + date))
+		return signed{path, date, hex.EncodeToString(mac.Sum(nil))}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/old/repo.git/info/refs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		resp, err := m.UpstreamClient().Do(req)
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		resp.Body.Close()
+	}
+	// Redirects and retries of the same request are signed afresh
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	expected := []signed{
+		want("/old/repo.git/info/refs", start.Add(time.Second)),
+		want("/new/repo.git/info/refs", start.Add(2*time.Second)),
+		want("/old/repo.git/info/refs", start.Add(3*time.Second)),
+		want("/new/repo.git/info/refs", start.Add(4*time.Second)),
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d requests, got %+v", len(expected), got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("request %d: expected %+v, got %+v", i, expected[i], got[i])
+		}
+	}
+	if req.Header.Get("X-Sig") != "" {
+		t.Fatal("expected the caller's request left unsigned")
+	}
+
+	// Without a signing auth mode, requests go as they are
+	m.Reload(&config.Config{AuthMode: "none"})
+	got = nil
+	resp, err := m.UpstreamClient().Get(srv.URL + "/plain")
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	resp.Body.Close()
+	if len(got) != 1 || got[0].sig != "" {
+		t.Fatalf("expected no signature, got %+v", got)
+	}
+}
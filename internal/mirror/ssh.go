@@ -0,0 +1,85 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+)
+
+// sshUpstream fetches the mirrors of some upstream hosts over SSH instead of
+// HTTPS. Clients are still served smart HTTP from the mirror; only the
+// proxy's own key is used upstream, so client credentials aren't checked
+// against SSH upstreams.
+type sshUpstream struct {
+	hosts      map[string]bool
+	user       string
+	key        string // Private key file, empty lets ssh pick
+	knownHosts string // known_hosts file, empty uses ssh's defaults
+}
+
+func newSSHUpstream(cfg *config.Config) *sshUpstream {
+	s := &sshUpstream{
+		hosts:      map[string]bool{},
+		user:       cfg.UpstreamSSHUser,
+		key:        cfg.UpstreamSSHKey,
+		knownHosts: cfg.UpstreamSSHKnownHosts,
+	}
+	for host, scheme := range cfg.UpstreamSchemes {
+		if scheme == "ssh" {
+			s.hosts[host] = true
+		}
+	}
+	return s
+}
+
+// url returns the SSH URL of target (host/owner/repo), without the .git
+// suffix UpstreamURL adds, or "" if its host is fetched over HTTPS.
+func (s *sshUpstream) url(target string) string {
+	host, _, _ := strings.Cut(target, "/")
+	if !s.hosts[host] {
+		return ""
+	}
+	user := ""
+	if s.user != "" {
+		user = s.user + "@"
+	}
+	return "ssh://" + user + target
+}
+
+// isSSH reports whether upstreamURL is fetched over SSH.
+func isSSH(upstreamURL string) bool {
+	return strings.HasPrefix(upstreamURL, "ssh://")
+}
+
+// sshCommand returns the GIT_SSH_COMMAND for fetching upstreamURL: never
+// prompting, with the configured key and known hosts, and connecting to the
+// overridden or custom-resolved address while checking the real host's key.
+func (m *Mirror) sshCommand(ctx context.Context, upstreamURL string) (string, error) {
+	parsed, err := url.Parse(upstreamURL)
+	if err != nil {
+		return "", fmt.Errorf("parse upstream url: %w", err)
+	}
+	args := []string{"ssh", "-o", "BatchMode=yes"}
+	if m.ssh.key != "" {
+		args = append(args, "-i", shellQuote(m.ssh.key), "-o", "IdentitiesOnly=yes")
+	}
+	if m.ssh.knownHosts != "" {
+		args = append(args, "-o", shellQuote("UserKnownHostsFile="+m.ssh.knownHosts), "-o", "StrictHostKeyChecking=yes")
+	}
+	addrs, err := m.resolver.lookup(ctx, parsed.Hostname())
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) > 0 {
+		args = append(args, "-o", shellQuote("HostName="+addrs[0]), "-o", shellQuote("HostKeyAlias="+parsed.Hostname()))
+	}
+	return strings.Join(args, " "), nil
+}
+
+// shellQuote quotes s for the shell git runs GIT_SSH_COMMAND with.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
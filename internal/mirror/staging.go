@@ -0,0 +1,102 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// rename moves a directory; overridable in tests to simulate cross-device moves.
+var rename = os.Rename
+
+// stage returns the path a new mirror for repoPath should be built at, and a
+// cleanup func removing leftovers. With a temp dir configured, mirrors are
+// built there and moved into place by publish; otherwise they're built in place.
+func (m *Mirror) stage(repoPath string) (string, func(), error) {
+	if m.tempDir == "" {
+		return repoPath, func() {}, nil
+	}
+	dir, err := os.MkdirTemp(m.tempDir, "clone-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("create staging dir: %w", err)
+	}
+	return filepath.Join(dir, filepath.Base(repoPath)), func() { _ = os.RemoveAll(dir) }, nil
+}
+
+// publish moves a mirror built at staged into repoPath. The rename is atomic
+// when both are on the same filesystem; otherwise the repo is copied next to
+// repoPath first and renamed from there, so readers never see a partial mirror.
+func (m *Mirror) publish(staged, repoPath string) error {
+	if staged == repoPath {
+		return nil
+	}
+	if err := mkdirAll(filepath.Dir(repoPath), m.dirMode); err != nil {
+		return fmt.Errorf("create parent dir: %w", err)
+	}
+	err := rename(staged, repoPath)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp(filepath.Dir(repoPath), ".publish-*")
+	if err != nil {
+		return fmt.Errorf("create publish dir: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+	copied := filepath.Join(tmp, filepath.Base(repoPath))
+	if err := copyDir(staged, copied); err != nil {
+		return fmt.Errorf("copy staged mirror: %w", err)
+	}
+	return os.Rename(copied, repoPath)
+}
+
+// copyDir recursively copies the directory tree at src to dst.
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			return copyFile(p, target, info.Mode().Perm())
+		}
+	})
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,93 @@
+package mirror
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestStageAndPublish(t *testing.T) {
+	m := &Mirror{tempDir: t.TempDir()}
+	repoPath := filepath.Join(t.TempDir(), "github.com", "owner", "repo.git")
+
+	staged, cleanup, err := m.stage(repoPath)
+	if err != nil {
+		t.Fatalf("stage: %v", err)
+	}
+	defer cleanup()
+	if filepath.Dir(filepath.Dir(staged)) != m.tempDir {
+		t.Fatalf("expected staging under temp dir, got %s", staged)
+	}
+	if err := os.MkdirAll(filepath.Join(staged, "refs", "heads"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(staged, "HEAD"), []byte("ref: refs/heads/main\n"), 0o644); err != nil {
+		t.Fatalf("write HEAD: %v", err)
+	}
+
+	if err := m.publish(staged, repoPath); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(repoPath, "HEAD")); err != nil {
+		t.Fatalf("expected published mirror: %v", err)
+	}
+	if _, err := os.Stat(staged); !os.IsNotExist(err) {
+		t.Fatalf("expected staged mirror to be moved, got %v", err)
+	}
+}
+
+func TestCopyDir(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "objects", "pack"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "objects", "pack", "pack-1.pack"), []byte("PACK"), 0o444); err != nil {
+		t.Fatalf("write pack: %v", err)
+	}
+	dst := filepath.Join(t.TempDir(), "copy.git")
+	if err := copyDir(src, dst); err != nil {
+		t.Fatalf("copyDir: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dst, "objects", "pack", "pack-1.pack"))
+	if err != nil || string(data) != "PACK" {
+		t.Fatalf("expected copied pack, got %q (%v)", data, err)
+	}
+}
+
+func TestPublishAcrossFilesystems(t *testing.T) {
+	m := &Mirror{tempDir: t.TempDir()}
+	repoPath := filepath.Join(t.TempDir(), "github.com", "owner", "repo.git")
+
+	// Only the direct move from the temp dir crosses devices
+	rename = func(oldpath, newpath string) error {
+		if filepath.Dir(filepath.Dir(oldpath)) == m.tempDir {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+		}
+		return os.Rename(oldpath, newpath)
+	}
+	t.Cleanup(func() { rename = os.Rename })
+
+	staged, cleanup, err := m.stage(repoPath)
+	if err != nil {
+		t.Fatalf("stage: %v", err)
+	}
+	defer cleanup()
+	if err := os.MkdirAll(staged, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(staged, "HEAD"), []byte("ref: refs/heads/main\n"), 0o644); err != nil {
+		t.Fatalf("write HEAD: %v", err)
+	}
+
+	if err := m.publish(staged, repoPath); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(repoPath, "HEAD")); err != nil || string(data) != "ref: refs/heads/main\n" {
+		t.Fatalf("expected copied mirror, got %q (%v)", data, err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(repoPath))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected no publish leftovers next to the mirror, got %v (%v)", entries, err)
+	}
+}
@@ -0,0 +1,98 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/crohr/smart-git-proxy/internal/gitcmd"
+)
+
+// warmSubmodules clones the repos referenced by .gitmodules on the default
+// branch of the new mirror at repoPath, so a following `git clone --recursive`
+// finds them warm. Only allowed upstream hosts are fetched, without
+// credentials; failures are only logged since clients fetch them anyway.
+func (m *Mirror) warmSubmodules(key, repoPath, upstreamURL string) {
+	ctx := WithPriority(context.Background(), PriorityBatch)
+	urls, err := submoduleURLs(ctx, repoPath)
+	if err != nil {
+		m.log.Debug("no submodules to prewarm", "repo", key, "err", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, u := range urls {
+		host, owner, repo, ok := resolveSubmodule(upstreamURL, u)
+		cur := m.settings.Load()
+		host = cur.aliases.Canonical(host)
+		if !ok || !slices.Contains(cur.allowedUpstreams, host) {
+			m.log.Debug("skipping submodule prewarm", "repo", key, "url", u)
+			continue
+		}
+		repo = cur.gitSuffixHosts.RepoName(host, repo)
+		wg.Go(func() {
+			subKey := fmt.Sprintf("%s/%s/%s", host, owner, repo)
+			status, err := m.Warm(ctx, host, owner, repo, "")
+			if err != nil {
+				m.log.Warn("submodule prewarm failed", "repo", key, "submodule", subKey, "err", err)
+				return
+			}
+			m.log.Info("submodule prewarmed", "repo", key, "submodule", subKey, "status", status)
+		})
+	}
+	wg.Wait()
+}
+
+// submoduleURLs returns the submodule URLs listed in .gitmodules on the
+// default branch of the mirror at repoPath.
+func submoduleURLs(ctx context.Context, repoPath string) ([]string, error) {
+	cmd := gitcmd.Command(ctx, "-C", repoPath, "config", "--blob", "HEAD:.gitmodules", "--get-regexp", `^submodule\..*\.url$`)
+	cmd.Env = gitEnv("", "")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("read .gitmodules: %w", err)
+	}
+	var urls []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if _, u, ok := strings.Cut(line, " "); ok {
+			urls = append(urls, strings.TrimSpace(u))
+		}
+	}
+	return urls, nil
+}
+
+// resolveSubmodule maps a submodule URL to the repo it names, leaving any .git
+// suffix for config.GitSuffixHosts to normalize. Relative URLs
+// are resolved against the superproject's upstreamURL like git does, as if it
+// were a directory. ok is false for URLs the proxy doesn't fetch, like SSH ones.
+func resolveSubmodule(upstreamURL, subURL string) (host, owner, repo string, ok bool) {
+	ref, err := url.Parse(subURL)
+	if err != nil {
+		return "", "", "", false
+	}
+	if strings.HasPrefix(subURL, "./") || strings.HasPrefix(subURL, "../") {
+		base, err := url.Parse(strings.TrimSuffix(upstreamURL, "/") + "/")
+		if err != nil {
+			return "", "", "", false
+		}
+		ref = base.ResolveReference(ref)
+	}
+	if ref.Scheme != "https" || ref.Host == "" {
+		return "", "", "", false
+	}
+
+	p := strings.Trim(ref.Path, "/")
+	for _, seg := range strings.Split(p, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return "", "", "", false
+		}
+	}
+	owner, repo, ok = strings.Cut(p, "/")
+	if !ok {
+		return "", "", "", false
+	}
+	return ref.Host, owner, repo, true
+}
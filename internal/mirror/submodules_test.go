@@ -0,0 +1,74 @@
+package mirror
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestResolveSubmodule(t *testing.T) {
+	const upstream = "https://github.com/owner/super.git"
+	tests := []struct {
+		url               string
+		host, owner, repo string
+		ok                bool
+	}{
+		{"https://github.com/other/lib.git", "github.com", "other", "lib.git", true},
+		{"https://gitlab.com/group/sub/lib", "gitlab.com", "group", "sub/lib", true},
+		{"../lib.git", "github.com", "owner", "lib.git", true},
+		{"../../other/lib", "github.com", "other", "lib", true},
+		{"git@github.com:other/lib.git", "", "", "", false},
+		{"ssh://git@github.com/other/lib.git", "", "", "", false},
+		{"http://github.com/other/lib.git", "", "", "", false},
+		{"https://github.com/lib.git", "", "", "", false},
+		{"https://github.com/other/../../etc", "", "", "", false},
+	}
+	for _, tt := range tests {
+		host, owner, repo, ok := resolveSubmodule(upstream, tt.url)
+		if ok != tt.ok || host != tt.host || owner != tt.owner || repo != tt.repo {
+			t.Errorf("resolveSubmodule(%q) = %q %q %q %v, want %q %q %q %v", tt.url, host, owner, repo, ok, tt.host, tt.owner, tt.repo, tt.ok)
+		}
+	}
+}
+
+func TestSubmoduleURLs(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	work := filepath.Join(t.TempDir(), "work")
+	bare := filepath.Join(t.TempDir(), "repo.git")
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	git("init", "-q", "-b", "main", work)
+	git("-C", work, "commit", "-q", "--allow-empty", "-m", "initial")
+	git("clone", "-q", "--bare", work, bare)
+	if _, err := submoduleURLs(context.Background(), bare); err == nil {
+		t.Fatalf("expected an error without .gitmodules")
+	}
+
+	gitmodules := filepath.Join(work, ".gitmodules")
+	git("config", "-f", gitmodules, "submodule.lib.path", "lib")
+	git("config", "-f", gitmodules, "submodule.lib.url", "../lib.git")
+	git("config", "-f", gitmodules, "submodule.vendor/tool.url", "https://github.com/other/tool")
+	git("-C", work, "add", ".gitmodules")
+	git("-C", work, "commit", "-q", "-m", "submodules")
+	git("-C", work, "push", "-q", bare, "main")
+
+	urls, err := submoduleURLs(context.Background(), bare)
+	if err != nil {
+		t.Fatalf("submoduleURLs: %v", err)
+	}
+	if !slices.Equal(urls, []string{"../lib.git", "https://github.com/other/tool"}) {
+		t.Fatalf("unexpected submodule urls: %v", urls)
+	}
+}
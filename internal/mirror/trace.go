@@ -0,0 +1,102 @@
+package mirror
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+)
+
+// tracingTransport records how long each phase of upstream requests takes
+// (DNS lookup, TCP connect, TLS handshake, time to first byte): by host in
+// metrics, unless nil, to tell slow name resolution or handshakes apart from
+// slow transfers, and in the Phases of the request they are sent for, if any.
+// Phases skipped thanks to a reused connection aren't recorded. Requests with
+// nothing to record into go out untraced.
+type tracingTransport struct {
+	base    http.RoundTripper
+	metrics *metrics.Metrics
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	phases := phasesFrom(req.Context())
+	if t.metrics == nil && phases == nil {
+		return t.base.RoundTrip(req)
+	}
+	host := req.URL.Hostname()
+	start := time.Now()
+	m := t.metrics
+	if m == nil {
+		m = &metrics.Metrics{} // No histograms to observe
+	}
+	observe := func(histogram *prometheus.HistogramVec, phase Phase, d time.Duration) {
+		if histogram != nil {
+			histogram.WithLabelValues(host).Observe(d.Seconds())
+		}
+		phases.Add(phase, d)
+	}
+
+	// Dials may run concurrently (e.g. IPv4 and IPv6) and outlive the request
+	var mu sync.Mutex
+	var dnsStart, tlsStart, wrote time.Time
+	connectStart := map[string]time.Time{}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			dnsStart = time.Now()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			if info.Err == nil && !dnsStart.IsZero() {
+				observe(m.UpstreamDNS, PhaseDNS, time.Since(dnsStart))
+			}
+		},
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			defer mu.Unlock()
+			connectStart[network+"/"+addr] = time.Now()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if began, ok := connectStart[network+"/"+addr]; ok && err == nil {
+				observe(m.UpstreamConnect, PhaseConnect, time.Since(began))
+			}
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil && !tlsStart.IsZero() {
+				observe(m.UpstreamTLS, PhaseTLS, time.Since(tlsStart))
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			wrote = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			if m.UpstreamTTFB != nil {
+				m.UpstreamTTFB.WithLabelValues(host).Observe(time.Since(start).Seconds())
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !wrote.IsZero() {
+				phases.Since(PhaseUpstreamNegotiation, wrote)
+			}
+		},
+	}
+	return t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
@@ -0,0 +1,57 @@
+package mirror
+
+import (
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestUpstreamTracing(t *testing.T) {
+	cert, caFile := newHostCert(t, "localhost")
+	t.Setenv("GIT_SSL_CAINFO", caFile)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.StartTLS()
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+
+	for _, tracing := range []bool{false, true} {
+		cfg := &config.Config{MirrorDir: t.TempDir(), SyncStaleAfter: time.Minute, UpstreamTracing: tracing}
+		m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+		if err != nil {
+			t.Fatalf("mirror init: %v", err)
+		}
+		resp, err := m.UpstreamClient().Get("https://localhost:" + srvURL.Port() + "/")
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		resp.Body.Close()
+
+		want := 0
+		if tracing {
+			want = 1
+		}
+		for name, h := range map[string]*prometheus.HistogramVec{
+			"dns":        m.metrics.UpstreamDNS,
+			"connect":    m.metrics.UpstreamConnect,
+			"tls":        m.metrics.UpstreamTLS,
+			"first byte": m.metrics.UpstreamTTFB,
+		} {
+			if n := testutil.CollectAndCount(h); n != want {
+				t.Fatalf("tracing=%v: expected %d %s series, got %d", tracing, want, name, n)
+			}
+		}
+	}
+}
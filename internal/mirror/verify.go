@@ -0,0 +1,125 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/gitcmd"
+)
+
+// StartVerifyLoop checks a random sample of mirrors against upstream every
+// interval until ctx is done, each mirror being picked with probability rate.
+// A non-positive rate disables it.
+func (m *Mirror) StartVerifyLoop(ctx context.Context, interval time.Duration, rate float64) {
+	if interval <= 0 || rate <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.verifySample(ctx, rate)
+			}
+		}
+	}()
+}
+
+// verifySample verifies each mirror with probability rate.
+func (m *Mirror) verifySample(ctx context.Context, rate float64) {
+	repos, err := m.listRepos()
+	if err != nil {
+		m.log.Warn("list mirrors to verify failed", "err", err)
+		return
+	}
+	for _, r := range repos {
+		if ctx.Err() != nil {
+			return
+		}
+		// Frozen mirrors are synced when next used anyway
+		if !r.frozenAt.IsZero() || rand.Float64() >= rate {
+			continue
+		}
+		result, err := m.verifyRepo(WithPriority(ctx, PriorityBatch), r.key, r.path)
+		if err != nil {
+			m.log.Warn("verify mirror failed", "repo", r.key, "err", err)
+		}
+		if result != "" {
+			m.metrics.VerifyTotal.WithLabelValues(result).Inc()
+		}
+	}
+}
+
+// verifyRepo compares the mirror's HEAD with upstream's and syncs the mirror
+// if they differ, like an admin refresh but without counting as an access
+// for eviction. It returns "match", "behind" (upstream moved on), "diverged"
+// (the old HEAD isn't in upstream's history anymore, e.g. after a force-push)
+// or "error", and "" for private mirrors, which can't be checked without a
+// client's credentials.
+func (m *Mirror) verifyRepo(ctx context.Context, key, repoPath string) (string, error) {
+	if m.requiresAuth(repoPath) {
+		return "", nil
+	}
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) != 3 {
+		return "", nil
+	}
+	upstreamURL, err := m.UpstreamURL(parts[0], parts[1], parts[2])
+	if err != nil {
+		return "error", err
+	}
+
+	local := readHead(ctx, repoPath)
+	remote, err := m.upstreamHead(ctx, upstreamURL)
+	if err != nil {
+		return "error", err
+	}
+	if remote == local.SHA {
+		return "match", nil
+	}
+
+	_, err, _ = m.do(ctx, "sync:"+key, func(ctx context.Context) (interface{}, error) {
+		return nil, m.syncRepo(ctx, key, repoPath, upstreamURL, "", "")
+	})
+	if err != nil {
+		return "error", err
+	}
+	m.markSynced(key)
+
+	if local.SHA != "" && !isAncestor(ctx, repoPath, local.SHA, "HEAD") {
+		m.log.Warn("mirror diverged from upstream, synced", "repo", key, "old_head", local.SHA, "upstream_head", remote)
+		return "diverged", nil
+	}
+	m.log.Info("mirror behind upstream, synced", "repo", key, "old_head", local.SHA, "upstream_head", remote)
+	return "behind", nil
+}
+
+// upstreamHead returns the commit upstream's HEAD points to, "" if it has none.
+func (m *Mirror) upstreamHead(ctx context.Context, upstreamURL string) (string, error) {
+	ctx, cancel := m.upstreamContext(ctx, opInfo)
+	defer cancel()
+	env, err := m.upstreamEnv(ctx, upstreamURL, "")
+	if err != nil {
+		return "", err
+	}
+	cmd := upstreamCommand(ctx, env, "ls-remote", upstreamURL, "HEAD")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git ls-remote failed: %w\noutput: %s", err, out)
+	}
+	sha, _, _ := strings.Cut(string(out), "\t")
+	return strings.TrimSpace(sha), nil
+}
+
+// isAncestor reports whether commit is reachable from rev in the repo at repoPath.
+func isAncestor(ctx context.Context, repoPath, commit, rev string) bool {
+	cmd := gitcmd.Command(ctx, "-C", repoPath, "merge-base", "--is-ancestor", commit, rev)
+	cmd.Env = gitEnv("", "")
+	return cmd.Run() == nil
+}
@@ -0,0 +1,103 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestVerifyRepo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	root := t.TempDir()
+	work := filepath.Join(t.TempDir(), "work")
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	commit := func(msg string) string {
+		git("-C", work, "commit", "-q", "--allow-empty", "-m", msg)
+		git("-C", work, "push", "-q", "-f", filepath.Join(root, "owner", "repo.git"), "main")
+		return git("-C", work, "rev-parse", "HEAD")
+	}
+	git("init", "-q", "--bare", "-b", "main", filepath.Join(root, "owner", "repo.git"))
+	git("init", "-q", "-b", "main", work)
+	commit("first")
+
+	// Upstream is reached through an ssh that runs the git command in root
+	bin := t.TempDir()
+	script := `#!/bin/sh
+for cmd; do :; done
+cd "` + root + `" && eval "$(printf '%s' "$cmd" | sed "s#'/#'#")"
+`
+	if err := os.WriteFile(filepath.Join(bin, "ssh"), []byte(script), 0o755); err != nil {
+		t.Fatalf("write ssh: %v", err)
+	}
+	t.Setenv("PATH", bin+string(filepath.ListSeparator)+os.Getenv("PATH"))
+
+	cfg := &config.Config{
+		MirrorDir:        t.TempDir(),
+		AllowedUpstreams: []string{"git.internal"},
+		UpstreamSchemes:  map[string]string{"git.internal": "ssh"},
+	}
+	m, err := New(cfg, metrics.NewUnregistered(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	t.Cleanup(m.Wait)
+	ctx := context.Background()
+	upstreamURL, err := m.UpstreamURL("git.internal", "owner", "repo")
+	if err != nil {
+		t.Fatalf("upstream url: %v", err)
+	}
+	repoPath, _, err := m.EnsureRepo(ctx, "git.internal", "owner", "repo", upstreamURL, "")
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	key := "git.internal/owner/repo"
+
+	if result, err := m.verifyRepo(ctx, key, repoPath); err != nil || result != "match" {
+		t.Fatalf("expected fresh mirror to match, got %q (%v)", result, err)
+	}
+
+	// Upstream moves on
+	head := commit("second")
+	if result, err := m.verifyRepo(ctx, key, repoPath); err != nil || result != "behind" {
+		t.Fatalf("expected mirror to be behind, got %q (%v)", result, err)
+	}
+	if got := git("-C", repoPath, "rev-parse", "HEAD"); got != head {
+		t.Fatalf("expected mirror to be synced to %s, got %s", head, got)
+	}
+
+	// Upstream rewrites history
+	git("-C", work, "reset", "-q", "--hard", "HEAD~1")
+	head = commit("rewritten")
+	m.verifySample(ctx, 1)
+	if got := testutil.ToFloat64(m.metrics.VerifyTotal.WithLabelValues("diverged")); got != 1 {
+		t.Fatalf("expected 1 diverged mirror, got %v", got)
+	}
+	if got := git("-C", repoPath, "rev-parse", "HEAD"); got != head {
+		t.Fatalf("expected mirror to be synced to %s, got %s", head, got)
+	}
+	m.verifySample(ctx, 1)
+	if got := testutil.ToFloat64(m.metrics.VerifyTotal.WithLabelValues("match")); got != 1 {
+		t.Fatalf("expected 1 matching mirror, got %v", got)
+	}
+}
@@ -0,0 +1,30 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+)
+
+// prewarmConcurrency bounds the clones prewarming mirrors running at once,
+// across all mirrors.
+const prewarmConcurrency = 4
+
+// Warm clones the mirror of host/owner/repo if it is missing, ahead of any
+// client asking for it. Prewarm clones run as batch fetches, and no more than
+// prewarmConcurrency at once; a missing mirror is only cloned once however
+// many callers warm it.
+func (m *Mirror) Warm(ctx context.Context, host, owner, repo, authHeader string) (Status, error) {
+	upstreamURL, err := m.UpstreamURL(host, owner, repo)
+	if err != nil {
+		return "", err
+	}
+	select {
+	case m.prewarmSem <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	defer func() { <-m.prewarmSem }()
+
+	key := fmt.Sprintf("%s/%s/%s", host, owner, repo)
+	return m.ensureCloned(WithPriority(ctx, PriorityBatch), key, m.RepoPath(host, owner, repo), upstreamURL, authHeader)
+}
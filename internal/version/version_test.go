@@ -0,0 +1,18 @@
+package version
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	orig := Version
+	t.Cleanup(func() { Version, Commit, Date = orig, "", "" })
+	Version, Commit, Date = "1.2.3", "abc123", "2024-01-02T03:04:05Z"
+
+	got := Get()
+	want := Info{Version: "1.2.3", Commit: "abc123", Date: "2024-01-02T03:04:05Z", GoVersion: runtime.Version()}
+	if got != want {
+		t.Fatalf("Get() = %+v, want %+v", got, want)
+	}
+}